@@ -0,0 +1,357 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package benchmark measures the performance of lazy pulling an image through
+// the fetch and cache path of the snapshotter (resolving blobs, reading TOCs,
+// prefetching and reading files) without FUSE and containerd. So the results are
+// reproducible enough to catch performance regressions of that path.
+package benchmark
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/stargz-snapshotter/cache"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/reader"
+	"github.com/containerd/stargz-snapshotter/fs/remote"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// Workload is a list of files read by a workload (e.g. recorded during the
+// startup of a container), in the order of accesses.
+type Workload struct {
+	Name  string   `json:"name"`
+	Files []string `json:"files"`
+}
+
+// LoadWorkload reads a workload from the file. The file is either a JSON
+// serialized Workload or a list of file paths separated by newlines.
+func LoadWorkload(path string) (Workload, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Workload{}, err
+	}
+	var w Workload
+	if err := json.Unmarshal(data, &w); err == nil {
+		if w.Name == "" {
+			w.Name = path
+		}
+		return w, nil
+	}
+	w = Workload{Name: path}
+	sc := bufio.NewScanner(strings.NewReader(string(data)))
+	for sc.Scan() {
+		if l := strings.TrimSpace(sc.Text()); l != "" && !strings.HasPrefix(l, "#") {
+			w.Files = append(w.Files, l)
+		}
+	}
+	return w, sc.Err()
+}
+
+// Result is the result of a run of a workload.
+type Result struct {
+	Image    string `json:"image"`
+	Workload string `json:"workload,omitempty"`
+	Layers   int    `json:"layers"`
+
+	// TimeToMount is the duration until all layers are resolved and their TOCs
+	// are read (and prefetched if enabled).
+	TimeToMount time.Duration `json:"time_to_mount_ns"`
+
+	// TimeToFirstRead is the duration until the first file of the workload is
+	// read.
+	TimeToFirstRead time.Duration `json:"time_to_first_read_ns,omitempty"`
+
+	// TimeToReady is the duration until all files of the workload are read.
+	TimeToReady time.Duration `json:"time_to_ready_ns"`
+
+	// FilesRead is the number of files of the workload found and read.
+	FilesRead int `json:"files_read"`
+
+	// FilesMissing is the number of files of the workload not found in the image.
+	FilesMissing int `json:"files_missing,omitempty"`
+
+	// BytesFetched is the number of bytes received from the registry.
+	BytesFetched int64 `json:"bytes_fetched"`
+
+	// ImageSize is the total size of the layer blobs.
+	ImageSize int64 `json:"image_size"`
+}
+
+// Option is an option of Run.
+type Option func(*options)
+
+type options struct {
+	noPrefetch   bool
+	prefetchSize int64
+	blobConfig   config.BlobConfig
+	platform     platforms.MatchComparer
+}
+
+// WithNoPrefetch disables prefetching the prioritized files on mount.
+func WithNoPrefetch() Option {
+	return func(o *options) {
+		o.noPrefetch = true
+	}
+}
+
+// WithPrefetchSize specifies the size prefetched from layers without the
+// prefetch landmark.
+func WithPrefetchSize(size int64) Option {
+	return func(o *options) {
+		o.prefetchSize = size
+	}
+}
+
+// WithBlobConfig specifies the config of fetching blobs.
+func WithBlobConfig(cfg config.BlobConfig) Option {
+	return func(o *options) {
+		o.blobConfig = cfg
+	}
+}
+
+// WithPlatform specifies the platform of the image run. The default is the
+// platform of the host.
+func WithPlatform(p platforms.MatchComparer) Option {
+	return func(o *options) {
+		o.platform = p
+	}
+}
+
+// Run lazily pulls the image and reads the files of the workload. Caches aren't
+// shared among runs so each run measures a cold pull.
+func Run(ctx context.Context, hosts docker.RegistryHosts, ref string, w Workload, opts ...Option) (*Result, error) {
+	o := options{platform: platforms.Default()}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid reference %q", ref)
+	}
+	var fetched int64
+	hosts = countingHosts(hosts, &fetched)
+
+	start := time.Now()
+	layers, err := resolveLayers(ctx, hosts, ref, o.platform)
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{Image: ref, Workload: w.Name, Layers: len(layers)}
+	resolver := remote.NewResolver(cache.NewMemoryCache(), o.blobConfig)
+	readers := make([]reader.Reader, len(layers))
+	for i, l := range layers {
+		blob, err := resolver.Resolve(ctx, hosts, refspec, l)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to resolve layer %v", l.Digest)
+		}
+		res.ImageSize += blob.Size()
+		vr, _, err := reader.NewReader(io.NewSectionReader(readerAtFunc(func(p []byte, off int64) (int, error) {
+			return blob.ReadAt(p, off)
+		}), 0, blob.Size()), cache.NewMemoryCache())
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read layer %v", l.Digest)
+		}
+		readers[i] = vr.SkipVerify()
+		if !o.noPrefetch {
+			if err := prefetch(blob, readers[i], o.prefetchSize); err != nil {
+				return nil, errors.Wrapf(err, "failed to prefetch layer %v", l.Digest)
+			}
+		}
+	}
+	res.TimeToMount = time.Since(start)
+
+	var buf []byte
+	for _, f := range w.Files {
+		name := strings.TrimPrefix(f, "/")
+		var (
+			found bool
+			e     *estargz.TOCEntry
+			r     reader.Reader
+		)
+		for i := len(readers) - 1; i >= 0; i-- { // upper layer first
+			if e, found = readers[i].Lookup(name); found {
+				r = readers[i]
+				break
+			}
+		}
+		if !found || e.Type != "reg" {
+			res.FilesMissing++
+			continue
+		}
+		ra, err := r.OpenFile(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to open %q", f)
+		}
+		if int64(cap(buf)) < e.Size {
+			buf = make([]byte, e.Size)
+		}
+		if _, err := ra.ReadAt(buf[:e.Size], 0); err != nil && err != io.EOF {
+			return nil, errors.Wrapf(err, "failed to read %q", f)
+		}
+		if res.FilesRead == 0 {
+			res.TimeToFirstRead = time.Since(start)
+		}
+		res.FilesRead++
+	}
+	res.TimeToReady = time.Since(start)
+	res.BytesFetched = atomic.LoadInt64(&fetched)
+	return res, nil
+}
+
+// prefetch prefetches the layer in the same manner as the snapshotter.
+func prefetch(blob remote.Blob, r reader.Reader, prefetchSize int64) error {
+	if _, ok := r.Lookup(estargz.NoPrefetchLandmark); ok {
+		return nil
+	} else if e, ok := r.Lookup(estargz.PrefetchLandmark); ok {
+		prefetchSize = e.Offset
+	}
+	if prefetchSize > blob.Size() {
+		prefetchSize = blob.Size()
+	}
+	if prefetchSize <= 0 {
+		return nil
+	}
+	if err := blob.Cache(0, prefetchSize); err != nil {
+		return err
+	}
+	return r.Cache(reader.WithFilter(func(e *estargz.TOCEntry) bool {
+		return e.Offset < prefetchSize
+	}))
+}
+
+// resolveLayers returns the layers of the image for the platform.
+func resolveLayers(ctx context.Context, hosts docker.RegistryHosts, ref string, platform platforms.MatchComparer) ([]ocispec.Descriptor, error) {
+	resolver := docker.NewResolver(docker.ResolverOptions{Hosts: hosts})
+	name, desc, err := resolver.Resolve(ctx, ref)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to resolve %q", ref)
+	}
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		rc, err := fetcher.Fetch(ctx, desc)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to fetch %v", desc.Digest)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		switch desc.MediaType {
+		case images.MediaTypeDockerSchema2ManifestList, ocispec.MediaTypeImageIndex:
+			var index ocispec.Index
+			if err := json.Unmarshal(data, &index); err != nil {
+				return nil, err
+			}
+			var found bool
+			for _, m := range index.Manifests {
+				if m.Platform == nil || platform.Match(*m.Platform) {
+					desc, found = m, true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("no manifest for the platform in %q", ref)
+			}
+		case images.MediaTypeDockerSchema2Manifest, ocispec.MediaTypeImageManifest:
+			var manifest ocispec.Manifest
+			if err := json.Unmarshal(data, &manifest); err != nil {
+				return nil, err
+			}
+			return manifest.Layers, nil
+		default:
+			return nil, fmt.Errorf("unsupported media type %q of %q", desc.MediaType, ref)
+		}
+	}
+}
+
+// countingHosts wraps the clients of the hosts to count the received bytes.
+func countingHosts(hosts docker.RegistryHosts, n *int64) docker.RegistryHosts {
+	return func(host string) ([]docker.RegistryHost, error) {
+		rhosts, err := hosts(host)
+		if err != nil {
+			return nil, err
+		}
+		for i, h := range rhosts {
+			var tr http.RoundTripper = http.DefaultTransport
+			if h.Client != nil && h.Client.Transport != nil {
+				tr = h.Client.Transport
+			}
+			c := &http.Client{Transport: &countingTransport{tr, n}}
+			if h.Client != nil {
+				cc := *h.Client
+				cc.Transport = c.Transport
+				c = &cc
+			}
+			rhosts[i].Client = c
+		}
+		return rhosts, nil
+	}
+}
+
+type countingTransport struct {
+	http.RoundTripper
+	n *int64
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err == nil && resp.Body != nil {
+		resp.Body = &countingReadCloser{resp.Body, t.n}
+	}
+	return resp, err
+}
+
+type countingReadCloser struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (r *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
+
+type readerAtFunc func([]byte, int64) (int, error)
+
+func (f readerAtFunc) ReadAt(p []byte, offset int64) (int, error) { return f(p, offset) }
+
+// WriteJSON writes the results as JSON.
+func WriteJSON(w io.Writer, results []*Result) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(results)
+}
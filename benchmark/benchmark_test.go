@@ -0,0 +1,290 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package benchmark
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestRun(t *testing.T) {
+	files := map[string]string{
+		"bin/sh":        strings.Repeat("sh", 10000),
+		"etc/hosts":     "127.0.0.1 localhost\n",
+		"lib/libc.so":   strings.Repeat("c", 50000),
+		"usr/share/doc": strings.Repeat("d", 100000),
+	}
+	layer := buildLayer(t, files, []string{"bin/sh", "lib/libc.so"})
+	layerDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(layer),
+		Size:      int64(len(layer)),
+	}
+	config := []byte("{}")
+	manifest, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config: ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageConfig,
+			Digest:    digest.FromBytes(config),
+			Size:      int64(len(config)),
+		},
+		Layers: []ocispec.Descriptor{layerDesc},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal manifest: %v", err)
+	}
+	srv := httptest.NewServer(&testRegistry{
+		manifest: manifest,
+		blobs: map[digest.Digest][]byte{
+			layerDesc.Digest:         layer,
+			digest.FromBytes(config): config,
+		},
+	})
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	hosts := docker.ConfigureDefaultRegistries(docker.WithPlainHTTP(docker.MatchAllHosts))
+
+	w := Workload{Name: "test", Files: []string{"/bin/sh", "/lib/libc.so", "/etc/hosts", "/not/exist"}}
+	for _, tt := range []struct {
+		name string
+		opts []Option
+	}{
+		{name: "prefetch"},
+		{name: "no prefetch", opts: []Option{WithNoPrefetch()}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := Run(context.Background(), hosts, host+"/test/image:latest", w, tt.opts...)
+			if err != nil {
+				t.Fatalf("failed to run: %v", err)
+			}
+			if res.Layers != 1 || res.ImageSize != layerDesc.Size {
+				t.Errorf("layers = %d, image size = %d; want 1, %d", res.Layers, res.ImageSize, layerDesc.Size)
+			}
+			if res.FilesRead != 3 || res.FilesMissing != 1 {
+				t.Errorf("files read = %d, missing = %d; want 3, 1", res.FilesRead, res.FilesMissing)
+			}
+			if res.BytesFetched <= 0 {
+				t.Errorf("bytes fetched must be counted")
+			}
+			if res.TimeToFirstRead <= 0 || res.TimeToFirstRead > res.TimeToReady || res.TimeToMount > res.TimeToReady {
+				t.Errorf("invalid durations: mount=%v, first read=%v, ready=%v",
+					res.TimeToMount, res.TimeToFirstRead, res.TimeToReady)
+			}
+		})
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	files := map[string]string{
+		"bin/sh":        strings.Repeat("sh", 10000),
+		"etc/hosts":     "127.0.0.1 localhost\n",
+		"usr/share/doc": strings.Repeat("d", 100000),
+	}
+	layer, tocDigest := buildLayerWithTOCDigest(t, files, []string{"bin/sh"})
+	layerDesc := ocispec.Descriptor{
+		MediaType:   ocispec.MediaTypeImageLayerGzip,
+		Digest:      digest.FromBytes(layer),
+		Size:        int64(len(layer)),
+		Annotations: map[string]string{estargz.TOCJSONDigestAnnotation: tocDigest.String()},
+	}
+	plain := []byte("not estargz")
+	plainDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(plain),
+		Size:      int64(len(plain)),
+	}
+	config := []byte("{}")
+	newRegistry := func(layers ...ocispec.Descriptor) *httptest.Server {
+		manifest, err := json.Marshal(ocispec.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			Config: ocispec.Descriptor{
+				MediaType: ocispec.MediaTypeImageConfig,
+				Digest:    digest.FromBytes(config),
+				Size:      int64(len(config)),
+			},
+			Layers: layers,
+		})
+		if err != nil {
+			t.Fatalf("failed to marshal manifest: %v", err)
+		}
+		return httptest.NewServer(&testRegistry{
+			manifest: manifest,
+			blobs: map[digest.Digest][]byte{
+				layerDesc.Digest:         layer,
+				plainDesc.Digest:         plain,
+				digest.FromBytes(config): config,
+			},
+		})
+	}
+	hosts := docker.ConfigureDefaultRegistries(docker.WithPlainHTTP(docker.MatchAllHosts))
+
+	srv := newRegistry(plainDesc, layerDesc)
+	defer srv.Close()
+	ref := strings.TrimPrefix(srv.URL, "http://") + "/test/image:latest"
+	res, err := SelfTest(context.Background(), hosts, ref, WithChunks(2), WithVerifyBlobs())
+	if err != nil {
+		t.Fatalf("failed to self-test: %v", err)
+	}
+	if len(res.Layers) != 2 || res.Layers[0].Skipped == "" || res.Layers[1].Skipped != "" {
+		t.Fatalf("unexpected layers %+v", res.Layers)
+	}
+	if l := res.Layers[1]; l.PrefetchSize <= 0 || l.ChunksRead != 2 || l.Phases.Verify <= 0 {
+		t.Errorf("unexpected result of layer %+v", l)
+	}
+	if res.ChunksRead != 2 || res.BytesFetched < layerDesc.Size {
+		t.Errorf("chunks read = %d, bytes fetched = %d; want 2, >= %d", res.ChunksRead, res.BytesFetched, layerDesc.Size)
+	}
+
+	// The TOC must be verified.
+	broken := layerDesc
+	broken.Annotations = map[string]string{estargz.TOCJSONDigestAnnotation: digest.FromString("broken").String()}
+	srv2 := newRegistry(broken)
+	defer srv2.Close()
+	if _, err := SelfTest(context.Background(), hosts, strings.TrimPrefix(srv2.URL, "http://")+"/test/image:latest"); err == nil {
+		t.Errorf("self-test must fail with the wrong TOC digest")
+	}
+
+	// Images without eStargz layers can't be lazily pulled.
+	srv3 := newRegistry(plainDesc)
+	defer srv3.Close()
+	if _, err := SelfTest(context.Background(), hosts, strings.TrimPrefix(srv3.URL, "http://")+"/test/image:latest"); err == nil {
+		t.Errorf("self-test must fail without eStargz layers")
+	}
+}
+
+func TestLoadWorkload(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testworkload")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	want := []string{"/bin/sh", "/etc/hosts"}
+	for name, data := range map[string]string{
+		"json": `{"name":"json","files":["/bin/sh","/etc/hosts"]}`,
+		"list": "# recorded\n/bin/sh\n\n/etc/hosts\n",
+	} {
+		p := filepath.Join(tmp, name)
+		if err := ioutil.WriteFile(p, []byte(data), 0600); err != nil {
+			t.Fatalf("failed to write workload: %v", err)
+		}
+		w, err := LoadWorkload(p)
+		if err != nil {
+			t.Fatalf("failed to load workload %q: %v", name, err)
+		}
+		if !reflect.DeepEqual(w.Files, want) {
+			t.Errorf("files of %q = %v; want %v", name, w.Files, want)
+		}
+		if w.Name == "" {
+			t.Errorf("name of %q must be set", name)
+		}
+	}
+}
+
+func buildLayer(t *testing.T, files map[string]string, prioritized []string) []byte {
+	data, _ := buildLayerWithTOCDigest(t, files, prioritized)
+	return data
+}
+
+func buildLayerWithTOCDigest(t *testing.T, files map[string]string, prioritized []string) ([]byte, digest.Digest) {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	dirs := make(map[string]bool)
+	for name, contents := range files {
+		if d := path.Dir(name); !dirs[d] {
+			dirs[d] = true
+			if err := tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     d + "/",
+				Mode:     0755,
+			}); err != nil {
+				t.Fatalf("failed to write tar header: %v", err)
+			}
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(contents)),
+		}); err != nil {
+			t.Fatalf("failed to write tar header: %v", err)
+		}
+		if _, err := tw.Write([]byte(contents)); err != nil {
+			t.Fatalf("failed to write tar contents: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close tar: %v", err)
+	}
+	rc, err := estargz.Build(io.NewSectionReader(bytes.NewReader(buf.Bytes()), 0, int64(buf.Len())),
+		estargz.WithPrioritizedFiles(prioritized))
+	if err != nil {
+		t.Fatalf("failed to build eStargz: %v", err)
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("failed to read eStargz: %v", err)
+	}
+	return data, rc.TOCDigest()
+}
+
+// testRegistry serves a single manifest tagged as "latest" and blobs.
+type testRegistry struct {
+	manifest []byte
+	blobs    map[digest.Digest][]byte
+}
+
+func (r *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch p := req.URL.Path; {
+	case p == "/v2/":
+		w.WriteHeader(http.StatusOK)
+	case strings.HasPrefix(p, "/v2/test/image/manifests/"):
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(r.manifest).String())
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(r.manifest))
+	case strings.HasPrefix(p, "/v2/test/image/blobs/"):
+		blob, ok := r.blobs[digest.Digest(strings.TrimPrefix(p, "/v2/test/image/blobs/"))]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(blob))
+	default:
+		http.NotFound(w, req)
+	}
+}
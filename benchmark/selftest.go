@@ -0,0 +1,330 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package benchmark
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/stargz-snapshotter/cache"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/reader"
+	"github.com/containerd/stargz-snapshotter/fs/remote"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// SelfTestResult is the result of a self-test. Durations are the total of all
+// layers for each phase.
+type SelfTestResult struct {
+	Image  string            `json:"image"`
+	Layers []SelfTestLayer   `json:"layers"`
+	Phases SelfTestDurations `json:"phases"`
+
+	// ChunksRead is the number of randomly chosen chunks read and verified.
+	ChunksRead int `json:"chunks_read"`
+
+	// BytesFetched is the number of bytes received from the registry.
+	BytesFetched int64 `json:"bytes_fetched"`
+}
+
+// SelfTestLayer is the result of a layer of a self-test.
+type SelfTestLayer struct {
+	Digest       string            `json:"digest"`
+	Size         int64             `json:"size"`
+	PrefetchSize int64             `json:"prefetch_size"`
+	ChunksRead   int               `json:"chunks_read"`
+	Phases       SelfTestDurations `json:"phases"`
+
+	// Skipped is the reason why the layer isn't tested (e.g. it isn't
+	// eStargz). Such layers are pulled by containerd as usual.
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// SelfTestDurations are the durations of the phases of a self-test.
+type SelfTestDurations struct {
+	// Resolve is the duration of resolving the manifest and the blobs.
+	Resolve time.Duration `json:"resolve_ns"`
+
+	// TOC is the duration of fetching the TOCs and verifying their digests.
+	TOC time.Duration `json:"toc_ns"`
+
+	// Prefetch is the duration of prefetching the range until the prefetch
+	// landmark.
+	Prefetch time.Duration `json:"prefetch_ns"`
+
+	// Read is the duration of reading random chunks and verifying their digests.
+	Read time.Duration `json:"read_ns"`
+
+	// Verify is the duration of fetching the whole blobs and verifying their
+	// digests. This is zero unless WithVerifyBlobs is specified.
+	Verify time.Duration `json:"verify_ns,omitempty"`
+}
+
+func (d *SelfTestDurations) add(o SelfTestDurations) {
+	d.Resolve += o.Resolve
+	d.TOC += o.TOC
+	d.Prefetch += o.Prefetch
+	d.Read += o.Read
+	d.Verify += o.Verify
+}
+
+// SelfTestOption is an option of SelfTest.
+type SelfTestOption func(*selfTestOptions)
+
+type selfTestOptions struct {
+	chunks      int
+	verifyBlobs bool
+	blobConfig  config.BlobConfig
+	platform    platforms.MatchComparer
+	rand        *rand.Rand
+}
+
+// WithChunks specifies the number of chunks randomly read from each layer. The
+// default is 16.
+func WithChunks(n int) SelfTestOption {
+	return func(o *selfTestOptions) {
+		o.chunks = n
+	}
+}
+
+// WithVerifyBlobs fetches the whole blobs of layers and verifies their
+// digests in addition.
+func WithVerifyBlobs() SelfTestOption {
+	return func(o *selfTestOptions) {
+		o.verifyBlobs = true
+	}
+}
+
+// WithSelfTestBlobConfig specifies the config of fetching blobs.
+func WithSelfTestBlobConfig(cfg config.BlobConfig) SelfTestOption {
+	return func(o *selfTestOptions) {
+		o.blobConfig = cfg
+	}
+}
+
+// WithSelfTestPlatform specifies the platform of the image tested. The default
+// is the platform of the host.
+func WithSelfTestPlatform(p platforms.MatchComparer) SelfTestOption {
+	return func(o *selfTestOptions) {
+		o.platform = p
+	}
+}
+
+// SelfTest lazily pulls the image end-to-end in the same manner as the
+// snapshotter: it resolves the image and its eStargz layers, fetches and
+// verifies the TOCs, prefetches the ranges until the prefetch landmarks and
+// reads random chunks verifying their digests. Any failure is returned as an
+// error so this can be used for validating that a node can lazily pull images
+// from the registry. Caches are kept in memory and discarded.
+func SelfTest(ctx context.Context, hosts docker.RegistryHosts, ref string, opts ...SelfTestOption) (*SelfTestResult, error) {
+	o := selfTestOptions{
+		chunks:   16,
+		platform: platforms.Default(),
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid reference %q", ref)
+	}
+	var fetched int64
+	hosts = countingHosts(hosts, &fetched)
+
+	start := time.Now()
+	layers, err := resolveLayers(ctx, hosts, ref, o.platform)
+	if err != nil {
+		return nil, err
+	}
+	res := &SelfTestResult{Image: ref}
+	res.Phases.Resolve = time.Since(start)
+	resolver := remote.NewResolver(cache.NewMemoryCache(), o.blobConfig)
+	var tested int
+	for _, l := range layers {
+		lres, err := selfTestLayer(ctx, resolver, hosts, refspec, l, o)
+		if err != nil {
+			return nil, errors.Wrapf(err, "layer %v", l.Digest)
+		}
+		res.Layers = append(res.Layers, lres)
+		res.Phases.add(lres.Phases)
+		res.ChunksRead += lres.ChunksRead
+		if lres.Skipped == "" {
+			tested++
+		}
+	}
+	res.BytesFetched = atomic.LoadInt64(&fetched)
+	if tested == 0 {
+		return res, fmt.Errorf("no eStargz layer in %q", ref)
+	}
+	return res, nil
+}
+
+func selfTestLayer(ctx context.Context, resolver *remote.Resolver, hosts docker.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor, o selfTestOptions) (res SelfTestLayer, _ error) {
+	res = SelfTestLayer{Digest: desc.Digest.String(), Size: desc.Size}
+	tocDigestStr, ok := desc.Annotations[estargz.TOCJSONDigestAnnotation]
+	if !ok {
+		res.Skipped = "no TOC digest annotation"
+		return res, nil
+	}
+	tocDigest, err := digest.Parse(tocDigestStr)
+	if err != nil {
+		return res, errors.Wrapf(err, "invalid TOC digest %q", tocDigestStr)
+	}
+
+	start := time.Now()
+	blob, err := resolver.Resolve(ctx, hosts, refspec, desc)
+	if err != nil {
+		return res, errors.Wrap(err, "failed to resolve")
+	}
+	res.Phases.Resolve = time.Since(start)
+
+	start = time.Now()
+	vr, _, err := reader.NewReader(io.NewSectionReader(readerAtFunc(func(p []byte, off int64) (int, error) {
+		return blob.ReadAt(p, off)
+	}), 0, blob.Size()), cache.NewMemoryCache())
+	if err != nil {
+		return res, errors.Wrap(err, "failed to read TOC")
+	}
+	r, err := vr.VerifyTOC(tocDigest)
+	if err != nil {
+		return res, errors.Wrap(err, "failed to verify TOC")
+	}
+	res.Phases.TOC = time.Since(start)
+
+	start = time.Now()
+	if e, ok := r.Lookup(estargz.PrefetchLandmark); ok {
+		res.PrefetchSize = e.Offset
+		if err := prefetch(blob, r, 0); err != nil {
+			return res, errors.Wrap(err, "failed to prefetch")
+		}
+	}
+	res.Phases.Prefetch = time.Since(start)
+
+	start = time.Now()
+	n, err := readRandomChunks(vr, r, res.PrefetchSize, o.chunks, o.rand)
+	if err != nil {
+		return res, err
+	}
+	res.ChunksRead = n
+	res.Phases.Read = time.Since(start)
+
+	if o.verifyBlobs {
+		start = time.Now()
+		if err := verifyBlob(ctx, blob, desc.Digest); err != nil {
+			return res, err
+		}
+		res.Phases.Verify = time.Since(start)
+	}
+	return res, nil
+}
+
+// readRandomChunks reads n chunks randomly chosen from the layer. Chunks out of
+// the prefetched range are preferred so that they are fetched from the
+// registry. The reader verifies the digest of each chunk.
+func readRandomChunks(vr *reader.VerifiableReader, r reader.Reader, prefetchSize int64, n int, rnd *rand.Rand) (int, error) {
+	var all, cold []*estargz.TOCEntry
+	if err := vr.ForeachChunkEntry(func(_ string, ce *estargz.TOCEntry) {
+		all = append(all, ce)
+		if ce.Offset >= prefetchSize {
+			cold = append(cold, ce)
+		}
+	}); err != nil {
+		return 0, errors.Wrap(err, "failed to walk chunks")
+	}
+	candidates := cold
+	if len(candidates) < n {
+		candidates = all
+	}
+	rnd.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+	for _, ce := range candidates {
+		ra, err := r.OpenFile(ce.Name)
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to open %q", ce.Name)
+		}
+		buf := make([]byte, ce.ChunkSize)
+		if _, err := ra.ReadAt(buf, ce.ChunkOffset); err != nil && err != io.EOF {
+			return 0, errors.Wrapf(err, "failed to read chunk %q at %d", ce.Name, ce.ChunkOffset)
+		}
+	}
+	return len(candidates), nil
+}
+
+// verifyBlob fetches the whole blob and verifies its digest. The blob is
+// streamed without being stored in the cache if possible.
+func verifyBlob(ctx context.Context, blob remote.Blob, dgst digest.Digest) error {
+	var r io.Reader
+	if s, ok := blob.(remote.Streamer); ok {
+		rc, err := s.Stream(ctx, 0, blob.Size())
+		if err != nil {
+			return errors.Wrap(err, "failed to fetch blob")
+		}
+		defer rc.Close()
+		r = rc
+	} else {
+		r = io.NewSectionReader(readerAtFunc(func(p []byte, off int64) (int, error) {
+			return blob.ReadAt(p, off)
+		}), 0, blob.Size())
+	}
+	verifier := dgst.Verifier()
+	if _, err := io.Copy(verifier, r); err != nil {
+		return errors.Wrap(err, "failed to fetch blob")
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("digest of blob mismatch; want %v", dgst)
+	}
+	return nil
+}
+
+// WriteSelfTestResult writes the timing breakdown of the self-test.
+func WriteSelfTestResult(w io.Writer, res *SelfTestResult) error {
+	fmt.Fprintf(w, "image: %s\n", res.Image)
+	for _, l := range res.Layers {
+		if l.Skipped != "" {
+			fmt.Fprintf(w, "  %s: skipped (%s)\n", l.Digest, l.Skipped)
+			continue
+		}
+		fmt.Fprintf(w, "  %s: size=%d prefetch=%d chunks=%d %s\n",
+			l.Digest, l.Size, l.PrefetchSize, l.ChunksRead, formatDurations(l.Phases))
+	}
+	_, err := fmt.Fprintf(w, "total: chunks=%d fetched=%d %s\n",
+		res.ChunksRead, res.BytesFetched, formatDurations(res.Phases))
+	return err
+}
+
+func formatDurations(d SelfTestDurations) string {
+	s := fmt.Sprintf("resolve=%v toc=%v prefetch=%v read=%v", d.Resolve, d.TOC, d.Prefetch, d.Read)
+	if d.Verify > 0 {
+		s += fmt.Sprintf(" verify=%v", d.Verify)
+	}
+	return s
+}
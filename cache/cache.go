@@ -20,10 +20,15 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/containerd/stargz-snapshotter/util/fdbudget"
 	"github.com/golang/groupcache/lru"
 	"github.com/pkg/errors"
 )
@@ -37,6 +42,37 @@ type DirectoryCacheConfig struct {
 	MaxLRUCacheEntry int
 	MaxCacheFds      int
 	SyncAdd          bool
+
+	// HighWatermarkPercent is the disk usage (in percent) of the filesystem
+	// where the cache directory is located, which triggers eviction of caches.
+	// Zero disables watermark-based eviction.
+	HighWatermarkPercent int
+
+	// LowWatermarkPercent is the disk usage (in percent) where the eviction
+	// stops. Zero means the same value as HighWatermarkPercent.
+	LowWatermarkPercent int
+
+	// WatermarkCheckInterval is the interval to check the disk usage.
+	WatermarkCheckInterval time.Duration
+
+	// Compress makes the cache store contents on the disk compressed with zstd.
+	// This can be overridden per Add operation by Compression option.
+	Compress bool
+
+	// DecompressedCacheMaxBytes is the size limit of the memory cache holding
+	// decompressed contents of frequently read cache files stored compressed.
+	// Zero disables the cache.
+	DecompressedCacheMaxBytes int64
+
+	// IOUring makes the cache read and write the cache files with io_uring.
+	// This requires the cache built with "iouring" tag and Linux 5.6 or later.
+	// Otherwise, the standard I/O is used.
+	IOUring bool
+
+	// FDBudget accounts file handles of cache files kept open by the cache.
+	// When the budget exceeds its soft cap, the least recently used handles
+	// are closed.
+	FDBudget *fdbudget.Budget
 }
 
 // TODO: contents validation.
@@ -46,8 +82,57 @@ type BlobCache interface {
 	FetchAt(key string, offset int64, p []byte, opts ...Option) (n int, err error)
 }
 
+// MemoryReclaimer is implemented by caches which hold contents in the memory.
+type MemoryReclaimer interface {
+
+	// MemoryUsage returns the size of the contents held in the memory.
+	MemoryUsage() int64
+
+	// ReclaimMemory drops contents from the memory until the specified size is
+	// dropped or nothing remains. This returns the dropped size.
+	ReclaimMemory(size int64) int64
+}
+
+// FileOpener is implemented by caches which store contents in plain files on
+// the disk. The files can be read without copying the contents through the
+// user space (e.g. splice(2)).
+type FileOpener interface {
+
+	// OpenFile opens the file holding the whole contents of the key. The caller
+	// must close the file. This fails if the contents aren't stored in a plain
+	// file (e.g. compressed or still being written).
+	OpenFile(key string) (*os.File, error)
+}
+
+// Remover is implemented by caches which support removing contents.
+type Remover interface {
+	Remove(key string) error
+}
+
+// Sizer is implemented by caches which can report the size of stored contents.
+type Sizer interface {
+
+	// StoredSize returns the size the contents of the key occupy in the cache
+	// storage (e.g. the compressed size on the disk). This fails if the key
+	// isn't stored.
+	StoredSize(key string) (int64, error)
+}
+
+// Pinner is implemented by caches whose contents can be protected from the
+// eviction (e.g. by the disk usage watermark). Pins are counted per key so the
+// contents of a key become evictable after unpinned as many times as pinned.
+// Keys not stored yet can be pinned as well.
+type Pinner interface {
+	Pin(key string)
+	Unpin(key string)
+}
+
 type cacheOpt struct {
-	direct bool
+	direct   bool
+	compress *bool
+	hot      bool
+	willNeed bool
+	owner    string
 }
 
 type Option func(o *cacheOpt) *cacheOpt
@@ -63,6 +148,42 @@ func Direct() Option {
 	}
 }
 
+// When Compression option is specified for Add method, the contents are stored
+// on the disk compressed (or uncompressed) regardless of the default setting of
+// the cache. Caches that don't support compression ignore this option.
+func Compression(enable bool) Option {
+	return func(o *cacheOpt) *cacheOpt {
+		o.compress = &enable
+		return o
+	}
+}
+
+// When WillNeed option is specified for FetchAt and Add methods, the kernel is
+// advised (posix_fadvise(POSIX_FADV_WILLNEED)) to read the cache file into the
+// page cache so that following reads of the contents don't hit the disk. This
+// trades the memory for the latency. Caches that aren't backed by files ignore
+// this option.
+func WillNeed() Option {
+	return func(o *cacheOpt) *cacheOpt {
+		o.willNeed = true
+		return o
+	}
+}
+
+// When Owner option is specified for FetchAt method, file handles kept open for
+// the read are accounted to the owner (e.g. a layer) in the FD budget of the
+// cache.
+func Owner(owner string) Option {
+	return func(o *cacheOpt) *cacheOpt {
+		o.owner = owner
+		return o
+	}
+}
+
+// adviseWillNeed advises the kernel to read the whole file into the page cache.
+// This is best-effort so the error can be ignored.
+var adviseWillNeed = fadviseWillNeed
+
 func NewDirectoryCache(directory string, config DirectoryCacheConfig) (BlobCache, error) {
 	maxEntry := config.MaxLRUCacheEntry
 	if maxEntry == 0 {
@@ -75,11 +196,17 @@ func NewDirectoryCache(directory string, config DirectoryCacheConfig) (BlobCache
 	if err := os.MkdirAll(directory, os.ModePerm); err != nil {
 		return nil, err
 	}
+	if err := repairDirectory(directory); err != nil {
+		return nil, errors.Wrapf(err, "failed to repair cache directory %q", directory)
+	}
 	dc := &directoryCache{
 		cache:     newObjectCache(maxEntry),
 		fileCache: newObjectCache(maxFds),
 		wipLock:   &namedLock{},
 		directory: directory,
+		io:        newFileIO(config.IOUring),
+		fdBudget:  config.FDBudget,
+		done:      make(chan struct{}),
 		bufPool: sync.Pool{
 			New: func() interface{} {
 				return new(bytes.Buffer)
@@ -87,12 +214,31 @@ func NewDirectoryCache(directory string, config DirectoryCacheConfig) (BlobCache
 		},
 	}
 	dc.cache.finalize = func(value interface{}) {
+		atomic.AddInt64(&dc.memBytes, -int64(value.(*bytes.Buffer).Len()))
 		dc.bufPool.Put(value)
 	}
 	dc.fileCache.finalize = func(value interface{}) {
-		value.(*os.File).Close()
+		f := value.(*cachedFile)
+		f.Close()
+		dc.fdBudget.Release(f.owner, 1)
 	}
+	dc.fdBudget.AddReclaimer(dc.fileCache.evictOldest)
 	dc.syncAdd = config.SyncAdd
+	dc.compress = config.Compress
+	if config.DecompressedCacheMaxBytes > 0 {
+		dc.decompressed = newDecompressedCache(config.DecompressedCacheMaxBytes)
+	}
+	if config.HighWatermarkPercent > 0 {
+		we, err := newWatermarkEvictor(dc, config.HighWatermarkPercent, config.LowWatermarkPercent)
+		if err != nil {
+			return nil, err
+		}
+		interval := config.WatermarkCheckInterval
+		if interval == 0 {
+			interval = defaultWatermarkCheckInterval
+		}
+		go we.run(interval, dc.done)
+	}
 	return dc, nil
 }
 
@@ -102,10 +248,32 @@ type directoryCache struct {
 	fileCache *objectCache
 	directory string
 	wipLock   *namedLock
+	io        fileIO
+	fdBudget  *fdbudget.Budget
+	memBytes  int64 // size of contents in cache; accessed atomically
 
 	bufPool sync.Pool
 
-	syncAdd bool
+	syncAdd  bool
+	compress bool
+
+	// decompressed holds decompressed contents of hot compressed cache files.
+	// nil if disabled.
+	decompressed *decompressedCache
+
+	pinned   map[string]int // key -> pin count
+	pinnedMu sync.Mutex
+
+	// done is closed on Close to stop background goroutines.
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Close stops background goroutines of this cache (e.g. the disk usage
+// watermark checker). Contents stored on the disk are kept.
+func (dc *directoryCache) Close() error {
+	dc.closeOnce.Do(func() { close(dc.done) })
+	return nil
 }
 
 func (dc *directoryCache) FetchAt(key string, offset int64, p []byte, opts ...Option) (n int, err error) {
@@ -129,7 +297,10 @@ func (dc *directoryCache) FetchAt(key string, offset int64, p []byte, opts ...Op
 		// Get data from disk. If the file is already opened, use it.
 		if f, done, ok := dc.fileCache.get(key); ok {
 			defer done()
-			return f.(*os.File).ReadAt(p, offset)
+			if opt.willNeed {
+				adviseWillNeed(f.(*cachedFile).File)
+			}
+			return dc.io.ReadAt(f.(*cachedFile).File, p, offset)
 		}
 	}
 
@@ -137,19 +308,22 @@ func (dc *directoryCache) FetchAt(key string, offset int64, p []byte, opts ...Op
 	// TODO: If the target cache is write-in-progress, should we wait for the completion
 	//       or simply report the cache miss?
 	file, err := os.Open(dc.cachePath(key))
-	if err != nil {
+	if os.IsNotExist(err) {
+		return dc.fetchCompressedAt(key, offset, p, opt)
+	} else if err != nil {
 		return 0, errors.Wrapf(err, "failed to open blob file for %q", key)
 	}
-	if n, err = file.ReadAt(p, offset); err == io.EOF {
+	if opt.willNeed {
+		adviseWillNeed(file)
+	}
+	if n, err = dc.io.ReadAt(file, p, offset); err == io.EOF {
 		err = nil
 	}
 
 	// Cache the opened file for future use. If "direct" option is specified, this
 	// won't be done. This option is useful for preventing file cache from being
 	// polluted by data that won't be accessed immediately.
-	if opt.direct || !dc.fileCache.add(key, file) {
-		file.Close()
-	}
+	dc.keepOpen(key, file, opt)
 
 	// TODO: should we cache the entire file data on memory?
 	//       but making I/O (possibly huge) on every fetching
@@ -158,6 +332,67 @@ func (dc *directoryCache) FetchAt(key string, offset int64, p []byte, opts ...Op
 	return n, err
 }
 
+// fetchCompressedAt reads the compressed cache file. The decompressed contents
+// are kept in the memory cache because compressed files can't be read partially.
+func (dc *directoryCache) fetchCompressedAt(key string, offset int64, p []byte, opt *cacheOpt) (int, error) {
+	data, hit, err := dc.readCompressed(key, !opt.direct)
+	if err != nil {
+		return 0, err
+	}
+	if int64(len(data)) < offset {
+		return 0, fmt.Errorf("invalid offset %d exceeds chunk size %d",
+			offset, len(data))
+	}
+	n := copy(p, data[offset:])
+	if !opt.direct && !hit {
+		// Contents in the decompressed cache aren't duplicated in the memory cache.
+		b := dc.bufPool.Get().(*bytes.Buffer)
+		b.Reset()
+		b.Write(data)
+		if !dc.addToMemory(key, b) {
+			dc.bufPool.Put(b) // Already exists. No need to cache.
+		}
+	}
+	return n, nil
+}
+
+// readCompressed returns the decompressed contents of the compressed cache
+// file. hit is true if the contents are served by the decompressed cache. If
+// admit is true, the contents can be kept in the decompressed cache. The caller
+// must not modify the returned slice.
+func (dc *directoryCache) readCompressed(key string, admit bool) (data []byte, hit bool, err error) {
+	if data, ok := dc.decompressed.get(key); ok {
+		return data, true, nil
+	}
+	compressed, err := ioutil.ReadFile(dc.compressedPath(key))
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "failed to open blob file for %q", key)
+	}
+	data, err = decompress(compressed)
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "failed to decompress blob file for %q", key)
+	}
+	if admit {
+		dc.decompressed.add(key, data)
+	}
+	return data, false, nil
+}
+
+// readAll returns the whole contents of the cache.
+func (dc *directoryCache) readAll(key string) ([]byte, error) {
+	if b, done, ok := dc.cache.get(key); ok {
+		defer done()
+		return append([]byte{}, b.(*bytes.Buffer).Bytes()...), nil
+	}
+	data, err := ioutil.ReadFile(dc.cachePath(key))
+	if os.IsNotExist(err) {
+		if data, _, err = dc.readCompressed(key, false); err == nil {
+			return append([]byte{}, data...), nil
+		}
+	}
+	return data, err
+}
+
 func (dc *directoryCache) Add(key string, p []byte, opts ...Option) {
 	opt := &cacheOpt{}
 	for _, o := range opts {
@@ -172,11 +407,16 @@ func (dc *directoryCache) Add(key string, p []byte, opts ...Option) {
 		b := dc.bufPool.Get().(*bytes.Buffer)
 		b.Reset()
 		b.Write(p)
-		if !dc.cache.add(key, b) {
+		if !dc.addToMemory(key, b) {
 			dc.bufPool.Put(b) // Already exists. No need to cache.
 		}
 	}
 
+	compressed := dc.compress
+	if opt.compress != nil {
+		compressed = *opt.compress
+	}
+
 	// Cache the passed data to disk.
 	b2 := dc.bufPool.Get().(*bytes.Buffer)
 	b2.Reset()
@@ -188,13 +428,23 @@ func (dc *directoryCache) Add(key string, p []byte, opts ...Option) {
 			c   = dc.cachePath(key)
 			wip = dc.wipPath(key)
 		)
+		if compressed {
+			c = dc.compressedPath(key)
+		}
 
 		dc.wipLock.lock(key)
 		if _, err := os.Stat(wip); err == nil {
 			dc.wipLock.unlock(key)
 			return // Write in progress
 		}
-		if _, err := os.Stat(c); err == nil {
+		if _, err := os.Stat(dc.cachePath(key)); err == nil {
+			dc.wipLock.unlock(key)
+			if opt.willNeed {
+				dc.willNeed(key)
+			}
+			return // Already exists.
+		}
+		if _, err := os.Stat(dc.compressedPath(key)); err == nil {
 			dc.wipLock.unlock(key)
 			return // Already exists.
 		}
@@ -217,12 +467,28 @@ func (dc *directoryCache) Add(key string, p []byte, opts ...Option) {
 			wipfile.Close()
 			os.Remove(wipfile.Name())
 		}()
-		want := b2.Len()
-		if _, err := io.CopyN(wipfile, b2, int64(want)); err != nil {
+		src := b2
+		if compressed {
+			data, err := compress(b2.Bytes())
+			if err != nil {
+				fmt.Printf("Warning: failed to compress cache %q: %v\n", key, err)
+				return
+			}
+			src = bytes.NewBuffer(data)
+		}
+		if _, err := dc.io.WriteAt(wipfile, src.Bytes(), 0); err != nil {
 			fmt.Printf("Warning: failed to write cache: %v\n", err)
 			return
 		}
 
+		// Make sure the contents reach the disk before the cache file becomes
+		// visible. Otherwise, a power loss after the rename can leave a cache
+		// file pointing to truncated contents.
+		if err := wipfile.Sync(); err != nil {
+			fmt.Printf("Warning: failed to sync cache %q: %v\n", wip, err)
+			return
+		}
+
 		// Commit the cache contents
 		if err := os.MkdirAll(filepath.Dir(c), os.ModePerm); err != nil {
 			fmt.Printf("Warning: Failed to Create blob cache directory %q: %v\n", c, err)
@@ -232,18 +498,25 @@ func (dc *directoryCache) Add(key string, p []byte, opts ...Option) {
 			fmt.Printf("Warning: failed to commit cache to %q: %v\n", c, err)
 			return
 		}
+		if err := syncDir(filepath.Dir(c)); err != nil {
+			fmt.Printf("Warning: failed to sync cache directory of %q: %v\n", c, err)
+		}
+		if compressed {
+			return // Compressed file can't be served by ReadAt.
+		}
 		file, err := os.Open(c)
 		if err != nil {
 			fmt.Printf("Warning: failed to open cache on %q: %v\n", c, err)
 			return
 		}
+		if opt.willNeed {
+			adviseWillNeed(file)
+		}
 
 		// Cache the opened file for future use. If "direct" option is specified, this
 		// won't be done. This option is useful for preventing file cache from being
 		// polluted by data that won't be accessed immediately.
-		if opt.direct || !dc.fileCache.add(key, file) {
-			file.Close()
-		}
+		dc.keepOpen(key, file, opt)
 	}
 
 	if dc.syncAdd {
@@ -253,14 +526,187 @@ func (dc *directoryCache) Add(key string, p []byte, opts ...Option) {
 	}
 }
 
+// addToMemory adds the contents to the memory cache and accounts the size.
+func (dc *directoryCache) addToMemory(key string, b *bytes.Buffer) bool {
+	n := int64(b.Len())
+	atomic.AddInt64(&dc.memBytes, n)
+	if !dc.cache.add(key, b) {
+		atomic.AddInt64(&dc.memBytes, -n)
+		return false
+	}
+	return true
+}
+
+// MemoryUsage returns the size of the contents in the memory cache and the
+// decompressed cache.
+func (dc *directoryCache) MemoryUsage() int64 {
+	return atomic.LoadInt64(&dc.memBytes) + dc.decompressed.usage()
+}
+
+// ReclaimMemory drops contents from the memory cache in the least recently
+// used order. They are still served from the disk. Contents being read are
+// dropped when the reads complete so they aren't counted. The decompressed
+// cache is dropped first.
+func (dc *directoryCache) ReclaimMemory(size int64) int64 {
+	dropped := dc.decompressed.reclaim(size)
+	before := dc.MemoryUsage()
+	for dropped+before-dc.MemoryUsage() < size {
+		if dc.cache.evictOldest(1) == 0 {
+			break
+		}
+	}
+	return dropped + before - dc.MemoryUsage()
+}
+
+// keepOpen caches the opened file unless "direct" option is specified. The
+// handle is accounted in the FD budget while it's cached.
+func (dc *directoryCache) keepOpen(key string, file *os.File, opt *cacheOpt) {
+	if opt.direct {
+		file.Close()
+		return
+	}
+	owner := opt.owner
+	if owner == "" {
+		owner = "cache:" + dc.directory
+	}
+	dc.fdBudget.Acquire(owner, 1)
+	if !dc.fileCache.add(key, &cachedFile{file, owner}) {
+		file.Close()
+		dc.fdBudget.Release(owner, 1)
+	}
+}
+
+func (dc *directoryCache) willNeed(key string) {
+	if f, done, ok := dc.fileCache.get(key); ok {
+		defer done()
+		adviseWillNeed(f.(*cachedFile).File)
+		return
+	}
+	if f, err := os.Open(dc.cachePath(key)); err == nil {
+		adviseWillNeed(f)
+		f.Close()
+	}
+}
+
+// OpenFile opens the cache file of the key. Files are committed by renaming
+// so an existing file always holds the whole contents.
+func (dc *directoryCache) OpenFile(key string) (*os.File, error) {
+	f, err := os.Open(dc.cachePath(key))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open blob file for %q", key)
+	}
+	return f, nil
+}
+
+// Remove drops the contents from both of memory and disk.
+func (dc *directoryCache) Remove(key string) error {
+	dc.wipLock.lock(key)
+	defer dc.wipLock.unlock(key)
+	dc.cache.remove(key)
+	dc.fileCache.remove(key)
+	dc.decompressed.remove(key)
+	for _, p := range []string{dc.cachePath(key), dc.compressedPath(key)} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dc *directoryCache) Pin(key string) {
+	dc.pinnedMu.Lock()
+	if dc.pinned == nil {
+		dc.pinned = make(map[string]int)
+	}
+	dc.pinned[key]++
+	dc.pinnedMu.Unlock()
+}
+
+func (dc *directoryCache) Unpin(key string) {
+	dc.pinnedMu.Lock()
+	if dc.pinned[key] <= 1 {
+		delete(dc.pinned, key)
+	} else {
+		dc.pinned[key]--
+	}
+	dc.pinnedMu.Unlock()
+}
+
+func (dc *directoryCache) isPinned(key string) bool {
+	dc.pinnedMu.Lock()
+	defer dc.pinnedMu.Unlock()
+	return dc.pinned[key] > 0
+}
+
+// StoredSize returns the size of the cache file of the key on the disk.
+func (dc *directoryCache) StoredSize(key string) (int64, error) {
+	for _, p := range []string{dc.cachePath(key), dc.compressedPath(key)} {
+		if fi, err := os.Stat(p); err == nil {
+			return fi.Size(), nil
+		} else if !os.IsNotExist(err) {
+			return 0, err
+		}
+	}
+	return 0, fmt.Errorf("Missed cache: %q", key)
+}
+
 func (dc *directoryCache) cachePath(key string) string {
 	return filepath.Join(dc.directory, key[:2], key)
 }
 
+func (dc *directoryCache) compressedPath(key string) string {
+	return dc.cachePath(key) + compressedSuffix
+}
+
 func (dc *directoryCache) wipPath(key string) string {
 	return filepath.Join(dc.directory, key[:2], "w", key)
 }
 
+// repairDirectory verifies the layout of the cache directory and removes
+// entries that can be left by an unclean shutdown. Cache contents are committed
+// by fsync and atomic rename so files under the write-in-progress directories
+// are the only ones that can hold incomplete data.
+func repairDirectory(directory string) error {
+	dirs, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return err
+	}
+	for _, d := range dirs {
+		if !d.IsDir() || len(d.Name()) != 2 {
+			continue // Not a cache bucket
+		}
+		p := filepath.Join(directory, d.Name())
+		ents, err := ioutil.ReadDir(p)
+		if err != nil {
+			return err
+		}
+		for _, e := range ents {
+			ep := filepath.Join(p, e.Name())
+			if e.Name() == "w" {
+				// Write-in-progress caches are incomplete. Discard them.
+				if err := os.RemoveAll(ep); err != nil {
+					return err
+				}
+			} else if !e.Mode().IsRegular() || !strings.HasPrefix(e.Name(), d.Name()) {
+				// Unexpected entry. This can't be served as a cache.
+				if err := os.RemoveAll(ep); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return syncDir(directory)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
 type namedLock struct {
 	muMap  map[string]*sync.Mutex
 	refMap map[string]int
@@ -297,6 +743,13 @@ func (nl *namedLock) unlock(name string) {
 	mu.Unlock()
 }
 
+// cachedFile is a cache file kept open. owner is the owner accounted in the FD
+// budget.
+type cachedFile struct {
+	*os.File
+	owner string
+}
+
 func newObjectCache(maxEntries int) *objectCache {
 	oc := &objectCache{
 		cache: lru.New(maxEntries),
@@ -339,6 +792,23 @@ func (oc *objectCache) add(key string, value interface{}) bool {
 	return true
 }
 
+func (oc *objectCache) remove(key string) {
+	oc.cacheMu.Lock()
+	defer oc.cacheMu.Unlock()
+	oc.cache.Remove(key)
+}
+
+// evictOldest evicts up to n least recently used objects and returns the number
+// of evicted ones. Objects in use are finalized when they are released.
+func (oc *objectCache) evictOldest(n int) (evicted int) {
+	oc.cacheMu.Lock()
+	defer oc.cacheMu.Unlock()
+	for ; evicted < n && oc.cache.Len() > 0; evicted++ {
+		oc.cache.RemoveOldest()
+	}
+	return evicted
+}
+
 type object struct {
 	v interface{}
 
@@ -373,6 +843,7 @@ func NewMemoryCache() BlobCache {
 // memoryCache is a cache implementation which backend is a memory.
 type memoryCache struct {
 	membuf map[string]string // read-only []byte map is more ideal but we don't have it in golang...
+	size   int64             // total size of membuf
 	mu     sync.Mutex
 }
 
@@ -387,8 +858,49 @@ func (mc *memoryCache) FetchAt(key string, offset int64, p []byte, opts ...Optio
 	return copy(p, cache[offset:]), nil
 }
 
+func (mc *memoryCache) Remove(key string) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.size -= int64(len(mc.membuf[key]))
+	delete(mc.membuf, key)
+	return nil
+}
+
+func (mc *memoryCache) StoredSize(key string) (int64, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	cache, ok := mc.membuf[key]
+	if !ok {
+		return 0, fmt.Errorf("Missed cache: %q", key)
+	}
+	return int64(len(cache)), nil
+}
+
 func (mc *memoryCache) Add(key string, p []byte, opts ...Option) {
 	mc.mu.Lock()
 	defer mc.mu.Unlock()
+	mc.size += int64(len(p) - len(mc.membuf[key]))
 	mc.membuf[key] = string(p)
 }
+
+func (mc *memoryCache) MemoryUsage() int64 {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.size
+}
+
+// ReclaimMemory drops contents in an arbitrary order. They need to be fetched
+// again because this cache has no other storage.
+func (mc *memoryCache) ReclaimMemory(size int64) (dropped int64) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	for key, c := range mc.membuf {
+		if dropped >= size {
+			break
+		}
+		delete(mc.membuf, key)
+		dropped += int64(len(c))
+	}
+	mc.size -= dropped
+	return dropped
+}
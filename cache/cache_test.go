@@ -27,7 +27,11 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/util/fdbudget"
 )
 
 const (
@@ -69,6 +73,42 @@ func TestDirectoryCache(t *testing.T) {
 		return c, func() { os.RemoveAll(tmp) }
 	}
 	testCache(t, "dir-with-small-mem", newCache)
+
+	// with compression
+	newCache = func() (BlobCache, cleanFunc) {
+		tmp, err := ioutil.TempDir("", "testcache")
+		if err != nil {
+			t.Fatalf("failed to make tempdir: %v", err)
+		}
+		c, err := NewDirectoryCache(tmp, DirectoryCacheConfig{
+			MaxLRUCacheEntry: 1,
+			SyncAdd:          true,
+			Compress:         true,
+		})
+		if err != nil {
+			t.Fatalf("failed to make cache: %v", err)
+		}
+		return c, func() { os.RemoveAll(tmp) }
+	}
+	testCache(t, "dir-compressed", newCache)
+
+	// with io_uring (standard I/O is used if it's unavailable)
+	newCache = func() (BlobCache, cleanFunc) {
+		tmp, err := ioutil.TempDir("", "testcache")
+		if err != nil {
+			t.Fatalf("failed to make tempdir: %v", err)
+		}
+		c, err := NewDirectoryCache(tmp, DirectoryCacheConfig{
+			MaxLRUCacheEntry: 1,
+			SyncAdd:          true,
+			IOUring:          true,
+		})
+		if err != nil {
+			t.Fatalf("failed to make cache: %v", err)
+		}
+		return c, func() { os.RemoveAll(tmp) }
+	}
+	testCache(t, "dir-io-uring", newCache)
 }
 
 func TestMemoryCache(t *testing.T) {
@@ -185,3 +225,251 @@ func miss(sample string) check {
 		}
 	}
 }
+
+func TestDirectoryCacheRepair(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testcache")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	c, err := NewDirectoryCache(tmp, DirectoryCacheConfig{SyncAdd: true})
+	if err != nil {
+		t.Fatalf("failed to make cache: %v", err)
+	}
+	committed := digestFor(sampleData)
+	c.Add(committed, []byte(sampleData))
+
+	// Emulate an unclean shutdown during writing a cache.
+	wip := digestFor("wip")
+	wipPath := filepath.Join(tmp, wip[:2], "w", wip)
+	if err := os.MkdirAll(filepath.Dir(wipPath), 0700); err != nil {
+		t.Fatalf("failed to prepare wip directory: %v", err)
+	}
+	if err := ioutil.WriteFile(wipPath, []byte("wi"), 0600); err != nil {
+		t.Fatalf("failed to write wip file: %v", err)
+	}
+
+	c, err = NewDirectoryCache(tmp, DirectoryCacheConfig{SyncAdd: true})
+	if err != nil {
+		t.Fatalf("failed to reopen cache: %v", err)
+	}
+	if _, err := os.Stat(wipPath); !os.IsNotExist(err) {
+		t.Errorf("incomplete cache %q must be removed on startup: %v", wipPath, err)
+	}
+	hit(sampleData)(t, c)
+	miss("wip")(t, c)
+}
+
+func TestDirectoryCacheCompression(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testcache")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	c, err := NewDirectoryCache(tmp, DirectoryCacheConfig{SyncAdd: true})
+	if err != nil {
+		t.Fatalf("failed to make cache: %v", err)
+	}
+	compressed, plain := digestFor(sampleData), digestFor("test")
+	c.Add(compressed, []byte(sampleData), Direct(), Compression(true))
+	c.Add(plain, []byte("test"), Direct())
+	if _, err := os.Stat(filepath.Join(tmp, compressed[:2], compressed+compressedSuffix)); err != nil {
+		t.Errorf("compressed cache must be stored: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, plain[:2], plain)); err != nil {
+		t.Errorf("uncompressed cache must be stored: %v", err)
+	}
+
+	// Both caches are available even after the default setting is changed.
+	c, err = NewDirectoryCache(tmp, DirectoryCacheConfig{SyncAdd: true, Compress: true})
+	if err != nil {
+		t.Fatalf("failed to reopen cache: %v", err)
+	}
+	hit(sampleData)(t, c)
+	hit("test")(t, c)
+}
+
+func TestDirectoryCacheDecompressed(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testcache")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	c, err := NewDirectoryCache(tmp, DirectoryCacheConfig{
+		MaxLRUCacheEntry:          1,
+		SyncAdd:                   true,
+		Compress:                  true,
+		DecompressedCacheMaxBytes: 1 << 20,
+	})
+	if err != nil {
+		t.Fatalf("failed to make cache: %v", err)
+	}
+	a, b := digestFor(sampleData), digestFor("test")
+	c.Add(a, []byte(sampleData), Direct())
+	c.Add(b, []byte("test"), Direct())
+
+	// Contents decompressed twice are admitted. The memory cache holds only one
+	// entry so each read decompresses the file.
+	for i := 0; i < 2; i++ {
+		hit(sampleData)(t, c)
+		hit("test")(t, c)
+	}
+	for _, key := range []string{a, b} {
+		if err := os.Remove(filepath.Join(tmp, key[:2], key+compressedSuffix)); err != nil {
+			t.Fatalf("failed to remove cache file: %v", err)
+		}
+	}
+	hit(sampleData)(t, c)
+	hit("test")(t, c)
+
+	// Both are in the decompressed cache and "test" is also in the memory cache.
+	mr := c.(MemoryReclaimer)
+	if got, want := mr.MemoryUsage(), int64(len(sampleData)+2*len("test")); got != want {
+		t.Errorf("memory usage = %d; want %d", got, want)
+	}
+	mr.ReclaimMemory(1 << 20)
+	if got := mr.MemoryUsage(); got != 0 {
+		t.Errorf("memory must be reclaimed but %d", got)
+	}
+	miss("test")(t, c)
+}
+
+func TestDirectoryCacheOpenFile(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testcache")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	c, err := NewDirectoryCache(tmp, DirectoryCacheConfig{SyncAdd: true})
+	if err != nil {
+		t.Fatalf("failed to make cache: %v", err)
+	}
+	compressed, plain := digestFor(sampleData), digestFor("test")
+	c.Add(compressed, []byte(sampleData), Compression(true))
+	c.Add(plain, []byte("test"))
+	fo := c.(FileOpener)
+	if f, err := fo.OpenFile(compressed); err == nil {
+		f.Close()
+		t.Errorf("compressed cache must not be opened as a plain file")
+	}
+	f, err := fo.OpenFile(plain)
+	if err != nil {
+		t.Fatalf("failed to open cache file: %v", err)
+	}
+	defer f.Close()
+	if data, err := ioutil.ReadAll(f); err != nil || string(data) != "test" {
+		t.Errorf("unexpected contents %q: %v", string(data), err)
+	}
+}
+
+func TestDirectoryCacheRemove(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testcache")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	c, err := NewDirectoryCache(tmp, DirectoryCacheConfig{SyncAdd: true})
+	if err != nil {
+		t.Fatalf("failed to make cache: %v", err)
+	}
+	plain, compressed := digestFor(sampleData), digestFor("test")
+	c.Add(plain, []byte(sampleData))
+	c.Add(compressed, []byte("test"), Compression(true))
+	hit(sampleData)(t, c)
+	hit("test")(t, c)
+	if n, err := c.(Sizer).StoredSize(plain); err != nil || n != int64(len(sampleData)) {
+		t.Errorf("unexpected stored size %d: %v", n, err)
+	}
+	if n, err := c.(Sizer).StoredSize(compressed); err != nil || n == 0 {
+		t.Errorf("unexpected stored size of compressed contents %d: %v", n, err)
+	}
+	for _, key := range []string{plain, compressed} {
+		if err := c.(Remover).Remove(key); err != nil {
+			t.Fatalf("failed to remove %q: %v", key, err)
+		}
+	}
+	miss(sampleData)(t, c)
+	miss("test")(t, c)
+	if _, err := c.(Sizer).StoredSize(plain); err == nil {
+		t.Errorf("removed contents must not have the size")
+	}
+}
+
+func TestDirectoryCacheWillNeed(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testcache")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	var advised []string
+	orig := adviseWillNeed
+	adviseWillNeed = func(f *os.File) error {
+		advised = append(advised, filepath.Base(f.Name()))
+		return nil
+	}
+	defer func() { adviseWillNeed = orig }()
+
+	c, err := NewDirectoryCache(tmp, DirectoryCacheConfig{SyncAdd: true})
+	if err != nil {
+		t.Fatalf("failed to make cache: %v", err)
+	}
+	key, other := digestFor(sampleData), digestFor("test")
+	c.Add(other, []byte("test"), Direct())
+	if _, err := c.FetchAt(other, 0, make([]byte, 4), Direct()); err != nil {
+		t.Fatalf("failed to fetch: %v", err)
+	}
+	if len(advised) != 0 {
+		t.Fatalf("contents must not be advised without the option: %v", advised)
+	}
+	c.Add(key, []byte(sampleData), Direct(), WillNeed())
+	c.Add(key, []byte(sampleData), Direct(), WillNeed()) // already exists
+	if _, err := c.FetchAt(key, 0, make([]byte, 4), Direct(), WillNeed()); err != nil {
+		t.Fatalf("failed to fetch: %v", err)
+	}
+	if len(advised) != 3 {
+		t.Fatalf("contents must be advised on each operation: %v", advised)
+	}
+	for _, a := range advised {
+		if a != key {
+			t.Errorf("unexpected file advised: %q", a)
+		}
+	}
+}
+
+func TestDirectoryCacheFDBudget(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testcache")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	budget := fdbudget.New(2)
+	c, err := NewDirectoryCache(tmp, DirectoryCacheConfig{
+		MaxCacheFds: 10,
+		SyncAdd:     true,
+		FDBudget:    budget,
+	})
+	if err != nil {
+		t.Fatalf("failed to make cache: %v", err)
+	}
+	for _, d := range []string{"a", "b", "c", "d"} {
+		c.Add(digestFor(d), []byte(d), Direct())
+		if _, err := c.FetchAt(digestFor(d), 0, make([]byte, 1), Owner("layer-"+d)); err != nil {
+			t.Fatalf("failed to fetch: %v", err)
+		}
+	}
+	// Handles exceeding the soft cap are closed in background.
+	var s fdbudget.Stats
+	for i := 0; i < 100; i++ {
+		if s = budget.Stats(); s.Held <= 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s.Held != 2 || s.Reclaimed == 0 {
+		t.Fatalf("handles over the soft cap must be closed: %+v", s)
+	}
+	if len(s.Owners) != 2 || s.Owners[0].Owner != "layer-c" || s.Owners[1].Owner != "layer-d" {
+		t.Errorf("recently used handles must be kept: %+v", s.Owners)
+	}
+	hit("c")(t, c)
+}
@@ -0,0 +1,63 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressedSuffix is appended to the name of cache files stored with zstd
+// compression. Compressed and uncompressed caches can coexist in a directory so
+// that the compression setting can be changed without wiping the directory.
+const compressedSuffix = ".zst"
+
+var (
+	zstdEncoder  *zstd.Encoder
+	zstdDecoder  *zstd.Decoder
+	zstdInitErr  error
+	zstdInitOnce sync.Once
+)
+
+// zstdCodec returns the encoder and decoder shared among caches. EncodeAll and
+// DecodeAll of them are safe for concurrent use.
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdInitOnce.Do(func() {
+		if zstdEncoder, zstdInitErr = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest)); zstdInitErr != nil {
+			return
+		}
+		zstdDecoder, zstdInitErr = zstd.NewReader(nil)
+	})
+	return zstdEncoder, zstdDecoder, zstdInitErr
+}
+
+func compress(p []byte) ([]byte, error) {
+	enc, _, err := zstdCodec()
+	if err != nil {
+		return nil, err
+	}
+	return enc.EncodeAll(p, nil), nil
+}
+
+func decompress(p []byte) ([]byte, error) {
+	_, dec, err := zstdCodec()
+	if err != nil {
+		return nil, err
+	}
+	return dec.DecodeAll(p, nil)
+}
@@ -0,0 +1,143 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/golang/groupcache/lru"
+)
+
+// maxSeenEntries is the number of keys remembered for admission to the
+// decompressed cache.
+const maxSeenEntries = 10000
+
+// decompressedCache keeps decompressed contents of cache files stored
+// compressed so that repeated reads of hot chunks don't pay decompression.
+// Unlike the memory cache of the directory cache, which is bounded by the
+// number of entries and filled by every Add, this is bounded by the size and
+// only admits contents decompressed for the second time, so hot chunks aren't
+// flushed by chunks read once (e.g. prefetch). Stored contents are never
+// modified so they can be read without the lock.
+type decompressedCache struct {
+	maxBytes int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List // front is the most recently used
+	entries map[string]*list.Element
+	seen    *lru.Cache
+}
+
+type decompressedEntry struct {
+	key  string
+	data []byte
+}
+
+func newDecompressedCache(maxBytes int64) *decompressedCache {
+	return &decompressedCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		seen:     lru.New(maxSeenEntries),
+	}
+}
+
+// get returns the decompressed contents of the key. The caller must not modify
+// the returned slice. This is nil-safe.
+func (c *decompressedCache) get(key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*decompressedEntry).data, true
+}
+
+// add stores the decompressed contents if the key has been decompressed
+// before. Otherwise, this only remembers the key. The cache takes the
+// ownership of data.
+func (c *decompressedCache) add(key string, data []byte) {
+	if c == nil || int64(len(data)) > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	if _, ok := c.seen.Get(key); !ok {
+		c.seen.Add(key, struct{}{})
+		return
+	}
+	c.seen.Remove(key)
+	c.entries[key] = c.lru.PushFront(&decompressedEntry{key, data})
+	c.size += int64(len(data))
+	for c.size > c.maxBytes {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+func (c *decompressedCache) remove(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.removeElement(e)
+	}
+	c.seen.Remove(key)
+}
+
+func (c *decompressedCache) usage() int64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// reclaim drops contents in the least recently used order until the specified
+// size is dropped and returns the dropped size.
+func (c *decompressedCache) reclaim(size int64) (dropped int64) {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for dropped < size && c.lru.Len() > 0 {
+		e := c.lru.Back()
+		dropped += int64(len(e.Value.(*decompressedEntry).data))
+		c.removeElement(e)
+	}
+	return dropped
+}
+
+// removeElement removes the element from the cache. c.mu must be held.
+func (c *decompressedCache) removeElement(e *list.Element) {
+	de := c.lru.Remove(e).(*decompressedEntry)
+	delete(c.entries, de.key)
+	c.size -= int64(len(de.data))
+}
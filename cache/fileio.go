@@ -0,0 +1,55 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"fmt"
+	"os"
+)
+
+// fileIO reads and writes cache files. The standard I/O (pread/pwrite) is used
+// by default and io_uring can be used instead when the cache is built with
+// "iouring" tag.
+type fileIO interface {
+	ReadAt(f *os.File, p []byte, offset int64) (int, error)
+	WriteAt(f *os.File, p []byte, offset int64) (int, error)
+}
+
+type stdIO struct{}
+
+func (stdIO) ReadAt(f *os.File, p []byte, offset int64) (int, error) {
+	return f.ReadAt(p, offset)
+}
+
+func (stdIO) WriteAt(f *os.File, p []byte, offset int64) (int, error) {
+	return f.WriteAt(p, offset)
+}
+
+// newFileIO returns the I/O used by the cache. If io_uring is requested but
+// unavailable (e.g. not compiled in or not supported by the kernel), the
+// standard I/O is used with a warning.
+func newFileIO(useIOUring bool) fileIO {
+	if !useIOUring {
+		return stdIO{}
+	}
+	uio, err := newIOUring(defaultIOUringEntries)
+	if err != nil {
+		fmt.Printf("Warning: failed to use io_uring for cache; falling back to standard I/O: %v\n", err)
+		return stdIO{}
+	}
+	return uio
+}
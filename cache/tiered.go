@@ -0,0 +1,304 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/golang/groupcache/lru"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultPromoteAfterHits = 1
+	maxHitCountEntries      = 10000
+)
+
+type TieredCacheConfig struct {
+	// HotMaxBytes is the maximum size of contents stored in the hot tier. When
+	// the hot tier exceeds this size, least recently used contents are demoted
+	// (i.e. removed from the hot tier. They are still available in the cold tier).
+	HotMaxBytes int64
+
+	// PromoteAfterHits is the number of reads served by the cold tier after which
+	// the contents are promoted to the hot tier. Zero means 1.
+	PromoteAfterHits int
+}
+
+// When Hot option is specified for Add method of a tiered cache, the contents
+// are stored in the hot tier immediately as well as in the cold tier. This is
+// useful for latency-sensitive contents. Other caches ignore this option.
+func Hot() Option {
+	return func(o *cacheOpt) *cacheOpt {
+		o.hot = true
+		return o
+	}
+}
+
+// NewTieredCache returns a two-tier cache. The hot tier is stored in hotDir,
+// which is expected to be on a memory-backed filesystem like tmpfs, and the cold
+// tier is a directory cache on coldDir. All contents are written to the cold
+// tier so the hot tier can lose contents at any time (e.g. on reboot).
+func NewTieredCache(hotDir, coldDir string, coldConfig DirectoryCacheConfig, config TieredCacheConfig) (BlobCache, error) {
+	if config.HotMaxBytes <= 0 {
+		return nil, fmt.Errorf("size limit of the hot tier must be positive; got %d", config.HotMaxBytes)
+	}
+	promoteAfterHits := config.PromoteAfterHits
+	if promoteAfterHits == 0 {
+		promoteAfterHits = defaultPromoteAfterHits
+	}
+	hot, err := newHotTier(hotDir, config.HotMaxBytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to prepare hot tier on %q", hotDir)
+	}
+	cold, err := NewDirectoryCache(coldDir, coldConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &tieredCache{
+		hot:              hot,
+		cold:             cold.(*directoryCache),
+		promoteAfterHits: promoteAfterHits,
+		hits:             lru.New(maxHitCountEntries),
+	}, nil
+}
+
+type tieredCache struct {
+	hot              *hotTier
+	cold             *directoryCache
+	promoteAfterHits int
+	hits             *lru.Cache
+	hitsMu           sync.Mutex
+}
+
+func (tc *tieredCache) FetchAt(key string, offset int64, p []byte, opts ...Option) (n int, err error) {
+	if n, err := tc.hot.fetchAt(key, offset, p); err == nil {
+		return n, nil
+	}
+	n, err = tc.cold.FetchAt(key, offset, p, opts...)
+	if err != nil {
+		return n, err
+	}
+	if tc.countHit(key) {
+		if data, err := tc.cold.readAll(key); err == nil {
+			tc.hot.add(key, data)
+		}
+	}
+	return n, nil
+}
+
+func (tc *tieredCache) Add(key string, p []byte, opts ...Option) {
+	opt := &cacheOpt{}
+	for _, o := range opts {
+		opt = o(opt)
+	}
+	if opt.hot {
+		tc.hot.add(key, p)
+	}
+	tc.cold.Add(key, p, opts...)
+}
+
+// Close stops background goroutines of the cold tier.
+func (tc *tieredCache) Close() error {
+	return tc.cold.Close()
+}
+
+func (tc *tieredCache) Remove(key string) error {
+	tc.hot.remove(key)
+	tc.hitsMu.Lock()
+	tc.hits.Remove(key)
+	tc.hitsMu.Unlock()
+	return tc.cold.Remove(key)
+}
+
+// Pin protects the contents of the key in the cold tier from the eviction.
+// Contents in the hot tier are still demoted to the cold tier.
+func (tc *tieredCache) Pin(key string) {
+	tc.cold.Pin(key)
+}
+
+func (tc *tieredCache) Unpin(key string) {
+	tc.cold.Unpin(key)
+}
+
+// MemoryUsage returns the size of the contents in the memory cache of the cold
+// tier. The hot tier doesn't hold contents in the memory.
+func (tc *tieredCache) MemoryUsage() int64 {
+	return tc.cold.MemoryUsage()
+}
+
+func (tc *tieredCache) ReclaimMemory(size int64) int64 {
+	return tc.cold.ReclaimMemory(size)
+}
+
+// OpenFile opens the file of the cold tier, which always holds the contents.
+func (tc *tieredCache) OpenFile(key string) (*os.File, error) {
+	return tc.cold.OpenFile(key)
+}
+
+// countHit counts a read served by the cold tier and reports whether the
+// contents should be promoted to the hot tier.
+func (tc *tieredCache) countHit(key string) bool {
+	tc.hitsMu.Lock()
+	defer tc.hitsMu.Unlock()
+	hits := 1
+	if h, ok := tc.hits.Get(key); ok {
+		hits += h.(int)
+	}
+	if hits >= tc.promoteAfterHits {
+		tc.hits.Remove(key)
+		return true
+	}
+	tc.hits.Add(key, hits)
+	return false
+}
+
+// hotTier is a size-limited directory which holds contents in LRU order.
+type hotTier struct {
+	directory string
+	maxBytes  int64
+	size      int64
+	lru       *list.List
+	entries   map[string]*list.Element
+	mu        sync.Mutex
+}
+
+type hotEntry struct {
+	key  string
+	size int64
+}
+
+func newHotTier(directory string, maxBytes int64) (*hotTier, error) {
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, err
+	}
+	// Sizes of existing contents aren't tracked. Discard them.
+	dirs, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dirs {
+		if d.IsDir() && len(d.Name()) == 2 {
+			if err := os.RemoveAll(filepath.Join(directory, d.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &hotTier{
+		directory: directory,
+		maxBytes:  maxBytes,
+		lru:       list.New(),
+		entries:   make(map[string]*list.Element),
+	}, nil
+}
+
+func (ht *hotTier) fetchAt(key string, offset int64, p []byte) (int, error) {
+	ht.mu.Lock()
+	e, ok := ht.entries[key]
+	if ok {
+		ht.lru.MoveToFront(e)
+	}
+	ht.mu.Unlock()
+	if !ok {
+		return 0, fmt.Errorf("missed hot cache %q", key)
+	}
+
+	// The file can be removed by demotion at this moment. The caller falls back
+	// to the cold tier in that case.
+	f, err := os.Open(ht.path(key))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	n, err := f.ReadAt(p, offset)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (ht *hotTier) add(key string, p []byte) {
+	size := int64(len(p))
+	if size > ht.maxBytes {
+		return // Never fits in this tier.
+	}
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	if e, ok := ht.entries[key]; ok {
+		ht.lru.MoveToFront(e)
+		return
+	}
+	c := ht.path(key)
+	if err := os.MkdirAll(filepath.Dir(c), 0700); err != nil {
+		fmt.Printf("Warning: failed to create hot cache directory %q: %v\n", c, err)
+		return
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(c), "w")
+	if err != nil {
+		fmt.Printf("Warning: failed to prepare hot cache %q: %v\n", key, err)
+		return
+	}
+	_, err = tmp.Write(p)
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), c)
+	}
+	if err != nil {
+		fmt.Printf("Warning: failed to store hot cache %q: %v\n", key, err)
+		os.Remove(tmp.Name())
+		return
+	}
+	ht.entries[key] = ht.lru.PushFront(&hotEntry{key: key, size: size})
+	ht.size += size
+	for ht.size > ht.maxBytes {
+		ht.demoteOldest()
+	}
+}
+
+func (ht *hotTier) remove(key string) {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	if e, ok := ht.entries[key]; ok {
+		ht.removeUnlocked(e)
+	}
+}
+
+func (ht *hotTier) demoteOldest() {
+	if e := ht.lru.Back(); e != nil {
+		ht.removeUnlocked(e)
+	}
+}
+
+func (ht *hotTier) removeUnlocked(e *list.Element) {
+	he := e.Value.(*hotEntry)
+	ht.lru.Remove(e)
+	delete(ht.entries, he.key)
+	ht.size -= he.size
+	if err := os.Remove(ht.path(he.key)); err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Warning: failed to remove hot cache %q: %v\n", he.key, err)
+	}
+}
+
+func (ht *hotTier) path(key string) string {
+	return filepath.Join(ht.directory, key[:2], key)
+}
@@ -0,0 +1,86 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestTieredCache(t *testing.T, config TieredCacheConfig) (*tieredCache, cleanFunc) {
+	tmp, err := ioutil.TempDir("", "testcache")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	c, err := NewTieredCache(filepath.Join(tmp, "hot"), filepath.Join(tmp, "cold"),
+		DirectoryCacheConfig{SyncAdd: true}, config)
+	if err != nil {
+		t.Fatalf("failed to make cache: %v", err)
+	}
+	return c.(*tieredCache), func() { os.RemoveAll(tmp) }
+}
+
+func TestTieredCache(t *testing.T) {
+	testCache(t, "tiered", func() (BlobCache, cleanFunc) {
+		return newTestTieredCache(t, TieredCacheConfig{HotMaxBytes: 1024})
+	})
+}
+
+func TestTieredCachePromotion(t *testing.T) {
+	c, clean := newTestTieredCache(t, TieredCacheConfig{
+		HotMaxBytes:      int64(len(sampleData)),
+		PromoteAfterHits: 2,
+	})
+	defer clean()
+
+	var (
+		hotKey   = digestFor(sampleData)
+		coldKey  = digestFor("test")
+		inHot    = func(key string) bool { _, ok := c.hot.entries[key]; return ok }
+		fetchAll = func(key string, size int) {
+			if _, err := c.FetchAt(key, 0, make([]byte, size)); err != nil {
+				t.Fatalf("failed to fetch %q: %v", key, err)
+			}
+		}
+	)
+	c.Add(hotKey, []byte(sampleData), Hot())
+	c.Add(coldKey, []byte("test"))
+	if !inHot(hotKey) || inHot(coldKey) {
+		t.Fatalf("only contents added with Hot option must be in the hot tier")
+	}
+
+	fetchAll(coldKey, 4)
+	if inHot(coldKey) {
+		t.Fatalf("contents must not be promoted before reaching the hit count")
+	}
+	fetchAll(coldKey, 4)
+	if !inHot(coldKey) {
+		t.Fatalf("contents must be promoted after reaching the hit count")
+	}
+
+	// The hot tier can't hold both contents.
+	if inHot(hotKey) {
+		t.Fatalf("least recently used contents must be demoted")
+	}
+	if c.hot.size > c.hot.maxBytes {
+		t.Fatalf("hot tier size %d exceeds the limit %d", c.hot.size, c.hot.maxBytes)
+	}
+	hit(sampleData)(t, c)
+	hit("test")(t, c)
+}
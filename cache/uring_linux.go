@@ -0,0 +1,308 @@
+//go:build linux && iouring
+// +build linux,iouring
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Constants of io_uring (include/uapi/linux/io_uring.h).
+const (
+	ioringOffSQRing = 0
+	ioringOffCQRing = 0x8000000
+	ioringOffSQEs   = 0x10000000
+
+	ioringOpRead  = 22 // since Linux 5.6
+	ioringOpWrite = 23 // since Linux 5.6
+
+	ioringEnterGetEvents = 1 << 0
+)
+
+const defaultIOUringEntries = 256
+
+type ioUringSQOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type ioUringCQOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type ioUringParams struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFd uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  ioUringSQOffsets
+	cqOff                                                                  ioUringCQOffsets
+}
+
+type ioUringSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	rwFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	addr3       uint64
+	pad         uint64
+}
+
+type ioUringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// ioUring is a fileIO which submits reads and writes of cache files to an
+// io_uring instance. Requests issued concurrently (e.g. reads of many small
+// chunk files during container startup) are submitted and reaped together in
+// a single io_uring_enter(2) call.
+type ioUring struct {
+	fd      int
+	entries uint32
+
+	sqTail, sqMask         *uint32
+	sqArray                []uint32
+	sqes                   []ioUringSQE
+	cqHead, cqTail, cqMask *uint32
+	cqes                   []ioUringCQE
+
+	reqCh chan *ioUringReq
+
+	// broken is set when the ring becomes unusable. Following requests are
+	// served by the standard I/O.
+	broken int32
+}
+
+type ioUringReq struct {
+	opcode uint8
+	fd     int32
+	p      []byte
+	offset int64
+	res    int32
+	done   chan struct{}
+}
+
+func newIOUring(entries uint32) (fileIO, error) {
+	var params ioUringParams
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&params)), 0)
+	if errno != 0 {
+		return nil, errors.Wrap(errno, "failed to setup io_uring")
+	}
+	r := &ioUring{fd: int(fd), entries: params.sqEntries}
+	mmap := func(offset int64, size uint32) ([]byte, error) {
+		return unix.Mmap(r.fd, offset, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	}
+	sqRing, err := mmap(ioringOffSQRing, params.sqOff.array+params.sqEntries*4)
+	if err != nil {
+		unix.Close(r.fd)
+		return nil, errors.Wrap(err, "failed to map submission queue")
+	}
+	cqRing, err := mmap(ioringOffCQRing, params.cqOff.cqes+params.cqEntries*uint32(unsafe.Sizeof(ioUringCQE{})))
+	if err != nil {
+		unix.Munmap(sqRing)
+		unix.Close(r.fd)
+		return nil, errors.Wrap(err, "failed to map completion queue")
+	}
+	sqeMem, err := mmap(ioringOffSQEs, params.sqEntries*uint32(unsafe.Sizeof(ioUringSQE{})))
+	if err != nil {
+		unix.Munmap(cqRing)
+		unix.Munmap(sqRing)
+		unix.Close(r.fd)
+		return nil, errors.Wrap(err, "failed to map submission queue entries")
+	}
+	u32 := func(b []byte, off uint32) *uint32 { return (*uint32)(unsafe.Pointer(&b[off])) }
+	r.sqTail, r.sqMask = u32(sqRing, params.sqOff.tail), u32(sqRing, params.sqOff.ringMask)
+	r.sqArray = (*[1 << 20]uint32)(unsafe.Pointer(&sqRing[params.sqOff.array]))[:params.sqEntries:params.sqEntries]
+	r.sqes = (*[1 << 16]ioUringSQE)(unsafe.Pointer(&sqeMem[0]))[:params.sqEntries:params.sqEntries]
+	r.cqHead, r.cqTail, r.cqMask = u32(cqRing, params.cqOff.head), u32(cqRing, params.cqOff.tail), u32(cqRing, params.cqOff.ringMask)
+	r.cqes = (*[1 << 17]ioUringCQE)(unsafe.Pointer(&cqRing[params.cqOff.cqes]))[:params.cqEntries:params.cqEntries]
+	r.reqCh = make(chan *ioUringReq, r.entries)
+	go r.run()
+
+	// IORING_OP_READ isn't supported by kernels older than 5.6.
+	zero, err := os.Open("/dev/zero")
+	if err != nil {
+		return nil, err
+	}
+	defer zero.Close()
+	if _, err := r.do(ioringOpRead, zero, make([]byte, 1), 0); err != nil {
+		atomic.StoreInt32(&r.broken, 1)
+		return nil, errors.Wrap(err, "io_uring doesn't support read operation")
+	}
+	return r, nil
+}
+
+func (r *ioUring) ReadAt(f *os.File, p []byte, offset int64) (n int, err error) {
+	if atomic.LoadInt32(&r.broken) != 0 {
+		return stdIO{}.ReadAt(f, p, offset)
+	}
+	for n < len(p) {
+		m, err := r.do(ioringOpRead, f, p[n:], offset+int64(n))
+		if err != nil {
+			return n, err
+		}
+		if m == 0 {
+			return n, io.EOF
+		}
+		n += m
+	}
+	return n, nil
+}
+
+func (r *ioUring) WriteAt(f *os.File, p []byte, offset int64) (n int, err error) {
+	if atomic.LoadInt32(&r.broken) != 0 {
+		return stdIO{}.WriteAt(f, p, offset)
+	}
+	for n < len(p) {
+		m, err := r.do(ioringOpWrite, f, p[n:], offset+int64(n))
+		if err != nil {
+			return n, err
+		}
+		if m == 0 {
+			return n, io.ErrShortWrite
+		}
+		n += m
+	}
+	return n, nil
+}
+
+func (r *ioUring) do(opcode uint8, f *os.File, p []byte, offset int64) (int, error) {
+	req := &ioUringReq{
+		opcode: opcode,
+		fd:     int32(f.Fd()),
+		p:      p,
+		offset: offset,
+		done:   make(chan struct{}),
+	}
+	r.reqCh <- req
+	<-req.done
+	runtime.KeepAlive(f)
+	if req.res < 0 {
+		op := "read"
+		if opcode == ioringOpWrite {
+			op = "write"
+		}
+		return 0, &os.PathError{Op: "io_uring " + op, Path: f.Name(), Err: syscall.Errno(-req.res)}
+	}
+	return int(req.res), nil
+}
+
+// run submits requests in batches. At most the number of the entries of the
+// ring are in flight so the completion queue (twice as large) never overflows.
+func (r *ioUring) run() {
+	batch := make([]*ioUringReq, 0, r.entries)
+	for req := range r.reqCh {
+		batch = append(batch[:0], req)
+	drain:
+		for uint32(len(batch)) < r.entries {
+			select {
+			case req := <-r.reqCh:
+				batch = append(batch, req)
+			default:
+				break drain
+			}
+		}
+		r.submit(batch)
+	}
+}
+
+func (r *ioUring) submit(batch []*ioUringReq) {
+	if atomic.LoadInt32(&r.broken) != 0 {
+		// Requests queued before the ring broke.
+		for _, req := range batch {
+			var n int
+			var err error
+			if req.opcode == ioringOpWrite {
+				n, err = unix.Pwrite(int(req.fd), req.p, req.offset)
+			} else {
+				n, err = unix.Pread(int(req.fd), req.p, req.offset)
+			}
+			req.res = int32(n)
+			if errno, ok := err.(syscall.Errno); ok {
+				req.res = -int32(errno)
+			}
+			close(req.done)
+		}
+		return
+	}
+	tail, mask := atomic.LoadUint32(r.sqTail), atomic.LoadUint32(r.sqMask)
+	for i, req := range batch {
+		idx := (tail + uint32(i)) & mask
+		r.sqes[idx] = ioUringSQE{
+			opcode:   req.opcode,
+			fd:       req.fd,
+			off:      uint64(req.offset),
+			addr:     uint64(uintptr(unsafe.Pointer(&req.p[0]))),
+			len:      uint32(len(req.p)),
+			userData: uint64(i),
+		}
+		r.sqArray[idx] = idx
+	}
+	atomic.StoreUint32(r.sqTail, tail+uint32(len(batch)))
+
+	toSubmit, remaining := len(batch), len(batch)
+	completed := make([]bool, len(batch))
+	for remaining > 0 {
+		n, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(toSubmit), 1, ioringEnterGetEvents, 0, 0)
+		if errno == unix.EINTR {
+			continue
+		} else if errno != 0 {
+			// The ring can't be trusted anymore. Fail the pending requests and
+			// serve the following ones with the standard I/O.
+			fmt.Printf("Warning: io_uring failed; falling back to standard I/O: %v\n", errno)
+			atomic.StoreInt32(&r.broken, 1)
+			for i, req := range batch {
+				if !completed[i] {
+					req.res = -int32(errno)
+					close(req.done)
+				}
+			}
+			return
+		}
+		toSubmit -= int(n)
+		head, cqMask := atomic.LoadUint32(r.cqHead), atomic.LoadUint32(r.cqMask)
+		for ; head != atomic.LoadUint32(r.cqTail); head++ {
+			cqe := r.cqes[head&cqMask]
+			req := batch[cqe.userData]
+			req.res = cqe.res
+			completed[cqe.userData] = true
+			close(req.done)
+			remaining--
+		}
+		atomic.StoreUint32(r.cqHead, head)
+	}
+}
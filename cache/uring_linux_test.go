@@ -0,0 +1,78 @@
+//go:build linux && iouring
+// +build linux,iouring
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestIOUring(t *testing.T) {
+	uio, err := newIOUring(8)
+	if err != nil {
+		t.Skipf("io_uring is unavailable: %v", err)
+	}
+	tmp, err := ioutil.TempFile("", "testiouring")
+	if err != nil {
+		t.Fatalf("failed to make tempfile: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	// More requests than the entries of the ring are issued concurrently.
+	const files = 64
+	var wg sync.WaitGroup
+	for i := 0; i < files; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data := []byte(fmt.Sprintf("%04d", i))
+			if _, err := uio.WriteAt(tmp, data, int64(i*4)); err != nil {
+				t.Errorf("failed to write: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < files; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p := make([]byte, 4)
+			if _, err := uio.ReadAt(tmp, p, int64(i*4)); err != nil {
+				t.Errorf("failed to read: %v", err)
+			}
+			if want := []byte(fmt.Sprintf("%04d", i)); !bytes.Equal(p, want) {
+				t.Errorf("read %q; want %q", p, want)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Reads beyond the end of file report EOF as os.File does.
+	p := make([]byte, 8)
+	if n, err := uio.ReadAt(tmp, p, files*4-4); n != 4 || err != io.EOF {
+		t.Errorf("read beyond EOF = (%d, %v); want (4, EOF)", n, err)
+	}
+}
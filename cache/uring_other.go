@@ -0,0 +1,30 @@
+//go:build !linux || !iouring
+// +build !linux !iouring
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"fmt"
+)
+
+const defaultIOUringEntries = 0
+
+func newIOUring(entries uint32) (fileIO, error) {
+	return nil, fmt.Errorf("io_uring support isn't compiled in (build with \"iouring\" tag)")
+}
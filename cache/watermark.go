@@ -0,0 +1,168 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const defaultWatermarkCheckInterval = 10 * time.Second
+
+// diskUsageFunc returns the used percentage of the filesystem where the
+// specified directory is located.
+type diskUsageFunc func(dir string) (float64, error)
+
+func statfsUsage(dir string) (float64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	if st.Blocks == 0 {
+		return 0, nil
+	}
+	return float64(st.Blocks-st.Bavail) / float64(st.Blocks) * 100.0, nil
+}
+
+// watermarkEvictor evicts cache contents from the disk when the usage of the
+// underlying filesystem exceeds the high watermark. Eviction continues until the
+// usage goes below the low watermark. The watermarks should be lower than the
+// kubelet's imagefs eviction thresholds so that caches of lazily pulled images
+// don't cause node DiskPressure.
+type watermarkEvictor struct {
+	dc            *directoryCache
+	highWatermark float64
+	lowWatermark  float64
+	usage         diskUsageFunc
+}
+
+func newWatermarkEvictor(dc *directoryCache, high, low int) (*watermarkEvictor, error) {
+	if high <= 0 || high > 100 {
+		return nil, fmt.Errorf("high watermark must be in (0, 100]; got %d", high)
+	}
+	if low <= 0 {
+		low = high
+	}
+	if low > high {
+		return nil, fmt.Errorf("low watermark %d must not exceed high watermark %d", low, high)
+	}
+	return &watermarkEvictor{
+		dc:            dc,
+		highWatermark: float64(high),
+		lowWatermark:  float64(low),
+		usage:         statfsUsage,
+	}, nil
+}
+
+// run checks the disk usage every interval until done is closed.
+func (we *watermarkEvictor) run(interval time.Duration, done <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if _, err := we.evict(); err != nil {
+				fmt.Printf("Warning: failed to evict caches from %q: %v\n", we.dc.directory, err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// evict removes cache files in the order of oldest modification time until the
+// disk usage goes below the low watermark. Pinned files are never removed. This
+// returns the number of removed cache files.
+func (we *watermarkEvictor) evict() (int, error) {
+	u, err := we.usage(we.dc.directory)
+	if err != nil {
+		return 0, err
+	}
+	if u < we.highWatermark {
+		return 0, nil
+	}
+	files, err := we.cacheFiles()
+	if err != nil {
+		return 0, err
+	}
+	var removed int
+	for _, f := range files {
+		if u < we.lowWatermark {
+			break
+		}
+		if we.dc.isPinned(f.key) {
+			continue
+		}
+		we.dc.wipLock.lock(f.key)
+		we.dc.fileCache.remove(f.key)
+		err := os.Remove(f.path)
+		we.dc.wipLock.unlock(f.key)
+		if err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		removed++
+		if u, err = we.usage(we.dc.directory); err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+type cacheFile struct {
+	key     string
+	path    string
+	modTime time.Time
+}
+
+func (we *watermarkEvictor) cacheFiles() ([]cacheFile, error) {
+	dirs, err := ioutil.ReadDir(we.dc.directory)
+	if err != nil {
+		return nil, err
+	}
+	var files []cacheFile
+	for _, d := range dirs {
+		if !d.IsDir() || len(d.Name()) != 2 {
+			continue
+		}
+		p := filepath.Join(we.dc.directory, d.Name())
+		ents, err := ioutil.ReadDir(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range ents {
+			if !e.Mode().IsRegular() {
+				continue // write-in-progress directory
+			}
+			files = append(files, cacheFile{
+				key:     strings.TrimSuffix(e.Name(), compressedSuffix),
+				path:    filepath.Join(p, e.Name()),
+				modTime: e.ModTime(),
+			})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	return files, nil
+}
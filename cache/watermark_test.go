@@ -0,0 +1,158 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatermarkEviction(t *testing.T) {
+	tests := []struct {
+		name        string
+		high        int
+		low         int
+		entries     int
+		pinned      []int
+		wantRemoved int
+	}{
+		{name: "under_high", high: 80, low: 50, entries: 7, wantRemoved: 0},
+		{name: "over_high", high: 80, low: 50, entries: 9, wantRemoved: 5},
+		{name: "low_defaults_to_high", high: 80, entries: 9, wantRemoved: 2},
+		{name: "pinned", high: 80, low: 50, entries: 9, pinned: []int{0, 2}, wantRemoved: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmp, err := ioutil.TempDir("", "testcache")
+			if err != nil {
+				t.Fatalf("failed to make tempdir: %v", err)
+			}
+			defer os.RemoveAll(tmp)
+			c, err := NewDirectoryCache(tmp, DirectoryCacheConfig{SyncAdd: true})
+			if err != nil {
+				t.Fatalf("failed to make cache: %v", err)
+			}
+			dc := c.(*directoryCache)
+			var keys []string
+			now := time.Now()
+			for i := 0; i < tt.entries; i++ {
+				key := digestFor(fmt.Sprintf("%s-%d", sampleData, i))
+				dc.Add(key, []byte(sampleData))
+				mt := now.Add(time.Duration(i) * time.Second)
+				if err := os.Chtimes(dc.cachePath(key), mt, mt); err != nil {
+					t.Fatalf("failed to change mtime: %v", err)
+				}
+				keys = append(keys, key)
+			}
+			pinned := make(map[int]bool)
+			for _, i := range tt.pinned {
+				dc.Pin(keys[i])
+				pinned[i] = true
+			}
+
+			// Each cache file takes 10% of the disk.
+			we, err := newWatermarkEvictor(dc, tt.high, tt.low)
+			if err != nil {
+				t.Fatalf("failed to make evictor: %v", err)
+			}
+			we.usage = func(dir string) (float64, error) {
+				ents, err := filepath.Glob(filepath.Join(dir, "*", "*"))
+				if err != nil {
+					return 0, err
+				}
+				var n int
+				for _, e := range ents {
+					if fi, err := os.Stat(e); err == nil && fi.Mode().IsRegular() {
+						n++
+					}
+				}
+				return float64(n) * 10, nil
+			}
+			removed, err := we.evict()
+			if err != nil {
+				t.Fatalf("failed to evict: %v", err)
+			}
+			if removed != tt.wantRemoved {
+				t.Fatalf("removed %d entries; want %d", removed, tt.wantRemoved)
+			}
+			evicted := 0
+			for i, key := range keys {
+				_, err := os.Stat(dc.cachePath(key))
+				if pinned[i] {
+					if err != nil {
+						t.Errorf("pinned entry %d must be kept: %v", i, err)
+					}
+					continue
+				}
+				if evicted < removed {
+					if !os.IsNotExist(err) {
+						t.Errorf("old entry %d must be evicted", i)
+					}
+					evicted++
+				} else if err != nil {
+					t.Errorf("new entry %d must be kept: %v", i, err)
+				}
+			}
+		})
+	}
+}
+
+func TestWatermarkConfig(t *testing.T) {
+	for _, wm := range [][2]int{{101, 50}, {50, 80}, {-1, 0}} {
+		if _, err := newWatermarkEvictor(nil, wm[0], wm[1]); err == nil {
+			t.Errorf("watermark (high=%d, low=%d) must be invalid", wm[0], wm[1])
+		}
+	}
+}
+
+func TestWatermarkStopOnClose(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testcache")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	c, err := NewDirectoryCache(tmp, DirectoryCacheConfig{SyncAdd: true})
+	if err != nil {
+		t.Fatalf("failed to make cache: %v", err)
+	}
+	dc := c.(*directoryCache)
+	we, err := newWatermarkEvictor(dc, 80, 50)
+	if err != nil {
+		t.Fatalf("failed to make evictor: %v", err)
+	}
+	we.usage = func(dir string) (float64, error) { return 0, nil }
+	stopped := make(chan struct{})
+	go func() {
+		we.run(time.Millisecond, dc.done)
+		close(stopped)
+	}()
+	if err := dc.Close(); err != nil {
+		t.Fatalf("failed to close cache: %v", err)
+	}
+	if err := dc.Close(); err != nil {
+		t.Fatalf("closing cache twice must succeed: %v", err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("watermark checker must stop on Close")
+	}
+}
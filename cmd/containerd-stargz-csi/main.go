@@ -0,0 +1,102 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/stargz-snapshotter/csi"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultEndpoint   = "/run/containerd-stargz-csi/csi.sock"
+	defaultDriverName = "stargz.csi.containerd.io"
+	defaultLogLevel   = logrus.InfoLevel
+	driverVersion     = "v0.1.0"
+)
+
+var (
+	endpoint    = flag.String("endpoint", defaultEndpoint, "path to the unix socket of the CSI server")
+	driverName  = flag.String("driver-name", defaultDriverName, "name of the CSI driver")
+	nodeID      = flag.String("node-id", "", "ID of the node (e.g. the name of the Kubernetes node)")
+	address     = flag.String("containerd-address", "/run/containerd/containerd.sock", "address of containerd")
+	namespace   = flag.String("namespace", "k8s.io", "containerd namespace where images are pulled")
+	snapshotter = flag.String("snapshotter", "stargz", "snapshotter which mounts images")
+	logLevel    = flag.String("log-level", defaultLogLevel.String(), "set the logging level [trace, debug, info, warn, error, fatal, panic]")
+)
+
+func main() {
+	flag.Parse()
+	lvl, err := logrus.ParseLevel(*logLevel)
+	if err != nil {
+		log.L.WithError(err).Fatal("failed to prepare logger")
+	}
+	logrus.SetLevel(lvl)
+	logrus.SetFormatter(&logrus.JSONFormatter{
+		TimestampFormat: log.RFC3339NanoFixed,
+	})
+	ctx := log.WithLogger(context.Background(), log.L)
+
+	if *nodeID == "" {
+		if *nodeID, err = os.Hostname(); err != nil {
+			log.G(ctx).WithError(err).Fatal("failed to get node ID")
+		}
+	}
+	client, err := containerd.New(*address, containerd.WithDefaultNamespace(*namespace))
+	if err != nil {
+		log.G(ctx).WithError(err).Fatalf("failed to connect to containerd %q", *address)
+	}
+	defer client.Close()
+
+	d := csi.NewDriver(*driverName, driverVersion, *nodeID, csi.NewContainerdBackend(client, *snapshotter))
+	rpc := csi.NewServer(d)
+
+	// Prepare the directory for the socket
+	if err := os.MkdirAll(filepath.Dir(*endpoint), 0700); err != nil {
+		log.G(ctx).WithError(err).Fatalf("failed to create directory %q", filepath.Dir(*endpoint))
+	}
+
+	// Try to remove the socket file to avoid EADDRINUSE
+	if err := os.RemoveAll(*endpoint); err != nil {
+		log.G(ctx).WithError(err).Fatalf("failed to remove %q", *endpoint)
+	}
+
+	l, err := net.Listen("unix", *endpoint)
+	if err != nil {
+		log.G(ctx).WithError(err).Fatalf("error on listen socket %q", *endpoint)
+	}
+	go func() {
+		if err := rpc.Serve(l); err != nil {
+			log.G(ctx).WithError(err).Fatalf("error on serving via socket %q", *endpoint)
+		}
+	}()
+	log.G(ctx).WithField("driver", *driverName).WithField("node", *nodeID).Info("serving CSI")
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	<-c
+	rpc.GracefulStop()
+}
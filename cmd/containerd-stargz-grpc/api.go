@@ -0,0 +1,378 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots"
+	stargzfs "github.com/containerd/stargz-snapshotter/fs"
+	snbase "github.com/containerd/stargz-snapshotter/snapshot"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// serveAPI serves the HTTP API of this snapshotter on the specified unix socket.
+// Clients (e.g. CRI plugin's image pull progress reporter) can get information
+// about lazily pulled layers through this API.
+func serveAPI(ctx context.Context, address string, fs snbase.FileSystem, sn snapshots.Snapshotter, gc *layerGC) error {
+	m := http.NewServeMux()
+	if pr, ok := fs.(stargzfs.ProgressReporter); ok {
+		m.HandleFunc("/progress", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(ctx, w, pr.Progress(r.Context()))
+		})
+	}
+	if dr, ok := fs.(stargzfs.DedupReporter); ok {
+		m.HandleFunc("/stats/dedup", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(ctx, w, dr.DedupStats(r.Context()))
+		})
+	}
+	if fr, ok := fs.(stargzfs.FDReporter); ok {
+		m.HandleFunc("/stats/fds", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(ctx, w, fr.FDStats(r.Context()))
+		})
+	}
+	if mr, ok := fs.(stargzfs.MemoryReporter); ok {
+		m.HandleFunc("/stats/memory", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(ctx, w, mr.MemoryStats(r.Context()))
+		})
+	}
+	if tr, ok := fs.(stargzfs.TagPinReporter); ok {
+		m.HandleFunc("/stats/tags", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(ctx, w, tr.TagPins(r.Context()))
+		})
+	}
+	if wr, ok := fs.(stargzfs.LatencyWatchdogReporter); ok {
+		m.HandleFunc("/stats/watchdog", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(ctx, w, wr.LatencyWatchdogEvents(r.Context()))
+		})
+	}
+	if ir, ok := fs.(stargzfs.IntegrityReporter); ok {
+		m.HandleFunc("/stats/integrity", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(ctx, w, ir.IntegrityStats(r.Context()))
+		})
+	}
+	if rr, ok := fs.(stargzfs.RateLimitReporter); ok {
+		m.HandleFunc("/stats/ratelimit", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(ctx, w, rr.RateLimitStats(r.Context()))
+		})
+	}
+	if ir, ok := fs.(stargzfs.CacheInventoryReporter); ok {
+		m.HandleFunc("/stats/inventory", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(ctx, w, ir.CacheInventory(r.Context()))
+		})
+	}
+	if ci, ok := fs.(stargzfs.CacheInvalidator); ok {
+		m.HandleFunc("/invalidate", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			dgst := r.URL.Query().Get("digest")
+			if dgst == "" {
+				http.Error(w, "digest must be specified", http.StatusBadRequest)
+				return
+			}
+			if err := ci.InvalidateLayerCache(r.Context(), dgst); err != nil {
+				log.G(ctx).WithError(err).WithField("digest", dgst).Warn("failed to invalidate layer cache")
+				writeError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		})
+	}
+	if cp, ok := fs.(stargzfs.CachePinner); ok {
+		pinHandler := func(pin bool) http.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost {
+					http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+					return
+				}
+				dgsts := r.URL.Query()["digest"]
+				if len(dgsts) == 0 {
+					http.Error(w, "digest must be specified", http.StatusBadRequest)
+					return
+				}
+				for _, d := range dgsts {
+					if _, err := digest.Parse(d); err != nil {
+						http.Error(w, fmt.Sprintf("invalid digest %q: %v", d, err), http.StatusBadRequest)
+						return
+					}
+				}
+				var err error
+				if pin {
+					err = cp.PinLayers(r.Context(), r.URL.Query().Get("ref"), dgsts)
+				} else {
+					err = cp.UnpinLayers(r.Context(), dgsts)
+				}
+				if err != nil {
+					writeError(w, err)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			}
+		}
+		m.HandleFunc("/pin", pinHandler(true))
+		m.HandleFunc("/unpin", pinHandler(false))
+		m.HandleFunc("/pins", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(ctx, w, cp.Pins(r.Context()))
+		})
+	}
+	if gc != nil {
+		m.HandleFunc("/gc", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+			res, err := collectGarbage(r.Context(), gc, sn, dryRun)
+			if err != nil {
+				log.G(ctx).WithError(err).Warn("failed to collect garbage")
+				writeError(w, err)
+				return
+			}
+			writeJSON(ctx, w, res)
+		})
+	}
+	if ft, ok := fs.(stargzfs.FUSETracer); ok {
+		m.HandleFunc("/debug/fuse-trace", func(w http.ResponseWriter, r *http.Request) {
+			duration, err := durationParam(r, "duration", defaultFUSETraceDuration)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			threshold, err := durationParam(r, "threshold", defaultFUSETraceThreshold)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			res, err := ft.TraceFUSE(r.Context(), duration, threshold)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			writeJSON(ctx, w, res)
+		})
+	}
+
+	// Go runtime profiles and traces.
+	m.HandleFunc("/debug/pprof/", pprof.Index)
+	m.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	m.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	m.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	m.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	if ex, ok := sn.(exporter); ok {
+		m.HandleFunc("/export", func(w http.ResponseWriter, r *http.Request) {
+			key := r.URL.Query().Get("key")
+			if key == "" {
+				http.Error(w, "key must be specified", http.StatusBadRequest)
+				return
+			}
+			merged, _ := strconv.ParseBool(r.URL.Query().Get("merged"))
+			w.Header().Set("Content-Type", ocispec.MediaTypeImageLayer)
+			if err := ex.Export(r.Context(), key, w, merged); err != nil {
+				// Headers might have been sent. The client detects the failure
+				// by the broken tar stream.
+				log.G(ctx).WithError(err).WithField("key", key).Warn("failed to export snapshot")
+				writeError(w, err)
+				return
+			}
+		})
+	}
+
+	if wr, ok := sn.(writeReporter); ok {
+		m.HandleFunc("/stats/writes", func(w http.ResponseWriter, r *http.Request) {
+			top := defaultWriteReportTop
+			if v := r.URL.Query().Get("top"); v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("invalid top %q: %v", v, err), http.StatusBadRequest)
+					return
+				}
+				top = n
+			}
+			res, err := wr.WriteReports(r.Context(), top)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			writeJSON(ctx, w, res)
+		})
+	}
+
+	if fr, ok := fs.(stargzfs.FetchLogReporter); ok {
+		if rm, ok := sn.(remoteMountpointer); ok {
+			m.HandleFunc("/stats/fetches", func(w http.ResponseWriter, r *http.Request) {
+				key := r.URL.Query().Get("key")
+				if key == "" {
+					http.Error(w, "key must be specified", http.StatusBadRequest)
+					return
+				}
+				var since time.Time
+				if v := r.URL.Query().Get("since"); v != "" {
+					t, err := time.Parse(time.RFC3339Nano, v)
+					if err != nil {
+						http.Error(w, fmt.Sprintf("invalid since %q: %v", v, err), http.StatusBadRequest)
+						return
+					}
+					since = t
+				}
+				mps, err := rm.RemoteMountpoints(r.Context(), key)
+				if err != nil {
+					writeError(w, err)
+					return
+				}
+				writeJSON(ctx, w, fr.FetchLog(r.Context(), mps, since))
+			})
+		}
+	}
+
+	if sr, ok := fs.(stargzfs.SnapshotStatsReporter); ok {
+		if rm, ok := sn.(remoteMountpointer); ok {
+			m.HandleFunc("/stats/snapshot", func(w http.ResponseWriter, r *http.Request) {
+				key := r.URL.Query().Get("key")
+				if key == "" {
+					http.Error(w, "key must be specified", http.StatusBadRequest)
+					return
+				}
+				window, err := durationParam(r, "window", defaultSnapshotStatsWindow)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				mps, err := rm.RemoteMountpoints(r.Context(), key)
+				if err != nil {
+					writeError(w, err)
+					return
+				}
+				writeJSON(ctx, w, sr.SnapshotStats(r.Context(), mps, window))
+			})
+		}
+	}
+
+	if rr, ok := fs.(stargzfs.ReadinessReporter); ok {
+		if rm, ok := sn.(remoteMountpointer); ok {
+			// Clients (e.g. readiness probes of containers) can check whether
+			// the prefetch of the layers of a snapshot finished.
+			m.HandleFunc("/readiness", func(w http.ResponseWriter, r *http.Request) {
+				key := r.URL.Query().Get("key")
+				if key == "" {
+					http.Error(w, "key must be specified", http.StatusBadRequest)
+					return
+				}
+				mps, err := rm.RemoteMountpoints(r.Context(), key)
+				if err != nil {
+					writeError(w, err)
+					return
+				}
+				writeJSON(ctx, w, rr.Readiness(r.Context(), mps))
+			})
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(address), 0700); err != nil {
+		return errors.Wrapf(err, "failed to create directory %q", filepath.Dir(address))
+	}
+	if err := os.RemoveAll(address); err != nil {
+		return errors.Wrapf(err, "failed to remove %q", address)
+	}
+	l, err := net.Listen("unix", address)
+	if err != nil {
+		return errors.Wrapf(err, "error on listen socket %q", address)
+	}
+	go func() {
+		if err := http.Serve(l, m); err != nil {
+			log.G(ctx).WithError(err).Errorf("error on serving API via socket %q", address)
+		}
+	}()
+	return nil
+}
+
+const (
+	defaultFUSETraceDuration   = 30 * time.Second
+	defaultFUSETraceThreshold  = 10 * time.Millisecond
+	defaultWriteReportTop      = 20
+	defaultSnapshotStatsWindow = 5 * time.Minute
+)
+
+func durationParam(r *http.Request, key string, def time.Duration) (time.Duration, error) {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid %s %q", key, v)
+	}
+	return d, nil
+}
+
+type materializer interface {
+	Materialize(ctx context.Context, key string) error
+}
+
+type exporter interface {
+	Export(ctx context.Context, key string, w io.Writer, merged bool) error
+}
+
+type dirCleaner interface {
+	CleanupDirs(ctx context.Context, dryRun bool) ([]snbase.CleanupDir, error)
+}
+
+type writeReporter interface {
+	WriteReports(ctx context.Context, top int) ([]snbase.WriteReport, error)
+}
+
+type remoteMountpointer interface {
+	RemoteMountpoints(ctx context.Context, key string) ([]string, error)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case errdefs.IsNotFound(err):
+		code = http.StatusNotFound
+	case errdefs.IsInvalidArgument(err):
+		code = http.StatusBadRequest
+	case errdefs.IsNotImplemented(err):
+		code = http.StatusNotImplemented
+	case errdefs.IsUnavailable(err):
+		code = http.StatusServiceUnavailable
+	}
+	http.Error(w, err.Error(), code)
+}
+
+func writeJSON(ctx context.Context, w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to write API response")
+	}
+}
@@ -0,0 +1,450 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	fsconfig "github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	snbase "github.com/containerd/stargz-snapshotter/snapshot"
+	"github.com/containerd/stargz-snapshotter/util/privilege"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// loadConfig decodes the config file into cfg. Unknown keys (e.g. typos) are
+// reported as errors.
+func loadConfig(path string, cfg *Config) error {
+	md, err := toml.DecodeFile(path, cfg)
+	if err != nil {
+		return err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		var keys []string
+		for _, k := range undecoded {
+			keys = append(keys, k.String())
+		}
+		return fmt.Errorf("unknown keys in %q: %s", path, strings.Join(keys, ", "))
+	}
+	return nil
+}
+
+// validateConfig checks values in the config. All invalid values are reported
+// at once.
+func validateConfig(cfg Config) error {
+	var errs *multierror.Error
+	invalid := func(key string, format string, a ...interface{}) {
+		errs = multierror.Append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, a...)))
+	}
+	for key, v := range map[string]string{
+		"http_cache_type":       cfg.HTTPCacheType,
+		"filesystem_cache_type": cfg.FSCacheType,
+	} {
+		if v != "" && v != "directory" && v != "memory" {
+			invalid(key, "must be \"directory\" or \"memory\" but %q", v)
+		}
+	}
+	switch cfg.FUSECacheMode {
+	case "", fsconfig.FUSECacheModeKeepCache, fsconfig.FUSECacheModeDirectIO:
+	default:
+		invalid("fuse_cache_mode", "must be %q or %q but %q",
+			fsconfig.FUSECacheModeKeepCache, fsconfig.FUSECacheModeDirectIO, cfg.FUSECacheMode)
+	}
+	switch cfg.ATimeMode {
+	case "", fsconfig.ATimeModeNoATime, fsconfig.ATimeModeRelATime, fsconfig.ATimeModeStrictATime:
+	default:
+		invalid("atime_mode", "must be %q, %q or %q but %q",
+			fsconfig.ATimeModeNoATime, fsconfig.ATimeModeRelATime, fsconfig.ATimeModeStrictATime, cfg.ATimeMode)
+	}
+	switch cfg.OverlayOpaqueType {
+	case "", fsconfig.OverlayOpaqueTrusted, fsconfig.OverlayOpaqueUser, fsconfig.OverlayOpaqueAll:
+	default:
+		invalid("overlay_opaque_type", "must be %q, %q or %q but %q",
+			fsconfig.OverlayOpaqueTrusted, fsconfig.OverlayOpaqueUser, fsconfig.OverlayOpaqueAll, cfg.OverlayOpaqueType)
+	}
+	if _, err := fsconfig.NewLabelFilter(cfg.LabelPassthrough); err != nil {
+		invalid("label_passthrough", "%v", err)
+	}
+	if cfg.OverlayDataOnlyVerity && !cfg.OverlayDataOnly && !cfg.Composefs {
+		invalid("overlay_data_only_verity", "requires overlay_data_only or composefs")
+	}
+	if err := snbase.OverlayFeatures(cfg.OverlayRedirectDir, "")(&snbase.SnapshotterConfig{}); err != nil {
+		invalid("overlay_redirect_dir", "%v", err)
+	} else if err := snbase.OverlayFeatures(cfg.OverlayRedirectDir, cfg.OverlayMetacopy)(&snbase.SnapshotterConfig{}); err != nil {
+		invalid("overlay_metacopy", "%v", err)
+	} else if (cfg.OverlayDataOnly || cfg.Composefs) && cfg.OverlayMetacopy == "off" {
+		invalid("overlay_metacopy", "must not be \"off\" with overlay_data_only or composefs")
+	}
+	if cfg.MergedViewMinLayers > 0 && (cfg.OverlayDataOnly || cfg.Composefs || cfg.UblkSquashfs) {
+		invalid("merged_view_min_layers", "conflicts with overlay_data_only, composefs and ublk_squashfs")
+	}
+	if cfg.AuditLog.Path != "" && cfg.AuditLog.Syslog {
+		invalid("audit_log.path", "conflicts with audit_log.syslog")
+	} else if cfg.AuditLog.Path != "" && !filepath.IsAbs(cfg.AuditLog.Path) {
+		invalid("audit_log.path", "must be an absolute path but %q", cfg.AuditLog.Path)
+	}
+	for key, v := range map[string]int64{
+		"resolve_result_entry":                         int64(cfg.ResolveResultEntry),
+		"prefetch_size":                                cfg.PrefetchSize,
+		"prefetch_timeout_sec":                         cfg.PrefetchTimeoutSec,
+		"max_concurrency":                              cfg.MaxConcurrency,
+		"mount_timeout_sec":                            cfg.MountTimeoutSec,
+		"sync_resolve_top_layers":                      int64(cfg.SyncResolveTopLayers),
+		"access_hints_learn_window_sec":                cfg.AccessHintsLearnWindowSec,
+		"scan_prefetch_threshold":                      int64(cfg.ScanPrefetchThreshold),
+		"scan_prefetch_max_file_size":                  cfg.ScanPrefetchMaxFileSize,
+		"idle_unmount_ttl_sec":                         cfg.IdleUnmountTTLSec,
+		"merged_view_min_layers":                       int64(cfg.MergedViewMinLayers),
+		"fd_soft_cap":                                  int64(cfg.FDSoftCap),
+		"fd_leak_check_interval_sec":                   cfg.FDLeakCheckIntervalSec,
+		"max_memory_bytes":                             cfg.MaxMemoryBytes,
+		"memory_check_interval_sec":                    cfg.MemoryCheckIntervalSec,
+		"streaming_read_threshold":                     cfg.StreamingReadThreshold,
+		"tag_drift_check_interval_sec":                 cfg.TagDriftCheckIntervalSec,
+		"image_volume.prefetch_size":                   cfg.ImageVolume.PrefetchSize,
+		"privilege.serve_uid":                          int64(cfg.Privilege.ServeUID),
+		"privilege.serve_gid":                          int64(cfg.Privilege.ServeGID),
+		"latency_watchdog.threshold_msec":              cfg.LatencyWatchdog.ThresholdMsec,
+		"latency_watchdog.window_sec":                  cfg.LatencyWatchdog.WindowSec,
+		"latency_watchdog.min_samples":                 int64(cfg.LatencyWatchdog.MinSamples),
+		"chunk_integrity.quarantine_threshold":         int64(cfg.ChunkIntegrity.QuarantineThreshold),
+		"containerd_gc.debounce_sec":                   cfg.ContainerdGC.DebounceSec,
+		"blob.valid_interval":                          cfg.BlobConfig.ValidInterval,
+		"blob.chunk_size":                              cfg.BlobConfig.ChunkSize,
+		"blob.fetching_timeout_sec":                    cfg.BlobConfig.FetchTimeoutSec,
+		"blob.resolve_timeout_sec":                     cfg.BlobConfig.ResolveTimeoutSec,
+		"blob.toc_fetching_timeout_sec":                cfg.BlobConfig.TOCFetchTimeoutSec,
+		"blob.prefetch_fetching_timeout_sec":           cfg.BlobConfig.PrefetchFetchTimeoutSec,
+		"blob.on_demand_fetching_timeout_sec":          cfg.BlobConfig.OnDemandFetchTimeoutSec,
+		"blob.max_concurrent_fetches":                  int64(cfg.BlobConfig.MaxConcurrentFetches),
+		"blob.hedging.min_delay_msec":                  cfg.BlobConfig.Hedging.MinDelayMsec,
+		"directory_cache.max_lru_cache_entry":          int64(cfg.DirectoryCacheConfig.MaxLRUCacheEntry),
+		"directory_cache.max_cache_fds":                int64(cfg.DirectoryCacheConfig.MaxCacheFds),
+		"directory_cache.watermark_check_interval_sec": cfg.DirectoryCacheConfig.WatermarkCheckIntervalSec,
+		"directory_cache.hot_cache_max_bytes":          cfg.DirectoryCacheConfig.HotCacheMaxBytes,
+		"directory_cache.hot_cache_promote_after_hits": int64(cfg.DirectoryCacheConfig.HotCachePromoteAfterHits),
+		"directory_cache.decompressed_cache_max_bytes": cfg.DirectoryCacheConfig.DecompressedCacheMaxBytes,
+	} {
+		if v < 0 {
+			invalid(key, "must not be negative but %d", v)
+		}
+	}
+	if _, err := privilege.ParseCapabilities(cfg.Privilege.KeepCapabilities); err != nil {
+		invalid("privilege.keep_capabilities", "%v", err)
+	}
+	dc := cfg.DirectoryCacheConfig
+	for key, v := range map[string]int{
+		"directory_cache.high_watermark_percent": dc.HighWatermarkPercent,
+		"directory_cache.low_watermark_percent":  dc.LowWatermarkPercent,
+		"blob.hedging.percentile":                cfg.BlobConfig.Hedging.Percentile,
+		"blob.hedging.budget_percent":            cfg.BlobConfig.Hedging.BudgetPercent,
+	} {
+		if v < 0 || v > 100 {
+			invalid(key, "must be in [0, 100] but %d", v)
+		}
+	}
+	if dc.HighWatermarkPercent > 0 && dc.LowWatermarkPercent > dc.HighWatermarkPercent {
+		invalid("directory_cache.low_watermark_percent", "must not be larger than high_watermark_percent (%d) but %d",
+			dc.HighWatermarkPercent, dc.LowWatermarkPercent)
+	}
+
+	var hosts []string
+	for h := range cfg.ResolverConfig.Host {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+	for _, h := range hosts {
+		hc := cfg.ResolverConfig.Host[h]
+		key := fmt.Sprintf("resolver.host.%q", h)
+		if _, err := proxyFunc(hc.Proxy); err != nil {
+			invalid(key+".proxy", "%v", err)
+		}
+		if err := validateTLSConfig(hc.TLSConfig, cfg.FIPS); err != nil {
+			invalid(key, "%v", err)
+		}
+		if err := validateHeader(hc.Header); err != nil {
+			invalid(key+".header", "%v", err)
+		}
+		for i, m := range hc.Mirrors {
+			mkey := fmt.Sprintf("%s.mirrors[%d]", key, i)
+			if m.Host == "" {
+				invalid(mkey+".host", "must be specified")
+			} else if strings.Contains(m.Host, "://") || strings.Contains(m.Host, "/") {
+				invalid(mkey+".host", "must be a host name without scheme and path but %q", m.Host)
+			}
+			if _, err := proxyFunc(m.Proxy); err != nil {
+				invalid(mkey+".proxy", "%v", err)
+			}
+			if err := validateTLSConfig(m.TLSConfig, cfg.FIPS); err != nil {
+				invalid(mkey, "%v", err)
+			}
+			if err := validateHeader(m.Header); err != nil {
+				invalid(mkey+".header", "%v", err)
+			}
+		}
+	}
+
+	if cm := cfg.CacheMirror; cm.Address != "" {
+		if cm.CertFile == "" || cm.KeyFile == "" {
+			invalid("cache_mirror", "cert_file and key_file must be specified")
+		}
+		if len(cm.Tokens) == 0 {
+			invalid("cache_mirror.tokens", "must be specified")
+		}
+		for i, t := range cm.Tokens {
+			key := fmt.Sprintf("cache_mirror.tokens[%d]", i)
+			if t.TokenFile == "" {
+				invalid(key+".token_file", "must be specified")
+			}
+			if len(t.Repositories) == 0 {
+				invalid(key+".repositories", "must be specified")
+			}
+			for _, r := range t.Repositories {
+				if _, err := path.Match(r, ""); err != nil {
+					invalid(key+".repositories", "invalid pattern %q: %v", r, err)
+				}
+			}
+		}
+	}
+
+	registered := make(map[string]bool)
+	for _, name := range source.Providers() {
+		registered[name] = true
+	}
+	var plugins []string
+	for name := range cfg.SourcePlugins {
+		plugins = append(plugins, name)
+	}
+	sort.Strings(plugins)
+	for _, name := range plugins {
+		key := fmt.Sprintf("source_plugins.%q", name)
+		if registered[name] {
+			invalid(key, "conflicts with the built-in source provider")
+		}
+		if cfg.SourcePlugins[name].Address == "" {
+			invalid(key+".address", "must be specified")
+		}
+		registered[name] = true
+	}
+	providers := cfg.SourceProviders
+	if len(providers) == 0 {
+		providers = defaultSourceProviders
+	}
+	configured := make(map[string]bool)
+	for i, name := range providers {
+		if !registered[name] {
+			invalid(fmt.Sprintf("source_providers[%d]", i), "must be a source provider or a source plugin but %q", name)
+		}
+		configured[name] = true
+	}
+	for name := range cfg.SourceProviderConfig {
+		if !configured[name] {
+			invalid(fmt.Sprintf("source_provider_config.%q", name), "isn't used by source_providers")
+		}
+	}
+	return errs.ErrorOrNil()
+}
+
+func validateTLSConfig(cfg TLSConfig, fips bool) error {
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return fmt.Errorf("cert_file and key_file must be specified together")
+	}
+	if fips && cfg.InsecureSkipVerify {
+		return fmt.Errorf("insecure_skip_verify isn't allowed with fips")
+	}
+	return nil
+}
+
+// validateHeader validates header fields of requests to registry hosts. Fields
+// controlled by the snapshotter can't be overridden.
+func validateHeader(header map[string]string) error {
+	for k, v := range header {
+		if k == "" || strings.ContainsAny(k, " \t\r\n:") {
+			return fmt.Errorf("invalid field name %q", k)
+		}
+		if strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("invalid value of %q", k)
+		}
+		switch http.CanonicalHeaderKey(k) {
+		case "Host", "Range":
+			return fmt.Errorf("%q can't be overridden", k)
+		case "User-Agent":
+			return fmt.Errorf("%q must be specified by user_agent", k)
+		}
+	}
+	return nil
+}
+
+// checkResult is the result of a check of --check-config.
+type checkResult struct {
+	name string
+	err  error
+}
+
+// checkNode checks the config and the node prerequisites needed for serving the
+// snapshotter.
+func checkNode(cfg Config, root string) (results []checkResult) {
+	check := func(name string, err error) {
+		results = append(results, checkResult{name, err})
+	}
+	check("config values", validateConfig(cfg))
+
+	// Resolver hosts
+	hosts := hostsFromConfig(cfg.ResolverConfig, authn.DefaultKeychain, cfg.FIPS)
+	var names []string
+	for h := range cfg.ResolverConfig.Host {
+		names = append(names, h)
+	}
+	sort.Strings(names)
+	for _, h := range names {
+		rhosts, err := hosts(h)
+		if err != nil {
+			check(fmt.Sprintf("resolver host %q", h), err)
+			continue
+		}
+		for _, rh := range rhosts {
+			scheme := rh.Scheme
+			if scheme == "" {
+				scheme = "https"
+			}
+			check(fmt.Sprintf("connection to %q", rh.Host), pingRegistry(rh.Client, scheme+"://"+rh.Host+rh.Path+"/"))
+		}
+	}
+
+	// Paths
+	check(fmt.Sprintf("root directory %q", root), checkWritableDir(root))
+	if d := cfg.DirectoryCacheConfig.HotCacheDir; d != "" {
+		check(fmt.Sprintf("hot cache directory %q", d), checkWritableDir(d))
+	}
+	if kc := cfg.KubeconfigKeychainConfig; kc.EnableKeychain && kc.KubeconfigPath != "" {
+		_, err := os.Stat(kc.KubeconfigPath)
+		check(fmt.Sprintf("kubeconfig %q", kc.KubeconfigPath), err)
+	}
+	if ci := cfg.CacheInventory; ci.NodeAnnotation && ci.KubeconfigPath != "" {
+		_, err := os.Stat(ci.KubeconfigPath)
+		check(fmt.Sprintf("kubeconfig %q", ci.KubeconfigPath), err)
+	}
+
+	// FUSE and kernel
+	f, err := os.OpenFile("/dev/fuse", os.O_RDWR, 0)
+	if err == nil {
+		f.Close()
+	}
+	check("/dev/fuse", err)
+	if isRootless() {
+		checkRootless(cfg, check)
+	}
+	fss, err := kernelFilesystems()
+	if err != nil {
+		check("kernel filesystems", err)
+	} else {
+		for _, fs := range []string{"fuse", "overlay"} {
+			if !fss[fs] {
+				err = fmt.Errorf("%q isn't supported by the kernel (modprobe %s?)", fs, fs)
+			}
+			check(fmt.Sprintf("filesystem %q", fs), err)
+			err = nil
+		}
+	}
+	if c := cfg.FDSoftCap; c > 0 {
+		var rlimit unix.Rlimit
+		err := unix.Getrlimit(unix.RLIMIT_NOFILE, &rlimit)
+		if err == nil && uint64(c) >= rlimit.Cur {
+			err = fmt.Errorf("fd_soft_cap %d isn't below RLIMIT_NOFILE %d", c, rlimit.Cur)
+		}
+		check("RLIMIT_NOFILE for fd_soft_cap", err)
+	}
+	if cfg.EBPFAccessHints {
+		err := fmt.Errorf("tracefs not found")
+		for _, p := range []string{"/sys/kernel/tracing", "/sys/kernel/debug/tracing"} {
+			if _, sErr := os.Stat(filepath.Join(p, "kprobe_events")); sErr == nil {
+				err = nil
+				break
+			}
+		}
+		check("tracefs for ebpf_access_hints", err)
+	}
+	if cfg.UblkSquashfs {
+		f, err := os.OpenFile("/dev/ublk-control", os.O_RDWR, 0)
+		if err == nil {
+			f.Close()
+		} else if os.IsNotExist(err) {
+			err = fmt.Errorf("ublk isn't supported by the kernel (modprobe ublk_drv?)")
+		}
+		check("/dev/ublk-control for ublk_squashfs", err)
+	}
+	return results
+}
+
+func pingRegistry(client *http.Client, url string) error {
+	c := *client
+	c.Timeout = 10 * time.Second
+	resp, err := c.Get(url)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func checkWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".check")
+	if err != nil {
+		return errors.Wrap(err, "not writable")
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// kernelFilesystems returns filesystems supported by the kernel.
+func kernelFilesystems() (map[string]bool, error) {
+	f, err := os.Open("/proc/filesystems")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fss := make(map[string]bool)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) > 0 {
+			fss[fields[len(fields)-1]] = true
+		}
+	}
+	return fss, sc.Err()
+}
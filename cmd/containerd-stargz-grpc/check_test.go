@@ -0,0 +1,172 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testconfig")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	tests := []struct {
+		name    string
+		config  string
+		wantErr []string
+	}{
+		{
+			name: "valid",
+			config: `
+noprefetch = true
+source_providers = ["cdn", "default"]
+label_passthrough = ["containerd.io/snapshot/example.com/*"]
+[directory_cache]
+high_watermark_percent = 80
+low_watermark_percent = 70
+[resolver.host."docker.io"]
+user_agent = "example-agent/1.0"
+[resolver.host."docker.io".header]
+x-trace-id = "abc"
+[[resolver.host."docker.io".mirrors]]
+host = "mirror.test"
+[source_provider_config.default]
+foo = "bar"
+[source_plugins.cdn]
+address = "/run/cdn.sock"
+[cache_mirror]
+address = ":8079"
+cert_file = "/etc/mirror.crt"
+key_file = "/etc/mirror.key"
+[[cache_mirror.tokens]]
+token_file = "/etc/mirror-token"
+repositories = ["docker.io/library/*"]
+`,
+		},
+		{
+			name: "unknown keys",
+			config: `
+noprefetch = true
+no_prefetch = true
+[directory_cache]
+max_lru_cache_entries = 10
+`,
+			wantErr: []string{"no_prefetch", "directory_cache.max_lru_cache_entries"},
+		},
+		{
+			name: "invalid values",
+			config: `
+http_cache_type = "disk"
+max_concurrency = -1
+fuse_cache_mode = "mmap"
+atime_mode = "lazytime"
+overlay_metacopy = "yes"
+overlay_data_only_verity = true
+merged_view_min_layers = 2
+ublk_squashfs = true
+source_providers = ["unknown"]
+label_passthrough = [""]
+fips = true
+[directory_cache]
+high_watermark_percent = 120
+low_watermark_percent = 50
+[resolver.host."docker.io"]
+insecure_skip_verify = true
+[[resolver.host."docker.io".mirrors]]
+host = "https://mirror.test"
+cert_file = "/etc/cert.pem"
+[resolver.host."docker.io".mirrors.header]
+Range = "bytes=0-1"
+[source_provider_config.cri]
+foo = "bar"
+[source_plugins.default]
+[blob.hedging]
+enable = true
+percentile = 101
+[audit_log]
+path = "audit.log"
+[privilege]
+serve_uid = -1
+keep_capabilities = ["CAP_UNKNOWN"]
+[cache_mirror]
+address = ":8079"
+[[cache_mirror.tokens]]
+repositories = ["docker.io/["]
+`,
+			wantErr: []string{
+				"http_cache_type",
+				"max_concurrency",
+				"fuse_cache_mode",
+				"atime_mode",
+				"overlay_metacopy",
+				"overlay_data_only_verity",
+				"merged_view_min_layers",
+				"label_passthrough",
+				"directory_cache.high_watermark_percent",
+				"insecure_skip_verify isn't allowed with fips",
+				`resolver.host."docker.io".mirrors[0].host`,
+				"cert_file and key_file",
+				`resolver.host."docker.io".mirrors[0].header`,
+				"source_providers[0]",
+				`source_provider_config."cri"`,
+				`source_plugins."default"`,
+				`source_plugins."default".address`,
+				"blob.hedging.percentile",
+				"audit_log.path",
+				"privilege.serve_uid",
+				"privilege.keep_capabilities",
+				"cache_mirror: cert_file and key_file must be specified",
+				"cache_mirror.tokens[0].token_file",
+				"cache_mirror.tokens[0].repositories",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := filepath.Join(tmp, tt.name+".toml")
+			if err := ioutil.WriteFile(p, []byte(tt.config), 0600); err != nil {
+				t.Fatalf("failed to write config: %v", err)
+			}
+			var cfg Config
+			err := loadConfig(p, &cfg)
+			if err == nil {
+				err = validateConfig(cfg)
+			}
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Fatalf("failed to load valid config: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("invalid config must be rejected")
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q must mention %q", err, want)
+				}
+			}
+		})
+	}
+}
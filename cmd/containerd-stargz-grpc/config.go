@@ -26,6 +26,154 @@ type Config struct {
 
 	// ResolverConfig is config for resolving registries.
 	ResolverConfig `toml:"resolver"`
+
+	// SourceProviders is the names of source providers consulted in order
+	// for getting sources of layers from snapshot labels. Defaults to
+	// ["cri", "default"].
+	SourceProviders []string `toml:"source_providers"`
+
+	// SourceProviderConfig is provider-specific configuration keyed by
+	// provider names.
+	SourceProviderConfig map[string]map[string]string `toml:"source_provider_config"`
+
+	// SourcePlugins is blob source plugins running as separate processes
+	// keyed by provider names. These names can be used in SourceProviders.
+	SourcePlugins map[string]SourcePluginConfig `toml:"source_plugins"`
+
+	// IdleUnmountTTLSec is the duration after which remote snapshots not used
+	// by any container are unmounted until the next access. 0 disables it.
+	IdleUnmountTTLSec int64 `toml:"idle_unmount_ttl_sec"`
+
+	// RouteToOverlayfs serves images which can't be lazily pulled (i.e. layers
+	// without eStargz or Nydus annotations) by the overlayfs snapshotter
+	// instead of trying remote snapshots for them. Each image is routed by its
+	// lowest layer.
+	RouteToOverlayfs bool `toml:"route_to_overlayfs"`
+
+	// OverlayRedirectDir and OverlayMetacopy are the "redirect_dir" and
+	// "metacopy" options of overlayfs mounts stacked on the layers. Empty
+	// means the default; metacopy is turned off if the overlay module enables
+	// it by default, except for data-only layers which need it.
+	OverlayRedirectDir string `toml:"overlay_redirect_dir"`
+	OverlayMetacopy    string `toml:"overlay_metacopy"`
+
+	// MergedViewMinLayers is the number of lower layers of a container from
+	// which they are passed to overlayfs as a single FUSE mount presenting
+	// their merged tree instead of one lowerdir per layer. This is applied
+	// only if all the lower layers are lazily pulled. 0 disables it.
+	MergedViewMinLayers int `toml:"merged_view_min_layers"`
+
+	// Offline serves layers exclusively from the cache imported by
+	// "ctr-remote cache import" and never contacts registries. Source
+	// providers and the resolver configuration are ignored.
+	Offline bool `toml:"offline"`
+
+	// OfflineCacheDir is the cache directory of the offline mode. Defaults to
+	// "offline" under the root directory.
+	OfflineCacheDir string `toml:"offline_cache_dir"`
+
+	// ContainerdGC is config for cleaning caches of layers of images removed
+	// from containerd.
+	ContainerdGC ContainerdGCConfig `toml:"containerd_gc"`
+
+	// CacheMirror is config for serving cached contents of layers to other
+	// nodes over HTTP.
+	CacheMirror CacheMirrorConfig `toml:"cache_mirror"`
+
+	// Events is config for publishing lifecycle events of layers to
+	// containerd.
+	Events EventsConfig `toml:"events"`
+
+	// CacheInventory is config for publishing caches of images mounted on
+	// this node to Kubernetes.
+	CacheInventory CacheInventoryConfig `toml:"cache_inventory"`
+}
+
+// CacheInventoryConfig is config for publishing caches of images mounted on
+// this node as an annotation of the Kubernetes Node.
+type CacheInventoryConfig struct {
+	// NodeAnnotation enables the annotation
+	// "stargz.containerd.io/image-caches" of the Node.
+	NodeAnnotation bool `toml:"node_annotation"`
+
+	// NodeName is the name of the Node. Defaults to $NODE_NAME and then the
+	// hostname.
+	NodeName string `toml:"node_name"`
+
+	// KubeconfigPath is the kubeconfig used for updating the Node. Defaults to
+	// $KUBECONFIG, ~/.kube/config and then the in-cluster config.
+	KubeconfigPath string `toml:"kubeconfig_path"`
+
+	// IntervalSec is the interval of updating the annotation. Defaults to 60.
+	IntervalSec int64 `toml:"interval_sec"`
+}
+
+// EventsConfig is config for publishing lifecycle events of layers (e.g.
+// "resolved" and "prefetched") as containerd events.
+type EventsConfig struct {
+	// Enable publishes the events.
+	Enable bool `toml:"enable"`
+
+	// Address is the address of containerd. Defaults to
+	// /run/containerd/containerd.sock.
+	Address string `toml:"address"`
+
+	// Namespace is the namespace of events not associated with a request
+	// from containerd. Defaults to "default".
+	Namespace string `toml:"namespace"`
+}
+
+// CacheMirrorConfig is config for the read-only HTTPS server of cached
+// contents of layers.
+type CacheMirrorConfig struct {
+	// Address is the TCP address (e.g. ":8079") the server listens on. Empty
+	// disables the server.
+	Address string `toml:"address"`
+
+	// Tokens are the bearer tokens which clients must present in the
+	// Authorization header. At least one is mandatory.
+	Tokens []CacheMirrorTokenConfig `toml:"tokens"`
+
+	// CertFile and KeyFile are PEM files of the server certificate and its
+	// key. These are mandatory so that tokens aren't sent in plain text.
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+}
+
+// CacheMirrorTokenConfig is a bearer token of the cache mirror and the
+// repositories it gives access to.
+type CacheMirrorTokenConfig struct {
+	// TokenFile is the file containing the token.
+	TokenFile string `toml:"token_file"`
+
+	// Repositories are patterns (in the syntax of path.Match) of repositories
+	// including the host (e.g. "docker.io/library/*"). Layers are served to
+	// holders of the token only if the layers are resolved from a matching
+	// repository.
+	Repositories []string `toml:"repositories"`
+}
+
+// ContainerdGCConfig is config for garbage collection driven by containerd
+// events.
+type ContainerdGCConfig struct {
+	// Enable subscribes to image and snapshot removal events of containerd
+	// and drops caches and metadata of layers no longer referenced by any
+	// image. A reconciliation pass also runs on startup.
+	Enable bool `toml:"enable"`
+
+	// Address is the address of containerd. Defaults to
+	// /run/containerd/containerd.sock.
+	Address string `toml:"address"`
+
+	// DebounceSec is the duration to wait for subsequent events before
+	// starting a pass. Defaults to 10.
+	DebounceSec int64 `toml:"debounce_sec"`
+}
+
+// SourcePluginConfig is config for a blob source plugin.
+type SourcePluginConfig struct {
+	// Address is the path to the unix socket the plugin listens on.
+	Address string `toml:"address"`
 }
 
 type KubeconfigKeychainConfig struct {
@@ -35,13 +183,81 @@ type KubeconfigKeychainConfig struct {
 
 type ResolverConfig struct {
 	Host map[string]HostConfig `toml:"host"`
+
+	// CertsDir is the directory containing per-host TLS files laid out in the
+	// same way as containerd's certs.d (e.g. <certs_dir>/<host>/ca.crt).
+	// Defaults to /etc/containerd/certs.d.
+	CertsDir string `toml:"certs_dir"`
+
+	// Rewrite is rules for rewriting repositories of image references before
+	// resolving them (e.g. for pulling images through a pull-through cache).
+	// The most specific rule matching a repository is used.
+	Rewrite []RewriteConfig `toml:"rewrite"`
+}
+
+// RewriteConfig is a rule for rewriting repositories of image references.
+type RewriteConfig struct {
+	// From is a repository (e.g. "docker.io/library/ubuntu") or a namespace
+	// with the trailing "/*" (e.g. "docker.io/*").
+	From string `toml:"from"`
+
+	// To is the repository or the namespace replacing From.
+	To string `toml:"to"`
+
+	// Fallback tries the original reference when the rewritten one fails.
+	Fallback bool `toml:"fallback"`
 }
 
 type HostConfig struct {
 	Mirrors []MirrorConfig `toml:"mirrors"`
+
+	// TLSConfig is used for connecting to the host itself.
+	TLSConfig
+
+	// Proxy is the proxy used for connecting to the host itself. See
+	// MirrorConfig.Proxy for the format.
+	Proxy string `toml:"proxy"`
+
+	// UserAgent and Header are used for requests to the host itself. See
+	// MirrorConfig for details.
+	UserAgent string            `toml:"user_agent"`
+	Header    map[string]string `toml:"header"`
 }
 
 type MirrorConfig struct {
 	Host     string `toml:"host"`
 	Insecure bool   `toml:"insecure"`
+
+	TLSConfig
+
+	// Proxy is the URL of the proxy used for connecting to the host, which
+	// overrides HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+	// "direct" connects to the host without proxy. Empty means using the
+	// environment variables.
+	Proxy string `toml:"proxy"`
+
+	// UserAgent overrides the User-Agent header of requests for the host,
+	// including ones to the token server and redirected blob locations.
+	UserAgent string `toml:"user_agent"`
+
+	// Header is HTTP header fields (e.g. tracing headers) added to requests
+	// to the host. These aren't sent to other hosts such as the token server
+	// and redirected blob locations.
+	Header map[string]string `toml:"header"`
+}
+
+// TLSConfig is TLS configuration for connecting to a registry host. This is
+// used in addition to the files in the certs directory of the host.
+type TLSConfig struct {
+	// CAFile is a PEM file of CA certificates trusted in addition to the
+	// system's ones.
+	CAFile string `toml:"ca_file"`
+
+	// CertFile and KeyFile are PEM files of the client certificate and its key
+	// for mutual TLS.
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+
+	// InsecureSkipVerify disables verification of the server's certificate.
+	InsecureSkipVerify bool `toml:"insecure_skip_verify"`
 }
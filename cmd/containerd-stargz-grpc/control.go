@@ -0,0 +1,42 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/stargz-snapshotter/snapshot/api"
+)
+
+// controlService serves the gRPC control API of remote snapshots on the
+// snapshotter's socket.
+type controlService struct {
+	m materializer
+}
+
+func (s *controlService) Materialize(ctx context.Context, req *api.MaterializeRequest) (*api.MaterializeResponse, error) {
+	if req.Key == "" {
+		return nil, errdefs.ToGRPCf(errdefs.ErrInvalidArgument, "key must be specified")
+	}
+	if err := s.m.Materialize(ctx, req.Key); err != nil {
+		log.G(ctx).WithError(err).WithField("key", req.Key).Warn("failed to materialize snapshot")
+		return nil, errdefs.ToGRPC(err)
+	}
+	return &api.MaterializeResponse{}, nil
+}
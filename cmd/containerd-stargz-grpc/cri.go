@@ -39,6 +39,21 @@ const (
 	targetImageLayersLabel = "containerd.io/snapshot/cri.image-layers"
 )
 
+// criSourceProvider is the name of the source provider based on CRI labels.
+const criSourceProvider = "cri"
+
+// defaultSourceProviders are source providers used when nothing is configured.
+var defaultSourceProviders = []string{
+	criSourceProvider,      // provides source info based on CRI labels
+	source.DefaultProvider, // provides source info based on default labels
+}
+
+func init() {
+	source.Register(criSourceProvider, func(cfg source.ProviderConfig) (source.GetSources, error) {
+		return sourceFromCRILabels(cfg.Hosts), nil
+	})
+}
+
 func sourceFromCRILabels(hosts docker.RegistryHosts) source.GetSources {
 	return func(labels map[string]string) ([]source.Source, error) {
 		refStr, ok := labels[targetRefLabel]
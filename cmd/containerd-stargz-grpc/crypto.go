@@ -0,0 +1,54 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// fipsCipherSuites are the TLS 1.2 cipher suites approved by FIPS 140.
+var fipsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+// restrictTLSToFIPS restricts the TLS configuration to the versions, cipher
+// suites and curves approved by FIPS 140. TLS 1.3 isn't used because its
+// cipher suites can't be configured.
+func restrictTLSToFIPS(tc *tls.Config) {
+	tc.MinVersion = tls.VersionTLS12
+	tc.MaxVersion = tls.VersionTLS12
+	tc.CipherSuites = fipsCipherSuites
+	tc.CurvePreferences = []tls.CurveID{tls.CurveP256, tls.CurveP384, tls.CurveP521}
+}
+
+// cryptoMode describes the cryptographic mode of the daemon. This is logged on
+// startup so deployments can confirm the mode.
+func cryptoMode(fips bool) string {
+	impl := "Go standard library (not FIPS validated)"
+	if boringCrypto {
+		impl = "BoringCrypto (FIPS-only TLS)"
+	}
+	algs := "all supported algorithms are allowed"
+	if fips {
+		algs = "only FIPS 140 approved algorithms are allowed"
+	}
+	return fmt.Sprintf("crypto: %s; %s", impl, algs)
+}
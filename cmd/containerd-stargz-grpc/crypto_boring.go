@@ -0,0 +1,27 @@
+//go:build boringcrypto
+// +build boringcrypto
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+// fipsonly restricts TLS to FIPS 140 approved settings in the whole process.
+import _ "crypto/tls/fipsonly"
+
+// boringCrypto is true if the daemon is built with BoringCrypto
+// (GOEXPERIMENT=boringcrypto).
+const boringCrypto = true
@@ -0,0 +1,136 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/events"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
+	stargzfs "github.com/containerd/stargz-snapshotter/fs"
+	"github.com/containerd/typeurl"
+	"github.com/pkg/errors"
+)
+
+const (
+	// eventTopicPrefix is the prefix of topics of lifecycle events of layers.
+	// The type of the event follows (e.g. "/snapshot/stargz/prefetched").
+	eventTopicPrefix = "/snapshot/stargz/"
+
+	defaultEventsNamespace = "default"
+	eventQueueSize         = 1024
+	eventPublishTimeout    = 5 * time.Second
+)
+
+func init() {
+	// Events are published as JSON with this type URL.
+	typeurl.Register(&stargzfs.Event{}, "stargz-snapshotter", "Event")
+}
+
+type queuedEvent struct {
+	namespace string
+	event     stargzfs.Event
+}
+
+// eventPublisher publishes lifecycle events of layers to containerd. Events
+// are queued so the filesystem is never blocked by containerd and are dropped
+// if the queue is full or containerd is unavailable.
+type eventPublisher struct {
+	namespace string
+	queue     chan queuedEvent
+
+	// connect returns the publisher of containerd and the function to close
+	// the connection.
+	connect func() (events.Publisher, func() error, error)
+}
+
+func newEventPublisher(cfg EventsConfig) *eventPublisher {
+	address := cfg.Address
+	if address == "" {
+		address = defaultContainerdAddress
+	}
+	namespace := cfg.Namespace
+	if namespace == "" {
+		namespace = defaultEventsNamespace
+	}
+	return &eventPublisher{
+		namespace: namespace,
+		queue:     make(chan queuedEvent, eventQueueSize),
+		connect: func() (events.Publisher, func() error, error) {
+			client, err := containerd.New(address)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "failed to connect to containerd")
+			}
+			return client.EventService(), client.Close, nil
+		},
+	}
+}
+
+// handle queues the event. The namespace of ctx is used if any.
+func (p *eventPublisher) handle(ctx context.Context, e stargzfs.Event) {
+	ns, ok := namespaces.Namespace(ctx)
+	if !ok {
+		ns = p.namespace
+	}
+	select {
+	case p.queue <- queuedEvent{namespace: ns, event: e}:
+	default:
+		log.G(ctx).WithField("type", e.Type).Warn("event queue is full; dropping event")
+	}
+}
+
+// run publishes queued events until ctx is done, connecting to containerd on
+// demand.
+func (p *eventPublisher) run(ctx context.Context) {
+	var (
+		pub     events.Publisher
+		closeFn func() error
+	)
+	defer func() {
+		if closeFn != nil {
+			closeFn()
+		}
+	}()
+	for {
+		var qe queuedEvent
+		select {
+		case <-ctx.Done():
+			return
+		case qe = <-p.queue:
+		}
+		if pub == nil {
+			var err error
+			if pub, closeFn, err = p.connect(); err != nil {
+				log.G(ctx).WithError(err).WithField("type", qe.event.Type).Warn("failed to publish event")
+				continue
+			}
+		}
+		pctx, cancel := context.WithTimeout(namespaces.WithNamespace(ctx, qe.namespace), eventPublishTimeout)
+		err := pub.Publish(pctx, eventTopicPrefix+qe.event.Type, &qe.event)
+		cancel()
+		if err != nil {
+			log.G(ctx).WithError(err).WithField("type", qe.event.Type).Warn("failed to publish event")
+
+			// Reconnect on the next event.
+			closeFn()
+			pub, closeFn = nil, nil
+		}
+	}
+}
@@ -0,0 +1,92 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/events"
+	"github.com/containerd/containerd/namespaces"
+	stargzfs "github.com/containerd/stargz-snapshotter/fs"
+	"github.com/containerd/typeurl"
+)
+
+type publishedEvent struct {
+	namespace string
+	topic     string
+	event     stargzfs.Event
+}
+
+type testPublisher struct {
+	published chan publishedEvent
+	fail      bool
+}
+
+func (tp *testPublisher) Publish(ctx context.Context, topic string, event events.Event) error {
+	if tp.fail {
+		tp.fail = false
+		return fmt.Errorf("failed")
+	}
+	ns, _ := namespaces.Namespace(ctx)
+	tp.published <- publishedEvent{ns, topic, *event.(*stargzfs.Event)}
+	return nil
+}
+
+func TestEventPublisher(t *testing.T) {
+	tp := &testPublisher{published: make(chan publishedEvent, 10), fail: true}
+	var connected int
+	p := newEventPublisher(EventsConfig{})
+	p.connect = func() (events.Publisher, func() error, error) {
+		connected++
+		return tp, func() error { return nil }, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.run(ctx)
+
+	p.handle(ctx, stargzfs.Event{Type: stargzfs.EventResolved}) // dropped by the failure
+	p.handle(namespaces.WithNamespace(ctx, "k8s.io"), stargzfs.Event{Type: stargzfs.EventPrefetched, Digest: "sha256:abc"})
+	p.handle(ctx, stargzfs.Event{Type: stargzfs.EventFallback})
+	for _, want := range []publishedEvent{
+		{"k8s.io", "/snapshot/stargz/prefetched", stargzfs.Event{Type: stargzfs.EventPrefetched, Digest: "sha256:abc"}},
+		{"default", "/snapshot/stargz/fallback", stargzfs.Event{Type: stargzfs.EventFallback}},
+	} {
+		select {
+		case got := <-tp.published:
+			if got != want {
+				t.Errorf("published %+v; want %+v", got, want)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("event %+v isn't published", want)
+		}
+	}
+	if connected != 2 {
+		t.Errorf("connected %d times; want 2 (reconnected after the failure)", connected)
+	}
+
+	// Events are published as JSON.
+	any, err := typeurl.MarshalAny(&stargzfs.Event{Type: stargzfs.EventResolved})
+	if err != nil {
+		t.Fatalf("failed to marshal event: %v", err)
+	}
+	if string(any.Value) != `{"type":"resolved"}` {
+		t.Errorf("marshaled event %q", string(any.Value))
+	}
+}
@@ -0,0 +1,212 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/snapshots"
+	stargzfs "github.com/containerd/stargz-snapshotter/fs"
+	snbase "github.com/containerd/stargz-snapshotter/snapshot"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultContainerdAddress = "/run/containerd/containerd.sock"
+	defaultGCDebounceSec     = 10
+	gcRetryInterval          = 30 * time.Second
+)
+
+// gcEventFilters are topics of containerd events after which layers may be
+// no longer referenced by images.
+var gcEventFilters = []string{
+	`topic=="/images/delete"`,
+	`topic=="/snapshot/remove"`,
+	`topic=="/content/delete"`,
+}
+
+// layerGC collects caches of layers not referenced by any image in
+// containerd.
+type layerGC struct {
+	address  string
+	debounce time.Duration
+	lc       stargzfs.LayerCollector
+
+	// mu serializes passes of events and API requests.
+	mu sync.Mutex
+}
+
+func newLayerGC(cfg ContainerdGCConfig, lc stargzfs.LayerCollector) *layerGC {
+	address := cfg.Address
+	if address == "" {
+		address = defaultContainerdAddress
+	}
+	debounceSec := cfg.DebounceSec
+	if debounceSec == 0 {
+		debounceSec = defaultGCDebounceSec
+	}
+	return &layerGC{address: address, debounce: time.Duration(debounceSec) * time.Second, lc: lc}
+}
+
+// run collects layers on startup and on removal events. This runs until ctx is
+// done, reconnecting to containerd on failures.
+func (g *layerGC) run(ctx context.Context) {
+	for {
+		err := g.watch(ctx)
+		log.G(ctx).WithError(err).WithField("address", g.address).Warn("failed to watch containerd events for gc")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(gcRetryInterval):
+		}
+	}
+}
+
+func (g *layerGC) watch(ctx context.Context) error {
+	client, err := containerd.New(g.address)
+	if err != nil {
+		return errors.Wrapf(err, "failed to connect to containerd")
+	}
+	defer client.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Subscribe before the first pass so that no removal is missed.
+	evCh, errCh := client.EventService().Subscribe(ctx, gcEventFilters...)
+	g.reconcile(ctx, client)
+	var timer <-chan time.Time
+	for {
+		select {
+		case ev := <-evCh:
+			log.G(ctx).WithField("topic", ev.Topic).WithField("namespace", ev.Namespace).Debug("received gc event")
+			if timer == nil {
+				timer = time.After(g.debounce)
+			}
+		case <-timer:
+			timer = nil
+			g.reconcile(ctx, client)
+		case err := <-errCh:
+			return errors.Wrapf(err, "failed to receive events")
+		}
+	}
+}
+
+func (g *layerGC) reconcile(ctx context.Context, client *containerd.Client) {
+	if _, err := g.collect(ctx, client); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to collect layers")
+	}
+}
+
+// collectOnce connects to containerd and runs a pass.
+func (g *layerGC) collectOnce(ctx context.Context, opts ...stargzfs.GCOpt) (stargzfs.GCResult, error) {
+	client, err := containerd.New(g.address)
+	if err != nil {
+		return stargzfs.GCResult{}, errors.Wrapf(err, "failed to connect to containerd")
+	}
+	defer client.Close()
+	return g.collect(ctx, client, opts...)
+}
+
+// collect collects layers not referenced by images in any namespace. The pass
+// is skipped on any failure of listing images so that caches in use are never
+// removed based on partial information.
+func (g *layerGC) collect(ctx context.Context, client *containerd.Client, opts ...stargzfs.GCOpt) (stargzfs.GCResult, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	nss, err := client.NamespaceService().List(ctx)
+	if err != nil {
+		return stargzfs.GCResult{}, errors.Wrapf(err, "failed to list namespaces")
+	}
+	used := make(map[digest.Digest]struct{})
+	for _, ns := range nss {
+		nctx := namespaces.WithNamespace(ctx, ns)
+		imgs, err := client.ImageService().List(nctx)
+		if err != nil {
+			return stargzfs.GCResult{}, errors.Wrapf(err, "failed to list images in %q", ns)
+		}
+		if err := imageBlobs(nctx, client.ContentStore(), imgs, used); err != nil {
+			return stargzfs.GCResult{}, errors.Wrapf(err, "failed to walk images in %q", ns)
+		}
+	}
+	return g.lc.CollectLayers(ctx, func(dgst digest.Digest) bool {
+		_, ok := used[dgst]
+		return ok
+	}, opts...)
+}
+
+// gcReport is the result of an explicit garbage collection.
+type gcReport struct {
+	stargzfs.GCResult
+
+	// Snapshots are directories of removed or abandoned snapshots including
+	// their metadata images attached to loop devices.
+	Snapshots []snbase.CleanupDir `json:"snapshots"`
+}
+
+// collectGarbage collects unused layers and directories of removed snapshots.
+// Nothing is removed if dryRun is true.
+func collectGarbage(ctx context.Context, gc *layerGC, sn snapshots.Snapshotter, dryRun bool) (res gcReport, _ error) {
+	var opts []stargzfs.GCOpt
+	if dryRun {
+		opts = append(opts, stargzfs.GCDryRun())
+	}
+	var err error
+	if res.GCResult, err = gc.collectOnce(ctx, opts...); err != nil {
+		return res, err
+	}
+	res.Snapshots = []snbase.CleanupDir{}
+	if dc, ok := sn.(dirCleaner); ok {
+		if res.Snapshots, err = dc.CleanupDirs(ctx, dryRun); err != nil {
+			return res, errors.Wrapf(err, "failed to clean up snapshot directories")
+		}
+	}
+	for _, d := range res.Snapshots {
+		res.ReclaimedSize += d.Size
+	}
+	return res, nil
+}
+
+// imageBlobs adds digests of blobs (manifests, configs and layers) referenced
+// by the images to used. Manifests missing from the content store are skipped
+// unless they are targets of images because manifests of other platforms
+// aren't pulled.
+func imageBlobs(ctx context.Context, provider content.Provider, imgs []images.Image, used map[digest.Digest]struct{}) error {
+	for _, img := range imgs {
+		target := img.Target
+		if err := images.Walk(ctx, images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+			used[desc.Digest] = struct{}{}
+			children, err := images.Children(ctx, provider, desc)
+			if errdefs.IsNotFound(err) && desc.Digest != target.Digest {
+				return nil, nil
+			}
+			return children, err
+		}), target); err != nil {
+			return errors.Wrapf(err, "failed to walk image %q", img.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// TestImageBlobs tests layers of images are listed even if they aren't in the
+// content store (i.e. lazily pulled).
+func TestImageBlobs(t *testing.T) {
+	ctx := context.Background()
+	tmp, err := ioutil.TempDir("", "testimageblobs")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	cs, err := local.NewStore(tmp)
+	if err != nil {
+		t.Fatalf("failed to create content store: %v", err)
+	}
+	write := func(mediaType string, v interface{}) ocispec.Descriptor {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("failed to marshal: %v", err)
+		}
+		desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(data), Size: int64(len(data))}
+		if err := content.WriteBlob(ctx, cs, desc.Digest.String(), bytes.NewReader(data), desc); err != nil {
+			t.Fatalf("failed to write blob: %v", err)
+		}
+		return desc
+	}
+	layer := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromString("layer"), Size: 5}
+	manifest := write(ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    write(ocispec.MediaTypeImageConfig, ocispec.Image{}),
+		Layers:    []ocispec.Descriptor{layer},
+	})
+	other := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("other"), Size: 5}
+	index := write(ocispec.MediaTypeImageIndex, ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []ocispec.Descriptor{manifest, other}, // other platforms aren't pulled
+	})
+
+	used := make(map[digest.Digest]struct{})
+	if err := imageBlobs(ctx, cs, []images.Image{{Name: "test", Target: index}}, used); err != nil {
+		t.Fatalf("failed to walk images: %v", err)
+	}
+	if _, ok := used[layer.Digest]; !ok || len(used) != 5 {
+		t.Errorf("unexpected blobs %v", used)
+	}
+
+	missing := images.Image{Name: "missing", Target: other}
+	if err := imageBlobs(ctx, cs, []images.Image{missing}, used); err == nil {
+		t.Errorf("images whose targets are missing must not be skipped")
+	}
+}
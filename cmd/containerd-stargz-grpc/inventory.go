@@ -0,0 +1,163 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	stargzfs "github.com/containerd/stargz-snapshotter/fs"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	// imageCachesAnnotation is the annotation of the Node listing images with
+	// caches on the node. The value is a JSON array of imageCacheEntry.
+	imageCachesAnnotation = "stargz.containerd.io/image-caches"
+
+	// maxImageCachesAnnotationSize is the maximum size of the annotation.
+	// Images with colder caches are omitted beyond this. The total size of
+	// annotations of an object is limited to 256KiB.
+	maxImageCachesAnnotationSize = 64 << 10
+
+	defaultCacheInventoryIntervalSec = 60
+)
+
+// imageCacheEntry is an image in the annotation of the Node.
+type imageCacheEntry struct {
+	Ref            string   `json:"ref"`
+	Size           int64    `json:"size"`
+	FetchedPercent float64  `json:"fetchedPercent"`
+	Layers         []string `json:"layers"`
+}
+
+// imageCachesAnnotationValue returns the value of the annotation listing the
+// images, warmest first, within maxImageCachesAnnotationSize.
+func imageCachesAnnotationValue(images []stargzfs.ImageCache) (string, error) {
+	sort.SliceStable(images, func(i, j int) bool { return images[i].FetchedPercent > images[j].FetchedPercent })
+	entries := []imageCacheEntry{}
+	size := 2 // "[]"
+	for _, img := range images {
+		e := imageCacheEntry{
+			Ref:            img.Ref,
+			Size:           img.Size,
+			FetchedPercent: float64(int(img.FetchedPercent*10)) / 10,
+		}
+		for _, l := range img.Layers {
+			e.Layers = append(e.Layers, l.Digest)
+		}
+		b, err := json.Marshal(e)
+		if err != nil {
+			return "", err
+		}
+		if size+len(b)+1 > maxImageCachesAnnotationSize {
+			break
+		}
+		size += len(b) + 1 // with ","
+		entries = append(entries, e)
+	}
+	b, err := json.Marshal(entries)
+	return string(b), err
+}
+
+// nodeAnnotator periodically publishes caches of images mounted on this node
+// as an annotation of the Node so that scheduler plugins can prefer nodes with
+// warm caches.
+type nodeAnnotator struct {
+	inventory stargzfs.CacheInventoryReporter
+	node      string
+	patch     func(ctx context.Context, node string, patch []byte) error
+	last      string
+}
+
+func newNodeAnnotator(cfg CacheInventoryConfig, inventory stargzfs.CacheInventoryReporter) (*nodeAnnotator, error) {
+	node := cfg.NodeName
+	if node == "" {
+		node = os.Getenv("NODE_NAME")
+	}
+	if node == "" {
+		var err error
+		if node, err = os.Hostname(); err != nil {
+			return nil, errors.Wrap(err, "failed to get node name")
+		}
+	}
+	// Falls back to the in-cluster config if no kubeconfig is found.
+	loadingRule := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRule.ExplicitPath = cfg.KubeconfigPath
+	clientcfg, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		loadingRule, &clientcmd.ConfigOverrides{}).ClientConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load kubeconfig")
+	}
+	client, err := kubernetes.NewForConfig(clientcfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare client")
+	}
+	return &nodeAnnotator{
+		inventory: inventory,
+		node:      node,
+		patch: func(ctx context.Context, node string, patch []byte) error {
+			_, err := client.CoreV1().Nodes().Patch(ctx, node, types.MergePatchType, patch, metav1.PatchOptions{})
+			return err
+		},
+	}, nil
+}
+
+// sync updates the annotation if the inventory changed since the last update.
+func (na *nodeAnnotator) sync(ctx context.Context) error {
+	value, err := imageCachesAnnotationValue(na.inventory.CacheInventory(ctx))
+	if err != nil {
+		return err
+	}
+	if value == na.last {
+		return nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{imageCachesAnnotation: value},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if err := na.patch(ctx, na.node, patch); err != nil {
+		return errors.Wrapf(err, "failed to annotate node %q", na.node)
+	}
+	na.last = value
+	return nil
+}
+
+func (na *nodeAnnotator) run(ctx context.Context, interval time.Duration) {
+	for {
+		if err := na.sync(ctx); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to publish cache inventory")
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,96 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	stargzfs "github.com/containerd/stargz-snapshotter/fs"
+)
+
+type testInventory []stargzfs.ImageCache
+
+func (ti *testInventory) CacheInventory(ctx context.Context) []stargzfs.ImageCache {
+	return append([]stargzfs.ImageCache{}, (*ti)...)
+}
+
+func TestNodeAnnotator(t *testing.T) {
+	inv := &testInventory{
+		{Ref: "example.com/cold:1", Size: 100, FetchedPercent: 10.04, Layers: []stargzfs.LayerCache{{Digest: "sha256:c"}}},
+		{Ref: "example.com/warm:1", Size: 200, FetchedPercent: 90, Layers: []stargzfs.LayerCache{{Digest: "sha256:a"}, {Digest: "sha256:b"}}},
+	}
+	var patches []string
+	na := &nodeAnnotator{
+		inventory: inv,
+		node:      "node1",
+		patch: func(ctx context.Context, node string, patch []byte) error {
+			if node != "node1" {
+				return fmt.Errorf("unexpected node %q", node)
+			}
+			patches = append(patches, string(patch))
+			return nil
+		},
+	}
+	for i := 0; i < 2; i++ {
+		if err := na.sync(context.Background()); err != nil {
+			t.Fatalf("failed to sync: %v", err)
+		}
+	}
+	if len(patches) != 1 {
+		t.Fatalf("node must be patched only on changes; patched %d times", len(patches))
+	}
+	var p struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal([]byte(patches[0]), &p); err != nil {
+		t.Fatalf("invalid patch %q: %v", patches[0], err)
+	}
+	want := `[{"ref":"example.com/warm:1","size":200,"fetchedPercent":90,"layers":["sha256:a","sha256:b"]},` +
+		`{"ref":"example.com/cold:1","size":100,"fetchedPercent":10,"layers":["sha256:c"]}]`
+	if got := p.Metadata.Annotations[imageCachesAnnotation]; got != want {
+		t.Errorf("annotation = %s; want %s", got, want)
+	}
+
+	*inv = (*inv)[:1]
+	if err := na.sync(context.Background()); err != nil || len(patches) != 2 {
+		t.Errorf("node must be patched on changes (err: %v, patches: %d)", err, len(patches))
+	}
+}
+
+func TestImageCachesAnnotationLimit(t *testing.T) {
+	var images []stargzfs.ImageCache
+	for i := 0; i < 10000; i++ {
+		images = append(images, stargzfs.ImageCache{Ref: fmt.Sprintf("example.com/image%d:%s", i, strings.Repeat("x", 50))})
+	}
+	v, err := imageCachesAnnotationValue(images)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) > maxImageCachesAnnotationSize {
+		t.Errorf("annotation size %d exceeds %d", len(v), maxImageCachesAnnotationSize)
+	}
+	var entries []imageCacheEntry
+	if err := json.Unmarshal([]byte(v), &entries); err != nil || len(entries) == 0 {
+		t.Errorf("invalid annotation (%d entries): %v", len(entries), err)
+	}
+}
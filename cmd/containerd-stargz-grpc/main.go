@@ -19,24 +19,33 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"time"
 
-	"github.com/BurntSushi/toml"
 	snapshotsapi "github.com/containerd/containerd/api/services/snapshots/v1"
 	"github.com/containerd/containerd/contrib/snapshotservice"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/overlay"
+	"github.com/containerd/containerd/sys"
 	"github.com/containerd/stargz-snapshotter/cmd/containerd-stargz-grpc/keychain"
 	stargzfs "github.com/containerd/stargz-snapshotter/fs"
 	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/containerd/stargz-snapshotter/fs/source/grpcplugin"
+	"github.com/containerd/stargz-snapshotter/fs/source/offline"
 	snbase "github.com/containerd/stargz-snapshotter/snapshot"
+	"github.com/containerd/stargz-snapshotter/snapshot/api"
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 )
@@ -53,6 +62,8 @@ var (
 	configPath = flag.String("config", defaultConfigPath, "path to the configuration file")
 	logLevel   = flag.String("log-level", defaultLogLevel.String(), "set the logging level [trace, debug, info, warn, error, fatal, panic]")
 	rootDir    = flag.String("root", defaultRootDir, "path to the root directory for this snapshotter")
+	apiAddress = flag.String("api-address", "", "address for the snapshotter's HTTP API server (e.g. layer fetch progress). disabled if empty")
+	checkOnly  = flag.Bool("check-config", false, "check the configuration and the node prerequisites (resolver hosts, paths, FUSE and kernel) and exit")
 )
 
 func main() {
@@ -71,10 +82,57 @@ func main() {
 		config Config
 	)
 
+	rootless := isRootless()
+	if rootless {
+		if err := applyRootlessPaths(); err != nil {
+			log.G(ctx).WithError(err).Fatal("failed to configure the rootless mode")
+		}
+	}
+
 	// Get configuration from specified file
-	if _, err := toml.DecodeFile(*configPath, &config); err != nil && !(os.IsNotExist(err) && *configPath == defaultConfigPath) {
+	if err := loadConfig(*configPath, &config); err != nil && !(os.IsNotExist(err) && !isFlagSet("config")) {
 		log.G(ctx).WithError(err).Fatalf("failed to load config file %q", *configPath)
 	}
+	if rootless {
+		applyRootlessConfig(&config)
+	}
+	if *checkOnly {
+		failed := false
+		for _, r := range checkNode(config, *rootDir) {
+			if r.err != nil {
+				failed = true
+				fmt.Printf("FAIL %s: %v\n", r.name, r.err)
+			} else {
+				fmt.Printf("ok   %s\n", r.name)
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+		return
+	}
+	if err := validateConfig(config); err != nil {
+		log.G(ctx).WithError(err).Fatalf("invalid config file %q", *configPath)
+	}
+	log.G(ctx).WithField("boringcrypto", boringCrypto).WithField("fips", config.FIPS).Info(cryptoMode(config.FIPS))
+	if rootless {
+		var errs *multierror.Error
+		checkRootless(config, func(name string, err error) {
+			if err != nil {
+				errs = multierror.Append(errs, errors.Wrap(err, name))
+			}
+		})
+		if err := errs.ErrorOrNil(); err != nil {
+			log.G(ctx).WithError(err).Fatal("prerequisites of the rootless mode aren't met")
+		}
+		// Layers are mounted directly in user namespaces.
+		if !sys.RunningInUserNS() {
+			if err := prepareFusermount(filepath.Join(*rootDir, "bin")); err != nil {
+				log.G(ctx).WithError(err).Fatal("failed to prepare fusermount")
+			}
+		}
+		log.G(ctx).WithField("root", *rootDir).Info("running in the rootless mode")
+	}
 
 	// Prepare kubeconfig-based keychain if required
 	kc := authn.DefaultKeychain
@@ -87,26 +145,122 @@ func main() {
 	}
 
 	// Use RegistryHosts based on ResolverConfig and keychain
-	hosts := hostsFromConfig(config.ResolverConfig, kc)
+	hosts := hostsFromConfig(config.ResolverConfig, kc, config.FIPS)
+
+	if flag.Arg(0) == "selftest" {
+		if err := runSelfTest(ctx, config, hosts, flag.Args()[1:], os.Stdout); err != nil {
+			fmt.Printf("FAIL selftest: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Source providers are consulted in order
+	for name, p := range config.SourcePlugins {
+		source.Register(name, grpcplugin.NewProviderFunc(p.Address))
+	}
+	providers := config.SourceProviders
+	if len(providers) == 0 {
+		providers = defaultSourceProviders
+	}
+	providerConfig := config.SourceProviderConfig
+	if config.Offline {
+		dir := config.OfflineCacheDir
+		if dir == "" {
+			dir = filepath.Join(*rootDir, "offline")
+		}
+		log.G(ctx).WithField("dir", dir).Info("running in the offline mode")
+		hosts, providers = offline.Hosts, []string{offline.Name}
+		providerConfig = map[string]map[string]string{offline.Name: {"root": dir}}
+		config.PinTagDigest = false
+	}
+	getSources, err := source.FromProviders(providers, hosts, providerConfig)
+	if err != nil {
+		log.G(ctx).WithError(err).Fatalf("failed to configure source providers")
+	}
+	if rewrite := config.ResolverConfig.Rewrite; len(rewrite) > 0 && !config.Offline {
+		var rules []source.RewriteRule
+		for _, r := range rewrite {
+			rules = append(rules, source.RewriteRule{From: r.From, To: r.To, Fallback: r.Fallback})
+		}
+		if getSources, err = source.WithRewriteRules(getSources, rules); err != nil {
+			log.G(ctx).WithError(err).Fatalf("failed to configure rewrite rules")
+		}
+	}
 
 	// Configure filesystem and snapshotter
-	fs, err := stargzfs.NewFilesystem(filepath.Join(*rootDir, "stargz"),
-		config.Config,
-		stargzfs.WithGetSources(sources(
-			sourceFromCRILabels(hosts),      // provides source info based on CRI labels
-			source.FromDefaultLabels(hosts), // provides source info based on default labels
-		)),
-	)
+	fsOpts := []stargzfs.Option{stargzfs.WithGetSources(getSources)}
+	if config.Events.Enable {
+		pub := newEventPublisher(config.Events)
+		go pub.run(ctx)
+		fsOpts = append(fsOpts, stargzfs.WithEventHandler(pub.handle))
+	}
+	fs, err := stargzfs.NewFilesystem(filepath.Join(*rootDir, "stargz"), config.Config, fsOpts...)
 	if err != nil {
 		log.G(ctx).WithError(err).Fatalf("failed to configure filesystem")
 	}
-	rs, err := snbase.NewSnapshotter(ctx, filepath.Join(*rootDir, "snapshotter"), fs, snbase.AsynchronousRemove)
+	var gc *layerGC
+	if lc, ok := fs.(stargzfs.LayerCollector); ok {
+		gc = newLayerGC(config.ContainerdGC, lc)
+	}
+	if config.ContainerdGC.Enable {
+		if gc == nil {
+			log.G(ctx).Fatalf("filesystem doesn't support garbage collection")
+		}
+		go gc.run(ctx)
+	}
+	snOpts := []snbase.Opt{
+		snbase.AsynchronousRemove,
+		snbase.OverlayFeatures(config.OverlayRedirectDir, config.OverlayMetacopy),
+		snbase.MergedLowerView(config.MergedViewMinLayers),
+	}
+	if config.IdleUnmountTTLSec > 0 {
+		snOpts = append(snOpts, snbase.IdleUnmountTTL(time.Duration(config.IdleUnmountTTLSec)*time.Second))
+	}
+	rs, err := snbase.NewSnapshotter(ctx, filepath.Join(*rootDir, "snapshotter"), fs, snOpts...)
 	if err != nil {
 		log.G(ctx).WithError(err).Fatalf("failed to configure snapshotter")
 	}
+	var sn snapshots.Snapshotter = rs
+	if config.RouteToOverlayfs {
+		ov, err := overlay.NewSnapshotter(filepath.Join(*rootDir, "overlayfs"))
+		if err != nil {
+			log.G(ctx).WithError(err).Fatalf("failed to configure overlayfs snapshotter")
+		}
+		sn = snbase.NewRouter(rs, ov, stargzfs.IsLazyLayer)
+	}
+	if *apiAddress != "" {
+		if err := serveAPI(ctx, *apiAddress, fs, rs, gc); err != nil {
+			log.G(ctx).WithError(err).Fatalf("failed to serve API")
+		}
+	}
+	if config.CacheMirror.Address != "" {
+		cm, ok := fs.(stargzfs.CacheMirror)
+		if !ok {
+			log.G(ctx).Fatalf("filesystem doesn't support cache mirror")
+		}
+		if err := serveCacheMirror(ctx, config.CacheMirror, config.FIPS, cm); err != nil {
+			log.G(ctx).WithError(err).Fatalf("failed to serve cache mirror")
+		}
+	}
+	if config.CacheInventory.NodeAnnotation {
+		inv, ok := fs.(stargzfs.CacheInventoryReporter)
+		if !ok {
+			log.G(ctx).Fatalf("filesystem doesn't support cache inventory")
+		}
+		na, err := newNodeAnnotator(config.CacheInventory, inv)
+		if err != nil {
+			log.G(ctx).WithError(err).Fatalf("failed to prepare node annotator")
+		}
+		interval := config.CacheInventory.IntervalSec
+		if interval <= 0 {
+			interval = defaultCacheInventoryIntervalSec
+		}
+		go na.run(ctx, time.Duration(interval)*time.Second)
+	}
 	defer func() {
 		log.G(ctx).Debug("Closing the snapshotter")
-		rs.Close()
+		sn.Close()
 		log.G(ctx).Info("Exiting")
 	}()
 
@@ -114,10 +268,13 @@ func main() {
 	rpc := grpc.NewServer()
 
 	// Convert the snapshotter to a gRPC service,
-	service := snapshotservice.FromSnapshotter(rs)
+	service := snapshotservice.FromSnapshotter(sn)
 
 	// Register the service with the gRPC server
 	snapshotsapi.RegisterSnapshotsServer(rpc, service)
+	if m, ok := rs.(materializer); ok {
+		api.RegisterControlServer(rpc, &controlService{m})
+	}
 
 	// Prepare the directory for the socket
 	if err := os.MkdirAll(filepath.Dir(*address), 0700); err != nil {
@@ -134,6 +291,12 @@ func main() {
 	if err != nil {
 		log.G(ctx).WithError(err).Fatalf("error on listen socket %q", *address)
 	}
+
+	// Privileges are reduced after everything needing them (e.g. restoring
+	// mounts) is done.
+	if err := reducePrivileges(ctx, config.Config); err != nil {
+		log.G(ctx).WithError(err).Fatalf("failed to reduce privileges")
+	}
 	go func() {
 		if err := rpc.Serve(l); err != nil {
 			log.G(ctx).WithError(err).Fatalf("error on serving via socket %q", *address)
@@ -149,15 +312,42 @@ func waitForSIGINT() {
 	<-c
 }
 
-func hostsFromConfig(cfg ResolverConfig, keychain authn.Keychain) docker.RegistryHosts {
+// hostsFromConfig returns RegistryHosts of the configuration. If fips is true,
+// registries are connected with FIPS 140 approved TLS settings only.
+func hostsFromConfig(cfg ResolverConfig, keychain authn.Keychain, fips bool) docker.RegistryHosts {
+	certsDir := cfg.CertsDir
+	if certsDir == "" {
+		certsDir = defaultCertsDir
+	}
 	return func(host string) (hosts []docker.RegistryHost, _ error) {
 		for _, h := range append(cfg.Host[host].Mirrors, MirrorConfig{
-			Host: host,
+			Host:      host,
+			TLSConfig: cfg.Host[host].TLSConfig,
+			Proxy:     cfg.Host[host].Proxy,
+			UserAgent: cfg.Host[host].UserAgent,
+			Header:    cfg.Host[host].Header,
 		}) {
-			tr := &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()}
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			proxy, err := proxyFunc(h.Proxy)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid proxy for %q", h.Host)
+			}
+			transport.Proxy = proxy
+			tlsConfig, err := tlsConfigForHost(certsDir, h.Host, h.TLSConfig, fips)
+			if err != nil {
+				return nil, err
+			}
+			if tlsConfig != nil {
+				transport.TLSClientConfig = tlsConfig
+			}
+			hostname := h.Host
+			if hostname == "docker.io" {
+				hostname = "registry-1.docker.io"
+			}
+			tr := &http.Client{Transport: withHeader(transport, hostname, h.UserAgent, h.Header)}
 			config := docker.RegistryHost{
 				Client:       tr,
-				Host:         h.Host,
+				Host:         hostname,
 				Scheme:       "https",
 				Path:         "/v2",
 				Capabilities: docker.HostCapabilityPull,
@@ -188,24 +378,60 @@ func hostsFromConfig(cfg ResolverConfig, keychain authn.Keychain) docker.Registr
 			if localhost, _ := docker.MatchLocalhost(config.Host); localhost || h.Insecure {
 				config.Scheme = "http"
 			}
-			if config.Host == "docker.io" {
-				config.Host = "registry-1.docker.io"
-			}
 			hosts = append(hosts, config)
 		}
 		return
 	}
 }
 
-func sources(ps ...source.GetSources) source.GetSources {
-	return func(labels map[string]string) (source []source.Source, allErr error) {
-		for _, p := range ps {
-			src, err := p(labels)
-			if err == nil {
-				return src, nil
-			}
-			allErr = multierror.Append(allErr, err)
+// withHeader wraps the transport to set the User-Agent of all requests and the
+// header fields of requests to the host. The transport is returned as is if
+// nothing is configured.
+func withHeader(inner http.RoundTripper, host, userAgent string, header map[string]string) http.RoundTripper {
+	if userAgent == "" && len(header) == 0 {
+		return inner
+	}
+	h := make(http.Header)
+	for k, v := range header {
+		h.Set(k, v)
+	}
+	return &headerTransport{inner: inner, host: host, userAgent: userAgent, header: h}
+}
+
+type headerTransport struct {
+	inner     http.RoundTripper
+	host      string
+	userAgent string
+	header    http.Header
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context()) // RoundTrippers must not modify the request
+	if t.userAgent != "" {
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+	if req.URL.Host == t.host {
+		for k, v := range t.header {
+			req.Header[k] = v
 		}
-		return
 	}
+	return t.inner.RoundTrip(req)
+}
+
+// proxyFunc returns the function to select the proxy of requests.
+func proxyFunc(proxy string) (func(*http.Request) (*url.URL, error), error) {
+	switch proxy {
+	case "":
+		return http.ProxyFromEnvironment, nil
+	case "direct":
+		return nil, nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("proxy %q must be an absolute URL", proxy)
+	}
+	return http.ProxyURL(u), nil
 }
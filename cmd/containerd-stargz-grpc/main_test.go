@@ -0,0 +1,156 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+)
+
+func TestHostsFromConfigProxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+	}))
+	defer proxy.Close()
+	tmp, err := ioutil.TempDir("", "testcertsd")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	hosts := hostsFromConfig(ResolverConfig{
+		Host: map[string]HostConfig{
+			"registry.test": {
+				Mirrors: []MirrorConfig{
+					{Host: "mirror.test", Insecure: true, Proxy: "direct"},
+					{Host: "env.test", Insecure: true},
+				},
+				Proxy: proxy.URL,
+			},
+			"invalid.test": {Proxy: "proxy.test:3128"},
+		},
+		CertsDir: tmp,
+	}, authn.DefaultKeychain, false)
+
+	rhosts, err := hosts("registry.test")
+	if err != nil {
+		t.Fatalf("failed to get hosts: %v", err)
+	}
+	if len(rhosts) != 3 {
+		t.Fatalf("unexpected number of hosts %d; want 3", len(rhosts))
+	}
+	for _, h := range rhosts {
+		tr := h.Client.Transport.(*http.Transport)
+		switch h.Host {
+		case "mirror.test":
+			if tr.Proxy != nil {
+				t.Errorf("proxy must be disabled for %q", h.Host)
+			}
+		case "env.test":
+			if tr.Proxy == nil {
+				t.Errorf("environment variables must be used for %q", h.Host)
+			}
+		case "registry.test":
+			resp, err := h.Client.Get("http://registry.test/v2/")
+			if err != nil {
+				t.Fatalf("failed to send request via proxy: %v", err)
+			}
+			resp.Body.Close()
+			if len(proxied) != 1 || proxied[0] != "http://registry.test/v2/" {
+				t.Errorf("request must be sent via the proxy: %v", proxied)
+			}
+		default:
+			t.Errorf("unexpected host %q", h.Host)
+		}
+	}
+
+	if _, err := hosts("invalid.test"); err == nil {
+		t.Errorf("proxy without scheme must be rejected")
+	}
+}
+
+func TestHostsFromConfigHeader(t *testing.T) {
+	var got []http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header)
+	}))
+	defer srv.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header)
+	}))
+	defer other.Close()
+	tmp, err := ioutil.TempDir("", "testcertsd")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	hosts := hostsFromConfig(ResolverConfig{
+		Host: map[string]HostConfig{
+			host: {
+				UserAgent: "example-agent/1.0",
+				Header:    map[string]string{"x-trace-id": "abc"},
+				Proxy:     "direct",
+			},
+		},
+		CertsDir: tmp,
+	}, authn.DefaultKeychain, false)
+	rhosts, err := hosts(host)
+	if err != nil {
+		t.Fatalf("failed to get hosts: %v", err)
+	}
+	if len(rhosts) != 1 {
+		t.Fatalf("unexpected number of hosts %d; want 1", len(rhosts))
+	}
+	for _, u := range []string{srv.URL + "/v2/", other.URL + "/blob"} {
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("User-Agent", "containerd/test")
+		resp, err := rhosts[0].Client.Do(req)
+		if err != nil {
+			t.Fatalf("failed to send request: %v", err)
+		}
+		resp.Body.Close()
+		if req.Header.Get("User-Agent") != "containerd/test" {
+			t.Errorf("request must not be modified")
+		}
+	}
+	if len(got) != 2 {
+		t.Fatalf("unexpected number of requests %d; want 2", len(got))
+	}
+	for i, h := range got {
+		if ua := h.Get("User-Agent"); ua != "example-agent/1.0" {
+			t.Errorf("request %d: user agent = %q; want %q", i, ua, "example-agent/1.0")
+		}
+	}
+	if v := got[0].Get("X-Trace-Id"); v != "abc" {
+		t.Errorf("header of the host = %q; want %q", v, "abc")
+	}
+	if v := got[1].Get("X-Trace-Id"); v != "" {
+		t.Errorf("header must not be sent to other hosts but %q", v)
+	}
+}
@@ -0,0 +1,252 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	stargzfs "github.com/containerd/stargz-snapshotter/fs"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+const (
+	cacheMirrorAPIPrefix = "/v2/"
+	cacheMirrorBlobsPath = "/blobs/"
+
+	// maxCacheMirrorRange is the maximum size of a range served by a request.
+	maxCacheMirrorRange = 16 << 20
+)
+
+// cacheMirrorToken is a bearer token and the patterns of the repositories it
+// gives access to.
+type cacheMirrorToken struct {
+	token        string
+	repositories []string
+}
+
+// allows returns true if the token gives access to the repository.
+func (t *cacheMirrorToken) allows(repo string) bool {
+	for _, p := range t.repositories {
+		if ok, _ := path.Match(p, repo); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// serveCacheMirror serves cached contents of layers to other nodes over HTTPS.
+// Only contents already in the cache are served; nothing is fetched from
+// registries on behalf of clients.
+func serveCacheMirror(ctx context.Context, cfg CacheMirrorConfig, fips bool, cm stargzfs.CacheMirror) error {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return fmt.Errorf("cert_file and key_file must be specified")
+	}
+	if len(cfg.Tokens) == 0 {
+		return fmt.Errorf("tokens must be specified")
+	}
+	var tokens []*cacheMirrorToken
+	for _, tc := range cfg.Tokens {
+		b, err := ioutil.ReadFile(tc.TokenFile)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read token file %q", tc.TokenFile)
+		}
+		token := strings.TrimSpace(string(b))
+		if token == "" {
+			return fmt.Errorf("token file %q is empty", tc.TokenFile)
+		}
+		tokens = append(tokens, &cacheMirrorToken{token: token, repositories: tc.Repositories})
+	}
+	l, err := net.Listen("tcp", cfg.Address)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen on %q", cfg.Address)
+	}
+	tc := &tls.Config{MinVersion: tls.VersionTLS12}
+	if fips {
+		restrictTLSToFIPS(tc)
+	}
+	srv := &http.Server{Handler: cacheMirrorHandler(ctx, tokens, cm), TLSConfig: tc}
+	go func() {
+		if err := srv.ServeTLS(l, cfg.CertFile, cfg.KeyFile); err != nil {
+			log.G(ctx).WithError(err).Errorf("error on serving cache mirror on %q", cfg.Address)
+		}
+	}()
+	log.G(ctx).WithField("address", cfg.Address).Info("serving cache mirror")
+	return nil
+}
+
+// cacheMirrorHandler serves blobs as "/v2/<name>/blobs/<digest>" of the
+// registry API so the server can be used as a registry mirror. The repository
+// is <name> prefixed by the host given as the "ns" query parameter or, if it
+// isn't given, any host. Requests must have a bearer token giving access to
+// the repository and can have a single byte range. Layers not resolved from
+// the repository and regions not fully cached are reported as 404 so clients
+// can fall back to the registry.
+func cacheMirrorHandler(ctx context.Context, tokens []*cacheMirrorToken, cm stargzfs.CacheMirror) http.Handler {
+	m := http.NewServeMux()
+	m.HandleFunc(cacheMirrorAPIPrefix, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var token *cacheMirrorToken
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		for _, t := range tokens {
+			if subtle.ConstantTimeCompare([]byte(given), []byte(t.token)) == 1 {
+				token = t
+			}
+		}
+		if token == nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == cacheMirrorAPIPrefix {
+			// API version check
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		name, dgstStr, ok := parseCacheMirrorBlobPath(r.URL.Path)
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		dgst, err := digest.Parse(dgstStr)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid digest: %v", err), http.StatusBadRequest)
+			return
+		}
+		var known, allowed bool
+		for _, repo := range cm.LayerRepositories(dgst.String()) {
+			if matchCacheMirrorRepository(repo, name, r.URL.Query().Get("ns")) {
+				known = true
+				if token.allows(repo) {
+					allowed = true
+					break
+				}
+			}
+		}
+		if !known {
+			http.Error(w, "blob unknown to the repository", http.StatusNotFound)
+			return
+		} else if !allowed {
+			http.Error(w, "access to the repository denied", http.StatusForbidden)
+			return
+		}
+		ra, size, err := cm.CachedLayer(r.Context(), dgst.String())
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		offset, length, partial, err := parseCacheMirrorRange(r.Header.Get("Range"), size)
+		if err != nil {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if length > maxCacheMirrorRange {
+			http.Error(w, fmt.Sprintf("at most %d bytes can be requested at once", maxCacheMirrorRange), http.StatusBadRequest)
+			return
+		}
+		p := make([]byte, length)
+		if n, err := ra.ReadAt(p, offset); err != nil || int64(n) != length {
+			if err == nil || !errdefs.IsNotFound(err) {
+				log.G(ctx).WithError(err).WithField("digest", dgst).Debug("failed to read cached contents")
+			}
+			http.Error(w, "not cached", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		if partial {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, size))
+			w.WriteHeader(http.StatusPartialContent)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+		if r.Method == http.MethodGet {
+			w.Write(p)
+		}
+	})
+	return m
+}
+
+// parseCacheMirrorBlobPath parses "/v2/<name>/blobs/<digest>".
+func parseCacheMirrorBlobPath(p string) (name, dgst string, ok bool) {
+	if !strings.HasPrefix(p, cacheMirrorAPIPrefix) {
+		return "", "", false
+	}
+	p = strings.TrimPrefix(p, cacheMirrorAPIPrefix)
+	i := strings.LastIndex(p, cacheMirrorBlobsPath)
+	if i <= 0 {
+		return "", "", false
+	}
+	return p[:i], p[i+len(cacheMirrorBlobsPath):], true
+}
+
+// matchCacheMirrorRepository returns true if the repository (e.g.
+// "docker.io/library/ubuntu") is the one requested as the name (e.g.
+// "library/ubuntu") and the optional host (e.g. "docker.io").
+func matchCacheMirrorRepository(repo, name, host string) bool {
+	if host != "" {
+		return repo == host+"/"+name
+	}
+	i := strings.Index(repo, "/")
+	return i >= 0 && repo[i+1:] == name
+}
+
+// parseCacheMirrorRange parses a Range header with a single byte range. An
+// empty header means the whole blob.
+func parseCacheMirrorRange(h string, size int64) (offset, length int64, partial bool, err error) {
+	if h == "" {
+		return 0, size, false, nil
+	}
+	spec := strings.TrimPrefix(h, "bytes=")
+	if spec == h || strings.Contains(spec, ",") {
+		return 0, 0, false, fmt.Errorf("unsupported range %q", h)
+	}
+	parts := strings.SplitN(spec, "-", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return 0, 0, false, fmt.Errorf("unsupported range %q", h)
+	}
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false, fmt.Errorf("invalid range %q", h)
+	}
+	end := size - 1
+	if parts[1] != "" {
+		if end, err = strconv.ParseInt(parts[1], 10, 64); err != nil || end < start {
+			return 0, 0, false, fmt.Errorf("invalid range %q", h)
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end - start + 1, true, nil
+}
@@ -0,0 +1,145 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+const testMirrorContents = "0123456789"
+
+var testMirrorDigest = digest.FromString(testMirrorContents)
+
+// testCacheMirror has testMirrorContents of which only the first 5 bytes are
+// cached.
+type testCacheMirror struct{}
+
+func (testCacheMirror) CachedLayer(ctx context.Context, dgst string) (io.ReaderAt, int64, error) {
+	if dgst != testMirrorDigest.String() {
+		return nil, 0, errors.Wrapf(errdefs.ErrNotFound, "layer %q isn't known", dgst)
+	}
+	return testCachedReaderAt{}, int64(len(testMirrorContents)), nil
+}
+
+func (testCacheMirror) LayerRepositories(dgst string) []string {
+	if dgst != testMirrorDigest.String() {
+		return nil
+	}
+	return []string{"docker.io/library/ubuntu", "registry.test/private/app"}
+}
+
+type testCachedReaderAt struct{}
+
+func (testCachedReaderAt) ReadAt(p []byte, offset int64) (int, error) {
+	if offset+int64(len(p)) > 5 {
+		return 0, errdefs.ErrNotFound
+	}
+	return copy(p, testMirrorContents[offset:]), nil
+}
+
+func TestCacheMirrorHandler(t *testing.T) {
+	h := cacheMirrorHandler(context.Background(), []*cacheMirrorToken{
+		{token: "secret", repositories: []string{"docker.io/library/*"}},
+		{token: "private", repositories: []string{"registry.test/private/*"}},
+	}, testCacheMirror{})
+	blob := "/v2/library/ubuntu/blobs/" + testMirrorDigest.String()
+	privateBlob := "/v2/private/app/blobs/" + testMirrorDigest.String()
+	tests := []struct {
+		name      string
+		path      string
+		token     string
+		rng       string
+		wantCode  int
+		wantBody  string
+		wantRange string
+	}{
+		{name: "no_token", path: blob, rng: "bytes=0-1", wantCode: http.StatusUnauthorized},
+		{name: "wrong_token", path: blob, token: "wrong", rng: "bytes=0-1", wantCode: http.StatusUnauthorized},
+		{name: "version_check", path: "/v2/", token: "secret", wantCode: http.StatusOK},
+		{name: "cached", path: blob, token: "secret", rng: "bytes=1-3", wantCode: http.StatusPartialContent, wantBody: "123", wantRange: "bytes 1-3/10"},
+		{name: "cached_ns", path: blob + "?ns=docker.io", token: "secret", rng: "bytes=1-3", wantCode: http.StatusPartialContent, wantBody: "123", wantRange: "bytes 1-3/10"},
+		{name: "cached_other_token", path: privateBlob, token: "private", rng: "bytes=0-1", wantCode: http.StatusPartialContent, wantBody: "01", wantRange: "bytes 0-1/10"},
+		{name: "denied_repository", path: privateBlob, token: "secret", rng: "bytes=0-1", wantCode: http.StatusForbidden},
+		{name: "denied_ns", path: blob + "?ns=docker.io", token: "private", rng: "bytes=0-1", wantCode: http.StatusForbidden},
+		{name: "other_ns", path: blob + "?ns=registry.test", token: "secret", rng: "bytes=0-1", wantCode: http.StatusNotFound},
+		{name: "other_repository", path: "/v2/library/debian/blobs/" + testMirrorDigest.String(), token: "secret", rng: "bytes=0-1", wantCode: http.StatusNotFound},
+		{name: "not_cached", path: blob, token: "secret", rng: "bytes=3-6", wantCode: http.StatusNotFound},
+		{name: "whole_not_cached", path: blob, token: "secret", wantCode: http.StatusNotFound},
+		{name: "unknown_layer", path: "/v2/library/ubuntu/blobs/" + digest.FromString("x").String(), token: "secret", rng: "bytes=0-1", wantCode: http.StatusNotFound},
+		{name: "manifest", path: "/v2/library/ubuntu/manifests/latest", token: "secret", wantCode: http.StatusNotFound},
+		{name: "invalid_digest", path: "/v2/library/ubuntu/blobs/foo", token: "secret", wantCode: http.StatusBadRequest},
+		{name: "invalid_range", path: blob, token: "secret", rng: "bytes=10-", wantCode: http.StatusRequestedRangeNotSatisfiable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			if tt.rng != "" {
+				req.Header.Set("Range", tt.rng)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %d; want %d", rec.Code, tt.wantCode)
+			}
+			if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %q; want %q", rec.Body.String(), tt.wantBody)
+			}
+			if got := rec.Header().Get("Content-Range"); tt.wantRange != "" && got != tt.wantRange {
+				t.Errorf("Content-Range = %q; want %q", got, tt.wantRange)
+			}
+		})
+	}
+}
+
+func TestParseCacheMirrorRange(t *testing.T) {
+	for h, want := range map[string]*[3]int64{
+		"":              {0, 10, 0},
+		"bytes=2-4":     {2, 3, 1},
+		"bytes=2-":      {2, 8, 1},
+		"bytes=8-20":    {8, 2, 1},
+		"bytes=-3":      nil,
+		"bytes=4-2":     nil,
+		"bytes=0-1,3-4": nil,
+		"items=0-1":     nil,
+	} {
+		offset, length, partial, err := parseCacheMirrorRange(h, 10)
+		if want == nil {
+			if err == nil {
+				t.Errorf("%q: got %d+%d; want error", h, offset, length)
+			}
+			continue
+		}
+		p := int64(0)
+		if partial {
+			p = 1
+		}
+		if err != nil || [3]int64{offset, length, p} != *want {
+			t.Errorf("%q: got %d+%d (partial: %v, err: %v); want %v", h, offset, length, partial, err, *want)
+		}
+	}
+}
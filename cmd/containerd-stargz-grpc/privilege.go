@@ -0,0 +1,83 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/log"
+	fsconfig "github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/util/privilege"
+	"github.com/pkg/errors"
+)
+
+// defaultKeepCapabilities is the capabilities needed for mounting layers
+// (including overlayfs and EROFS in the data-only mode) and populating their
+// metadata.
+var defaultKeepCapabilities = []string{
+	"CAP_SYS_ADMIN",
+	"CAP_DAC_OVERRIDE",
+	"CAP_DAC_READ_SEARCH",
+	"CAP_FOWNER",
+	"CAP_CHOWN",
+	"CAP_FSETID",
+	"CAP_MKNOD",
+}
+
+// ebpfCapabilities is the capabilities needed for learning accesses with eBPF.
+var ebpfCapabilities = []string{"CAP_BPF", "CAP_PERFMON", "CAP_SYS_RESOURCE"}
+
+// ebpfSyscalls is the syscalls needed for learning accesses with eBPF.
+var ebpfSyscalls = map[string]bool{"bpf": true, "perf_event_open": true}
+
+// reducePrivileges drops capabilities, switches the credentials and installs
+// the seccomp filter as configured. cfg.Privilege.NoAllowOther is handled by
+// the filesystem.
+func reducePrivileges(ctx context.Context, cfg fsconfig.Config) error {
+	pc := cfg.Privilege
+	if pc.Seccomp {
+		// The filter is installed first because this needs CAP_SYS_ADMIN.
+		var deny []string
+		for _, s := range privilege.DefaultDeniedSyscalls {
+			if !(cfg.EBPFAccessHints && ebpfSyscalls[s]) {
+				deny = append(deny, s)
+			}
+		}
+		if err := privilege.DenySyscalls(deny); err != nil {
+			return errors.Wrap(err, "failed to install seccomp filter")
+		}
+		log.G(ctx).Infof("installed seccomp filter denying %d syscalls", len(deny))
+	}
+	if pc.DropCapabilities || pc.ServeUID != 0 || pc.ServeGID != 0 {
+		var keep []string
+		if pc.DropCapabilities {
+			keep = pc.KeepCapabilities
+			if len(keep) == 0 {
+				keep = defaultKeepCapabilities
+				if cfg.EBPFAccessHints {
+					keep = append(keep, ebpfCapabilities...)
+				}
+			}
+		}
+		if err := privilege.Drop(keep, pc.ServeUID, pc.ServeGID); err != nil {
+			return errors.Wrap(err, "failed to drop privileges")
+		}
+		log.G(ctx).WithField("uid", pc.ServeUID).WithField("gid", pc.ServeGID).
+			Infof("dropped privileges (keeping capabilities %v)", keep)
+	}
+	return nil
+}
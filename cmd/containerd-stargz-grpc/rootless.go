@@ -0,0 +1,198 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/sys"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// rootlessMaxConcurrentFetches is the default of blob.max_concurrent_fetches in
+// the rootless mode. slirp4netns, which typically provides the network of
+// rootless containerd, processes TCP of all connections in a user-space
+// process so many parallel fetches slow down each other.
+const rootlessMaxConcurrentFetches = 4
+
+// isRootless returns true if the daemon runs without the privileges of the
+// real root, i.e. as a non-root user or as root of a user namespace (e.g. in
+// the namespaces of RootlessKit, which rootless containerd runs in).
+func isRootless() bool {
+	return os.Geteuid() != 0 || sys.RunningInUserNS()
+}
+
+// rootlessPaths is the default paths in the rootless mode.
+type rootlessPaths struct {
+	address    string
+	rootDir    string
+	configPath string
+}
+
+// getRootlessPaths returns the default paths in the rootless mode, which follow
+// the XDG Base Directory Specification like rootless containerd.
+func getRootlessPaths(getenv func(string) string) (rootlessPaths, error) {
+	runtimeDir := getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		return rootlessPaths{}, fmt.Errorf("XDG_RUNTIME_DIR must be set in the rootless mode")
+	}
+	dataHome, configHome := getenv("XDG_DATA_HOME"), getenv("XDG_CONFIG_HOME")
+	if dataHome == "" || configHome == "" {
+		home := getenv("HOME")
+		if home == "" {
+			return rootlessPaths{}, fmt.Errorf("HOME or XDG_DATA_HOME and XDG_CONFIG_HOME must be set in the rootless mode")
+		}
+		if dataHome == "" {
+			dataHome = filepath.Join(home, ".local", "share")
+		}
+		if configHome == "" {
+			configHome = filepath.Join(home, ".config")
+		}
+	}
+	return rootlessPaths{
+		address:    filepath.Join(runtimeDir, "containerd-stargz-grpc", "containerd-stargz-grpc.sock"),
+		rootDir:    filepath.Join(dataHome, "containerd-stargz-grpc"),
+		configPath: filepath.Join(configHome, "containerd-stargz-grpc", "config.toml"),
+	}, nil
+}
+
+// applyRootlessPaths replaces the paths which aren't specified by flags with the
+// defaults of the rootless mode.
+func applyRootlessPaths() error {
+	paths, err := getRootlessPaths(os.Getenv)
+	if err != nil {
+		return err
+	}
+	for name, v := range map[string]struct {
+		p   *string
+		def string
+	}{
+		"address": {address, paths.address},
+		"root":    {rootDir, paths.rootDir},
+		"config":  {configPath, paths.configPath},
+	} {
+		if !isFlagSet(name) {
+			*v.p = v.def
+		}
+	}
+	return nil
+}
+
+// isFlagSet returns true if the flag is specified in the command line.
+func isFlagSet(name string) (set bool) {
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return
+}
+
+// applyRootlessConfig applies the defaults of the rootless mode to the config.
+func applyRootlessConfig(cfg *Config) {
+	if cfg.BlobConfig.MaxConcurrentFetches == 0 {
+		cfg.BlobConfig.MaxConcurrentFetches = rootlessMaxConcurrentFetches
+	}
+}
+
+// prepareFusermount makes fusermount3 available as fusermount, which is the name
+// looked up by the FUSE library, on hosts where only FUSE 3 is installed. The
+// symlink is created under dir and dir is prepended to PATH.
+func prepareFusermount(dir string) error {
+	if _, err := exec.LookPath("fusermount"); err == nil {
+		return nil
+	}
+	fm3, err := exec.LookPath("fusermount3")
+	if err != nil {
+		return fmt.Errorf("neither fusermount3 nor fusermount is found; install fuse3")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	link := filepath.Join(dir, "fusermount")
+	if err := os.RemoveAll(link); err != nil {
+		return err
+	}
+	if err := os.Symlink(fm3, link); err != nil {
+		return errors.Wrap(err, "failed to link fusermount3")
+	}
+	return os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// checkRootless checks the prerequisites of the rootless mode.
+func checkRootless(cfg Config, check func(name string, err error)) {
+	if sys.RunningInUserNS() {
+		// FUSE can be mounted in user namespaces since Linux 4.18.
+		var uts unix.Utsname
+		err := unix.Uname(&uts)
+		if err == nil {
+			var major, minor int
+			release := unix.ByteSliceToString(uts.Release[:])
+			if _, sErr := fmt.Sscanf(release, "%d.%d", &major, &minor); sErr != nil {
+				err = errors.Wrapf(sErr, "failed to parse kernel release %q", release)
+			} else if major < 4 || (major == 4 && minor < 18) {
+				err = fmt.Errorf("Linux 4.18 or later is needed for mounting FUSE in a user namespace but %s", release)
+			}
+		}
+		check("kernel for FUSE in user namespace", err)
+		return
+	}
+
+	// Not in a user namespace: mounting needs the setuid fusermount.
+	_, err := exec.LookPath("fusermount")
+	if err != nil {
+		_, err = exec.LookPath("fusermount3")
+	}
+	if err != nil {
+		err = fmt.Errorf("neither fusermount3 nor fusermount is found; install fuse3")
+	}
+	check("fusermount", err)
+	if !cfg.Privilege.NoAllowOther {
+		err := fuseConfAllowsOther("/etc/fuse.conf")
+		if err != nil {
+			err = errors.Wrap(err, "add user_allow_other to /etc/fuse.conf or set privilege.no_allow_other")
+		}
+		check("allow_other of FUSE", err)
+	}
+}
+
+// fuseConfAllowsOther returns nil if the FUSE config allows non-root users to
+// mount with allow_other.
+func fuseConfAllowsOther(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if strings.TrimSpace(sc.Text()) == "user_allow_other" {
+			return nil
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("user_allow_other isn't set in %q", path)
+}
@@ -0,0 +1,81 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetRootlessPaths(t *testing.T) {
+	env := map[string]string{
+		"XDG_RUNTIME_DIR": "/run/user/1000",
+		"HOME":            "/home/user",
+	}
+	paths, err := getRootlessPaths(func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatalf("failed to get paths: %v", err)
+	}
+	want := rootlessPaths{
+		address:    "/run/user/1000/containerd-stargz-grpc/containerd-stargz-grpc.sock",
+		rootDir:    "/home/user/.local/share/containerd-stargz-grpc",
+		configPath: "/home/user/.config/containerd-stargz-grpc/config.toml",
+	}
+	if paths != want {
+		t.Errorf("paths = %+v; want %+v", paths, want)
+	}
+
+	env["XDG_DATA_HOME"] = "/data"
+	env["XDG_CONFIG_HOME"] = "/config"
+	delete(env, "HOME")
+	if paths, err = getRootlessPaths(func(k string) string { return env[k] }); err != nil {
+		t.Fatalf("failed to get paths with XDG directories: %v", err)
+	}
+	if paths.rootDir != "/data/containerd-stargz-grpc" || paths.configPath != "/config/containerd-stargz-grpc/config.toml" {
+		t.Errorf("XDG directories must be used: %+v", paths)
+	}
+
+	delete(env, "XDG_RUNTIME_DIR")
+	if _, err := getRootlessPaths(func(k string) string { return env[k] }); err == nil {
+		t.Errorf("XDG_RUNTIME_DIR must be required")
+	}
+}
+
+func TestFuseConfAllowsOther(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testfuseconf")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	for _, tt := range []struct {
+		conf  string
+		allow bool
+	}{
+		{"# user_allow_other\nmount_max = 1000\n", false},
+		{"mount_max = 1000\n  user_allow_other\n", true},
+	} {
+		p := filepath.Join(tmp, "fuse.conf")
+		if err := ioutil.WriteFile(p, []byte(tt.conf), 0600); err != nil {
+			t.Fatalf("failed to write config: %v", err)
+		}
+		if err := fuseConfAllowsOther(p); (err == nil) != tt.allow {
+			t.Errorf("fuseConfAllowsOther(%q) = %v; want allowed=%v", tt.conf, err, tt.allow)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/stargz-snapshotter/benchmark"
+	"github.com/pkg/errors"
+)
+
+// runSelfTest runs the "selftest" subcommand which lazily pulls an image
+// end-to-end with the resolver configuration of the snapshotter. This is
+// useful for validating nodes on bootstrap.
+func runSelfTest(ctx context.Context, config Config, hosts docker.RegistryHosts, args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	var (
+		image       = fs.String("image", "", "image to lazily pull (must contain eStargz layers)")
+		platform    = fs.String("platform", "", "platform of the image. defaults to the platform of this host")
+		chunks      = fs.Int("chunks", 16, "number of chunks randomly read from each layer")
+		verifyBlobs = fs.Bool("verify-blobs", false, "fetch whole layers and verify their digests in addition")
+		timeout     = fs.Duration("timeout", 5*time.Minute, "timeout of the whole test")
+		jsonOut     = fs.Bool("json", false, "print the result as JSON")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *image == "" {
+		return errors.New("--image must be specified")
+	}
+	opts := []benchmark.SelfTestOption{
+		benchmark.WithChunks(*chunks),
+		benchmark.WithSelfTestBlobConfig(config.BlobConfig),
+	}
+	if *verifyBlobs {
+		opts = append(opts, benchmark.WithVerifyBlobs())
+	}
+	if *platform != "" {
+		p, err := platforms.Parse(*platform)
+		if err != nil {
+			return errors.Wrapf(err, "invalid platform %q", *platform)
+		}
+		opts = append(opts, benchmark.WithSelfTestPlatform(platforms.Only(p)))
+	}
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+	res, err := benchmark.SelfTest(ctx, hosts, *image, opts...)
+	if err != nil {
+		return err
+	}
+	if *jsonOut {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(res)
+	}
+	if err := benchmark.WriteSelfTestResult(w, res); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, "ok")
+	return err
+}
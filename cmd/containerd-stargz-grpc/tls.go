@@ -0,0 +1,236 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+)
+
+const defaultCertsDir = "/etc/containerd/certs.d"
+
+type hostTLS struct {
+	caFiles     []string
+	clientPairs [][2]string // cert and key; empty key means the key is in the cert file
+	skipVerify  bool
+}
+
+// hostsFile is the subset of containerd's hosts.toml used for TLS configuration
+// of the host.
+type hostsFile struct {
+	CA         interface{} `toml:"ca"`
+	Client     interface{} `toml:"client"`
+	SkipVerify bool        `toml:"skip_verify"`
+}
+
+// tlsConfigForHost returns TLS configuration for connecting to the host based
+// on the certs directory and the snapshotter's configuration. If fips is true,
+// the configuration is restricted to FIPS 140 approved algorithms. This returns
+// nil if nothing is configured for the host.
+func tlsConfigForHost(certsDir, host string, cfg TLSConfig, fips bool) (*tls.Config, error) {
+	t, err := loadCertsDir(certsDir, host)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load certs directory of %q", host)
+	}
+	if cfg.CAFile != "" {
+		t.caFiles = append(t.caFiles, cfg.CAFile)
+	}
+	if cfg.CertFile != "" {
+		t.clientPairs = append(t.clientPairs, [2]string{cfg.CertFile, cfg.KeyFile})
+	}
+	t.skipVerify = t.skipVerify || cfg.InsecureSkipVerify
+	if fips && t.skipVerify {
+		return nil, fmt.Errorf("skipping verification of %q isn't allowed in the FIPS mode", host)
+	}
+	if len(t.caFiles) == 0 && len(t.clientPairs) == 0 && !t.skipVerify && !fips {
+		return nil, nil
+	}
+
+	tc := &tls.Config{InsecureSkipVerify: t.skipVerify}
+	if fips {
+		restrictTLSToFIPS(tc)
+	}
+	if len(t.caFiles) > 0 {
+		if tc.RootCAs, err = x509.SystemCertPool(); err != nil {
+			tc.RootCAs = x509.NewCertPool()
+		}
+		for _, f := range t.caFiles {
+			data, err := ioutil.ReadFile(f)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to read CA file %q", f)
+			}
+			if !tc.RootCAs.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("no certificate found in CA file %q", f)
+			}
+		}
+	}
+	for _, pair := range t.clientPairs {
+		key := pair[1]
+		if key == "" {
+			key = pair[0]
+		}
+		cert, err := tls.LoadX509KeyPair(pair[0], key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load client certificate %q", pair[0])
+		}
+		tc.Certificates = append(tc.Certificates, cert)
+	}
+	return tc, nil
+}
+
+// loadCertsDir loads TLS files of the host in the certs directory. The
+// directory of the host is named after the host ("host:port" can also be named
+// "host_port_"). The following files are recognized:
+//   - hosts.toml: "ca", "client" and "skip_verify" of the host itself
+//   - *.crt: CA certificates
+//   - *.cert: client certificates with the keys in the *.key of the same name
+func loadCertsDir(certsDir, host string) (t hostTLS, _ error) {
+	if certsDir == "" {
+		return
+	}
+	var dir string
+	for _, d := range []string{hostDirectory(host), host} {
+		p := filepath.Join(certsDir, d)
+		if fi, err := os.Stat(p); err == nil && fi.IsDir() {
+			dir = p
+			break
+		}
+	}
+	if dir == "" {
+		return
+	}
+
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "hosts.toml")); err == nil {
+		var hf hostsFile
+		if _, err := toml.Decode(string(data), &hf); err != nil {
+			return t, errors.Wrap(err, "failed to parse hosts.toml")
+		}
+		if t.caFiles, err = tomlPaths(dir, hf.CA); err != nil {
+			return t, errors.Wrap(err, "invalid \"ca\"")
+		}
+		if t.clientPairs, err = tomlPairs(dir, hf.Client); err != nil {
+			return t, errors.Wrap(err, "invalid \"client\"")
+		}
+		t.skipVerify = hf.SkipVerify
+	} else if !os.IsNotExist(err) {
+		return t, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return t, err
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		switch name := f.Name(); filepath.Ext(name) {
+		case ".crt":
+			t.caFiles = append(t.caFiles, filepath.Join(dir, name))
+		case ".cert":
+			pair := [2]string{filepath.Join(dir, name)}
+			key := filepath.Join(dir, strings.TrimSuffix(name, ".cert")+".key")
+			if _, err := os.Stat(key); err == nil {
+				pair[1] = key
+			} else if !os.IsNotExist(err) {
+				return t, err
+			}
+			t.clientPairs = append(t.clientPairs, pair)
+		}
+	}
+	return t, nil
+}
+
+// tomlPaths parses a string or an array of strings.
+func tomlPaths(base string, v interface{}) ([]string, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{absPath(base, v)}, nil
+	case []interface{}:
+		var res []string
+		for _, p := range v {
+			s, ok := p.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid type %T", p)
+			}
+			res = append(res, absPath(base, s))
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("invalid type %T", v)
+}
+
+// tomlPairs parses a string, an array of strings or an array of [cert, key].
+func tomlPairs(base string, v interface{}) ([][2]string, error) {
+	if a, ok := v.([]interface{}); ok {
+		var res [][2]string
+		for _, p := range a {
+			if pair, ok := p.([]interface{}); ok {
+				paths, err := tomlPaths(base, pair)
+				if err != nil {
+					return nil, err
+				} else if len(paths) != 2 {
+					return nil, fmt.Errorf("invalid pair %v", pair)
+				}
+				res = append(res, [2]string{paths[0], paths[1]})
+				continue
+			}
+			paths, err := tomlPaths(base, p)
+			if err != nil {
+				return nil, err
+			}
+			for _, c := range paths {
+				res = append(res, [2]string{c})
+			}
+		}
+		return res, nil
+	}
+	paths, err := tomlPaths(base, v)
+	if err != nil {
+		return nil, err
+	}
+	var res [][2]string
+	for _, c := range paths {
+		res = append(res, [2]string{c})
+	}
+	return res, nil
+}
+
+func absPath(base, p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(base, p)
+}
+
+// hostDirectory converts "host:port" to "host_port_" as containerd does.
+func hostDirectory(host string) string {
+	if idx := strings.LastIndex(host, ":"); idx > 0 {
+		return host[:idx] + "_" + host[idx+1:] + "_"
+	}
+	return host
+}
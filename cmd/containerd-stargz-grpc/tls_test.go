@@ -0,0 +1,184 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTLSConfigForHost(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+	serverCA := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+
+	tmp, err := ioutil.TempDir("", "testcertsd")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	certPEM, keyPEM := selfSignedPair(t)
+	writeFiles(t, filepath.Join(tmp, "certs.d", "registry.test_5000_"), map[string][]byte{
+		"ca.crt":      serverCA,
+		"client.cert": certPEM,
+		"client.key":  keyPEM,
+	})
+	writeFiles(t, filepath.Join(tmp, "certs.d", "toml.test"), map[string][]byte{
+		"hosts.toml": []byte(`ca = "certs/server.pem"
+client = [["certs/client.pem", "certs/client-key.pem"]]
+`),
+		"certs/server.pem":     serverCA,
+		"certs/client.pem":     certPEM,
+		"certs/client-key.pem": keyPEM,
+	})
+	writeFiles(t, filepath.Join(tmp, "explicit"), map[string][]byte{
+		"ca.pem":         serverCA,
+		"client.pem":     certPEM,
+		"client-key.pem": keyPEM,
+	})
+	certsDir := filepath.Join(tmp, "certs.d")
+
+	for _, tt := range []struct {
+		name string
+		host string
+		cfg  TLSConfig
+	}{
+		{name: "certs.d", host: "registry.test:5000"},
+		{name: "hosts.toml", host: "toml.test"},
+		{
+			name: "config",
+			host: "none.test",
+			cfg: TLSConfig{
+				CAFile:   filepath.Join(tmp, "explicit", "ca.pem"),
+				CertFile: filepath.Join(tmp, "explicit", "client.pem"),
+				KeyFile:  filepath.Join(tmp, "explicit", "client-key.pem"),
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, err := tlsConfigForHost(certsDir, tt.host, tt.cfg, false)
+			if err != nil {
+				t.Fatalf("failed to get TLS config: %v", err)
+			}
+			if tc == nil || len(tc.Certificates) != 1 {
+				t.Fatalf("client certificate must be loaded: %+v", tc)
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: tc}}
+			resp, err := client.Get(srv.URL)
+			if err != nil {
+				t.Fatalf("failed to connect to the server: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("client certificate isn't sent: status %d", resp.StatusCode)
+			}
+		})
+	}
+
+	if tc, err := tlsConfigForHost(certsDir, "none.test", TLSConfig{}, false); err != nil || tc != nil {
+		t.Errorf("nothing must be configured for unknown host: %+v (err=%v)", tc, err)
+	}
+	if tc, err := tlsConfigForHost(certsDir, "none.test", TLSConfig{InsecureSkipVerify: true}, false); err != nil || tc == nil || !tc.InsecureSkipVerify {
+		t.Errorf("insecure_skip_verify must be enabled: %+v (err=%v)", tc, err)
+	}
+	if _, err := tlsConfigForHost(certsDir, "none.test", TLSConfig{CAFile: filepath.Join(tmp, "explicit", "client-key.pem")}, false); err == nil {
+		t.Errorf("CA file without certificates must be rejected")
+	}
+
+	// FIPS mode
+	if _, err := tlsConfigForHost(certsDir, "none.test", TLSConfig{InsecureSkipVerify: true}, true); err == nil {
+		t.Errorf("insecure_skip_verify must be rejected in the FIPS mode")
+	}
+	if tc, err := tlsConfigForHost(certsDir, "none.test", TLSConfig{}, true); err != nil || tc == nil || tc.MaxVersion != tls.VersionTLS12 {
+		t.Errorf("TLS must be restricted for unknown host in the FIPS mode: %+v (err=%v)", tc, err)
+	}
+	tc, err := tlsConfigForHost(certsDir, "registry.test:5000", TLSConfig{}, true)
+	if err != nil {
+		t.Fatalf("failed to get TLS config in the FIPS mode: %v", err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tc}}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("failed to connect to the server in the FIPS mode: %v", err)
+	}
+	resp.Body.Close()
+	if resp.TLS.Version != tls.VersionTLS12 {
+		t.Errorf("TLS 1.2 must be used in the FIPS mode but %x", resp.TLS.Version)
+	}
+	approved := false
+	for _, c := range fipsCipherSuites {
+		approved = approved || resp.TLS.CipherSuite == c
+	}
+	if !approved {
+		t.Errorf("cipher suite %x isn't approved", resp.TLS.CipherSuite)
+	}
+}
+
+func selfSignedPair(t *testing.T) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeFiles(t *testing.T, dir string, files map[string][]byte) {
+	for name, data := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatalf("failed to make directory: %v", err)
+		}
+		if err := ioutil.WriteFile(p, data, 0600); err != nil {
+			t.Fatalf("failed to write %q: %v", p, err)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+//go:build linux
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	gocontext "context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	stargzfs "github.com/containerd/stargz-snapshotter/fs"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// AnalyzeCommand explains on-demand fetches which slowed down the start of a
+// container.
+var AnalyzeCommand = cli.Command{
+	Name:      "analyze",
+	Usage:     "rank files which caused on-demand fetches during the start of a container",
+	ArgsUsage: "[flags] <container-id>",
+	Description: `Correlate reads of the container's layers which missed the cache with the
+fetch latency and the prefetch state of the layers, and print the paths ranked
+by the total latency of on-demand fetches.
+
+Fetches since the creation of the container are analyzed by default. Paths
+marked as prioritized are in the prefetch region of the layer (e.g. prioritized
+files of eStargz) and were fetched on demand because the prefetch hadn't
+completed. Other paths can be prefetched by optimizing the image against the
+workload (see "ctr-remote image optimize").
+`,
+	Flags: []cli.Flag{
+		apiAddressFlag,
+		cli.DurationFlag{
+			Name:  "since",
+			Usage: "analyze fetches in this duration until now instead of since the creation of the container",
+		},
+		cli.DurationFlag{
+			Name:  "window",
+			Usage: "analyze only fetches in this duration from the start (0 for no limit)",
+		},
+		cli.IntFlag{
+			Name:  "top",
+			Usage: "number of paths to print",
+			Value: 20,
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "print the result as JSON",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		id := context.Args().First()
+		if id == "" {
+			return errors.New("container id must be specified")
+		}
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+		c, err := client.ContainerService().Get(ctx, id)
+		if err != nil {
+			return errors.Wrapf(err, "failed to get container %q", id)
+		}
+		if c.Snapshotter != remoteSnapshotterName {
+			return fmt.Errorf("container %q doesn't use %q snapshotter but %q", id, remoteSnapshotterName, c.Snapshotter)
+		}
+		since := c.CreatedAt
+		if d := context.Duration("since"); d > 0 {
+			since = time.Now().Add(-d)
+		}
+
+		res, err := newAPIClient(context.String(apiAddressFlag.Name)).do(gocontext.Background(), http.MethodGet,
+			"/stats/fetches", url.Values{"key": {c.SnapshotKey}, "since": {since.Format(time.RFC3339Nano)}})
+		if err != nil {
+			return fmt.Errorf("failed to get fetches: %v", err)
+		}
+		defer res.Body.Close()
+		var logs []stargzfs.LayerFetchLog
+		if err := json.NewDecoder(res.Body).Decode(&logs); err != nil {
+			return fmt.Errorf("failed to decode result: %v", err)
+		}
+
+		a := analyzeFetches(logs, since, context.Duration("window"))
+		if top := context.Int("top"); top >= 0 && len(a.Paths) > top {
+			a.Paths = a.Paths[:top]
+		}
+		if context.Bool("json") {
+			enc := json.NewEncoder(context.App.Writer)
+			enc.SetIndent("", "  ")
+			return enc.Encode(a)
+		}
+		return printAnalysis(context.App.Writer, a)
+	},
+}
+
+// fetchAnalysis is the result of analyzing on-demand fetches of a container.
+type fetchAnalysis struct {
+	Since   time.Time       `json:"since"`
+	Layers  []layerAnalysis `json:"layers"`
+	Paths   []pathAnalysis  `json:"paths"`
+	Latency time.Duration   `json:"latency"` // total of all layers
+
+	// PrioritizedLatency is the latency of fetches of prioritized chunks.
+	PrioritizedLatency time.Duration `json:"prioritizedLatency"`
+}
+
+type layerAnalysis struct {
+	Digest            string        `json:"digest"`
+	FetchedPercent    float64       `json:"fetchedPercent"`
+	PrefetchedPercent float64       `json:"prefetchedPercent"`
+	Fetches           int           `json:"fetches"`
+	Latency           time.Duration `json:"latency"`
+	Dropped           int           `json:"dropped,omitempty"`
+}
+
+type pathAnalysis struct {
+	Path        string        `json:"path"`
+	Layer       string        `json:"layer"`
+	Fetches     int           `json:"fetches"`
+	Size        int64         `json:"size"`
+	Latency     time.Duration `json:"latency"`
+	MaxLatency  time.Duration `json:"maxLatency"`
+	Prioritized bool          `json:"prioritized"`
+}
+
+// analyzeFetches aggregates fetches started in [since, since+window) per path
+// and ranks the paths by the total latency. window <= 0 means no limit.
+func analyzeFetches(logs []stargzfs.LayerFetchLog, since time.Time, window time.Duration) *fetchAnalysis {
+	a := &fetchAnalysis{Since: since}
+	type pathKey struct{ layer, path string }
+	paths := make(map[pathKey]*pathAnalysis)
+	for _, l := range logs {
+		la := layerAnalysis{
+			Digest:            l.Digest,
+			FetchedPercent:    l.FetchedPercent,
+			PrefetchedPercent: l.PrefetchedPercent,
+			Dropped:           l.Dropped,
+		}
+		for _, r := range l.Records {
+			if r.Start.Before(since) || (window > 0 && !r.Start.Before(since.Add(window))) {
+				continue
+			}
+			la.Fetches++
+			la.Latency += r.Latency
+			if r.Prioritized {
+				a.PrioritizedLatency += r.Latency
+			}
+			k := pathKey{l.Digest, r.Path}
+			p, ok := paths[k]
+			if !ok {
+				p = &pathAnalysis{Path: r.Path, Layer: l.Digest}
+				paths[k] = p
+			}
+			p.Fetches++
+			p.Size += r.Size
+			p.Latency += r.Latency
+			if r.Latency > p.MaxLatency {
+				p.MaxLatency = r.Latency
+			}
+			// A file is prioritized if any fetched chunk is in the prefetch region.
+			p.Prioritized = p.Prioritized || r.Prioritized
+		}
+		a.Latency += la.Latency
+		a.Layers = append(a.Layers, la)
+	}
+	for _, p := range paths {
+		a.Paths = append(a.Paths, *p)
+	}
+	sort.Slice(a.Paths, func(i, j int) bool {
+		if a.Paths[i].Latency != a.Paths[j].Latency {
+			return a.Paths[i].Latency > a.Paths[j].Latency
+		}
+		return a.Paths[i].Path < a.Paths[j].Path
+	})
+	return a
+}
+
+func printAnalysis(w io.Writer, a *fetchAnalysis) error {
+	tw := tabwriter.NewWriter(w, 1, 8, 1, ' ', 0)
+	fmt.Fprintln(tw, "LAYER\tFETCHED\tPREFETCHED\tFETCHES\tLATENCY")
+	for _, l := range a.Layers {
+		fetches := fmt.Sprintf("%d", l.Fetches)
+		if l.Dropped > 0 {
+			fetches += fmt.Sprintf(" (%d dropped)", l.Dropped)
+		}
+		fmt.Fprintf(tw, "%s\t%.1f%%\t%.1f%%\t%s\t%v\n", shortDigest(l.Digest), l.FetchedPercent, l.PrefetchedPercent, fetches, l.Latency)
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "RANK\tPATH\tLAYER\tFETCHES\tSIZE\tLATENCY\tMAX\tPRIORITIZED")
+	for i, p := range a.Paths {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%d\t%v\t%v\t%v\n", i+1, p.Path, shortDigest(p.Layer), p.Fetches, p.Size, p.Latency, p.MaxLatency, p.Prioritized)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "\non-demand fetches since %s took %v in total\n", a.Since.Format(time.RFC3339), a.Latency); err != nil {
+		return err
+	}
+	if a.Latency == 0 {
+		return nil
+	}
+	if others := a.Latency - a.PrioritizedLatency; others > 0 {
+		fmt.Fprintf(w, "- %v (%.0f%%) is for files not prioritized in the image; optimizing the image against the workload prefetches them\n",
+			others, float64(others)/float64(a.Latency)*100)
+	}
+	if a.PrioritizedLatency > 0 {
+		fmt.Fprintf(w, "- %v (%.0f%%) is for prioritized files read before the prefetch completed; check the bandwidth to the registry and the prefetch timeout\n",
+			a.PrioritizedLatency, float64(a.PrioritizedLatency)/float64(a.Latency)*100)
+	}
+	return nil
+}
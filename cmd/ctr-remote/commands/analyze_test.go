@@ -0,0 +1,72 @@
+//go:build linux
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"testing"
+	"time"
+
+	stargzfs "github.com/containerd/stargz-snapshotter/fs"
+)
+
+func TestAnalyzeFetches(t *testing.T) {
+	since := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	rec := func(path string, after, latency time.Duration, prioritized bool) stargzfs.FetchRecord {
+		return stargzfs.FetchRecord{Path: path, Size: 10, Start: since.Add(after), Latency: latency, Prioritized: prioritized}
+	}
+	logs := []stargzfs.LayerFetchLog{
+		{
+			LayerProgress: stargzfs.LayerProgress{Digest: "sha256:aaa"},
+			Records: []stargzfs.FetchRecord{
+				rec("/before", -time.Second, time.Hour, false),
+				rec("/bin/app", time.Second, 100*time.Millisecond, false),
+				rec("/bin/app", 2*time.Second, 300*time.Millisecond, false),
+				rec("/after", time.Minute, time.Hour, false),
+			},
+		},
+		{
+			LayerProgress: stargzfs.LayerProgress{Digest: "sha256:bbb"},
+			Records: []stargzfs.FetchRecord{
+				rec("/etc/conf", time.Second, 200*time.Millisecond, true),
+				rec("/bin/app", time.Second, 50*time.Millisecond, false),
+			},
+		},
+	}
+	a := analyzeFetches(logs, since, 10*time.Second)
+	want := []pathAnalysis{
+		{Path: "/bin/app", Layer: "sha256:aaa", Fetches: 2, Size: 20, Latency: 400 * time.Millisecond, MaxLatency: 300 * time.Millisecond},
+		{Path: "/etc/conf", Layer: "sha256:bbb", Fetches: 1, Size: 10, Latency: 200 * time.Millisecond, MaxLatency: 200 * time.Millisecond, Prioritized: true},
+		{Path: "/bin/app", Layer: "sha256:bbb", Fetches: 1, Size: 10, Latency: 50 * time.Millisecond, MaxLatency: 50 * time.Millisecond},
+	}
+	if len(a.Paths) != len(want) {
+		t.Fatalf("unexpected paths %+v", a.Paths)
+	}
+	for i := range want {
+		if a.Paths[i] != want[i] {
+			t.Errorf("path[%d] = %+v; want %+v", i, a.Paths[i], want[i])
+		}
+	}
+	if a.Latency != 650*time.Millisecond || a.PrioritizedLatency != 200*time.Millisecond {
+		t.Errorf("unexpected latency %v (prioritized %v)", a.Latency, a.PrioritizedLatency)
+	}
+	if len(a.Layers) != 2 || a.Layers[0].Fetches != 2 || a.Layers[1].Fetches != 2 {
+		t.Errorf("unexpected layers %+v", a.Layers)
+	}
+}
@@ -0,0 +1,80 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+const (
+	defaultAPIAddress         = "/run/containerd-stargz-grpc/api.sock"
+	defaultSnapshotterAddress = "/run/containerd-stargz-grpc/containerd-stargz-grpc.sock"
+)
+
+// apiAddressFlag specifies the address of stargz snapshotter's HTTP API.
+var apiAddressFlag = cli.StringFlag{
+	Name:  "api-address",
+	Usage: "address of stargz snapshotter's API server",
+	Value: defaultAPIAddress,
+}
+
+// apiClient is a client of the HTTP API served by containerd-stargz-grpc.
+type apiClient struct {
+	client *http.Client
+}
+
+func newAPIClient(address string) *apiClient {
+	return &apiClient{
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", address)
+				},
+			},
+		},
+	}
+}
+
+// do sends a request to the specified API endpoint. The caller must close the
+// body of the returned response.
+func (c *apiClient) do(ctx context.Context, method, path string, query url.Values) (*http.Response, error) {
+	u := url.URL{Scheme: "http", Host: "stargz-snapshotter", Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		defer res.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4096))
+		return nil, fmt.Errorf("unexpected status %q: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+	return res, nil
+}
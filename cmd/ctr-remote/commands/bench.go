@@ -0,0 +1,131 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	gocontext "context"
+	"io"
+	"os"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/stargz-snapshotter/benchmark"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// BenchCommand measures lazy pulling of an image without containerd.
+var BenchCommand = cli.Command{
+	Name:      "bench",
+	Usage:     "measure lazy pulling of an image and emit the results as JSON",
+	ArgsUsage: "[flags] <ref>",
+	Description: `Lazily pulls the image from the registry (without containerd and FUSE) and
+reads the files of the workloads, measuring time-to-mount, time-to-first-read,
+time-to-ready and bytes fetched from the registry. Each run starts with empty
+caches. A workload is a file listing paths in the order of accesses (one per
+line) or a JSON object {"name": ..., "files": [...]} .
+`,
+	Flags: append(commands.RegistryFlags,
+		cli.StringSliceFlag{
+			Name:  "workload",
+			Usage: "file of a workload to run. if not specified, only mounting is measured",
+		},
+		cli.IntFlag{
+			Name:  "runs",
+			Usage: "number of runs of each workload",
+			Value: 3,
+		},
+		cli.BoolFlag{
+			Name:  "no-prefetch",
+			Usage: "don't prefetch the prioritized files on mount",
+		},
+		cli.Int64Flag{
+			Name:  "prefetch-size",
+			Usage: "size prefetched from layers without the prefetch landmark",
+		},
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "platform of the image to measure",
+		},
+		cli.StringFlag{
+			Name:  "output,o",
+			Usage: "file to write the results. defaults to stdout",
+		},
+	),
+	Action: func(clicontext *cli.Context) error {
+		ref := clicontext.Args().First()
+		if ref == "" {
+			return errors.New("please provide an image reference to measure")
+		}
+		runs := clicontext.Int("runs")
+		if runs <= 0 {
+			return errors.New("runs must be positive")
+		}
+		workloads := []benchmark.Workload{{}}
+		if paths := clicontext.StringSlice("workload"); len(paths) > 0 {
+			workloads = nil
+			for _, p := range paths {
+				w, err := benchmark.LoadWorkload(p)
+				if err != nil {
+					return errors.Wrapf(err, "failed to load workload %q", p)
+				}
+				workloads = append(workloads, w)
+			}
+		}
+		var opts []benchmark.Option
+		if clicontext.Bool("no-prefetch") {
+			opts = append(opts, benchmark.WithNoPrefetch())
+		}
+		if size := clicontext.Int64("prefetch-size"); size > 0 {
+			opts = append(opts, benchmark.WithPrefetchSize(size))
+		}
+		if pStr := clicontext.String("platform"); pStr != "" {
+			p, err := platforms.Parse(pStr)
+			if err != nil {
+				return errors.Wrapf(err, "invalid platform %q", pStr)
+			}
+			opts = append(opts, benchmark.WithPlatform(platforms.Only(p)))
+		}
+
+		ctx := gocontext.Background()
+		hosts, err := registryHosts(ctx, clicontext)
+		if err != nil {
+			return err
+		}
+		var results []*benchmark.Result
+		for _, w := range workloads {
+			for i := 0; i < runs; i++ {
+				res, err := benchmark.Run(ctx, hosts, ref, w, opts...)
+				if err != nil {
+					return errors.Wrapf(err, "failed to run workload %q", w.Name)
+				}
+				results = append(results, res)
+			}
+		}
+
+		var out io.Writer = os.Stdout
+		if o := clicontext.String("output"); o != "" {
+			f, err := os.Create(o)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			out = f
+		}
+		return benchmark.WriteJSON(out, results)
+	},
+}
@@ -0,0 +1,237 @@
+//go:build linux
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	gocontext "context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	ctrcontent "github.com/containerd/containerd/cmd/ctr/commands/content"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/stargz-snapshotter/fs/source/offline"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var InvalidateCacheCommand = cli.Command{
+	Name:      "invalidate-cache",
+	Usage:     "drop cached contents of layers and refetch them on the next access",
+	ArgsUsage: "[flags] <layer digest>...",
+	Description: `Drop cached chunks and TOC of lazily pulled layers in stargz snapshotter.
+
+The contents are fetched from the registry again on the next access. This is
+useful when a registry (mirror) served corrupted data and the node needs to
+recover without reboot.
+`,
+	Flags: []cli.Flag{apiAddressFlag},
+	Action: func(context *cli.Context) error {
+		if context.NArg() == 0 {
+			return fmt.Errorf("please provide digests of layers to invalidate")
+		}
+		c := newAPIClient(context.String(apiAddressFlag.Name))
+		for _, d := range context.Args() {
+			if _, err := digest.Parse(d); err != nil {
+				return fmt.Errorf("invalid digest %q: %v", d, err)
+			}
+			res, err := c.do(gocontext.Background(), http.MethodPost, "/invalidate", url.Values{"digest": {d}})
+			if err != nil {
+				return fmt.Errorf("failed to invalidate %q: %v", d, err)
+			}
+			res.Body.Close()
+			fmt.Fprintln(context.App.Writer, d)
+		}
+		return nil
+	},
+}
+
+const defaultOfflineCacheDir = "/var/lib/containerd-stargz-grpc/offline"
+
+var CacheCommand = cli.Command{
+	Name:  "cache",
+	Usage: "manage caches of images of stargz snapshotter (pre-seeded caches for the offline mode and pins)",
+	Subcommands: []cli.Command{
+		cacheExportCommand,
+		cacheImportCommand,
+		cachePinCommand,
+		cacheUnpinCommand,
+		cachePinsCommand,
+	},
+}
+
+var cacheExportCommand = cli.Command{
+	Name:      "export",
+	Usage:     "export an image with whole layer blobs to a tar archive",
+	ArgsUsage: "[flags] <image> <archive>",
+	Description: `Export the image in containerd as a tar archive (OCI image layout), which can be
+imported by "ctr-remote cache import" on disconnected nodes.
+
+Layers which aren't in the content store (e.g. lazily pulled ones) are fetched
+from the registry.
+`,
+	Flags: append(commands.RegistryFlags,
+		cli.StringSliceFlag{
+			Name:  "platform",
+			Usage: "export the manifests of the platforms. Defaults to the platform of this host.",
+		},
+		cli.BoolFlag{
+			Name:  "all-platforms",
+			Usage: "export the manifests of all platforms",
+		},
+	),
+	Action: func(context *cli.Context) error {
+		ref, out := context.Args().Get(0), context.Args().Get(1)
+		if ref == "" || out == "" {
+			return fmt.Errorf("please provide an image and the archive path")
+		}
+		p := platforms.Default()
+		if context.Bool("all-platforms") {
+			p = platforms.All
+		} else if ps := context.StringSlice("platform"); len(ps) > 0 {
+			var specs []ocispec.Platform
+			for _, s := range ps {
+				sp, err := platforms.Parse(s)
+				if err != nil {
+					return errors.Wrapf(err, "invalid platform %q", s)
+				}
+				specs = append(specs, sp)
+			}
+			p = platforms.Any(specs...)
+		}
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+		img, err := client.ImageService().Get(ctx, ref)
+		if err != nil {
+			return err
+		}
+		resolver, err := commands.GetResolver(ctx, context)
+		if err != nil {
+			return err
+		}
+		remote, err := resolver.Fetcher(ctx, ref)
+		if err != nil {
+			return err
+		}
+		cs := client.ContentStore()
+		f := remotes.FetcherFunc(func(ctx gocontext.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+			ra, err := cs.ReaderAt(ctx, desc)
+			if err == nil {
+				return &readerAtCloser{content.NewReader(ra), ra}, nil
+			} else if !errdefs.IsNotFound(err) {
+				return nil, err
+			}
+			return remote.Fetch(ctx, desc)
+		})
+		w, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		if err := offline.Export(ctx, w, f, ref, img.Target, p); err != nil {
+			w.Close()
+			os.Remove(out)
+			return errors.Wrapf(err, "failed to export %q", ref)
+		}
+		return w.Close()
+	},
+}
+
+type readerAtCloser struct {
+	io.Reader
+	io.Closer
+}
+
+var cacheImportCommand = cli.Command{
+	Name:      "import",
+	Usage:     "import images exported by \"cache export\" to the offline cache and containerd",
+	ArgsUsage: "[flags] <archive>",
+	Description: `Import the archive to the cache of stargz snapshotter running with "offline = true"
+and register the images to containerd using stargz snapshotter. Layers are
+lazily served from the cache and registries are never contacted.
+`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "cache-dir",
+			Usage: "cache directory of the offline mode of stargz snapshotter",
+			Value: defaultOfflineCacheDir,
+		},
+		cli.BoolFlag{
+			Name:  "no-pull",
+			Usage: "only import the archive to the cache without registering images to containerd",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		in := context.Args().First()
+		if in == "" {
+			return fmt.Errorf("please provide the archive to import")
+		}
+		dir := context.String("cache-dir")
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+		r, err := os.Open(in)
+		if err != nil {
+			return err
+		}
+		names, err := offline.Import(dir, r)
+		r.Close()
+		if err != nil {
+			return errors.Wrapf(err, "failed to import %q", in)
+		}
+		if context.Bool("no-pull") {
+			for _, name := range names {
+				fmt.Fprintln(context.App.Writer, name)
+			}
+			return nil
+		}
+
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+		ctx, done, err := client.WithLease(ctx)
+		if err != nil {
+			return err
+		}
+		defer done(ctx)
+		config := &rPullConfig{
+			FetchConfig: &ctrcontent.FetchConfig{Resolver: offline.NewResolver(dir)},
+		}
+		for _, name := range names {
+			if err := pull(ctx, client, name, config); err != nil {
+				return errors.Wrapf(err, "failed to register %q", name)
+			}
+			fmt.Fprintln(context.App.Writer, name)
+		}
+		return nil
+	},
+}
@@ -20,7 +20,12 @@ import (
 	"compress/gzip"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/containerd/containerd/cmd/ctr/commands"
 	"github.com/containerd/containerd/platforms"
@@ -28,7 +33,10 @@ import (
 	"github.com/containerd/stargz-snapshotter/estargz"
 	"github.com/containerd/stargz-snapshotter/nativeconverter"
 	estargzconvert "github.com/containerd/stargz-snapshotter/nativeconverter/estargz"
+	nydusconvert "github.com/containerd/stargz-snapshotter/nativeconverter/nydus"
 	"github.com/containerd/stargz-snapshotter/nativeconverter/uncompress"
+	"github.com/containerd/stargz-snapshotter/nativeconverter/zstdchunked"
+	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -43,8 +51,28 @@ var ConvertCommand = cli.Command{
 
 e.g., 'ctr-remote convert --estargz --oci example.com/foo:orig example.com/foo:esgz'
 
+Use '--to' to convert an eStargz image into another lazy-pulling format.
+e.g., 'ctr-remote convert --to nydus --oci example.com/foo:esgz example.com/foo:nydus'
+
+Use '--merge-layers' to merge adjacent layers into one layer.
+e.g., 'ctr-remote convert --estargz --oci --merge-layers 0-9 example.com/foo:orig example.com/foo:esgz'
+
+The output eStargz layers are reproducible for the same input and flags.
+The modification time of the files added to the layers (e.g. landmarks) is taken
+from SOURCE_DATE_EPOCH environment variable if set.
+
+Defaults of the output (the chunk size, the compression level, excluded paths
+and annotations of manifests) can be defined by the conversion policy file
+specified by '--policy' (default: ~/.config/ctr-remote/convert.toml).
+
 Use '--platform' to define the output platform.
 When '--all-platforms' is given all images in a manifest list must be available.
+
+Attestation manifests (e.g. SBOMs and provenances made by BuildKit) in the
+source index are kept and re-associated with the converted manifests.
+Use '--digest-map' to write the mapping from the original manifest digests to
+the converted ones, for re-associating artifacts outside of the image (e.g.
+signatures and referrers in the registry).
 `,
 	Flags: []cli.Flag{
 		// estargz flags
@@ -56,6 +84,10 @@ When '--all-platforms' is given all images in a manifest list must be available.
 			Name:  "estargz-record-in",
 			Usage: "Read 'ctr-remote optimize --record-out=<FILE>' record file",
 		},
+		cli.StringSliceFlag{
+			Name:  "estargz-profile-record-in",
+			Usage: "Read a record file for the named prefetch profile (<NAME>=<FILE>). Layers are mounted with the profile by 'containerd.io/snapshot/remote/stargz.prefetch-profile=<NAME>' snapshot label",
+		},
 		cli.IntFlag{
 			Name:  "estargz-compression-level",
 			Usage: "eStargz compression level",
@@ -66,6 +98,11 @@ When '--all-platforms' is given all images in a manifest list must be available.
 			Usage: "eStargz chunk size",
 			Value: 0,
 		},
+		// format bridges
+		cli.StringFlag{
+			Name:  "to",
+			Usage: "convert eStargz layers to another lazy-pulling format reusing their TOCs (nydus, zstd:chunked). Should be used in conjunction with '--oci'",
+		},
 		// generic flags
 		cli.BoolFlag{
 			Name:  "uncompress",
@@ -75,6 +112,10 @@ When '--all-platforms' is given all images in a manifest list must be available.
 			Name:  "oci",
 			Usage: "convert Docker media types to OCI media types",
 		},
+		cli.StringSliceFlag{
+			Name:  "merge-layers",
+			Usage: "merge adjacent layers in the range of 0-based layer indexes (<START>-<END> or <START>- for the rest) into a single layer before conversion",
+		},
 		// platform flags
 		cli.StringSliceFlag{
 			Name:  "platform",
@@ -85,6 +126,11 @@ When '--all-platforms' is given all images in a manifest list must be available.
 			Name:  "all-platforms",
 			Usage: "Convert content for all platforms",
 		},
+		cli.StringFlag{
+			Name:  "digest-map",
+			Usage: "write the mapping from the original manifest (index) digests to the converted ones to the file as JSON",
+		},
+		policyFlag,
 	},
 	Action: func(context *cli.Context) error {
 		var (
@@ -95,6 +141,10 @@ When '--all-platforms' is given all images in a manifest list must be available.
 		if srcRef == "" || targetRef == "" {
 			return errors.New("src and target image need to be specified")
 		}
+		policy, err := loadConvertPolicy(context)
+		if err != nil {
+			return err
+		}
 
 		if !context.Bool("all-platforms") {
 			if pss := context.StringSlice("platform"); len(pss) > 0 {
@@ -113,7 +163,7 @@ When '--all-platforms' is given all images in a manifest list must be available.
 		}
 
 		if context.Bool("estargz") {
-			esgzOpts, err := getESGZConvertOpts(context)
+			esgzOpts, err := getESGZConvertOpts(context, policy)
 			if err != nil {
 				return err
 			}
@@ -130,10 +180,49 @@ When '--all-platforms' is given all images in a manifest list must be available.
 			convertOpts = append(convertOpts, nativeconverter.WithLayerConvertFunc(uncompress.LayerConvertFunc))
 		}
 
+		if to := context.String("to"); to != "" {
+			if context.Bool("estargz") || context.Bool("uncompress") {
+				return errors.New("option --to conflicts with --estargz and --uncompress")
+			}
+			bridgeOpts, err := getBridgeConvertOpts(to)
+			if err != nil {
+				return err
+			}
+			convertOpts = append(convertOpts, bridgeOpts...)
+			if !context.Bool("oci") {
+				logrus.Warn("option --to should be used in conjunction with --oci")
+			}
+		}
+
 		if context.Bool("oci") {
 			convertOpts = append(convertOpts, nativeconverter.WithDockerToOCI(true))
 		}
 
+		annotations, err := policy.annotations(srcRef, targetRef)
+		if err != nil {
+			return err
+		}
+		if len(annotations) > 0 {
+			convertOpts = append(convertOpts, nativeconverter.WithManifestAnnotations(annotations))
+			if !context.Bool("oci") {
+				logrus.Warn("annotations of the policy aren't added to Docker manifests; use --oci")
+			}
+		}
+
+		for _, r := range context.StringSlice("merge-layers") {
+			lr, err := nativeconverter.ParseLayerRange(r)
+			if err != nil {
+				return err
+			}
+			convertOpts = append(convertOpts, nativeconverter.WithMergeLayers(lr))
+		}
+
+		digestMapFile := context.String("digest-map")
+		digestMap := make(map[digest.Digest]digest.Digest)
+		if digestMapFile != "" {
+			convertOpts = append(convertOpts, nativeconverter.WithDigestMap(digestMap))
+		}
+
 		client, ctx, cancel, err := commands.NewClient(context)
 		if err != nil {
 			return err
@@ -148,15 +237,32 @@ When '--all-platforms' is given all images in a manifest list must be available.
 		if err != nil {
 			return err
 		}
+		if digestMapFile != "" {
+			if err := writeDigestMap(digestMapFile, digestMap); err != nil {
+				return errors.Wrapf(err, "failed to write digest map to %q", digestMapFile)
+			}
+		}
 		fmt.Fprintln(context.App.Writer, newImg.Target.Digest.String())
 		return nil
 	},
 }
 
-func getESGZConvertOpts(context *cli.Context) ([]estargz.Option, error) {
-	esgzOpts := []estargz.Option{
-		estargz.WithCompressionLevel(context.Int("estargz-compression-level")),
-		estargz.WithChunkSize(context.Int("estargz-chunk-size")),
+func writeDigestMap(filename string, m map[digest.Digest]digest.Digest) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, append(b, '\n'), 0644)
+}
+
+func getESGZConvertOpts(context *cli.Context, policy *convertPolicy) ([]estargz.Option, error) {
+	esgzOpts := policy.esgzOptions(context, "estargz-chunk-size", "estargz-compression-level")
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		sec, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid SOURCE_DATE_EPOCH %q", epoch)
+		}
+		esgzOpts = append(esgzOpts, estargz.WithSourceDateEpoch(time.Unix(sec, 0).UTC()))
 	}
 	if estargzRecordIn := context.String("estargz-record-in"); estargzRecordIn != "" {
 		paths, err := readPathsFromRecordFile(estargzRecordIn)
@@ -167,9 +273,57 @@ func getESGZConvertOpts(context *cli.Context) ([]estargz.Option, error) {
 		var ignored []string
 		esgzOpts = append(esgzOpts, estargz.WithAllowPrioritizeNotFound(&ignored))
 	}
+	if profileRecordIn := context.StringSlice("estargz-profile-record-in"); len(profileRecordIn) > 0 {
+		profiles := make(map[string][]string)
+		for _, p := range profileRecordIn {
+			name, filename := p, ""
+			if i := strings.Index(p, "="); i >= 0 {
+				name, filename = p[:i], p[i+1:]
+			}
+			if name == "" || filename == "" {
+				return nil, errors.Errorf("invalid profile record %q; must be <NAME>=<FILE>", p)
+			}
+			paths, err := readPathsFromRecordFile(filename)
+			if err != nil {
+				return nil, err
+			}
+			profiles[name] = append(profiles[name], paths...)
+		}
+		esgzOpts = append(esgzOpts, estargz.WithPrefetchProfiles(profiles))
+		if context.String("estargz-record-in") == "" {
+			var ignored []string
+			esgzOpts = append(esgzOpts, estargz.WithAllowPrioritizeNotFound(&ignored))
+		}
+	}
 	return esgzOpts, nil
 }
 
+// getBridgeConvertOpts returns options for converting eStargz images into the
+// specified format.
+func getBridgeConvertOpts(to string) ([]nativeconverter.ConvertOpt, error) {
+	switch to {
+	case "nydus":
+		return []nativeconverter.ConvertOpt{
+			nativeconverter.WithLayerConvertFunc(nydusconvert.LayerConvertFunc()),
+			nativeconverter.WithAppendLayersFunc(nydusconvert.AppendBootstrapFunc()),
+		}, nil
+	case "zstd:chunked":
+		return []nativeconverter.ConvertOpt{
+			nativeconverter.WithLayerConvertFunc(zstdchunked.LayerConvertFunc()),
+		}, nil
+	case "soci-index":
+		// SOCI indexes refer to zTOCs which have checkpoints of the gzip
+		// decompressor. They can't be derived from eStargz TOCs.
+		return nil, errors.New("conversion to soci-index isn't supported")
+	}
+	return nil, errors.Errorf("unknown format %q; must be nydus or zstd:chunked", to)
+}
+
+// readPathsFromRecordFile reads the paths recorded in the file. If the record
+// has phases of the workload (see "--phase-marker" of "optimize"), paths are
+// ordered by the phase of the first access so files of earlier phases are
+// placed earlier, and by the time of the access if all entries have it.
+// Otherwise, paths keep the order of the record.
 func readPathsFromRecordFile(filename string) ([]string, error) {
 	r, err := os.Open(filename)
 	if err != nil {
@@ -177,13 +331,25 @@ func readPathsFromRecordFile(filename string) ([]string, error) {
 	}
 	defer r.Close()
 	dec := json.NewDecoder(r)
-	var paths []string
-	added := make(map[string]struct{})
+	var entries []recorder.Entry
+	timed := true
 	for dec.More() {
 		var e recorder.Entry
 		if err := dec.Decode(&e); err != nil {
 			return nil, err
 		}
+		timed = timed && e.Time != nil
+		entries = append(entries, e)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Phase != entries[j].Phase {
+			return entries[i].Phase < entries[j].Phase
+		}
+		return timed && entries[i].Time.Before(*entries[j].Time)
+	})
+	var paths []string
+	added := make(map[string]struct{})
+	for _, e := range entries {
 		if _, ok := added[e.Path]; !ok {
 			paths = append(paths, e.Path)
 			added[e.Path] = struct{}{}
@@ -0,0 +1,91 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/converter/optimizer/recorder"
+)
+
+func TestReadPathsFromRecordFile(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testrecord")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	writeRecord := func(entries ...recorder.Entry) string {
+		f, err := ioutil.TempFile(tmp, "record")
+		if err != nil {
+			t.Fatalf("failed to create record: %v", err)
+		}
+		defer f.Close()
+		enc := json.NewEncoder(f)
+		for _, e := range entries {
+			if err := enc.Encode(e); err != nil {
+				t.Fatalf("failed to write record: %v", err)
+			}
+		}
+		return f.Name()
+	}
+	at := func(sec int) *time.Time {
+		t := time.Unix(int64(sec), 0)
+		return &t
+	}
+
+	tests := []struct {
+		name    string
+		entries []recorder.Entry
+		want    []string
+	}{
+		{
+			name: "no phases",
+			entries: []recorder.Entry{
+				{Path: "b"}, {Path: "a"}, {Path: "b"}, {Path: "c"},
+			},
+			want: []string{"b", "a", "c"},
+		},
+		{
+			// Entries are recorded layer by layer.
+			name: "phases",
+			entries: []recorder.Entry{
+				{Path: "lib/a", Time: at(3), Phase: 2},
+				{Path: "lib/b", Time: at(1), Phase: 1},
+				{Path: "bin/c", Time: at(2), Phase: 1},
+				{Path: "bin/d", Time: at(4), Phase: 2},
+				{Path: "bin/c", Time: at(5), Phase: 2},
+			},
+			want: []string{"lib/b", "bin/c", "lib/a", "bin/d"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paths, err := readPathsFromRecordFile(writeRecord(tt.entries...))
+			if err != nil {
+				t.Fatalf("failed to read record: %v", err)
+			}
+			if got, want := strings.Join(paths, ","), strings.Join(tt.want, ","); got != want {
+				t.Errorf("paths = %q; want %q", got, want)
+			}
+		})
+	}
+}
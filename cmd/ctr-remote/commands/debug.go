@@ -0,0 +1,118 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	gocontext "context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// DebugCommand provides subcommands for diagnosing stargz snapshotter.
+var DebugCommand = cli.Command{
+	Name:        "debug",
+	Usage:       "diagnose stargz snapshotter",
+	Subcommands: []cli.Command{debugProfileCommand},
+}
+
+var debugProfileCommand = cli.Command{
+	Name:  "profile",
+	Usage: "get a profile of stargz snapshotter",
+	Description: `Get a profile from the running stargz snapshotter.
+
+Types of profiles:
+  cpu        : CPU profile of the daemon (pprof format)
+  heap       : heap profile of the daemon (pprof format)
+  trace      : Go runtime execution trace of the daemon
+  fuse-trace : FUSE operations slower than --threshold (JSON)
+
+cpu, trace and fuse-trace are recorded for --duration.
+`,
+	Flags: []cli.Flag{
+		apiAddressFlag,
+		cli.StringFlag{
+			Name:  "type",
+			Usage: "type of the profile (cpu, heap, trace, fuse-trace)",
+			Value: "cpu",
+		},
+		cli.DurationFlag{
+			Name:  "duration",
+			Usage: "duration to record the profile",
+			Value: 30 * time.Second,
+		},
+		cli.DurationFlag{
+			Name:  "threshold",
+			Usage: "minimal latency of FUSE operations recorded by fuse-trace",
+			Value: 10 * time.Millisecond,
+		},
+		cli.StringFlag{
+			Name:  "output,o",
+			Usage: "file to write the profile (\"-\" for stdout)",
+			Value: "-",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		duration := context.Duration("duration")
+		seconds := strconv.Itoa(int((duration + time.Second - 1) / time.Second))
+		var (
+			path  string
+			query url.Values
+		)
+		switch t := context.String("type"); t {
+		case "cpu":
+			path, query = "/debug/pprof/profile", url.Values{"seconds": {seconds}}
+		case "heap":
+			path = "/debug/pprof/heap"
+		case "trace":
+			path, query = "/debug/pprof/trace", url.Values{"seconds": {seconds}}
+		case "fuse-trace":
+			path, query = "/debug/fuse-trace", url.Values{
+				"duration":  {duration.String()},
+				"threshold": {context.Duration("threshold").String()},
+			}
+		default:
+			return fmt.Errorf("unknown profile type %q", t)
+		}
+
+		var w io.Writer = context.App.Writer
+		if o := context.String("output"); o != "-" {
+			f, err := os.Create(o)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		c := newAPIClient(context.String(apiAddressFlag.Name))
+		res, err := c.do(gocontext.Background(), http.MethodGet, path, query)
+		if err != nil {
+			return fmt.Errorf("failed to get profile: %v", err)
+		}
+		defer res.Body.Close()
+		if _, err := io.Copy(w, res.Body); err != nil {
+			return fmt.Errorf("failed to write profile: %v", err)
+		}
+		return nil
+	},
+}
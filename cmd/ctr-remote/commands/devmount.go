@@ -0,0 +1,224 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"compress/gzip"
+	gocontext "context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"syscall"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/stargz-snapshotter/converter/optimizer/imageio"
+	"github.com/containerd/stargz-snapshotter/converter/optimizer/logger"
+	"github.com/containerd/stargz-snapshotter/converter/optimizer/recorder"
+	"github.com/containerd/stargz-snapshotter/util/tempfiles"
+	regpkg "github.com/google/go-containerregistry/pkg/v1"
+	spec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/sync/errgroup"
+)
+
+// DevMountCommand mounts layers of an image with the logger filesystem used by
+// "optimize" so that the image can be inspected and the accesses to it can be
+// profiled without containerd and the snapshotter. This works on macOS with
+// macFUSE as well as on Linux.
+var DevMountCommand = cli.Command{
+	Name:      "devmount",
+	Usage:     "mount layers of an image locally for inspecting and profiling it (development mode)",
+	ArgsUsage: "<ref> <mountpoint>",
+	Description: `Each layer is mounted on <mountpoint>/<index> (the base layer is 0) until
+the command receives a signal (Ctrl + C). Then files accessed through the mount
+points are printed in the format of "ctr-remote image optimize --record-out".`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "plain-http",
+			Usage: "allow HTTP connections to the registry which has the prefix \"http://\"",
+		},
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "platform of the image to mount (default: linux/<arch of this machine>)",
+		},
+		cli.StringFlag{
+			Name:  "record-out",
+			Usage: "write the record of accessed files to the specified file instead of stdout",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		ref, mountpoint := context.Args().Get(0), context.Args().Get(1)
+		if ref == "" || mountpoint == "" {
+			return errors.New("image reference and mountpoint must be specified")
+		}
+		ctx := gocontext.Background()
+
+		iio, err := parseReference(ref, context)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse ref %q", ref)
+		}
+		// Images for Linux are mounted by default even on macOS.
+		platform := spec.Platform{OS: "linux", Architecture: runtime.GOARCH}
+		if pStr := context.String("platform"); pStr != "" {
+			if platform, err = platforms.Parse(pStr); err != nil {
+				return errors.Wrapf(err, "failed to parse platform %q", pStr)
+			}
+		}
+		img, err := readPlatformImage(iio, platform)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read image %q", ref)
+		}
+		manifestDigest, err := img.Digest()
+		if err != nil {
+			return err
+		}
+		layers, err := img.Layers()
+		if err != nil {
+			return err
+		}
+
+		tf := tempfiles.NewTempFiles()
+		defer func() {
+			if err := tf.CleanupAll(); err != nil {
+				log.G(ctx).WithError(err).Warn("failed to cleanup layer files")
+			}
+		}()
+		var (
+			eg        errgroup.Group
+			monitors  = make([]logger.Monitor, len(layers))
+			unmounts  []func() error
+			unmountMu sync.Mutex
+		)
+		defer func() {
+			for _, unmount := range unmounts {
+				if err := unmount(); err != nil {
+					log.G(ctx).WithError(err).Warn("failed to unmount layer")
+				}
+			}
+		}()
+		for i, l := range layers {
+			i, l := i, l
+			eg.Go(func() error {
+				dgst, err := l.Digest()
+				if err != nil {
+					return err
+				}
+				mp := filepath.Join(mountpoint, fmt.Sprintf("%d", i))
+				if err := os.MkdirAll(mp, 0755); err != nil {
+					return err
+				}
+				decompressedFile, err := tf.TempFile("", "decompresseddata")
+				if err != nil {
+					return err
+				}
+				r, err := l.Compressed()
+				if err != nil {
+					return err
+				}
+				defer r.Close()
+				zr, err := gzip.NewReader(r)
+				if err != nil {
+					return errors.Wrapf(err, "layer %q isn't gzip-compressed", dgst)
+				}
+				defer zr.Close()
+				if _, err := io.Copy(decompressedFile, zr); err != nil {
+					return errors.Wrapf(err, "failed to decompress layer %q", dgst)
+				}
+				mon := logger.NewOpenReadMonitor()
+				unmount, err := logger.Mount(mp, decompressedFile, mon)
+				if err != nil {
+					return errors.Wrapf(err, "failed to mount on %q", mp)
+				}
+				unmountMu.Lock()
+				unmounts = append(unmounts, unmount)
+				unmountMu.Unlock()
+				monitors[i] = mon
+				log.G(ctx).WithField("digest", dgst).Infof("mounted layer on %q", mp)
+				return nil
+			})
+		}
+		if err := eg.Wait(); err != nil {
+			return err
+		}
+
+		log.G(ctx).Infof("all layers are mounted; press Ctrl + C to unmount")
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+		<-sigCh
+
+		var w io.Writer = os.Stdout
+		if recordOut := context.String("record-out"); recordOut != "" {
+			f, err := os.Create(recordOut)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		rec := recorder.New(w)
+		for i, mon := range monitors {
+			i := i
+			recorded := make(map[string]bool)
+			for _, p := range mon.DumpLog() {
+				if recorded[p] {
+					continue
+				}
+				recorded[p] = true
+				if err := rec.Record(&recorder.Entry{
+					Path:           p,
+					ManifestDigest: manifestDigest.String(),
+					LayerIndex:     &i,
+				}); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	},
+}
+
+// readPlatformImage reads the image of the specified platform. If the reference
+// points to a single image, it is returned regardless of the platform.
+func readPlatformImage(iio imageio.ImageIO, platform spec.Platform) (regpkg.Image, error) {
+	index, err := iio.ReadIndex()
+	if err != nil {
+		// No index found. Try to deal it as a thin image.
+		return iio.ReadImage()
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	matcher := platforms.NewMatcher(platform)
+	for _, m := range manifest.Manifests {
+		if m.Platform != nil && !matcher.Match(spec.Platform{
+			Architecture: m.Platform.Architecture,
+			OS:           m.Platform.OS,
+			Variant:      m.Platform.Variant,
+		}) {
+			continue
+		}
+		return index.Image(m.Digest)
+	}
+	return nil, fmt.Errorf("no image found for platform %q", platforms.Format(platform))
+}
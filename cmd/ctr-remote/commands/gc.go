@@ -0,0 +1,117 @@
+//go:build linux
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	gocontext "context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	stargzfs "github.com/containerd/stargz-snapshotter/fs"
+	"github.com/containerd/stargz-snapshotter/snapshot"
+	"github.com/urfave/cli"
+)
+
+// gcReport is the response of "/gc" endpoint of the HTTP API.
+type gcReport struct {
+	stargzfs.GCResult
+	Snapshots []snapshot.CleanupDir `json:"snapshots"`
+}
+
+// GCCommand triggers garbage collection of stargz snapshotter.
+var GCCommand = cli.Command{
+	Name:  "gc",
+	Usage: "remove caches of layers no longer used and directories of removed snapshots",
+	Description: `Remove data of stargz snapshotter which is no longer used:
+
+- cached chunks and metadata of layers not referenced by any image in containerd
+  and not mounted (chunks shared with layers in use are kept),
+- per-layer files (access hints and prefetch models) of these layers and
+- directories of removed or abandoned snapshots, including metadata images
+  attached to loop devices.
+
+With --dry-run, nothing is removed and the data to be removed is listed with
+the space to be reclaimed. The snapshotter reads images from containerd at the
+address configured in [containerd_gc] of its configuration.
+`,
+	Flags: []cli.Flag{
+		apiAddressFlag,
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "list what would be removed without removing anything",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "print the result as JSON",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		c := newAPIClient(context.String(apiAddressFlag.Name))
+		dryRun := context.Bool("dry-run")
+		res, err := c.do(gocontext.Background(), http.MethodPost, "/gc", url.Values{"dry_run": {strconv.FormatBool(dryRun)}})
+		if err != nil {
+			return fmt.Errorf("failed to collect garbage: %v", err)
+		}
+		defer res.Body.Close()
+		var r gcReport
+		if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+			return fmt.Errorf("failed to decode result: %v", err)
+		}
+		if context.Bool("json") {
+			enc := json.NewEncoder(context.App.Writer)
+			enc.SetIndent("", "  ")
+			return enc.Encode(r)
+		}
+		return printGCReport(context.App.Writer, r)
+	},
+}
+
+func printGCReport(w io.Writer, r gcReport) error {
+	tw := tabwriter.NewWriter(w, 1, 8, 1, ' ', 0)
+	fmt.Fprintln(tw, "KIND\tTARGET\tSIZE\tDETAILS")
+	for _, l := range r.Layers {
+		fmt.Fprintf(tw, "layer\t%s\t%d\tchunks=%d metadata=%d\n", l.Digest, l.CacheSize, l.Chunks, l.MetadataSize)
+	}
+	for _, f := range r.Files {
+		fmt.Fprintf(tw, "file\t%s\t%d\t\n", f.Path, f.Size)
+	}
+	for _, d := range r.Snapshots {
+		var details string
+		if len(d.Images) > 0 {
+			details = "loopback images=" + strings.Join(d.Images, ",")
+		}
+		fmt.Fprintf(tw, "snapshot\t%s\t%d\t%s\n", d.Path, d.Size, details)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	verb := "reclaimed"
+	if r.DryRun {
+		verb = "would reclaim"
+	}
+	_, err := fmt.Fprintf(w, "%s %d bytes\n", verb, r.ReclaimedSize)
+	return err
+}
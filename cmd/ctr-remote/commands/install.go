@@ -0,0 +1,264 @@
+//go:build linux
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+const defaultSnapshotterConfig = "/etc/containerd-stargz-grpc/config.toml"
+
+// InstallCommand installs stargz snapshotter to the node.
+var InstallCommand = cli.Command{
+	Name:  "install",
+	Usage: "install stargz snapshotter to the node",
+	Description: `Install stargz snapshotter to the node.
+
+This writes the configuration file of stargz snapshotter (if not exist),
+registers stargz snapshotter to containerd's config as a proxy plugin and
+generates the systemd unit of stargz snapshotter. Then this checks the
+connectivity to the registries specified by --check-registry.
+
+All paths are relative to --root so this can be run in a container which mounts
+the host's root filesystem (e.g. an init container of a DaemonSet). With
+--dry-run, nothing is written and the changes are printed instead.
+
+This doesn't restart any service. After installation, reload systemd and
+(re)start stargz snapshotter and containerd.
+`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "root",
+			Usage: "root directory of the node filesystem",
+			Value: "/",
+		},
+		cli.StringFlag{
+			Name:  "snapshotter-config",
+			Usage: "path to the config file of stargz snapshotter",
+			Value: defaultSnapshotterConfig,
+		},
+		cli.StringFlag{
+			Name:  "containerd-config",
+			Usage: "path to the config file of containerd",
+			Value: "/etc/containerd/config.toml",
+		},
+		cli.StringFlag{
+			Name:  "systemd-unit",
+			Usage: "path to the systemd unit of stargz snapshotter (empty to skip)",
+			Value: "/etc/systemd/system/stargz-snapshotter.service",
+		},
+		cli.StringFlag{
+			Name:  "binary",
+			Usage: "path to containerd-stargz-grpc binary",
+			Value: "/usr/local/bin/containerd-stargz-grpc",
+		},
+		cli.StringFlag{
+			Name:  "address",
+			Usage: "address of the gRPC socket of stargz snapshotter",
+			Value: defaultSnapshotterAddress,
+		},
+		cli.StringSliceFlag{
+			Name:  "check-registry",
+			Usage: "registry host whose connectivity is checked (can be specified multiple times)",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "print the changes without writing anything",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		var (
+			root    = context.String("root")
+			dryRun  = context.Bool("dry-run")
+			address = context.String("address")
+			cfgPath = context.String("snapshotter-config")
+		)
+
+		// Config of stargz snapshotter. Existing one is kept as is.
+		if _, err := os.Stat(filepath.Join(root, cfgPath)); os.IsNotExist(err) {
+			if err := installFile(root, cfgPath, []byte(defaultConfigTOML), dryRun); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		} else {
+			fmt.Printf("unchanged %s\n", cfgPath)
+		}
+
+		// Config of containerd
+		ctrdPath := context.String("containerd-config")
+		data, err := ioutil.ReadFile(filepath.Join(root, ctrdPath))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		patched, changed, err := patchContainerdConfig(data, address)
+		if err != nil {
+			return errors.Wrapf(err, "failed to patch %q", ctrdPath)
+		}
+		if changed {
+			if err := installFile(root, ctrdPath, patched, dryRun); err != nil {
+				return err
+			}
+		} else {
+			fmt.Printf("unchanged %s\n", ctrdPath)
+		}
+
+		// Systemd unit
+		if unit := context.String("systemd-unit"); unit != "" {
+			data := []byte(systemdUnit(context.String("binary"), cfgPath))
+			if old, err := ioutil.ReadFile(filepath.Join(root, unit)); err == nil && bytes.Equal(old, data) {
+				fmt.Printf("unchanged %s\n", unit)
+			} else if err := installFile(root, unit, data, dryRun); err != nil {
+				return err
+			}
+		}
+
+		// Connectivity to registries
+		for _, host := range context.StringSlice("check-registry") {
+			if err := checkRegistry(host); err != nil {
+				return errors.Wrapf(err, "failed to connect to registry %q", host)
+			}
+			fmt.Printf("reachable %s\n", host)
+		}
+		return nil
+	},
+}
+
+const defaultConfigTOML = `# Configuration of stargz snapshotter (containerd-stargz-grpc).
+# See also: https://github.com/containerd/stargz-snapshotter/blob/master/docs/overview.md
+`
+
+// installFile writes data to path under root. With dryRun, this only prints data.
+func installFile(root, path string, data []byte, dryRun bool) error {
+	if dryRun {
+		fmt.Printf("would write %s:\n%s\n", path, data)
+		return nil
+	}
+	p := filepath.Join(root, path)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(p), "."+filepath.Base(p))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(p); err == nil {
+		mode = fi.Mode()
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s\n", path)
+	return nil
+}
+
+// patchContainerdConfig registers stargz snapshotter as a proxy plugin to the
+// containerd config. This returns the patched config and whether it's changed.
+// The existing contents are kept as is and the plugin is appended to the tail.
+func patchContainerdConfig(data []byte, address string) ([]byte, bool, error) {
+	var cfg struct {
+		ProxyPlugins map[string]struct {
+			Type    string `toml:"type"`
+			Address string `toml:"address"`
+		} `toml:"proxy_plugins"`
+	}
+	if _, err := toml.Decode(string(data), &cfg); err != nil {
+		return nil, false, errors.Wrap(err, "failed to parse containerd config")
+	}
+	if p, ok := cfg.ProxyPlugins[remoteSnapshotterName]; ok {
+		if p.Type != "snapshot" || p.Address != address {
+			return nil, false, fmt.Errorf("proxy plugin %q is already configured with type %q and address %q",
+				remoteSnapshotterName, p.Type, p.Address)
+		}
+		return data, false, nil
+	}
+	var buf bytes.Buffer
+	buf.Write(data)
+	if len(data) == 0 {
+		buf.WriteString("version = 2\n")
+	} else if !bytes.HasSuffix(data, []byte("\n")) {
+		buf.WriteString("\n")
+	}
+	fmt.Fprintf(&buf, `
+# Use stargz snapshotter
+[proxy_plugins.%s]
+  type = "snapshot"
+  address = %q
+`, remoteSnapshotterName, address)
+	return buf.Bytes(), true, nil
+}
+
+func systemdUnit(binary, config string) string {
+	return fmt.Sprintf(`[Unit]
+Description=stargz snapshotter
+After=network.target
+Before=containerd.service
+
+[Service]
+Environment=HOME=/root
+ExecStart=%s --config=%s
+Restart=always
+RestartSec=1
+
+[Install]
+WantedBy=multi-user.target
+`, binary, config)
+}
+
+// checkRegistry checks that the registry API endpoint of the host responds.
+// Any HTTP status (e.g. 401 for registries requiring authentication) is OK.
+func checkRegistry(host string) error {
+	if !strings.Contains(host, "://") {
+		host = "https://" + host
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(strings.TrimSuffix(host, "/") + "/v2/")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+//go:build linux
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPatchContainerdConfig(t *testing.T) {
+	const addr = "/run/test.sock"
+	tests := []struct {
+		name        string
+		in          string
+		wantChanged bool
+		wantErr     bool
+	}{
+		{name: "empty", in: "", wantChanged: true},
+		{
+			name: "other plugins",
+			in: `version = 2
+[plugins."io.containerd.grpc.v1.cri".containerd]
+  snapshotter = "stargz"
+[proxy_plugins]
+  [proxy_plugins.other]
+    type = "snapshot"
+    address = "/run/other.sock"`,
+			wantChanged: true,
+		},
+		{
+			name: "installed",
+			in: `[proxy_plugins.stargz]
+  type = "snapshot"
+  address = "/run/test.sock"
+`,
+		},
+		{
+			name: "conflict",
+			in: `[proxy_plugins.stargz]
+  type = "snapshot"
+  address = "/run/other.sock"
+`,
+			wantErr: true,
+		},
+		{name: "invalid", in: "[proxy_plugins", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, changed, err := patchContainerdConfig([]byte(tt.in), addr)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("patch must fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to patch: %v", err)
+			}
+			if changed != tt.wantChanged {
+				t.Errorf("changed = %v; want %v", changed, tt.wantChanged)
+			}
+			if !strings.HasPrefix(string(out), tt.in) {
+				t.Errorf("existing config must be kept:\n%s", out)
+			}
+			// The result must be recognized as installed.
+			if _, changed, err := patchContainerdConfig(out, addr); err != nil || changed {
+				t.Errorf("patched config isn't recognized (changed=%v, err=%v):\n%s", changed, err, out)
+			}
+		})
+	}
+}
@@ -1,3 +1,6 @@
+//go:build linux
+// +build linux
+
 /*
    Copyright The containerd Authors.
 
@@ -23,12 +26,13 @@
 package commands
 
 import (
+	"bytes"
 	gocontext "context"
 	"encoding/csv"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
-	"path/filepath"
 	"strings"
 	"time"
 
@@ -38,10 +42,11 @@ import (
 	"github.com/containerd/stargz-snapshotter/converter/optimizer"
 	"github.com/containerd/stargz-snapshotter/converter/optimizer/imageio"
 	"github.com/containerd/stargz-snapshotter/converter/optimizer/recorder"
+	"github.com/containerd/stargz-snapshotter/converter/optimizer/report"
 	"github.com/containerd/stargz-snapshotter/converter/optimizer/sampler"
 	"github.com/containerd/stargz-snapshotter/util/tempfiles"
 	reglogs "github.com/google/go-containerregistry/pkg/logs"
-	"github.com/google/go-containerregistry/pkg/name"
+	regpkg "github.com/google/go-containerregistry/pkg/v1"
 	spec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -67,6 +72,10 @@ var OptimizeCommand = cli.Command{
 			Name:  "terminal,t",
 			Usage: "enable terminal for sample container",
 		},
+		cli.StringFlag{
+			Name:  "interaction",
+			Usage: "path to the script of stdin inputs and signals replayed against the sample container (see docs/ctr-remote.md)",
+		},
 		cli.BoolFlag{
 			Name:  "wait-on-signal",
 			Usage: "ignore context cancel and keep the container running until it receives signal (Ctrl + C) sent manually",
@@ -129,6 +138,30 @@ var OptimizeCommand = cli.Command{
 			Name:  "cni-plugin-dir",
 			Usage: "path to the CNI plugins binary directory",
 		},
+		cli.StringFlag{
+			Name:  "seccomp-profile",
+			Usage: "path to the seccomp profile (in JSON) of the sample container; \"unconfined\" disables seccomp (default: containerd's default profile)",
+		},
+		cli.BoolFlag{
+			Name:  "allow-new-privileges",
+			Usage: "allow processes in the sample container to gain privileges (e.g. with setuid binaries)",
+		},
+		cli.BoolFlag{
+			Name:  "rootless",
+			Usage: "run without root privileges in a user namespace, using rootless runc for the sample container",
+		},
+		cli.StringSliceFlag{
+			Name:  "device",
+			Usage: "add a host device to the sample container (\"<host-path>[:<container-path>][:<permissions>]\"); can be specified multiple times",
+		},
+		cli.StringFlag{
+			Name:  "gpus",
+			Usage: "NVIDIA GPUs visible in the sample container (\"all\" or comma-separated indexes or UUIDs); requires NVIDIA Container Toolkit",
+		},
+		cli.StringFlag{
+			Name:  "nvidia-hook",
+			Usage: "path to the prestart hook of NVIDIA Container Toolkit used by --gpus (default: looked up from $PATH)",
+		},
 		cli.StringFlag{
 			Name:  "platform",
 			Usage: "platform specifier of the source image",
@@ -141,16 +174,60 @@ var OptimizeCommand = cli.Command{
 			Name:  "no-optimize",
 			Usage: "convert image without optimization",
 		},
+		cli.BoolFlag{
+			Name:  "stream",
+			Usage: "push each layer to the destination registry as soon as it's converted, without keeping all layers on disk (requires --no-optimize)",
+		},
+		cli.IntFlag{
+			Name:  "stream-max-concurrency",
+			Usage: "maximum number of layers converted at the same time with --stream",
+			Value: 1,
+		},
+		cli.StringFlag{
+			Name:  "stream-state",
+			Usage: "record layers pushed with --stream to the specified file and reuse them when the conversion is resumed",
+		},
 		cli.StringFlag{
 			Name:  "record-out",
 			Usage: "record the monitor log to the specified file",
 		},
+		cli.StringFlag{
+			Name:  "report-out",
+			Usage: "write the recommendation of the order of Dockerfile steps based on the monitor log to the specified file",
+		},
+		cli.StringFlag{
+			Name:  "report-format",
+			Usage: "format of the report (\"markdown\" or \"json\")",
+			Value: "markdown",
+		},
+		cli.StringSliceFlag{
+			Name:  "prefetch-include",
+			Usage: "prefetch only the accessed files matching the glob pattern (e.g. \"usr/lib/*\"); can be specified multiple times",
+		},
+		cli.StringSliceFlag{
+			Name:  "prefetch-exclude",
+			Usage: "never prefetch the files matching the glob pattern even if accessed by the workload (e.g. \"var/log\"); can be specified multiple times",
+		},
+		cli.StringSliceFlag{
+			Name:  "phase-marker",
+			Usage: "HTTP(S) URL polled from the network of the sample container (e.g. \"http://localhost:8080/ready\") which starts the next phase of the workload when it responds with 2xx; can be specified multiple times in the order of phases",
+		},
+		cli.StringSliceFlag{
+			Name:  "sidecar",
+			Usage: "optimize another image together by running it as a sidecar sharing the network namespace of the sample container (\"<input-ref>=<output-ref>\"); can be specified multiple times",
+		},
+		policyFlag,
 		// TODO: add "record-in" to use existing record
 	},
 	Action: func(context *cli.Context) error {
 
 		ctx := gocontext.Background()
 
+		// Mounting the layers needs root. Become root in a user namespace.
+		if context.Bool("rootless") && os.Geteuid() != 0 {
+			return reexecInUserNS()
+		}
+
 		// Set up logs package of ggcr to get useful messages
 		reglogs.Warn.SetOutput(log.G(ctx).WriterLevel(logrus.WarnLevel))
 		reglogs.Progress.SetOutput(log.G(ctx).WriterLevel(logrus.InfoLevel))
@@ -193,6 +270,13 @@ var OptimizeCommand = cli.Command{
 			platform = &p
 		}
 
+		defer func() {
+			for _, s := range imageio.RateLimits.Stats() {
+				log.G(ctx).WithField("host", s.Host).Infof("rate limit: remaining %d/%d, %d requests rejected with 429, waited %.0fs",
+					s.Remaining, s.Limit, s.TooManyRequests, s.DeferredSec)
+			}
+		}()
+
 		tf := tempfiles.NewTempFiles()
 		defer func() {
 			if err := tf.CleanupAll(); err != nil {
@@ -201,19 +285,92 @@ var OptimizeCommand = cli.Command{
 		}()
 
 		noOptimize := context.Bool("no-optimize")
+		policy, err := loadConvertPolicy(context)
+		if err != nil {
+			return err
+		}
+		annotations, err := policy.annotations(src, dst)
+		if err != nil {
+			return err
+		}
 		optimizerOpts := &optimizer.Opts{
-			Reuse:  context.Bool("reuse"),
-			Period: time.Duration(context.Int("period")) * time.Second,
+			Reuse:           context.Bool("reuse"),
+			Period:          time.Duration(context.Int("period")) * time.Second,
+			Rootless:        context.Bool("rootless"),
+			EStargzOptions:  policy.esgzOptions(context, "", ""),
+			Annotations:     annotations,
+			PrefetchInclude: context.StringSlice("prefetch-include"),
+			PrefetchExclude: context.StringSlice("prefetch-exclude"),
+			PhaseMarkers:    context.StringSlice("phase-marker"),
 		}
 
-		var rec *recorder.Recorder
+		var stream *converter.StreamOpts
+		if context.Bool("stream") {
+			if !noOptimize {
+				return fmt.Errorf("\"--stream\" must be used with \"--no-optimize\"")
+			}
+			ri, ok := dstIO.(*imageio.RemoteImage)
+			if !ok {
+				return fmt.Errorf("\"--stream\" needs a registry as the destination")
+			}
+			stream = &converter.StreamOpts{
+				PushLayer:           ri.WriteLayer,
+				MaxConcurrentLayers: context.Int("stream-max-concurrency"),
+				LayerExists:         ri.LayerExists,
+			}
+			if statePath := context.String("stream-state"); statePath != "" {
+				if stream.State, err = converter.LoadStreamState(statePath); err != nil {
+					return errors.Wrapf(err, "failed to load state %q", statePath)
+				}
+			}
+		} else if context.String("stream-state") != "" {
+			return fmt.Errorf("\"--stream-state\" must be used with \"--stream\"")
+		}
+
+		var recordWriters []io.Writer
 		if recordOut := context.String("record-out"); recordOut != "" {
 			recordWriter, err := os.Create(recordOut)
 			if err != nil {
 				return err
 			}
 			defer recordWriter.Close()
-			rec = recorder.New(recordWriter)
+			recordWriters = append(recordWriters, recordWriter)
+		}
+		reportOut, reportFormat := context.String("report-out"), context.String("report-format")
+		var recordBuf bytes.Buffer
+		if reportOut != "" {
+			if reportFormat != "markdown" && reportFormat != "json" {
+				return fmt.Errorf("unknown report format %q", reportFormat)
+			}
+			recordWriters = append(recordWriters, &recordBuf)
+		}
+		var rec *recorder.Recorder
+		if len(recordWriters) > 0 {
+			rec = recorder.New(io.MultiWriter(recordWriters...))
+		}
+
+		if sidecars := context.StringSlice("sidecar"); len(sidecars) > 0 {
+			if noOptimize || stream != nil {
+				return fmt.Errorf("\"--sidecar\" can't be used with \"--no-optimize\" or \"--stream\"")
+			}
+			if platform == nil || !platforms.NewMatcher(platforms.DefaultSpec()).Match(*platform) {
+				return fmt.Errorf("\"--sidecar\" needs images of the platform where this command runs on")
+			}
+			g := &sidecarGroup{
+				main:     &sidecarRef{src: src, dst: dst, srcIO: srcIO, dstIO: dstIO},
+				opts:     opts,
+				platform: *platform,
+			}
+			if err := g.parse(context, sidecars); err != nil {
+				return err
+			}
+			if err := g.run(ctx, optimizerOpts, policy, tf, rec); err != nil {
+				return err
+			}
+			if reportOut != "" {
+				return writeReport(reportOut, reportFormat, &recordBuf, g.image)
+			}
+			return nil
 		}
 
 		// Convert and push the image
@@ -226,27 +383,75 @@ var OptimizeCommand = cli.Command{
 				return err
 			}
 			p := platforms.DefaultSpec()
-			dstImage, err := converter.ConvertImage(ctx, noOptimize, optimizerOpts, srcImage, &p, tf, rec, opts...)
+			dstImage, err := converter.ConvertImage(ctx, noOptimize, optimizerOpts, stream, srcImage, &p, tf, rec, opts...)
 			if err != nil {
 				return err
 			}
+			if reportOut != "" {
+				if err := writeReport(reportOut, reportFormat, &recordBuf, func(regpkg.Hash) (regpkg.Image, error) {
+					return srcImage, nil
+				}); err != nil {
+					return err
+				}
+			}
 			return dstIO.WriteImage(dstImage)
 		}
-		dstIndex, err := converter.ConvertIndex(ctx, noOptimize, optimizerOpts, srcIndex, platform, tf, rec, opts...)
+		dstIndex, err := converter.ConvertIndex(ctx, noOptimize, optimizerOpts, stream, srcIndex, platform, tf, rec, opts...)
 		if err != nil {
 			return err
 		}
+		if reportOut != "" {
+			if err := writeReport(reportOut, reportFormat, &recordBuf, srcIndex.Image); err != nil {
+				return err
+			}
+		}
 		return dstIO.WriteIndex(dstIndex)
 	},
 }
 
+// writeReport writes the recommendation of the order of Dockerfile steps of
+// each optimized image, based on the recorded monitor log.
+func writeReport(path, format string, record io.Reader, getImage func(regpkg.Hash) (regpkg.Image, error)) error {
+	entries, err := recorder.ReadAll(record)
+	if err != nil {
+		return errors.Wrap(err, "failed to read record")
+	}
+	var reports []*report.Report
+	done := make(map[string]bool)
+	for _, e := range entries {
+		if done[e.ManifestDigest] {
+			continue
+		}
+		done[e.ManifestDigest] = true
+		h, err := regpkg.NewHash(e.ManifestDigest)
+		if err != nil {
+			return errors.Wrapf(err, "invalid manifest digest %q", e.ManifestDigest)
+		}
+		img, err := getImage(h)
+		if err != nil {
+			return errors.Wrapf(err, "failed to get image %q", e.ManifestDigest)
+		}
+		r, err := report.New(img, entries)
+		if err != nil {
+			return errors.Wrapf(err, "failed to generate report of %q", e.ManifestDigest)
+		}
+		reports = append(reports, r)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if format == "json" {
+		return report.WriteJSON(f, reports)
+	}
+	return report.WriteMarkdown(f, reports)
+}
+
 func parseArgs(clicontext *cli.Context) (opts []sampler.Option, err error) {
 	if env := clicontext.StringSlice("env"); len(env) > 0 {
 		opts = append(opts, sampler.WithEnvs(env))
 	}
-	if mounts := clicontext.StringSlice("mount"); len(mounts) > 0 {
-		opts = append(opts, sampler.WithMounts(mounts))
-	}
 	if args := clicontext.String("args"); args != "" {
 		var as []string
 		err = json.Unmarshal([]byte(args), &as)
@@ -275,6 +480,40 @@ func parseArgs(clicontext *cli.Context) (opts []sampler.Option, err error) {
 	if clicontext.Bool("wait-on-signal") {
 		opts = append(opts, sampler.WithWaitOnSignal())
 	}
+	if script := clicontext.String("interaction"); script != "" {
+		f, err := os.Open(script)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		interaction, err := sampler.ParseInteraction(f)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse interaction script %q", script)
+		}
+		opts = append(opts, sampler.WithInteraction(interaction))
+	}
+	if devices := clicontext.StringSlice("device"); len(devices) > 0 {
+		opts = append(opts, sampler.WithDevices(devices))
+	}
+	if gpus := clicontext.String("gpus"); gpus != "" {
+		opts = append(opts, sampler.WithGPUs(gpus))
+	}
+	if hook := clicontext.String("nvidia-hook"); hook != "" {
+		opts = append(opts, sampler.WithNvidiaHook(hook))
+	}
+	sharedOpts, err := parseSharedArgs(clicontext)
+	if err != nil {
+		return nil, err
+	}
+	return append(opts, sharedOpts...), nil
+}
+
+// parseSharedArgs parses the options applied to sidecars as well as the main
+// container.
+func parseSharedArgs(clicontext *cli.Context) (opts []sampler.Option, err error) {
+	if mounts := clicontext.StringSlice("mount"); len(mounts) > 0 {
+		opts = append(opts, sampler.WithMounts(mounts))
+	}
 	if nameservers := clicontext.String("dns-nameservers"); nameservers != "" {
 		fields, err := csv.NewReader(strings.NewReader(nameservers)).Read()
 		if err != nil {
@@ -312,30 +551,15 @@ func parseArgs(clicontext *cli.Context) (opts []sampler.Option, err error) {
 	if cniPluginDir := clicontext.String("cni-plugin-dir"); cniPluginDir != "" {
 		opts = append(opts, sampler.WithCNIPluginDir(cniPluginDir))
 	}
-
-	return
-}
-
-func parseReference(ref string, clicontext *cli.Context) (imageio.ImageIO, error) {
-	if strings.HasPrefix(ref, "local://") {
-		abspath, err := filepath.Abs(strings.TrimPrefix(ref, "local://"))
-		if err != nil {
-			return nil, err
-		}
-		return &imageio.LocalImage{LocalPath: abspath}, nil
+	if profile := clicontext.String("seccomp-profile"); profile != "" {
+		opts = append(opts, sampler.WithSeccompProfile(profile))
 	}
-	var opts []name.Option
-	if strings.HasPrefix(ref, "http://") {
-		ref = strings.TrimPrefix(ref, "http://")
-		if clicontext.Bool("plain-http") {
-			opts = append(opts, name.Insecure)
-		} else {
-			return nil, fmt.Errorf("\"--plain-http\" option must be specified to connect to %q using HTTP", ref)
-		}
+	if clicontext.Bool("allow-new-privileges") {
+		opts = append(opts, sampler.WithAllowNewPrivileges())
 	}
-	remoteRef, err := name.ParseReference(ref, opts...)
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to parse reference %q", ref)
+	if clicontext.Bool("rootless") {
+		opts = append(opts, sampler.WithRootless())
 	}
-	return &imageio.RemoteImage{RemoteRef: remoteRef}, nil
+
+	return
 }
@@ -0,0 +1,157 @@
+//go:build linux
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	gocontext "context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"text/tabwriter"
+	"time"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	stargzfs "github.com/containerd/stargz-snapshotter/fs"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var cachePinCommand = cli.Command{
+	Name:      "pin",
+	Usage:     "protect cached contents of images from eviction",
+	ArgsUsage: "[flags] <image>...",
+	Description: `Pin the layers of images in the cache of stargz snapshotter. Cached chunks of
+pinned layers are never evicted (e.g. by the disk usage watermark) regardless of
+the pressure. Pins persist across restarts of stargz snapshotter until they
+are removed by "ctr-remote cache unpin".
+
+Layers which aren't lazily pulled yet are pinned when they are mounted.
+`,
+	Flags: []cli.Flag{
+		apiAddressFlag,
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "platform of the image to pin. Defaults to the platform of this host.",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		return pinImages(context, "/pin")
+	},
+}
+
+var cacheUnpinCommand = cli.Command{
+	Name:      "unpin",
+	Usage:     "allow cached contents of images pinned by \"cache pin\" to be evicted",
+	ArgsUsage: "[flags] <image>...",
+	Flags: []cli.Flag{
+		apiAddressFlag,
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "platform of the image to unpin. Defaults to the platform of this host.",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		return pinImages(context, "/unpin")
+	},
+}
+
+var cachePinsCommand = cli.Command{
+	Name:  "pins",
+	Usage: "list layers pinned in the cache",
+	Flags: []cli.Flag{
+		apiAddressFlag,
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "print the result as JSON",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		res, err := newAPIClient(context.String(apiAddressFlag.Name)).do(gocontext.Background(), http.MethodGet, "/pins", nil)
+		if err != nil {
+			return fmt.Errorf("failed to get pins: %v", err)
+		}
+		defer res.Body.Close()
+		var pins []stargzfs.LayerPin
+		if err := json.NewDecoder(res.Body).Decode(&pins); err != nil {
+			return fmt.Errorf("failed to decode result: %v", err)
+		}
+		if context.Bool("json") {
+			enc := json.NewEncoder(context.App.Writer)
+			enc.SetIndent("", "  ")
+			return enc.Encode(pins)
+		}
+		return printPins(context.App.Writer, pins)
+	},
+}
+
+// pinImages requests the API endpoint for the layers of each image.
+func pinImages(context *cli.Context, path string) error {
+	if context.NArg() == 0 {
+		return fmt.Errorf("please provide images")
+	}
+	platformMC := platforms.Default()
+	if pStr := context.String("platform"); pStr != "" {
+		p, err := platforms.Parse(pStr)
+		if err != nil {
+			return errors.Wrapf(err, "invalid platform %q", pStr)
+		}
+		platformMC = platforms.Only(p)
+	}
+	client, ctx, cancel, err := commands.NewClient(context)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	api := newAPIClient(context.String(apiAddressFlag.Name))
+	for _, ref := range context.Args() {
+		img, err := client.ImageService().Get(ctx, ref)
+		if err != nil {
+			return err
+		}
+		manifest, err := images.Manifest(ctx, client.ContentStore(), img.Target, platformMC)
+		if err != nil {
+			return err
+		}
+		q := url.Values{"ref": {ref}}
+		for _, l := range manifest.Layers {
+			q.Add("digest", l.Digest.String())
+		}
+		res, err := api.do(gocontext.Background(), http.MethodPost, path, q)
+		if err != nil {
+			return fmt.Errorf("failed to request %s for %q: %v", path, ref, err)
+		}
+		res.Body.Close()
+		fmt.Fprintln(context.App.Writer, ref)
+	}
+	return nil
+}
+
+func printPins(w io.Writer, pins []stargzfs.LayerPin) error {
+	tw := tabwriter.NewWriter(w, 1, 8, 1, ' ', 0)
+	fmt.Fprintln(tw, "LAYER\tREF\tCHUNKS\tPINNED")
+	for _, p := range pins {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", shortDigest(p.Digest), p.Ref, p.Chunks, p.PinnedAt.Format(time.RFC3339))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,181 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// policyFlag is the flag of the conversion policy file of "optimize" and
+// "convert".
+var policyFlag = cli.StringFlag{
+	Name:  "policy",
+	Usage: "conversion policy file defining the defaults of the output (default: $XDG_CONFIG_HOME/ctr-remote/convert.toml or ~/.config/ctr-remote/convert.toml)",
+}
+
+// convertPolicy is the conversion policy shared by "optimize" and "convert" so
+// the output images can be standardized across repositories. Flags specified
+// in the command line take precedence over the policy.
+type convertPolicy struct {
+	// ChunkSize is the chunk size of eStargz layers.
+	ChunkSize int `toml:"chunk_size"`
+
+	// CompressionLevel is the gzip compression level of eStargz layers.
+	CompressionLevel *int `toml:"compression_level"`
+
+	// ExcludedPaths is the patterns of files excluded from eStargz layers
+	// (see estargz.WithExcludedPaths).
+	ExcludedPaths []string `toml:"excluded_paths"`
+
+	// Annotations are added to the converted manifests. Values are templates
+	// of text/template executed with annotationVars.
+	Annotations map[string]string `toml:"annotations"`
+}
+
+// annotationVars is the variables available in annotation templates.
+type annotationVars struct {
+	Source  string // source image reference
+	Target  string // target image reference
+	Created string // RFC 3339 time of the conversion (or SOURCE_DATE_EPOCH)
+}
+
+// defaultPolicyPath returns the path of the conversion policy file used when
+// "--policy" isn't specified.
+func defaultPolicyPath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "ctr-remote", "convert.toml")
+}
+
+// loadConvertPolicy loads the conversion policy file specified by "--policy".
+// If the flag isn't specified, the default file is loaded if it exists.
+func loadConvertPolicy(context *cli.Context) (*convertPolicy, error) {
+	p := context.String("policy")
+	if p == "" {
+		p = defaultPolicyPath()
+		if _, err := os.Stat(p); p == "" || os.IsNotExist(err) {
+			return &convertPolicy{}, nil
+		}
+	}
+	var policy convertPolicy
+	md, err := toml.DecodeFile(p, &policy)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load policy %q", p)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		var keys []string
+		for _, k := range undecoded {
+			keys = append(keys, k.String())
+		}
+		return nil, fmt.Errorf("unknown keys in policy %q: %s", p, strings.Join(keys, ", "))
+	}
+	if err := policy.validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid policy %q", p)
+	}
+	return &policy, nil
+}
+
+func (p *convertPolicy) validate() error {
+	if p.ChunkSize < 0 {
+		return fmt.Errorf("chunk_size must be non-negative but %d", p.ChunkSize)
+	}
+	if l := p.CompressionLevel; l != nil && (*l < gzip.HuffmanOnly || *l > gzip.BestCompression) {
+		return fmt.Errorf("compression_level must be in [%d, %d] but %d", gzip.HuffmanOnly, gzip.BestCompression, *l)
+	}
+	for _, pattern := range p.ExcludedPaths {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q in excluded_paths", pattern)
+		}
+	}
+	for k, v := range p.Annotations {
+		if _, err := template.New(k).Option("missingkey=error").Parse(v); err != nil {
+			return errors.Wrapf(err, "invalid template of annotation %q", k)
+		}
+	}
+	return nil
+}
+
+// esgzOptions returns the options of eStargz layers. Values of the flags
+// (chunkSizeFlag and levelFlag) take precedence over the policy if they are
+// specified. Empty flag names mean that the command doesn't have the flags.
+func (p *convertPolicy) esgzOptions(context *cli.Context, chunkSizeFlag, levelFlag string) []estargz.Option {
+	var opts []estargz.Option
+	if chunkSizeFlag != "" && (context.IsSet(chunkSizeFlag) || p.ChunkSize == 0) {
+		opts = append(opts, estargz.WithChunkSize(context.Int(chunkSizeFlag)))
+	} else if p.ChunkSize > 0 {
+		opts = append(opts, estargz.WithChunkSize(p.ChunkSize))
+	}
+	if levelFlag != "" && (context.IsSet(levelFlag) || p.CompressionLevel == nil) {
+		opts = append(opts, estargz.WithCompressionLevel(context.Int(levelFlag)))
+	} else if p.CompressionLevel != nil {
+		opts = append(opts, estargz.WithCompressionLevel(*p.CompressionLevel))
+	}
+	if len(p.ExcludedPaths) > 0 {
+		opts = append(opts, estargz.WithExcludedPaths(p.ExcludedPaths))
+	}
+	return opts
+}
+
+// annotations executes the annotation templates for the conversion from src
+// to dst.
+func (p *convertPolicy) annotations(src, dst string) (map[string]string, error) {
+	if len(p.Annotations) == 0 {
+		return nil, nil
+	}
+	created := time.Now().UTC()
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		sec, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid SOURCE_DATE_EPOCH %q", epoch)
+		}
+		created = time.Unix(sec, 0).UTC()
+	}
+	vars := annotationVars{Source: src, Target: dst, Created: created.Format(time.RFC3339)}
+	res := make(map[string]string, len(p.Annotations))
+	for k, v := range p.Annotations {
+		tmpl, err := template.New(k).Option("missingkey=error").Parse(v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid template of annotation %q", k)
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, vars); err != nil {
+			return nil, errors.Wrapf(err, "failed to execute template of annotation %q", k)
+		}
+		res[k] = buf.String()
+	}
+	return res, nil
+}
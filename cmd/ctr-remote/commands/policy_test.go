@@ -0,0 +1,112 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/urfave/cli"
+)
+
+func TestConvertPolicy(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testpolicy")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	newContext := func(args ...string) *cli.Context {
+		set := flag.NewFlagSet("test", flag.ContinueOnError)
+		set.String("policy", "", "")
+		set.Int("estargz-chunk-size", 0, "")
+		set.Int("estargz-compression-level", 9, "")
+		if err := set.Parse(args); err != nil {
+			t.Fatalf("failed to parse flags: %v", err)
+		}
+		return cli.NewContext(nil, set, nil)
+	}
+	writePolicy := func(name, data string) string {
+		p := filepath.Join(tmp, name)
+		if err := ioutil.WriteFile(p, []byte(data), 0600); err != nil {
+			t.Fatalf("failed to write policy: %v", err)
+		}
+		return p
+	}
+
+	// The default file is optional.
+	os.Setenv("XDG_CONFIG_HOME", filepath.Join(tmp, "config"))
+	defer os.Unsetenv("XDG_CONFIG_HOME")
+	if p, err := loadConvertPolicy(newContext()); err != nil || !reflect.DeepEqual(p, &convertPolicy{}) {
+		t.Errorf("empty policy must be used without the default file: %+v (err=%v)", p, err)
+	}
+	if _, err := loadConvertPolicy(newContext("--policy", filepath.Join(tmp, "none.toml"))); err == nil {
+		t.Errorf("missing policy specified by the flag must be rejected")
+	}
+	os.MkdirAll(filepath.Join(tmp, "config", "ctr-remote"), 0700)
+	writePolicy("config/ctr-remote/convert.toml", `
+chunk_size = 1048576
+compression_level = 6
+excluded_paths = ["var/cache/*"]
+[annotations]
+"org.opencontainers.image.source" = "{{.Source}}"
+"org.example.converted" = "{{.Source}} -> {{.Target}} at {{.Created}}"
+`)
+	policy, err := loadConvertPolicy(newContext())
+	if err != nil {
+		t.Fatalf("failed to load the default policy: %v", err)
+	}
+	if policy.ChunkSize != 1048576 || policy.CompressionLevel == nil || *policy.CompressionLevel != 6 ||
+		!reflect.DeepEqual(policy.ExcludedPaths, []string{"var/cache/*"}) {
+		t.Errorf("unexpected policy: %+v", policy)
+	}
+	if n := len(policy.esgzOptions(newContext(), "estargz-chunk-size", "estargz-compression-level")); n != 3 {
+		t.Errorf("chunk size, compression level and excluded paths must be applied; got %d options", n)
+	}
+	if n := len(policy.esgzOptions(newContext(), "", "")); n != 3 {
+		t.Errorf("policy must be applied without flags; got %d options", n)
+	}
+
+	os.Setenv("SOURCE_DATE_EPOCH", "1600000000")
+	defer os.Unsetenv("SOURCE_DATE_EPOCH")
+	annotations, err := policy.annotations("example.com/foo:orig", "example.com/foo:esgz")
+	if err != nil {
+		t.Fatalf("failed to execute annotations: %v", err)
+	}
+	want := map[string]string{
+		"org.opencontainers.image.source": "example.com/foo:orig",
+		"org.example.converted":           "example.com/foo:orig -> example.com/foo:esgz at 2020-09-13T12:26:40Z",
+	}
+	if !reflect.DeepEqual(annotations, want) {
+		t.Errorf("annotations = %+v; want %+v", annotations, want)
+	}
+
+	for name, data := range map[string]string{
+		"unknown.toml":  `chunksize = 1`,
+		"chunk.toml":    `chunk_size = -1`,
+		"level.toml":    `compression_level = 10`,
+		"pattern.toml":  `excluded_paths = ["["]`,
+		"template.toml": "[annotations]\n\"a\" = \"{{.Source\"",
+	} {
+		if _, err := loadConvertPolicy(newContext("--policy", writePolicy(name, data))); err == nil {
+			t.Errorf("invalid policy %q must be rejected", name)
+		}
+	}
+}
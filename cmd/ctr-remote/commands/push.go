@@ -0,0 +1,215 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/containerd/console"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/containerd/remotes/docker/config"
+	"github.com/containerd/stargz-snapshotter/push"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// PushCommand replaces ctr's push command with the pusher which uploads blobs
+// in parallel and in chunks.
+var PushCommand = cli.Command{
+	Name:      "push",
+	Usage:     "push an image to a remote uploading blobs in parallel",
+	ArgsUsage: "[flags] <remote> [<local>]",
+	Description: `Pushes an image reference from containerd.
+
+All resources associated with the manifest reference will be pushed. Blobs are
+uploaded in parallel and in chunks. A chunk failed with 5xx status or a network
+error is retried resuming from the data the registry has already received.
+Blobs are mounted from other repositories in the registry (those specified by
+--mount-from and those recorded in the distribution source labels) if possible.
+`,
+	Flags: append(commands.RegistryFlags,
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "push content from a specific platform",
+		},
+		cli.IntFlag{
+			Name:  "max-concurrent-uploads",
+			Usage: "maximum number of blobs uploaded in parallel",
+			Value: 4,
+		},
+		cli.Int64Flag{
+			Name:  "chunk-size",
+			Usage: "size of each chunk uploaded in a request. negative value uploads each blob in a request",
+			Value: 32 << 20,
+		},
+		cli.IntFlag{
+			Name:  "retries",
+			Usage: "number of retries of each request failed with 5xx status or a network error",
+			Value: 3,
+		},
+		cli.StringSliceFlag{
+			Name:  "mount-from",
+			Usage: "repository in the same registry from which blobs are tried to be mounted",
+		},
+	),
+	Action: func(clicontext *cli.Context) error {
+		var (
+			ref   = clicontext.Args().First()
+			local = clicontext.Args().Get(1)
+		)
+		if ref == "" {
+			return errors.New("please provide a remote image reference to push")
+		}
+		if local == "" {
+			local = ref
+		}
+
+		client, ctx, cancel, err := commands.NewClient(clicontext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		img, err := client.ImageService().Get(ctx, local)
+		if err != nil {
+			return errors.Wrap(err, "unable to resolve image to manifest")
+		}
+		desc := img.Target
+		cs := client.ContentStore()
+		if pStr := clicontext.String("platform"); pStr != "" {
+			p, err := platforms.Parse(pStr)
+			if err != nil {
+				return errors.Wrapf(err, "invalid platform %q", pStr)
+			}
+			manifests, err := images.Children(ctx, cs, desc)
+			if err != nil {
+				return err
+			}
+			matcher := platforms.NewMatcher(p)
+			for _, m := range manifests {
+				if m.Platform != nil && matcher.Match(*m.Platform) {
+					desc = m
+					break
+				}
+			}
+		}
+
+		hosts, err := registryHosts(ctx, clicontext)
+		if err != nil {
+			return err
+		}
+		retries := clicontext.Int("retries")
+		if retries == 0 {
+			retries = -1 // zero means the default in the pusher
+		}
+		p := push.NewPusher(hosts,
+			push.WithConcurrency(clicontext.Int("max-concurrent-uploads")),
+			push.WithChunkSize(clicontext.Int64("chunk-size")),
+			push.WithRetries(retries),
+			push.WithMountFrom(clicontext.StringSlice("mount-from")...),
+			push.WithProgress(func(desc ocispec.Descriptor, state string) {
+				fmt.Printf("%s %v... %v\n", state, desc.Digest.String()[:15], desc.MediaType)
+			}),
+		)
+		log.G(ctx).WithField("image", ref).WithField("digest", desc.Digest).Debug("pushing")
+		return p.Push(ctx, ref, cs, desc)
+	},
+}
+
+// registryHosts returns registry hosts configured with the registry flags in the
+// same way as ctr.
+func registryHosts(ctx context.Context, clicontext *cli.Context) (docker.RegistryHosts, error) {
+	username := clicontext.String("user")
+	var secret string
+	if i := strings.IndexByte(username, ':'); i > 0 {
+		secret = username[i+1:]
+		username = username[0:i]
+	}
+	if username != "" {
+		if secret == "" {
+			fmt.Printf("Password: ")
+			var err error
+			if secret, err = passwordPrompt(); err != nil {
+				return nil, err
+			}
+			fmt.Print("\n")
+		}
+	} else if rt := clicontext.String("refresh"); rt != "" {
+		secret = rt
+	}
+
+	hostOptions := config.HostOptions{
+		Credentials: func(host string) (string, string, error) {
+			return username, secret, nil
+		},
+	}
+	if clicontext.Bool("plain-http") {
+		hostOptions.DefaultScheme = "http"
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: clicontext.Bool("skip-verify")}
+	if path := clicontext.String("tlscacert"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %q", path)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("failed to load TLS CAs from %q: invalid data", path)
+		}
+	}
+	if cert, key := clicontext.String("tlscert"), clicontext.String("tlskey"); cert != "" || key != "" {
+		if cert == "" || key == "" {
+			return nil, errors.New("flags --tlscert and --tlskey must be set together")
+		}
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load TLS client credentials (cert=%q, key=%q)", cert, key)
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+	hostOptions.DefaultTLS = tlsConfig
+	if hostDir := clicontext.String("hosts-dir"); hostDir != "" {
+		hostOptions.HostDir = config.HostDirFromRoot(hostDir)
+	}
+	return config.ConfigureHosts(ctx, hostOptions), nil
+}
+
+func passwordPrompt() (string, error) {
+	c := console.Current()
+	defer c.Reset()
+
+	if err := c.DisableEcho(); err != nil {
+		return "", errors.Wrap(err, "failed to disable echo")
+	}
+
+	line, _, err := bufio.NewReader(c).ReadLine()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read line")
+	}
+	return string(line), nil
+}
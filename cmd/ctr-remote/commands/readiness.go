@@ -0,0 +1,157 @@
+//go:build linux
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	gocontext "context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"text/tabwriter"
+	"time"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	stargzfs "github.com/containerd/stargz-snapshotter/fs"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// ReadinessCommand checks whether the prefetch of the layers of a container
+// finished.
+var ReadinessCommand = cli.Command{
+	Name:      "readiness",
+	Usage:     "check whether the prefetch of the layers of a container finished",
+	ArgsUsage: "[flags] <container-id>",
+	Description: `Check whether the prefetch of all lazily pulled layers of the container
+finished. Exits with an error if it hasn't finished so this can be used as a
+readiness check (e.g. an exec probe or an agent updating a readiness gate of
+the pod) which prevents traffic to the container until its prioritized files
+(e.g. files marked by the prefetch landmark of eStargz) are in the cache.
+
+Layers which failed to be prefetched are treated as ready because they are
+still readable on demand. With --wait, this polls the state until the prefetch
+finishes or the duration elapses.
+
+Containers of Kubernetes pods are in the "k8s.io" namespace
+(e.g. "ctr-remote -n k8s.io readiness <container-id>").
+`,
+	Flags: []cli.Flag{
+		apiAddressFlag,
+		cli.DurationFlag{
+			Name:  "wait",
+			Usage: "wait for the prefetch completion up to this duration",
+		},
+		cli.DurationFlag{
+			Name:  "interval",
+			Usage: "interval of polling the state with --wait",
+			Value: time.Second,
+		},
+		cli.BoolFlag{
+			Name:  "quiet,q",
+			Usage: "don't print the state",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "print the state as JSON",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		id := context.Args().First()
+		if id == "" {
+			return errors.New("container id must be specified")
+		}
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+		c, err := client.ContainerService().Get(ctx, id)
+		if err != nil {
+			return errors.Wrapf(err, "failed to get container %q", id)
+		}
+		if c.Snapshotter != remoteSnapshotterName {
+			return fmt.Errorf("container %q doesn't use %q snapshotter but %q", id, remoteSnapshotterName, c.Snapshotter)
+		}
+
+		api := newAPIClient(context.String(apiAddressFlag.Name))
+		rd, err := pollReadiness(gocontext.Background(), func(ctx gocontext.Context) (stargzfs.Readiness, error) {
+			var rd stargzfs.Readiness
+			res, err := api.do(ctx, http.MethodGet, "/readiness", url.Values{"key": {c.SnapshotKey}})
+			if err != nil {
+				return rd, fmt.Errorf("failed to get readiness: %v", err)
+			}
+			defer res.Body.Close()
+			if err := json.NewDecoder(res.Body).Decode(&rd); err != nil {
+				return rd, fmt.Errorf("failed to decode result: %v", err)
+			}
+			return rd, nil
+		}, context.Duration("wait"), context.Duration("interval"))
+		if err != nil {
+			return err
+		}
+		if !context.Bool("quiet") {
+			if context.Bool("json") {
+				enc := json.NewEncoder(context.App.Writer)
+				enc.SetIndent("", "  ")
+				if err := enc.Encode(rd); err != nil {
+					return err
+				}
+			} else if err := printReadiness(context.App.Writer, rd); err != nil {
+				return err
+			}
+		}
+		if !rd.Ready {
+			return fmt.Errorf("container %q is not ready", id)
+		}
+		return nil
+	},
+}
+
+// pollReadiness gets the readiness with get until it becomes ready or wait
+// elapses. wait <= 0 means getting it only once.
+func pollReadiness(ctx gocontext.Context, get func(gocontext.Context) (stargzfs.Readiness, error), wait, interval time.Duration) (stargzfs.Readiness, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		rd, err := get(ctx)
+		if err != nil || rd.Ready || !time.Now().Add(interval).Before(deadline) {
+			return rd, err
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return rd, ctx.Err()
+		}
+	}
+}
+
+func printReadiness(w io.Writer, rd stargzfs.Readiness) error {
+	tw := tabwriter.NewWriter(w, 1, 8, 1, ' ', 0)
+	fmt.Fprintln(tw, "LAYER\tREADY\tPREFETCHED\tERROR")
+	for _, l := range rd.Layers {
+		layer := shortDigest(l.Digest)
+		if layer == "" {
+			layer = l.Mountpoint
+		}
+		fmt.Fprintf(tw, "%s\t%v\t%.1f%%\t%s\n", layer, l.Ready, l.PrefetchedPercent, l.Error)
+	}
+	return tw.Flush()
+}
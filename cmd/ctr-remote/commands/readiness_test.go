@@ -0,0 +1,65 @@
+//go:build linux
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	stargzfs "github.com/containerd/stargz-snapshotter/fs"
+)
+
+func TestPollReadiness(t *testing.T) {
+	tests := []struct {
+		name      string
+		wait      time.Duration
+		readyAt   int // ready at this call (1-origin); 0 for never
+		failAt    int
+		wantCalls int
+		wantReady bool
+		wantErr   bool
+	}{
+		{name: "ready", readyAt: 1, wantCalls: 1, wantReady: true},
+		{name: "no_wait", readyAt: 2, wantCalls: 1},
+		{name: "wait", wait: time.Minute, readyAt: 3, wantCalls: 3, wantReady: true},
+		{name: "timeout", wait: 15 * time.Millisecond, wantCalls: 2},
+		{name: "error", wait: time.Minute, failAt: 2, wantCalls: 2, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			rd, err := pollReadiness(context.Background(), func(context.Context) (stargzfs.Readiness, error) {
+				calls++
+				if calls == tt.failAt {
+					return stargzfs.Readiness{}, fmt.Errorf("failure")
+				}
+				return stargzfs.Readiness{Ready: calls == tt.readyAt}, nil
+			}, tt.wait, 10*time.Millisecond)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v; want error %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls || rd.Ready != tt.wantReady {
+				t.Errorf("calls = %d, ready = %v; want %d, %v", calls, rd.Ready, tt.wantCalls, tt.wantReady)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/stargz-snapshotter/converter/optimizer/imageio"
+	"github.com/google/go-containerregistry/pkg/name"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+func parseReference(ref string, clicontext *cli.Context) (imageio.ImageIO, error) {
+	if strings.HasPrefix(ref, "local://") {
+		abspath, err := filepath.Abs(strings.TrimPrefix(ref, "local://"))
+		if err != nil {
+			return nil, err
+		}
+		return &imageio.LocalImage{LocalPath: abspath}, nil
+	}
+	var opts []name.Option
+	if strings.HasPrefix(ref, "http://") {
+		ref = strings.TrimPrefix(ref, "http://")
+		if clicontext.Bool("plain-http") {
+			opts = append(opts, name.Insecure)
+		} else {
+			return nil, fmt.Errorf("\"--plain-http\" option must be specified to connect to %q using HTTP", ref)
+		}
+	}
+	remoteRef, err := name.ParseReference(ref, opts...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse reference %q", ref)
+	}
+	return &imageio.RemoteImage{RemoteRef: remoteRef}, nil
+}
+
+// shortDigest returns the first 12 characters of the encoded part of the digest.
+func shortDigest(dgst string) string {
+	d, err := digest.Parse(dgst)
+	if err != nil || len(d.Encoded()) < 12 {
+		return dgst
+	}
+	return d.Encoded()[:12]
+}
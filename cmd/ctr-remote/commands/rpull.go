@@ -1,3 +1,6 @@
+//go:build linux
+// +build linux
+
 /*
    Copyright The containerd Authors.
 
@@ -19,15 +22,18 @@ package commands
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/cmd/ctr/commands"
 	"github.com/containerd/containerd/cmd/ctr/commands/content"
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/snapshots"
 	fsconfig "github.com/containerd/stargz-snapshotter/fs/config"
 	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/containerd/stargz-snapshotter/snapshot"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/urfave/cli"
 )
@@ -35,6 +41,10 @@ import (
 const (
 	remoteSnapshotterName = "stargz"
 	skipContentVerifyOpt  = "skip-content-verify"
+	retriesOpt            = "retries"
+	fallbackOpt           = "fallback"
+	fuseCacheOpt          = "fuse-cache"
+	snapshotLabelOpt      = "snapshot-label"
 )
 
 var RpullCommand = cli.Command{
@@ -45,12 +55,36 @@ var RpullCommand = cli.Command{
 
 After pulling an image, it should be ready to use the same reference in a run
 command. 
+
+A failed pull is retried resuming the contents already fetched. The image is
+registered only after all of manifests and configs are fetched and all layers
+are prepared. If the pull finally fails, the image record is restored to the
+state before the pull. Layers which can't be lazily pulled (e.g. not eStargz)
+are downloaded and unpacked as normal layers unless --fallback=false is
+specified.
 `,
 	Flags: append(commands.RegistryFlags, commands.LabelFlag,
 		cli.BoolFlag{
 			Name:  skipContentVerifyOpt,
 			Usage: "Skip content verification for layers contained in this image.",
 		},
+		cli.IntFlag{
+			Name:  retriesOpt,
+			Usage: "Number of retries of the failed pull.",
+			Value: 3,
+		},
+		cli.BoolTFlag{
+			Name:  fallbackOpt,
+			Usage: "Download and unpack layers which can't be lazily pulled. If false, the pull fails on such layers.",
+		},
+		cli.StringFlag{
+			Name:  fuseCacheOpt,
+			Usage: "How the kernel caches file contents of this image (\"keep_cache\" or \"direct_io\"). Defaults to the snapshotter config.",
+		},
+		cli.StringSliceFlag{
+			Name:  snapshotLabelOpt,
+			Usage: "Labels (key=value) passed to the snapshotter for the layers of this image. Labels not in label_passthrough of the snapshotter are dropped.",
+		},
 	),
 	Action: func(context *cli.Context) error {
 		var (
@@ -82,6 +116,15 @@ command.
 		if context.Bool(skipContentVerifyOpt) {
 			config.skipVerify = true
 		}
+		config.retries = context.Int(retriesOpt)
+		config.noFallback = !context.BoolT(fallbackOpt)
+		switch m := context.String(fuseCacheOpt); m {
+		case "", fsconfig.FUSECacheModeKeepCache, fsconfig.FUSECacheModeDirectIO:
+			config.fuseCacheMode = m
+		default:
+			return fmt.Errorf("unknown FUSE cache mode %q", m)
+		}
+		config.snapshotLabels = commands.LabelArgs(context.StringSlice(snapshotLabelOpt))
 
 		if err := pull(ctx, client, ref, config); err != nil {
 			return err
@@ -93,9 +136,55 @@ command.
 type rPullConfig struct {
 	*content.FetchConfig
 	skipVerify bool
+	retries    int
+	noFallback bool
+
+	fuseCacheMode  string
+	snapshotLabels map[string]string
+}
+
+// pull pulls the image with retries. If the pull finally fails, the image record
+// is restored so that a partially pulled image isn't left registered.
+func pull(ctx context.Context, client *containerd.Client, ref string, config *rPullConfig) (retErr error) {
+	is := client.ImageService()
+	prev, err := is.Get(ctx, ref)
+	if err != nil && !errdefs.IsNotFound(err) {
+		return err
+	}
+	existed := err == nil
+	defer func() {
+		if retErr == nil {
+			return
+		}
+		if existed {
+			if _, err := is.Update(ctx, prev); err != nil {
+				log.G(ctx).WithError(err).Warn("failed to restore image record")
+			}
+		} else if err := is.Delete(ctx, ref); err != nil && !errdefs.IsNotFound(err) {
+			log.G(ctx).WithError(err).Warn("failed to cleanup image record")
+		}
+	}()
+
+	wait := time.Second
+	for i := 0; ; i++ {
+		err := pullOnce(ctx, client, ref, config)
+		if err == nil || i >= config.retries || errdefs.IsNotFound(err) || ctx.Err() != nil {
+			return err
+		}
+		log.G(ctx).WithError(err).Warnf("failed to pull; retrying in %v (%d/%d)", wait, i+1, config.retries)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+		wait *= 2
+	}
 }
 
-func pull(ctx context.Context, client *containerd.Client, ref string, config *rPullConfig) error {
+// pullOnce pulls the image. The contents fetched by the previous attempts are
+// reused because the fetched contents are kept by the lease and the content
+// store resumes the partially written ingests.
+func pullOnce(ctx context.Context, client *containerd.Client, ref string, config *rPullConfig) error {
 	pCtx := ctx
 	h := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
 		if desc.MediaType != images.MediaTypeDockerSchema1Manifest {
@@ -105,11 +194,22 @@ func pull(ctx context.Context, client *containerd.Client, ref string, config *rP
 	})
 
 	var snOpts []snapshots.Opt
+	snLabels := make(map[string]string)
+	for k, v := range config.snapshotLabels {
+		snLabels[k] = v
+	}
 	if config.skipVerify {
 		log.G(pCtx).WithField("image", ref).Warn("content verification disabled")
-		snOpts = append(snOpts, snapshots.WithLabels(map[string]string{
-			fsconfig.TargetSkipVerifyLabel: "true",
-		}))
+		snLabels[fsconfig.TargetSkipVerifyLabel] = "true"
+	}
+	if config.noFallback {
+		snLabels[snapshot.NoFallbackLabel] = "true"
+	}
+	if config.fuseCacheMode != "" {
+		snLabels[fsconfig.TargetFUSECacheModeLabel] = config.fuseCacheMode
+	}
+	if len(snLabels) > 0 {
+		snOpts = append(snOpts, snapshots.WithLabels(snLabels))
 	}
 
 	log.G(pCtx).WithField("image", ref).Debug("fetching")
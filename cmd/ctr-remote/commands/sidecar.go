@@ -0,0 +1,162 @@
+//go:build linux
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	gocontext "context"
+	"fmt"
+	"strings"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/stargz-snapshotter/converter"
+	"github.com/containerd/stargz-snapshotter/converter/optimizer"
+	"github.com/containerd/stargz-snapshotter/converter/optimizer/imageio"
+	"github.com/containerd/stargz-snapshotter/converter/optimizer/recorder"
+	"github.com/containerd/stargz-snapshotter/converter/optimizer/sampler"
+	"github.com/containerd/stargz-snapshotter/util/tempfiles"
+	regpkg "github.com/google/go-containerregistry/pkg/v1"
+	spec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// sidecarRef is the source and the destination of an image optimized in a
+// group.
+type sidecarRef struct {
+	src, dst     string
+	srcIO, dstIO imageio.ImageIO
+}
+
+// sidecarGroup is the main image and the images of its sidecars optimized
+// together with "--sidecar".
+type sidecarGroup struct {
+	main       *sidecarRef
+	sidecars   []*sidecarRef
+	opts       []sampler.Option // options of the main container
+	shareOpts  []sampler.Option // options of the sidecars
+	platform   spec.Platform
+	srcImgByID map[regpkg.Hash]regpkg.Image
+}
+
+// parseSidecarRef parses "<input-ref>=<output-ref>" of "--sidecar".
+func parseSidecarRef(s string) (src, dst string, _ error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("sidecar must be \"<input-ref>=<output-ref>\" but %q", s)
+	}
+	return parts[0], parts[1], nil
+}
+
+func (g *sidecarGroup) parse(clicontext *cli.Context, sidecars []string) (err error) {
+	for _, s := range sidecars {
+		src, dst, err := parseSidecarRef(s)
+		if err != nil {
+			return err
+		}
+		r := &sidecarRef{src: src, dst: dst}
+		if r.srcIO, err = parseReference(src, clicontext); err != nil {
+			return errors.Wrapf(err, "failed to parse source ref %q", src)
+		}
+		if r.dstIO, err = parseReference(dst, clicontext); err != nil {
+			return errors.Wrapf(err, "failed to parse destination ref %q", dst)
+		}
+		g.sidecars = append(g.sidecars, r)
+	}
+	g.shareOpts, err = parseSharedArgs(clicontext)
+	return err
+}
+
+// run optimizes the images together and writes them to the destinations.
+func (g *sidecarGroup) run(ctx gocontext.Context, opts *optimizer.Opts, policy *convertPolicy, tf *tempfiles.TempFiles, rec *recorder.Recorder) error {
+	refs := append([]*sidecarRef{g.main}, g.sidecars...)
+	workloads := make([]optimizer.Workload, len(refs))
+	g.srcImgByID = make(map[regpkg.Hash]regpkg.Image)
+	for i, r := range refs {
+		img, err := readImageForPlatform(r.srcIO, g.platform)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read %q", r.src)
+		}
+		dgst, err := img.Digest()
+		if err != nil {
+			return err
+		}
+		g.srcImgByID[dgst] = img
+		annotations, err := policy.annotations(r.src, r.dst)
+		if err != nil {
+			return err
+		}
+		workloads[i] = optimizer.Workload{
+			Image:       img,
+			SamplerOpts: g.shareOpts,
+			Annotations: annotations,
+		}
+	}
+	workloads[0].SamplerOpts = g.opts
+
+	dstImgs, err := converter.ConvertImages(ctx, opts, workloads, tf, rec)
+	if err != nil {
+		return err
+	}
+	for i, r := range refs {
+		log.G(ctx).Infof("writing optimized image %q", r.dst)
+		if err := r.dstIO.WriteImage(dstImgs[i]); err != nil {
+			return errors.Wrapf(err, "failed to write %q", r.dst)
+		}
+	}
+	return nil
+}
+
+// image returns the source image of the manifest digest.
+func (g *sidecarGroup) image(dgst regpkg.Hash) (regpkg.Image, error) {
+	img, ok := g.srcImgByID[dgst]
+	if !ok {
+		return nil, fmt.Errorf("unknown image %v", dgst)
+	}
+	return img, nil
+}
+
+// readImageForPlatform reads the image of the platform from the index, or the
+// image itself if the reference is a thin image.
+func readImageForPlatform(iio imageio.ImageIO, platform spec.Platform) (regpkg.Image, error) {
+	index, err := iio.ReadIndex()
+	if err != nil {
+		return iio.ReadImage()
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	matcher := platforms.NewMatcher(platform)
+	for _, m := range manifest.Manifests {
+		p := platforms.DefaultSpec()
+		if m.Platform != nil {
+			p = spec.Platform{
+				OS:           m.Platform.OS,
+				Architecture: m.Platform.Architecture,
+				Variant:      m.Platform.Variant,
+			}
+		}
+		if matcher.Match(p) {
+			return index.Image(m.Digest)
+		}
+	}
+	return nil, fmt.Errorf("no image for platform %q", platforms.Format(platform))
+}
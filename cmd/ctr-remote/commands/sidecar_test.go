@@ -0,0 +1,52 @@
+//go:build linux
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import "testing"
+
+func TestParseSidecarRef(t *testing.T) {
+	tests := []struct {
+		in       string
+		src, dst string
+		wantErr  bool
+	}{
+		{in: "envoy:1.0=registry2:5000/envoy:1.0-esgz", src: "envoy:1.0", dst: "registry2:5000/envoy:1.0-esgz"},
+		{in: "http://registry2:5000/a=local:///tmp/a", src: "http://registry2:5000/a", dst: "local:///tmp/a"},
+		{in: "envoy:1.0", wantErr: true},
+		{in: "=envoy:1.0", wantErr: true},
+		{in: "envoy:1.0=", wantErr: true},
+	}
+	for _, tt := range tests {
+		src, dst, err := parseSidecarRef(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parsed invalid sidecar %q", tt.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("failed to parse %q: %v", tt.in, err)
+			continue
+		}
+		if src != tt.src || dst != tt.dst {
+			t.Errorf("%q: got (%q, %q); want (%q, %q)", tt.in, src, dst, tt.src, tt.dst)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"archive/tar"
+	gocontext "context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/stargz-snapshotter/snapshot/api"
+	"github.com/urfave/cli"
+	"google.golang.org/grpc"
+)
+
+var SnapshotMaterializeCommand = cli.Command{
+	Name:      "materialize",
+	Usage:     "fetch all contents of a remote snapshot and make it a local snapshot",
+	ArgsUsage: "[flags] <key>...",
+	Description: `Fetch all remaining contents of remote snapshots managed by stargz snapshotter.
+
+Contents of materialized snapshots are pinned in the cache of the snapshotter
+so they are never evicted and the snapshots don't need the connection to the
+registry anymore. This is useful for pinning critical workloads off the network
+path. Materialized snapshots stay materialized across restarts of the
+snapshotter.
+`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "snapshotter-address",
+			Usage: "address of the gRPC socket of stargz snapshotter",
+			Value: defaultSnapshotterAddress,
+		},
+	},
+	Action: func(context *cli.Context) error {
+		if context.NArg() == 0 {
+			return fmt.Errorf("please provide keys of snapshots to materialize")
+		}
+		address := context.String("snapshotter-address")
+		conn, err := grpc.Dial(address,
+			grpc.WithInsecure(),
+			grpc.WithContextDialer(func(ctx gocontext.Context, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+			}),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to dial %q: %v", address, err)
+		}
+		defer conn.Close()
+		c := api.NewControlClient(conn)
+		for _, key := range context.Args() {
+			if _, err := c.Materialize(gocontext.Background(), &api.MaterializeRequest{Key: key}); err != nil {
+				return fmt.Errorf("failed to materialize %q: %v", key, errdefs.FromGRPC(err))
+			}
+			fmt.Fprintln(context.App.Writer, key)
+		}
+		return nil
+	},
+}
+
+var SnapshotExportCommand = cli.Command{
+	Name:      "export",
+	Usage:     "export a snapshot as a tar archive",
+	ArgsUsage: "[flags] <key>",
+	Description: `Export the contents of a snapshot managed by stargz snapshotter as a tar archive.
+
+By default, only the topmost layer of the snapshot is exported as an OCI layer
+tar. If '--merged' is specified, the merged view of the snapshot and all of its
+parents is exported. Lazily pulled contents are fetched from the registry during
+the export.
+`,
+	Flags: []cli.Flag{
+		apiAddressFlag,
+		cli.BoolFlag{
+			Name:  "merged",
+			Usage: "export the merged view of the snapshot and all of its parents",
+		},
+		cli.StringFlag{
+			Name:  "output,o",
+			Usage: "path to the output file (default: stdout)",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		key := context.Args().First()
+		if key == "" {
+			return fmt.Errorf("please provide the key of the snapshot to export")
+		}
+		var w io.Writer = context.App.Writer
+		if out := context.String("output"); out != "" {
+			f, err := os.Create(out)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		c := newAPIClient(context.String(apiAddressFlag.Name))
+		res, err := c.do(gocontext.Background(), http.MethodGet, "/export", url.Values{
+			"key":    {key},
+			"merged": {strconv.FormatBool(context.Bool("merged"))},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to export %q: %v", key, err)
+		}
+		defer res.Body.Close()
+
+		// Validate the archive while writing it so that a stream broken in the
+		// middle of the export isn't treated as a complete archive.
+		pr, pw := io.Pipe()
+		done := make(chan error)
+		go func() {
+			tr := tar.NewReader(pr)
+			var err error
+			for {
+				if _, err = tr.Next(); err != nil {
+					break
+				}
+			}
+			io.Copy(ioutil.Discard, pr)
+			if err == io.EOF {
+				err = nil
+			}
+			done <- err
+		}()
+		_, err = io.Copy(io.MultiWriter(w, pw), res.Body)
+		pw.CloseWithError(err)
+		if vErr := <-done; vErr != nil {
+			return fmt.Errorf("exported archive of %q is broken: %v", key, vErr)
+		}
+		return err
+	},
+}
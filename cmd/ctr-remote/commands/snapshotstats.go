@@ -0,0 +1,99 @@
+//go:build linux
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	gocontext "context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"text/tabwriter"
+	"time"
+
+	stargzfs "github.com/containerd/stargz-snapshotter/fs"
+	"github.com/urfave/cli"
+)
+
+// SnapshotStatsCommand shows statistics of reads on a remote snapshot.
+var SnapshotStatsCommand = cli.Command{
+	Name:      "stats",
+	Usage:     "show statistics of reads on a remote snapshot",
+	ArgsUsage: "[flags] <key>",
+	Description: `Show the statistics of reads on the remote layers of a snapshot managed by
+stargz snapshotter: the cache hit rate since the layers were mounted and
+on-demand fetches in the last --window with their latency percentiles.
+
+Schedulers and autoscalers can use them to prefer nodes with warm caches for
+an image. The key of the snapshot of an image is the chain ID of its layers.
+`,
+	Flags: []cli.Flag{
+		apiAddressFlag,
+		cli.DurationFlag{
+			Name:  "window",
+			Usage: "duration until now in which on-demand fetches are aggregated",
+			Value: 5 * time.Minute,
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "print the statistics as JSON",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		key := context.Args().First()
+		if key == "" {
+			return fmt.Errorf("please provide the key of the snapshot")
+		}
+		c := newAPIClient(context.String(apiAddressFlag.Name))
+		res, err := c.do(gocontext.Background(), http.MethodGet, "/stats/snapshot", url.Values{
+			"key":    {key},
+			"window": {context.Duration("window").String()},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get statistics of %q: %v", key, err)
+		}
+		defer res.Body.Close()
+		var st stargzfs.SnapshotStats
+		if err := json.NewDecoder(res.Body).Decode(&st); err != nil {
+			return fmt.Errorf("failed to decode result: %v", err)
+		}
+		if context.Bool("json") {
+			enc := json.NewEncoder(context.App.Writer)
+			enc.SetIndent("", "  ")
+			return enc.Encode(st)
+		}
+		return printSnapshotStats(context.App.Writer, st)
+	},
+}
+
+func printSnapshotStats(w io.Writer, st stargzfs.SnapshotStats) error {
+	tw := tabwriter.NewWriter(w, 1, 8, 1, ' ', 0)
+	fmt.Fprintln(tw, "LAYER\tFETCHED\tHITS\tMISSES")
+	for _, l := range st.Layers {
+		fmt.Fprintf(tw, "%s\t%.1f%%\t%d\t%d\n", shortDigest(l.Digest), l.FetchedPercent, l.CacheHits, l.CacheMisses)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "\ncache hit rate: %.1f%%\non-demand fetches in %v: %d (%d bytes), latency p50=%v p90=%v p99=%v\n",
+		st.CacheHitRate*100, st.Window, st.OnDemandFetches, st.OnDemandSize, st.LatencyP50, st.LatencyP90, st.LatencyP99)
+	return err
+}
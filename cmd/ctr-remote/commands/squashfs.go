@@ -0,0 +1,80 @@
+//go:build linux
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/blockdev"
+	"github.com/urfave/cli"
+)
+
+// SquashfsCommand converts an eStargz layer blob to a squashfs image.
+var SquashfsCommand = cli.Command{
+	Name:      "squashfs",
+	Usage:     "convert an eStargz layer blob to a squashfs image (experimental)",
+	ArgsUsage: "<layer blob> <output image>",
+	Description: `Convert an eStargz layer blob to a squashfs image of the same layout as the
+block devices served by stargz snapshotter with "ublk_squashfs = true".
+
+Data blocks of the image are stored uncompressed. Whiteouts are converted to
+the overlayfs style so images of layers can be stacked by overlayfs.
+`,
+	Action: func(context *cli.Context) error {
+		if context.NArg() != 2 {
+			return fmt.Errorf("please specify the layer blob and the output image")
+		}
+		in, err := os.Open(context.Args().Get(0))
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		st, err := in.Stat()
+		if err != nil {
+			return err
+		}
+		r, err := estargz.Open(io.NewSectionReader(in, 0, st.Size()))
+		if err != nil {
+			return fmt.Errorf("failed to open eStargz layer: %v", err)
+		}
+		root, ok := r.Lookup("")
+		if !ok {
+			return fmt.Errorf("root directory not found in the layer")
+		}
+		img, err := blockdev.NewSquashfsImage(root, func(name string) (io.ReaderAt, error) {
+			return r.OpenFile(name)
+		})
+		if err != nil {
+			return err
+		}
+		out, err := os.Create(context.Args().Get(1))
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, io.NewSectionReader(img, 0, img.Size())); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	},
+}
@@ -0,0 +1,298 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+const (
+	whiteoutPrefix    = ".wh."
+	whiteoutOpaqueDir = whiteoutPrefix + whiteoutPrefix + ".opq"
+
+	lintOrphanWhiteout   = "orphan-whiteout"
+	lintShadowedWhiteout = "shadowed-whiteout"
+	lintLargeOpaque      = "large-opaque"
+)
+
+// TOCCommand inspects TOCs of eStargz images.
+var TOCCommand = cli.Command{
+	Name:        "toc",
+	Usage:       "inspect TOCs of eStargz images",
+	Subcommands: []cli.Command{tocLintCommand},
+}
+
+var tocLintCommand = cli.Command{
+	Name:      "lint",
+	Usage:     "check whiteouts and opaque directories of eStargz layers",
+	ArgsUsage: "[flags] <ref>",
+	Description: `Check the TOCs of the eStargz layers of an image for suspicious whiteouts and
+opaque directories, which silently inflate the traffic of lazy pulling because
+contents hidden by them are still in the lower layers.
+
+The following are reported.
+
+- orphan-whiteout: a whiteout of a path which doesn't exist in the lower layers
+- shadowed-whiteout: a whiteout of a path which is recreated by an upper layer
+- large-opaque: an opaque directory hiding contents larger than
+  --opaque-threshold in the lower layers
+
+The layers must be in the content store (e.g. converted by
+"ctr-remote image convert"). Exits with an error if anything is reported.
+`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "platform of the image to check. Defaults to the platform of this host.",
+		},
+		cli.Int64Flag{
+			Name:  "opaque-threshold",
+			Usage: "size in bytes of contents hidden by an opaque directory to be reported",
+			Value: 10 << 20,
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "print the result as JSON",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		ref := context.Args().First()
+		if ref == "" {
+			return errors.New("image must be specified")
+		}
+		platformMC := platforms.Default()
+		if pStr := context.String("platform"); pStr != "" {
+			p, err := platforms.Parse(pStr)
+			if err != nil {
+				return errors.Wrapf(err, "invalid platform %q", pStr)
+			}
+			platformMC = platforms.Only(p)
+		}
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+		img, err := client.ImageService().Get(ctx, ref)
+		if err != nil {
+			return err
+		}
+		cs := client.ContentStore()
+		manifest, err := images.Manifest(ctx, cs, img.Target, platformMC)
+		if err != nil {
+			return err
+		}
+		var layers [][]lintEntry
+		for i, l := range manifest.Layers {
+			ents, err := func() ([]lintEntry, error) {
+				ra, err := cs.ReaderAt(ctx, l)
+				if err != nil {
+					return nil, err
+				}
+				defer ra.Close()
+				r, err := estargz.Open(io.NewSectionReader(ra, 0, l.Size))
+				if err != nil {
+					return nil, err
+				}
+				root, ok := r.Lookup("")
+				if !ok {
+					return nil, fmt.Errorf("root directory not found")
+				}
+				return tocLintEntries(root), nil
+			}()
+			if err != nil {
+				return errors.Wrapf(err, "failed to read TOC of layer %d (%s)", i, l.Digest)
+			}
+			layers = append(layers, ents)
+		}
+
+		findings := lintLayers(layers, context.Int64("opaque-threshold"))
+		for i := range findings {
+			findings[i].Digest = manifest.Layers[findings[i].Layer].Digest.String()
+		}
+		if context.Bool("json") {
+			enc := json.NewEncoder(context.App.Writer)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(findings); err != nil {
+				return err
+			}
+		} else if err := printLintFindings(context.App.Writer, findings); err != nil {
+			return err
+		}
+		if len(findings) > 0 {
+			return fmt.Errorf("%d issues found", len(findings))
+		}
+		return nil
+	},
+}
+
+// lintEntry is an entry of a layer. Whiteouts are included as they are.
+type lintEntry struct {
+	name string // cleaned path without the leading "/"
+	dir  bool
+	size int64
+}
+
+// lintFinding is a suspicious whiteout or opaque directory.
+type lintFinding struct {
+	Layer      int    `json:"layer"`
+	Digest     string `json:"digest"`
+	Kind       string `json:"kind"`
+	Path       string `json:"path"`
+	Detail     string `json:"detail"`
+	HiddenSize int64  `json:"hiddenSize,omitempty"`
+}
+
+// tocLintEntries returns the entries under root in the lexical order.
+func tocLintEntries(root *estargz.TOCEntry) []lintEntry {
+	var ents []lintEntry
+	var walk func(dir string, e *estargz.TOCEntry)
+	walk = func(dir string, e *estargz.TOCEntry) {
+		var names []string
+		children := make(map[string]*estargz.TOCEntry)
+		e.ForeachChild(func(baseName string, ent *estargz.TOCEntry) bool {
+			names = append(names, baseName)
+			children[baseName] = ent
+			return true
+		})
+		sort.Strings(names)
+		for _, name := range names {
+			ent := children[name]
+			p := path.Join(dir, name)
+			ents = append(ents, lintEntry{name: p, dir: ent.Type == "dir", size: ent.Size})
+			if ent.Type == "dir" {
+				walk(p, ent)
+			}
+		}
+	}
+	walk("", root)
+	return ents
+}
+
+// lintLayers applies the layers from the lowest one with the overlayfs
+// semantics and reports suspicious whiteouts and opaque directories.
+func lintLayers(layers [][]lintEntry, opaqueThreshold int64) (findings []lintFinding) {
+	type visible struct {
+		dir  bool
+		size int64
+	}
+	var (
+		view     = make(map[string]visible) // paths visible from the current layer
+		whiteout = make(map[string]int)     // whited-out path -> layer
+	)
+	// remove removes p (if self is true) and its children from the view and
+	// returns the total size and the number of the removed files.
+	remove := func(p string, self bool) (size int64, files int) {
+		prefix := p + "/"
+		if p == "" {
+			prefix = ""
+		}
+		for k, v := range view {
+			if (self && k == p) || strings.HasPrefix(k, prefix) {
+				if !v.dir {
+					size += v.size
+					files++
+				}
+				delete(view, k)
+			}
+		}
+		return
+	}
+	for i, ents := range layers {
+		// Whiteouts only affect lower layers so they are applied first.
+		for _, e := range ents {
+			dir, base := path.Split(e.name)
+			dir = strings.TrimSuffix(dir, "/")
+			switch {
+			case base == whiteoutOpaqueDir:
+				if size, files := remove(dir, false); size >= opaqueThreshold && files > 0 {
+					findings = append(findings, lintFinding{
+						Layer:      i,
+						Kind:       lintLargeOpaque,
+						Path:       "/" + dir,
+						Detail:     fmt.Sprintf("hides %d bytes in %d files of lower layers", size, files),
+						HiddenSize: size,
+					})
+				}
+			case strings.HasPrefix(base, whiteoutPrefix):
+				target := path.Join(dir, base[len(whiteoutPrefix):])
+				if _, ok := view[target]; !ok {
+					findings = append(findings, lintFinding{
+						Layer:  i,
+						Kind:   lintOrphanWhiteout,
+						Path:   "/" + target,
+						Detail: "no lower layer has the path",
+					})
+					continue
+				}
+				remove(target, true)
+				whiteout[target] = i
+			}
+		}
+		for _, e := range ents {
+			if strings.HasPrefix(path.Base(e.name), whiteoutPrefix) {
+				continue
+			}
+			if l, ok := whiteout[e.name]; ok && l < i {
+				findings = append(findings, lintFinding{
+					Layer:  l,
+					Kind:   lintShadowedWhiteout,
+					Path:   "/" + e.name,
+					Detail: fmt.Sprintf("recreated by layer %d", i),
+				})
+				delete(whiteout, e.name)
+			}
+			if old, ok := view[e.name]; ok && old.dir && !e.dir {
+				remove(e.name, false)
+			}
+			view[e.name] = visible{dir: e.dir, size: e.size}
+		}
+	}
+	sort.SliceStable(findings, func(i, j int) bool {
+		if findings[i].Layer != findings[j].Layer {
+			return findings[i].Layer < findings[j].Layer
+		}
+		return findings[i].Path < findings[j].Path
+	})
+	return findings
+}
+
+func printLintFindings(w io.Writer, findings []lintFinding) error {
+	if len(findings) == 0 {
+		_, err := fmt.Fprintln(w, "no issues found")
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 1, 8, 1, ' ', 0)
+	fmt.Fprintln(tw, "LAYER\tKIND\tPATH\tDETAIL")
+	for _, f := range findings {
+		fmt.Fprintf(tw, "%d (%s)\t%s\t%s\t%s\n", f.Layer, shortDigest(f.Digest), f.Kind, f.Path, f.Detail)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,52 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLintLayers(t *testing.T) {
+	dir := func(name string) lintEntry { return lintEntry{name: name, dir: true} }
+	file := func(name string, size int64) lintEntry { return lintEntry{name: name, size: size} }
+	layers := [][]lintEntry{
+		{
+			dir("app"), file("app/a", 100), file("app/b", 200),
+			dir("data"), file("data/big", 1000),
+			file("tmp", 1),
+		},
+		{
+			file(".wh.nonexistent", 0),
+			file(".wh.tmp", 0),
+			dir("data"), file("data/.wh..wh..opq", 0),
+			dir("app"), file("app/.wh..wh..opq", 0), file("app/c", 10),
+		},
+		{
+			file("tmp", 2),
+		},
+	}
+	got := lintLayers(layers, 500)
+	want := []lintFinding{
+		{Layer: 1, Kind: lintLargeOpaque, Path: "/data", Detail: "hides 1000 bytes in 1 files of lower layers", HiddenSize: 1000},
+		{Layer: 1, Kind: lintOrphanWhiteout, Path: "/nonexistent", Detail: "no lower layer has the path"},
+		{Layer: 1, Kind: lintShadowedWhiteout, Path: "/tmp", Detail: "recreated by layer 2"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("findings = %+v; want %+v", got, want)
+	}
+}
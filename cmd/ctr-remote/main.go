@@ -30,15 +30,41 @@ func init() {
 	seed.WithTimeAndRand()
 }
 
+var (
+	// Commands added as subcommands of ctr's commands of the same name.
+	customCommands = map[string][]cli.Command{
+		"images":    {commands.ConvertCommand, commands.BenchCommand, commands.DevMountCommand},
+		"snapshots": {commands.SnapshotMaterializeCommand, commands.SnapshotExportCommand},
+	}
+	// Commands replacing ctr's subcommands of the same name.
+	overrideCommands = map[string][]cli.Command{
+		"images": {commands.PushCommand},
+	}
+	// Commands replacing ctr's top-level commands of the same name.
+	replaceCommands = map[string]cli.Command{}
+	// Commands added as top-level commands.
+	topLevelCommands = []cli.Command{commands.DebugCommand, commands.TOCCommand}
+)
+
 func main() {
-	customCommands := []cli.Command{commands.RpullCommand, commands.OptimizeCommand, commands.ConvertCommand}
 	app := app.New()
 	for i := range app.Commands {
-		if app.Commands[i].Name == "images" {
-			app.Commands[i].Subcommands = append(app.Commands[i].Subcommands, customCommands...)
-			break
+		if c, ok := replaceCommands[app.Commands[i].Name]; ok {
+			app.Commands[i] = c
+			continue
+		}
+		for _, o := range overrideCommands[app.Commands[i].Name] {
+			for j := range app.Commands[i].Subcommands {
+				if app.Commands[i].Subcommands[j].Name == o.Name {
+					app.Commands[i].Subcommands[j] = o
+				}
+			}
+		}
+		if c, ok := customCommands[app.Commands[i].Name]; ok {
+			app.Commands[i].Subcommands = append(app.Commands[i].Subcommands, c...)
 		}
 	}
+	app.Commands = append(app.Commands, topLevelCommands...)
 	if err := app.Run(os.Args); err != nil {
 		fmt.Fprintf(os.Stderr, "ctr: %v\n", err)
 		os.Exit(1)
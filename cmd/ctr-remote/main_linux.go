@@ -0,0 +1,36 @@
+//go:build linux
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/containerd/stargz-snapshotter/cmd/ctr-remote/commands"
+)
+
+// Commands which need Linux, e.g. the ones depending on stargz snapshotter or
+// running containers.
+func init() {
+	customCommands["images"] = append(customCommands["images"],
+		commands.RpullCommand, commands.OptimizeCommand, commands.InvalidateCacheCommand, commands.SquashfsCommand)
+	customCommands["snapshots"] = append(customCommands["snapshots"], commands.SnapshotStatsCommand)
+	// ctr's "install" (installing packages from images) is replaced by the
+	// installer of stargz snapshotter.
+	replaceCommands[commands.InstallCommand.Name] = commands.InstallCommand
+	topLevelCommands = append(topLevelCommands, commands.CacheCommand, commands.GCCommand, commands.AnalyzeCommand, commands.ReadinessCommand)
+}
@@ -0,0 +1,70 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package converter
+
+import (
+	"bytes"
+	"encoding/json"
+
+	regpkg "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// annotatedImage is an image whose manifest has additional annotations.
+type annotatedImage struct {
+	regpkg.Image
+	annotations map[string]string
+}
+
+func (i *annotatedImage) Manifest() (*regpkg.Manifest, error) {
+	m, err := i.Image.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	m = m.DeepCopy()
+	if m.Annotations == nil {
+		m.Annotations = make(map[string]string, len(i.annotations))
+	}
+	for k, v := range i.annotations {
+		m.Annotations[k] = v
+	}
+	return m, nil
+}
+
+func (i *annotatedImage) RawManifest() ([]byte, error) {
+	m, err := i.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(m)
+}
+
+func (i *annotatedImage) Digest() (regpkg.Hash, error) {
+	b, err := i.RawManifest()
+	if err != nil {
+		return regpkg.Hash{}, err
+	}
+	h, _, err := regpkg.SHA256(bytes.NewReader(b))
+	return h, err
+}
+
+func (i *annotatedImage) Size() (int64, error) {
+	b, err := i.RawManifest()
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(b)), nil
+}
@@ -23,6 +23,8 @@
 package converter
 
 import (
+	"bufio"
+	"compress/gzip"
 	gocontext "context"
 	"fmt"
 	"io"
@@ -45,9 +47,31 @@ import (
 	spec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
 )
 
-func ConvertIndex(ctx gocontext.Context, noOptimize bool, opts *optimizer.Opts, srcIndex regpkg.ImageIndex, platform *spec.Platform, tf *tempfiles.TempFiles, rec *recorder.Recorder, runopts ...sampler.Option) (regpkg.ImageIndex, error) {
+// StreamOpts makes the conversion without optimization push each layer to the
+// destination as soon as it's converted, instead of keeping all converted
+// layers on disk until the image is written. This bounds the temporary disk
+// usage to the layers being converted at the same time.
+type StreamOpts struct {
+	// PushLayer pushes a converted layer to the destination repository.
+	PushLayer func(regpkg.Layer) error
+
+	// MaxConcurrentLayers is the maximum number of layers converted at the
+	// same time. Defaults to 1.
+	MaxConcurrentLayers int
+
+	// State records the pushed layers for resuming an aborted conversion.
+	// Layers recorded in State are reused without conversion if LayerExists
+	// reports that the destination has them.
+	State *StreamState
+
+	// LayerExists returns true if the destination repository has the blob.
+	LayerExists func(regpkg.Hash) (bool, error)
+}
+
+func ConvertIndex(ctx gocontext.Context, noOptimize bool, opts *optimizer.Opts, stream *StreamOpts, srcIndex regpkg.ImageIndex, platform *spec.Platform, tf *tempfiles.TempFiles, rec *recorder.Recorder, runopts ...sampler.Option) (regpkg.ImageIndex, error) {
 	var addendums []mutate.IndexAddendum
 	manifest, err := srcIndex.IndexManifest()
 	if err != nil {
@@ -68,7 +92,7 @@ func ConvertIndex(ctx gocontext.Context, noOptimize bool, opts *optimizer.Opts,
 			return nil, err
 		}
 		cctx := log.WithLogger(ctx, log.G(ctx).WithField("platform", platforms.Format(p)))
-		dstImg, err := ConvertImage(cctx, noOptimize, opts, srcImg, &p, tf, rec, runopts...)
+		dstImg, err := ConvertImage(cctx, noOptimize, opts, stream, srcImg, &p, tf, rec, runopts...)
 		if err != nil {
 			return nil, err
 		}
@@ -90,14 +114,25 @@ func ConvertIndex(ctx gocontext.Context, noOptimize bool, opts *optimizer.Opts,
 	return mutate.AppendManifests(empty.Index, addendums...), nil
 }
 
-func ConvertImage(ctx gocontext.Context, noOptimize bool, opts *optimizer.Opts, srcImg regpkg.Image, platform *spec.Platform, tf *tempfiles.TempFiles, rec *recorder.Recorder, runopts ...sampler.Option) (dstImg regpkg.Image, _ error) {
+func ConvertImage(ctx gocontext.Context, noOptimize bool, opts *optimizer.Opts, stream *StreamOpts, srcImg regpkg.Image, platform *spec.Platform, tf *tempfiles.TempFiles, rec *recorder.Recorder, runopts ...sampler.Option) (dstImg regpkg.Image, _ error) {
 	// The order of the list is base layer first, top layer last.
 	layers, err := srcImg.Layers()
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to get image layers")
 	}
+	var esgzOpts []estargz.Option
+	if opts != nil {
+		esgzOpts = opts.EStargzOptions
+	}
 	addendums := make([]mutate.Addendum, len(layers))
-	if noOptimize || !platforms.NewMatcher(platforms.DefaultSpec()).Match(*platform) {
+	if stream != nil {
+		if !noOptimize && platforms.NewMatcher(platforms.DefaultSpec()).Match(*platform) {
+			return nil, fmt.Errorf("streaming conversion doesn't support optimization")
+		}
+		if addendums, err = streamEStargzLayers(ctx, layers, stream, esgzOpts); err != nil {
+			return nil, errors.Wrapf(err, "failed to convert layer to stargz")
+		}
+	} else if noOptimize || !platforms.NewMatcher(platforms.DefaultSpec()).Match(*platform) {
 		// Do not run the optimization container if the option requires it or
 		// the source image doesn't match to the platform where this command runs on.
 		log.G(ctx).Warn("Platform mismatch or optimization disabled; converting without optimization")
@@ -107,7 +142,8 @@ func ConvertImage(ctx gocontext.Context, noOptimize bool, opts *optimizer.Opts,
 		for i, l := range layers {
 			i, l := i, l
 			eg.Go(func() error {
-				newL, jtocDigest, err := buildEStargzLayer(l, tf)
+				ctx := log.WithLogger(ctx, log.G(ctx).WithField("layer", i))
+				newL, jtocDigest, err := buildEStargzLayer(ctx, l, tf, esgzOpts...)
 				if err != nil {
 					return err
 				}
@@ -131,6 +167,38 @@ func ConvertImage(ctx gocontext.Context, noOptimize bool, opts *optimizer.Opts,
 			return nil, err
 		}
 	}
+	var annotations map[string]string
+	if opts != nil {
+		annotations = opts.Annotations
+	}
+	return newImage(srcImg, addendums, annotations)
+}
+
+// ConvertImages optimizes the images together against the workload running
+// all of them at the same time and converts them. The first image is the main
+// container and the others are its sidecars (see optimizer.OptimizeGroup).
+// The images must be runnable on this platform.
+func ConvertImages(ctx gocontext.Context, opts *optimizer.Opts, workloads []optimizer.Workload, tf *tempfiles.TempFiles, rec *recorder.Recorder) ([]regpkg.Image, error) {
+	addendums, err := optimizer.OptimizeGroup(ctx, opts, workloads, tf, rec)
+	if err != nil {
+		return nil, err
+	}
+	imgs := make([]regpkg.Image, len(workloads))
+	for i, w := range workloads {
+		annotations := w.Annotations
+		if annotations == nil {
+			annotations = opts.Annotations
+		}
+		if imgs[i], err = newImage(w.Image, addendums[i], annotations); err != nil {
+			return nil, err
+		}
+	}
+	return imgs, nil
+}
+
+// newImage returns the image with the config of the source image and the
+// converted layers. The annotations are added to the manifest.
+func newImage(srcImg regpkg.Image, addendums []mutate.Addendum, annotations map[string]string) (regpkg.Image, error) {
 	srcCfg, err := srcImg.ConfigFile()
 	if err != nil {
 		return nil, err
@@ -142,13 +210,135 @@ func ConvertImage(ctx gocontext.Context, noOptimize bool, opts *optimizer.Opts,
 		return nil, err
 	}
 
-	return mutate.Append(img, addendums...)
+	if img, err = mutate.Append(img, addendums...); err != nil {
+		return nil, err
+	}
+	if len(annotations) > 0 {
+		img = &annotatedImage{img, annotations}
+	}
+	return img, nil
 }
 
-func buildEStargzLayer(uncompressed regpkg.Layer, tf *tempfiles.TempFiles) (regpkg.Layer, ocidigest.Digest, error) {
+// streamEStargzLayers converts layers to eStargz and pushes them one by one.
+// Temporary files of a layer are removed right after the layer is pushed so
+// at most stream.MaxConcurrentLayers layers are on disk at the same time.
+func streamEStargzLayers(ctx gocontext.Context, layers []regpkg.Layer, stream *StreamOpts, esgzOpts []estargz.Option) ([]mutate.Addendum, error) {
+	concurrency := stream.MaxConcurrentLayers
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	var (
+		addendums = make([]mutate.Addendum, len(layers))
+		sem       = semaphore.NewWeighted(int64(concurrency))
+	)
+	eg, egCtx := errgroup.WithContext(ctx)
+	for i, l := range layers {
+		i, l := i, l
+		if err := sem.Acquire(egCtx, 1); err != nil {
+			break // the error is returned by eg.Wait()
+		}
+		eg.Go(func() error {
+			a, err := streamEStargzLayer(ctx, i, l, stream, esgzOpts)
+			if err != nil {
+				// The semaphore isn't released so that no more layers are started.
+				return err
+			}
+			addendums[i] = a
+			sem.Release(1)
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return addendums, nil
+}
+
+func streamEStargzLayer(ctx gocontext.Context, i int, l regpkg.Layer, stream *StreamOpts, esgzOpts []estargz.Option) (mutate.Addendum, error) {
+	ltf := tempfiles.NewTempFiles()
+	defer func() {
+		if err := ltf.CleanupAll(); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to cleanup layer files")
+		}
+	}()
+	ctx = log.WithLogger(ctx, log.G(ctx).WithField("layer", i))
+	src, err := l.Digest()
+	if err != nil {
+		return mutate.Addendum{}, err
+	}
+	if pushed, tocDigest, ok := reusableLayer(stream, src); ok {
+		log.G(ctx).Infof("reusing the layer pushed by the previous conversion")
+		return mutate.Addendum{
+			Layer: pushed,
+			Annotations: map[string]string{
+				estargz.TOCJSONDigestAnnotation: tocDigest,
+			},
+		}, nil
+	}
+	newL, jtocDigest, err := buildEStargzLayer(ctx, l, ltf, esgzOpts...)
+	if err != nil {
+		return mutate.Addendum{}, err
+	}
+	if err := stream.PushLayer(newL); err != nil {
+		return mutate.Addendum{}, errors.Wrapf(err, "failed to push layer %d", i)
+	}
+	pushed, err := layer.NewPushedLayer(newL)
+	if err != nil {
+		return mutate.Addendum{}, err
+	}
+	if stream.State != nil {
+		if err := stream.State.record(src, pushed, jtocDigest.String()); err != nil {
+			return mutate.Addendum{}, errors.Wrapf(err, "failed to record layer %d to the state", i)
+		}
+	}
+	log.G(ctx).Infof("converted and pushed")
+	return mutate.Addendum{
+		Layer: pushed,
+		Annotations: map[string]string{
+			estargz.TOCJSONDigestAnnotation: jtocDigest.String(),
+		},
+	}, nil
+}
+
+// reusableLayer returns the layer converted from src by the previous conversion
+// if it's recorded in stream.State and the destination still has it.
+func reusableLayer(stream *StreamOpts, src regpkg.Hash) (regpkg.Layer, string, bool) {
+	if stream.State == nil || stream.LayerExists == nil {
+		return nil, "", false
+	}
+	l, tocDigest, ok := stream.State.lookup(src)
+	if !ok {
+		return nil, "", false
+	}
+	dgst, err := l.Digest()
+	if err != nil {
+		return nil, "", false
+	}
+	if exists, err := stream.LayerExists(dgst); err != nil || !exists {
+		return nil, "", false
+	}
+	return l, tocDigest, true
+}
+
+func buildEStargzLayer(ctx gocontext.Context, uncompressed regpkg.Layer, tf *tempfiles.TempFiles, opts ...estargz.Option) (regpkg.Layer, ocidigest.Digest, error) {
 	tftmp := tempfiles.NewTempFiles() // Shorter lifetime than tempfiles passed by argument
 	defer tftmp.CleanupAll()
-	r, err := uncompressed.Uncompressed()
+	size, err := uncompressed.Size()
+	if err != nil {
+		size = -1 // progress is reported without ETA
+	}
+	progress := newLayerProgress(size)
+	done := progress.report(ctx)
+	defer done()
+	rc, err := uncompressed.Compressed()
+	if err != nil {
+		return nil, "", err
+	}
+	defer rc.Close()
+	r, err := decompress(progress.countRead(rc))
 	if err != nil {
 		return nil, "", err
 	}
@@ -163,16 +353,27 @@ func buildEStargzLayer(uncompressed regpkg.Layer, tf *tempfiles.TempFiles) (regp
 	if err != nil {
 		return nil, "", err
 	}
-	rc, err := estargz.Build(sr) // no optimization
+	blob, err := estargz.Build(sr, opts...) // no optimization
 	if err != nil {
 		return nil, "", err
 	}
-	defer rc.Close()
-	l, err := layer.NewStaticCompressedLayer(rc, tf)
+	defer blob.Close()
+	l, err := layer.NewStaticCompressedLayer(progress.countWritten(blob), tf)
 	if err != nil {
 		return nil, "", err
 	}
-	return l, rc.TOCDigest(), err
+	log.G(ctx).Infof("converted: %s", progress)
+	return l, blob.TOCDigest(), err
+}
+
+// decompress returns the tar stream of the layer blob, which is gzip-compressed
+// or uncompressed.
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	return br, nil
 }
 
 // specPlatform converts ggcr's platform struct to OCI's struct
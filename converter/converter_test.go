@@ -0,0 +1,214 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package converter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	regpkg "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func TestStreamEStargzLayers(t *testing.T) {
+	const (
+		layersNum   = 5
+		concurrency = 2
+	)
+	var layers []regpkg.Layer
+	for i := 0; i < layersNum; i++ {
+		l, err := random.Layer(1024, types.DockerLayer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		layers = append(layers, l)
+	}
+	var (
+		mu      sync.Mutex
+		running int
+		pushed  = make(map[regpkg.Hash]bool)
+	)
+	stream := &StreamOpts{
+		PushLayer: func(l regpkg.Layer) error {
+			mu.Lock()
+			running++
+			if running > concurrency {
+				t.Errorf("%d layers are converted at the same time; want <= %d", running, concurrency)
+			}
+			mu.Unlock()
+			defer func() {
+				mu.Lock()
+				running--
+				mu.Unlock()
+			}()
+			r, err := l.Compressed()
+			if err != nil {
+				return err
+			}
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			if _, err := estargz.Open(io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b)))); err != nil {
+				t.Errorf("pushed layer isn't eStargz: %v", err)
+			}
+			dgst, err := l.Digest()
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			pushed[dgst] = true
+			mu.Unlock()
+			return nil
+		},
+		MaxConcurrentLayers: concurrency,
+	}
+	adds, err := streamEStargzLayers(context.Background(), layers, stream, nil)
+	if err != nil {
+		t.Fatalf("failed to convert layers: %v", err)
+	}
+	if len(adds) != layersNum || len(pushed) != layersNum {
+		t.Fatalf("got %d layers (%d pushed); want %d", len(adds), len(pushed), layersNum)
+	}
+	for i, a := range adds {
+		dgst, err := a.Layer.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !pushed[dgst] {
+			t.Errorf("layer %d (%v) isn't pushed", i, dgst)
+		}
+		if _, err := a.Layer.Compressed(); err == nil {
+			t.Errorf("contents of layer %d must not be kept after push", i)
+		}
+		if a.Annotations[estargz.TOCJSONDigestAnnotation] == "" {
+			t.Errorf("layer %d doesn't have TOC digest annotation", i)
+		}
+	}
+}
+
+func TestStreamEStargzLayersResume(t *testing.T) {
+	var layers []regpkg.Layer
+	for i := 0; i < 3; i++ {
+		l, err := random.Layer(1024, types.DockerLayer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		layers = append(layers, l)
+	}
+	tmp, err := ioutil.TempDir("", "teststreamstate")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	statePath := filepath.Join(tmp, "state.json")
+	state, err := LoadStreamState(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		registry = make(map[regpkg.Hash]bool)
+		pushes   int
+		abort    = true
+	)
+	stream := &StreamOpts{
+		PushLayer: func(l regpkg.Layer) error {
+			dgst, err := l.Digest()
+			if err != nil {
+				return err
+			}
+			if pushes++; abort && pushes == 2 {
+				return fmt.Errorf("aborted")
+			}
+			registry[dgst] = true
+			return nil
+		},
+		State: state,
+		LayerExists: func(h regpkg.Hash) (bool, error) {
+			return registry[h], nil
+		},
+	}
+	if _, err := streamEStargzLayers(context.Background(), layers, stream, nil); err == nil {
+		t.Fatalf("conversion must be aborted")
+	}
+
+	// Resume the conversion with the state loaded from the file.
+	if stream.State, err = LoadStreamState(statePath); err != nil {
+		t.Fatal(err)
+	}
+	pushes, abort = 0, false
+	adds, err := streamEStargzLayers(context.Background(), layers, stream, nil)
+	if err != nil {
+		t.Fatalf("failed to resume conversion: %v", err)
+	}
+	if pushes != 2 {
+		t.Errorf("%d layers are pushed on resume; want 2", pushes)
+	}
+	for i, a := range adds {
+		dgst, err := a.Layer.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !registry[dgst] {
+			t.Errorf("layer %d (%v) isn't pushed", i, dgst)
+		}
+		if a.Annotations[estargz.TOCJSONDigestAnnotation] == "" {
+			t.Errorf("layer %d doesn't have TOC digest annotation", i)
+		}
+	}
+}
+
+func TestAnnotatedImage(t *testing.T) {
+	src, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := &annotatedImage{src, map[string]string{"org.example.team": "platform"}}
+	m, err := img.Manifest()
+	if err != nil {
+		t.Fatalf("failed to get manifest: %v", err)
+	}
+	if got := m.Annotations["org.example.team"]; got != "platform" {
+		t.Errorf("annotation = %q; want %q", got, "platform")
+	}
+	if srcM, err := src.Manifest(); err != nil || len(srcM.Annotations) != 0 {
+		t.Errorf("source manifest must not be modified: %+v (err=%v)", srcM, err)
+	}
+	raw, err := img.RawManifest()
+	if err != nil {
+		t.Fatalf("failed to get raw manifest: %v", err)
+	}
+	want, _, err := regpkg.SHA256(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := img.Digest(); err != nil || got != want {
+		t.Errorf("digest = %v; want %v (err=%v)", got, want, err)
+	}
+	if got, err := img.Size(); err != nil || got != int64(len(raw)) {
+		t.Errorf("size = %d; want %d (err=%v)", got, len(raw), err)
+	}
+}
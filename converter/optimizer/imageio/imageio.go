@@ -24,7 +24,10 @@ package imageio
 
 import (
 	"fmt"
+	"net/http"
+	"time"
 
+	"github.com/containerd/stargz-snapshotter/util/ratelimit"
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
 	regpkg "github.com/google/go-containerregistry/pkg/v1"
@@ -33,8 +36,28 @@ import (
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/partial"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
 )
 
+// maxRateLimitWait is the maximum time to wait for retrying a request rejected
+// by the rate limit of the registry.
+const maxRateLimitWait = 5 * time.Minute
+
+// RateLimits tracks the rate limits reported by the registries accessed by
+// RemoteImage.
+var RateLimits = ratelimit.NewTracker(0)
+
+func remoteOptions() []remote.Option {
+	return []remote.Option{
+		remote.WithAuthFromKeychain(authn.DefaultKeychain),
+		remote.WithTransport(&ratelimit.Transport{
+			Inner:        http.DefaultTransport,
+			Tracker:      RateLimits,
+			MaxRetryWait: maxRateLimitWait,
+		}),
+	}
+}
+
 // ImageIO is an interface for helpers of reading/writing images to/from somewhere.
 type ImageIO interface {
 	ReadIndex() (regpkg.ImageIndex, error)
@@ -49,15 +72,15 @@ type RemoteImage struct {
 }
 
 func (ri RemoteImage) ReadIndex() (regpkg.ImageIndex, error) {
-	return remote.Index(ri.RemoteRef, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	return remote.Index(ri.RemoteRef, remoteOptions()...)
 }
 
 func (ri RemoteImage) WriteIndex(index regpkg.ImageIndex) error {
-	return remote.WriteIndex(ri.RemoteRef, index, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	return remote.WriteIndex(ri.RemoteRef, index, remoteOptions()...)
 }
 
 func (ri RemoteImage) ReadImage() (regpkg.Image, error) {
-	desc, err := remote.Get(ri.RemoteRef, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	desc, err := remote.Get(ri.RemoteRef, remoteOptions()...)
 	if err != nil {
 		return nil, err
 	}
@@ -65,7 +88,27 @@ func (ri RemoteImage) ReadImage() (regpkg.Image, error) {
 }
 
 func (ri RemoteImage) WriteImage(image regpkg.Image) error {
-	return remote.Write(ri.RemoteRef, image, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	return remote.Write(ri.RemoteRef, image, remoteOptions()...)
+}
+
+// LayerExists returns true if the repository of the reference has the blob.
+func (ri RemoteImage) LayerExists(h regpkg.Hash) (bool, error) {
+	l, err := remote.Layer(ri.RemoteRef.Context().Digest(h.String()), remoteOptions()...)
+	if err != nil {
+		return false, err
+	}
+	if _, err := l.Size(); err != nil {
+		if terr, ok := err.(*transport.Error); ok && terr.StatusCode == http.StatusNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// WriteLayer pushes a layer blob to the repository of the reference.
+func (ri RemoteImage) WriteLayer(layer regpkg.Layer) error {
+	return remote.WriteLayer(ri.RemoteRef.Context(), layer, remoteOptions()...)
 }
 
 // LocalImage is a helper for reading/writing images stored in the OCI Image Layout directory.
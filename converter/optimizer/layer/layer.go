@@ -104,3 +104,65 @@ func (l StaticCompressedLayer) Compressed() (io.ReadCloser, error) {
 func (l StaticCompressedLayer) Uncompressed() (io.ReadCloser, error) {
 	return nil, errors.New("unsupported")
 }
+
+// NewPushedLayer returns a layer which has the same descriptor as l but no
+// contents. This is used in place of a layer which has already been pushed to
+// the destination registry so that its contents needn't be kept until the
+// image is written. Writing the image skips the layer because the registry
+// already has the blob.
+func NewPushedLayer(l regpkg.Layer) (regpkg.Layer, error) {
+	dgst, err := l.Digest()
+	if err != nil {
+		return nil, err
+	}
+	diffID, err := l.DiffID()
+	if err != nil {
+		return nil, err
+	}
+	size, err := l.Size()
+	if err != nil {
+		return nil, err
+	}
+	mediaType, err := l.MediaType()
+	if err != nil {
+		return nil, err
+	}
+	return NewPushedLayerFromDescriptor(dgst, diffID, size, mediaType), nil
+}
+
+// NewPushedLayerFromDescriptor is the same as NewPushedLayer but the descriptor
+// is specified directly (e.g. when resuming an aborted conversion).
+func NewPushedLayerFromDescriptor(dgst, diffID regpkg.Hash, size int64, mediaType types.MediaType) regpkg.Layer {
+	return pushedLayer{hash: dgst, diff: diffID, size: size, mediaType: mediaType}
+}
+
+type pushedLayer struct {
+	hash      regpkg.Hash
+	diff      regpkg.Hash
+	size      int64
+	mediaType types.MediaType
+}
+
+func (l pushedLayer) Digest() (regpkg.Hash, error) {
+	return l.hash, nil
+}
+
+func (l pushedLayer) Size() (int64, error) {
+	return l.size, nil
+}
+
+func (l pushedLayer) DiffID() (regpkg.Hash, error) {
+	return l.diff, nil
+}
+
+func (l pushedLayer) MediaType() (types.MediaType, error) {
+	return l.mediaType, nil
+}
+
+func (l pushedLayer) Compressed() (io.ReadCloser, error) {
+	return nil, errors.Errorf("contents of layer %v have already been pushed", l.hash)
+}
+
+func (l pushedLayer) Uncompressed() (io.ReadCloser, error) {
+	return nil, errors.Errorf("contents of layer %v have already been pushed", l.hash)
+}
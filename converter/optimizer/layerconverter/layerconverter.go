@@ -40,12 +40,12 @@ import (
 
 type LayerConverter = func() (mutate.Addendum, error)
 
-func FromTar(ctx context.Context, sr *io.SectionReader, mon logger.Monitor, tf *tempfiles.TempFiles) LayerConverter {
+func FromTar(ctx context.Context, sr *io.SectionReader, mon logger.Monitor, tf *tempfiles.TempFiles, opts ...estargz.Option) LayerConverter {
 	return func() (mutate.Addendum, error) {
 		log.G(ctx).Debugf("converting...")
 		defer log.G(ctx).Infof("converted")
 
-		rc, err := estargz.Build(sr, estargz.WithPrioritizedFiles(mon.DumpLog()))
+		rc, err := estargz.Build(sr, append([]estargz.Option{estargz.WithPrioritizedFiles(mon.DumpLog())}, opts...)...)
 		if err != nil {
 			return mutate.Addendum{}, err
 		}
@@ -0,0 +1,84 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package logger
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// NewFilteredMonitor returns a Monitor which drops accesses to the files not
+// matching the include patterns (if any) or matching the exclude patterns from
+// the log of m. Patterns follow path.Match and are matched against the paths
+// relative to the root of the layer (e.g. "var/log/*"). A pattern matching a
+// directory matches all of its descendants as well.
+func NewFilteredMonitor(m Monitor, include, exclude []string) (Monitor, error) {
+	for _, p := range append(append([]string{}, include...), exclude...) {
+		if _, err := path.Match(cleanPattern(p), ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", p, err)
+		}
+	}
+	return &filteredMonitor{Monitor: m, include: include, exclude: exclude}, nil
+}
+
+type filteredMonitor struct {
+	Monitor
+	include []string
+	exclude []string
+}
+
+func (m *filteredMonitor) DumpLog() (res []string) {
+	for _, name := range m.Monitor.DumpLog() {
+		if (len(m.include) == 0 || matchPath(m.include, name)) && !matchPath(m.exclude, name) {
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+// DumpAccesses filters the accesses of m in the same way as DumpLog. This
+// returns nil if m doesn't record accesses.
+func (m *filteredMonitor) DumpAccesses() (res []Access) {
+	al, ok := m.Monitor.(AccessLogger)
+	if !ok {
+		return nil
+	}
+	for _, a := range al.DumpAccesses() {
+		if (len(m.include) == 0 || matchPath(m.include, a.Path)) && !matchPath(m.exclude, a.Path) {
+			res = append(res, a)
+		}
+	}
+	return res
+}
+
+// matchPath returns true if the path or any of its ancestors matches one of
+// the patterns.
+func matchPath(patterns []string, name string) bool {
+	for name = cleanPattern(name); name != "" && name != "."; name = path.Dir(name) {
+		for _, p := range patterns {
+			if ok, _ := path.Match(cleanPattern(p), name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func cleanPattern(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
@@ -55,10 +55,7 @@ func Mount(mountPoint string, tarfile io.ReaderAt, monitor Monitor) (func() erro
 	if err := root.InitNodes(); err != nil {
 		return nil, errors.Wrap(err, "failed to init nodes")
 	}
-	server, err := fuse.NewServer(rawFS, mountPoint, &fuse.MountOptions{
-		AllowOther: true,             // allow users other than root&mounter to access fs
-		Options:    []string{"suid"}, // allow setuid inside container
-	})
+	server, err := fuse.NewServer(rawFS, mountPoint, mountOptions())
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to prepare filesystem server")
 	}
@@ -286,7 +283,10 @@ func (n *node) InitNodes() error {
 				if pn.xattr == nil {
 					pn.xattr = make(map[string][]byte)
 				}
+				// Both of trusted and user (for "userxattr" overlayfs in the
+				// rootless mode) xattrs are set.
 				pn.xattr["trusted.overlay.opaque"] = []byte("y")
+				pn.xattr["user.overlay.opaque"] = []byte("y")
 			} else {
 				// This node is a whiteout, so we don't want to show it.
 				// We record it now and then hide the target node later.
@@ -377,13 +377,12 @@ var _ = (fusefs.NodeGetattrer)((*whiteout)(nil))
 func (w *whiteout) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
 	out.Ino = 0 // TODO
 	out.Size = 0
-	out.Blksize = uint32(DefaultBlockSize)
+	setBlksize(&out.Attr, DefaultBlockSize)
 	out.Blocks = 0
 	out.Mode = syscall.S_IFCHR
 	out.Owner = fuse.Owner{Uid: 0, Gid: 0}
 	out.Rdev = uint32(unix.Mkdev(0, 0))
 	out.Nlink = 1
-	out.Padding = 0 // TODO
 	return 0
 }
 
@@ -397,31 +396,64 @@ type Monitor interface {
 	DumpLog() []string
 }
 
+// Access is an access to a file recorded by a monitor.
+type Access struct {
+	Path  string
+	Time  time.Time
+	Phase int // 0 if phases aren't tracked
+}
+
+// AccessLogger is implemented by monitors recording the time and the phase of
+// each access in addition to the log of DumpLog.
+type AccessLogger interface {
+	DumpAccesses() []Access
+}
+
 func NewOpenReadMonitor() Monitor {
 	return &OpenReadMonitor{}
 }
 
+// NewPhasedOpenReadMonitor returns an OpenReadMonitor recording the phase of
+// the workload in which each access happens.
+func NewPhasedOpenReadMonitor(phases *Phases) Monitor {
+	return &OpenReadMonitor{phases: phases}
+}
+
 type OpenReadMonitor struct {
-	log   []string
-	logMu sync.Mutex
+	log    []Access
+	logMu  sync.Mutex
+	phases *Phases
 }
 
 func (m *OpenReadMonitor) OnOpen(name string) {
-	m.logMu.Lock()
-	m.log = append(m.log, name)
-	m.logMu.Unlock()
+	m.record(name)
 }
 
 func (m *OpenReadMonitor) OnRead(name string, off, size int64) {
+	m.record(name)
+}
+
+func (m *OpenReadMonitor) record(name string) {
+	a := Access{Path: name, Time: time.Now(), Phase: m.phases.Current()}
 	m.logMu.Lock()
-	m.log = append(m.log, name)
+	m.log = append(m.log, a)
 	m.logMu.Unlock()
 }
 
 func (m *OpenReadMonitor) DumpLog() []string {
 	m.logMu.Lock()
 	defer m.logMu.Unlock()
-	return m.log
+	names := make([]string, len(m.log))
+	for i, a := range m.log {
+		names[i] = a.Path
+	}
+	return names
+}
+
+func (m *OpenReadMonitor) DumpAccesses() []Access {
+	m.logMu.Lock()
+	defer m.logMu.Unlock()
+	return append([]Access(nil), m.log...)
 }
 
 func (m *OpenReadMonitor) OnLookup(name string)             {}
@@ -454,14 +486,13 @@ func headerToAttr(h *tar.Header) (fuse.Attr, fusefs.StableAttr) {
 	out.Mtimensec = uint32(h.ModTime.UnixNano())
 	out.Ctimensec = uint32(h.ChangeTime.UnixNano())
 	out.Mode = fileModeToSystemMode(h.FileInfo().Mode())
-	out.Blksize = uint32(DefaultBlockSize)
+	setBlksize(&out, DefaultBlockSize)
 	out.Owner = fuse.Owner{Uid: uint32(h.Uid), Gid: uint32(h.Gid)}
 	out.Rdev = uint32(unix.Mkdev(uint32(h.Devmajor), uint32(h.Devminor)))
 
 	// ad-hoc
 	out.Ino = 0
 	out.Nlink = 1
-	out.Padding = 0
 
 	return out, fusefs.StableAttr{
 		Mode: out.Mode,
@@ -484,8 +515,7 @@ func copyAttr(dest *fuse.Attr, src fuse.Attr) {
 	dest.Nlink = src.Nlink
 	dest.Owner = src.Owner
 	dest.Rdev = src.Rdev
-	dest.Blksize = src.Blksize
-	dest.Padding = src.Padding
+	copyPlatformAttr(dest, src)
 }
 
 func fileModeToSystemMode(m os.FileMode) uint32 {
@@ -0,0 +1,41 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package logger
+
+import (
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// mountOptions returns the options of macFUSE. This is for inspecting images
+// on the developer's machine so the filesystem is visible only to the mounter.
+// "noappledouble" prevents Finder from looking up "._*" files, which would
+// pollute the access log.
+func mountOptions() *fuse.MountOptions {
+	return &fuse.MountOptions{
+		Name:    "stargz",
+		Options: []string{"ro", "noappledouble"},
+	}
+}
+
+// macFUSE doesn't report the block size of files.
+func setBlksize(out *fuse.Attr, size uint32) {}
+
+func copyPlatformAttr(dest *fuse.Attr, src fuse.Attr) {
+	dest.Flags_ = src.Flags_
+	dest.Crtime_ = src.Crtime_
+	dest.Crtimensec_ = src.Crtimensec_
+}
@@ -0,0 +1,38 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package logger
+
+import (
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func mountOptions() *fuse.MountOptions {
+	return &fuse.MountOptions{
+		AllowOther: true,             // allow users other than root&mounter to access fs
+		Options:    []string{"suid"}, // allow setuid inside container
+	}
+}
+
+func setBlksize(out *fuse.Attr, size uint32) {
+	out.Blksize = size
+	out.Padding = 0
+}
+
+func copyPlatformAttr(dest *fuse.Attr, src fuse.Attr) {
+	dest.Blksize = src.Blksize
+	dest.Padding = src.Padding
+}
@@ -86,6 +86,7 @@ func TestExistence(t *testing.T) {
 			},
 			want: []check{
 				hasNodeXattrs("foo/", opaqueXattr, opaqueXattrValue),
+				hasNodeXattrs("foo/", "user.overlay.opaque", opaqueXattrValue),
 				fileNotExist("foo/.wh..wh..opq"),
 			},
 		},
@@ -533,3 +534,87 @@ func readFile(filename string, b []byte) accessFunc {
 		return nil
 	}
 }
+
+func TestFilteredMonitor(t *testing.T) {
+	accessed := []string{"bin/sh", "usr/lib/libc.so", "var/log/app.log", "var/cache/apt/pkg.bin", "etc/hosts"}
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		want    []string
+	}{
+		{
+			name: "none",
+			want: accessed,
+		},
+		{
+			name:    "exclude",
+			exclude: []string{"var/log/*", "/var/cache"},
+			want:    []string{"bin/sh", "usr/lib/libc.so", "etc/hosts"},
+		},
+		{
+			name:    "include",
+			include: []string{"usr", "bin/*"},
+			want:    []string{"bin/sh", "usr/lib/libc.so"},
+		},
+		{
+			name:    "include and exclude",
+			include: []string{"usr", "var"},
+			exclude: []string{"var/cache"},
+			want:    []string{"usr/lib/libc.so", "var/log/app.log"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mon, err := NewFilteredMonitor(NewOpenReadMonitor(), tt.include, tt.exclude)
+			if err != nil {
+				t.Fatalf("failed to create monitor: %v", err)
+			}
+			for _, name := range accessed {
+				mon.OnOpen(name)
+			}
+			if got, want := strings.Join(mon.DumpLog(), ","), strings.Join(tt.want, ","); got != want {
+				t.Errorf("log = %q; want %q", got, want)
+			}
+		})
+	}
+	if _, err := NewFilteredMonitor(NewOpenReadMonitor(), nil, []string{"["}); err == nil {
+		t.Errorf("invalid pattern must be rejected")
+	}
+}
+
+func TestPhasedMonitor(t *testing.T) {
+	phases := NewPhases()
+	mon, err := NewFilteredMonitor(NewPhasedOpenReadMonitor(phases), nil, []string{"var/log"})
+	if err != nil {
+		t.Fatalf("failed to create monitor: %v", err)
+	}
+	mon.OnOpen("bin/app")
+	mon.OnRead("var/log/app.log", 0, 10)
+	if got := phases.Next(); got != 2 {
+		t.Fatalf("next phase = %d; want 2", got)
+	}
+	mon.OnRead("usr/lib/plugin.so", 0, 10)
+	mon.OnRead("bin/app", 10, 10)
+
+	accesses := mon.(AccessLogger).DumpAccesses()
+	want := []Access{{Path: "bin/app", Phase: 1}, {Path: "usr/lib/plugin.so", Phase: 2}, {Path: "bin/app", Phase: 2}}
+	if len(accesses) != len(want) {
+		t.Fatalf("accesses = %+v; want %+v", accesses, want)
+	}
+	for i, a := range accesses {
+		if a.Path != want[i].Path || a.Phase != want[i].Phase || a.Time.IsZero() {
+			t.Errorf("access %d = %+v; want %+v", i, a, want[i])
+		}
+		if i > 0 && a.Time.Before(accesses[i-1].Time) {
+			t.Errorf("access %d is recorded before the previous one", i)
+		}
+	}
+
+	// Phases aren't tracked by default.
+	plain := NewOpenReadMonitor()
+	plain.OnOpen("bin/app")
+	if a := plain.(AccessLogger).DumpAccesses(); len(a) != 1 || a[0].Phase != 0 {
+		t.Errorf("accesses = %+v; want phase 0", a)
+	}
+}
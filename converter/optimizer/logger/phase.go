@@ -0,0 +1,44 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package logger
+
+import "sync/atomic"
+
+// Phases tracks the phase of the workload (e.g. phase 1 until the application
+// becomes ready and phase 2 after that). Phases start from 1. A nil Phases is
+// always in phase 0, which means phases aren't tracked.
+type Phases struct {
+	cur int32
+}
+
+// NewPhases returns Phases starting from phase 1.
+func NewPhases() *Phases {
+	return &Phases{cur: 1}
+}
+
+// Current returns the current phase.
+func (p *Phases) Current() int {
+	if p == nil {
+		return 0
+	}
+	return int(atomic.LoadInt32(&p.cur))
+}
+
+// Next moves to the next phase and returns it.
+func (p *Phases) Next() int {
+	return int(atomic.AddInt32(&p.cur, 1))
+}
@@ -54,35 +54,155 @@ import (
 type Opts struct {
 	Reuse  bool
 	Period time.Duration
+
+	// Rootless mounts the rootfs of the workload for running in a user
+	// namespace, where overlayfs can't use trusted.* xattrs. The workload
+	// should be run with sampler.WithRootless as well.
+	Rootless bool
+
+	// EStargzOptions are passed to estargz.Build when layers are converted
+	// (e.g. the chunk size and the excluded paths).
+	EStargzOptions []estargz.Option
+
+	// Annotations are added to the manifests of the converted images.
+	Annotations map[string]string
+
+	// PrefetchInclude and PrefetchExclude are patterns of files accessed by
+	// the workload. If PrefetchInclude is specified, only the files matching
+	// it are prefetched. Files matching PrefetchExclude are never prefetched
+	// (e.g. logs and package caches written during the workload). See
+	// logger.NewFilteredMonitor for the syntax.
+	PrefetchInclude []string
+	PrefetchExclude []string
+
+	// PhaseMarkers are HTTP(S) URLs marking the phases of the workload (see
+	// sampler.WithPhaseMarkers). Phase 1 lasts until the first marker becomes
+	// ready, phase 2 until the second one and so on. The phase and the time
+	// of each access are recorded so files of earlier phases are placed
+	// earlier when the record is used for conversion.
+	PhaseMarkers []string
 }
 
 func Optimize(ctx gocontext.Context, opts *Opts, srcImg regpkg.Image, tf *tempfiles.TempFiles, rec *recorder.Recorder, samplerOpts ...sampler.Option) ([]mutate.Addendum, error) {
+	adds, err := OptimizeGroup(ctx, opts, []Workload{{Image: srcImg, SamplerOpts: samplerOpts}}, tf, rec)
+	if err != nil {
+		return nil, err
+	}
+	return adds[0], nil
+}
+
+// Workload is an image optimized by OptimizeGroup and the options of its
+// container.
+type Workload struct {
+	Image       regpkg.Image
+	SamplerOpts []sampler.Option
+
+	// Annotations are added to the manifest of the converted image instead
+	// of Opts.Annotations if specified.
+	Annotations map[string]string
+}
+
+// OptimizeGroup optimizes the images against the workload running all of them
+// at the same time. The first image is the main container and the others are
+// its sidecars sharing its network namespace (see sampler.RunGroup), so
+// images whose startups depend on each other (e.g. an application and its
+// proxy) are profiled together. This returns the converted layers of each
+// image.
+func OptimizeGroup(ctx gocontext.Context, opts *Opts, workloads []Workload, tf *tempfiles.TempFiles, rec *recorder.Recorder) ([][]mutate.Addendum, error) {
+	// Setup temporary workspace
+	tmpRoot, err := ioutil.TempDir("", "optimize-work")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpRoot)
+	log.G(ctx).Debugf("workspace directory: %q", tmpRoot)
+
+	var (
+		prepared  = make([]*preparedImage, len(workloads))
+		runs      = make([]sampler.Workload, len(workloads))
+		unmounted []func()
+		phases    = logger.NewPhases()
+	)
+	defer func() {
+		for i := len(unmounted) - 1; i >= 0; i-- {
+			unmounted[i]()
+		}
+	}()
+	for i, w := range workloads {
+		ctx := ctx
+		if len(workloads) > 1 {
+			ctx = log.WithLogger(ctx, log.G(ctx).WithField("workload", i))
+		}
+		p, unmount, err := prepareImage(ctx, opts, w.Image, tmpRoot, tf, phases)
+		unmounted = append(unmounted, unmount)
+		if err != nil {
+			return nil, err
+		}
+		prepared[i] = p
+		runs[i] = sampler.Workload{Bundle: p.bundle, Config: p.config, Opts: w.SamplerOpts}
+	}
+	if len(opts.PhaseMarkers) > 0 {
+		runs[0].Opts = append(append([]sampler.Option{}, runs[0].Opts...),
+			sampler.WithPhaseMarkers(opts.PhaseMarkers, func() { phases.Next() }))
+	}
+
+	// run the workload with timeout
+	runCtx, cancel := gocontext.WithTimeout(ctx, opts.Period)
+	defer cancel()
+	if err = sampler.RunGroup(runCtx, runs); err != nil {
+		return nil, errors.Wrap(err, "failed to run the sampler")
+	}
+
+	adds := make([][]mutate.Addendum, len(prepared))
+	for i, p := range prepared {
+		if adds[i], err = p.convert(rec); err != nil {
+			return nil, err
+		}
+	}
+	return adds, nil
+}
+
+// preparedImage is an image whose layers are mounted with the loggers as the
+// rootfs of the bundle.
+type preparedImage struct {
+	srcImg       regpkg.Image
+	bundle       string
+	config       spec.Image
+	convertLayer []func() (mutate.Addendum, error)
+	monitors     []logger.Monitor
+}
+
+// prepareImage mounts the layers of the image with the loggers and the rootfs
+// of the bundle on the temporary directories under tmpRoot. Accesses are
+// recorded with the phases. The returned function unmounts them, even on
+// error.
+func prepareImage(ctx gocontext.Context, opts *Opts, srcImg regpkg.Image, tmpRoot string, tf *tempfiles.TempFiles, phases *logger.Phases) (_ *preparedImage, unmount func(), _ error) {
+	var mounts []string
+	unmount = func() {
+		for i := len(mounts) - 1; i >= 0; i-- {
+			syscall.Unmount(mounts[i], syscall.MNT_FORCE)
+		}
+	}
+
 	// Get image's basic information
 	manifest, err := srcImg.Manifest()
 	if err != nil {
-		return nil, err
+		return nil, unmount, err
 	}
 	configData, err := srcImg.RawConfigFile()
 	if err != nil {
-		return nil, err
+		return nil, unmount, err
 	}
 	var config spec.Image
 	if err := json.Unmarshal(configData, &config); err != nil {
-		return nil, errors.Wrap(err, "failed to parse image config file")
+		return nil, unmount, errors.Wrap(err, "failed to parse image config file")
 	}
 	// The order is base layer first, top layer last.
 	in, err := srcImg.Layers()
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to get image layers")
+		return nil, unmount, errors.Wrap(err, "failed to get image layers")
 	}
 
-	// Setup temporary workspace
-	tmpRoot, err := ioutil.TempDir("", "optimize-work")
-	if err != nil {
-		return nil, err
-	}
-	defer os.RemoveAll(tmpRoot)
-	log.G(ctx).Debugf("workspace directory: %q", tmpRoot)
 	mktemp := func(name string) (path string, err error) {
 		if path, err = ioutil.TempDir(tmpRoot, "optimize-"+name+"-"); err != nil {
 			return "", err
@@ -104,14 +224,14 @@ func Optimize(ctx gocontext.Context, opts *Opts, srcImg regpkg.Image, tf *tempfi
 		i := i
 		dgst, err := in[i].Digest()
 		if err != nil {
-			return nil, err
+			return nil, unmount, err
 		}
 		ctx := log.WithLogger(ctx, log.G(ctx).WithField("digest", dgst))
 		mp, err := mktemp(fmt.Sprintf("lower%d", i))
 		if err != nil {
-			return nil, err
+			return nil, unmount, err
 		}
-		defer syscall.Unmount(mp, syscall.MNT_FORCE)
+		mounts = append(mounts, mp)
 		lowerdirs = append([]string{mp}, lowerdirs...) // top layer first, base layer last (for overlayfs).
 		eg.Go(func() error {
 			// TODO: These files should be deduplicated.
@@ -138,7 +258,12 @@ func Optimize(ctx gocontext.Context, opts *Opts, srcImg regpkg.Image, tf *tempfi
 			if _, err := io.Copy(decompressedFile, zr); err != nil {
 				return err
 			}
-			mon := logger.NewOpenReadMonitor()
+			mon := logger.NewPhasedOpenReadMonitor(phases)
+			if len(opts.PrefetchInclude) > 0 || len(opts.PrefetchExclude) > 0 {
+				if mon, err = logger.NewFilteredMonitor(mon, opts.PrefetchInclude, opts.PrefetchExclude); err != nil {
+					return errors.Wrap(err, "invalid prefetch filter")
+				}
+			}
 			monitors[i] = mon
 			if _, err := logger.Mount(mp, decompressedFile, mon); err != nil {
 				return errors.Wrapf(err, "failed to mount on %q", mp)
@@ -165,13 +290,13 @@ func Optimize(ctx gocontext.Context, opts *Opts, srcImg regpkg.Image, tf *tempfi
 				return err
 			}
 			convertLayer[i] = layerconverter.Compose(
-				append(cvts, layerconverter.FromTar(ctx, decompressedLayer, mon, tf))...)
+				append(cvts, layerconverter.FromTar(ctx, decompressedLayer, mon, tf, opts.EStargzOptions...))...)
 			log.G(ctx).Infof("unpacked")
 			return nil
 		})
 	}
 	if err := eg.Wait(); err != nil {
-		return nil, err
+		return nil, unmount, err
 	}
 
 	// prepare FileSystem Bundle
@@ -181,40 +306,48 @@ func Optimize(ctx gocontext.Context, opts *Opts, srcImg regpkg.Image, tf *tempfi
 		workdir  string
 	)
 	if bundle, err = mktemp("bundle"); err != nil {
-		return nil, err
+		return nil, unmount, err
 	}
 	if upperdir, err = mktemp("upperdir"); err != nil {
-		return nil, err
+		return nil, unmount, err
 	}
 	if workdir, err = mktemp("workdir"); err != nil {
-		return nil, err
+		return nil, unmount, err
 	}
 	var (
 		rootfs = sampler.GetRootfsPathUnder(bundle)
 		option = fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s",
 			strings.Join(lowerdirs, ":"), upperdir, workdir)
 	)
+	if opts.Rootless {
+		option += ",userxattr"
+	}
 	if err = os.Mkdir(rootfs, 0777); err != nil {
-		return nil, err
+		return nil, unmount, err
 	}
 	if err = syscall.Mount("overlay", rootfs, "overlay", 0, option); err != nil {
-		return nil, errors.Wrapf(err, "mount overlayfs on %q with data %q", rootfs, option)
+		return nil, unmount, errors.Wrapf(err, "mount overlayfs on %q with data %q", rootfs, option)
 	}
-	defer syscall.Unmount(rootfs, syscall.MNT_FORCE)
+	mounts = append(mounts, rootfs)
 
-	// run the workload with timeout
-	runCtx, cancel := gocontext.WithTimeout(ctx, opts.Period)
-	defer cancel()
-	if err = sampler.Run(runCtx, bundle, config, samplerOpts...); err != nil {
-		return nil, errors.Wrap(err, "failed to run the sampler")
-	}
+	return &preparedImage{
+		srcImg:       srcImg,
+		bundle:       bundle,
+		config:       config,
+		convertLayer: convertLayer,
+		monitors:     monitors,
+	}, unmount, nil
+}
 
-	// get converted layers
+// convert returns the converted layers of the image after the workload, and
+// records the files accessed by the workload.
+func (p *preparedImage) convert(rec *recorder.Recorder) ([]mutate.Addendum, error) {
 	var (
-		adds   = make([]mutate.Addendum, len(convertLayer))
+		eg     errgroup.Group
+		adds   = make([]mutate.Addendum, len(p.convertLayer))
 		addsMu sync.Mutex
 	)
-	for i, f := range convertLayer {
+	for i, f := range p.convertLayer {
 		i, f := i, f
 		eg.Go(func() error {
 			addendum, err := f()
@@ -233,18 +366,35 @@ func Optimize(ctx gocontext.Context, opts *Opts, srcImg regpkg.Image, tf *tempfi
 	}
 
 	if rec != nil {
-		manifestDigest, err := srcImg.Digest()
+		manifestDigest, err := p.srcImg.Digest()
 		if err != nil {
 			return nil, err
 		}
 		manifestDigestStr := manifestDigest.String()
-		for i, mon := range monitors {
+		for i, mon := range p.monitors {
 			i := i
-			for _, f := range mon.DumpLog() {
+			al, ok := mon.(logger.AccessLogger)
+			if !ok {
+				for _, f := range mon.DumpLog() {
+					e := &recorder.Entry{
+						Path:           f,
+						ManifestDigest: manifestDigestStr,
+						LayerIndex:     &i,
+					}
+					if err := rec.Record(e); err != nil {
+						return nil, err
+					}
+				}
+				continue
+			}
+			for _, a := range al.DumpAccesses() {
+				t := a.Time
 				e := &recorder.Entry{
-					Path:           f,
+					Path:           a.Path,
 					ManifestDigest: manifestDigestStr,
 					LayerIndex:     &i,
+					Time:           &t,
+					Phase:          a.Phase,
 				}
 				if err := rec.Record(e); err != nil {
 					return nil, err
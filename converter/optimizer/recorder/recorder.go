@@ -21,12 +21,19 @@ import (
 	"encoding/json"
 	"io"
 	"sync"
+	"time"
 )
 
 type Entry struct {
 	Path           string `json:"path"`
 	ManifestDigest string `json:"manifestDigest,omitempty"`
 	LayerIndex     *int   `json:"layerIndex,omitempty"`
+
+	// Time and Phase are the time of the access and the phase of the
+	// workload in which it happened (starting from 1). They are empty if
+	// the recorder doesn't track them.
+	Time  *time.Time `json:"time,omitempty"`
+	Phase int        `json:"phase,omitempty"`
 }
 
 func New(w io.Writer) *Recorder {
@@ -46,3 +53,18 @@ func (ll *Recorder) Record(e *Entry) error {
 	defer ll.mu.Unlock()
 	return ll.enc.Encode(e)
 }
+
+// ReadAll reads all entries recorded in r.
+func ReadAll(r io.Reader) ([]*Entry, error) {
+	var entries []*Entry
+	dec := json.NewDecoder(r)
+	for {
+		var e Entry
+		if err := dec.Decode(&e); err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+		entries = append(entries, &e)
+	}
+}
@@ -0,0 +1,194 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package report generates a report recommending how to reorder steps of the
+// Dockerfile of an image based on the files accessed by the workload during
+// optimization.
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/containerd/stargz-snapshotter/converter/optimizer/recorder"
+	regpkg "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+)
+
+// maxHotFiles is the max number of hot files listed per layer.
+const maxHotFiles = 10
+
+// Layer is a layer of the image and the step of the Dockerfile which created it.
+type Layer struct {
+	Index     int    `json:"index"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+	CreatedBy string `json:"createdBy,omitempty"`
+
+	// AccessedFiles is the number of files of this layer accessed by the
+	// workload. HotFiles are the first accessed ones.
+	AccessedFiles int      `json:"accessedFiles"`
+	HotFiles      []string `json:"hotFiles,omitempty"`
+}
+
+// Report is the recommendation for an image.
+type Report struct {
+	ManifestDigest string `json:"manifestDigest"`
+
+	// Layers are ordered from the lowest to the uppermost.
+	Layers []Layer `json:"layers"`
+
+	// RecommendedOrder is the indexes of layers in the recommended order
+	// from the lowest. Layers without accessed files come first and layers
+	// with hot files come last, each keeping its original relative order.
+	RecommendedOrder []int `json:"recommendedOrder"`
+
+	// Suggestions are human-readable suggestions for the Dockerfile.
+	Suggestions []string `json:"suggestions"`
+}
+
+// New generates the report of the source image from the recorded entries.
+// Entries of other images are ignored.
+func New(img regpkg.Image, entries []*recorder.Entry) (*Report, error) {
+	dgst, err := img.Digest()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get digest of image")
+	}
+	config, err := img.ConfigFile()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get config of image")
+	}
+	ls, err := img.Layers()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get layers of image")
+	}
+	var layers []Layer
+	for i, l := range ls {
+		d, err := l.Digest()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get digest of layer %d", i)
+		}
+		size, err := l.Size()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get size of layer %d", i)
+		}
+		layers = append(layers, Layer{Index: i, Digest: d.String(), Size: size})
+	}
+	return newReport(dgst.String(), layers, config.History, entries), nil
+}
+
+func newReport(manifestDigest string, layers []Layer, history []regpkg.History, entries []*recorder.Entry) *Report {
+	r := &Report{ManifestDigest: manifestDigest, Layers: layers}
+
+	// Each history entry which isn't marked as empty corresponds to a layer.
+	var steps []string
+	for _, h := range history {
+		if !h.EmptyLayer {
+			steps = append(steps, h.CreatedBy)
+		}
+	}
+	if len(steps) == len(r.Layers) {
+		for i := range r.Layers {
+			r.Layers[i].CreatedBy = steps[i]
+		}
+	}
+	for _, e := range entries {
+		if e.ManifestDigest != manifestDigest || e.LayerIndex == nil ||
+			*e.LayerIndex < 0 || *e.LayerIndex >= len(r.Layers) {
+			continue
+		}
+		l := &r.Layers[*e.LayerIndex]
+		l.AccessedFiles++
+		if len(l.HotFiles) < maxHotFiles {
+			l.HotFiles = append(l.HotFiles, e.Path)
+		}
+	}
+
+	var hot, cold []int
+	for i, l := range r.Layers {
+		if l.AccessedFiles > 0 {
+			hot = append(hot, i)
+		} else {
+			cold = append(cold, i)
+		}
+	}
+	r.RecommendedOrder = append(append([]int{}, cold...), hot...)
+	r.Suggestions = []string{}
+	if len(hot) == 0 {
+		return r
+	}
+	for _, i := range cold {
+		if i > hot[0] {
+			r.Suggestions = append(r.Suggestions, fmt.Sprintf(
+				"Move step %s (layer %d, %d bytes, no files accessed) before step %s (layer %d) so that hot files are in upper layers.",
+				r.Layers[i].step(), i, r.Layers[i].Size, r.Layers[hot[0]].step(), hot[0]))
+		}
+	}
+	if len(hot) > 1 {
+		r.Suggestions = append(r.Suggestions, fmt.Sprintf(
+			"Accessed files are spread across %d layers; consider copying them in as few steps as possible at the end of the Dockerfile.",
+			len(hot)))
+	}
+	return r
+}
+
+func (l Layer) step() string {
+	if l.CreatedBy == "" {
+		return "(unknown)"
+	}
+	return "`" + strings.TrimPrefix(l.CreatedBy, "/bin/sh -c ") + "`"
+}
+
+// WriteJSON writes the reports as JSON.
+func WriteJSON(w io.Writer, reports []*Report) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(reports)
+}
+
+// WriteMarkdown writes the reports as Markdown.
+func WriteMarkdown(w io.Writer, reports []*Report) error {
+	var b strings.Builder
+	b.WriteString("# Dockerfile step order recommendation\n\n")
+	b.WriteString("Layers of the base image can't be reordered and steps depending on earlier steps (e.g. `RUN` using copied files) must keep their order.\n")
+	for _, r := range reports {
+		fmt.Fprintf(&b, "\n## %s\n\n", r.ManifestDigest)
+		b.WriteString("|layer|step|size|accessed files|\n---|---|---|---\n")
+		for _, l := range r.Layers {
+			fmt.Fprintf(&b, "%d|%s|%d|%d\n", l.Index, strings.ReplaceAll(l.step(), "|", "\\|"), l.Size, l.AccessedFiles)
+		}
+		b.WriteString("\n### Suggestions\n\n")
+		if len(r.Suggestions) == 0 {
+			b.WriteString("No reordering is needed.\n")
+		}
+		for _, s := range r.Suggestions {
+			fmt.Fprintf(&b, "- %s\n", s)
+		}
+		for _, l := range r.Layers {
+			if len(l.HotFiles) == 0 {
+				continue
+			}
+			fmt.Fprintf(&b, "\n### Hot files of layer %d\n\n", l.Index)
+			for _, f := range l.HotFiles {
+				fmt.Fprintf(&b, "- `%s`\n", f)
+			}
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,69 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package report
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/converter/optimizer/recorder"
+	regpkg "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// TestReport tests layers with hot files are recommended to be upper.
+func TestReport(t *testing.T) {
+	history := []regpkg.History{
+		{CreatedBy: "/bin/sh -c #(nop) ADD file:abc in /"},
+		{CreatedBy: "/bin/sh -c #(nop) ENV A=B", EmptyLayer: true},
+		{CreatedBy: "/bin/sh -c #(nop) COPY dir:app in /app"},
+		{CreatedBy: "/bin/sh -c #(nop) COPY dir:assets in /assets"},
+	}
+	layers := []Layer{{Index: 0, Size: 100}, {Index: 1, Size: 10}, {Index: 2, Size: 1000}}
+	idx := func(i int) *int { return &i }
+	var entries []*recorder.Entry
+	for _, e := range []struct {
+		path  string
+		layer int
+	}{
+		{"/bin/sh", 0},
+		{"/app/main", 1},
+		{"/app/lib", 1},
+	} {
+		entries = append(entries, &recorder.Entry{Path: e.path, ManifestDigest: "sha256:a", LayerIndex: idx(e.layer)})
+	}
+	entries = append(entries, &recorder.Entry{Path: "/assets/x", ManifestDigest: "sha256:b", LayerIndex: idx(2)})
+
+	r := newReport("sha256:a", layers, history, entries)
+	if r.Layers[1].CreatedBy != history[2].CreatedBy || r.Layers[1].AccessedFiles != 2 || r.Layers[2].AccessedFiles != 0 {
+		t.Errorf("unexpected layers %+v", r.Layers)
+	}
+	if len(r.RecommendedOrder) != 3 || r.RecommendedOrder[0] != 2 || r.RecommendedOrder[1] != 0 || r.RecommendedOrder[2] != 1 {
+		t.Errorf("unexpected order %v", r.RecommendedOrder)
+	}
+	if len(r.Suggestions) != 2 || !strings.Contains(r.Suggestions[0], "COPY dir:assets") {
+		t.Errorf("unexpected suggestions %v", r.Suggestions)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteMarkdown(&buf, []*Report{r}); err != nil {
+		t.Fatalf("failed to write markdown: %v", err)
+	}
+	if !strings.Contains(buf.String(), "- `/app/main`") {
+		t.Errorf("hot files aren't reported:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,149 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sampler
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/docker/docker/oci"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// nvidiaHooks are the names of the prestart hook of NVIDIA Container Toolkit,
+// which makes the GPUs and the driver libraries visible in the container.
+// "nvidia-container-toolkit" is the name used by newer releases.
+var nvidiaHooks = []string{"nvidia-container-runtime-hook", "nvidia-container-toolkit"}
+
+// parseDevice parses the device in the format of "--device" of docker
+// ("<host-path>[:<container-path>][:<permissions>]").
+func parseDevice(device string) (host, container, permissions string, _ error) {
+	permissions = "rwm"
+	parts := strings.Split(device, ":")
+	switch len(parts) {
+	case 3:
+		host, container, permissions = parts[0], parts[1], parts[2]
+	case 2:
+		host = parts[0]
+		if validDevicePermissions(parts[1]) {
+			permissions = parts[1]
+		} else {
+			container = parts[1]
+		}
+	case 1:
+		host = parts[0]
+	default:
+		return "", "", "", fmt.Errorf("invalid device %q", device)
+	}
+	if container == "" {
+		container = host
+	}
+	if !strings.HasPrefix(host, "/") || !strings.HasPrefix(container, "/") {
+		return "", "", "", fmt.Errorf("device paths must be absolute but %q", device)
+	}
+	if !validDevicePermissions(permissions) {
+		return "", "", "", fmt.Errorf("invalid permissions %q of device %q", permissions, device)
+	}
+	return host, container, permissions, nil
+}
+
+func validDevicePermissions(p string) bool {
+	if p == "" {
+		return false
+	}
+	for _, c := range p {
+		if c != 'r' && c != 'w' && c != 'm' {
+			return false
+		}
+	}
+	return true
+}
+
+// addDevices makes the devices (or the devices under the directories) on the
+// host available in the container.
+func addDevices(s *specs.Spec, devices []string) error {
+	for _, d := range devices {
+		host, container, permissions, err := parseDevice(d)
+		if err != nil {
+			return err
+		}
+		devs, rules, err := oci.DevicesFromPath(host, container, permissions)
+		if err != nil {
+			return err
+		}
+		s.Linux.Devices = append(s.Linux.Devices, devs...)
+		if s.Linux.Resources == nil {
+			s.Linux.Resources = &specs.LinuxResources{}
+		}
+		s.Linux.Resources.Devices = append(s.Linux.Resources.Devices, rules...)
+	}
+	return nil
+}
+
+// addNvidiaGPUs makes the GPUs visible in the container with the prestart hook
+// of NVIDIA Container Toolkit. gpus is "all" or comma-separated indexes or
+// UUIDs of the GPUs. If hook is empty, the hook is looked up from $PATH.
+func addNvidiaGPUs(s *specs.Spec, gpus, hook string) error {
+	if hook == "" {
+		for _, name := range nvidiaHooks {
+			if p, err := exec.LookPath(name); err == nil {
+				hook = p
+				break
+			}
+		}
+		if hook == "" {
+			return fmt.Errorf("NVIDIA Container Toolkit is needed for GPUs but none of %v is found", nvidiaHooks)
+		}
+	} else {
+		p, err := exec.LookPath(hook)
+		if err != nil {
+			return errors.Wrapf(err, "NVIDIA hook %q isn't available", hook)
+		}
+		hook = p
+	}
+
+	// The hook finds the GPUs and the driver capabilities from the
+	// environment variables of the container. The ones in the image config
+	// are kept (e.g. NVIDIA_DRIVER_CAPABILITIES of CUDA images) except the
+	// visible devices specified here.
+	env := []string{"NVIDIA_VISIBLE_DEVICES=" + gpus}
+	hasCapabilities := false
+	for _, e := range s.Process.Env {
+		if strings.HasPrefix(e, "NVIDIA_VISIBLE_DEVICES=") {
+			continue
+		}
+		if strings.HasPrefix(e, "NVIDIA_DRIVER_CAPABILITIES=") {
+			hasCapabilities = true
+		}
+		env = append(env, e)
+	}
+	if !hasCapabilities {
+		env = append(env, "NVIDIA_DRIVER_CAPABILITIES=compute,utility")
+	}
+	s.Process.Env = env
+
+	if s.Hooks == nil {
+		s.Hooks = &specs.Hooks{}
+	}
+	s.Hooks.Prestart = append(s.Hooks.Prestart, specs.Hook{
+		Path: hook,
+		Args: []string{hook, "prestart"},
+	})
+	return nil
+}
@@ -0,0 +1,120 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sampler
+
+import (
+	"os/exec"
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestParseDevice(t *testing.T) {
+	tests := []struct {
+		in                           string
+		host, container, permissions string
+		wantErr                      bool
+	}{
+		{in: "/dev/nvidia0", host: "/dev/nvidia0", container: "/dev/nvidia0", permissions: "rwm"},
+		{in: "/dev/nvidia0:r", host: "/dev/nvidia0", container: "/dev/nvidia0", permissions: "r"},
+		{in: "/dev/nvidia0:/dev/gpu0", host: "/dev/nvidia0", container: "/dev/gpu0", permissions: "rwm"},
+		{in: "/dev/nvidia0:/dev/gpu0:rw", host: "/dev/nvidia0", container: "/dev/gpu0", permissions: "rw"},
+		{in: "dev/nvidia0", wantErr: true},
+		{in: "/dev/nvidia0:/dev/gpu0:x", wantErr: true},
+		{in: "/dev/nvidia0:/dev/gpu0:rw:m", wantErr: true},
+	}
+	for _, tt := range tests {
+		host, container, permissions, err := parseDevice(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parsed invalid device %q", tt.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("failed to parse %q: %v", tt.in, err)
+			continue
+		}
+		if host != tt.host || container != tt.container || permissions != tt.permissions {
+			t.Errorf("%q: got (%q, %q, %q); want (%q, %q, %q)", tt.in,
+				host, container, permissions, tt.host, tt.container, tt.permissions)
+		}
+	}
+}
+
+func TestAddDevices(t *testing.T) {
+	var s specs.Spec
+	s.Linux = &specs.Linux{}
+	if err := addDevices(&s, []string{"/dev/null:/dev/mynull:r"}); err != nil {
+		t.Fatalf("failed to add device: %v", err)
+	}
+	if len(s.Linux.Devices) != 1 || s.Linux.Devices[0].Path != "/dev/mynull" || s.Linux.Devices[0].Type != "c" {
+		t.Errorf("unexpected devices %+v", s.Linux.Devices)
+	}
+	if r := s.Linux.Resources; r == nil || len(r.Devices) != 1 || !r.Devices[0].Allow || r.Devices[0].Access != "r" {
+		t.Errorf("unexpected device cgroup rules %+v", r)
+	}
+	if err := addDevices(&s, []string{"/dev/nonexistent"}); err == nil {
+		t.Errorf("added nonexistent device")
+	}
+}
+
+func TestAddNvidiaGPUs(t *testing.T) {
+	hook, err := exec.LookPath("true")
+	if err != nil {
+		t.Skipf("no command for the hook: %v", err)
+	}
+	s := specs.Spec{Process: &specs.Process{Env: []string{
+		"PATH=/usr/bin",
+		"NVIDIA_VISIBLE_DEVICES=void",
+		"NVIDIA_DRIVER_CAPABILITIES=compute,utility,video",
+	}}}
+	if err := addNvidiaGPUs(&s, "0,1", "true"); err != nil {
+		t.Fatalf("failed to add GPUs: %v", err)
+	}
+	want := []string{
+		"NVIDIA_VISIBLE_DEVICES=0,1",
+		"PATH=/usr/bin",
+		"NVIDIA_DRIVER_CAPABILITIES=compute,utility,video",
+	}
+	if len(s.Process.Env) != len(want) {
+		t.Fatalf("env = %v; want %v", s.Process.Env, want)
+	}
+	for i := range want {
+		if s.Process.Env[i] != want[i] {
+			t.Errorf("env = %v; want %v", s.Process.Env, want)
+			break
+		}
+	}
+	if s.Hooks == nil || len(s.Hooks.Prestart) != 1 || s.Hooks.Prestart[0].Path != hook ||
+		len(s.Hooks.Prestart[0].Args) != 2 || s.Hooks.Prestart[0].Args[1] != "prestart" {
+		t.Errorf("unexpected hooks %+v", s.Hooks)
+	}
+
+	// The default capabilities are added unless the image specifies them.
+	s = specs.Spec{Process: &specs.Process{}}
+	if err := addNvidiaGPUs(&s, "all", "true"); err != nil {
+		t.Fatalf("failed to add GPUs: %v", err)
+	}
+	if len(s.Process.Env) != 2 || s.Process.Env[1] != "NVIDIA_DRIVER_CAPABILITIES=compute,utility" {
+		t.Errorf("env = %v; want default capabilities", s.Process.Env)
+	}
+
+	if err := addNvidiaGPUs(&s, "all", "/nonexistent/hook"); err == nil {
+		t.Errorf("added nonexistent hook")
+	}
+}
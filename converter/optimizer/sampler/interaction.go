@@ -0,0 +1,255 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sampler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// defaultExpectTimeout is the time to wait for an "expect" step unless the
+// script specifies it with "timeout".
+const defaultExpectTimeout = 30 * time.Second
+
+// Interaction is a script replayed against the sample container. The script
+// is expect-style and has one command per line:
+//
+//   - "sleep <duration>" waits for the duration (e.g. "500ms").
+//   - "expect <text>" waits until the container writes the text to stdout or
+//     stderr (e.g. prompts of REPLs).
+//   - "timeout <duration>" sets the maximum time to wait for the following
+//     "expect" commands (default: 30s).
+//   - "send <text>" writes the text to stdin of the container.
+//   - "sendline <text>" writes the text followed by a newline.
+//   - "signal <signal>" sends the signal (e.g. "SIGINT", "INT" or "2").
+//   - "close" closes stdin of the container.
+//
+// Texts can be quoted as Go string literals to contain escape sequences (e.g.
+// "\x04" for Ctrl-D). Empty lines and lines starting with "#" are ignored.
+// Stdin of the container is closed at the end of the script.
+type Interaction struct {
+	steps []interactionStep
+}
+
+type interactionStep struct {
+	op      string
+	text    []byte
+	dur     time.Duration
+	signal  syscall.Signal
+	lineNum int
+}
+
+// ParseInteraction parses the interaction script.
+func ParseInteraction(r io.Reader) (*Interaction, error) {
+	var steps []interactionStep
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		op, arg := line, ""
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			op, arg = line[:i], strings.TrimLeft(line[i:], " \t")
+		}
+		s := interactionStep{op: op, lineNum: lineNum}
+		switch op {
+		case "sleep", "timeout":
+			d, err := time.ParseDuration(arg)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("line %d: invalid duration %q", lineNum, arg)
+			}
+			s.dur = d
+		case "expect", "send", "sendline":
+			text, err := unquoteText(arg)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNum, err)
+			}
+			if op == "sendline" {
+				text += "\n"
+			}
+			if op == "expect" && text == "" {
+				return nil, fmt.Errorf("line %d: expect needs a text", lineNum)
+			}
+			s.text = []byte(text)
+		case "signal":
+			sig, err := parseSignal(arg)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNum, err)
+			}
+			s.signal = sig
+		case "close":
+			if arg != "" {
+				return nil, fmt.Errorf("line %d: close takes no argument", lineNum)
+			}
+		default:
+			return nil, fmt.Errorf("line %d: unknown command %q", lineNum, op)
+		}
+		steps = append(steps, s)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &Interaction{steps: steps}, nil
+}
+
+func unquoteText(s string) (string, error) {
+	if strings.HasPrefix(s, "\"") || strings.HasPrefix(s, "`") {
+		t, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid quoted text %s", s)
+		}
+		return t, nil
+	}
+	return s, nil
+}
+
+func parseSignal(s string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil && n > 0 {
+		return syscall.Signal(n), nil
+	}
+	name := strings.ToUpper(s)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if sig := unix.SignalNum(name); sig != 0 {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("unknown signal %q", s)
+}
+
+// interactionIO connects stdin of the container to the replayed script and
+// tees stdout and stderr of the container to the matcher of "expect" commands.
+type interactionIO struct {
+	stdinR, stdinW *os.File
+	out            *outputMatcher
+}
+
+func newInteractionIO() (*interactionIO, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	return &interactionIO{stdinR: r, stdinW: w, out: newOutputMatcher()}, nil
+}
+
+func (i *interactionIO) Close() error {
+	i.stdinW.Close()
+	return i.stdinR.Close()
+}
+
+func (i *interactionIO) Stdin() io.WriteCloser { return i.stdinW }
+func (i *interactionIO) Stdout() io.ReadCloser { return nil }
+func (i *interactionIO) Stderr() io.ReadCloser { return nil }
+
+func (i *interactionIO) Set(cmd *exec.Cmd) {
+	cmd.Stdin = i.stdinR
+	cmd.Stdout = io.MultiWriter(os.Stdout, i.out)
+	cmd.Stderr = io.MultiWriter(os.Stderr, i.out)
+}
+
+// outputMatcher records the output of the container which isn't consumed by
+// "expect" commands yet.
+type outputMatcher struct {
+	buf     bytes.Buffer
+	updated chan struct{}
+	mu      sync.Mutex
+}
+
+func newOutputMatcher() *outputMatcher {
+	return &outputMatcher{updated: make(chan struct{})}
+}
+
+func (m *outputMatcher) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.buf.Write(p)
+	close(m.updated)
+	m.updated = make(chan struct{})
+	return len(p), nil
+}
+
+// expect waits until the text appears in the output and consumes the output
+// until the end of the text.
+func (m *outputMatcher) expect(ctx context.Context, text []byte, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		m.mu.Lock()
+		if i := bytes.Index(m.buf.Bytes(), text); i >= 0 {
+			m.buf.Next(i + len(text))
+			m.mu.Unlock()
+			return nil
+		}
+		updated := m.updated
+		m.mu.Unlock()
+		select {
+		case <-updated:
+		case <-timer.C:
+			return fmt.Errorf("timed out waiting for %q", text)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// replay runs the script against the container. kill sends a signal to the
+// container. Stdin is closed when the script ends or fails.
+func (in *Interaction) replay(ctx context.Context, sio *interactionIO, kill func(syscall.Signal) error) error {
+	defer sio.stdinW.Close()
+	timeout := defaultExpectTimeout
+	for _, s := range in.steps {
+		var err error
+		switch s.op {
+		case "sleep":
+			select {
+			case <-time.After(s.dur):
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+		case "timeout":
+			timeout = s.dur
+		case "expect":
+			err = sio.out.expect(ctx, s.text, timeout)
+		case "send", "sendline":
+			_, err = sio.stdinW.Write(s.text)
+		case "signal":
+			err = kill(s.signal)
+		case "close":
+			err = sio.stdinW.Close()
+		}
+		if err != nil {
+			return errors.Wrapf(err, "line %d (%s)", s.lineNum, s.op)
+		}
+		log.G(ctx).Debugf("interaction: done line %d (%s)", s.lineNum, s.op)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sampler
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseInteraction(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		want    []interactionStep
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			script: `# start the REPL
+timeout 5s
+expect >>> 
+sendline import os
+sleep 100ms
+send "exit()\n"
+signal INT
+signal SIGTERM
+signal 9
+close
+`,
+			want: []interactionStep{
+				{op: "timeout", dur: 5 * time.Second, lineNum: 2},
+				{op: "expect", text: []byte(">>>"), lineNum: 3},
+				{op: "sendline", text: []byte("import os\n"), lineNum: 4},
+				{op: "sleep", dur: 100 * time.Millisecond, lineNum: 5},
+				{op: "send", text: []byte("exit()\n"), lineNum: 6},
+				{op: "signal", signal: syscall.SIGINT, lineNum: 7},
+				{op: "signal", signal: syscall.SIGTERM, lineNum: 8},
+				{op: "signal", signal: syscall.SIGKILL, lineNum: 9},
+				{op: "close", lineNum: 10},
+			},
+		},
+		{name: "unknown command", script: "type foo", wantErr: true},
+		{name: "invalid duration", script: "sleep 1", wantErr: true},
+		{name: "unknown signal", script: "signal FOO", wantErr: true},
+		{name: "invalid quote", script: `send "foo`, wantErr: true},
+		{name: "empty expect", script: "expect", wantErr: true},
+		{name: "close with arg", script: "close now", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in, err := ParseInteraction(strings.NewReader(tt.script))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parsed invalid script %q", tt.script)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse: %v", err)
+			}
+			if len(in.steps) != len(tt.want) {
+				t.Fatalf("got %d steps; want %d", len(in.steps), len(tt.want))
+			}
+			for i, s := range in.steps {
+				w := tt.want[i]
+				if s.op != w.op || string(s.text) != string(w.text) || s.dur != w.dur ||
+					s.signal != w.signal || s.lineNum != w.lineNum {
+					t.Errorf("step %d = %+v; want %+v", i, s, w)
+				}
+			}
+		})
+	}
+}
+
+func TestReplayInteraction(t *testing.T) {
+	in, err := ParseInteraction(strings.NewReader(`expect "$ "
+sendline echo hello
+signal HUP
+expect "$ "
+send "\x04"
+`))
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	sio, err := newInteractionIO()
+	if err != nil {
+		t.Fatalf("failed to create io: %v", err)
+	}
+	defer sio.Close()
+
+	var signals []syscall.Signal
+	replayed := make(chan error)
+	go func() {
+		replayed <- in.replay(context.Background(), sio, func(sig syscall.Signal) error {
+			signals = append(signals, sig)
+			return nil
+		})
+	}()
+	sio.out.Write([]byte("$ "))
+	time.Sleep(10 * time.Millisecond)
+	sio.out.Write([]byte("hello\n$ "))
+
+	// stdin is closed at the end of the script.
+	got, err := ioutil.ReadAll(sio.stdinR)
+	if err != nil {
+		t.Fatalf("failed to read stdin: %v", err)
+	}
+	if err := <-replayed; err != nil {
+		t.Fatalf("failed to replay: %v", err)
+	}
+	if want := "echo hello\n\x04"; string(got) != want {
+		t.Errorf("stdin = %q; want %q", got, want)
+	}
+	if len(signals) != 1 || signals[0] != syscall.SIGHUP {
+		t.Errorf("signals = %v; want [SIGHUP]", signals)
+	}
+
+	// expect times out if the text doesn't appear.
+	if err := sio.out.expect(context.Background(), []byte("$ "), 10*time.Millisecond); err == nil {
+		t.Errorf("consumed output matched twice")
+	}
+}
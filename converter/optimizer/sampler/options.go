@@ -34,6 +34,15 @@ type options struct {
 	cni              bool
 	cniPluginConfDir string
 	cniPluginDir     string
+	seccompProfile   string
+	allowNewPrivs    bool
+	rootless         bool
+	interaction      *Interaction
+	devices          []string
+	gpus             string
+	nvidiaHook       string
+	phaseMarkers     []string
+	onPhase          func()
 }
 
 func WithEnvs(envs []string) Option {
@@ -125,3 +134,78 @@ func WithCNIPluginDir(cniPluginDir string) Option {
 		opts.cniPluginDir = cniPluginDir
 	}
 }
+
+// WithSeccompProfile specifies the path to the seccomp profile (in JSON) of the
+// container. "unconfined" disables seccomp. By default, the default profile of
+// containerd is used.
+func WithSeccompProfile(seccompProfile string) Option {
+	return func(opts *options) {
+		opts.seccompProfile = seccompProfile
+	}
+}
+
+// WithAllowNewPrivileges allows processes in the container to gain privileges
+// (e.g. with setuid binaries). By default, no_new_privs is set.
+func WithAllowNewPrivileges() Option {
+	return func(opts *options) {
+		opts.allowNewPrivs = true
+	}
+}
+
+// WithRootless runs the container with rootless runc. The container has its own
+// user namespace where only root is mapped (to the current user) and shares the
+// network with the caller.
+func WithRootless() Option {
+	return func(opts *options) {
+		opts.rootless = true
+	}
+}
+
+// WithInteraction replays the script against stdin of the container, and
+// signals, so interactive workloads (e.g. CLIs and REPLs) are sampled
+// deterministically. See Interaction for the syntax of the script.
+func WithInteraction(interaction *Interaction) Option {
+	return func(opts *options) {
+		opts.interaction = interaction
+	}
+}
+
+// WithDevices makes the devices on the host available in the container. The
+// format of a device is the one of "--device" of docker
+// ("<host-path>[:<container-path>][:<permissions>]"). A directory adds all
+// devices under it (e.g. "/dev/dri").
+func WithDevices(devices []string) Option {
+	return func(opts *options) {
+		opts.devices = devices
+	}
+}
+
+// WithGPUs makes the NVIDIA GPUs visible in the container with the prestart
+// hook of NVIDIA Container Toolkit, so workloads loading the driver libraries
+// only when a GPU is available (e.g. ML serving) are sampled as they run in
+// production. gpus is "all" or comma-separated indexes or UUIDs of the GPUs.
+func WithGPUs(gpus string) Option {
+	return func(opts *options) {
+		opts.gpus = gpus
+	}
+}
+
+// WithNvidiaHook specifies the path to the prestart hook used by WithGPUs. By
+// default, "nvidia-container-runtime-hook" or "nvidia-container-toolkit" is
+// looked up from $PATH.
+func WithNvidiaHook(path string) Option {
+	return func(opts *options) {
+		opts.nvidiaHook = path
+	}
+}
+
+// WithPhaseMarkers marks the phases of the workload with the HTTP(S) URLs
+// (e.g. "http://localhost:8080/ready"). The URLs are polled in order from the
+// network namespace of the container and next is called when each of them
+// responds with a 2xx status.
+func WithPhaseMarkers(markers []string, next func()) Option {
+	return func(opts *options) {
+		opts.phaseMarkers = markers
+		opts.onPhase = next
+	}
+}
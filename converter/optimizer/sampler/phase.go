@@ -0,0 +1,125 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sampler
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// phaseMarkerInterval is the interval of polling phase markers.
+const phaseMarkerInterval = 100 * time.Millisecond
+
+// validatePhaseMarkers checks that the markers are HTTP(S) URLs.
+func validatePhaseMarkers(markers []string) error {
+	for _, m := range markers {
+		u, err := url.Parse(m)
+		if err != nil {
+			return errors.Wrapf(err, "invalid phase marker %q", m)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("phase marker must be an HTTP(S) URL but %q", m)
+		}
+	}
+	return nil
+}
+
+// watchPhaseMarkers polls the markers in order from the network namespace of
+// the container and calls next when each of them responds with a 2xx status,
+// until the context is canceled. If netNS is empty, the markers are polled
+// from the network of this process.
+func watchPhaseMarkers(ctx context.Context, netNS string, markers []string, next func()) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext:       dialInNetNS(netNS),
+			DisableKeepAlives: true,
+		},
+		Timeout: time.Second,
+	}
+	start := time.Now()
+	for i, m := range markers {
+		for !markerReady(ctx, client, m) {
+			select {
+			case <-ctx.Done():
+				log.G(ctx).Warnf("phase marker %q didn't become ready", m)
+				return
+			case <-time.After(phaseMarkerInterval):
+			}
+		}
+		next()
+		log.G(ctx).Infof("phase %d started after %v (marker %q is ready)", i+2, time.Since(start), m)
+	}
+}
+
+func markerReady(ctx context.Context, client *http.Client, marker string) bool {
+	req, err := http.NewRequest("GET", marker, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
+}
+
+// dialInNetNS returns a dialer connecting from the network namespace.
+func dialInNetNS(netNS string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	// Fast fallback dials from other goroutines (i.e. other threads) so it's
+	// disabled to keep the socket in the namespace.
+	d := &net.Dialer{FallbackDelay: -1}
+	if netNS == "" {
+		return d.DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		type result struct {
+			conn net.Conn
+			err  error
+		}
+		ch := make(chan result, 1)
+		go func() {
+			// The thread is never unlocked so it's discarded when this
+			// goroutine exits, instead of being reused in the namespace.
+			runtime.LockOSThread()
+			f, err := os.Open(netNS)
+			if err != nil {
+				ch <- result{nil, err}
+				return
+			}
+			defer f.Close()
+			if err := unix.Setns(int(f.Fd()), unix.CLONE_NEWNET); err != nil {
+				ch <- result{nil, errors.Wrapf(err, "failed to enter %q", netNS)}
+				return
+			}
+			conn, err := d.DialContext(ctx, network, addr)
+			ch <- result{conn, err}
+		}()
+		r := <-ch
+		return r.conn, r.err
+	}
+}
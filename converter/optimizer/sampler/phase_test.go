@@ -0,0 +1,70 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sampler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWatchPhaseMarkers(t *testing.T) {
+	var ready int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ready" && atomic.LoadInt32(&ready) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	var phase int32 = 1
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		watchPhaseMarkers(ctx, "", []string{srv.URL + "/ready", srv.URL + "/warm"}, func() {
+			atomic.AddInt32(&phase, 1)
+		})
+	}()
+
+	time.Sleep(3 * phaseMarkerInterval)
+	if got := atomic.LoadInt32(&phase); got != 1 {
+		t.Fatalf("phase = %d before the marker is ready; want 1", got)
+	}
+	atomic.StoreInt32(&ready, 1)
+	<-done
+	if got := atomic.LoadInt32(&phase); got != 3 {
+		t.Errorf("phase = %d; want 3", got)
+	}
+}
+
+func TestValidatePhaseMarkers(t *testing.T) {
+	if err := validatePhaseMarkers([]string{"http://localhost:8080/ready", "https://127.0.0.1/"}); err != nil {
+		t.Errorf("valid markers are rejected: %v", err)
+	}
+	for _, m := range []string{"localhost:8080", "tcp://localhost:8080", "http:///ready"} {
+		if err := validatePhaseMarkers([]string{m}); err == nil {
+			t.Errorf("invalid marker %q is accepted", m)
+		}
+	}
+}
@@ -22,14 +22,17 @@ import (
 	"encoding/csv"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
 
+	"github.com/containerd/containerd/contrib/seccomp"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/pkg/netns"
 	gocni "github.com/containerd/go-cni"
@@ -37,6 +40,7 @@ import (
 	"github.com/docker/docker/oci"
 	"github.com/hashicorp/go-multierror"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/runc/libcontainer/specconv"
 	"github.com/opencontainers/runc/libcontainer/user"
 	specs "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pkg/errors"
@@ -44,37 +48,153 @@ import (
 )
 
 func Run(ctx context.Context, bundle string, config v1.Image, opts ...Option) error {
+	return RunGroup(ctx, []Workload{{Bundle: bundle, Config: config, Opts: opts}})
+}
+
+// Workload is a container run by RunGroup.
+type Workload struct {
+	Bundle string
+	Config v1.Image
+	Opts   []Option
+}
+
+// RunGroup runs the containers of the workloads at the same time. The first
+// workload is the main container and the others are its sidecars, which join
+// the network namespace of the main container so they can talk to each other
+// over localhost (as containers of a Kubernetes pod do). Sidecars are started
+// after the main container and never have stdin. All containers are killed
+// when the main container exits or the context is canceled.
+func RunGroup(ctx context.Context, workloads []Workload) (retErr error) {
+	if len(workloads) == 0 {
+		return fmt.Errorf("no workload is specified")
+	}
+	var (
+		prepared   []*preparedWorkload
+		containers []*container
+	)
+	defer func() {
+		// Kill sidecars first because they may depend on the main container.
+		for i := len(containers) - 1; i >= 0; i-- {
+			if err := containers[i].kill(ctx); err != nil {
+				retErr = multierror.Append(retErr, errors.Wrap(err, "failed to kill containers"))
+			}
+		}
+		for i := len(prepared) - 1; i >= 0; i-- {
+			prepared[i].cleanup(ctx)
+		}
+	}()
+	main, err := prepareWorkload(ctx, workloads[0], nil)
+	if err != nil {
+		return err
+	}
+	prepared = append(prepared, main)
+	c, err := startContainer(ctx, main.bundle, main.opt.rootless, main.opt.interaction, false)
+	if err != nil {
+		return errors.Wrap(err, "failed to run containers")
+	}
+	containers = append(containers, c)
+	var netNS *string
+	if len(workloads) > 1 || len(main.opt.phaseMarkers) > 0 {
+		if netNS, err = c.netNS(ctx, main.spec); err != nil {
+			return errors.Wrap(err, "failed to get network namespace of the main container")
+		}
+	}
+	if len(main.opt.phaseMarkers) > 0 {
+		watchCtx, cancelWatch := context.WithCancel(ctx)
+		defer cancelWatch()
+		go watchPhaseMarkers(watchCtx, *netNS, main.opt.phaseMarkers, main.opt.onPhase)
+	}
+	if len(workloads) > 1 {
+		for _, w := range workloads[1:] {
+			sidecar, err := prepareWorkload(ctx, w, netNS)
+			if err != nil {
+				return errors.Wrapf(err, "failed to prepare sidecar %q", w.Bundle)
+			}
+			prepared = append(prepared, sidecar)
+			sc, err := startContainer(ctx, sidecar.bundle, sidecar.opt.rootless, nil, true)
+			if err != nil {
+				return errors.Wrap(err, "failed to run sidecar containers")
+			}
+			containers = append(containers, sc)
+		}
+	}
+	c.wait(ctx, main.opt.waitOnSignal)
+	return nil
+}
+
+// preparedWorkload is a workload whose bundle is ready to run.
+type preparedWorkload struct {
+	bundle string
+	spec   specs.Spec
+	opt    options
+	done   func() error
+}
+
+// prepareWorkload writes the spec of the workload to the bundle. If netNS is
+// non-nil, the container joins the network namespace (see
+// container.netNS) instead of configuring its own.
+func prepareWorkload(ctx context.Context, w Workload, netNS *string) (*preparedWorkload, error) {
 	opt := options{}
-	for _, o := range opts {
+	for _, o := range w.Opts {
 		o(&opt)
 	}
+	if err := validatePhaseMarkers(opt.phaseMarkers); err != nil {
+		return nil, err
+	}
+	if netNS != nil {
+		if len(opt.phaseMarkers) > 0 {
+			return nil, fmt.Errorf("sidecars can't have phase markers")
+		}
+		if (*netNS == "") != opt.rootless {
+			return nil, fmt.Errorf("sidecars must be run in the same (rootless or not) mode as the main container")
+		}
+		if opt.terminal || opt.interaction != nil {
+			return nil, fmt.Errorf("sidecars can't have terminal or interaction")
+		}
+		opt.cni = false
+	}
 
-	spec, done, err := conf2spec(config.Config, GetRootfsPathUnder(bundle), opt)
+	spec, done, err := conf2spec(w.Config.Config, GetRootfsPathUnder(w.Bundle), opt)
 	if err != nil {
-		return errors.Wrap(err, "failed to convert config to spec")
+		return nil, errors.Wrap(err, "failed to convert config to spec")
 	}
-	defer func() {
-		if err := done(); err != nil {
-			log.G(ctx).WithError(err).Warnf("failed to cleanup")
-			return
-		}
-		log.G(ctx).Infof("cleaned up successfully")
-	}()
-	sf, err := os.Create(filepath.Join(bundle, "config.json"))
+	if netNS != nil && *netNS != "" {
+		setNetNS(&spec, *netNS)
+	}
+	sf, err := os.Create(filepath.Join(w.Bundle, "config.json"))
 	if err != nil {
-		return errors.Wrap(err, "failed to create config.json in the bundle")
+		done()
+		return nil, errors.Wrap(err, "failed to create config.json in the bundle")
 	}
 	defer sf.Close()
 	if err = json.NewEncoder(sf).Encode(spec); err != nil {
-		return errors.Wrap(err, "failed to parse user")
+		done()
+		return nil, errors.Wrap(err, "failed to parse user")
 	}
+	return &preparedWorkload{bundle: w.Bundle, spec: spec, opt: opt, done: done}, nil
+}
 
-	// run the container
-	if err := runContainer(ctx, bundle, opt.waitOnSignal); err != nil {
-		return errors.Wrap(err, "failed to run containers")
+func (w *preparedWorkload) cleanup(ctx context.Context) {
+	if err := w.done(); err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to cleanup")
+		return
 	}
+	log.G(ctx).Infof("cleaned up successfully")
+}
 
-	return nil
+// setNetNS makes the container join the network namespace at the path.
+func setNetNS(s *specs.Spec, path string) {
+	for i, e := range s.Linux.Namespaces {
+		if e.Type == specs.NetworkNamespace {
+			before := s.Linux.Namespaces[:i]
+			after := s.Linux.Namespaces[i+1:]
+			s.Linux.Namespaces = append(append(before, specs.LinuxNamespace{
+				Type: specs.NetworkNamespace,
+				Path: path,
+			}), after...)
+			break
+		}
+	}
 }
 
 func GetRootfsPathUnder(bundle string) string {
@@ -132,6 +252,10 @@ func conf2spec(config v1.ImageConfig, rootfs string, opt options) (spec specs.Sp
 			rErr = errors.Wrapf(err, "failed to resolve username %q", username)
 			return
 		}
+		if opt.rootless && execUser.Uid != 0 {
+			rErr = fmt.Errorf("user %q isn't mapped in the rootless mode; only root is available", username)
+			return
+		}
 		s.Process.User.UID = uint32(execUser.Uid)
 		s.Process.User.GID = uint32(execUser.Gid)
 		for _, g := range execUser.Sgids {
@@ -281,6 +405,51 @@ func conf2spec(config v1.ImageConfig, rootfs string, opt options) (spec specs.Sp
 		s.Mounts = append(s.Mounts, mc)
 	}
 
+	// Devices and GPUs
+	if err := addDevices(&s, opt.devices); err != nil {
+		rErr = errors.Wrap(err, "failed to add devices")
+		return
+	}
+	if opt.gpus != "" {
+		if opt.rootless {
+			rErr = fmt.Errorf("GPUs aren't supported in the rootless mode")
+			return
+		}
+		if err := addNvidiaGPUs(&s, opt.gpus, opt.nvidiaHook); err != nil {
+			rErr = errors.Wrap(err, "failed to add GPUs")
+			return
+		}
+	}
+
+	// Sandbox the workload because images can be untrusted.
+	s.Process.NoNewPrivileges = !opt.allowNewPrivs
+	switch opt.seccompProfile {
+	case "":
+		s.Linux.Seccomp = seccomp.DefaultProfile(&s)
+	case "unconfined":
+		s.Linux.Seccomp = nil
+	default:
+		data, err := ioutil.ReadFile(opt.seccompProfile)
+		if err != nil {
+			rErr = errors.Wrapf(err, "failed to read seccomp profile %q", opt.seccompProfile)
+			return
+		}
+		var profile specs.LinuxSeccomp
+		if err := json.Unmarshal(data, &profile); err != nil {
+			rErr = errors.Wrapf(err, "failed to parse seccomp profile %q", opt.seccompProfile)
+			return
+		}
+		s.Linux.Seccomp = &profile
+	}
+
+	if opt.rootless {
+		if opt.cni {
+			rErr = fmt.Errorf("CNI-based networking isn't supported in the rootless mode")
+			return
+		}
+		specconv.ToRootless(&s)
+	}
+
 	// CNI-based networking (if enabled).
 	if opt.cni {
 		// Create a new network namespace for configuring it with CNI plugins
@@ -318,38 +487,54 @@ func conf2spec(config v1.ImageConfig, rootfs string, opt options) (spec specs.Sp
 		})
 
 		// Make the container use this network namespace
-		for i, e := range s.Linux.Namespaces {
-			if e.Type == specs.NetworkNamespace {
-				before := s.Linux.Namespaces[:i]
-				after := s.Linux.Namespaces[i+1:]
-				s.Linux.Namespaces = append(append(before, specs.LinuxNamespace{
-					Type: specs.NetworkNamespace,
-					Path: ns.GetPath(),
-				}), after...)
-				break
-			}
-		}
+		setNetNS(&s, ns.GetPath())
 	}
 
 	return s, done, nil
 }
 
-func runContainer(ctx context.Context, bundle string, ignoreCtxCancel bool) error {
+// container is a running container.
+type container struct {
+	id      string
+	runtime *runc.Runc
+	done    chan struct{} // closed when the container stops
+	close   func()
+}
+
+// startContainer runs the container of the bundle in background. If
+// interaction is specified, it's replayed against the container. If noStdin
+// is true, the container doesn't read stdin of this process.
+func startContainer(ctx context.Context, bundle string, rootless bool, interaction *Interaction, noStdin bool) (*container, error) {
 	runtime := &runc.Runc{
 		Log:          filepath.Join(bundle, "runc-log.json"),
 		LogFormat:    runc.JSON,
 		PdeathSignal: syscall.SIGKILL,
 		// Setpgid:      true,         // TODO: do we need this?
 	}
+	if rootless {
+		runtime.Rootless = &rootless
+	}
 
 	// Run the container
 	id := xid.New().String()
-	stdio, err := runc.NewSTDIO()
+	var (
+		stdio runc.IO
+		iio   *interactionIO
+		err   error
+	)
+	if interaction != nil {
+		iio, err = newInteractionIO()
+		stdio = iio
+	} else if noStdin {
+		stdio = outputIO{}
+	} else {
+		stdio, err = runc.NewSTDIO()
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 	runCtx, cancelRun := context.WithCancel(context.Background())
-	defer cancelRun()
+	replayCtx, cancelReplay := context.WithCancel(context.Background())
 	done := make(chan struct{})
 	go func() {
 		defer close(done)
@@ -359,8 +544,67 @@ func runContainer(ctx context.Context, bundle string, ignoreCtxCancel bool) erro
 		})
 		log.G(ctx).Infof("container %q stopped", id)
 	}()
+	if interaction != nil {
+		go func() {
+			if err := interaction.replay(replayCtx, iio, func(sig syscall.Signal) error {
+				return runtime.Kill(replayCtx, id, int(sig), nil)
+			}); err != nil {
+				log.G(ctx).WithError(err).Warnf("failed to replay the interaction with container %q", id)
+				return
+			}
+			log.G(ctx).Infof("replayed the interaction with container %q", id)
+		}()
+	}
+	return &container{
+		id:      id,
+		runtime: runtime,
+		done:    done,
+		close: func() {
+			cancelReplay()
+			cancelRun()
+			stdio.Close()
+		},
+	}, nil
+}
 
-	// Wait until context is canceled or signal is detected
+// netNS returns the path to the network namespace of the container for
+// sidecars. This is empty if the container shares the network with the host.
+func (c *container) netNS(ctx context.Context, s specs.Spec) (*string, error) {
+	var path string
+	for _, e := range s.Linux.Namespaces {
+		if e.Type != specs.NetworkNamespace {
+			continue
+		}
+		if e.Path != "" {
+			path = e.Path
+			return &path, nil
+		}
+		// The namespace is created by runc so it's available once the
+		// process of the container starts.
+		timeout := time.After(netNSTimeout)
+		for {
+			if st, err := c.runtime.State(ctx, c.id); err == nil && st.Pid > 0 {
+				path = fmt.Sprintf("/proc/%d/ns/net", st.Pid)
+				return &path, nil
+			}
+			select {
+			case <-c.done:
+				return nil, fmt.Errorf("container %q stopped", c.id)
+			case <-timeout:
+				return nil, fmt.Errorf("container %q didn't start in %v", c.id, netNSTimeout)
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+	}
+	return &path, nil
+}
+
+// netNSTimeout is the time to wait for the main container to start.
+const netNSTimeout = 30 * time.Second
+
+// wait waits until the container stops, the context is canceled or a signal
+// is detected. If ignoreCtxCancel is true, only signals are waited for.
+func (c *container) wait(ctx context.Context, ignoreCtxCancel bool) {
 	sc := make(chan os.Signal, 1)
 	signal.Notify(sc,
 		syscall.SIGHUP,
@@ -369,36 +613,38 @@ func runContainer(ctx context.Context, bundle string, ignoreCtxCancel bool) erro
 		syscall.SIGQUIT)
 	defer signal.Stop(sc)
 	if ignoreCtxCancel {
-		log.G(ctx).Infof("press Ctrl+C to terminate the container %q", id)
+		log.G(ctx).Infof("press Ctrl+C to terminate the container %q", c.id)
 		select {
-		case <-done:
-			return nil
+		case <-c.done:
 		case <-sc:
 			log.G(ctx).Info("signal detected")
 		}
 	} else {
-		log.G(ctx).Debugf("waiting for the termination of container %q", id)
+		log.G(ctx).Debugf("waiting for the termination of container %q", c.id)
 		select {
-		case <-done:
-			return nil
+		case <-c.done:
 		case <-ctx.Done():
 			log.G(ctx).Info("context canceled")
 		case <-sc:
 			log.G(ctx).Info("signal detected")
 		}
 	}
+}
 
-	// Kill the container
+// kill kills the container unless it's already stopped and releases its
+// resources.
+func (c *container) kill(ctx context.Context) error {
+	defer c.close()
 	for {
 		select {
-		case <-done:
+		case <-c.done:
 			// container terminated
 			return nil
 		default:
-			log.G(ctx).Debugf("trying to kill container %q", id)
+			log.G(ctx).Debugf("trying to kill container %q", c.id)
 			killCtx, timeout := context.WithTimeout(context.Background(), 7*time.Second)
-			if err := runtime.Kill(killCtx, id, int(syscall.SIGKILL), nil); err != nil {
-				log.G(ctx).WithError(err).Warnf("failed to kill container %q", id)
+			if err := c.runtime.Kill(killCtx, c.id, int(syscall.SIGKILL), nil); err != nil {
+				log.G(ctx).WithError(err).Warnf("failed to kill container %q", c.id)
 				select {
 				case <-killCtx.Done():
 					// runc kill seems to hang. we shouldn't retry this anymore.
@@ -409,7 +655,7 @@ func runContainer(ctx context.Context, bundle string, ignoreCtxCancel bool) erro
 			}
 			timeout()
 			select {
-			case <-done:
+			case <-c.done:
 				return nil
 			case <-time.After(50 * time.Millisecond):
 				// retry runc kill
@@ -417,3 +663,17 @@ func runContainer(ctx context.Context, bundle string, ignoreCtxCancel bool) erro
 		}
 	}
 }
+
+// outputIO connects stdout and stderr of the container to the ones of this
+// process, without stdin.
+type outputIO struct{}
+
+func (outputIO) Close() error          { return nil }
+func (outputIO) Stdin() io.WriteCloser { return nil }
+func (outputIO) Stdout() io.ReadCloser { return nil }
+func (outputIO) Stderr() io.ReadCloser { return nil }
+
+func (outputIO) Set(cmd *exec.Cmd) {
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+}
@@ -0,0 +1,79 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sampler
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestPrepareSidecar(t *testing.T) {
+	bundle, err := ioutil.TempDir("", "testsidecar")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(bundle)
+	config := v1.Image{Config: v1.ImageConfig{Cmd: []string{"envoy"}}}
+	netNSOf := func(s specs.Spec) (string, bool) {
+		for _, ns := range s.Linux.Namespaces {
+			if ns.Type == specs.NetworkNamespace {
+				return ns.Path, true
+			}
+		}
+		return "", false
+	}
+
+	path := "/proc/10/ns/net"
+	p, err := prepareWorkload(context.Background(), Workload{Bundle: bundle, Config: config}, &path)
+	if err != nil {
+		t.Fatalf("failed to prepare sidecar: %v", err)
+	}
+	defer p.done()
+	if got, ok := netNSOf(p.spec); !ok || got != path {
+		t.Errorf("network namespace = %q; want %q", got, path)
+	}
+	if _, err := os.Stat(filepath.Join(bundle, "config.json")); err != nil {
+		t.Errorf("config.json isn't written: %v", err)
+	}
+
+	// The main container has its own network namespace until it starts.
+	m, err := prepareWorkload(context.Background(), Workload{Bundle: bundle, Config: config}, nil)
+	if err != nil {
+		t.Fatalf("failed to prepare main container: %v", err)
+	}
+	defer m.done()
+	if got, ok := netNSOf(m.spec); !ok || got != "" {
+		t.Errorf("network namespace of the main container = (%q, %v); want a new one", got, ok)
+	}
+
+	for _, opts := range [][]Option{
+		{WithRootless()},
+		{WithTerminal()},
+		{WithInteraction(&Interaction{})},
+	} {
+		if p, err := prepareWorkload(context.Background(), Workload{Bundle: bundle, Config: config, Opts: opts}, &path); err == nil {
+			p.done()
+			t.Errorf("prepared invalid sidecar")
+		}
+	}
+}
@@ -0,0 +1,104 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package converter
+
+import (
+	gocontext "context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/containerd/containerd/log"
+)
+
+// progressInterval is the interval of logging the progress of layer conversion.
+const progressInterval = 10 * time.Second
+
+// layerProgress tracks the progress of converting a layer.
+type layerProgress struct {
+	total   int64 // size of the compressed source layer; <= 0 if unknown
+	read    int64 // bytes read from the compressed source layer; accessed atomically
+	written int64 // bytes of the converted layer; accessed atomically
+	start   time.Time
+}
+
+func newLayerProgress(total int64) *layerProgress {
+	return &layerProgress{total: total, start: time.Now()}
+}
+
+// countRead returns a reader which counts the bytes read from the source layer.
+func (p *layerProgress) countRead(r io.Reader) io.Reader {
+	return &countReader{r: r, n: &p.read}
+}
+
+// countWritten returns a reader which counts the bytes of the converted layer.
+func (p *layerProgress) countWritten(r io.Reader) io.Reader {
+	return &countReader{r: r, n: &p.written}
+}
+
+func (p *layerProgress) String() string {
+	var (
+		read    = atomic.LoadInt64(&p.read)
+		written = atomic.LoadInt64(&p.written)
+		elapsed = time.Since(p.start)
+	)
+	if p.total <= 0 {
+		return fmt.Sprintf("read %s, written %s, elapsed %s", mib(read), mib(written), elapsed.Round(time.Second))
+	}
+	eta := "unknown"
+	if read > 0 && read <= p.total {
+		eta = (time.Duration(float64(elapsed) * float64(p.total-read) / float64(read))).Round(time.Second).String()
+	}
+	return fmt.Sprintf("read %s/%s (%d%%), written %s, ETA %s",
+		mib(read), mib(p.total), read*100/p.total, mib(written), eta)
+}
+
+// report logs the progress periodically until the returned function is called.
+func (p *layerProgress) report(ctx gocontext.Context) (done func()) {
+	stopCh := make(chan struct{})
+	go func() {
+		t := time.NewTicker(progressInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				log.G(ctx).Infof("converting: %s", p)
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stopCh)
+	}
+}
+
+func mib(n int64) string {
+	return fmt.Sprintf("%.1fMiB", float64(n)/(1<<20))
+}
+
+type countReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
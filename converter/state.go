@@ -0,0 +1,141 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package converter
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/containerd/stargz-snapshotter/converter/optimizer/layer"
+	regpkg "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/pkg/errors"
+)
+
+// StreamState records the layers converted and pushed by the streaming
+// conversion in a file, so that an aborted conversion can be resumed without
+// converting these layers again.
+type StreamState struct {
+	path   string
+	layers map[string]StreamStateLayer // key: digest of the source layer
+	mu     sync.Mutex
+}
+
+// StreamStateLayer is a converted layer recorded in StreamState.
+type StreamStateLayer struct {
+	Digest    string `json:"digest"`
+	DiffID    string `json:"diffID"`
+	Size      int64  `json:"size"`
+	MediaType string `json:"mediaType"`
+	TOCDigest string `json:"tocDigest"`
+}
+
+type streamStateFile struct {
+	Layers map[string]StreamStateLayer `json:"layers"`
+}
+
+// LoadStreamState loads the state from the file. The state is empty if the
+// file doesn't exist. The state file is updated every time a layer is pushed.
+func LoadStreamState(path string) (*StreamState, error) {
+	s := &StreamState{path: path, layers: make(map[string]StreamStateLayer)}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var f streamStateFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse state file %q", path)
+	}
+	for k, v := range f.Layers {
+		s.layers[k] = v
+	}
+	return s, nil
+}
+
+// lookup returns the converted layer of the source layer and the TOC digest
+// if it's recorded.
+func (s *StreamState) lookup(src regpkg.Hash) (regpkg.Layer, string, bool) {
+	s.mu.Lock()
+	l, ok := s.layers[src.String()]
+	s.mu.Unlock()
+	if !ok {
+		return nil, "", false
+	}
+	dgst, err := regpkg.NewHash(l.Digest)
+	if err != nil {
+		return nil, "", false
+	}
+	diffID, err := regpkg.NewHash(l.DiffID)
+	if err != nil {
+		return nil, "", false
+	}
+	return layer.NewPushedLayerFromDescriptor(dgst, diffID, l.Size, types.MediaType(l.MediaType)), l.TOCDigest, true
+}
+
+// record records the converted layer of the source layer and writes the state
+// to the file.
+func (s *StreamState) record(src regpkg.Hash, l regpkg.Layer, tocDigest string) error {
+	dgst, err := l.Digest()
+	if err != nil {
+		return err
+	}
+	diffID, err := l.DiffID()
+	if err != nil {
+		return err
+	}
+	size, err := l.Size()
+	if err != nil {
+		return err
+	}
+	mediaType, err := l.MediaType()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.layers[src.String()] = StreamStateLayer{
+		Digest:    dgst.String(),
+		DiffID:    diffID.String(),
+		Size:      size,
+		MediaType: string(mediaType),
+		TOCDigest: tocDigest,
+	}
+	b, err := json.MarshalIndent(streamStateFile{Layers: s.layers}, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write the state atomically not to break it when the conversion is aborted.
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
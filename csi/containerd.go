@@ -0,0 +1,180 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package csi
+
+import (
+	"context"
+	"os"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/leases"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/opencontainers/image-spec/identity"
+	"github.com/pkg/errors"
+)
+
+const (
+	// prefetchSize is the size of the prefetch of layers without landmarks.
+	prefetchSize = 10 * 1024 * 1024
+
+	// usernameKey and passwordKey are keys of the secret which contains the
+	// credentials of the registry (nodePublishSecretRef).
+	usernameKey = "username"
+	passwordKey = "password"
+)
+
+// ContainerdBackend mounts images as snapshots of containerd. Images which
+// aren't in containerd are pulled with the snapshotter, which is expected to
+// be the stargz snapshotter so that the contents are lazily fetched with the
+// prefetch policy of image volumes. The
+// contents are always verified by the snapshotter because the driver doesn't
+// allow skipping verification. Each mount is kept as a read-only view of the
+// image with a lease so the image isn't garbage collected while it's mounted.
+type ContainerdBackend struct {
+	client      *containerd.Client
+	snapshotter string
+}
+
+// NewContainerdBackend returns a backend using the client. The namespace is
+// the default namespace of the client.
+func NewContainerdBackend(client *containerd.Client, snapshotter string) *ContainerdBackend {
+	return &ContainerdBackend{client: client, snapshotter: snapshotter}
+}
+
+var _ = (Backend)((*ContainerdBackend)(nil))
+
+func (b *ContainerdBackend) Publish(ctx context.Context, key, ref, target string, secrets map[string]string) (retErr error) {
+	if mounted, err := isMountpoint(target); err != nil {
+		return err
+	} else if mounted {
+		return nil // already published
+	}
+
+	ls := b.client.LeasesService()
+	l, err := ls.Create(ctx, leases.WithID(key))
+	if errdefs.IsAlreadyExists(err) {
+		l = leases.Lease{ID: key} // left by the previous failed attempt
+	} else if err != nil {
+		return errors.Wrapf(err, "failed to create lease %q", key)
+	}
+	ctx = leases.WithLease(ctx, l.ID)
+	defer func() {
+		if retErr != nil {
+			if err := b.release(ctx, key); err != nil {
+				log.G(ctx).WithError(err).Warnf("failed to release %q", key)
+			}
+		}
+	}()
+
+	img, err := b.client.GetImage(ctx, ref)
+	if err == nil {
+		var unpacked bool
+		if unpacked, err = img.IsUnpacked(ctx, b.snapshotter); err == nil && !unpacked {
+			err = errors.Wrapf(errdefs.ErrNotFound, "image %q isn't unpacked", ref)
+		}
+	}
+	if errdefs.IsNotFound(err) {
+		log.G(ctx).WithField("image", ref).Info("pulling image")
+		img, err = b.client.Pull(ctx, ref,
+			containerd.WithResolver(newResolver(secrets)),
+			containerd.WithPullUnpack,
+			containerd.WithPullSnapshotter(b.snapshotter, snapshots.WithLabels(map[string]string{
+				config.TargetImageVolumeLabel: "true",
+			})),
+			containerd.WithImageHandlerWrapper(source.AppendDefaultLabelsHandlerWrapper(ref, prefetchSize)),
+		)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to get image %q", ref)
+	}
+	diffIDs, err := img.RootFS(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get layers of %q", ref)
+	}
+
+	sn := b.client.SnapshotService(b.snapshotter)
+	mounts, err := sn.View(ctx, key, identity.ChainID(diffIDs).String())
+	if errdefs.IsAlreadyExists(err) {
+		mounts, err = sn.Mounts(ctx, key)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to get view of %q", ref)
+	}
+	if err := os.MkdirAll(target, 0750); err != nil {
+		return errors.Wrapf(err, "failed to create target %q", target)
+	}
+	if err := mount.All(mounts, target); err != nil {
+		return errors.Wrapf(err, "failed to mount %q", target)
+	}
+	return nil
+}
+
+func (b *ContainerdBackend) Unpublish(ctx context.Context, key, target string) error {
+	if err := mount.UnmountAll(target, 0); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to unmount %q", target)
+	}
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to remove target %q", target)
+	}
+	return b.release(ctx, key)
+}
+
+// release removes the view and the lease of the mount. Contents of the image
+// are garbage collected by containerd when they are no longer referenced.
+func (b *ContainerdBackend) release(ctx context.Context, key string) error {
+	if err := b.client.SnapshotService(b.snapshotter).Remove(ctx, key); err != nil && !errdefs.IsNotFound(err) {
+		return errors.Wrapf(err, "failed to remove view %q", key)
+	}
+	if err := b.client.LeasesService().Delete(ctx, leases.Lease{ID: key}); err != nil && !errdefs.IsNotFound(err) {
+		return errors.Wrapf(err, "failed to delete lease %q", key)
+	}
+	return nil
+}
+
+// newResolver returns the resolver which uses the credentials in the secrets
+// if provided.
+func newResolver(secrets map[string]string) remotes.Resolver {
+	var opts []docker.AuthorizerOpt
+	if user, pass := secrets[usernameKey], secrets[passwordKey]; user != "" || pass != "" {
+		opts = append(opts, docker.WithAuthCreds(func(string) (string, string, error) {
+			return user, pass, nil
+		}))
+	}
+	return docker.NewResolver(docker.ResolverOptions{
+		Hosts: docker.ConfigureDefaultRegistries(docker.WithAuthorizer(docker.NewDockerAuthorizer(opts...))),
+	})
+}
+
+func isMountpoint(target string) (bool, error) {
+	if _, err := os.Stat(target); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrapf(err, "failed to stat target %q", target)
+	}
+	info, err := mount.Lookup(target)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to lookup mount of %q", target)
+	}
+	return info.Mountpoint == target, nil
+}
@@ -0,0 +1,193 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package csi implements a node plugin of Container Storage Interface (CSI)
+// which mounts images as read-only volumes of pods. Images are lazily pulled
+// by the stargz snapshotter so a pod can start before the whole contents of
+// the volume are downloaded.
+package csi
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/containerd/containerd/log"
+	digest "github.com/opencontainers/go-digest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ImageKey is the key of the volume context (volumeAttributes) which specifies
+// the reference of the image to be mounted.
+const ImageKey = "image"
+
+// Backend mounts images on the node.
+type Backend interface {
+
+	// Publish mounts the image read-only on the target. key identifies the
+	// mount and is passed to Unpublish. This must succeed if the image is
+	// already mounted on the target. secrets are the credentials of the
+	// registry passed by the CO.
+	Publish(ctx context.Context, key, ref, target string, secrets map[string]string) error
+
+	// Unpublish unmounts the target and releases the resources of the mount.
+	// This must succeed if the target isn't mounted.
+	Unpublish(ctx context.Context, key, target string) error
+}
+
+// Driver serves the Identity and Node services of CSI. Node staging, volume
+// stats and expansion aren't supported.
+type Driver struct {
+	csi.UnimplementedNodeServer
+
+	name    string
+	version string
+	nodeID  string
+	backend Backend
+
+	mu       sync.Mutex
+	inflight map[string]struct{} // target paths being published or unpublished
+}
+
+// NewDriver returns a driver named name which mounts images using the backend.
+func NewDriver(name, version, nodeID string, backend Backend) *Driver {
+	return &Driver{
+		name:     name,
+		version:  version,
+		nodeID:   nodeID,
+		backend:  backend,
+		inflight: make(map[string]struct{}),
+	}
+}
+
+// NewServer returns a gRPC server serving the driver.
+func NewServer(d *Driver) *grpc.Server {
+	s := grpc.NewServer()
+	csi.RegisterIdentityServer(s, d)
+	csi.RegisterNodeServer(s, d)
+	return s
+}
+
+var _ = (csi.IdentityServer)((*Driver)(nil))
+var _ = (csi.NodeServer)((*Driver)(nil))
+
+func (d *Driver) GetPluginInfo(ctx context.Context, _ *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
+	return &csi.GetPluginInfoResponse{Name: d.name, VendorVersion: d.version}, nil
+}
+
+func (d *Driver) GetPluginCapabilities(ctx context.Context, _ *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	return &csi.GetPluginCapabilitiesResponse{}, nil
+}
+
+func (d *Driver) Probe(ctx context.Context, _ *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	return &csi.ProbeResponse{}, nil
+}
+
+func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID must be specified")
+	}
+	if req.TargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "target path must be specified")
+	}
+	vc := req.VolumeCapability
+	if vc == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume capability must be specified")
+	}
+	if vc.GetBlock() != nil || vc.GetMount() == nil {
+		return nil, status.Error(codes.InvalidArgument, "only mount access type is supported")
+	}
+	if m := vc.AccessMode; m != nil && (m.Mode == csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER || m.Mode == csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER) {
+		// Kubernetes passes the mode of the PV, which is often RWO, even if the
+		// pod mounts the volume read-only. So only modes requiring writes from
+		// multiple nodes are rejected. The volume is read-only anyway.
+		return nil, status.Errorf(codes.InvalidArgument, "access mode %s isn't supported by read-only volumes", m.Mode)
+	}
+	ref := req.VolumeContext[ImageKey]
+	if ref == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "image must be specified by volume attribute %q", ImageKey)
+	}
+	target := filepath.Clean(req.TargetPath)
+	release, err := d.lock(target)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	log.G(ctx).WithField("volume", req.VolumeId).WithField("image", ref).WithField("target", target).Info("publishing volume")
+	if err := d.backend.Publish(ctx, mountKey(target), ref, target, req.Secrets); err != nil {
+		log.G(ctx).WithError(err).WithField("volume", req.VolumeId).Warn("failed to publish volume")
+		return nil, status.Errorf(codes.Internal, "failed to mount image %q: %v", ref, err)
+	}
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID must be specified")
+	}
+	if req.TargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "target path must be specified")
+	}
+	target := filepath.Clean(req.TargetPath)
+	release, err := d.lock(target)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	log.G(ctx).WithField("volume", req.VolumeId).WithField("target", target).Info("unpublishing volume")
+	if err := d.backend.Unpublish(ctx, mountKey(target), target); err != nil {
+		log.G(ctx).WithError(err).WithField("volume", req.VolumeId).Warn("failed to unpublish volume")
+		return nil, status.Errorf(codes.Internal, "failed to unmount %q: %v", target, err)
+	}
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+func (d *Driver) NodeGetCapabilities(ctx context.Context, _ *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	return &csi.NodeGetCapabilitiesResponse{}, nil
+}
+
+func (d *Driver) NodeGetInfo(ctx context.Context, _ *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	return &csi.NodeGetInfoResponse{NodeId: d.nodeID}, nil
+}
+
+// lock marks the target as in use by an operation. As recommended by the CSI
+// spec, concurrent operations on the same target are aborted and retried by
+// the CO.
+func (d *Driver) lock(target string) (func(), error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.inflight[target]; ok {
+		return nil, status.Errorf(codes.Aborted, "operation on %q is in progress", target)
+	}
+	d.inflight[target] = struct{}{}
+	return func() {
+		d.mu.Lock()
+		delete(d.inflight, target)
+		d.mu.Unlock()
+	}, nil
+}
+
+// mountKey returns the key of the mount on the target. A persistent volume can
+// be published on several targets on a node (one per pod) so the key is
+// derived from the target path, which is unique per pod and volume.
+func mountKey(target string) string {
+	return "csi-" + digest.FromString(target).Encoded()
+}
@@ -0,0 +1,152 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package csi
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type testBackend struct {
+	mounts  map[string]string // target -> image
+	keys    map[string]string // target -> key
+	secrets map[string]string
+}
+
+func (b *testBackend) Publish(ctx context.Context, key, ref, target string, secrets map[string]string) error {
+	b.mounts[target] = ref
+	b.keys[target] = key
+	b.secrets = secrets
+	return nil
+}
+
+func (b *testBackend) Unpublish(ctx context.Context, key, target string) error {
+	if b.keys[target] != key {
+		return status.Errorf(codes.Internal, "unexpected key %q", key)
+	}
+	delete(b.mounts, target)
+	delete(b.keys, target)
+	return nil
+}
+
+// TestDriver tests volumes are published and unpublished over the CSI protocol.
+func TestDriver(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "test-csi")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	addr := filepath.Join(tempDir, "csi.sock")
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	b := &testBackend{mounts: make(map[string]string), keys: make(map[string]string)}
+	s := NewServer(NewDriver("stargz.csi.test", "v0", "node1", b))
+	go s.Serve(l)
+	defer s.Stop()
+	conn, err := grpc.Dial("unix://"+addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	ctx := context.Background()
+
+	info, err := csi.NewIdentityClient(conn).GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+	if err != nil || info.Name != "stargz.csi.test" || info.VendorVersion != "v0" {
+		t.Errorf("unexpected plugin info %+v: %v", info, err)
+	}
+	node := csi.NewNodeClient(conn)
+	if ni, err := node.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{}); err != nil || ni.NodeId != "node1" {
+		t.Errorf("unexpected node info %+v: %v", ni, err)
+	}
+
+	mountCap := &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}}
+	for _, tt := range []struct {
+		name string
+		req  *csi.NodePublishVolumeRequest
+	}{
+		{"no volume", &csi.NodePublishVolumeRequest{TargetPath: "/a", VolumeCapability: mountCap, VolumeContext: map[string]string{ImageKey: "foo"}}},
+		{"no target", &csi.NodePublishVolumeRequest{VolumeId: "v", VolumeCapability: mountCap, VolumeContext: map[string]string{ImageKey: "foo"}}},
+		{"no image", &csi.NodePublishVolumeRequest{VolumeId: "v", TargetPath: "/a", VolumeCapability: mountCap}},
+		{"block", &csi.NodePublishVolumeRequest{VolumeId: "v", TargetPath: "/a", VolumeCapability: &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}}, VolumeContext: map[string]string{ImageKey: "foo"}}},
+		{"writer", &csi.NodePublishVolumeRequest{VolumeId: "v", TargetPath: "/a", VolumeCapability: &csi.VolumeCapability{AccessType: mountCap.AccessType, AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER}}, VolumeContext: map[string]string{ImageKey: "foo"}}},
+	} {
+		if _, err := node.NodePublishVolume(ctx, tt.req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: invalid request must be rejected: %v", tt.name, err)
+		}
+	}
+
+	// A volume can be published on several targets.
+	for _, target := range []string{"/pod1/vol", "/pod2/vol/"} {
+		if _, err := node.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+			VolumeId:         "model",
+			TargetPath:       target,
+			VolumeCapability: &csi.VolumeCapability{AccessType: mountCap.AccessType, AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER}},
+			Secrets:          map[string]string{usernameKey: "user"},
+			VolumeContext:    map[string]string{ImageKey: "example.test/model:v1"},
+		}); err != nil {
+			t.Fatalf("failed to publish volume on %q: %v", target, err)
+		}
+	}
+	if len(b.mounts) != 2 || b.mounts["/pod1/vol"] != "example.test/model:v1" || b.mounts["/pod2/vol"] != "example.test/model:v1" {
+		t.Errorf("unexpected mounts %v", b.mounts)
+	}
+	if b.keys["/pod1/vol"] == b.keys["/pod2/vol"] {
+		t.Errorf("mounts on different targets must have different keys")
+	}
+	if b.secrets[usernameKey] != "user" {
+		t.Errorf("secrets must be passed to the backend: %v", b.secrets)
+	}
+
+	if _, err := node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "model", TargetPath: "/pod1/vol"}); err != nil {
+		t.Fatalf("failed to unpublish volume: %v", err)
+	}
+	if _, ok := b.mounts["/pod1/vol"]; ok || len(b.mounts) != 1 {
+		t.Errorf("unexpected mounts after unpublish %v", b.mounts)
+	}
+}
+
+// TestDriverLock tests concurrent operations on the same target are aborted.
+func TestDriverLock(t *testing.T) {
+	d := NewDriver("test", "v0", "node1", &testBackend{})
+	release, err := d.lock("/a")
+	if err != nil {
+		t.Fatalf("failed to lock: %v", err)
+	}
+	if _, err := d.lock("/a"); status.Code(err) != codes.Aborted {
+		t.Errorf("concurrent operation must be aborted: %v", err)
+	}
+	if _, err := d.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "v", TargetPath: "/a/"}); status.Code(err) != codes.Aborted {
+		t.Errorf("concurrent unpublish must be aborted: %v", err)
+	}
+	release()
+	r, err := d.lock("/a")
+	if err != nil {
+		t.Fatalf("failed to lock released target: %v", err)
+	}
+	r()
+}
@@ -0,0 +1,398 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// WithRemovedFiles option specifies the files removed from the base blob by
+// Append. When a directory is specified, all of its descendants are removed as
+// well. Paths are normalized in the same way as WithPrioritizedFiles.
+func WithRemovedFiles(files []string) Option {
+	return func(o *options) error {
+		o.removedFiles = files
+		return nil
+	}
+}
+
+// Append builds a new eStargz blob by adding the entries of the tar blob to the
+// existing eStargz blob esgz. Entries in esgz which are overwritten by the tar
+// blob or specified by WithRemovedFiles option are removed.
+//
+// The compressed bytes of esgz are reused byte-for-byte except for the gzip
+// streams containing removed entries, which are recompressed without them. So
+// only the appended entries (and the TOC) need to be compressed and the
+// unmodified chunks of the new blob are identical to the ones in esgz.
+// WithChunkSize and WithCompressionLevel options are applied to the appended
+// entries. Prioritized files options are ignored and the prefetch landmark of
+// esgz (if any) is kept as is.
+func Append(esgz *io.SectionReader, tarBlob io.Reader, opt ...Option) (_ *Blob, rErr error) {
+	var opts options
+	opts.compressionLevel = gzip.BestCompression // BestCompression by default
+	for _, o := range opt {
+		if err := o(&opts); err != nil {
+			return nil, err
+		}
+	}
+	layerFiles := newTempFiles()
+	defer func() {
+		if rErr != nil {
+			if err := layerFiles.CleanupAll(); err != nil {
+				rErr = errors.Wrapf(rErr, "failed to cleanup tmp files: %v", err)
+			}
+		}
+	}()
+	tocOffset, _, err := OpenFooter(esgz)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse footer")
+	}
+	tr, err := openTOC(esgz)
+	if err != nil {
+		return nil, err
+	}
+	toc := new(jtoc)
+	if err := json.NewDecoder(tr).Decode(&toc); err != nil {
+		return nil, fmt.Errorf("error decoding TOC JSON: %v", err)
+	}
+	fillOwnerNames(toc.Entries)
+
+	// Compress the appended entries first so that we know which entries
+	// in the base blob are overwritten.
+	appendFile, err := layerFiles.TempFile("", "esgzappend")
+	if err != nil {
+		return nil, err
+	}
+	aw := NewWriterLevel(appendFile, opts.compressionLevel)
+	aw.ChunkSize = opts.chunkSize
+	if err := aw.AppendTar(tarBlob); err != nil {
+		return nil, errors.Wrap(err, "failed to append tar")
+	}
+	removed := &removedSet{
+		names:    make(map[string]struct{}),
+		subtrees: make(map[string]struct{}),
+	}
+	added := make(map[string]struct{})
+	for _, e := range aw.toc.Entries {
+		if e.Type == "chunk" {
+			continue
+		}
+		name := cleanEntryName(e.Name)
+		added[name] = struct{}{}
+		if e.Type == "dir" {
+			removed.names[name] = struct{}{} // metadata is overwritten
+		} else {
+			removed.subtrees[name] = struct{}{}
+		}
+	}
+	for _, f := range opts.removedFiles {
+		removed.subtrees[cleanEntryName(f)] = struct{}{}
+	}
+
+	// Hardlinks must follow their targets in the tar stream so the links
+	// to the overwritten files are moved to the tail.
+	var (
+		moved    []*entry
+		retained []*TOCEntry
+		lastName string
+	)
+	for _, e := range toc.Entries {
+		if e.Type != "chunk" {
+			lastName = cleanEntryName(e.Name)
+		}
+		if removed.has(lastName) {
+			continue
+		}
+		if e.Type == "hardlink" {
+			if target := cleanEntryName(e.LinkName); removed.has(target) {
+				if _, ok := added[target]; !ok {
+					return nil, fmt.Errorf("hardlink %q points to the removed file %q", e.Name, e.LinkName)
+				}
+				removed.names[lastName] = struct{}{}
+				moved = append(moved, &entry{header: linkHeader(e), payload: bytes.NewReader(nil)})
+				continue
+			}
+		}
+		retained = append(retained, e)
+	}
+	if len(moved) > 0 {
+		if err := aw.AppendTar(readerFromEntries(moved...)); err != nil {
+			return nil, errors.Wrap(err, "failed to append moved hardlinks")
+		}
+	}
+
+	// Copy the gzip streams of the base blob, dropping the removed entries.
+	members, err := gzipMembers(io.NewSectionReader(esgz, 0, tocOffset))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse gzip streams")
+	}
+	removedRanges, err := tarRanges(io.NewSectionReader(esgz, 0, tocOffset), removed.has)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse tar entries")
+	}
+	baseFile, err := layerFiles.TempFile("", "esgzbase")
+	if err != nil {
+		return nil, err
+	}
+	bw := NewWriterLevel(baseFile, opts.compressionLevel)
+	offsets, err := copyMembers(bw.cw, esgz, members, removedRanges, opts.compressionLevel)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range retained {
+		if (e.Type == "reg" && e.Size > 0) || e.Type == "chunk" {
+			off, ok := offsets[e.Offset]
+			if !ok {
+				return nil, fmt.Errorf("gzip stream of %q at %d not found", e.Name, e.Offset)
+			}
+			e.Offset = off
+		}
+		e.Uname = bw.nameIfChanged(&bw.lastUsername, e.UID, e.Uname)
+		e.Gname = bw.nameIfChanged(&bw.lastGroupname, e.GID, e.Gname)
+		bw.toc.Entries = append(bw.toc.Entries, e)
+	}
+	if toc.Version > bw.toc.Version {
+		bw.toc.Version = toc.Version
+	}
+
+	tocAndFooter, tocDgst, err := closeWithCombine(opts.compressionLevel, opts.sourceDateEpoch, bw, aw)
+	if err != nil {
+		return nil, err
+	}
+	return newBlob([]*os.File{baseFile, appendFile}, tocAndFooter, tocDgst, layerFiles)
+}
+
+// removedSet is a set of entry names removed from the base blob of Append.
+type removedSet struct {
+	names    map[string]struct{} // removed entries
+	subtrees map[string]struct{} // removed entries with their descendants
+}
+
+func (s *removedSet) has(name string) bool {
+	if _, ok := s.names[name]; ok {
+		return true
+	}
+	for p := name; ; p = parentDir(p) {
+		if _, ok := s.subtrees[p]; ok {
+			return true
+		}
+		if p == "" {
+			return false
+		}
+	}
+}
+
+// fillOwnerNames populates the user and group names omitted in the serialized
+// TOC so that the names survive even if the entry where they appeared first is
+// removed.
+func fillOwnerNames(entries []*TOCEntry) {
+	uname, gname := map[int]string{}, map[int]string{}
+	for _, e := range entries {
+		if e.Type == "chunk" {
+			continue
+		}
+		if e.Uname != "" {
+			uname[e.UID] = e.Uname
+		} else {
+			e.Uname = uname[e.UID]
+		}
+		if e.Gname != "" {
+			gname[e.GID] = e.Gname
+		} else {
+			e.Gname = gname[e.GID]
+		}
+	}
+}
+
+// linkHeader returns the tar header of the hardlink TOCEntry.
+func linkHeader(e *TOCEntry) *tar.Header {
+	h := &tar.Header{
+		Typeflag: tar.TypeLink,
+		Name:     e.Name,
+		Linkname: e.LinkName,
+		Mode:     e.Mode,
+		Uid:      e.UID,
+		Gid:      e.GID,
+		Uname:    e.Uname,
+		Gname:    e.Gname,
+	}
+	h.ModTime, _ = time.Parse(time.RFC3339, e.ModTime3339)
+	if len(e.Xattrs) > 0 {
+		h.PAXRecords = make(map[string]string, len(e.Xattrs))
+		for k, v := range e.Xattrs {
+			h.PAXRecords["SCHILY.xattr."+k] = string(v)
+		}
+	}
+	return h
+}
+
+// gzipMember is the location of a gzip stream in the blob.
+type gzipMember struct {
+	offset, size   int64 // range in the compressed blob
+	uOffset, uSize int64 // range in the uncompressed tar
+}
+
+// gzipMembers returns the locations of all gzip streams in the passed reader.
+func gzipMembers(sr *io.SectionReader) (members []gzipMember, _ error) {
+	cw := &countWriter{w: ioutil.Discard}
+	br := bufio.NewReader(io.TeeReader(sr, cw))
+	var (
+		zr      *gzip.Reader
+		uOffset int64
+		err     error
+	)
+	for {
+		if _, err := br.Peek(1); err == io.EOF {
+			return members, nil
+		} else if err != nil {
+			return nil, err
+		}
+		offset := cw.n - int64(br.Buffered())
+		if zr == nil {
+			zr, err = gzip.NewReader(br)
+		} else {
+			err = zr.Reset(br)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "malformed gzip header at %d", offset)
+		}
+		zr.Multistream(false)
+		n, err := io.Copy(ioutil.Discard, zr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decompress gzip stream at %d", offset)
+		}
+		members = append(members, gzipMember{
+			offset:  offset,
+			size:    cw.n - int64(br.Buffered()) - offset,
+			uOffset: uOffset,
+			uSize:   n,
+		})
+		uOffset += n
+	}
+}
+
+// byteRange is a range [start, end) in the uncompressed tar.
+type byteRange struct{ start, end int64 }
+
+// tarRanges returns the ranges of the tar entries (headers, payloads and
+// paddings) matched by the passed function. Adjacent ranges are merged.
+func tarRanges(sr *io.SectionReader, match func(name string) bool) (ranges []byteRange, _ error) {
+	zr, err := gzip.NewReader(sr)
+	if err != nil {
+		return nil, err
+	}
+	cw := &countWriter{w: ioutil.Discard}
+	tr := tar.NewReader(io.TeeReader(zr, cw))
+	var start int64
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return ranges, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+			return nil, err
+		}
+		end := cw.n
+		if pad := end % 512; pad != 0 {
+			end += 512 - pad
+		}
+		if match(cleanEntryName(h.Name)) {
+			if l := len(ranges) - 1; l >= 0 && ranges[l].end == start {
+				ranges[l].end = end
+			} else {
+				ranges = append(ranges, byteRange{start, end})
+			}
+		}
+		start = end
+	}
+}
+
+// copyMembers copies the gzip streams to w. Streams overlapping with removed
+// ranges are recompressed without the bytes in these ranges. This returns the
+// map from the original offset of each stream to the new one.
+func copyMembers(w *countWriter, src *io.SectionReader, members []gzipMember, removed []byteRange, compressionLevel int) (map[int64]int64, error) {
+	offsets := make(map[int64]int64)
+	for _, m := range members {
+		uEnd := m.uOffset + m.uSize
+		i := sort.Search(len(removed), func(i int) bool { return removed[i].end > m.uOffset })
+		if i == len(removed) || removed[i].start >= uEnd {
+			// Nothing is removed from this stream. Reuse it.
+			offsets[m.offset] = w.n
+			if _, err := io.Copy(w, io.NewSectionReader(src, m.offset, m.size)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		zr, err := gzip.NewReader(io.NewSectionReader(src, m.offset, m.size))
+		if err != nil {
+			return nil, err
+		}
+		zr.Multistream(false)
+		var (
+			offset = w.n
+			zw     *gzip.Writer
+			pos    = m.uOffset
+		)
+		for pos < uEnd {
+			next := uEnd
+			if i < len(removed) && removed[i].start <= pos {
+				// Skip the removed bytes
+				if removed[i].end < next {
+					next = removed[i].end
+				}
+				if _, err := io.CopyN(ioutil.Discard, zr, next-pos); err != nil {
+					return nil, err
+				}
+				i++
+			} else {
+				if i < len(removed) && removed[i].start < next {
+					next = removed[i].start
+				}
+				if zw == nil {
+					if pos == m.uOffset {
+						offsets[m.offset] = offset
+					}
+					zw, _ = gzip.NewWriterLevel(w, compressionLevel)
+				}
+				if _, err := io.CopyN(zw, zr, next-pos); err != nil {
+					return nil, err
+				}
+			}
+			pos = next
+		}
+		if zw != nil {
+			if err := zw.Close(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return offsets, nil
+}
@@ -0,0 +1,209 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestAppend(t *testing.T) {
+	const chunkSize = 4
+	base := buildTarStatic(t, tarOf(
+		file("foo", "unmodified file", owner{uid: 1000, gid: 1000}),
+		file("bar", "old contents"),
+		link("barlink", "bar"),
+		dir("a/"),
+		file("a/x", "removed"),
+		file("a/y", "kept"),
+		dir("b/"),
+		file("b/z", "replaced by file b"),
+		symlink("sym", "foo"),
+	), "")
+	baseBlob, err := Build(base, WithChunkSize(chunkSize), WithPrioritizedFiles([]string{"foo"}))
+	if err != nil {
+		t.Fatalf("failed to build base blob: %v", err)
+	}
+	baseData, err := ioutil.ReadAll(baseBlob)
+	baseBlob.Close()
+	if err != nil {
+		t.Fatalf("failed to read base blob: %v", err)
+	}
+	baseSR := io.NewSectionReader(bytes.NewReader(baseData), 0, int64(len(baseData)))
+
+	patch, cancel := buildTar(t, tarOf(
+		file("bar", "new contents"),
+		file("b", "now a file"),
+		file("new", "added file"),
+	), "")
+	defer cancel()
+	blob, err := Append(baseSR, patch, WithChunkSize(chunkSize), WithRemovedFiles([]string{"/a/x", "sym"}))
+	if err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+	data, err := ioutil.ReadAll(blob)
+	blob.Close()
+	if err != nil {
+		t.Fatalf("failed to read appended blob: %v", err)
+	}
+	if got, want := blob.DiffID(), diffIDOfGz(t, data); got.String() != want {
+		t.Errorf("DiffID = %q; want %q", got, want)
+	}
+	sr := io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data)))
+	r, err := Open(sr)
+	if err != nil {
+		t.Fatalf("failed to open appended blob: %v", err)
+	}
+	v, err := r.VerifyTOC(blob.TOCDigest())
+	if err != nil {
+		t.Fatalf("failed to verify TOC: %v", err)
+	}
+
+	// Contents
+	for name, want := range map[string]string{
+		"foo":            "unmodified file",
+		"bar":            "new contents",
+		"barlink":        "new contents",
+		"a/y":            "kept",
+		"b":              "now a file",
+		"new":            "added file",
+		PrefetchLandmark: string([]byte{landmarkContents}),
+	} {
+		e, ok := r.Lookup(name)
+		if !ok {
+			t.Errorf("%q not found", name)
+			continue
+		}
+		for off := int64(0); off < e.Size; off += chunkSize {
+			ce, ok := r.ChunkEntryForOffset(e.Name, off)
+			if !ok {
+				t.Fatalf("chunk of %q at %d not found", name, off)
+			}
+			verifier, err := v.Verifier(ce)
+			if err != nil {
+				t.Fatalf("failed to get verifier of %q: %v", name, err)
+			}
+			zr, err := gzip.NewReader(io.NewSectionReader(sr, ce.Offset, ce.NextOffset()-ce.Offset))
+			if err != nil {
+				t.Fatalf("failed to decompress chunk of %q: %v", name, err)
+			}
+			if _, err := io.CopyN(verifier, zr, ce.ChunkSize); err != nil {
+				t.Fatalf("failed to read chunk of %q: %v", name, err)
+			}
+			if !verifier.Verified() {
+				t.Errorf("chunk of %q at %d isn't verified", name, off)
+			}
+		}
+		fr, err := r.OpenFile(name)
+		if err != nil {
+			t.Fatalf("failed to open %q: %v", name, err)
+		}
+		got, err := ioutil.ReadAll(io.NewSectionReader(fr, 0, e.Size))
+		if err != nil {
+			t.Fatalf("failed to read %q: %v", name, err)
+		}
+		if string(got) != want {
+			t.Errorf("contents of %q = %q; want %q", name, got, want)
+		}
+	}
+	for _, name := range []string{"a/x", "b/z", "sym"} {
+		if _, ok := r.Lookup(name); ok {
+			t.Errorf("%q must be removed", name)
+		}
+	}
+	if e, ok := r.Lookup("foo"); !ok || e.UID != 1000 {
+		t.Errorf("owner of foo must be kept: %+v", e)
+	}
+
+	// Unmodified chunks must be reused as is
+	members, err := gzipMembers(io.NewSectionReader(baseSR, 0, mustTOCOffset(t, baseSR)))
+	if err != nil {
+		t.Fatalf("failed to parse base blob: %v", err)
+	}
+	baseReader, err := Open(baseSR)
+	if err != nil {
+		t.Fatalf("failed to open base blob: %v", err)
+	}
+	fooEnt, _ := baseReader.Lookup("foo")
+	for off := int64(0); off < fooEnt.Size; off += chunkSize {
+		ce, _ := baseReader.ChunkEntryForOffset("foo", off)
+		for _, m := range members {
+			if m.offset == ce.Offset && !bytes.Contains(data, baseData[m.offset:m.offset+m.size]) {
+				t.Errorf("chunk of foo at %d is not reused", off)
+			}
+		}
+	}
+
+	// The uncompressed tar must not contain duplicated entries and hardlinks
+	// must follow their targets.
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to decompress appended blob: %v", err)
+	}
+	tr := tar.NewReader(zr)
+	seen := make(map[string]bool)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("failed to read tar: %v", err)
+		}
+		name := cleanEntryName(h.Name)
+		if seen[name] {
+			t.Errorf("duplicated entry %q", name)
+		}
+		if h.Typeflag == tar.TypeLink && !seen[cleanEntryName(h.Linkname)] {
+			t.Errorf("hardlink %q precedes its target %q", name, h.Linkname)
+		}
+		seen[name] = true
+	}
+}
+
+func TestAppendRemovedLinkTarget(t *testing.T) {
+	base := buildTarStatic(t, tarOf(
+		file("foo", "contents"),
+		link("foolink", "foo"),
+	), "")
+	baseBlob, err := Build(base)
+	if err != nil {
+		t.Fatalf("failed to build base blob: %v", err)
+	}
+	defer baseBlob.Close()
+	baseData, err := ioutil.ReadAll(baseBlob)
+	if err != nil {
+		t.Fatalf("failed to read base blob: %v", err)
+	}
+	patch, cancel := buildTar(t, nil, "")
+	defer cancel()
+	if _, err := Append(io.NewSectionReader(bytes.NewReader(baseData), 0, int64(len(baseData))),
+		patch, WithRemovedFiles([]string{"foo"})); err == nil {
+		t.Errorf("removing the target of a hardlink must fail")
+	}
+}
+
+func mustTOCOffset(t *testing.T, sr *io.SectionReader) int64 {
+	off, _, err := OpenFooter(sr)
+	if err != nil {
+		t.Fatalf("failed to parse footer: %v", err)
+	}
+	return off
+}
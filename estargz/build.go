@@ -32,9 +32,10 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
-	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/containerd/stargz-snapshotter/estargz/errorutil"
 	digest "github.com/opencontainers/go-digest"
@@ -47,6 +48,10 @@ type options struct {
 	compressionLevel       int
 	prioritizedFiles       []string
 	missedPrioritizedFiles *[]string
+	removedFiles           []string
+	excludedPaths          []string
+	prefetchProfiles       map[string][]string
+	sourceDateEpoch        time.Time
 }
 
 type Option func(o *options) error
@@ -94,6 +99,65 @@ func WithAllowPrioritizeNotFound(missedFiles *[]string) Option {
 	}
 }
 
+// WithPrefetchProfiles option specifies named prefetch profiles (e.g. "serve"
+// and "test"), each of which lists the files to prefetch when the blob is used
+// for the startup path of the profile. The files follow the prioritized files
+// and each profile is recorded to its landmark (see PrefetchProfileLandmark).
+// Profile names must consist of alphanumerics, '-', '_' and '.'. Files not
+// found in the input tar are handled in the same way as prioritized files.
+func WithPrefetchProfiles(profiles map[string][]string) Option {
+	return func(o *options) error {
+		for name := range profiles {
+			if !validPrefetchProfileName(name) {
+				return fmt.Errorf("WithPrefetchProfiles: invalid profile name %q", name)
+			}
+		}
+		o.prefetchProfiles = profiles
+		return nil
+	}
+}
+
+// WithExcludedPaths option specifies the patterns of the files excluded from
+// the blob built by Build. Patterns follow path.Match and are matched against
+// the paths normalized in the same way as WithPrioritizedFiles (e.g.
+// "var/cache/*" and "/usr/share/doc"). When a directory is excluded, all of
+// its descendants are excluded as well.
+func WithExcludedPaths(patterns []string) Option {
+	return func(o *options) error {
+		for _, p := range patterns {
+			if _, err := path.Match(cleanEntryName(p), ""); err != nil {
+				return fmt.Errorf("WithExcludedPaths: invalid pattern %q: %v", p, err)
+			}
+		}
+		o.excludedPaths = patterns
+		return nil
+	}
+}
+
+// WithSourceDateEpoch option specifies the modification time of the files
+// added by Build and Append (i.e. landmarks and TOC) instead of the zero time,
+// following SOURCE_DATE_EPOCH of reproducible builds.
+// See also: https://reproducible-builds.org/specs/source-date-epoch/
+func WithSourceDateEpoch(t time.Time) Option {
+	return func(o *options) error {
+		o.sourceDateEpoch = t
+		return nil
+	}
+}
+
+func validPrefetchProfileName(name string) bool {
+	if name == "" || name == "." || name == ".." {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') &&
+			c != '-' && c != '_' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
 // Blob is an eStargz blob.
 type Blob struct {
 	io.ReadCloser
@@ -115,8 +179,9 @@ func (b *Blob) TOCDigest() digest.Digest {
 // Build builds an eStargz blob which is an extended version of stargz, from tar blob passed
 // through the argument. If there are some prioritized files are listed in the option, these
 // files are grouped as "prioritized" and can be used for runtime optimization (e.g. prefetch).
-// This function builds a blob in parallel, with dividing that blob into several (at least the
-// number of runtime.GOMAXPROCS(0)) sub-blobs.
+// This function builds a blob in parallel, with dividing that blob into several (at least
+// buildPartsNum) sub-blobs. The number doesn't depend on the host so that the same input and
+// options always result in the same blob.
 func Build(tarBlob *io.SectionReader, opt ...Option) (_ *Blob, rErr error) {
 	var opts options
 	opts.compressionLevel = gzip.BestCompression // BestCompression by default
@@ -133,11 +198,16 @@ func Build(tarBlob *io.SectionReader, opt ...Option) (_ *Blob, rErr error) {
 			}
 		}
 	}()
-	entries, err := sortEntries(tarBlob, opts.prioritizedFiles, opts.missedPrioritizedFiles)
+	entries, err := sortEntries(tarBlob, opts.prioritizedFiles, opts.prefetchProfiles, opts.missedPrioritizedFiles, opts.sourceDateEpoch)
 	if err != nil {
 		return nil, err
 	}
-	tarParts := divideEntries(entries, runtime.GOMAXPROCS(0))
+	if len(opts.excludedPaths) > 0 {
+		if entries, err = excludeEntries(entries, opts.excludedPaths); err != nil {
+			return nil, err
+		}
+	}
+	tarParts := divideEntries(entries, buildPartsNum)
 	writers := make([]*Writer, len(tarParts))
 	payloads := make([]*os.File, len(tarParts))
 	var mu sync.Mutex
@@ -152,6 +222,14 @@ func Build(tarBlob *io.SectionReader, opt ...Option) (_ *Blob, rErr error) {
 			}
 			sw := NewWriterLevel(esgzFile, opts.compressionLevel)
 			sw.ChunkSize = opts.chunkSize
+			for _, e := range parts {
+				if e.sparse {
+					if sw.sparseFiles == nil {
+						sw.sparseFiles = make(map[string]bool)
+					}
+					sw.sparseFiles[e.header.Name] = true
+				}
+			}
 			if err := sw.AppendTar(readerFromEntries(parts...)); err != nil {
 				return err
 			}
@@ -166,11 +244,17 @@ func Build(tarBlob *io.SectionReader, opt ...Option) (_ *Blob, rErr error) {
 		rErr = err
 		return nil, err
 	}
-	tocAndFooter, tocDgst, err := closeWithCombine(opts.compressionLevel, writers...)
+	tocAndFooter, tocDgst, err := closeWithCombine(opts.compressionLevel, opts.sourceDateEpoch, writers...)
 	if err != nil {
 		rErr = err
 		return nil, err
 	}
+	return newBlob(payloads, tocAndFooter, tocDgst, layerFiles)
+}
+
+// newBlob returns a Blob which concatenates the payloads and the TOC and footer.
+// The temporary files are cleaned up when the Blob is closed.
+func newBlob(payloads []*os.File, tocAndFooter io.Reader, tocDgst digest.Digest, layerFiles *tempFiles) (*Blob, error) {
 	var rs []io.Reader
 	for _, p := range payloads {
 		fs, err := fileSectionReader(p)
@@ -208,7 +292,7 @@ func Build(tarBlob *io.SectionReader, opt ...Option) (_ *Blob, rErr error) {
 // Writers doesn't write TOC and footer to the underlying writers so they can be
 // combined into a single eStargz and tocAndFooter returned by this function can
 // be appended at the tail of that combined blob.
-func closeWithCombine(compressionLevel int, ws ...*Writer) (tocAndFooter io.Reader, tocDgst digest.Digest, err error) {
+func closeWithCombine(compressionLevel int, modTime time.Time, ws ...*Writer) (tocAndFooter io.Reader, tocDgst digest.Digest, err error) {
 	if len(ws) == 0 {
 		return nil, "", fmt.Errorf("at least one writer must be passed")
 	}
@@ -255,6 +339,7 @@ func closeWithCombine(compressionLevel int, ws ...*Writer) (tocAndFooter io.Read
 			Typeflag: tar.TypeReg,
 			Name:     TOCTarName,
 			Size:     int64(len(tocJSON)),
+			ModTime:  modTime,
 		}); err != nil {
 			pw.CloseWithError(err)
 			return
@@ -303,12 +388,16 @@ func divideEntries(entries []*entry, minPartsNum int) (set [][]*entry) {
 	return
 }
 
+// buildPartsNum is the number of sub-blobs built in parallel by Build.
+const buildPartsNum = 16
+
 var errNotFound = errors.New("not found")
 
 // sortEntries reads the specified tar blob and returns a list of tar entries.
 // If some of prioritized files are specified, the list starts from these
-// files with keeping the order specified by the argument.
-func sortEntries(in io.ReaderAt, prioritized []string, missedPrioritized *[]string) ([]*entry, error) {
+// files with keeping the order specified by the argument. Files of prefetch
+// profiles follow the prefetch landmark in the order of the profile names.
+func sortEntries(in io.ReaderAt, prioritized []string, profiles map[string][]string, missedPrioritized *[]string, modTime time.Time) ([]*entry, error) {
 
 	// Import tar file.
 	intar, err := importTar(in)
@@ -327,12 +416,14 @@ func sortEntries(in io.ReaderAt, prioritized []string, missedPrioritized *[]stri
 			return nil, errors.Wrap(err, "failed to sort tar entries")
 		}
 	}
+
 	if len(prioritized) == 0 {
 		sorted.add(&entry{
 			header: &tar.Header{
 				Name:     NoPrefetchLandmark,
 				Typeflag: tar.TypeReg,
 				Size:     int64(len([]byte{landmarkContents})),
+				ModTime:  modTime,
 			},
 			payload: bytes.NewReader([]byte{landmarkContents}),
 		})
@@ -342,11 +433,46 @@ func sortEntries(in io.ReaderAt, prioritized []string, missedPrioritized *[]stri
 				Name:     PrefetchLandmark,
 				Typeflag: tar.TypeReg,
 				Size:     int64(len([]byte{landmarkContents})),
+				ModTime:  modTime,
 			},
 			payload: bytes.NewReader([]byte{landmarkContents}),
 		})
 	}
 
+	// Files of the profiles follow the landmark so they aren't prefetched by
+	// default. Each profile is recorded to its landmark after the files.
+	var names []string
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var landmarks []*entry
+	for _, name := range names {
+		var list bytes.Buffer
+		for _, l := range profiles[name] {
+			if err := moveRec(l, intar, sorted); err != nil {
+				if errors.Is(err, errNotFound) && missedPrioritized != nil {
+					*missedPrioritized = append(*missedPrioritized, l)
+					continue // allow not found
+				}
+				return nil, errors.Wrapf(err, "failed to sort tar entries of profile %q", name)
+			}
+			fmt.Fprintln(&list, cleanEntryName(l))
+		}
+		landmarks = append(landmarks, &entry{
+			header: &tar.Header{
+				Name:     PrefetchProfileLandmark(name),
+				Typeflag: tar.TypeReg,
+				Size:     int64(list.Len()),
+				ModTime:  modTime,
+			},
+			payload: bytes.NewReader(list.Bytes()),
+		})
+	}
+	for _, e := range landmarks {
+		sorted.add(e)
+	}
+
 	// Dump all entry and concatinate them.
 	return append(sorted.dump(), intar.dump()...), nil
 }
@@ -382,7 +508,7 @@ func importTar(in io.ReaderAt) (*tarFile, error) {
 	tr := tar.NewReader(pw)
 
 	// Walk through all nodes.
-	for {
+	for index := 0; ; index++ {
 		// Fetch and parse next header.
 		h, err := tr.Next()
 		if err != nil {
@@ -392,8 +518,7 @@ func importTar(in io.ReaderAt) (*tarFile, error) {
 				return nil, errors.Wrap(err, "failed to parse tar file")
 			}
 		}
-		switch cleanEntryName(h.Name) {
-		case PrefetchLandmark, NoPrefetchLandmark:
+		if IsLandmark(cleanEntryName(h.Name)) {
 			// Ignore existing landmark
 			continue
 		}
@@ -402,15 +527,47 @@ func importTar(in io.ReaderAt) (*tarFile, error) {
 		if _, ok := tf.get(h.Name); ok {
 			tf.remove(h.Name)
 		}
-		tf.add(&entry{
+		e := &entry{
 			header:  h,
 			payload: io.NewSectionReader(in, pw.currentPos(), h.Size),
-		})
+		}
+		if isSparseHeader(h) {
+			// The payload of a sparse file is packed in the tar so it's
+			// read through archive/tar which expands the holes.
+			e.header, e.sparse = regHeaderOfSparse(h), true
+			e.payload = &sparsePayload{in: in, index: index}
+		}
+		tf.add(e)
 	}
 
 	return tf, nil
 }
 
+// sparsePayload is the contents of the index-th entry of the tar, which is a
+// sparse file. The entry is located on the first read.
+type sparsePayload struct {
+	in    io.ReaderAt
+	index int
+	r     io.Reader
+}
+
+func (sp *sparsePayload) Read(p []byte) (int, error) {
+	if sp.r == nil {
+		pw, err := newCountReader(sp.in)
+		if err != nil {
+			return 0, err
+		}
+		tr := tar.NewReader(pw)
+		for i := 0; i <= sp.index; i++ {
+			if _, err := tr.Next(); err != nil {
+				return 0, errors.Wrap(err, "failed to locate sparse file")
+			}
+		}
+		sp.r = tr
+	}
+	return sp.r.Read(p)
+}
+
 func moveRec(name string, in *tarFile, out *tarFile) error {
 	name = cleanEntryName(name)
 	if name == "" { // root directory. stop recursion.
@@ -447,7 +604,41 @@ func moveRec(name string, in *tarFile, out *tarFile) error {
 
 type entry struct {
 	header  *tar.Header
-	payload io.ReadSeeker
+	payload io.Reader
+	sparse  bool // header is a sparse file converted to a regular file
+}
+
+// excludeEntries removes the entries matching the patterns and their
+// descendants. Landmarks are never excluded.
+func excludeEntries(entries []*entry, patterns []string) ([]*entry, error) {
+	excluded := func(name string) bool {
+		for ; name != "." && name != "" && name != "/"; name = path.Dir(name) {
+			for _, p := range patterns {
+				if ok, _ := path.Match(cleanEntryName(p), name); ok {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	var (
+		res     []*entry
+		removed = make(map[string]struct{})
+	)
+	for _, e := range entries {
+		name := cleanEntryName(e.header.Name)
+		if !IsLandmark(name) && excluded(name) {
+			removed[name] = struct{}{}
+			continue
+		}
+		if e.header.Typeflag == tar.TypeLink {
+			if _, ok := removed[cleanEntryName(e.header.Linkname)]; ok {
+				return nil, fmt.Errorf("hardlink %q points to the excluded file %q", e.header.Name, e.header.Linkname)
+			}
+		}
+		res = append(res, e)
+	}
+	return res, nil
 }
 
 type tarFile struct {
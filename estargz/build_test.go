@@ -31,6 +31,8 @@ import (
 	"io"
 	"io/ioutil"
 	"reflect"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 
@@ -117,7 +119,7 @@ func TestBuild(t *testing.T) {
 
 					tarBlob := buildTarStatic(t, tt.in, prefix)
 					// Test divideEntries()
-					entries, err := sortEntries(tarBlob, nil, nil) // identical order
+					entries, err := sortEntries(tarBlob, nil, nil, nil, time.Time{}) // identical order
 					if err != nil {
 						t.Fatalf("faield to parse tar: %v", err)
 					}
@@ -444,6 +446,7 @@ func TestSort(t *testing.T) {
 		name             string
 		in               []tarEntry
 		log              []string // MUST NOT include "./" prefix here
+		profiles         map[string][]string
 		want             []tarEntry
 		wantFail         bool
 		allowMissedFiles []string
@@ -755,6 +758,48 @@ func TestSort(t *testing.T) {
 				file("/foo.txt", "foo"),
 			),
 		},
+		{
+			name: "profiles",
+			in: tarOf(
+				file("foo.txt", "foo"),
+				dir("bar/"),
+				file("bar/baz.txt", "baz"),
+				file("bar/bar.txt", "bar"),
+				file("baa.txt", "baa"),
+			),
+			log: []string{"foo.txt"},
+			profiles: map[string][]string{
+				"test":  {"baa.txt", "foo.txt"},
+				"serve": {"bar/bar.txt"},
+			},
+			want: tarOf(
+				file("foo.txt", "foo"),
+				prefetchLandmark(),
+				dir("bar/"),
+				file("bar/bar.txt", "bar"),
+				file("baa.txt", "baa"),
+				profileLandmark("serve", "bar/bar.txt"),
+				profileLandmark("test", "baa.txt", "foo.txt"),
+				file("bar/baz.txt", "baz"),
+			),
+		},
+		{
+			name: "profiles_without_log",
+			in: tarOf(
+				file("foo.txt", "foo"),
+				file("baa.txt", "baa"),
+			),
+			profiles: map[string][]string{
+				"serve": {"baa.txt", "dummy"},
+			},
+			allowMissedFiles: []string{"dummy"},
+			want: tarOf(
+				noPrefetchLandmark(),
+				file("baa.txt", "baa"),
+				profileLandmark("serve", "baa.txt"),
+				file("foo.txt", "foo"),
+			),
+		},
 	}
 	for _, tt := range tests {
 		for _, logprefix := range allowedPrefix {
@@ -768,6 +813,15 @@ func TestSort(t *testing.T) {
 						pfiles = append(pfiles, logprefix+f)
 					}
 					var opts []Option
+					if tt.profiles != nil {
+						profiles := make(map[string][]string)
+						for name, files := range tt.profiles {
+							for _, f := range files {
+								profiles[name] = append(profiles[name], logprefix+f)
+							}
+						}
+						opts = append(opts, WithPrefetchProfiles(profiles))
+					}
 					var missedFiles []string
 					if tt.allowMissedFiles != nil {
 						opts = append(opts, WithAllowPrioritizeNotFound(&missedFiles))
@@ -1589,6 +1643,23 @@ func noPrefetchLandmark() tarEntry {
 	})
 }
 
+func profileLandmark(name string, files ...string) tarEntry {
+	return tarEntryFunc(func(w *tar.Writer, prefix string) error {
+		contents := []byte(strings.Join(files, "\n") + "\n")
+		if err := w.WriteHeader(&tar.Header{
+			Name:     PrefetchProfileLandmark(name),
+			Typeflag: tar.TypeReg,
+			Size:     int64(len(contents)),
+		}); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, bytes.NewReader(contents), int64(len(contents))); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
 func parseStargz(sgz *io.SectionReader) (decodedJTOC *jtoc, jtocOffset int64, err error) {
 	// Parse stargz footer and get the offset of TOC JSON
 	tocOffset, footerSize, err := OpenFooter(sgz)
@@ -1626,6 +1697,95 @@ func parseStargz(sgz *io.SectionReader) (decodedJTOC *jtoc, jtocOffset int64, er
 	return decodedJTOC, tocOffset, nil
 }
 
+// TestBuildReproducible tests Build results in the same blob for the same input
+// and options regardless of the host.
+func TestBuildReproducible(t *testing.T) {
+	var ents []tarEntry
+	for i := 0; i < 50; i++ {
+		d := fmt.Sprintf("dir%d/", i)
+		ents = append(ents, dir(d), file(d+"file", strings.Repeat(d, i*100)))
+	}
+	in := buildTarStatic(t, tarOf(ents...), "")
+	epoch := time.Unix(1600000000, 0).UTC()
+	build := func(procs int) []byte {
+		defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+		rc, err := Build(in,
+			WithChunkSize(1000),
+			WithPrioritizedFiles([]string{"dir3/file"}),
+			WithSourceDateEpoch(epoch))
+		if err != nil {
+			t.Fatalf("failed to build: %v", err)
+		}
+		defer rc.Close()
+		b, err := ioutil.ReadAll(rc)
+		if err != nil {
+			t.Fatalf("failed to read blob: %v", err)
+		}
+		return b
+	}
+	b1, b2 := build(1), build(7)
+	if !bytes.Equal(b1, b2) {
+		t.Fatalf("blobs differ among builds")
+	}
+	r, err := Open(io.NewSectionReader(bytes.NewReader(b1), 0, int64(len(b1))))
+	if err != nil {
+		t.Fatalf("failed to open blob: %v", err)
+	}
+	e, ok := r.Lookup(PrefetchLandmark)
+	if !ok {
+		t.Fatalf("landmark not found")
+	}
+	if !e.ModTime().Equal(epoch) {
+		t.Errorf("landmark modtime = %v; want %v", e.ModTime(), epoch)
+	}
+}
+
+func TestBuildExcludedPaths(t *testing.T) {
+	in := buildTarStatic(t, tarOf(
+		dir("var/"),
+		dir("var/cache/"),
+		file("var/cache/a", "a"),
+		dir("var/lib/"),
+		file("var/lib/b", "b"),
+		dir("usr/"),
+		dir("usr/share/"),
+		dir("usr/share/doc/"),
+		file("usr/share/doc/README", "readme"),
+		file("usr/bin", "bin"),
+	), "")
+	rc, err := Build(in, WithExcludedPaths([]string{"var/cache/*", "/usr/share/doc"}))
+	if err != nil {
+		t.Fatalf("failed to build: %v", err)
+	}
+	defer rc.Close()
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("failed to read blob: %v", err)
+	}
+	r, err := Open(io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b))))
+	if err != nil {
+		t.Fatalf("failed to open blob: %v", err)
+	}
+	for _, name := range []string{"var/cache", "var/lib/b", "usr/share", "usr/bin", NoPrefetchLandmark} {
+		if _, ok := r.Lookup(name); !ok {
+			t.Errorf("%q must be kept", name)
+		}
+	}
+	for _, name := range []string{"var/cache/a", "usr/share/doc", "usr/share/doc/README"} {
+		if _, ok := r.Lookup(name); ok {
+			t.Errorf("%q must be excluded", name)
+		}
+	}
+
+	linked := buildTarStatic(t, tarOf(file("a", "a"), link("b", "a")), "")
+	if _, err := Build(linked, WithExcludedPaths([]string{"a"})); err == nil {
+		t.Errorf("hardlink to excluded file must be rejected")
+	}
+	if _, err := Build(in, WithExcludedPaths([]string{"["})); err == nil {
+		t.Errorf("invalid pattern must be rejected")
+	}
+}
+
 func TestCountReader(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -66,6 +66,43 @@ type Reader struct {
 //
 // Note that each entry name is normalized as the path that is relative to root.
 func Open(sr *io.SectionReader) (*Reader, error) {
+	tr, err := openTOC(sr)
+	if err != nil {
+		return nil, err
+	}
+	dgstr := digest.Canonical.Digester()
+	toc := new(jtoc)
+	if err := json.NewDecoder(io.TeeReader(tr, dgstr.Hash())).Decode(&toc); err != nil {
+		return nil, fmt.Errorf("error decoding TOC JSON: %v", err)
+	}
+	r := &Reader{sr: sr, toc: toc, tocDigest: dgstr.Digest()}
+	if err := r.initFields(); err != nil {
+		return nil, fmt.Errorf("failed to initialize fields of entries: %v", err)
+	}
+	return r, nil
+}
+
+// OpenTOCJSON parses the given TOC JSON which isn't contained in any stargz
+// file. This is useful for representing other image formats as TOCEntry trees.
+// The returned Reader holds no file contents so OpenFile doesn't read anything.
+func OpenTOCJSON(tocJSON []byte) (*Reader, error) {
+	toc := new(jtoc)
+	if err := json.Unmarshal(tocJSON, toc); err != nil {
+		return nil, fmt.Errorf("error decoding TOC JSON: %v", err)
+	}
+	r := &Reader{
+		sr:        io.NewSectionReader(bytes.NewReader(nil), 0, 0),
+		toc:       toc,
+		tocDigest: digest.FromBytes(tocJSON),
+	}
+	if err := r.initFields(); err != nil {
+		return nil, fmt.Errorf("failed to initialize fields of entries: %v", err)
+	}
+	return r, nil
+}
+
+// openTOC returns a reader of the TOC JSON contained in the given blob.
+func openTOC(sr *io.SectionReader) (io.Reader, error) {
 	tocOff, footerSize, err := OpenFooter(sr)
 	if err != nil {
 		return nil, errors.Wrapf(err, "error parsing footer")
@@ -87,16 +124,36 @@ func Open(sr *io.SectionReader) (*Reader, error) {
 	if h.Name != TOCTarName {
 		return nil, fmt.Errorf("TOC tar entry had name %q; expected %q", h.Name, TOCTarName)
 	}
-	dgstr := digest.Canonical.Digester()
-	toc := new(jtoc)
-	if err := json.NewDecoder(io.TeeReader(tr, dgstr.Hash())).Decode(&toc); err != nil {
-		return nil, fmt.Errorf("error decoding TOC JSON: %v", err)
+	return tr, nil
+}
+
+// TOCDigest returns the digest of the TOC JSON of this blob.
+func (r *Reader) TOCDigest() digest.Digest {
+	return r.tocDigest
+}
+
+// TOCJSON reads the raw TOC JSON from the blob.
+func (r *Reader) TOCJSON() ([]byte, error) {
+	tr, err := openTOC(r.sr)
+	if err != nil {
+		return nil, err
 	}
-	r := &Reader{sr: sr, toc: toc, tocDigest: dgstr.Digest()}
-	if err := r.initFields(); err != nil {
-		return nil, fmt.Errorf("failed to initialize fields of entries: %v", err)
+	return ioutil.ReadAll(tr)
+}
+
+// WithSectionReader returns a Reader which shares the parsed TOC with r but reads
+// file contents from sr. This is useful for avoiding parsing the same TOC more
+// than once when the same blob is served by several sources. sr must be a reader
+// of the same blob as r. Entries returned by the Readers must be treated as
+// read-only.
+func (r *Reader) WithSectionReader(sr *io.SectionReader) *Reader {
+	return &Reader{
+		sr:        sr,
+		toc:       r.toc,
+		tocDigest: r.tocDigest,
+		m:         r.m,
+		chunks:    r.chunks,
 	}
-	return r, nil
 }
 
 // OpenFooter extracts and parses footer from the given blob.
@@ -456,6 +513,10 @@ type Writer struct {
 	lastGroupname    map[int]string
 	compressionLevel int
 
+	// sparseFiles are names of regular files in the input tar which are
+	// expanded sparse files (see Build).
+	sparseFiles map[string]bool
+
 	// ChunkSize optionally controls the maximum number of bytes
 	// of data of a regular file that can be written in one gzip
 	// stream before a new gzip stream is started.
@@ -639,6 +700,13 @@ func (w *Writer) AppendTar(r io.Reader) error {
 			ModTime3339: formatModtime(h.ModTime),
 			Xattrs:      xattrs,
 		}
+		sparse := w.sparseFiles[h.Name]
+		if isSparseHeader(h) {
+			sparse = true
+			// Sparse files are stored as regular files. Their holes are
+			// recorded in the TOC instead.
+			h = regHeaderOfSparse(h)
+		}
 		w.condOpenGz()
 		tw := tar.NewWriter(currentGzipWriter{w})
 		if err := tw.WriteHeader(h); err != nil {
@@ -679,7 +747,12 @@ func (w *Writer) AppendTar(r io.Reader) error {
 			payloadDigest = digest.Canonical.Digester()
 		}
 
-		if h.Typeflag == tar.TypeReg && ent.Size > 0 {
+		if h.Typeflag == tar.TypeReg && ent.Size > 0 && sparse {
+			tee := io.TeeReader(tr, payloadDigest.Hash())
+			if err := w.appendSparseFile(tw, tee, ent); err != nil {
+				return err
+			}
+		} else if h.Typeflag == tar.TypeReg && ent.Size > 0 {
 			var written int64
 			totalSize := ent.Size // save it before we destroy ent
 			tee := io.TeeReader(tr, payloadDigest.Hash())
@@ -726,6 +799,161 @@ func (w *Writer) AppendTar(r io.Reader) error {
 	return nil
 }
 
+// sparseBlockSize is the granularity of holes detected in sparse files.
+const sparseBlockSize = 4096
+
+// isSparseHeader reports whether h is a GNU sparse file, in either of the old
+// GNU format or the PAX format.
+func isSparseHeader(h *tar.Header) bool {
+	if h.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for k := range h.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// regHeaderOfSparse returns a copy of the sparse file header h as a regular
+// file. archive/tar has already expanded the holes in the contents.
+func regHeaderOfSparse(h *tar.Header) *tar.Header {
+	rh := *h
+	rh.Typeflag = tar.TypeReg
+	rh.PAXRecords = make(map[string]string)
+	for k, v := range h.PAXRecords {
+		if !strings.HasPrefix(k, "GNU.sparse.") {
+			rh.PAXRecords[k] = v
+		}
+	}
+	if rh.Format == tar.FormatGNU && len(rh.PAXRecords) > 0 {
+		rh.Format = tar.FormatUnknown
+	}
+	return &rh
+}
+
+// appendSparseFile writes the contents of the sparse file ent read from r.
+// Runs of zeros not smaller than the chunk size are written as dedicated
+// chunks marked as holes, so that readers can serve them without fetching.
+// Data is chunked as usual.
+func (w *Writer) appendSparseFile(tw *tar.Writer, r io.Reader, ent *TOCEntry) error {
+	var (
+		name       = ent.Name
+		totalSize  = ent.Size
+		chunkSize  = int64(w.chunkSize())
+		written    int64
+		cur        *TOCEntry // the chunk being written
+		curSize    int64
+		curDigest  digest.Digester
+		zeros      int64 // zeros read but not written yet
+		buf        = make([]byte, sparseBlockSize)
+		zeroBuf    = make([]byte, sparseBlockSize)
+		firstChunk = true
+	)
+	finishChunk := func() {
+		if cur == nil {
+			return
+		}
+		if written < totalSize {
+			cur.ChunkSize = curSize
+		}
+		cur.ChunkDigest = curDigest.Digest().String()
+		w.toc.Entries = append(w.toc.Entries, cur)
+		cur = nil
+	}
+	startChunk := func(hole bool) error {
+		finishChunk()
+		if err := w.closeGz(); err != nil {
+			return err
+		}
+		if firstChunk {
+			cur, firstChunk = ent, false
+		} else {
+			cur = &TOCEntry{Name: name, Type: "chunk"}
+		}
+		cur.Offset = w.cw.n
+		cur.ChunkOffset = written
+		cur.Hole = hole
+		curSize = 0
+		curDigest = digest.Canonical.Digester()
+		w.condOpenGz()
+		return nil
+	}
+	write := func(p []byte) error {
+		if _, err := tw.Write(p); err != nil {
+			return fmt.Errorf("error copying %q: %v", name, err)
+		}
+		curDigest.Hash().Write(p)
+		curSize += int64(len(p))
+		written += int64(len(p))
+		return nil
+	}
+	writeData := func(p []byte) error {
+		for len(p) > 0 {
+			if cur == nil || cur.Hole || curSize >= chunkSize {
+				if err := startChunk(false); err != nil {
+					return err
+				}
+			}
+			n := int64(len(p))
+			if remain := chunkSize - curSize; n > remain {
+				n = remain
+			}
+			if err := write(p[:n]); err != nil {
+				return err
+			}
+			p = p[n:]
+		}
+		return nil
+	}
+	flushZeros := func() error {
+		writeZeros := writeData
+		if zeros >= chunkSize {
+			if err := startChunk(true); err != nil {
+				return err
+			}
+			writeZeros = write
+		}
+		for zeros > 0 {
+			n := int64(sparseBlockSize)
+			if zeros < n {
+				n = zeros
+			}
+			if err := writeZeros(zeroBuf[:n]); err != nil {
+				return err
+			}
+			zeros -= n
+		}
+		return nil
+	}
+	for read := int64(0); read < totalSize; {
+		n := int64(sparseBlockSize)
+		if remain := totalSize - read; remain < n {
+			n = remain
+		}
+		if _, err := io.ReadFull(r, buf[:n]); err != nil {
+			return fmt.Errorf("error copying %q: %v", name, err)
+		}
+		read += n
+		if bytes.Equal(buf[:n], zeroBuf[:n]) {
+			zeros += n
+			continue
+		}
+		if err := flushZeros(); err != nil {
+			return err
+		}
+		if err := writeData(buf[:n]); err != nil {
+			return err
+		}
+	}
+	if err := flushZeros(); err != nil {
+		return err
+	}
+	finishChunk()
+	return nil
+}
+
 // DiffID returns the SHA-256 of the uncompressed tar bytes.
 // It is only valid to call DiffID after Close.
 func (w *Writer) DiffID() string {
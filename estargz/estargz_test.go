@@ -36,6 +36,8 @@ import (
 	"sort"
 	"strings"
 	"testing"
+
+	digest "github.com/opencontainers/go-digest"
 )
 
 var allowedPrefix = [4]string{"", "./", "/", "../"}
@@ -874,3 +876,140 @@ func regularFileReader(name string, size int64, chunkSize int64) (*TOCEntry, *Re
 		chunks: map[string][]*TOCEntry{name: chunks},
 	}
 }
+
+// sparseTarOf returns a tar containing a PAX (0.1) sparse file of the size
+// with data at the offsets. archive/tar can't write sparse files so GNU
+// sparse records are written with placeholder keys which are fixed later.
+func sparseTarOf(t *testing.T, name string, size int64, data map[int64]string) []byte {
+	var (
+		offs   []int64
+		packed bytes.Buffer
+		spMap  []string
+	)
+	for off := range data {
+		offs = append(offs, off)
+	}
+	sort.Slice(offs, func(i, j int) bool { return offs[i] < offs[j] })
+	for _, off := range offs {
+		packed.WriteString(data[off])
+		spMap = append(spMap, fmt.Sprintf("%d,%d", off, len(data[off])))
+	}
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(packed.Len()),
+		PAXRecords: map[string]string{
+			"GNU_sparse.major":     "0",
+			"GNU_sparse.minor":     "1",
+			"GNU_sparse.size":      fmt.Sprintf("%d", size),
+			"GNU_sparse.map":       strings.Join(spMap, ","),
+			"GNU_sparse.numblocks": fmt.Sprintf("%d", len(spMap)),
+		},
+		Format: tar.FormatPAX,
+	}); err != nil {
+		t.Fatalf("failed to write header: %v", err)
+	}
+	if _, err := tw.Write(packed.Bytes()); err != nil {
+		t.Fatalf("failed to write data: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close tar: %v", err)
+	}
+	return bytes.ReplaceAll(buf.Bytes(), []byte("GNU_sparse."), []byte("GNU.sparse."))
+}
+
+func TestSparseFile(t *testing.T) {
+	const (
+		chunkSize = 2 * sparseBlockSize
+		size      = 16 * sparseBlockSize
+	)
+	var (
+		dataA = strings.Repeat("a", sparseBlockSize)
+		dataB = strings.Repeat("b", sparseBlockSize+1)
+	)
+	in := sparseTarOf(t, "sparse", size, map[int64]string{
+		0:                    dataA,
+		2 * sparseBlockSize:  "x", // the hole before this is smaller than a chunk
+		10 * sparseBlockSize: dataB,
+	})
+	want := make([]byte, size)
+	copy(want, dataA)
+	copy(want[2*sparseBlockSize:], "x")
+	copy(want[10*sparseBlockSize:], dataB)
+	type chunk struct {
+		off, size int64
+		hole      bool
+	}
+	wantChunks := []chunk{
+		{0, chunkSize, false},
+		{2 * sparseBlockSize, sparseBlockSize, false},
+		{3 * sparseBlockSize, 7 * sparseBlockSize, true},
+		{10 * sparseBlockSize, chunkSize, false},
+		{12 * sparseBlockSize, 4 * sparseBlockSize, true},
+	}
+
+	check := func(t *testing.T, sgz []byte) {
+		r, err := Open(io.NewSectionReader(bytes.NewReader(sgz), 0, int64(len(sgz))))
+		if err != nil {
+			t.Fatalf("failed to open stargz: %v", err)
+		}
+		e, ok := r.Lookup("sparse")
+		if !ok || e.Type != "reg" || e.Size != size {
+			t.Fatalf("unexpected entry %+v", e)
+		}
+		if e.Digest != digest.FromBytes(want).String() {
+			t.Errorf("digest = %q; want %q", e.Digest, digest.FromBytes(want))
+		}
+		var gotChunks []chunk
+		for off := int64(0); off < size; {
+			ce, ok := r.ChunkEntryForOffset("sparse", off)
+			if !ok {
+				t.Fatalf("no chunk at %d", off)
+			}
+			gotChunks = append(gotChunks, chunk{ce.ChunkOffset, ce.ChunkSize, ce.Hole})
+			off = ce.ChunkOffset + ce.ChunkSize
+		}
+		if !reflect.DeepEqual(gotChunks, wantChunks) {
+			t.Errorf("chunks = %+v; want %+v", gotChunks, wantChunks)
+		}
+		ra, err := r.OpenFile("sparse")
+		if err != nil {
+			t.Fatalf("failed to open file: %v", err)
+		}
+		got := make([]byte, size)
+		if _, err := ra.ReadAt(got, 0); err != nil && err != io.EOF {
+			t.Fatalf("failed to read file: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("unexpected contents")
+		}
+	}
+
+	t.Run("append_tar", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		w := NewWriter(buf)
+		w.ChunkSize = chunkSize
+		if err := w.AppendTar(bytes.NewReader(in)); err != nil {
+			t.Fatalf("failed to append tar: %v", err)
+		}
+		if _, err := w.Close(); err != nil {
+			t.Fatalf("failed to close writer: %v", err)
+		}
+		check(t, buf.Bytes())
+	})
+	t.Run("build", func(t *testing.T) {
+		rc, err := Build(io.NewSectionReader(bytes.NewReader(in), 0, int64(len(in))), WithChunkSize(chunkSize))
+		if err != nil {
+			t.Fatalf("failed to build stargz: %v", err)
+		}
+		defer rc.Close()
+		sgz, err := ioutil.ReadAll(rc)
+		if err != nil {
+			t.Fatalf("failed to read stargz: %v", err)
+		}
+		check(t, sgz)
+	})
+}
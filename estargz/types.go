@@ -25,6 +25,7 @@ package estargz
 import (
 	"os"
 	"path"
+	"strings"
 	"time"
 
 	digest "github.com/opencontainers/go-digest"
@@ -80,9 +81,27 @@ const (
 	// occur in the stargz file.
 	NoPrefetchLandmark = ".no.prefetch.landmark"
 
+	// PrefetchProfileLandmarkPrefix is the prefix of file entries of named
+	// prefetch profiles. The entry ".prefetch.landmark.<name>" lists the files
+	// to prefetch for the profile "<name>", one path per line.
+	PrefetchProfileLandmarkPrefix = ".prefetch.landmark."
+
 	landmarkContents = 0xf
 )
 
+// PrefetchProfileLandmark returns the name of the landmark entry of the named
+// prefetch profile.
+func PrefetchProfileLandmark(profile string) string {
+	return PrefetchProfileLandmarkPrefix + profile
+}
+
+// IsLandmark returns true if the entry name is a prefetch landmark or a
+// landmark of a prefetch profile. Landmarks are placed at the root directory.
+func IsLandmark(name string) bool {
+	return name == PrefetchLandmark || name == NoPrefetchLandmark ||
+		strings.HasPrefix(name, PrefetchProfileLandmarkPrefix)
+}
+
 // jtoc is the JSON-serialized table of contents index of the files in the stargz file.
 type jtoc struct {
 	Version int         `json:"version"`
@@ -175,6 +194,11 @@ type TOCEntry struct {
 	// as "sha256:0123abcd...".
 	ChunkDigest string `json:"chunkDigest,omitempty"`
 
+	// Hole is true if the chunk is a hole of a sparse file. The chunk
+	// consists of zeros so readers can serve it without fetching the
+	// contents.
+	Hole bool `json:"hole,omitempty"`
+
 	children map[string]*TOCEntry
 }
 
@@ -0,0 +1,141 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"syscall"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/stargz-snapshotter/cache"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+)
+
+// mountAsync mounts the layer without waiting for resolving it. The root node
+// of the mountpoint blocks operations until the layer becomes ready. If resolving
+// fails, operations on the mountpoint fail with EIO and Check reports the error.
+func (fs *filesystem) mountAsync(ctx context.Context, mountpoint string, labels map[string]string, src []source.Source, cacheOpts []cache.Option) error {
+	openFlags, streamThreshold := fs.openFlags(ctx, labels), fs.streamThreshold(ctx, labels)
+	pl := newPendingLayer()
+	fs.layerMu.Lock()
+	fs.pending[mountpoint] = pl
+	fs.layerMu.Unlock()
+
+	// The context of Mount can be cancelled after return. Only the logger and
+	// the namespace are inherited.
+	bCtx := log.WithLogger(context.Background(), log.G(ctx))
+	if ns, ok := namespaces.Namespace(ctx); ok {
+		bCtx = namespaces.WithNamespace(bCtx, ns)
+	}
+	go func() {
+		l, layerReader, err := fs.prepareLayer(bCtx, mountpoint, labels, src, cacheOpts)
+		fs.layerMu.Lock()
+		if fs.pending[mountpoint] != pl {
+			// Already unmounted.
+			if err == nil {
+				delete(fs.layer, mountpoint)
+				delete(fs.mountRefs, mountpoint)
+				l.release()
+			}
+			fs.layerMu.Unlock()
+			return
+		}
+		if err == nil {
+			delete(fs.pending, mountpoint)
+		}
+		fs.layerMu.Unlock()
+		if err != nil {
+			log.G(bCtx).WithError(err).Warn("failed to prepare layer asynchronously")
+			pl.done(nil, err)
+			return
+		}
+		log.G(bCtx).Debug("layer is ready")
+		pl.done(&node{
+			fs:              fs,
+			layer:           layerReader,
+			e:               l.root,
+			s:               fs.newLayerState(l),
+			root:            mountpoint,
+			openFlags:       openFlags,
+			streamThreshold: streamThreshold,
+		}, nil)
+	}()
+
+	if err := fs.serve(ctx, mountpoint, &node{
+		fs:              fs,
+		root:            mountpoint,
+		pending:         pl,
+		openFlags:       openFlags,
+		streamThreshold: streamThreshold,
+	}); err != nil {
+		fs.layerMu.Lock()
+		delete(fs.pending, mountpoint)
+		fs.layerMu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// pendingLayer is a layer being prepared in background.
+type pendingLayer struct {
+	doneCh chan struct{}
+	n      *node
+	err    error
+}
+
+func newPendingLayer() *pendingLayer {
+	return &pendingLayer{doneCh: make(chan struct{})}
+}
+
+func (pl *pendingLayer) done(n *node, err error) {
+	pl.n, pl.err = n, err
+	close(pl.doneCh)
+}
+
+// wait blocks until the layer becomes ready and returns the root node.
+func (pl *pendingLayer) wait() (*node, error) {
+	<-pl.doneCh
+	return pl.n, pl.err
+}
+
+// failed returns the error occurred during preparing the layer. This returns
+// nil if the layer is still being prepared.
+func (pl *pendingLayer) failed() error {
+	select {
+	case <-pl.doneCh:
+		return pl.err
+	default:
+		return nil
+	}
+}
+
+// ready waits for the completion of preparing the layer if this is a root node
+// of the layer mounted asynchronously.
+func (n *node) ready() syscall.Errno {
+	if n.pending == nil {
+		return 0
+	}
+	rn, err := n.pending.wait()
+	if err != nil {
+		return syscall.EIO
+	}
+	n.readyOnce.Do(func() {
+		n.layer, n.e, n.s = rn.layer, rn.e, rn.s
+	})
+	return 0
+}
@@ -0,0 +1,107 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/dataonly"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
+)
+
+// relATimeInterval is the interval of updating access times in the relatime
+// mode even if they are later than the modification times.
+const relATimeInterval = 24 * time.Hour
+
+// atimeTracker records access times of files of a mount. FUSE inodes are
+// S_NOATIME in the kernel so reads are recorded by the filesystem. Files which
+// haven't been read report the modification times recorded in the TOC.
+type atimeTracker struct {
+	strict bool // false for relatime
+	atimes map[uint64]time.Time
+	now    func() time.Time
+	mu     sync.Mutex
+}
+
+// newATimeTracker returns the tracker of the mode. This returns nil if access
+// times aren't updated.
+func newATimeTracker(mode string) *atimeTracker {
+	if mode != config.ATimeModeRelATime && mode != config.ATimeModeStrictATime {
+		return nil
+	}
+	return &atimeTracker{
+		strict: mode == config.ATimeModeStrictATime,
+		atimes: make(map[uint64]time.Time),
+		now:    time.Now,
+	}
+}
+
+// accessed records a read of the file.
+func (t *atimeTracker) accessed(e *estargz.TOCEntry) {
+	if t == nil {
+		return
+	}
+	now := t.now()
+	ino := inodeOfEnt(e)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.strict {
+		if at, ok := t.atimes[ino]; ok && at.After(dataonly.ModTime(e)) && now.Sub(at) < relATimeInterval {
+			return
+		}
+	}
+	t.atimes[ino] = now
+}
+
+// setATime sets the access time of the entry to the attribute.
+func (t *atimeTracker) setATime(e *estargz.TOCEntry, out *fuse.Attr) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	at, ok := t.atimes[inodeOfEnt(e)]
+	t.mu.Unlock()
+	if ok {
+		out.SetTimes(&at, nil, nil)
+	}
+}
+
+// atimeMountOption returns the mount option and the flag of mount(2) of the
+// mode.
+func atimeMountOption(mode string) (string, uintptr) {
+	switch mode {
+	case config.ATimeModeNoATime:
+		return mode, unix.MS_NOATIME
+	case config.ATimeModeRelATime:
+		return mode, unix.MS_RELATIME
+	case config.ATimeModeStrictATime:
+		return mode, unix.MS_STRICTATIME
+	}
+	return "", 0
+}
+
+// atimes returns the tracker of the mount of the node, if any.
+func (n *node) atimes() *atimeTracker {
+	if n.s == nil {
+		return nil
+	}
+	return n.s.atimes
+}
@@ -0,0 +1,139 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+)
+
+// auditSyslogTag is the tag of records sent to syslog.
+const auditSyslogTag = "containerd-stargz-grpc"
+
+// auditRecord is a record of a read served without verification.
+type auditRecord struct {
+	Time         time.Time `json:"time"`
+	Image        string    `json:"image"`
+	Layer        string    `json:"layer"`
+	Verification string    `json:"verification"`
+	Path         string    `json:"path"`
+	Offset       int64     `json:"offset"`
+	Length       int64     `json:"length"`
+}
+
+// auditTarget is an unverified layer whose reads are recorded.
+type auditTarget struct {
+	image        string
+	layer        string
+	verification string
+}
+
+// auditLogger appends records of reads served from unverified layers to the
+// file or syslog.
+type auditLogger struct {
+	w       io.Writer
+	targets map[string]auditTarget // mountpoint -> layer
+	mu      sync.Mutex
+	now     func() time.Time
+}
+
+// newAuditLogger returns the logger configured by cfg. This returns nil if
+// the audit log isn't enabled.
+func newAuditLogger(cfg config.AuditLogConfig) (*auditLogger, error) {
+	var w io.Writer
+	switch {
+	case cfg.Syslog:
+		sw, err := syslog.New(syslog.LOG_NOTICE|syslog.LOG_DAEMON, auditSyslogTag)
+		if err != nil {
+			return nil, err
+		}
+		w = sw
+	case cfg.Path != "":
+		f, err := os.OpenFile(cfg.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	default:
+		return nil, nil
+	}
+	return &auditLogger{
+		w:       w,
+		targets: make(map[string]auditTarget),
+		now:     time.Now,
+	}, nil
+}
+
+// register starts recording reads of the layer on the mountpoint.
+func (a *auditLogger) register(mountpoint string, t auditTarget) {
+	a.mu.Lock()
+	a.targets[mountpoint] = t
+	a.mu.Unlock()
+}
+
+// unregister stops recording reads of the layer on the mountpoint.
+func (a *auditLogger) unregister(mountpoint string) {
+	a.mu.Lock()
+	delete(a.targets, mountpoint)
+	a.mu.Unlock()
+}
+
+// read records the read of the file in the layer on the mountpoint if the
+// layer isn't verified.
+func (a *auditLogger) read(mountpoint, path string, off, length int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	t, ok := a.targets[mountpoint]
+	if !ok || length <= 0 {
+		return
+	}
+	b, err := json.Marshal(auditRecord{
+		Time:         a.now().UTC(),
+		Image:        t.image,
+		Layer:        t.layer,
+		Verification: t.verification,
+		Path:         path,
+		Offset:       off,
+		Length:       length,
+	})
+	if err != nil {
+		return
+	}
+	if _, err := fmt.Fprintf(a.w, "%s\n", b); err != nil {
+		log.L.WithError(err).Warn("failed to write audit log")
+	}
+}
+
+// audit records the read of the file if the layer isn't verified.
+func (f *file) audit(off int64, size int) {
+	if f.n.fs == nil || f.n.fs.audit == nil {
+		return
+	}
+	length := int64(size)
+	if remain := f.e.Size - off; length > remain {
+		length = remain
+	}
+	f.n.fs.audit.read(f.n.root, f.e.Name, off, length)
+}
@@ -0,0 +1,46 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/stargz-snapshotter/fs/blockdev"
+	"github.com/containerd/stargz-snapshotter/fs/reader"
+)
+
+// attachBlockDevice serves the layer mounted on the mountpoint as a ublk block
+// device holding the squashfs image of the layer. The mount doesn't fail even
+// if the device isn't available because the layer is still usable through the
+// mountpoint.
+func (fs *filesystem) attachBlockDevice(ctx context.Context, mountpoint string, l *layer, lr reader.Reader) {
+	img, err := blockdev.NewSquashfsImage(l.root, lr.OpenFile)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to create squashfs image of the layer")
+		return
+	}
+	dev, err := blockdev.NewUblkDevice(img, img.Size())
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to serve the layer as a block device")
+		return
+	}
+	fs.layerMu.Lock()
+	fs.blockDevs[mountpoint] = dev
+	fs.layerMu.Unlock()
+	log.G(ctx).Infof("serving squashfs image of the layer on %q", dev.Path())
+}
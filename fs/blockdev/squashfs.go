@@ -0,0 +1,691 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package blockdev provides eStargz layers as block images for runtimes which
+// mount block devices as the rootfs (e.g. Kata Containers and Firecracker).
+//
+// A layer is converted to a squashfs image whose data blocks are stored
+// uncompressed. Only the metadata of the image is generated from the TOC and
+// held in memory. Reads of the data blocks are mapped to the contents of the
+// files so they are lazily fetched from the registry. The image can be served
+// as a block device by ublk (Linux 6.0 or later).
+package blockdev
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/dataonly"
+	"github.com/containerd/stargz-snapshotter/fs/internal/erofs"
+	"github.com/pkg/errors"
+)
+
+// Constants of squashfs 4.0 (fs/squashfs/squashfs_fs.h in the kernel).
+const (
+	sqMagic          = 0x73717368
+	sqSuperSize      = 96
+	sqBlockLog       = 17
+	sqBlockSize      = 1 << sqBlockLog
+	sqMetadataSize   = 8192
+	sqInvalidBlk     = math.MaxUint64
+	sqInvalidFrag    = math.MaxUint32
+	sqInvalidXattr   = math.MaxUint32
+	sqUncompressed   = 1 << 15 // of metadata block headers
+	sqUncompressedDB = 1 << 24 // of data block sizes
+	sqZlib           = 1
+	sqDirCount       = 256
+	sqImageAlign     = 4096 // mksquashfs pads images to 4KiB
+
+	sqNoInodeComp  = 0x1
+	sqNoDataComp   = 0x2
+	sqNoFragComp   = 0x8
+	sqNoFragments  = 0x10
+	sqNoXattrComp  = 0x100
+	sqNoXattrs     = 0x200
+	sqNoIDTableCom = 0x800
+
+	sqDirType     = 1
+	sqRegType     = 2
+	sqSymlinkType = 3
+	sqBlkdevType  = 4
+	sqChrdevType  = 5
+	sqFifoType    = 6
+	sqLTypeOffset = 7 // extended types are the basic types + 7
+)
+
+// sqXattrPrefixes are the prefixes of xattr names which squashfs can store.
+// Xattrs with other prefixes are dropped.
+var sqXattrPrefixes = []string{"user.", "trusted.", "security."}
+
+const (
+	opaqueXattr   = "trusted.overlay.opaque"
+	overlayXattrs = "trusted.overlay."
+)
+
+// Image is a squashfs image of an eStargz layer.
+type Image struct {
+	super      []byte
+	tables     []byte
+	tableStart int64
+	size       int64
+	extents    []extent // sorted by the offsets
+	open       func(name string) (io.ReaderAt, error)
+
+	files   map[string]io.ReaderAt
+	filesMu sync.Mutex
+}
+
+// extent is the contents of a regular file in the image.
+type extent struct {
+	off  int64
+	size int64
+	name string
+}
+
+// NewSquashfsImage creates a squashfs image of the layer. The contents of the
+// files are read using open, which is called with the names of the entries on
+// the first read of them. Whiteouts and opaque directories are converted to
+// the overlayfs style, so images can be stacked by overlayfs.
+func NewSquashfsImage(root *estargz.TOCEntry, open func(name string) (io.ReaderAt, error)) (*Image, error) {
+	sw := &sqWriter{
+		root:  root,
+		links: make(map[*estargz.TOCEntry]*sqInode),
+		ids:   make(map[uint32]uint16),
+		data:  sqSuperSize,
+	}
+	rootInode, err := sw.inode(root)
+	if err != nil {
+		return nil, err
+	}
+	if err := sw.dir(rootInode, rootInode, root); err != nil {
+		return nil, err
+	}
+	img := &Image{
+		extents: sw.extents,
+		open:    open,
+		files:   make(map[string]io.ReaderAt),
+	}
+	img.super, img.tables = sw.layout(rootInode)
+	img.tableStart = sw.data
+	img.size = alignUp(img.tableStart+int64(len(img.tables)), sqImageAlign)
+	return img, nil
+}
+
+// Size returns the size of the image.
+func (img *Image) Size() int64 {
+	return img.size
+}
+
+// ReadAt reads the image. Reads of the data blocks read the contents of the
+// files.
+func (img *Image) ReadAt(p []byte, off int64) (int, error) {
+	var n int
+	for n < len(p) {
+		cur := off + int64(n)
+		if cur >= img.size {
+			return n, io.EOF
+		}
+		var m int
+		switch {
+		case cur < sqSuperSize:
+			m = copy(p[n:], img.super[cur:])
+		case cur < img.tableStart:
+			var err error
+			if m, err = img.readData(p[n:], cur); err != nil {
+				return n, err
+			}
+		case cur < img.tableStart+int64(len(img.tables)):
+			m = copy(p[n:], img.tables[cur-img.tableStart:])
+		default: // padding
+			end := len(p)
+			if rest := img.size - cur; int64(end-n) > rest {
+				end = n + int(rest)
+			}
+			for i := n; i < end; i++ {
+				p[i] = 0
+			}
+			m = end - n
+		}
+		n += m
+	}
+	return n, nil
+}
+
+// readData reads the contents of the file at the offset of the image.
+func (img *Image) readData(p []byte, off int64) (int, error) {
+	i := sort.Search(len(img.extents), func(i int) bool {
+		return off < img.extents[i].off+img.extents[i].size
+	})
+	if i == len(img.extents) || off < img.extents[i].off {
+		return 0, fmt.Errorf("offset %d isn't mapped to any file", off)
+	}
+	ext := img.extents[i]
+	ra, err := img.file(ext.name)
+	if err != nil {
+		return 0, err
+	}
+	if rest := ext.off + ext.size - off; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	n, err := ra.ReadAt(p, off-ext.off)
+	if n == len(p) {
+		return n, nil
+	} else if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, errors.Wrapf(err, "failed to read %q", ext.name)
+}
+
+func (img *Image) file(name string) (io.ReaderAt, error) {
+	img.filesMu.Lock()
+	defer img.filesMu.Unlock()
+	if ra, ok := img.files[name]; ok {
+		return ra, nil
+	}
+	ra, err := img.open(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open %q", name)
+	}
+	img.files[name] = ra
+	return ra, nil
+}
+
+type sqInode struct {
+	typ      uint16 // basic type
+	ext      bool   // extended type
+	mode     uint16
+	uid, gid uint16 // indexes of the id table
+	mtime    uint32
+	ino      uint32
+	nlink    uint32
+	xattr    uint32 // index of the xattr id table
+
+	size      uint64
+	dataStart uint64   // regular files
+	blocks    []uint32 // regular files
+	target    []byte   // symlinks
+	rdev      uint32   // devices
+	ents      []sqDirent
+	parent    *sqInode
+
+	pos        int    // offset in the inode table stream
+	listing    int    // offset of the listing in the directory table stream
+	listingLen int    // length of the listing of the directory
+	xattrs     []byte // encoded xattr entries
+	nxattrs    int
+}
+
+type sqDirent struct {
+	name  string
+	inode *sqInode
+}
+
+type sqWriter struct {
+	root    *estargz.TOCEntry
+	links   map[*estargz.TOCEntry]*sqInode
+	inodes  []*sqInode // in the order of placement
+	ids     map[uint32]uint16
+	idList  []uint32
+	extents []extent
+	data    int64 // end of the data area
+}
+
+func (sw *sqWriter) newInode(in *sqInode) *sqInode {
+	sw.inodes = append(sw.inodes, in)
+	in.ino = uint32(len(sw.inodes))
+	in.xattr = sqInvalidXattr
+	return in
+}
+
+func (sw *sqWriter) id(id int) (uint16, error) {
+	if idx, ok := sw.ids[uint32(id)]; ok {
+		return idx, nil
+	}
+	if len(sw.idList) > math.MaxUint16 {
+		return 0, fmt.Errorf("too many uids and gids")
+	}
+	idx := uint16(len(sw.idList))
+	sw.ids[uint32(id)] = idx
+	sw.idList = append(sw.idList, uint32(id))
+	return idx, nil
+}
+
+// inode returns the inode of the entry. Directories are populated by dir.
+func (sw *sqWriter) inode(e *estargz.TOCEntry) (*sqInode, error) {
+	in := &sqInode{
+		mode:  uint16(e.Stat().Mode().Perm()),
+		nlink: 1,
+	}
+	var err error
+	if in.uid, err = sw.id(e.UID); err != nil {
+		return nil, err
+	}
+	if in.gid, err = sw.id(e.GID); err != nil {
+		return nil, err
+	}
+	if t := e.ModTime(); t.Unix() > 0 && t.Unix() <= math.MaxUint32 {
+		in.mtime = uint32(t.Unix())
+	}
+	switch e.Type {
+	case "dir":
+		in.typ, in.nlink = sqDirType, 2
+	case "reg":
+		in.typ = sqRegType
+		in.size = uint64(e.Size)
+		in.dataStart = uint64(sw.data)
+		if e.NumLink > 1 {
+			in.nlink = uint32(e.NumLink)
+		}
+		for rest := e.Size; rest > 0; rest -= sqBlockSize {
+			bs := rest
+			if bs > sqBlockSize {
+				bs = sqBlockSize
+			}
+			in.blocks = append(in.blocks, uint32(bs)|sqUncompressedDB)
+		}
+		if e.Size > 0 {
+			sw.extents = append(sw.extents, extent{off: sw.data, size: e.Size, name: e.Name})
+			sw.data += e.Size
+		}
+	case "symlink":
+		in.typ = sqSymlinkType
+		in.target = []byte(e.LinkName)
+		in.size = uint64(len(in.target))
+	case "char":
+		in.typ = sqChrdevType
+		in.rdev = erofs.EncodeDev(uint32(e.DevMajor), uint32(e.DevMinor))
+	case "block":
+		in.typ = sqBlkdevType
+		in.rdev = erofs.EncodeDev(uint32(e.DevMajor), uint32(e.DevMinor))
+	case "fifo":
+		in.typ = sqFifoType
+	default:
+		return nil, fmt.Errorf("unsupported entry type %q of %q", e.Type, e.Name)
+	}
+	in.mode |= specialBits(e)
+	names := make([]string, 0, len(e.Xattrs))
+	for k := range e.Xattrs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		if !strings.HasPrefix(k, overlayXattrs) {
+			in.addXattr(k, e.Xattrs[k])
+		}
+	}
+	if e.Type == "dir" {
+		if _, opaque := dataonly.Children(e, e == sw.root); opaque {
+			in.addXattr(opaqueXattr, []byte("y"))
+		}
+	}
+	return sw.newInode(in), nil
+}
+
+// dir populates the directory inode with the children of the entry.
+func (sw *sqWriter) dir(in, parent *sqInode, e *estargz.TOCEntry) error {
+	in.parent = parent
+	ents, _ := dataonly.Children(e, e == sw.root)
+	for _, c := range ents {
+		if c.Entry == nil {
+			// Whiteouts are 0/0 character devices.
+			wh := &sqInode{typ: sqChrdevType, nlink: 1}
+			var err error
+			if wh.uid, err = sw.id(0); err != nil {
+				return err
+			}
+			wh.gid = wh.uid
+			in.ents = append(in.ents, sqDirent{c.Name, sw.newInode(wh)})
+			continue
+		}
+		if ci, ok := sw.links[c.Entry]; ok {
+			in.ents = append(in.ents, sqDirent{c.Name, ci})
+			continue
+		}
+		ci, err := sw.inode(c.Entry)
+		if err != nil {
+			return err
+		}
+		if c.Entry.Type == "dir" {
+			in.nlink++
+			if err := sw.dir(ci, in, c.Entry); err != nil {
+				return err
+			}
+		} else {
+			sw.links[c.Entry] = ci
+		}
+		in.ents = append(in.ents, sqDirent{c.Name, ci})
+	}
+	return nil
+}
+
+func (in *sqInode) addXattr(name string, value []byte) {
+	for typ, prefix := range sqXattrPrefixes {
+		if strings.HasPrefix(name, prefix) && len(name) > len(prefix) {
+			b := make([]byte, 4, 4+len(name)-len(prefix)+4+len(value))
+			binary.LittleEndian.PutUint16(b[0:], uint16(typ))
+			binary.LittleEndian.PutUint16(b[2:], uint16(len(name)-len(prefix)))
+			b = append(b, name[len(prefix):]...)
+			b = append(b, 0, 0, 0, 0)
+			binary.LittleEndian.PutUint32(b[len(b)-4:], uint32(len(value)))
+			in.xattrs = append(in.xattrs, append(b, value...)...)
+			in.nxattrs++
+			return
+		}
+	}
+}
+
+// encodedSize returns the size of the encoded inode. Inodes which can't be
+// represented by the basic types are extended.
+func (in *sqInode) encodedSize() int {
+	const header = 16
+	switch in.typ {
+	case sqDirType:
+		if in.ext {
+			return header + 24
+		}
+		return header + 16
+	case sqRegType:
+		if in.ext {
+			return header + 40 + 4*len(in.blocks)
+		}
+		return header + 16 + 4*len(in.blocks)
+	case sqSymlinkType:
+		if in.ext {
+			return header + 12 + len(in.target)
+		}
+		return header + 8 + len(in.target)
+	case sqBlkdevType, sqChrdevType:
+		if in.ext {
+			return header + 12
+		}
+		return header + 8
+	}
+	if in.ext {
+		return header + 8
+	}
+	return header + 4
+}
+
+// layout places the inodes and the directories and returns the superblock and
+// the tables following the data area.
+func (sw *sqWriter) layout(root *sqInode) (super, tables []byte) {
+	// Assign xattrs and choose the inode types. The size of directories in
+	// basic inodes is limited to 16bits so the conservative estimation of the
+	// listing size is used.
+	var xattrData, xattrIDs []byte
+	var nxattrIDs uint32
+	for _, in := range sw.inodes {
+		if in.nxattrs > 0 {
+			var ref [16]byte
+			binary.LittleEndian.PutUint64(ref[0:], metaRef(len(xattrData)))
+			binary.LittleEndian.PutUint32(ref[8:], uint32(in.nxattrs))
+			binary.LittleEndian.PutUint32(ref[12:], uint32(len(in.xattrs)))
+			xattrData = append(xattrData, in.xattrs...)
+			xattrIDs = append(xattrIDs, ref[:]...)
+			in.xattr = nxattrIDs
+			nxattrIDs++
+			in.ext = true
+		}
+		switch in.typ {
+		case sqDirType:
+			estimated := 3
+			for _, c := range in.ents {
+				estimated += 12 + 8 + len(c.name)
+			}
+			if estimated > math.MaxUint16 {
+				in.ext = true
+			}
+		case sqRegType:
+			if in.nlink > 1 || in.size > math.MaxUint32 || in.dataStart > math.MaxUint32 {
+				in.ext = true
+			}
+		}
+	}
+	var pos int
+	for _, in := range sw.inodes {
+		in.pos = pos
+		pos += in.encodedSize()
+	}
+
+	// Directory table
+	var dirs []byte
+	for _, in := range sw.inodes {
+		if in.typ != sqDirType {
+			continue
+		}
+		in.listing = len(dirs)
+		for i := 0; i < len(in.ents); {
+			first := in.ents[i].inode
+			blk := first.pos / sqMetadataSize
+			j := i
+			for j < len(in.ents) && j-i < sqDirCount {
+				ci := in.ents[j].inode
+				if d := int64(ci.ino) - int64(first.ino); ci.pos/sqMetadataSize != blk || d < math.MinInt16 || d > math.MaxInt16 {
+					break
+				}
+				j++
+			}
+			var h [12]byte
+			binary.LittleEndian.PutUint32(h[0:], uint32(j-i-1))
+			binary.LittleEndian.PutUint32(h[4:], uint32(blk*(sqMetadataSize+2)))
+			binary.LittleEndian.PutUint32(h[8:], first.ino)
+			dirs = append(dirs, h[:]...)
+			for _, c := range in.ents[i:j] {
+				var d [8]byte
+				binary.LittleEndian.PutUint16(d[0:], uint16(c.inode.pos%sqMetadataSize))
+				binary.LittleEndian.PutUint16(d[2:], uint16(int16(int64(c.inode.ino)-int64(first.ino))))
+				binary.LittleEndian.PutUint16(d[4:], c.inode.typ)
+				binary.LittleEndian.PutUint16(d[6:], uint16(len(c.name)-1))
+				dirs = append(dirs, d[:]...)
+				dirs = append(dirs, c.name...)
+			}
+			i = j
+		}
+		in.listingLen = len(dirs) - in.listing
+	}
+
+	// Inode table
+	inodes := make([]byte, 0, pos)
+	for _, in := range sw.inodes {
+		inodes = in.encode(inodes)
+	}
+
+	ids := make([]byte, 4*len(sw.idList))
+	for i, id := range sw.idList {
+		binary.LittleEndian.PutUint32(ids[4*i:], id)
+	}
+
+	// Tables are placed in the order checked by the kernel.
+	inodeStart := sw.data
+	tables = metaBlocks(inodes)
+	dirStart := inodeStart + int64(len(tables))
+	tables = append(tables, metaBlocks(dirs)...)
+	tables, idStart := appendIndexedTable(tables, inodeStart, ids)
+	xattrStart := uint64(sqInvalidBlk)
+	flags := uint16(sqNoInodeComp | sqNoDataComp | sqNoFragComp | sqNoFragments | sqNoIDTableCom | sqNoXattrComp)
+	if nxattrIDs > 0 {
+		dataStart := inodeStart + int64(len(tables))
+		tables = append(tables, metaBlocks(xattrData)...)
+		idsStart := inodeStart + int64(len(tables))
+		tables = append(tables, metaBlocks(xattrIDs)...)
+		var hdr [16]byte
+		binary.LittleEndian.PutUint64(hdr[0:], uint64(dataStart))
+		binary.LittleEndian.PutUint32(hdr[8:], nxattrIDs)
+		xattrStart = uint64(inodeStart + int64(len(tables)))
+		tables = append(tables, hdr[:]...)
+		for i := 0; i*sqMetadataSize < len(xattrIDs); i++ {
+			tables = appendUint64(tables, uint64(idsStart)+uint64(i*(sqMetadataSize+2)))
+		}
+	} else {
+		flags |= sqNoXattrs
+	}
+
+	super = make([]byte, sqSuperSize)
+	le := binary.LittleEndian
+	le.PutUint32(super[0:], sqMagic)
+	le.PutUint32(super[4:], uint32(len(sw.inodes)))
+	le.PutUint32(super[12:], sqBlockSize)
+	le.PutUint16(super[20:], sqZlib)
+	le.PutUint16(super[22:], sqBlockLog)
+	le.PutUint16(super[24:], flags)
+	le.PutUint16(super[26:], uint16(len(sw.idList)))
+	le.PutUint16(super[28:], 4) // major
+	le.PutUint64(super[32:], metaRef(root.pos))
+	le.PutUint64(super[40:], uint64(inodeStart+int64(len(tables))))
+	le.PutUint64(super[48:], uint64(idStart))
+	le.PutUint64(super[56:], xattrStart)
+	le.PutUint64(super[64:], uint64(inodeStart))
+	le.PutUint64(super[72:], uint64(dirStart))
+	le.PutUint64(super[80:], sqInvalidBlk) // fragment table
+	le.PutUint64(super[88:], sqInvalidBlk) // lookup table
+	return super, tables
+}
+
+func (in *sqInode) encode(b []byte) []byte {
+	typ := in.typ
+	if in.ext {
+		typ += sqLTypeOffset
+	}
+	h := make([]byte, 16)
+	binary.LittleEndian.PutUint16(h[0:], typ)
+	binary.LittleEndian.PutUint16(h[2:], in.mode)
+	binary.LittleEndian.PutUint16(h[4:], in.uid)
+	binary.LittleEndian.PutUint16(h[6:], in.gid)
+	binary.LittleEndian.PutUint32(h[8:], in.mtime)
+	binary.LittleEndian.PutUint32(h[12:], in.ino)
+	b = append(b, h...)
+	listing := metaRef(in.listing)
+	switch {
+	case in.typ == sqDirType && in.ext:
+		b = appendUint32(b, in.nlink)
+		b = appendUint32(b, uint32(in.listingLen+3))
+		b = appendUint32(b, uint32(listing>>16))
+		b = appendUint32(b, in.parent.ino)
+		b = appendUint16(b, 0) // no index
+		b = appendUint16(b, uint16(listing))
+		b = appendUint32(b, in.xattr)
+	case in.typ == sqDirType:
+		b = appendUint32(b, uint32(listing>>16))
+		b = appendUint32(b, in.nlink)
+		b = appendUint16(b, uint16(in.listingLen+3))
+		b = appendUint16(b, uint16(listing))
+		b = appendUint32(b, in.parent.ino)
+	case in.typ == sqRegType && in.ext:
+		b = appendUint64(b, in.dataStart)
+		b = appendUint64(b, in.size)
+		b = appendUint64(b, 0) // sparse
+		b = appendUint32(b, in.nlink)
+		b = appendUint32(b, sqInvalidFrag)
+		b = appendUint32(b, 0)
+		b = appendUint32(b, in.xattr)
+	case in.typ == sqRegType:
+		b = appendUint32(b, uint32(in.dataStart))
+		b = appendUint32(b, sqInvalidFrag)
+		b = appendUint32(b, 0)
+		b = appendUint32(b, uint32(in.size))
+	case in.typ == sqSymlinkType:
+		b = appendUint32(b, in.nlink)
+		b = appendUint32(b, uint32(len(in.target)))
+		b = append(b, in.target...)
+	case in.typ == sqBlkdevType || in.typ == sqChrdevType:
+		b = appendUint32(b, in.nlink)
+		b = appendUint32(b, in.rdev)
+	default:
+		b = appendUint32(b, in.nlink)
+	}
+	for _, bs := range in.blocks {
+		b = appendUint32(b, bs)
+	}
+	if in.ext && in.typ != sqDirType && in.typ != sqRegType {
+		b = appendUint32(b, in.xattr)
+	}
+	return b
+}
+
+// metaRef returns the reference (the offset of the metadata block and the
+// offset in the block) of the offset in the uncompressed metadata stream.
+func metaRef(pos int) uint64 {
+	return uint64(pos/sqMetadataSize*(sqMetadataSize+2))<<16 | uint64(pos%sqMetadataSize)
+}
+
+// metaBlocks encodes the metadata stream as uncompressed metadata blocks.
+func metaBlocks(stream []byte) []byte {
+	b := make([]byte, 0, len(stream)+(len(stream)/sqMetadataSize+1)*2)
+	for len(stream) > 0 {
+		n := len(stream)
+		if n > sqMetadataSize {
+			n = sqMetadataSize
+		}
+		b = appendUint16(b, uint16(n)|sqUncompressed)
+		b = append(b, stream[:n]...)
+		stream = stream[n:]
+	}
+	return b
+}
+
+// appendIndexedTable appends the table as metadata blocks followed by the
+// index of the blocks and returns the offset of the index. base is the offset
+// of b in the image.
+func appendIndexedTable(b []byte, base int64, table []byte) ([]byte, int64) {
+	blocksStart := base + int64(len(b))
+	b = append(b, metaBlocks(table)...)
+	indexStart := base + int64(len(b))
+	for i := 0; i*sqMetadataSize < len(table); i++ {
+		b = appendUint64(b, uint64(blocksStart)+uint64(i*(sqMetadataSize+2)))
+	}
+	return b, indexStart
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v), byte(v>>8))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v)), uint32(v>>32))
+}
+
+// specialBits returns the setuid, setgid and sticky bits of the entry.
+// TOCEntry.Mode is a copy of tar.Header.Mode.
+func specialBits(e *estargz.TOCEntry) uint16 {
+	var bits uint16
+	mode := (&tar.Header{Mode: e.Mode}).FileInfo().Mode()
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return bits
+}
+
+func alignUp(v, align int64) int64 {
+	return (v + align - 1) / align * align
+}
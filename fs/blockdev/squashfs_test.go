@@ -0,0 +1,228 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package blockdev
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	digest "github.com/opencontainers/go-digest"
+	"golang.org/x/sys/unix"
+)
+
+func TestSquashfsImage(t *testing.T) {
+	large := bytes.Repeat([]byte("0123456789abcdef"), 20000) // 3 data blocks
+	contents := map[string][]byte{
+		"etc/hosts": []byte("hello"),
+		"large":     large,
+	}
+	entries := []*estargz.TOCEntry{
+		{Name: "etc/", Type: "dir", Mode: 0755},
+		{Name: "etc/hosts", Type: "reg", Size: 5, Digest: digest.FromBytes(contents["etc/hosts"]).String(), Mode: 0640, UID: 1, GID: 2,
+			ModTime3339: "2020-01-01T00:00:00Z",
+			Xattrs: map[string][]byte{
+				"user.foo":                 []byte("bar"),
+				"trusted.overlay.redirect": []byte("/evil"),
+			}},
+		{Name: "etc/hosts.link", Type: "hardlink", LinkName: "etc/hosts"},
+		{Name: "etc/empty", Type: "reg", Mode: 0644},
+		{Name: "large", Type: "reg", Size: int64(len(large)), Digest: digest.FromBytes(large).String(), Mode: 04755},
+		{Name: "lnk", Type: "symlink", LinkName: "etc/hosts"},
+		{Name: "null", Type: "char", DevMajor: 1, DevMinor: 3, Mode: 0666},
+		{Name: ".wh.gone", Type: "reg"},
+		{Name: "opq/", Type: "dir", Mode: 0755},
+		{Name: "opq/.wh..wh..opq", Type: "reg"},
+		{Name: "big/", Type: "dir", Mode: 0755},
+		{Name: estargz.PrefetchLandmark, Type: "reg", Size: 1, Digest: digest.FromString("x").String()},
+	}
+	for i := 0; i < 2000; i++ { // listed by an extended inode
+		entries = append(entries, &estargz.TOCEntry{Name: fmt.Sprintf("big/file-with-a-long-name-%04d", i), Type: "reg", Mode: 0644})
+	}
+	img, err := NewSquashfsImage(openTOC(t, entries), func(name string) (io.ReaderAt, error) {
+		c, ok := contents[name]
+		if !ok {
+			return nil, fmt.Errorf("unexpected read of %q", name)
+		}
+		return bytes.NewReader(c), nil
+	})
+	if err != nil {
+		t.Fatalf("failed to create image: %v", err)
+	}
+	if img.Size()%sqImageAlign != 0 {
+		t.Errorf("size of the image %d isn't aligned", img.Size())
+	}
+
+	tmp, err := ioutil.TempDir("", "testsquashfs")
+	if err != nil {
+		t.Fatalf("failed to make temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	imgFile := filepath.Join(tmp, "layer.img")
+	f, err := os.Create(imgFile)
+	if err != nil {
+		t.Fatalf("failed to create image file: %v", err)
+	}
+	if _, err := io.Copy(f, io.NewSectionReader(img, 0, img.Size())); err != nil {
+		t.Fatalf("failed to read image: %v", err)
+	}
+	f.Close()
+
+	mnt := filepath.Join(tmp, "mnt")
+	if err := os.Mkdir(mnt, 0700); err != nil {
+		t.Fatalf("failed to make mountpoint: %v", err)
+	}
+	out, err := exec.Command("losetup", "--find", "--show", "--read-only", imgFile).Output()
+	if err != nil {
+		t.Skipf("loop devices are unavailable: %v", err)
+	}
+	dev := strings.TrimSpace(string(out))
+	defer exec.Command("losetup", "--detach", dev).Run()
+	if err := unix.Mount(dev, mnt, "squashfs", unix.MS_RDONLY, ""); err != nil {
+		t.Fatalf("failed to mount image: %v", err)
+	}
+	defer unix.Unmount(mnt, 0)
+
+	for name, want := range map[string][]byte{
+		"etc/hosts":      contents["etc/hosts"],
+		"etc/hosts.link": contents["etc/hosts"],
+		"lnk":            contents["etc/hosts"],
+		"large":          large,
+		"etc/empty":      nil,
+	} {
+		got, err := ioutil.ReadFile(filepath.Join(mnt, name))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("contents of %q = %d bytes, %v; want %d bytes", name, len(got), err, len(want))
+		}
+	}
+
+	var st, lst syscall.Stat_t
+	if err := syscall.Lstat(filepath.Join(mnt, "etc/hosts"), &st); err != nil {
+		t.Fatalf("failed to stat: %v", err)
+	}
+	if st.Mode != syscall.S_IFREG|0640 || st.Uid != 1 || st.Gid != 2 || st.Nlink != 2 || st.Mtim.Sec != 1577836800 {
+		t.Errorf("unexpected stat of etc/hosts: mode=%o uid=%d gid=%d nlink=%d mtime=%d", st.Mode, st.Uid, st.Gid, st.Nlink, st.Mtim.Sec)
+	}
+	if err := syscall.Lstat(filepath.Join(mnt, "etc/hosts.link"), &lst); err != nil || lst.Ino != st.Ino {
+		t.Errorf("hardlink must share the inode: %v", err)
+	}
+	if got := getxattr(t, filepath.Join(mnt, "etc/hosts"), "user.foo"); got != "bar" {
+		t.Errorf("user.foo = %q; want bar", got)
+	}
+	if got := getxattr(t, filepath.Join(mnt, "etc/hosts"), "trusted.overlay.redirect"); got != "" {
+		t.Errorf("overlayfs xattrs of the layer must be dropped: %q", got)
+	}
+	if got := getxattr(t, filepath.Join(mnt, "opq"), opaqueXattr); got != "y" {
+		t.Errorf("opaque xattr = %q; want y", got)
+	}
+	if err := syscall.Lstat(filepath.Join(mnt, "large"), &st); err != nil || st.Mode != syscall.S_IFREG|04755 {
+		t.Errorf("unexpected mode of large: %o, %v", st.Mode, err)
+	}
+	if err := syscall.Lstat(filepath.Join(mnt, "null"), &st); err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFCHR || unix.Major(st.Rdev) != 1 || unix.Minor(st.Rdev) != 3 {
+		t.Errorf("unexpected device: mode=%o rdev=%d, %v", st.Mode, st.Rdev, err)
+	}
+	if err := syscall.Lstat(filepath.Join(mnt, "gone"), &st); err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFCHR || st.Rdev != 0 {
+		t.Errorf("unexpected whiteout: mode=%o rdev=%d, %v", st.Mode, st.Rdev, err)
+	}
+	if _, err := os.Lstat(filepath.Join(mnt, estargz.PrefetchLandmark)); !os.IsNotExist(err) {
+		t.Errorf("landmark must be omitted: %v", err)
+	}
+	names, err := ioutil.ReadDir(filepath.Join(mnt, "big"))
+	if err != nil || len(names) != 2000 {
+		t.Errorf("big directory has %d entries, %v; want 2000", len(names), err)
+	}
+	if _, err := os.Lstat(filepath.Join(mnt, "big/file-with-a-long-name-0777")); err != nil {
+		t.Errorf("failed to lookup in big directory: %v", err)
+	}
+}
+
+func getxattr(t *testing.T, p, attr string) string {
+	buf := make([]byte, 256)
+	n, err := unix.Lgetxattr(p, attr, buf)
+	if err == unix.ENODATA {
+		return ""
+	} else if err != nil {
+		t.Fatalf("failed to get xattr %q of %q: %v", attr, p, err)
+	}
+	return string(buf[:n])
+}
+
+// openTOC returns the root of the TOC of a layer holding no contents.
+func openTOC(t *testing.T, entries []*estargz.TOCEntry) *estargz.TOCEntry {
+	tocJSON, err := json.Marshal(struct {
+		Version int                 `json:"version"`
+		Entries []*estargz.TOCEntry `json:"entries"`
+	}{1, entries})
+	if err != nil {
+		t.Fatalf("failed to marshal TOC: %v", err)
+	}
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(zw)
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     estargz.TOCTarName,
+		Size:     int64(len(tocJSON)),
+	}); err != nil {
+		t.Fatalf("failed to write TOC header: %v", err)
+	}
+	if _, err := tw.Write(tocJSON); err != nil {
+		t.Fatalf("failed to write TOC: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close tar: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("failed to close gzip: %v", err)
+	}
+	buf.Write(footer(0))
+	r, err := estargz.Open(io.NewSectionReader(bytes.NewReader(buf.Bytes()), 0, int64(buf.Len())))
+	if err != nil {
+		t.Fatalf("failed to open TOC: %v", err)
+	}
+	root, ok := r.Lookup("")
+	if !ok {
+		t.Fatalf("root not found")
+	}
+	return root
+}
+
+// footer returns the eStargz footer pointing to the TOC at the offset.
+func footer(tocOff int64) []byte {
+	subfield := fmt.Sprintf("%016xSTARGZ", tocOff)
+	extra := append([]byte{'S', 'G', byte(len(subfield)), 0}, subfield...)
+	p := []byte{0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 0xff} // gzip header with FEXTRA
+	p = append(p, byte(len(extra)), 0)
+	p = append(p, extra...)
+	p = append(p, 1, 0, 0, 0xff, 0xff)    // empty final stored block
+	p = append(p, 0, 0, 0, 0, 0, 0, 0, 0) // CRC32 and ISIZE
+	if len(p) != estargz.FooterSize {
+		panic(fmt.Sprintf("footer = %d bytes, not %d", len(p), estargz.FooterSize))
+	}
+	return p
+}
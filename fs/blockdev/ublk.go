@@ -0,0 +1,541 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package blockdev
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Constants of ublk (include/uapi/linux/ublk_cmd.h) and io_uring.
+const (
+	ublkControlDev = "/dev/ublk-control"
+
+	ublkCmdStartDev  = 0x06
+	ublkCmdStopDev   = 0x07
+	ublkCmdAddDev    = 0x04
+	ublkCmdDelDev    = 0x05
+	ublkCmdSetParams = 0x08
+	ublkIOFetchReq   = 0x20
+	ublkIOCommitReq  = 0x21 // UBLK_IO_COMMIT_AND_FETCH_REQ
+
+	ublkIOOpRead  = 0
+	ublkIOOpWrite = 1
+	ublkIOOpFlush = 2
+
+	ublkIOResAbort  = -int32(unix.ENODEV)
+	ublkAttrRO      = 1 << 0
+	ublkParamBasic  = 1 << 0
+	ublkMaxQDepth   = 4096
+	ublkQueueDepth  = 64
+	ublkMaxIOBytes  = 512 << 10
+	ublkSectorShift = 9
+
+	ioringSetupSQE128 = 1 << 10
+	ioringOpPollAdd   = 6
+	ioringOpURingCmd  = 46
+	ioringOffSQRing   = 0
+	ioringOffCQRing   = 0x8000000
+	ioringOffSQEs     = 0x10000000
+	ioringEnterGetEvt = 1 << 0
+
+	eventUserData = ^uint64(0)
+)
+
+type ublkCtrlCmd struct {
+	devID      uint32
+	queueID    uint16
+	len        uint16
+	addr       uint64
+	data       uint64
+	devPathLen uint16
+	pad        uint16
+	reserved   uint32
+}
+
+type ublkDevInfo struct {
+	nrHWQueues    uint16
+	queueDepth    uint16
+	state         uint16
+	pad0          uint16
+	maxIOBufBytes uint32
+	devID         uint32
+	ublksrvPID    int32
+	pad1          uint32
+	flags         uint64
+	ublksrvFlags  uint64
+	ownerUID      uint32
+	ownerGID      uint32
+	reserved1     uint64
+	reserved2     uint64
+}
+
+type ublkParams struct {
+	len   uint32
+	types uint32
+
+	// struct ublk_param_basic
+	attrs            uint32
+	logicalBSShift   uint8
+	physicalBSShift  uint8
+	ioOptShift       uint8
+	ioMinShift       uint8
+	maxSectors       uint32
+	chunkSectors     uint32
+	devSectors       uint64
+	virtBoundaryMask uint64
+}
+
+type ublkIODesc struct {
+	opFlags     uint32
+	nrSectors   uint32
+	startSector uint64
+	addr        uint64
+}
+
+type ublkIOCmd struct {
+	qID    uint16
+	tag    uint16
+	result int32
+	addr   uint64
+}
+
+// ioctlCmd encodes the command in the same manner as _IOWR('u', nr, size).
+func ioctlCmd(nr uint32, size uintptr) uint32 {
+	return 3<<30 | uint32(size)<<16 | 'u'<<8 | nr
+}
+
+// UblkDevice is a read-only ublk block device serving an image.
+type UblkDevice struct {
+	id   uint32
+	ctrl *ring
+	ra   io.ReaderAt
+
+	events   int // eventfd waking up the queue
+	done     []ioDone
+	doneMu   sync.Mutex
+	inflight sync.WaitGroup
+	stopping int32
+	stopped  chan error
+}
+
+type ioDone struct {
+	tag    uint16
+	result int32
+}
+
+// NewUblkDevice creates a ublk block device serving reads from ra of the
+// size. The device is available at Path() when this returns. Reads are served
+// concurrently so slow reads (e.g. fetching the contents from the registry)
+// don't block others. This requires CAP_SYS_ADMIN and the ublk_drv module.
+func NewUblkDevice(ra io.ReaderAt, size int64) (*UblkDevice, error) {
+	ctl, err := os.OpenFile(ublkControlDev, os.O_RDWR, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "ublk is unavailable")
+	}
+	defer ctl.Close()
+	ctrl, err := newRing(4)
+	if err != nil {
+		return nil, err
+	}
+	info := ublkDevInfo{
+		nrHWQueues:    1,
+		queueDepth:    ublkQueueDepth,
+		maxIOBufBytes: ublkMaxIOBytes,
+		devID:         ^uint32(0), // allocated by the kernel
+		ublksrvPID:    int32(os.Getpid()),
+	}
+	if err := ctrl.ctrlCmd(ctl, ublkCmdAddDev, &ublkCtrlCmd{
+		devID: info.devID,
+		addr:  uint64(uintptr(unsafe.Pointer(&info))),
+		len:   uint16(unsafe.Sizeof(info)),
+	}); err != nil {
+		ctrl.close()
+		return nil, errors.Wrap(err, "failed to add ublk device")
+	}
+	runtime.KeepAlive(&info)
+	d := &UblkDevice{id: info.devID, ctrl: ctrl, ra: ra, stopped: make(chan error, 1)}
+	params := ublkParams{
+		types:           ublkParamBasic,
+		attrs:           ublkAttrRO,
+		logicalBSShift:  ublkSectorShift,
+		physicalBSShift: 12,
+		ioMinShift:      ublkSectorShift,
+		maxSectors:      ublkMaxIOBytes >> ublkSectorShift,
+		devSectors:      uint64(size) >> ublkSectorShift,
+	}
+	params.len = uint32(unsafe.Sizeof(params))
+	if err := ctrl.ctrlCmd(ctl, ublkCmdSetParams, &ublkCtrlCmd{
+		devID: d.id,
+		addr:  uint64(uintptr(unsafe.Pointer(&params))),
+		len:   uint16(params.len),
+	}); err != nil {
+		d.delete(ctl)
+		return nil, errors.Wrap(err, "failed to set parameters of ublk device")
+	}
+	runtime.KeepAlive(&params)
+
+	if d.events, err = unix.Eventfd(0, unix.EFD_CLOEXEC); err != nil {
+		d.delete(ctl)
+		return nil, err
+	}
+	ready := make(chan error, 1)
+	go d.serve(ready)
+	if err := <-ready; err != nil {
+		unix.Close(d.events)
+		d.delete(ctl)
+		return nil, err
+	}
+	if err := ctrl.ctrlCmd(ctl, ublkCmdStartDev, &ublkCtrlCmd{
+		devID: d.id,
+		data:  uint64(os.Getpid()),
+	}); err != nil {
+		d.stopQueue()
+		d.delete(ctl)
+		return nil, errors.Wrap(err, "failed to start ublk device")
+	}
+	return d, nil
+}
+
+// Path returns the path of the block device.
+func (d *UblkDevice) Path() string {
+	return fmt.Sprintf("/dev/ublkb%d", d.id)
+}
+
+// Close removes the block device. The device must not be mounted.
+func (d *UblkDevice) Close() error {
+	ctl, err := os.OpenFile(ublkControlDev, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer ctl.Close()
+	stopErr := d.ctrl.ctrlCmd(ctl, ublkCmdStopDev, &ublkCtrlCmd{devID: d.id})
+	d.stopQueue()
+	if err := d.delete(ctl); err != nil {
+		return err
+	}
+	return stopErr
+}
+
+func (d *UblkDevice) delete(ctl *os.File) error {
+	defer d.ctrl.close()
+	return d.ctrl.ctrlCmd(ctl, ublkCmdDelDev, &ublkCtrlCmd{devID: d.id})
+}
+
+func (d *UblkDevice) stopQueue() {
+	atomic.StoreInt32(&d.stopping, 1)
+	d.wakeup()
+	<-d.stopped
+	d.inflight.Wait()
+	unix.Close(d.events)
+}
+
+func (d *UblkDevice) wakeup() {
+	var one [8]byte
+	one[0] = 1
+	unix.Write(d.events, one[:])
+}
+
+// serve serves the queue of the device. All commands of the queue must be
+// issued by the same thread so the goroutine is locked to the thread. Reads
+// are done by other goroutines, which queue the results and wake up the
+// queue through the eventfd.
+func (d *UblkDevice) serve(ready chan<- error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	var err error
+	started := false
+	defer func() {
+		if !started {
+			ready <- err
+		}
+		d.stopped <- err
+	}()
+	cdev, err := os.OpenFile(fmt.Sprintf("/dev/ublkc%d", d.id), os.O_RDWR, 0)
+	if err != nil {
+		return
+	}
+	defer cdev.Close()
+	descSize := int(unsafe.Sizeof(ublkIODesc{})) * ublkQueueDepth
+	descMem, err := unix.Mmap(int(cdev.Fd()), 0, alignPage(descSize), unix.PROT_READ, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		err = errors.Wrap(err, "failed to map io descriptors")
+		return
+	}
+	defer unix.Munmap(descMem)
+	descs := (*[ublkMaxQDepth]ublkIODesc)(unsafe.Pointer(&descMem[0]))[:ublkQueueDepth:ublkQueueDepth]
+	bufMem, err := unix.Mmap(-1, 0, ublkQueueDepth*ublkMaxIOBytes, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		return
+	}
+	defer unix.Munmap(bufMem)
+	q, err := newRing(2 * ublkQueueDepth)
+	if err != nil {
+		return
+	}
+	defer q.close()
+
+	buf := func(tag uint16) []byte {
+		return bufMem[int(tag)*ublkMaxIOBytes : (int(tag)+1)*ublkMaxIOBytes]
+	}
+	ioCmd := func(op uint32, tag uint16, result int32) {
+		cmd := ublkIOCmd{
+			tag:    tag,
+			result: result,
+			addr:   uint64(uintptr(unsafe.Pointer(&buf(tag)[0]))),
+		}
+		q.pushCmd(int32(cdev.Fd()), ioctlCmd(op, unsafe.Sizeof(cmd)), uint64(tag), unsafe.Pointer(&cmd), unsafe.Sizeof(cmd))
+	}
+	pollEvents := func() {
+		q.push(ringSQE{opcode: ioringOpPollAdd, fd: int32(d.events), rwFlags: unix.POLLIN, userData: eventUserData})
+	}
+	for tag := uint16(0); tag < ublkQueueDepth; tag++ {
+		ioCmd(ublkIOFetchReq, tag, 0)
+	}
+	pollEvents()
+	if err = q.submit(0); err != nil {
+		return
+	}
+	started = true
+	ready <- nil
+
+	active := ublkQueueDepth
+	for active > 0 {
+		if atomic.LoadInt32(&d.stopping) != 0 {
+			return // the ring is closed and remaining commands are canceled
+		}
+		if err = q.submit(1); err != nil {
+			return
+		}
+		q.reap(func(userData uint64, res int32) {
+			if userData == eventUserData {
+				var v [8]byte
+				unix.Read(d.events, v[:])
+				d.doneMu.Lock()
+				done := d.done
+				d.done = nil
+				d.doneMu.Unlock()
+				for _, r := range done {
+					ioCmd(ublkIOCommitReq, r.tag, r.result)
+				}
+				pollEvents()
+				return
+			}
+			tag := uint16(userData)
+			if res == ublkIOResAbort {
+				active--
+				return
+			} else if res != 0 {
+				return // unexpected; the tag isn't used anymore
+			}
+			d.inflight.Add(1)
+			go d.handle(tag, descs[tag], buf(tag))
+		})
+	}
+}
+
+// handle serves the request and queues the result.
+func (d *UblkDevice) handle(tag uint16, desc ublkIODesc, buf []byte) {
+	defer d.inflight.Done()
+	var result int32
+	switch desc.opFlags & 0xff {
+	case ublkIOOpRead:
+		p := buf[:int(desc.nrSectors)<<ublkSectorShift]
+		n, err := d.ra.ReadAt(p, int64(desc.startSector)<<ublkSectorShift)
+		if err != nil && err != io.EOF {
+			result = -int32(unix.EIO)
+		} else {
+			for i := n; i < len(p); i++ {
+				p[i] = 0 // beyond the end of the image
+			}
+			result = int32(len(p))
+		}
+	case ublkIOOpFlush:
+	case ublkIOOpWrite:
+		result = -int32(unix.EROFS)
+	default:
+		result = -int32(unix.EOPNOTSUPP)
+	}
+	d.doneMu.Lock()
+	d.done = append(d.done, ioDone{tag, result})
+	d.doneMu.Unlock()
+	d.wakeup()
+}
+
+func alignPage(size int) int {
+	page := os.Getpagesize()
+	return (size + page - 1) / page * page
+}
+
+// ring is an io_uring instance with 128-byte submission queue entries, which
+// are needed by the commands of ublk.
+type ring struct {
+	fd                     int
+	sqHead, sqTail, sqMask *uint32
+	sqArray                []uint32
+	sqes                   []ringSQE
+	cqHead, cqTail, cqMask *uint32
+	cqes                   []ringCQE
+	toSubmit               uint32
+	mems                   [][]byte
+}
+
+type ringSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64 // cmd_op for IORING_OP_URING_CMD
+	addr        uint64
+	len         uint32
+	rwFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	cmd         [80]byte
+}
+
+type ringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+type ringParams struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFd uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  [10]uint32
+	cqOff                                                                  [10]uint32
+}
+
+func newRing(entries uint32) (*ring, error) {
+	params := ringParams{flags: ioringSetupSQE128}
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&params)), 0)
+	if errno != 0 {
+		return nil, errors.Wrap(errno, "failed to setup io_uring")
+	}
+	r := &ring{fd: int(fd)}
+	mmap := func(offset int64, size uint32) ([]byte, error) {
+		b, err := unix.Mmap(r.fd, offset, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+		if err == nil {
+			r.mems = append(r.mems, b)
+		}
+		return b, err
+	}
+	// offsets: head, tail, ring_mask, ring_entries, flags, dropped, array (SQ)
+	// and head, tail, ring_mask, ring_entries, overflow, cqes (CQ)
+	sq, cq := params.sqOff, params.cqOff
+	sqRing, err := mmap(ioringOffSQRing, sq[6]+params.sqEntries*4)
+	if err != nil {
+		r.close()
+		return nil, errors.Wrap(err, "failed to map submission queue")
+	}
+	cqRing, err := mmap(ioringOffCQRing, cq[5]+params.cqEntries*uint32(unsafe.Sizeof(ringCQE{})))
+	if err != nil {
+		r.close()
+		return nil, errors.Wrap(err, "failed to map completion queue")
+	}
+	sqeMem, err := mmap(ioringOffSQEs, params.sqEntries*uint32(unsafe.Sizeof(ringSQE{})))
+	if err != nil {
+		r.close()
+		return nil, errors.Wrap(err, "failed to map submission queue entries")
+	}
+	u32 := func(b []byte, off uint32) *uint32 { return (*uint32)(unsafe.Pointer(&b[off])) }
+	r.sqHead, r.sqTail, r.sqMask = u32(sqRing, sq[0]), u32(sqRing, sq[1]), u32(sqRing, sq[2])
+	r.sqArray = (*[1 << 20]uint32)(unsafe.Pointer(&sqRing[sq[6]]))[:params.sqEntries:params.sqEntries]
+	r.sqes = (*[1 << 14]ringSQE)(unsafe.Pointer(&sqeMem[0]))[:params.sqEntries:params.sqEntries]
+	r.cqHead, r.cqTail, r.cqMask = u32(cqRing, cq[0]), u32(cqRing, cq[1]), u32(cqRing, cq[2])
+	r.cqes = (*[1 << 17]ringCQE)(unsafe.Pointer(&cqRing[cq[5]]))[:params.cqEntries:params.cqEntries]
+	return r, nil
+}
+
+func (r *ring) close() {
+	for _, b := range r.mems {
+		unix.Munmap(b)
+	}
+	r.mems = nil
+	unix.Close(r.fd)
+}
+
+// push queues the entry. The caller must not queue more entries than the ring
+// can hold before submitting them.
+func (r *ring) push(sqe ringSQE) {
+	tail := atomic.LoadUint32(r.sqTail)
+	idx := tail & atomic.LoadUint32(r.sqMask)
+	r.sqes[idx] = sqe
+	r.sqArray[idx] = idx
+	atomic.StoreUint32(r.sqTail, tail+1)
+	r.toSubmit++
+}
+
+// pushCmd queues IORING_OP_URING_CMD with the payload of the size.
+func (r *ring) pushCmd(fd int32, op uint32, userData uint64, payload unsafe.Pointer, size uintptr) {
+	sqe := ringSQE{opcode: ioringOpURingCmd, fd: fd, off: uint64(op), userData: userData}
+	copy(sqe.cmd[:], (*[80]byte)(payload)[:size])
+	r.push(sqe)
+}
+
+// submit submits the queued entries and waits for at least minComplete
+// completions.
+func (r *ring) submit(minComplete uint32) error {
+	for {
+		n, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(r.toSubmit), uintptr(minComplete), ioringEnterGetEvt, 0, 0)
+		if errno == unix.EINTR {
+			continue
+		} else if errno != 0 {
+			return errors.Wrap(errno, "failed to enter io_uring")
+		}
+		r.toSubmit -= uint32(n)
+		return nil
+	}
+}
+
+// reap calls f for each completion.
+func (r *ring) reap(f func(userData uint64, res int32)) {
+	head, mask := atomic.LoadUint32(r.cqHead), atomic.LoadUint32(r.cqMask)
+	for ; head != atomic.LoadUint32(r.cqTail); head++ {
+		cqe := r.cqes[head&mask]
+		f(cqe.userData, cqe.res)
+	}
+	atomic.StoreUint32(r.cqHead, head)
+}
+
+// ctrlCmd issues the control command and returns the result.
+func (r *ring) ctrlCmd(ctl *os.File, nr uint32, cmd *ublkCtrlCmd) error {
+	size := unsafe.Sizeof(*cmd)
+	r.pushCmd(int32(ctl.Fd()), ioctlCmd(nr, size), 0, unsafe.Pointer(cmd), size)
+	if err := r.submit(1); err != nil {
+		return err
+	}
+	res := -int32(unix.EIO)
+	r.reap(func(_ uint64, cqeRes int32) { res = cqeRes })
+	if res < 0 {
+		return syscall.Errno(-res)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/remote"
+)
+
+// chunkIndex indexes chunks of resolved layers by their digests. A chunk
+// missing the filesystem cache can be taken from the blob cache of another
+// layer which contains the same chunk (e.g. files copied across build stages)
+// instead of fetching it from the registry.
+type chunkIndex struct {
+	chunks map[string][]chunkLocation // chunk digest -> locations
+	layers map[string]int             // layer digest -> number of registrations
+	mu     sync.RWMutex
+
+	hits       int64 // accessed atomically
+	reusedSize int64 // accessed atomically
+}
+
+// chunkLocation is the compressed region of a chunk in a layer blob.
+type chunkLocation struct {
+	layer      string
+	blob       remote.CachedReader
+	offset     int64
+	nextOffset int64
+}
+
+func newChunkIndex() *chunkIndex {
+	return &chunkIndex{
+		chunks: make(map[string][]chunkLocation),
+		layers: make(map[string]int),
+	}
+}
+
+// add registers chunks of the layer. A layer registered more than once (e.g.
+// resolved by different references) must be removed as many times.
+func (ci *chunkIndex) add(layerDigest string, blob remote.Blob, w chunkEntryWalker) error {
+	cr, ok := blob.(remote.CachedReader)
+	if !ok {
+		return nil
+	}
+	ci.mu.Lock()
+	if ci.layers[layerDigest] > 0 {
+		ci.layers[layerDigest]++
+		ci.mu.Unlock()
+		return nil
+	}
+	ci.mu.Unlock()
+
+	// Collect chunks without the lock because walking TOC can take long.
+	chunks := make(map[string]chunkLocation)
+	if err := w.ForeachChunkEntry(func(_ string, ce *estargz.TOCEntry) {
+		if ce.ChunkDigest == "" || ce.Hole {
+			return
+		}
+		chunks[ce.ChunkDigest] = chunkLocation{
+			layer:      layerDigest,
+			blob:       cr,
+			offset:     ce.Offset,
+			nextOffset: ce.NextOffset(),
+		}
+	}); err != nil {
+		return err
+	}
+
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	ci.layers[layerDigest]++
+	if ci.layers[layerDigest] > 1 {
+		return nil
+	}
+	for dgst, loc := range chunks {
+		ci.chunks[dgst] = append(ci.chunks[dgst], loc)
+	}
+	return nil
+}
+
+// remove unregisters chunks of the layer registered by add.
+func (ci *chunkIndex) remove(layerDigest string) {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	if ci.layers[layerDigest]--; ci.layers[layerDigest] > 0 {
+		return
+	}
+	delete(ci.layers, layerDigest)
+	for dgst, locs := range ci.chunks {
+		var remain []chunkLocation
+		for _, loc := range locs {
+			if loc.layer != layerDigest {
+				remain = append(remain, loc)
+			}
+		}
+		if len(remain) == 0 {
+			delete(ci.chunks, dgst)
+		} else {
+			ci.chunks[dgst] = remain
+		}
+	}
+}
+
+// read fills p with the chunk of the digest decompressed from the blob cache
+// of a layer other than self. Nothing is fetched from registries. The caller
+// must verify the contents.
+func (ci *chunkIndex) read(self, chunkDigest string, p []byte) bool {
+	ci.mu.RLock()
+	locs := ci.chunks[chunkDigest]
+	ci.mu.RUnlock()
+	for _, loc := range locs {
+		if loc.layer == self || loc.nextOffset <= loc.offset {
+			continue
+		}
+		buf := make([]byte, loc.nextOffset-loc.offset)
+		if n, err := loc.blob.ReadCachedAt(buf, loc.offset); err != nil || n != len(buf) {
+			continue
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(buf))
+		if err != nil {
+			continue
+		}
+		if _, err := io.ReadFull(zr, p); err != nil {
+			continue
+		}
+		atomic.AddInt64(&ci.hits, 1)
+		atomic.AddInt64(&ci.reusedSize, int64(len(p)))
+		return true
+	}
+	return false
+}
@@ -31,6 +31,120 @@ const (
 	// the layer. If the layer is eStargz and contains prefetch landmarks, these config
 	// will be respeced.
 	TargetPrefetchSizeLabel = "containerd.io/snapshot/remote/stargz.prefetch"
+
+	// TargetCacheCompressionLabel is a snapshot label key that indicates whether
+	// the filesystem cache of the layer is stored compressed ("true" or "false").
+	// This overrides "compress" option of the directory cache config.
+	TargetCacheCompressionLabel = "containerd.io/snapshot/remote/stargz.cache-compression"
+
+	// TargetCacheTierLabel is a snapshot label key that indicates the cache tier
+	// where the filesystem cache of the layer is stored first. If "hot" is
+	// specified and the hot tier is enabled, contents of the layer are stored in
+	// the hot tier.
+	TargetCacheTierLabel = "containerd.io/snapshot/remote/stargz.cache-tier"
+
+	// TargetFUSECacheModeLabel is a snapshot label key that indicates how the
+	// kernel caches the contents of files of the layer. This overrides
+	// "fuse_cache_mode" config. See FUSECacheMode* for the available values.
+	TargetFUSECacheModeLabel = "containerd.io/snapshot/remote/stargz.fuse-cache"
+
+	// TargetQoSClassLabel is a snapshot label key that indicates the QoS class
+	// of fetches of the layer ("high", "normal" or "low"). This is effective
+	// when "max_concurrent_fetches" is configured.
+	TargetQoSClassLabel = "containerd.io/snapshot/remote/stargz.qos-class"
+
+	// TargetStreamingReadThresholdLabel is a snapshot label key that indicates
+	// the size of files (in bytes) from which sequential reads are served by
+	// streams of the blob. "0" disables streaming for the layer. This
+	// overrides "streaming_read_threshold" config.
+	TargetStreamingReadThresholdLabel = "containerd.io/snapshot/remote/stargz.streaming-read-threshold"
+
+	// TargetImageVolumeLabel is a snapshot label key that indicates the layer
+	// is of an image mounted as a volume ("true"). The prefetch policy of
+	// ImageVolumeConfig is used for such layers.
+	TargetImageVolumeLabel = "containerd.io/snapshot/remote/stargz.image-volume"
+
+	// TargetPrefetchProfileLabel is a snapshot label key that indicates the
+	// named prefetch profile of the layer (e.g. "serve" or "test"). If the
+	// layer is eStargz built with the profile, the files listed by the profile
+	// are prefetched instead of the prefetch landmark. Otherwise, the profile
+	// is ignored.
+	TargetPrefetchProfileLabel = "containerd.io/snapshot/remote/stargz.prefetch-profile"
+
+	// TargetPinLabel is a snapshot label key that indicates the layer is
+	// pinned ("true") so its cached chunks are never evicted from the
+	// filesystem cache. The pin persists until it's removed via the API.
+	TargetPinLabel = "containerd.io/snapshot/remote/stargz.pin"
+
+	// VerifiedLabel is a label key of remote snapshots set by the snapshotter,
+	// which indicates whether the chunks of the layer are verified against
+	// the digests chained from the digest of the layer ("true" or "false").
+	VerifiedLabel = "containerd.io/snapshot/remote/stargz.verified"
+
+	// VerificationModeLabel is a label key of remote snapshots set by the
+	// snapshotter, which indicates how the layer is verified. See
+	// VerificationMode* for the values.
+	VerificationModeLabel = "containerd.io/snapshot/remote/stargz.verification"
+)
+
+const (
+	// VerificationModeTOCDigest verifies the TOC with the TOC digest passed
+	// by the annotation of the layer and the chunks with the digests in the
+	// TOC.
+	VerificationModeTOCDigest = "toc-digest"
+
+	// VerificationModeNydus verifies the bootstrap of a Nydus image with its
+	// digest and the chunks with the digests in the bootstrap.
+	VerificationModeNydus = "nydus-bootstrap"
+
+	// VerificationModeSkipped doesn't verify the layer because it has no TOC
+	// digest and TargetSkipVerifyLabel is specified with
+	// "allow_no_verification".
+	VerificationModeSkipped = "skipped"
+
+	// VerificationModeDisabled doesn't verify the layer because of
+	// "disable_verification".
+	VerificationModeDisabled = "disabled"
+)
+
+const (
+	// FUSECacheModeKeepCache keeps the page cache of files across opens
+	// (FOPEN_KEEP_CACHE). This is suitable for latency-sensitive workloads.
+	FUSECacheModeKeepCache = "keep_cache"
+
+	// FUSECacheModeDirectIO bypasses the page cache (FOPEN_DIRECT_IO) so that
+	// the contents aren't duplicated in the memory of the node. This is suitable
+	// for memory-constrained nodes. Note that files can't be mmapped with
+	// MAP_SHARED in this mode.
+	FUSECacheModeDirectIO = "direct_io"
+)
+
+const (
+	// ATimeModeNoATime never updates access times. Access times are the
+	// modification times recorded in TOCs.
+	ATimeModeNoATime = "noatime"
+
+	// ATimeModeRelATime updates the access time of a file on a read only if the
+	// previous access time is earlier than the modification time or a day ago.
+	ATimeModeRelATime = "relatime"
+
+	// ATimeModeStrictATime updates the access time of a file on each read.
+	ATimeModeStrictATime = "strictatime"
+)
+
+const (
+	// OverlayOpaqueTrusted indicates opaque directories with the
+	// "trusted.overlay.opaque" xattr, which is used by overlayfs mounted by
+	// the real root.
+	OverlayOpaqueTrusted = "trusted"
+
+	// OverlayOpaqueUser indicates opaque directories with the
+	// "user.overlay.opaque" xattr, which is used by overlayfs mounted with
+	// "userxattr" option (e.g. rootless overlayfs in user namespaces).
+	OverlayOpaqueUser = "user"
+
+	// OverlayOpaqueAll indicates opaque directories with both of the xattrs.
+	OverlayOpaqueAll = "all"
 )
 
 type Config struct {
@@ -46,6 +160,196 @@ type Config struct {
 	DisableVerification bool   `toml:"disable_verification"`
 	MaxConcurrency      int64  `toml:"max_concurrency"`
 
+	// MountTimeoutSec is the upper bound of the time to wait for resolving a
+	// layer on mount. Zero means the default (30).
+	MountTimeoutSec int64 `toml:"mount_timeout_sec"`
+
+	// SyncResolveTopLayers enables asynchronous mount of deep layers. If positive,
+	// only the top N layers of an image are resolved on mount and other layers are
+	// mounted immediately while they are resolved in background. Reads on these
+	// layers block until the completion. Zero disables asynchronous mount.
+	SyncResolveTopLayers int `toml:"sync_resolve_top_layers"`
+
+	// ExposeLayerBlob exposes the raw layer blob as a file in the state directory
+	// of each mount for debugging. Reading the file fetches the blob from the
+	// registry on demand.
+	ExposeLayerBlob bool `toml:"expose_layer_blob"`
+
+	// NegativeCacheTTLSec is the duration to remember layers which aren't eStargz.
+	// Mounting these layers fails without resolving them during this duration.
+	// Zero or negative value (default) disables the cache.
+	NegativeCacheTTLSec int64 `toml:"negative_cache_ttl_sec"`
+
+	// EBPFAccessHints enables learning files accessed by containers during
+	// startup using eBPF. Following mounts of the same layer prefetch these files
+	// in background. This requires CAP_SYS_ADMIN and tracefs.
+	EBPFAccessHints bool `toml:"ebpf_access_hints"`
+
+	// AccessHintsLearnWindowSec is the duration after mounting a layer during
+	// which accesses to the layer are learned. Zero means the default (60).
+	AccessHintsLearnWindowSec int64 `toml:"access_hints_learn_window_sec"`
+
+	// PredictivePrefetch enables prefetching files predicted to be accessed next
+	// on each file access. The prediction is learned from the order of accesses
+	// during prior mounts of the same layer on the node.
+	PredictivePrefetch bool `toml:"predictive_prefetch"`
+
+	// ScanPrefetch enables prefetching small files in directories swept by
+	// workloads (a readdir followed by lookups of many children, e.g. module
+	// scanning of Python) in bulk.
+	ScanPrefetch bool `toml:"scan_prefetch"`
+
+	// ScanPrefetchThreshold is the number of lookups in a directory within 5
+	// seconds after listing it which are regarded as a sweep. Zero means 16.
+	ScanPrefetchThreshold int `toml:"scan_prefetch_threshold"`
+
+	// ScanPrefetchMaxFileSize is the maximum size of files prefetched from swept
+	// directories. Zero means 65536.
+	ScanPrefetchMaxFileSize int64 `toml:"scan_prefetch_max_file_size"`
+
+	// PrefetchPageCache advises the kernel to load the filesystem cache of the
+	// prefetched contents into the page cache after prefetching, so the first
+	// reads by the container hit the memory. This trades the memory for the
+	// latency and is effective only with the directory cache.
+	PrefetchPageCache bool `toml:"prefetch_page_cache"`
+
+	// FUSECacheMode is the default of how the kernel caches the contents of
+	// files. This is either FUSECacheModeKeepCache or FUSECacheModeDirectIO.
+	// Empty means the kernel's default, which caches the contents but drops
+	// them on each open. This can be overridden per image with
+	// TargetFUSECacheModeLabel.
+	FUSECacheMode string `toml:"fuse_cache_mode"`
+
+	// ATimeMode is how access times of files on FUSE mounts are updated. This
+	// is one of ATimeMode* and is also passed as a mount option. The kernel
+	// doesn't update access times on FUSE so the filesystem tracks reads
+	// itself. Empty means ATimeModeNoATime without the mount option.
+	ATimeMode string `toml:"atime_mode"`
+
+	// OverlayOpaqueType is the xattr which indicates opaque directories to
+	// overlayfs stacked on the layers. This is one of OverlayOpaque*. Empty
+	// means OverlayOpaqueUser if the daemon runs in a user namespace (where
+	// overlayfs can't read trusted.* xattrs) and OverlayOpaqueTrusted
+	// otherwise.
+	OverlayOpaqueType string `toml:"overlay_opaque_type"`
+
+	// OverlayDataOnly provides layers as overlayfs data-only lower layers
+	// (Linux 6.5 or later) instead of FUSE mounts. The metadata of each layer is
+	// written to the snapshot directory so metadata operations don't reach FUSE.
+	// Only the contents of files are served by FUSE and fetched lazily. This
+	// disables SyncResolveTopLayers.
+	OverlayDataOnly bool `toml:"overlay_data_only"`
+
+	// OverlayDataOnlyVerity records fs-verity digests of files in the metadata
+	// of layers in the data-only mode (composefs-compatible). This reads all
+	// contents of each layer on mount.
+	OverlayDataOnlyVerity bool `toml:"overlay_data_only_verity"`
+
+	// Composefs writes the metadata of each layer as an EROFS image (composefs
+	// image) and mounts it instead of populating the snapshot directory in the
+	// data-only mode. This implies OverlayDataOnly.
+	Composefs bool `toml:"composefs"`
+
+	// UblkSquashfs additionally serves each layer as a read-only ublk block
+	// device (Linux 6.0 or later) holding a squashfs image of the layer, for
+	// runtimes which take the rootfs as block devices. Reads on the device are
+	// mapped to the contents of the files and fetched lazily. Experimental.
+	UblkSquashfs bool `toml:"ublk_squashfs"`
+
+	// LabelPassthrough is glob patterns of snapshot labels passed to the
+	// filesystem (source providers and fetch policies). "*" matches any
+	// sequence of characters including "/" and "?" matches a character.
+	// Labels of the snapshotter itself (containerd.io/snapshot.ref,
+	// containerd.io/snapshot/remote* and containerd.io/snapshot/cri.*) are
+	// always passed. Empty means all labels are passed.
+	LabelPassthrough []string `toml:"label_passthrough"`
+
+	// FDSoftCap is the soft cap of file descriptors held by cache files and FUSE
+	// connections. When this is exceeded, file handles kept open by the caches
+	// are closed in the least recently used order. Zero means no cap.
+	FDSoftCap int `toml:"fd_soft_cap"`
+
+	// FDLeakCheckIntervalSec is the interval to check file descriptors of the
+	// process. The top holders are logged when the process uses most of
+	// RLIMIT_NOFILE or descriptors not held by caches and FUSE connections keep
+	// growing. Zero means the default (300).
+	FDLeakCheckIntervalSec int64 `toml:"fd_leak_check_interval_sec"`
+
+	// MaxMemoryBytes is the memory budget of the metadata of layers and the
+	// memory caches. When the accounted memory or RSS of the process exceeds
+	// this, contents in the memory caches and least recently used resolution
+	// results are dropped. Zero means no budget.
+	MaxMemoryBytes int64 `toml:"max_memory_bytes"`
+
+	// MemoryCheckIntervalSec is the interval to check RSS against
+	// MaxMemoryBytes. Zero means the default (10).
+	MemoryCheckIntervalSec int64 `toml:"memory_check_interval_sec"`
+
+	// ZeroCopyRead serves reads of files from the filesystem cache with
+	// splice(2) instead of copying the contents through the user space. This
+	// reduces CPU usage of read-heavy workloads. Reads which span multiple
+	// chunks or hit chunks not cached yet are copied as usual. This is
+	// effective only with the directory cache without compression.
+	ZeroCopyRead bool `toml:"zero_copy_read"`
+
+	// StreamingReadThreshold is the size of files (in bytes) from which
+	// sequential reads are served by a single long-lived request to the
+	// registry instead of fetching chunks one by one. The streamed contents
+	// aren't stored in the caches so reading large files once (e.g. model
+	// weights) doesn't flush the caches. Zero disables streaming. This can be
+	// overridden per image with TargetStreamingReadThresholdLabel.
+	StreamingReadThreshold int64 `toml:"streaming_read_threshold"`
+
+	// DeltaPrefetch prefetches only chunks which aren't in the filesystem
+	// cache for layers sharing chunks with cached layers (e.g. a new version
+	// of an image whose previous version has been used on the node), instead
+	// of fetching the whole prefetch range of the layer.
+	DeltaPrefetch bool `toml:"delta_prefetch"`
+
+	// CrossLayerFetch indexes chunks of resolved layers by their digests and
+	// takes a chunk missing the filesystem cache from the blob cache of
+	// another layer containing the same chunk (e.g. a file copied across
+	// build stages) instead of fetching it from the registry.
+	CrossLayerFetch bool `toml:"cross_layer_fetch"`
+
+	// PinTagDigest resolves the manifest digest of each image mounted by tag
+	// and pins it on the first mount. The tag is periodically resolved again
+	// and drifts (i.e. the tag has moved upstream) are logged and reported by
+	// the API. Mounted contents never change on drift because layers are
+	// always fetched by their digests.
+	PinTagDigest bool `toml:"pin_tag_digest"`
+
+	// TagDriftCheckIntervalSec is the interval to resolve tags pinned by
+	// PinTagDigest. Zero means the default (600).
+	TagDriftCheckIntervalSec int64 `toml:"tag_drift_check_interval_sec"`
+
+	// ImageVolume is the prefetch policy of layers of images mounted as volumes
+	// (e.g. Kubernetes image volumes) instead of rootfs of containers.
+	ImageVolume ImageVolumeConfig `toml:"image_volume"`
+
+	// Privilege is config for reducing privileges of the daemon which parses
+	// untrusted data from registries.
+	Privilege PrivilegeConfig `toml:"privilege"`
+
+	// LatencyWatchdog is config for falling back to fetching whole layers when
+	// on-demand reads are persistently slow.
+	LatencyWatchdog LatencyWatchdogConfig `toml:"latency_watchdog"`
+
+	// ChunkIntegrity is config for verifying chunks read from the filesystem
+	// cache.
+	ChunkIntegrity ChunkIntegrityConfig `toml:"chunk_integrity"`
+
+	// AuditLog is config for recording reads of contents which aren't
+	// verified.
+	AuditLog AuditLogConfig `toml:"audit_log"`
+
+	// FIPS restricts cryptographic algorithms to the ones approved by FIPS
+	// 140. Layers of Nydus images whose chunks are digested by BLAKE3 are
+	// refused and registries are connected with TLS 1.2 and approved cipher
+	// suites only. The daemon needs to be built with BoringCrypto
+	// (GOEXPERIMENT=boringcrypto) to use a validated implementation of them.
+	FIPS bool `toml:"fips"`
+
 	// BlobConfig is config for layer blob management.
 	BlobConfig `toml:"blob"`
 
@@ -53,15 +357,206 @@ type Config struct {
 	DirectoryCacheConfig `toml:"directory_cache"`
 }
 
+// ImageVolumeConfig is the prefetch policy of layers of data images, which are
+// mounted as volumes. Layers are regarded as those of data images when they are
+// labeled with TargetImageVolumeLabel or mounted as read-only views (this is
+// how containerd mounts image volumes) instead of rootfs. Prefetch landmarks
+// of layers, which are based on the workload of containers, aren't used for
+// data images.
+type ImageVolumeConfig struct {
+	// PrefetchSize is the size to prefetch from the top of each layer of data
+	// images. Zero means the same as PrefetchSize of rootfs.
+	PrefetchSize int64 `toml:"prefetch_size"`
+
+	// PrefetchAll prefetches whole layers of data images. This takes precedence
+	// over PrefetchSize.
+	PrefetchAll bool `toml:"prefetch_all"`
+}
+
+// PrivilegeConfig is config for reducing privileges of the daemon. These are
+// applied after the daemon is initialized.
+type PrivilegeConfig struct {
+	// NoAllowOther mounts layers without "allow_other" so only the owner of
+	// the mounts (ServeUID if set, root otherwise) can access them. This is
+	// suitable only when containers don't access the mounts with other users
+	// (e.g. the mounts are lower layers of overlayfs, which accesses them with
+	// the credentials of the mounter).
+	NoAllowOther bool `toml:"no_allow_other"`
+
+	// ServeUID and ServeGID are the user and the group which the daemon
+	// switches to, keeping KeepCapabilities effective. FUSE mounts are owned
+	// by them and requests of the mounts are served under them. Note that
+	// goroutines share threads so the switch applies to the whole daemon.
+	// Like DropCapabilities, this requires the daemon built with
+	// CGO_ENABLED=0. Zero means staying root.
+	ServeUID int `toml:"serve_uid"`
+	ServeGID int `toml:"serve_gid"`
+
+	// DropCapabilities drops capabilities other than KeepCapabilities from
+	// the daemon. This requires the daemon built with CGO_ENABLED=0.
+	DropCapabilities bool `toml:"drop_capabilities"`
+
+	// KeepCapabilities is the capabilities kept by DropCapabilities. Empty
+	// means the ones needed for mounting and serving layers (CAP_SYS_ADMIN,
+	// CAP_DAC_OVERRIDE, CAP_DAC_READ_SEARCH, CAP_FOWNER, CAP_CHOWN,
+	// CAP_FSETID and CAP_MKNOD) plus CAP_BPF, CAP_PERFMON and
+	// CAP_SYS_RESOURCE if EBPFAccessHints is enabled.
+	KeepCapabilities []string `toml:"keep_capabilities"`
+
+	// Seccomp installs a seccomp filter to the daemon, which denies syscalls
+	// never needed for serving layers (e.g. ptrace, loading kernel modules and
+	// kexec). bpf and perf_event_open are allowed if EBPFAccessHints is
+	// enabled.
+	Seccomp bool `toml:"seccomp"`
+}
+
+// LatencyWatchdogConfig is config of the watchdog of the latency of on-demand
+// fetches. When the p99 latency of fetches of a layer in the last WindowSec
+// exceeds ThresholdMsec, the whole layer is fetched in background (i.e.
+// materialized) so following reads don't depend on the registry path anymore.
+// Triggered layers are logged and reported by the API.
+type LatencyWatchdogConfig struct {
+	// ThresholdMsec is the threshold of the p99 latency of on-demand fetches in
+	// milliseconds. Zero disables the watchdog.
+	ThresholdMsec int64 `toml:"threshold_msec"`
+
+	// WindowSec is the duration in which the latency must be sustained. Zero
+	// means the default (60).
+	WindowSec int64 `toml:"window_sec"`
+
+	// MinSamples is the minimum number of fetches in the window for evaluating
+	// the latency, so a few slow reads don't trigger the fallback. Zero means
+	// the default (20).
+	MinSamples int `toml:"min_samples"`
+}
+
+// ChunkIntegrityConfig is config of the verification of chunks read from the
+// filesystem cache. Chunks failing verification (e.g. corrupted on the disk)
+// are dropped from the cache and refetched from the registry instead of
+// failing the read with EIO. Failures are logged and reported by the API.
+type ChunkIntegrityConfig struct {
+	// VerifyCache verifies chunks read from the filesystem cache against their
+	// digests in the TOC. This costs CPU on every cache hit and disables
+	// ZeroCopyRead because reads with splice(2) can't be verified.
+	VerifyCache bool `toml:"verify_cache"`
+
+	// QuarantineThreshold is the number of failures after which a chunk is
+	// quarantined: it's always read from the registry and never stored in the
+	// cache again, so a faulty region of the cache storage doesn't cause a
+	// refetch on every read. Zero means the default (3).
+	QuarantineThreshold int `toml:"quarantine_threshold"`
+}
+
+// AuditLogConfig is config of the audit log of reads served from layers which
+// aren't verified, i.e. layers mounted with "disable_verification" or allowed
+// to skip verification by "allow_no_verification". Each read is recorded with
+// the image, the layer digest, the path and the byte range as a JSON line.
+type AuditLogConfig struct {
+	// Path is the file where records are appended. The file is created if it
+	// doesn't exist.
+	Path string `toml:"path"`
+
+	// Syslog sends records to the local syslog daemon instead of a file.
+	Syslog bool `toml:"syslog"`
+}
+
 type BlobConfig struct {
 	ValidInterval   int64 `toml:"valid_interval"`
 	CheckAlways     bool  `toml:"check_always"`
 	ChunkSize       int64 `toml:"chunk_size"`
 	FetchTimeoutSec int64 `toml:"fetching_timeout_sec"`
+
+	// ResolveTimeoutSec is the timeout of each request for resolving a blob
+	// (following the redirection and getting the size). Zero means 10.
+	ResolveTimeoutSec int64 `toml:"resolve_timeout_sec"`
+
+	// TOCFetchTimeoutSec, PrefetchFetchTimeoutSec and OnDemandFetchTimeoutSec
+	// are the timeouts of fetching TOCs, fetching the ranges prefetched on
+	// mount and fetching chunks read on demand respectively. Zero means
+	// FetchTimeoutSec, which is also used for other fetches (e.g. background
+	// fetches).
+	TOCFetchTimeoutSec      int64 `toml:"toc_fetching_timeout_sec"`
+	PrefetchFetchTimeoutSec int64 `toml:"prefetch_fetching_timeout_sec"`
+	OnDemandFetchTimeoutSec int64 `toml:"on_demand_fetching_timeout_sec"`
+
+	// MaxConcurrentFetches is the maximum number of concurrent fetches from
+	// registries. If positive, fetches are queued and admitted by QoS classes
+	// of layers (TargetQoSClassLabel); on-demand reads go before background
+	// fetches and high-class layers get larger shares. Zero means unlimited.
+	MaxConcurrentFetches int `toml:"max_concurrent_fetches"`
+
+	// RateLimitReserve is the number of requests left to on-demand fetches
+	// when a registry reports its rate limit (RateLimit-Remaining header).
+	// Background fetches from the registry are deferred while the remaining
+	// requests are this or fewer, or after the registry responded with 429.
+	// Zero means 10. Negative disables deferring by the remaining requests.
+	RateLimitReserve int `toml:"rate_limit_reserve"`
+
+	// Hedging is the config of hedging on-demand fetches.
+	Hedging HedgingConfig `toml:"hedging"`
+}
+
+// HedgingConfig is the config of hedged requests of on-demand fetches. If the
+// response of a fetch doesn't come within the delay, a second request is sent
+// to another host (e.g. a mirror) and the first response is taken.
+type HedgingConfig struct {
+	Enable bool `toml:"enable"`
+
+	// Percentile is the percentile of the latencies of recent fetches used as
+	// the delay. Zero means 95.
+	Percentile int `toml:"percentile"`
+
+	// MinDelayMsec is the minimum delay in milliseconds. This is also used
+	// until enough fetches are observed. Zero means 50.
+	MinDelayMsec int64 `toml:"min_delay_msec"`
+
+	// BudgetPercent caps the hedged requests to this percent of the on-demand
+	// fetches. Zero means 5.
+	BudgetPercent int `toml:"budget_percent"`
 }
 
 type DirectoryCacheConfig struct {
 	MaxLRUCacheEntry int  `toml:"max_lru_cache_entry"`
 	MaxCacheFds      int  `toml:"max_cache_fds"`
 	SyncAdd          bool `toml:"sync_add"`
+
+	// HighWatermarkPercent is the disk usage of the filesystem holding the
+	// cache directory, which triggers eviction of caches. This should be lower
+	// than kubelet's imagefs eviction threshold. Zero disables the eviction.
+	HighWatermarkPercent int `toml:"high_watermark_percent"`
+
+	// LowWatermarkPercent is the disk usage where the eviction stops.
+	LowWatermarkPercent int `toml:"low_watermark_percent"`
+
+	// WatermarkCheckIntervalSec is the interval to check the disk usage.
+	WatermarkCheckIntervalSec int64 `toml:"watermark_check_interval_sec"`
+
+	// Compress stores the filesystem cache compressed with zstd. This trades CPU
+	// for the capacity of the cache directory. HTTP cache isn't compressed because
+	// layer blobs are already compressed.
+	Compress bool `toml:"compress"`
+
+	// DecompressedCacheMaxBytes is the size limit of the memory cache holding
+	// decompressed contents of chunks frequently read from the compressed
+	// filesystem cache, so repeated reads of hot chunks skip decompression.
+	// This is effective only with Compress. Zero disables the cache.
+	DecompressedCacheMaxBytes int64 `toml:"decompressed_cache_max_bytes"`
+
+	// IOUring reads and writes cache files with io_uring, which reduces the
+	// overhead of syscalls when many small chunks are read. This requires the
+	// snapshotter built with "iouring" tag and Linux 5.6 or later. Otherwise the
+	// standard I/O is used.
+	IOUring bool `toml:"io_uring"`
+
+	// HotCacheDir is the directory (typically on tmpfs) for the hot tier of the
+	// filesystem cache. Contents read frequently are promoted to this tier.
+	// Empty disables the hot tier.
+	HotCacheDir string `toml:"hot_cache_dir"`
+
+	// HotCacheMaxBytes is the size limit of the hot tier.
+	HotCacheMaxBytes int64 `toml:"hot_cache_max_bytes"`
+
+	// HotCachePromoteAfterHits is the number of reads from the disk tier after
+	// which the contents are promoted to the hot tier.
+	HotCachePromoteAfterHits int `toml:"hot_cache_promote_after_hits"`
 }
@@ -0,0 +1,82 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// builtinLabelPatterns are patterns of labels used by the snapshotter itself.
+// These are always passed to the filesystem.
+var builtinLabelPatterns = []string{
+	"containerd.io/snapshot.ref",
+	"containerd.io/snapshot/remote*",
+	"containerd.io/snapshot/cri.*",
+}
+
+// LabelFilter filters snapshot labels by glob patterns.
+type LabelFilter struct {
+	re *regexp.Regexp
+}
+
+// NewLabelFilter returns a filter passing labels matching to any of the
+// patterns or the labels of the snapshotter. Nil is returned if no pattern is
+// specified, which passes all labels.
+func NewLabelFilter(patterns []string) (*LabelFilter, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	var res []string
+	for _, p := range append(patterns, builtinLabelPatterns...) {
+		if p == "" {
+			return nil, fmt.Errorf("pattern must not be empty")
+		}
+		var b strings.Builder
+		for _, c := range p {
+			switch c {
+			case '*':
+				b.WriteString(".*")
+			case '?':
+				b.WriteString(".")
+			default:
+				b.WriteString(regexp.QuoteMeta(string(c)))
+			}
+		}
+		res = append(res, b.String())
+	}
+	re, err := regexp.Compile("^(?:" + strings.Join(res, "|") + ")$")
+	if err != nil {
+		return nil, err
+	}
+	return &LabelFilter{re}, nil
+}
+
+// Filter returns labels passed by the filter. The passed map isn't modified.
+func (f *LabelFilter) Filter(labels map[string]string) map[string]string {
+	if f == nil {
+		return labels
+	}
+	filtered := make(map[string]string)
+	for k, v := range labels {
+		if f.re.MatchString(k) {
+			filtered[k] = v
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,60 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLabelFilter(t *testing.T) {
+	labels := map[string]string{
+		"containerd.io/snapshot.ref":                     "a",
+		"containerd.io/snapshot/remote/stargz.reference": "b",
+		"containerd.io/snapshot/cri.image-ref":           "c",
+		"containerd.io/snapshot/example.com/tenant":      "d",
+		"containerd.io/snapshot/example.com/a/b":         "e",
+		"containerd.io/snapshot/example.org/tenant":      "f",
+		"example.com/tenant":                             "g",
+	}
+	f, err := NewLabelFilter(nil)
+	if err != nil || f != nil {
+		t.Fatalf("empty patterns must pass all labels: %v", err)
+	}
+	if got := f.Filter(labels); len(got) != len(labels) {
+		t.Errorf("nil filter dropped labels: %v", got)
+	}
+
+	f, err = NewLabelFilter([]string{"containerd.io/snapshot/example.com/*", "example.co?/tenant"})
+	if err != nil {
+		t.Fatalf("failed to create filter: %v", err)
+	}
+	got := f.Filter(labels)
+	want := "map[containerd.io/snapshot.ref:a containerd.io/snapshot/cri.image-ref:c " +
+		"containerd.io/snapshot/example.com/a/b:e containerd.io/snapshot/example.com/tenant:d " +
+		"containerd.io/snapshot/remote/stargz.reference:b example.com/tenant:g]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("filtered labels = %v; want %v", got, want)
+	}
+	if len(labels) != 7 {
+		t.Errorf("original labels must not be modified")
+	}
+
+	if _, err := NewLabelFilter([]string{""}); err == nil {
+		t.Errorf("empty pattern must be rejected")
+	}
+}
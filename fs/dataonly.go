@@ -0,0 +1,204 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/dataonly"
+	"github.com/containerd/stargz-snapshotter/fs/reader"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/pkg/errors"
+)
+
+const dataDirMode = syscall.S_IFDIR | 0500 // dr-x------
+
+// dataDirOf returns the directory where the data directory of the layer on the
+// mountpoint is mounted in the overlayfs data-only mode.
+func dataDirOf(mountpoint string) string {
+	return mountpoint + ".data"
+}
+
+// mountDataOnly writes the metadata of the layer to the mountpoint as a normal
+// directory tree (or mounts it as an EROFS image in the composefs mode) and
+// mounts the contents of the files on the data directory.
+// Only reads of the contents reach FUSE and are lazily fetched.
+func (fs *filesystem) mountDataOnly(ctx context.Context, mountpoint string, l *layer, lr reader.Reader, openFlags uint32, streamThreshold int64) error {
+	objects, err := dataonly.Objects(l.root)
+	if err != nil {
+		return errors.Wrap(err, "layer can't be used as a data-only layer")
+	}
+	var opts []dataonly.Option
+	if fs.dataOnlyVerity {
+		// This reads all contents of the layer.
+		opts = append(opts, dataonly.WithVerityDigest(func(e *estargz.TOCEntry) ([]byte, error) {
+			ra, err := lr.OpenFile(e.Name)
+			if err != nil {
+				return nil, err
+			}
+			return dataonly.VerityDigest(io.NewSectionReader(ra, 0, e.Size))
+		}))
+	}
+	if fs.composefs {
+		if err := mountComposefs(mountpoint, l.root, opts...); err != nil {
+			return errors.Wrap(err, "failed to mount metadata image of the layer")
+		}
+	} else if err := dataonly.BuildMetadata(mountpoint, l.root, opts...); err != nil {
+		return errors.Wrap(err, "failed to build metadata of the layer")
+	}
+	dataDir := dataDirOf(mountpoint)
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		fs.unmountMetadata(mountpoint)
+		return err
+	}
+	s := fs.newLayerState(l)
+	if err := fs.serve(ctx, dataDir, &dataRoot{
+		objects: &objectDir{
+			objects: objects,
+			newNode: func(e *estargz.TOCEntry) *node {
+				return &node{
+					fs:              fs,
+					layer:           lr,
+					e:               e,
+					s:               s,
+					root:            mountpoint,
+					openFlags:       openFlags,
+					streamThreshold: streamThreshold,
+				}
+			},
+		},
+		s: s,
+	}); err != nil {
+		fs.unmountMetadata(mountpoint)
+		return err
+	}
+	fs.layerMu.Lock()
+	fs.dataDirs[mountpoint] = dataDir
+	fs.layerMu.Unlock()
+	log.G(ctx).Debugf("serving metadata on the mountpoint and data on %q", dataDir)
+	return nil
+}
+
+// mountComposefs writes the metadata of the layer as an EROFS image next to the
+// mountpoint and mounts it on the mountpoint.
+func mountComposefs(mountpoint string, root *estargz.TOCEntry, opts ...dataonly.Option) error {
+	image := mountpoint + ".erofs"
+	f, err := os.Create(image)
+	if err != nil {
+		return err
+	}
+	if err := dataonly.WriteEROFS(f, root, opts...); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return dataonly.MountEROFS(image, mountpoint)
+}
+
+// unmountMetadata unmounts the metadata image from the mountpoint in the
+// composefs mode. The metadata directory isn't a mount otherwise.
+func (fs *filesystem) unmountMetadata(mountpoint string) error {
+	if !fs.composefs {
+		return nil
+	}
+	return syscall.Unmount(mountpoint, 0)
+}
+
+// DataDir returns the data directory of the layer mounted on the mountpoint in
+// the overlayfs data-only mode.
+func (fs *filesystem) DataDir(mountpoint string) (string, bool) {
+	fs.layerMu.Lock()
+	defer fs.layerMu.Unlock()
+	dataDir, ok := fs.dataDirs[mountpoint]
+	return dataDir, ok
+}
+
+// dataRoot is the root of the data directory of a layer. This contains the
+// directory of the contents and the state directory.
+type dataRoot struct {
+	fusefs.Inode
+	objects *objectDir
+	s       *state
+}
+
+var _ = (fusefs.NodeOnAdder)((*dataRoot)(nil))
+
+func (r *dataRoot) OnAdd(ctx context.Context) {
+	r.AddChild(dataonly.ObjectDir, r.NewPersistentInode(ctx, r.objects, fusefs.StableAttr{Mode: dataDirMode}), false)
+	r.AddChild(stateDirName, r.NewPersistentInode(ctx, r.s, stateToAttr(r.s, &fuse.Attr{})), false)
+}
+
+var _ = (fusefs.NodeGetattrer)((*dataRoot)(nil))
+
+func (r *dataRoot) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = dataDirMode
+	return 0
+}
+
+var _ = (fusefs.NodeStatfser)((*dataRoot)(nil))
+
+func (r *dataRoot) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	defaultStatfs(out)
+	return 0
+}
+
+// objectDir is the directory of the contents of the files in the layer named
+// after their digests.
+type objectDir struct {
+	fusefs.Inode
+	objects map[string]*estargz.TOCEntry
+	newNode func(e *estargz.TOCEntry) *node
+}
+
+var _ = (fusefs.NodeReaddirer)((*objectDir)(nil))
+
+func (d *objectDir) Readdir(ctx context.Context) (fusefs.DirStream, syscall.Errno) {
+	ents := make([]fuse.DirEntry, 0, len(d.objects))
+	for name, e := range d.objects {
+		ents = append(ents, fuse.DirEntry{
+			Mode: syscall.S_IFREG,
+			Name: name,
+			Ino:  inodeOfEnt(e),
+		})
+	}
+	return fusefs.NewListDirStream(ents), 0
+}
+
+var _ = (fusefs.NodeLookuper)((*objectDir)(nil))
+
+func (d *objectDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	e, ok := d.objects[name]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	return d.NewInode(ctx, d.newNode(e), entryToAttr(e, &out.Attr)), 0
+}
+
+var _ = (fusefs.NodeGetattrer)((*objectDir)(nil))
+
+func (d *objectDir) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = dataDirMode
+	return 0
+}
@@ -0,0 +1,332 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package dataonly provides eStargz layers in a form consumable by overlayfs
+// "data-only" lower layers (Linux 6.5 or later), in the same manner as
+// composefs.
+//
+// A layer is split into two directories. The metadata directory is a real
+// directory tree holding all directories, symlinks, whiteouts and so on, and
+// regular files as empty sparse files marked as "metacopy" with the
+// "trusted.overlay.redirect" xattr pointing to the contents. The data directory
+// holds the contents of regular files named after their digests
+// ("/sha256/<hex>"). The data directory is passed to overlayfs after "::" in
+// lowerdir so metadata operations never reach the data directory.
+//
+// The metadata can also be written as an EROFS image (composefs image), which
+// is mounted read-only instead of populating a directory.
+package dataonly
+
+import (
+	"archive/tar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// ObjectDir is the directory in the data directory holding the contents.
+	ObjectDir = "sha256"
+
+	metacopyXattr     = "trusted.overlay.metacopy"
+	redirectXattr     = "trusted.overlay.redirect"
+	opaqueXattr       = "trusted.overlay.opaque"
+	opaqueXattrValue  = "y"
+	overlayXattrs     = "trusted.overlay."
+	whiteoutPrefix    = ".wh."
+	whiteoutOpaqueDir = whiteoutPrefix + whiteoutPrefix + ".opq"
+
+	// FS_VERITY_HASH_ALG_SHA256
+	verityHashAlgSHA256 = 1
+)
+
+// ObjectName returns the name of the file in ObjectDir holding the contents of
+// the regular file entry.
+func ObjectName(e *estargz.TOCEntry) (string, error) {
+	dgst, err := digest.Parse(e.Digest)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid digest of %q", e.Name)
+	}
+	if dgst.Algorithm() != digest.SHA256 {
+		return "", fmt.Errorf("unsupported digest algorithm of %q: %v", e.Name, dgst.Algorithm())
+	}
+	return dgst.Encoded(), nil
+}
+
+// Objects returns regular file entries of the layer which need the contents
+// in the data directory, keyed by the object names.
+func Objects(root *estargz.TOCEntry) (map[string]*estargz.TOCEntry, error) {
+	objects := make(map[string]*estargz.TOCEntry)
+	var walk func(e *estargz.TOCEntry) error
+	walk = func(e *estargz.TOCEntry) (err error) {
+		e.ForeachChild(func(baseName string, ce *estargz.TOCEntry) bool {
+			if e == root && isLandmark(baseName) {
+				return true
+			}
+			switch {
+			case ce.Type == "dir":
+				err = walk(ce)
+			case ce.Type == "reg" && ce.Size > 0:
+				var name string
+				if name, err = ObjectName(ce); err == nil {
+					objects[name] = ce
+				}
+			}
+			return err == nil
+		})
+		return
+	}
+	if err := walk(root); err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// Option is an option of BuildMetadata and WriteEROFS.
+type Option func(*options)
+
+type options struct {
+	verityDigest func(e *estargz.TOCEntry) ([]byte, error)
+}
+
+// WithVerityDigest records the fs-verity digests of regular files returned by
+// the function in the metacopy xattrs. overlayfs mounted with "verity=on"
+// verifies the contents against them.
+func WithVerityDigest(f func(e *estargz.TOCEntry) ([]byte, error)) Option {
+	return func(opts *options) {
+		opts.verityDigest = f
+	}
+}
+
+// BuildMetadata writes the metadata directory of the layer to dir. Existing
+// contents of dir are removed. This requires CAP_SYS_ADMIN for creating
+// whiteouts and "trusted." xattrs.
+func BuildMetadata(dir string, root *estargz.TOCEntry, opts ...Option) error {
+	var bOpts options
+	for _, o := range opts {
+		o(&bOpts)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	existing, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, c := range existing {
+		if err := os.RemoveAll(filepath.Join(dir, c.Name())); err != nil {
+			return errors.Wrapf(err, "failed to cleanup %q", dir)
+		}
+	}
+	b := &builder{
+		opts:  bOpts,
+		root:  root,
+		links: make(map[*estargz.TOCEntry]string),
+	}
+	if err := b.build(dir, root); err != nil {
+		return err
+	}
+	return b.setAttrs(dir, root)
+}
+
+type builder struct {
+	opts  options
+	root  *estargz.TOCEntry
+	links map[*estargz.TOCEntry]string // entry -> the first path created for it
+}
+
+func (b *builder) build(dir string, e *estargz.TOCEntry) error {
+	ents, opaque := Children(e, e == b.root)
+	if opaque {
+		if err := unix.Setxattr(dir, opaqueXattr, []byte(opaqueXattrValue), 0); err != nil {
+			return errors.Wrapf(err, "failed to mark %q as opaque", dir)
+		}
+	}
+	for _, c := range ents {
+		p := filepath.Join(dir, c.Name)
+		if c.Entry == nil {
+			if err := unix.Mknod(p, unix.S_IFCHR, 0); err != nil {
+				return errors.Wrapf(err, "failed to create whiteout %q", path.Join(e.Name, c.Name))
+			}
+			continue
+		}
+		if first, ok := b.links[c.Entry]; ok {
+			if err := os.Link(first, p); err != nil {
+				return errors.Wrapf(err, "failed to create hardlink %q", p)
+			}
+			continue
+		}
+		if err := b.create(p, c.Entry); err != nil {
+			return errors.Wrapf(err, "failed to create %q", c.Entry.Name)
+		}
+		if c.Entry.Type != "dir" {
+			b.links[c.Entry] = p
+		}
+		if err := b.setAttrs(p, c.Entry); err != nil {
+			return errors.Wrapf(err, "failed to set attributes of %q", c.Entry.Name)
+		}
+	}
+	return nil
+}
+
+func (b *builder) create(p string, e *estargz.TOCEntry) error {
+	switch e.Type {
+	case "dir":
+		if err := os.Mkdir(p, 0700); err != nil {
+			return err
+		}
+		return b.build(p, e)
+	case "reg":
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if e.Size == 0 {
+			return nil // no contents to redirect to
+		}
+		if err := f.Truncate(e.Size); err != nil {
+			return err
+		}
+		name, err := ObjectName(e)
+		if err != nil {
+			return err
+		}
+		var verity []byte
+		if b.opts.verityDigest != nil {
+			if verity, err = b.opts.verityDigest(e); err != nil {
+				return errors.Wrap(err, "failed to get fs-verity digest")
+			}
+		}
+		if err := unix.Fsetxattr(int(f.Fd()), metacopyXattr, metacopyValue(verity), 0); err != nil {
+			return err
+		}
+		return unix.Fsetxattr(int(f.Fd()), redirectXattr, []byte("/"+ObjectDir+"/"+name), 0)
+	case "symlink":
+		return os.Symlink(e.LinkName, p)
+	case "char":
+		return unix.Mknod(p, unix.S_IFCHR, int(unix.Mkdev(uint32(e.DevMajor), uint32(e.DevMinor))))
+	case "block":
+		return unix.Mknod(p, unix.S_IFBLK, int(unix.Mkdev(uint32(e.DevMajor), uint32(e.DevMinor))))
+	case "fifo":
+		return unix.Mkfifo(p, 0600)
+	}
+	return fmt.Errorf("unsupported entry type %q", e.Type)
+}
+
+// setAttrs applies the owner, the mode, xattrs and the modification time of the
+// entry to the path. These are applied after the children of directories are
+// created so that they aren't modified.
+func (b *builder) setAttrs(p string, e *estargz.TOCEntry) error {
+	if err := os.Lchown(p, e.UID, e.GID); err != nil {
+		return err
+	}
+	if e.Type != "symlink" {
+		mode := fileMode(e) & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+		if err := os.Chmod(p, mode); err != nil {
+			return err
+		}
+	}
+	for k, v := range e.Xattrs {
+		if strings.HasPrefix(k, overlayXattrs) {
+			// Layers must not control overlayfs (e.g. redirects).
+			continue
+		}
+		if err := unix.Lsetxattr(p, k, v, 0); err != nil {
+			return errors.Wrapf(err, "failed to set xattr %q", k)
+		}
+	}
+	mtime := unix.NsecToTimespec(ModTime(e).UnixNano())
+	return unix.UtimesNanoAt(unix.AT_FDCWD, p, []unix.Timespec{mtime, mtime}, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// metacopyValue returns the value of the metacopy xattr (struct ovl_metacopy
+// in the kernel) holding the fs-verity digest. Empty means no digest.
+func metacopyValue(verity []byte) []byte {
+	if len(verity) == 0 {
+		return []byte{}
+	}
+	return append([]byte{0, byte(4 + len(verity)), 0, verityHashAlgSHA256}, verity...)
+}
+
+// Child is an entry of a directory as seen by overlayfs.
+type Child struct {
+	Name  string
+	Entry *estargz.TOCEntry // nil for whiteouts
+}
+
+// Children returns the entries of the directory sorted by the names. Whiteout
+// files (".wh.<name>") are converted to overlayfs-style whiteouts unless an
+// entry of the name exists. Landmark files in the root directory are omitted.
+// This also reports whether the directory is opaque.
+func Children(e *estargz.TOCEntry, isRoot bool) (ents []Child, opaque bool) {
+	var names []string
+	e.ForeachChild(func(baseName string, _ *estargz.TOCEntry) bool {
+		names = append(names, baseName)
+		return true
+	})
+	sort.Strings(names)
+	for _, name := range names {
+		ce, _ := e.LookupChild(name)
+		if isRoot && isLandmark(name) {
+			continue
+		}
+		if name == whiteoutOpaqueDir {
+			opaque = true
+			continue
+		}
+		if strings.HasPrefix(name, whiteoutPrefix) {
+			target := name[len(whiteoutPrefix):]
+			if _, ok := e.LookupChild(target); !ok {
+				ents = append(ents, Child{Name: target})
+			}
+			continue
+		}
+		ents = append(ents, Child{Name: name, Entry: ce})
+	}
+	sort.Slice(ents, func(i, j int) bool { return ents[i].Name < ents[j].Name })
+	return
+}
+
+// modTime returns the modification time of the entry. Unknown time is the
+// epoch.
+func ModTime(e *estargz.TOCEntry) time.Time {
+	if t := e.ModTime(); !t.IsZero() {
+		return t
+	}
+	return time.Unix(0, 0)
+}
+
+// fileMode returns the mode of the entry including the setuid, setgid and
+// sticky bits, which TOCEntry.Stat doesn't provide. TOCEntry.Mode is a copy of
+// tar.Header.Mode.
+func fileMode(e *estargz.TOCEntry) os.FileMode {
+	return (&tar.Header{Mode: e.Mode}).FileInfo().Mode()
+}
+
+func isLandmark(name string) bool {
+	return estargz.IsLandmark(name)
+}
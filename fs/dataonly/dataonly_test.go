@@ -0,0 +1,358 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package dataonly
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	digest "github.com/opencontainers/go-digest"
+	"golang.org/x/sys/unix"
+)
+
+func TestVerityDigest(t *testing.T) {
+	block := bytes.Repeat([]byte{0xaa}, verityBlockSize)
+	tests := []struct {
+		name string
+		data []byte
+		root func() []byte
+	}{
+		{
+			name: "empty",
+			root: func() []byte { return nil },
+		},
+		{
+			name: "one block",
+			data: []byte("hello"),
+			root: func() []byte {
+				blk := make([]byte, verityBlockSize)
+				copy(blk, "hello")
+				h := sha256.Sum256(blk)
+				return h[:]
+			},
+		},
+		{
+			name: "two blocks",
+			data: append(append([]byte{}, block...), 'a'),
+			root: func() []byte {
+				h1 := sha256.Sum256(block)
+				last := make([]byte, verityBlockSize)
+				last[0] = 'a'
+				h2 := sha256.Sum256(last)
+				level := make([]byte, verityBlockSize)
+				copy(level, h1[:])
+				copy(level[sha256.Size:], h2[:])
+				h := sha256.Sum256(level)
+				return h[:]
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			desc := make([]byte, verityDescSize)
+			desc[0], desc[1], desc[2] = 1, verityHashAlgSHA256, verityLogBlockSize
+			binary.LittleEndian.PutUint64(desc[8:], uint64(len(tt.data)))
+			copy(desc[16:], tt.root())
+			want := sha256.Sum256(desc)
+			got, err := VerityDigest(bytes.NewReader(tt.data))
+			if err != nil {
+				t.Fatalf("failed to compute digest: %v", err)
+			}
+			if !bytes.Equal(got, want[:]) {
+				t.Errorf("digest = %x; want %x", got, want)
+			}
+		})
+	}
+
+	// The digest reported by "fsverity digest" for an empty file.
+	got, err := VerityDigest(bytes.NewReader(nil))
+	if err != nil {
+		t.Fatalf("failed to compute digest: %v", err)
+	}
+	if want := "3d248ca542a24fc62d1c43b916eae5016878e2533c88238480b26128a1f1af95"; hex.EncodeToString(got) != want {
+		t.Errorf("digest of empty file = %x; want %s", got, want)
+	}
+}
+
+const sampleContents = "hello"
+
+func TestBuildMetadata(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("test requires root")
+	}
+	tmp, err := ioutil.TempDir("", "testdataonly")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	meta := filepath.Join(tmp, "meta")
+	if err := os.MkdirAll(filepath.Join(meta, "stale"), 0700); err != nil {
+		t.Fatalf("failed to prepare metadata directory: %v", err)
+	}
+	if err := BuildMetadata(meta, sampleLayer(t)); err != nil {
+		t.Fatalf("failed to build metadata: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(meta, "stale")); !os.IsNotExist(err) {
+		t.Errorf("stale contents must be removed: %v", err)
+	}
+	checkMetadata(t, meta)
+	checkDataOnlyMount(t, tmp, meta)
+}
+
+func TestWriteEROFS(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("test requires root")
+	}
+	tmp, err := ioutil.TempDir("", "testdataonly")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	image := filepath.Join(tmp, "image.erofs")
+	f, err := os.Create(image)
+	if err != nil {
+		t.Fatalf("failed to create image: %v", err)
+	}
+	if err := WriteEROFS(f, sampleLayer(t)); err != nil {
+		f.Close()
+		t.Fatalf("failed to write image: %v", err)
+	}
+	f.Close()
+	meta := filepath.Join(tmp, "meta")
+	if err := os.Mkdir(meta, 0700); err != nil {
+		t.Fatalf("failed to make mountpoint: %v", err)
+	}
+	if err := MountEROFS(image, meta); err != nil {
+		t.Skipf("EROFS is unavailable: %v", err)
+	}
+	defer unix.Unmount(meta, 0)
+	checkMetadata(t, meta)
+
+	// Large directories span multiple blocks.
+	big, err := ioutil.ReadDir(filepath.Join(meta, "big"))
+	if err != nil || len(big) != 500 {
+		t.Errorf("failed to read big directory (%d entries): %v", len(big), err)
+	}
+	if _, err := os.Lstat(filepath.Join(meta, "big", "file-0499")); err != nil {
+		t.Errorf("failed to lookup the last entry: %v", err)
+	}
+	checkDataOnlyMount(t, tmp, meta)
+}
+
+func sampleLayer(t *testing.T) *estargz.TOCEntry {
+	dgst := digest.FromString(sampleContents)
+	entries := []*estargz.TOCEntry{
+		{Name: "etc/", Type: "dir", Mode: 0755},
+		{Name: "etc/hosts", Type: "reg", Size: int64(len(sampleContents)), Digest: dgst.String(), Mode: 0640, UID: 1, GID: 2,
+			ModTime3339: "2020-01-01T00:00:00Z",
+			Xattrs: map[string][]byte{
+				"user.foo":                 []byte("bar"),
+				"trusted.overlay.redirect": []byte("/evil"),
+			}},
+		{Name: "etc/hosts.link", Type: "hardlink", LinkName: "etc/hosts"},
+		{Name: "etc/empty", Type: "reg", Mode: 04755},
+		{Name: "lnk", Type: "symlink", LinkName: "etc/hosts"},
+		{Name: "null", Type: "char", DevMajor: 1, DevMinor: 3, Mode: 0666},
+		{Name: ".wh.gone", Type: "reg"},
+		{Name: "opq/", Type: "dir", Mode: 0755},
+		{Name: "opq/.wh..wh..opq", Type: "reg"},
+		{Name: "big/", Type: "dir", Mode: 0755},
+		{Name: estargz.PrefetchLandmark, Type: "reg", Size: 1, Digest: digest.FromString("x").String()},
+	}
+	for i := 0; i < 500; i++ {
+		entries = append(entries, &estargz.TOCEntry{Name: fmt.Sprintf("big/file-%04d", i), Type: "reg", Mode: 0644})
+	}
+	return openTOC(t, entries)
+}
+
+// checkMetadata checks the metadata of sampleLayer.
+func checkMetadata(t *testing.T, meta string) {
+	if _, err := os.Lstat(filepath.Join(meta, estargz.PrefetchLandmark)); !os.IsNotExist(err) {
+		t.Errorf("landmark must not exist: %v", err)
+	}
+	hosts := filepath.Join(meta, "etc", "hosts")
+	var st syscall.Stat_t
+	if err := syscall.Lstat(hosts, &st); err != nil {
+		t.Fatalf("failed to stat hosts: %v", err)
+	}
+	if st.Size != int64(len(sampleContents)) || st.Mode&0777 != 0640 || st.Uid != 1 || st.Gid != 2 || st.Nlink != 2 {
+		t.Errorf("invalid attributes of hosts: %+v", st)
+	}
+	if st.Mtim.Sec != 1577836800 {
+		t.Errorf("invalid mtime of hosts: %v", st.Mtim)
+	}
+	for k, want := range map[string]string{
+		redirectXattr: "/" + ObjectDir + "/" + digest.FromString(sampleContents).Encoded(),
+		metacopyXattr: "",
+		"user.foo":    "bar",
+	} {
+		if got := getxattr(t, hosts, k); got != want {
+			t.Errorf("xattr %q of hosts = %q; want %q", k, got, want)
+		}
+	}
+	if got := getxattr(t, filepath.Join(meta, "etc", "empty"), redirectXattr); got != "" {
+		t.Errorf("empty file must not be redirected but %q", got)
+	}
+	if err := syscall.Lstat(filepath.Join(meta, "etc", "empty"), &st); err != nil || st.Mode&07777 != 04755 {
+		t.Errorf("invalid mode of empty: %o, %v", st.Mode, err)
+	}
+	if got := getxattr(t, filepath.Join(meta, "opq"), opaqueXattr); got != opaqueXattrValue {
+		t.Errorf("opq must be opaque but %q", got)
+	}
+	if err := syscall.Lstat(filepath.Join(meta, "gone"), &st); err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFCHR || st.Rdev != 0 {
+		t.Errorf("gone must be a whiteout: %+v, %v", st, err)
+	}
+	if err := syscall.Lstat(filepath.Join(meta, "null"), &st); err != nil || st.Rdev != unix.Mkdev(1, 3) {
+		t.Errorf("invalid device null: %+v, %v", st, err)
+	}
+	if l, err := os.Readlink(filepath.Join(meta, "lnk")); err != nil || l != "etc/hosts" {
+		t.Errorf("invalid symlink lnk: %q, %v", l, err)
+	}
+}
+
+// checkDataOnlyMount mounts the metadata of sampleLayer with the data-only
+// layer and checks the contents.
+func checkDataOnlyMount(t *testing.T, tmp, meta string) {
+	data := filepath.Join(tmp, "data")
+	if err := os.MkdirAll(filepath.Join(data, ObjectDir), 0700); err != nil {
+		t.Fatalf("failed to prepare data directory: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(data, ObjectDir, digest.FromString(sampleContents).Encoded()), []byte(sampleContents), 0600); err != nil {
+		t.Fatalf("failed to write contents: %v", err)
+	}
+	mnt := filepath.Join(tmp, "mnt")
+	if err := os.Mkdir(mnt, 0700); err != nil {
+		t.Fatalf("failed to make mountpoint: %v", err)
+	}
+	if err := unix.Mount("overlay", mnt, "overlay", 0, fmt.Sprintf("lowerdir=%s::%s,metacopy=on", meta, data)); err != nil {
+		t.Skipf("overlayfs data-only layers are unavailable: %v", err)
+	}
+	defer unix.Unmount(mnt, 0)
+	for _, name := range []string{"etc/hosts", "etc/hosts.link", "lnk"} {
+		got, err := ioutil.ReadFile(filepath.Join(mnt, name))
+		if err != nil || string(got) != sampleContents {
+			t.Errorf("contents of %q = %q, %v; want %q", name, string(got), err, sampleContents)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(mnt, "gone")); !os.IsNotExist(err) {
+		t.Errorf("whiteout must be hidden: %v", err)
+	}
+}
+
+func TestObjects(t *testing.T) {
+	a, b := digest.FromString("a"), digest.FromString("b")
+	root := openTOC(t, []*estargz.TOCEntry{
+		{Name: "a", Type: "reg", Size: 1, Digest: a.String()},
+		{Name: "dir/", Type: "dir"},
+		{Name: "dir/b", Type: "reg", Size: 1, Digest: b.String()},
+		{Name: "dir/a", Type: "reg", Size: 1, Digest: a.String()},
+		{Name: "empty", Type: "reg"},
+	})
+	objects, err := Objects(root)
+	if err != nil {
+		t.Fatalf("failed to get objects: %v", err)
+	}
+	if len(objects) != 2 || objects[a.Encoded()] == nil || objects[b.Encoded()] == nil {
+		t.Errorf("unexpected objects: %v", objects)
+	}
+
+	root = openTOC(t, []*estargz.TOCEntry{{Name: "a", Type: "reg", Size: 1}})
+	if _, err := Objects(root); err == nil {
+		t.Errorf("files without digests must be rejected")
+	}
+}
+
+func getxattr(t *testing.T, p, attr string) string {
+	buf := make([]byte, 256)
+	n, err := unix.Lgetxattr(p, attr, buf)
+	if err == unix.ENODATA {
+		return ""
+	} else if err != nil {
+		t.Fatalf("failed to get xattr %q of %q: %v", attr, p, err)
+	}
+	return string(buf[:n])
+}
+
+// openTOC opens a blob which contains only the TOC JSON of the entries and
+// returns the root entry.
+func openTOC(t *testing.T, entries []*estargz.TOCEntry) *estargz.TOCEntry {
+	tocJSON, err := json.Marshal(struct {
+		Version int                 `json:"version"`
+		Entries []*estargz.TOCEntry `json:"entries"`
+	}{1, entries})
+	if err != nil {
+		t.Fatalf("failed to marshal TOC: %v", err)
+	}
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(zw)
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     estargz.TOCTarName,
+		Size:     int64(len(tocJSON)),
+	}); err != nil {
+		t.Fatalf("failed to write TOC header: %v", err)
+	}
+	if _, err := tw.Write(tocJSON); err != nil {
+		t.Fatalf("failed to write TOC: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close tar: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("failed to close gzip: %v", err)
+	}
+	buf.Write(footer(0))
+	r, err := estargz.Open(io.NewSectionReader(bytes.NewReader(buf.Bytes()), 0, int64(buf.Len())))
+	if err != nil {
+		t.Fatalf("failed to open TOC: %v", err)
+	}
+	root, ok := r.Lookup("")
+	if !ok {
+		t.Fatalf("root not found")
+	}
+	return root
+}
+
+// footer returns the eStargz footer pointing to the TOC. This is written by hand
+// so that the size doesn't depend on the behaviour of the gzip compressor.
+func footer(tocOff int64) []byte {
+	subfield := fmt.Sprintf("%016xSTARGZ", tocOff)
+	extra := append([]byte{'S', 'G', byte(len(subfield)), 0}, subfield...)
+	p := []byte{0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 0xff} // gzip header with FEXTRA
+	p = append(p, byte(len(extra)), 0)
+	p = append(p, extra...)
+	p = append(p, 1, 0, 0, 0xff, 0xff)    // empty final stored block
+	p = append(p, 0, 0, 0, 0, 0, 0, 0, 0) // CRC32 and ISIZE
+	if len(p) != estargz.FooterSize {
+		panic(fmt.Sprintf("footer = %d bytes, not %d", len(p), estargz.FooterSize))
+	}
+	return p
+}
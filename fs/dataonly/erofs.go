@@ -0,0 +1,420 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package dataonly
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/internal/erofs"
+	"github.com/pkg/errors"
+)
+
+// Block size of the image. Other constants of EROFS are in fs/internal/erofs.
+const (
+	erofsBlockSizeBits = 12
+	erofsBlockSize     = 1 << erofsBlockSizeBits
+)
+
+// erofsXattrPrefixes are the prefixes of xattr names which EROFS can store
+// without the "xattr prefixes" feature, keyed by the name index. Xattrs with
+// other prefixes are dropped.
+var erofsXattrPrefixes = []struct {
+	index  uint8
+	prefix string
+}{
+	{1, "user."},
+	{4, "trusted."},
+	{6, "security."},
+}
+
+type erofsInode struct {
+	mode     uint32
+	uid, gid uint32
+	mtime    int64
+	mtimeNs  uint32
+	size     uint64
+	rdev     uint32
+	nlink    uint32
+	xattrs   []byte
+	layout   uint8
+	iu       uint32        // i_u field except for the block address
+	data     []byte        // contents of symlinks and directories
+	ents     []erofsDirent // entries of directories
+	dirSizes []int         // lengths of the blocks of the directory
+	nid      uint64        // assigned on placing
+	off      int64         // offset of the inode in the image
+	blkaddr  uint32        // block address of the data of FLAT_PLAIN inodes
+	ino      uint32
+}
+
+type erofsDirent struct {
+	name  string
+	inode *erofsInode
+}
+
+// WriteEROFS writes the metadata of the layer as an EROFS image in the
+// composefs manner. The image has the same contents as the directory written by
+// BuildMetadata. The image should be mounted read-only as the lower layer of
+// overlayfs with the data directory as the data-only layer.
+func WriteEROFS(w io.Writer, root *estargz.TOCEntry, opts ...Option) error {
+	var bOpts options
+	for _, o := range opts {
+		o(&bOpts)
+	}
+	ew := &erofsWriter{
+		opts:  bOpts,
+		root:  root,
+		links: make(map[*estargz.TOCEntry]*erofsInode),
+	}
+	rootInode, err := ew.inode(root)
+	if err != nil {
+		return err
+	}
+	if err := ew.dir(rootInode, rootInode, root); err != nil {
+		return err
+	}
+	img := ew.layout(rootInode)
+	_, err = w.Write(img)
+	return err
+}
+
+type erofsWriter struct {
+	opts   options
+	root   *estargz.TOCEntry
+	links  map[*estargz.TOCEntry]*erofsInode
+	inodes []*erofsInode // in the order of placement
+}
+
+func (ew *erofsWriter) newInode(in *erofsInode) *erofsInode {
+	ew.inodes = append(ew.inodes, in)
+	in.ino = uint32(len(ew.inodes))
+	return in
+}
+
+// inode returns the inode of the entry. Directories are populated by dir.
+func (ew *erofsWriter) inode(e *estargz.TOCEntry) (*erofsInode, error) {
+	mtime := ModTime(e)
+	in := &erofsInode{
+		mode:    uint32(modeOf(e)),
+		uid:     uint32(e.UID),
+		gid:     uint32(e.GID),
+		mtime:   mtime.Unix(),
+		mtimeNs: uint32(mtime.Nanosecond()),
+		nlink:   1,
+		layout:  erofs.LayoutFlatPlain,
+	}
+	type xattr struct {
+		name  string
+		value []byte
+	}
+	var xattrs []xattr
+	for k, v := range e.Xattrs {
+		if !strings.HasPrefix(k, overlayXattrs) {
+			xattrs = append(xattrs, xattr{k, v})
+		}
+	}
+	switch e.Type {
+	case "dir":
+		in.nlink = 2
+	case "reg":
+		in.size = uint64(e.Size)
+		if e.Size > 0 {
+			name, err := ObjectName(e)
+			if err != nil {
+				return nil, err
+			}
+			var verity []byte
+			if ew.opts.verityDigest != nil {
+				if verity, err = ew.opts.verityDigest(e); err != nil {
+					return nil, errors.Wrapf(err, "failed to get fs-verity digest of %q", e.Name)
+				}
+			}
+			xattrs = append(xattrs,
+				xattr{metacopyXattr, metacopyValue(verity)},
+				xattr{redirectXattr, []byte("/" + ObjectDir + "/" + name)})
+
+			// The file is a hole of a single chunk.
+			in.layout = erofs.LayoutChunkBased
+			var bits uint32
+			for bits < erofs.ChunkFormatBlkbitsMask && uint64(erofsBlockSize)<<bits < in.size {
+				bits++
+			}
+			in.iu = bits
+			in.data = []byte{0xff, 0xff, 0xff, 0xff} // EROFS_NULL_ADDR
+		}
+	case "symlink":
+		in.data = []byte(e.LinkName)
+		in.size = uint64(len(in.data))
+	case "char", "block":
+		in.rdev = erofs.EncodeDev(uint32(e.DevMajor), uint32(e.DevMinor))
+	case "fifo":
+	default:
+		return nil, fmt.Errorf("unsupported entry type %q of %q", e.Type, e.Name)
+	}
+	if e.Type == "dir" {
+		if _, opaque := Children(e, e == ew.root); opaque {
+			xattrs = append(xattrs, xattr{opaqueXattr, []byte(opaqueXattrValue)})
+		}
+	}
+	sort.Slice(xattrs, func(i, j int) bool { return xattrs[i].name < xattrs[j].name })
+	for _, x := range xattrs {
+		if err := in.addXattr(x.name, x.value); err != nil {
+			return nil, errors.Wrapf(err, "failed to add xattr of %q", e.Name)
+		}
+	}
+	return ew.newInode(in), nil
+}
+
+func (ew *erofsWriter) dir(in, parent *erofsInode, e *estargz.TOCEntry) error {
+	in.ents = []erofsDirent{{".", in}, {"..", parent}}
+	ents, _ := Children(e, e == ew.root)
+	for _, c := range ents {
+		if c.Entry == nil {
+			// whiteout
+			in.ents = append(in.ents, erofsDirent{c.Name, ew.newInode(&erofsInode{
+				mode:  syscall.S_IFCHR,
+				nlink: 1,
+			})})
+			continue
+		}
+		if ci, ok := ew.links[c.Entry]; ok {
+			ci.nlink++
+			in.ents = append(in.ents, erofsDirent{c.Name, ci})
+			continue
+		}
+		ci, err := ew.inode(c.Entry)
+		if err != nil {
+			return err
+		}
+		if c.Entry.Type == "dir" {
+			in.nlink++
+			if err := ew.dir(ci, in, c.Entry); err != nil {
+				return err
+			}
+		} else {
+			ew.links[c.Entry] = ci
+		}
+		in.ents = append(in.ents, erofsDirent{c.Name, ci})
+	}
+	sort.Slice(in.ents, func(i, j int) bool { return in.ents[i].name < in.ents[j].name })
+
+	// Split the entries into blocks. Each block has the dirents followed by
+	// the names.
+	used := 0
+	for _, d := range in.ents {
+		if used+erofs.DirentSize+len(d.name) > erofsBlockSize {
+			in.dirSizes = append(in.dirSizes, used)
+			used = 0
+		}
+		used += erofs.DirentSize + len(d.name)
+	}
+	in.dirSizes = append(in.dirSizes, used)
+	in.size = uint64((len(in.dirSizes)-1)*erofsBlockSize + used)
+	return nil
+}
+
+func (in *erofsInode) addXattr(name string, value []byte) error {
+	var index uint8
+	for _, p := range erofsXattrPrefixes {
+		if strings.HasPrefix(name, p.prefix) {
+			index, name = p.index, name[len(p.prefix):]
+			break
+		}
+	}
+	if index == 0 {
+		return nil // unsupported prefix
+	}
+	if len(name) > 0xff || len(value) > 0xffff {
+		return fmt.Errorf("too large xattr %q", name)
+	}
+	if len(in.xattrs) == 0 {
+		in.xattrs = make([]byte, erofs.XattrHdrSize) // no shared xattrs
+	}
+	ent := []byte{byte(len(name)), index, 0, 0}
+	binary.LittleEndian.PutUint16(ent[2:], uint16(len(value)))
+	ent = append(append(ent, name...), value...)
+	for len(ent)%4 != 0 {
+		ent = append(ent, 0)
+	}
+	in.xattrs = append(in.xattrs, ent...)
+	return nil
+}
+
+// inline reports whether the data of the inode is placed right after the inode.
+func (in *erofsInode) inline() bool {
+	if in.layout == erofs.LayoutChunkBased {
+		return true // chunk indexes
+	}
+	return len(in.data) > 0 || len(in.ents) > 0
+}
+
+func (in *erofsInode) dataSize() int {
+	if len(in.ents) > 0 {
+		return int(in.size)
+	}
+	return len(in.data)
+}
+
+// layout places the inodes and the directory blocks and returns the image.
+func (ew *erofsWriter) layout(root *erofsInode) []byte {
+	// The metadata area starts from the block following the superblock. The
+	// root inode is the first one so that its nid fits in 16 bits.
+	off := int64(erofsBlockSize)
+	for _, in := range ew.inodes {
+		if in.layout != erofs.LayoutChunkBased && in.inline() {
+			if erofs.InodeSize+len(in.xattrs)+in.dataSize() <= erofsBlockSize {
+				in.layout = erofs.LayoutFlatInline
+			} else {
+				in.layout = erofs.LayoutFlatPlain // the data doesn't fit in a block
+			}
+		}
+		size := int64(erofs.InodeSize + len(in.xattrs))
+		if in.layout != erofs.LayoutFlatPlain {
+			size += int64(in.dataSize())
+		}
+		off = alignUp(off, erofs.SlotSize)
+		if size <= erofsBlockSize && off%erofsBlockSize+size > erofsBlockSize {
+			off = alignUp(off, erofsBlockSize) // inline data must not cross blocks
+		}
+		in.off = off
+		in.nid = uint64(off / erofs.SlotSize)
+		off += size
+	}
+	blk := alignUp(off, erofsBlockSize) / erofsBlockSize
+	for _, in := range ew.inodes {
+		if in.layout == erofs.LayoutFlatPlain && in.dataSize() > 0 {
+			in.blkaddr = uint32(blk)
+			blk += alignUp(int64(in.dataSize()), erofsBlockSize) / erofsBlockSize
+		}
+	}
+
+	img := make([]byte, blk*erofsBlockSize)
+	sb := img[erofs.SuperOffset:]
+	binary.LittleEndian.PutUint32(sb[0:], erofs.Magic)
+	sb[12] = erofsBlockSizeBits
+	binary.LittleEndian.PutUint16(sb[14:], uint16(root.nid))
+	binary.LittleEndian.PutUint64(sb[16:], uint64(len(ew.inodes)))
+	binary.LittleEndian.PutUint32(sb[36:], uint32(blk))
+	binary.LittleEndian.PutUint32(sb[80:], erofs.FeatureIncompatChunkedFile)
+
+	for _, in := range ew.inodes {
+		data := in.data
+		if len(in.ents) > 0 {
+			data = in.dirData(in.layout == erofs.LayoutFlatPlain)
+		}
+		p := img[in.off:]
+		icount := 0
+		if len(in.xattrs) > 0 {
+			icount = (len(in.xattrs)-erofs.XattrHdrSize)/4 + 1
+		}
+		binary.LittleEndian.PutUint16(p[0:], uint16(1|in.layout<<1)) // extended inode
+		binary.LittleEndian.PutUint16(p[2:], uint16(icount))
+		binary.LittleEndian.PutUint16(p[4:], uint16(in.mode))
+		binary.LittleEndian.PutUint64(p[8:], in.size)
+		switch {
+		case in.mode&syscall.S_IFMT == syscall.S_IFCHR || in.mode&syscall.S_IFMT == syscall.S_IFBLK:
+			binary.LittleEndian.PutUint32(p[16:], in.rdev)
+		case in.layout == erofs.LayoutChunkBased:
+			binary.LittleEndian.PutUint32(p[16:], in.iu)
+		case in.layout == erofs.LayoutFlatPlain && len(data) == 0:
+			binary.LittleEndian.PutUint32(p[16:], erofs.NullAddr)
+		default:
+			binary.LittleEndian.PutUint32(p[16:], in.blkaddr)
+		}
+		binary.LittleEndian.PutUint32(p[20:], in.ino)
+		binary.LittleEndian.PutUint32(p[24:], in.uid)
+		binary.LittleEndian.PutUint32(p[28:], in.gid)
+		binary.LittleEndian.PutUint64(p[32:], uint64(in.mtime))
+		binary.LittleEndian.PutUint32(p[40:], in.mtimeNs)
+		binary.LittleEndian.PutUint32(p[44:], in.nlink)
+		copy(p[erofs.InodeSize:], in.xattrs)
+		if in.layout == erofs.LayoutFlatPlain {
+			copy(img[int64(in.blkaddr)*erofsBlockSize:], data)
+		} else {
+			copy(p[erofs.InodeSize+len(in.xattrs):], data)
+		}
+	}
+	return img
+}
+
+// dirData returns the directory blocks. Blocks except the last one are padded
+// if padded is true.
+func (in *erofsInode) dirData(padded bool) []byte {
+	var data []byte
+	ents := in.ents
+	for i, size := range in.dirSizes {
+		blk := make([]byte, size)
+		n := 0
+		for l := 0; n < len(ents) && l+erofs.DirentSize+len(ents[n].name) <= size; n++ {
+			l += erofs.DirentSize + len(ents[n].name)
+		}
+		nameoff := n * erofs.DirentSize
+		for j, d := range ents[:n] {
+			de := blk[j*erofs.DirentSize:]
+			binary.LittleEndian.PutUint64(de[0:], d.inode.nid)
+			binary.LittleEndian.PutUint16(de[8:], uint16(nameoff))
+			de[10] = erofs.FileType(d.inode.mode)
+			nameoff += copy(blk[nameoff:], d.name)
+		}
+		ents = ents[n:]
+		data = append(data, blk...)
+		if padded && i < len(in.dirSizes)-1 {
+			data = append(data, make([]byte, erofsBlockSize-size)...)
+		}
+	}
+	return data
+}
+
+func modeOf(e *estargz.TOCEntry) uint32 {
+	fm := fileMode(e)
+	mode := uint32(fm.Perm())
+	if fm&os.ModeSetuid != 0 {
+		mode |= syscall.S_ISUID
+	}
+	if fm&os.ModeSetgid != 0 {
+		mode |= syscall.S_ISGID
+	}
+	if fm&os.ModeSticky != 0 {
+		mode |= syscall.S_ISVTX
+	}
+	switch e.Type {
+	case "dir":
+		mode |= syscall.S_IFDIR
+	case "reg":
+		mode |= syscall.S_IFREG
+	case "symlink":
+		mode |= syscall.S_IFLNK
+	case "char":
+		mode |= syscall.S_IFCHR
+	case "block":
+		mode |= syscall.S_IFBLK
+	case "fifo":
+		mode |= syscall.S_IFIFO
+	}
+	return mode
+}
+
+func alignUp(n, align int64) int64 {
+	return (n + align - 1) / align * align
+}
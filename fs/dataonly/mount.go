@@ -0,0 +1,86 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package dataonly
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// MountEROFS mounts the EROFS image file on the mountpoint read-only. The image
+// is mounted directly on Linux 6.12 or later. Otherwise, it's mounted through a
+// loop device which is freed on unmount.
+func MountEROFS(image, mountpoint string) error {
+	if err := unix.Mount(image, mountpoint, "erofs", unix.MS_RDONLY, ""); err == nil {
+		return nil
+	}
+	dev, err := attachLoop(image)
+	if err != nil {
+		return errors.Wrap(err, "failed to attach loop device")
+	}
+	if err := unix.Mount(dev.Name(), mountpoint, "erofs", unix.MS_RDONLY, ""); err != nil {
+		unix.IoctlSetInt(int(dev.Fd()), unix.LOOP_CLR_FD, 0)
+		dev.Close()
+		return errors.Wrapf(err, "failed to mount %q", dev.Name())
+	}
+	// The device is detached automatically on unmount.
+	return dev.Close()
+}
+
+// attachLoop attaches the file to a free loop device which is detached after
+// the last close.
+func attachLoop(file string) (*os.File, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ctl, err := os.OpenFile("/dev/loop-control", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer ctl.Close()
+	for retry := 0; retry < 10; retry++ {
+		idx, err := unix.IoctlRetInt(int(ctl.Fd()), unix.LOOP_CTL_GET_FREE)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get free loop device")
+		}
+		dev, err := os.OpenFile(fmt.Sprintf("/dev/loop%d", idx), os.O_RDONLY, 0)
+		if err != nil {
+			return nil, err
+		}
+		if err := unix.IoctlSetInt(int(dev.Fd()), unix.LOOP_SET_FD, int(f.Fd())); err != nil {
+			dev.Close()
+			if err == unix.EBUSY {
+				continue // taken by others
+			}
+			return nil, err
+		}
+		info := unix.LoopInfo64{Flags: unix.LO_FLAGS_AUTOCLEAR | unix.LO_FLAGS_READ_ONLY}
+		if _, _, errno := unix.Syscall(unix.SYS_IOCTL, dev.Fd(), unix.LOOP_SET_STATUS64, uintptr(unsafe.Pointer(&info))); errno != 0 {
+			unix.IoctlSetInt(int(dev.Fd()), unix.LOOP_CLR_FD, 0)
+			dev.Close()
+			return nil, errno
+		}
+		return dev, nil
+	}
+	return nil, fmt.Errorf("no free loop device")
+}
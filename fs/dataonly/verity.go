@@ -0,0 +1,83 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package dataonly
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	verityBlockSize    = 4096
+	verityLogBlockSize = 12
+	verityDescSize     = 256
+)
+
+// VerityDigest computes the fs-verity digest of the contents with SHA-256 and
+// 4096-byte blocks without salt, which is the same as the one reported by
+// "fsverity digest" (and FS_IOC_MEASURE_VERITY) of the file.
+func VerityDigest(r io.Reader) ([]byte, error) {
+	var (
+		size  int64
+		level []byte // hashes of the blocks of the current level
+		buf   = make([]byte, verityBlockSize)
+	)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			for i := n; i < len(buf); i++ {
+				buf[i] = 0
+			}
+			h := sha256.Sum256(buf)
+			level = append(level, h[:]...)
+			size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	// Build the Merkle tree up to the root. The root hash of an empty file is
+	// all zeros.
+	var rootHash [sha256.Size]byte
+	if size > 0 {
+		for len(level) > sha256.Size {
+			var next []byte
+			for off := 0; off < len(level); off += verityBlockSize {
+				blk := make([]byte, verityBlockSize)
+				copy(blk, level[off:])
+				h := sha256.Sum256(blk)
+				next = append(next, h[:]...)
+			}
+			level = next
+		}
+		copy(rootHash[:], level)
+	}
+
+	// struct fsverity_descriptor
+	desc := make([]byte, verityDescSize)
+	desc[0] = 1 // version
+	desc[1] = verityHashAlgSHA256
+	desc[2] = verityLogBlockSize
+	binary.LittleEndian.PutUint64(desc[8:], uint64(size))
+	copy(desc[16:], rootHash[:])
+	d := sha256.Sum256(desc)
+	return d[:], nil
+}
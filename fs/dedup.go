@@ -0,0 +1,177 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// DedupStats is the statistics of chunk deduplication among resolved layers.
+// When all layers are verified, chunks which have the same contents are stored
+// in the filesystem cache only once even if they are contained in different
+// files or layers (see reader.WithContentAddressedChunks).
+type DedupStats struct {
+	Layers       int     `json:"layers"`
+	Chunks       int64   `json:"chunks"`
+	UniqueChunks int64   `json:"uniqueChunks"`
+	LogicalSize  int64   `json:"logicalSize"`
+	UniqueSize   int64   `json:"uniqueSize"`
+	Ratio        float64 `json:"ratio"` // LogicalSize / UniqueSize
+
+	// DeltaLayers is the number of layers prefetched by delta (see
+	// `delta_prefetch`). DeltaReusedSize is the size of their prefetch
+	// targets found in the cache and DeltaFetchedSize is the size fetched.
+	DeltaLayers      int64 `json:"deltaLayers"`
+	DeltaReusedSize  int64 `json:"deltaReusedSize"`
+	DeltaFetchedSize int64 `json:"deltaFetchedSize"`
+
+	// CrossLayerChunks is the number of chunks taken from caches of other
+	// layers (see `cross_layer_fetch`) instead of the registry and
+	// CrossLayerReusedSize is their size.
+	CrossLayerChunks     int64 `json:"crossLayerChunks"`
+	CrossLayerReusedSize int64 `json:"crossLayerReusedSize"`
+}
+
+// DedupReporter reports the statistics of chunk deduplication. The filesystem
+// returned by NewFilesystem implements this interface.
+type DedupReporter interface {
+	DedupStats(ctx context.Context) DedupStats
+}
+
+var _ = (DedupReporter)((*filesystem)(nil))
+
+// DedupStats returns the statistics of chunk deduplication among layers
+// resolved by this filesystem.
+func (fs *filesystem) DedupStats(ctx context.Context) DedupStats {
+	s := fs.dedup.get()
+	s.DeltaLayers = atomic.LoadInt64(&fs.deltaStats.layers)
+	s.DeltaReusedSize = atomic.LoadInt64(&fs.deltaStats.reusedSize)
+	s.DeltaFetchedSize = atomic.LoadInt64(&fs.deltaStats.fetchedSize)
+	if ci := fs.chunkIndex; ci != nil {
+		s.CrossLayerChunks = atomic.LoadInt64(&ci.hits)
+		s.CrossLayerReusedSize = atomic.LoadInt64(&ci.reusedSize)
+	}
+	return s
+}
+
+type chunkWalker interface {
+	ForeachChunk(f func(id string, size int64)) error
+}
+
+// dedupTracker counts the chunks of resolved layers by their cache keys. A
+// layer is counted while any resolution result of it is alive so the statistics
+// follow the layers that can be served from the cache.
+type dedupTracker struct {
+	layers map[string]*dedupLayer
+	chunks map[string]int // number of occurrences among the counted layers
+	stats  DedupStats
+	mu     sync.Mutex
+}
+
+type dedupLayer struct {
+	refcnt int
+	chunks []dedupChunk
+}
+
+type dedupChunk struct {
+	id   string
+	size int64
+}
+
+func newDedupTracker() *dedupTracker {
+	return &dedupTracker{
+		layers: make(map[string]*dedupLayer),
+		chunks: make(map[string]int),
+	}
+}
+
+// add registers chunks of the specified layer. If the layer has already been
+// registered, only its reference count is incremented. Each successful call
+// must be paired with remove.
+func (dt *dedupTracker) add(layerDigest string, w chunkWalker) error {
+	dt.mu.Lock()
+	if l, ok := dt.layers[layerDigest]; ok {
+		l.refcnt++
+		dt.mu.Unlock()
+		return nil
+	}
+	dt.mu.Unlock()
+
+	// Collect chunks without the lock because walking TOC can take long.
+	var chunks []dedupChunk
+	if err := w.ForeachChunk(func(id string, size int64) {
+		chunks = append(chunks, dedupChunk{id, size})
+	}); err != nil {
+		return err
+	}
+
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	if l, ok := dt.layers[layerDigest]; ok {
+		l.refcnt++
+		return nil
+	}
+	dt.layers[layerDigest] = &dedupLayer{refcnt: 1, chunks: chunks}
+	dt.stats.Layers++
+	for _, c := range chunks {
+		dt.stats.Chunks++
+		dt.stats.LogicalSize += c.size
+		if dt.chunks[c.id] == 0 {
+			dt.stats.UniqueChunks++
+			dt.stats.UniqueSize += c.size
+		}
+		dt.chunks[c.id]++
+	}
+	return nil
+}
+
+// remove releases a reference of the layer. Chunks of the layer are
+// unregistered when the last reference is released.
+func (dt *dedupTracker) remove(layerDigest string) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	l, ok := dt.layers[layerDigest]
+	if !ok {
+		return
+	}
+	if l.refcnt--; l.refcnt > 0 {
+		return
+	}
+	delete(dt.layers, layerDigest)
+	dt.stats.Layers--
+	for _, c := range l.chunks {
+		dt.stats.Chunks--
+		dt.stats.LogicalSize -= c.size
+		if dt.chunks[c.id]--; dt.chunks[c.id] == 0 {
+			delete(dt.chunks, c.id)
+			dt.stats.UniqueChunks--
+			dt.stats.UniqueSize -= c.size
+		}
+	}
+}
+
+func (dt *dedupTracker) get() DedupStats {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	s := dt.stats
+	if s.UniqueSize > 0 {
+		s.Ratio = float64(s.LogicalSize) / float64(s.UniqueSize)
+	}
+	return s
+}
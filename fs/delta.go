@@ -0,0 +1,69 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"sync/atomic"
+
+	"github.com/containerd/stargz-snapshotter/cache"
+	"github.com/containerd/stargz-snapshotter/estargz"
+)
+
+// chunkDelta is the chunk-level delta of the prefetch target of a layer from
+// the contents already in the filesystem cache. Chunks are keyed by their
+// digests, so a new version of an image shares the cached chunks of the
+// previous version whose contents aren't changed.
+type chunkDelta struct {
+	chunks       int64
+	cachedChunks int64
+	size         int64
+	cachedSize   int64
+}
+
+type chunkEntryWalker interface {
+	ForeachChunkEntry(f func(id string, ce *estargz.TOCEntry)) error
+}
+
+// computeDelta compares chunks in the range [0, limit) of the layer with the
+// cache.
+func computeDelta(w chunkEntryWalker, c cache.BlobCache, limit int64) (d chunkDelta, _ error) {
+	err := w.ForeachChunkEntry(func(id string, ce *estargz.TOCEntry) {
+		if ce.Offset >= limit {
+			return
+		}
+		d.chunks++
+		d.size += ce.ChunkSize
+		if _, err := c.FetchAt(id, 0, nil); err == nil {
+			d.cachedChunks++
+			d.cachedSize += ce.ChunkSize
+		}
+	})
+	return d, err
+}
+
+// deltaStats counts layers prefetched by delta.
+type deltaStats struct {
+	layers      int64
+	reusedSize  int64
+	fetchedSize int64
+}
+
+func (ds *deltaStats) add(d chunkDelta) {
+	atomic.AddInt64(&ds.layers, 1)
+	atomic.AddInt64(&ds.reusedSize, d.cachedSize)
+	atomic.AddInt64(&ds.fetchedSize, d.size-d.cachedSize)
+}
@@ -0,0 +1,95 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+
+	snbase "github.com/containerd/stargz-snapshotter/snapshot"
+)
+
+// Types of lifecycle events of layers.
+const (
+	// EventResolved is emitted when a layer is resolved and registered to the
+	// mountpoint.
+	EventResolved = "resolved"
+
+	// EventPrefetched is emitted when the prefetch of a layer completes. Error
+	// is set if the prefetch failed.
+	EventPrefetched = "prefetched"
+
+	// EventBackgroundFetched is emitted when the whole contents of a layer are
+	// fetched in background.
+	EventBackgroundFetched = "background-fetch-complete"
+
+	// EventDegraded is emitted when a mounted layer becomes unavailable (e.g.
+	// the registry is unreachable).
+	EventDegraded = "degraded"
+
+	// EventFallback is emitted when a layer can't be mounted remotely and the
+	// snapshotter falls back to a normal snapshot pulled by the client.
+	EventFallback = "fallback"
+)
+
+// Event is a lifecycle event of a layer.
+type Event struct {
+	Type       string `json:"type"`
+	Mountpoint string `json:"mountpoint,omitempty"`
+	Digest     string `json:"digest,omitempty"`
+	Ref        string `json:"ref,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// EventHandler is called on each lifecycle event of layers. This must not
+// block. ctx carries the namespace of the request mounting the layer, if any.
+type EventHandler func(ctx context.Context, e Event)
+
+// WithEventHandler specifies the handler of lifecycle events of layers.
+func WithEventHandler(h EventHandler) Option {
+	return func(opts *options) {
+		opts.eventHandler = h
+	}
+}
+
+var _ = (snbase.FallbackNotifier)((*filesystem)(nil))
+
+// NotifyFallback emits EventFallback for the layer specified by the labels.
+func (fs *filesystem) NotifyFallback(ctx context.Context, labels map[string]string, err error) {
+	e := Event{Type: EventFallback}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if src, sErr := fs.getSources(fs.labelFilter.Filter(labels)); sErr == nil && len(src) > 0 {
+		e.Digest, e.Ref = src[0].Target.Digest.String(), src[0].Name.String()
+	}
+	fs.emit(ctx, e)
+}
+
+func (fs *filesystem) emit(ctx context.Context, e Event) {
+	if fs.eventHandler != nil {
+		fs.eventHandler(ctx, e)
+	}
+}
+
+// layerEvent returns an event of the layer mounted on the mountpoint.
+func layerEvent(typ, mountpoint string, l *layer, ref string, err error) Event {
+	e := Event{Type: typ, Mountpoint: mountpoint, Digest: l.desc.Digest.String(), Ref: ref}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	return e
+}
@@ -0,0 +1,164 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Maximum number of fetches recorded per layer. The oldest records are
+// discarded (and counted as dropped) when a layer exceeds this.
+const maxFetchLogRecords = 10000
+
+// FetchRecord is a read of a file which missed the cache so the chunk was
+// fetched from the blob on demand.
+type FetchRecord struct {
+	Path    string        `json:"path"`
+	Offset  int64         `json:"offset"` // offset of the chunk in the blob
+	Size    int64         `json:"size"`
+	Start   time.Time     `json:"start"`
+	Latency time.Duration `json:"latency"`
+
+	// Prioritized is true if the chunk is in the prefetch region of the layer
+	// (e.g. prioritized files of eStargz) so it was fetched on demand only
+	// because the prefetch hadn't completed at the time.
+	Prioritized bool `json:"prioritized"`
+}
+
+// LayerFetchLog is on-demand fetches recorded for a mounted layer.
+type LayerFetchLog struct {
+	LayerProgress
+	Records []FetchRecord `json:"records"`
+	Dropped int           `json:"dropped"`
+}
+
+// FetchLogReporter reports on-demand fetches of mounted layers. The filesystem
+// returned by NewFilesystem implements this interface.
+type FetchLogReporter interface {
+	FetchLog(ctx context.Context, mountpoints []string, since time.Time) []LayerFetchLog
+}
+
+var _ = (FetchLogReporter)((*filesystem)(nil))
+
+// FetchLog returns fetches recorded since the specified time for the layers
+// mounted on the mountpoints. Mountpoints where no layer is mounted are ignored.
+func (fs *filesystem) FetchLog(ctx context.Context, mountpoints []string, since time.Time) (res []LayerFetchLog) {
+	fs.layerMu.Lock()
+	defer fs.layerMu.Unlock()
+	for _, mp := range mountpoints {
+		l, ok := fs.layer[mp]
+		if !ok {
+			continue
+		}
+		p := l.progress.get()
+		p.Mountpoint = mp
+		p.Digest = l.desc.Digest.String()
+		p.Materialized = l.isMaterialized()
+		records, dropped := l.fetchLog.get(since)
+		for i := range records {
+			records[i].Prioritized = records[i].Offset < p.PrefetchSize
+		}
+		res = append(res, LayerFetchLog{
+			LayerProgress: p,
+			Records:       records,
+			Dropped:       dropped,
+		})
+	}
+	return
+}
+
+// fetchLog records on-demand fetches of a layer in a ring buffer. It also
+// counts all fetches and reads served from the cache.
+type fetchLog struct {
+	// Accessed atomically. Placed first for the 64-bit alignment.
+	hits    int64
+	hitSize int64
+
+	fetches     int64 // guarded by mu
+	fetchedSize int64 // guarded by mu
+
+	records []FetchRecord
+	next    int
+	dropped int
+	mu      sync.Mutex
+}
+
+func newFetchLog() *fetchLog {
+	return &fetchLog{}
+}
+
+// add is a reader.MissObserver.
+func (fl *fetchLog) add(name string, offset, size int64, latency time.Duration) {
+	r := FetchRecord{
+		Path:    "/" + name,
+		Offset:  offset,
+		Size:    size,
+		Start:   time.Now().Add(-latency),
+		Latency: latency,
+	}
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	fl.fetches++
+	fl.fetchedSize += size
+	if len(fl.records) < maxFetchLogRecords {
+		fl.records = append(fl.records, r)
+		return
+	}
+	fl.records[fl.next] = r
+	fl.next = (fl.next + 1) % maxFetchLogRecords
+	fl.dropped++
+}
+
+// addHit is a reader.HitObserver.
+func (fl *fetchLog) addHit(size int64) {
+	atomic.AddInt64(&fl.hits, 1)
+	atomic.AddInt64(&fl.hitSize, size)
+}
+
+// counts returns the numbers and the total sizes of reads served from the
+// cache and fetches since the layer was mounted.
+func (fl *fetchLog) counts() (hits, hitSize, fetches, fetchedSize int64) {
+	if fl == nil {
+		return
+	}
+	fl.mu.Lock()
+	fetches, fetchedSize = fl.fetches, fl.fetchedSize
+	fl.mu.Unlock()
+	return atomic.LoadInt64(&fl.hits), atomic.LoadInt64(&fl.hitSize), fetches, fetchedSize
+}
+
+// get returns the records started at or after since, oldest first, and the
+// number of records dropped so far.
+func (fl *fetchLog) get(since time.Time) (res []FetchRecord, dropped int) {
+	if fl == nil {
+		return nil, 0
+	}
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	for i := range fl.records {
+		r := fl.records[(fl.next+i)%len(fl.records)]
+		if !r.Start.Before(since) {
+			res = append(res, r)
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Start.Before(res[j].Start) })
+	return res, fl.dropped
+}
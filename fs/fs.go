@@ -43,26 +43,34 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"unsafe"
 
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/log"
-	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/containerd/sys"
 	"github.com/containerd/stargz-snapshotter/cache"
 	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/blockdev"
 	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/dataonly"
+	"github.com/containerd/stargz-snapshotter/fs/hint"
 	"github.com/containerd/stargz-snapshotter/fs/reader"
 	"github.com/containerd/stargz-snapshotter/fs/remote"
 	"github.com/containerd/stargz-snapshotter/fs/source"
 	snbase "github.com/containerd/stargz-snapshotter/snapshot"
 	"github.com/containerd/stargz-snapshotter/task"
+	"github.com/containerd/stargz-snapshotter/util/fdbudget"
 	"github.com/golang/groupcache/lru"
 	fusefs "github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -79,19 +87,29 @@ const (
 	whiteoutPrefix            = ".wh."
 	whiteoutOpaqueDir         = whiteoutPrefix + whiteoutPrefix + ".opq"
 	opaqueXattr               = "trusted.overlay.opaque"
+	userOpaqueXattr           = "user.overlay.opaque"
 	opaqueXattrValue          = "y"
+	overlayXattrs             = "trusted.overlay."
+	userOverlayXattrs         = "user.overlay."
 	stateDirName              = ".stargz-snapshotter"
 	defaultResolveResultEntry = 100
 	defaultPrefetchTimeoutSec = 10
 	defaultMaxConcurrency     = 2
+	defaultMountTimeoutSec    = 30
 	statFileMode              = syscall.S_IFREG | 0400 // -r--------
 	stateDirMode              = syscall.S_IFDIR | 0500 // dr-x------
 )
 
+// defaultFDLeakCheckIntervalSec is the default interval of checking file
+// descriptors of the process.
+const defaultFDLeakCheckIntervalSec = 300
+
 type Option func(*options)
 
 type options struct {
-	getSources source.GetSources
+	getSources     source.GetSources
+	prefetchPolicy PrefetchPolicy
+	eventHandler   EventHandler
 }
 
 func WithGetSources(s source.GetSources) Option {
@@ -100,11 +118,30 @@ func WithGetSources(s source.GetSources) Option {
 	}
 }
 
+// WithPrefetchPolicy specifies the policy to predict files to prefetch on each
+// file access. This takes precedence over `predictive_prefetch` configuration.
+func WithPrefetchPolicy(p PrefetchPolicy) Option {
+	return func(opts *options) {
+		opts.prefetchPolicy = p
+	}
+}
+
 func NewFilesystem(root string, cfg config.Config, opts ...Option) (_ snbase.FileSystem, err error) {
 	var fsOpts options
 	for _, o := range opts {
 		o(&fsOpts)
 	}
+	labelFilter, err := config.NewLabelFilter(cfg.LabelPassthrough)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid label_passthrough")
+	}
+
+	fdBudget := fdbudget.New(cfg.FDSoftCap)
+	leakCheckInterval := time.Duration(cfg.FDLeakCheckIntervalSec) * time.Second
+	if leakCheckInterval == 0 {
+		leakCheckInterval = defaultFDLeakCheckIntervalSec * time.Second
+	}
+	go fdBudget.RunLeakDetector(context.Background(), leakCheckInterval)
 
 	dcc := cfg.DirectoryCacheConfig
 	var httpCache cache.BlobCache
@@ -114,9 +151,14 @@ func NewFilesystem(root string, cfg config.Config, opts ...Option) (_ snbase.Fil
 		if httpCache, err = cache.NewDirectoryCache(
 			filepath.Join(root, "http"),
 			cache.DirectoryCacheConfig{
-				MaxLRUCacheEntry: dcc.MaxLRUCacheEntry,
-				MaxCacheFds:      dcc.MaxCacheFds,
-				SyncAdd:          dcc.SyncAdd,
+				MaxLRUCacheEntry:       dcc.MaxLRUCacheEntry,
+				MaxCacheFds:            dcc.MaxCacheFds,
+				SyncAdd:                dcc.SyncAdd,
+				HighWatermarkPercent:   dcc.HighWatermarkPercent,
+				LowWatermarkPercent:    dcc.LowWatermarkPercent,
+				WatermarkCheckInterval: time.Duration(dcc.WatermarkCheckIntervalSec) * time.Second,
+				IOUring:                dcc.IOUring,
+				FDBudget:               fdBudget,
 			},
 		); err != nil {
 			return nil, errors.Wrap(err, "failed to prepare HTTP cache")
@@ -126,14 +168,29 @@ func NewFilesystem(root string, cfg config.Config, opts ...Option) (_ snbase.Fil
 	if cfg.FSCacheType == memoryCacheType {
 		fsCache = cache.NewMemoryCache()
 	} else {
-		if fsCache, err = cache.NewDirectoryCache(
-			filepath.Join(root, "fscache"),
-			cache.DirectoryCacheConfig{
-				MaxLRUCacheEntry: dcc.MaxLRUCacheEntry,
-				MaxCacheFds:      dcc.MaxCacheFds,
-				SyncAdd:          dcc.SyncAdd,
-			},
-		); err != nil {
+		fsCacheDir := filepath.Join(root, "fscache")
+		fsCacheConfig := cache.DirectoryCacheConfig{
+			MaxLRUCacheEntry:          dcc.MaxLRUCacheEntry,
+			MaxCacheFds:               dcc.MaxCacheFds,
+			SyncAdd:                   dcc.SyncAdd,
+			HighWatermarkPercent:      dcc.HighWatermarkPercent,
+			LowWatermarkPercent:       dcc.LowWatermarkPercent,
+			WatermarkCheckInterval:    time.Duration(dcc.WatermarkCheckIntervalSec) * time.Second,
+			Compress:                  dcc.Compress,
+			DecompressedCacheMaxBytes: dcc.DecompressedCacheMaxBytes,
+			IOUring:                   dcc.IOUring,
+			FDBudget:                  fdBudget,
+		}
+		if dcc.HotCacheDir != "" {
+			fsCache, err = cache.NewTieredCache(dcc.HotCacheDir, fsCacheDir, fsCacheConfig,
+				cache.TieredCacheConfig{
+					HotMaxBytes:      dcc.HotCacheMaxBytes,
+					PromoteAfterHits: dcc.HotCachePromoteAfterHits,
+				})
+		} else {
+			fsCache, err = cache.NewDirectoryCache(fsCacheDir, fsCacheConfig)
+		}
+		if err != nil {
 			return nil, errors.Wrap(err, "failed to prepare filesystem cache")
 		}
 	}
@@ -145,39 +202,179 @@ func NewFilesystem(root string, cfg config.Config, opts ...Option) (_ snbase.Fil
 	if prefetchTimeout == 0 {
 		prefetchTimeout = defaultPrefetchTimeoutSec * time.Second
 	}
+	mountTimeout := time.Duration(cfg.MountTimeoutSec) * time.Second
+	if mountTimeout == 0 {
+		mountTimeout = defaultMountTimeoutSec * time.Second
+	}
+	volumePrefetchSize := cfg.ImageVolume.PrefetchSize
+	if cfg.ImageVolume.PrefetchAll {
+		volumePrefetchSize = math.MaxInt64 // adjusted to the size of each layer
+	} else if volumePrefetchSize == 0 {
+		volumePrefetchSize = cfg.PrefetchSize
+	}
 	maxConcurrency := cfg.MaxConcurrency
 	if maxConcurrency == 0 {
 		maxConcurrency = defaultMaxConcurrency
 	}
+	var negCache *negativeCache
+	if cfg.NegativeCacheTTLSec > 0 {
+		ttl := time.Duration(cfg.NegativeCacheTTLSec) * time.Second
+		if negCache, err = newNegativeCache(filepath.Join(root, negativeCacheFileName), ttl); err != nil {
+			return nil, errors.Wrap(err, "failed to prepare negative cache")
+		}
+	}
+	var pins *pinStore
+	if p, ok := fsCache.(cache.Pinner); ok {
+		if pins, err = newPinStore(filepath.Join(root, pinsFileName), p); err != nil {
+			return nil, errors.Wrap(err, "failed to prepare pins")
+		}
+	}
 	getSources := fsOpts.getSources
 	if getSources == nil {
 		getSources = source.FromDefaultLabels(
 			docker.ConfigureDefaultRegistries(docker.WithPlainHTTP(docker.MatchLocalhost)))
 	}
-	return &filesystem{
+	resolveResult := lru.New(resolveResultEntry)
+	resolveResult.OnEvicted = func(_ lru.Key, value interface{}) {
+		value.(*layer).release()
+	}
+	fs := &filesystem{
 		resolver:              remote.NewResolver(httpCache, cfg.BlobConfig),
 		getSources:            getSources,
 		fsCache:               fsCache,
 		prefetchSize:          cfg.PrefetchSize,
+		volumePrefetchSize:    volumePrefetchSize,
 		prefetchTimeout:       prefetchTimeout,
 		noprefetch:            cfg.NoPrefetch,
+		prefetchPageCache:     cfg.PrefetchPageCache,
+		fuseCacheMode:         cfg.FUSECacheMode,
+		atimeMode:             cfg.ATimeMode,
+		opaqueXattrs:          opaqueXattrsOf(cfg.OverlayOpaqueType, sys.RunningInUserNS()),
+		dataOnly:              cfg.OverlayDataOnly || cfg.Composefs,
+		composefs:             cfg.Composefs,
+		dataOnlyVerity:        cfg.OverlayDataOnlyVerity,
+		dataDirs:              make(map[string]string),
+		ublkSquashfs:          cfg.UblkSquashfs,
+		fips:                  cfg.FIPS,
+		blockDevs:             make(map[string]*blockdev.UblkDevice),
+		mergedViews:           make(map[string][]string),
 		noBackgroundFetch:     cfg.NoBackgroundFetch,
 		debug:                 cfg.Debug,
 		layer:                 make(map[string]*layer),
-		resolveResult:         lru.New(resolveResultEntry),
+		resolveResult:         resolveResult,
 		blobResult:            lru.New(resolveResultEntry),
 		backgroundTaskManager: task.NewBackgroundTaskManager(maxConcurrency, 5*time.Second),
 		allowNoVerification:   cfg.AllowNoVerification,
 		disableVerification:   cfg.DisableVerification,
-	}, nil
+		exposeLayerBlob:       cfg.ExposeLayerBlob,
+		pending:               make(map[string]*pendingLayer),
+		mountRefs:             make(map[string]string),
+		mountTimeout:          mountTimeout,
+		syncResolveTopLayers:  cfg.SyncResolveTopLayers,
+		dedup:                 newDedupTracker(),
+		negativeCache:         negCache,
+		pins:                  pins,
+		metadata:              newMetadataPool(),
+		labelFilter:           labelFilter,
+		fdBudget:              fdBudget,
+		zeroCopyRead:          cfg.ZeroCopyRead,
+		streamReadThreshold:   cfg.StreamingReadThreshold,
+		deltaPrefetch:         cfg.DeltaPrefetch,
+		noAllowOther:          cfg.Privilege.NoAllowOther,
+		directMount:           sys.RunningInUserNS(),
+		serveUID:              cfg.Privilege.ServeUID,
+		serveGID:              cfg.Privilege.ServeGID,
+	}
+	fs.memGuard = newMemoryGuard(fs, cfg.MaxMemoryBytes, httpCache, fsCache)
+	if cfg.MaxMemoryBytes > 0 {
+		interval := time.Duration(cfg.MemoryCheckIntervalSec) * time.Second
+		if interval == 0 {
+			interval = defaultMemoryCheckIntervalSec * time.Second
+		}
+		go fs.memGuard.run(context.Background(), interval)
+	}
+	if cfg.PinTagDigest {
+		interval := time.Duration(cfg.TagDriftCheckIntervalSec) * time.Second
+		if interval == 0 {
+			interval = defaultTagDriftCheckIntervalSec * time.Second
+		}
+		resolveTimeout := fs.resolver.ResolveTimeout()
+		fs.tagPins = newTagPinner(func(ctx context.Context, hosts docker.RegistryHosts, ref string) (digest.Digest, error) {
+			ctx, cancel := context.WithTimeout(ctx, resolveTimeout)
+			defer cancel()
+			return resolveManifest(ctx, hosts, ref)
+		})
+		go fs.tagPins.run(context.Background(), interval)
+	}
+	if lw := cfg.LatencyWatchdog; lw.ThresholdMsec > 0 {
+		window := time.Duration(lw.WindowSec) * time.Second
+		if window == 0 {
+			window = defaultLatencyWatchdogWindowSec * time.Second
+		}
+		minSamples := lw.MinSamples
+		if minSamples == 0 {
+			minSamples = defaultLatencyWatchdogMinSamples
+		}
+		fs.latencyWatchdog = newLatencyWatchdog(time.Duration(lw.ThresholdMsec)*time.Millisecond, window, minSamples,
+			fs.mountedLayers, fs.Materialize)
+		go fs.latencyWatchdog.run(context.Background())
+	}
+	if ci := cfg.ChunkIntegrity; ci.VerifyCache {
+		fs.chunkQuarantine = newChunkQuarantine(ci.QuarantineThreshold)
+	}
+	if fs.audit, err = newAuditLogger(cfg.AuditLog); err != nil {
+		return nil, errors.Wrap(err, "failed to open audit log")
+	}
+	fs.eventHandler = fsOpts.eventHandler
+	if cfg.CrossLayerFetch {
+		fs.chunkIndex = newChunkIndex()
+	}
+	if cfg.EBPFAccessHints {
+		window := time.Duration(cfg.AccessHintsLearnWindowSec) * time.Second
+		if window == 0 {
+			window = defaultAccessHintsLearnWindowSec * time.Second
+		}
+		if fs.hinter, err = newAccessHinter(fs, filepath.Join(root, "hints"), window); err != nil {
+			return nil, errors.Wrap(err, "failed to enable access hints")
+		}
+		fs.layerStateDirs = append(fs.layerStateDirs, filepath.Join(root, "hints"))
+	}
+	prefetchPolicy := fsOpts.prefetchPolicy
+	if prefetchPolicy == nil && cfg.PredictivePrefetch {
+		if prefetchPolicy, err = hint.NewMarkovPredictor(filepath.Join(root, "prefetch-model"), 0); err != nil {
+			return nil, errors.Wrap(err, "failed to prepare prefetch model")
+		}
+		fs.layerStateDirs = append(fs.layerStateDirs, filepath.Join(root, "prefetch-model"))
+	}
+	if prefetchPolicy != nil {
+		fs.predictor = newPredictivePrefetcher(fs, prefetchPolicy)
+	}
+	if cfg.ScanPrefetch {
+		fs.scanner = newScanPrefetcher(fs, cfg.ScanPrefetchThreshold, cfg.ScanPrefetchMaxFileSize)
+	}
+	return fs, nil
 }
 
 type filesystem struct {
 	resolver              *remote.Resolver
 	fsCache               cache.BlobCache
 	prefetchSize          int64
+	volumePrefetchSize    int64 // prefetch size of layers of image volumes
 	prefetchTimeout       time.Duration
 	noprefetch            bool
+	prefetchPageCache     bool
+	fuseCacheMode         string
+	atimeMode             string
+	opaqueXattrs          []string // xattrs indicating opaque directories
+	dataOnly              bool
+	dataOnlyVerity        bool
+	composefs             bool
+	dataDirs              map[string]string // mountpoint -> data directory in the data-only mode
+	ublkSquashfs          bool
+	fips                  bool
+	blockDevs             map[string]*blockdev.UblkDevice // mountpoint -> block device of the layer
+	mergedViews           map[string][]string             // directory of a merged view -> mountpoints of the layers
+	mergedMu              sync.Mutex
 	noBackgroundFetch     bool
 	debug                 bool
 	layer                 map[string]*layer
@@ -191,9 +388,52 @@ type filesystem struct {
 	disableVerification   bool
 	getSources            source.GetSources
 	resolveG              singleflight.Group
+	dedup                 *dedupTracker
+	negativeCache         *negativeCache
+	pins                  *pinStore // nil if the cache doesn't support pinning
+	exposeLayerBlob       bool
+	resolvedNames         map[string]map[string]struct{} // layer digest -> names of resolution results
+	resolvedNamesMu       sync.Mutex
+	pending               map[string]*pendingLayer // mountpoint -> layer being prepared in background
+	mountRefs             map[string]string        // mountpoint -> reference of the image
+	mountTimeout          time.Duration
+	syncResolveTopLayers  int
+	metadata              *metadataPool
+	fdBudget              *fdbudget.Budget
+	zeroCopyRead          bool
+	streamReadThreshold   int64
+	memGuard              *memoryGuard
+	opTracer              opTracer
+	hinter                *accessHinter
+	predictor             *predictivePrefetcher
+	scanner               *scanPrefetcher
+	labelFilter           *config.LabelFilter
+	tagPins               *tagPinner
+	latencyWatchdog       *latencyWatchdog
+	chunkQuarantine       *reader.ChunkQuarantine
+	audit                 *auditLogger // nil if the audit log is disabled
+	deltaPrefetch         bool
+	chunkIndex            *chunkIndex // non-nil if chunks are taken across layers
+	eventHandler          EventHandler
+	deltaStats            deltaStats
+	noAllowOther          bool
+	directMount           bool // mount FUSE with mount(2) instead of fusermount
+	serveUID              int  // owner of FUSE mounts; zero means root
+	serveGID              int
+	layerStateDirs        []string // directories of per-layer files named by layer digests
 }
 
-func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
+// IsLazyLayer returns true if the labels of the layer indicate that it can be
+// lazily pulled by this filesystem (i.e. eStargz layers annotated with TOC
+// digests and layers of Nydus images). The annotations of layers are passed as
+// labels by containerd.
+func IsLazyLayer(labels map[string]string) bool {
+	return labels[estargz.TOCJSONDigestAnnotation] != "" || isNydusLayer(labels)
+}
+
+func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[string]string) (retErr error) {
+	labels = fs.labelFilter.Filter(labels)
+
 	// This is a prioritized task and all background tasks will be stopped
 	// execution so this can avoid being disturbed for NW traffic by background
 	// tasks.
@@ -208,16 +448,130 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	} else if len(src) == 0 {
 		return fmt.Errorf("source must be passed")
 	}
+	if fs.tagPins != nil {
+		defer func() {
+			if retErr == nil {
+				fs.tagPins.add(ctx, mountpoint, src[0])
+			}
+		}()
+	}
+	if mode := fs.verificationMode(labels); fs.audit != nil && !isVerified(mode) {
+		defer func() {
+			if retErr == nil {
+				fs.audit.register(mountpoint, auditTarget{
+					image:        src[0].Name.String(),
+					layer:        src[0].Target.Digest.String(),
+					verification: mode,
+				})
+			}
+		}()
+	}
+
+	// Per-image cache options
+	var cacheOpts []cache.Option
+	if cStr, ok := labels[config.TargetCacheCompressionLabel]; ok {
+		if c, err := strconv.ParseBool(cStr); err == nil {
+			cacheOpts = append(cacheOpts, cache.Compression(c))
+		}
+	}
+	if labels[config.TargetCacheTierLabel] == "hot" {
+		cacheOpts = append(cacheOpts, cache.Hot())
+	}
 
+	if isNydusLayer(labels) {
+		return fs.mountNydus(ctx, mountpoint, labels, src, cacheOpts)
+	}
+
+	// Deep layers can be mounted before they are resolved. Reads on these layers
+	// block until the completion of resolving. The data-only mode and block
+	// devices need the metadata of the layer on mount so this isn't applied.
+	if !fs.dataOnly && !fs.ublkSquashfs && fs.syncResolveTopLayers > 0 && layerDepth(src[0]) >= fs.syncResolveTopLayers {
+		return fs.mountAsync(ctx, mountpoint, labels, src, cacheOpts)
+	}
+
+	l, layerReader, err := fs.prepareLayer(ctx, mountpoint, labels, src, cacheOpts)
+	if err != nil {
+		return err
+	}
+	if fs.dataOnly {
+		err = fs.mountDataOnly(ctx, mountpoint, l, layerReader, fs.openFlags(ctx, labels), fs.streamThreshold(ctx, labels))
+	} else {
+		err = fs.serve(ctx, mountpoint, &node{
+			fs:              fs,
+			layer:           layerReader,
+			e:               l.root,
+			s:               fs.newLayerState(l),
+			root:            mountpoint,
+			openFlags:       fs.openFlags(ctx, labels),
+			streamThreshold: fs.streamThreshold(ctx, labels),
+		})
+	}
+	if err == nil && fs.ublkSquashfs {
+		fs.attachBlockDevice(ctx, mountpoint, l, layerReader)
+	}
+	return err
+}
+
+// layerDepth returns the position of the target layer counted from the top
+// layer of the image, which is 0. This returns -1 if the layer isn't found in
+// the manifest.
+func layerDepth(s source.Source) int {
+	layers := s.Manifest.Layers
+	for i := len(layers) - 1; i >= 0; i-- {
+		if layers[i].Digest == s.Target.Digest {
+			return len(layers) - 1 - i
+		}
+	}
+	return -1
+}
+
+// openFlags returns the FUSE flags of files opened in the layer, which are
+// specified by the config and the label.
+func (fs *filesystem) openFlags(ctx context.Context, labels map[string]string) uint32 {
+	mode := fs.fuseCacheMode
+	if m, ok := labels[config.TargetFUSECacheModeLabel]; ok {
+		mode = m
+	}
+	switch mode {
+	case "":
+		return 0
+	case config.FUSECacheModeKeepCache:
+		return fuse.FOPEN_KEEP_CACHE
+	case config.FUSECacheModeDirectIO:
+		return fuse.FOPEN_DIRECT_IO
+	}
+	log.G(ctx).Warnf("unknown FUSE cache mode %q; using the default", mode)
+	return 0
+}
+
+// streamThreshold returns the size of files from which sequential reads are
+// served by streams of the blob, which is specified by the config and the
+// label. Zero means streaming is disabled.
+func (fs *filesystem) streamThreshold(ctx context.Context, labels map[string]string) int64 {
+	threshold := fs.streamReadThreshold
+	if t, ok := labels[config.TargetStreamingReadThresholdLabel]; ok {
+		v, err := strconv.ParseInt(t, 10, 64)
+		if err != nil || v < 0 {
+			log.G(ctx).Warnf("invalid streaming read threshold %q; using the default", t)
+		} else {
+			threshold = v
+		}
+	}
+	return threshold
+}
+
+// prepareLayer resolves and verifies the layer, registers it to the mountpoint
+// and starts fetching its contents.
+func (fs *filesystem) prepareLayer(ctx context.Context, mountpoint string, labels map[string]string, src []source.Source, cacheOpts []cache.Option) (*layer, reader.Reader, error) {
 	// Resolve the target layer
 	var (
-		resultChan = make(chan *layer)
-		errChan    = make(chan error)
+		resultChan = make(chan *layer, 1)
+		errChan    = make(chan error, 1)
 	)
 	go func() {
 		rErr := fmt.Errorf("failed to resolve target")
 		for _, s := range src {
-			l, err := fs.resolveLayer(ctx, s.Hosts, s.Name, s.Target)
+			l, err := fs.resolveLayer(ctx, s, s.Target, cacheOpts...)
 			if err == nil {
 				resultChan <- l
 				return
@@ -232,7 +586,7 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	preResolve := src[0] // TODO: should we pre-resolve blobs in other sources as well?
 	for _, desc := range preResolve.Manifest.Layers {
 		if desc.Digest.String() != preResolve.Target.Digest.String() {
-			go fs.resolveLayer(ctx, preResolve.Hosts, preResolve.Name, desc)
+			go fs.resolveLayer(ctx, preResolve, desc, cacheOpts...)
 		}
 	}
 
@@ -242,11 +596,12 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	case l = <-resultChan:
 	case err := <-errChan:
 		log.G(ctx).WithError(err).Debug("failed to resolve layer")
-		return errors.Wrapf(err, "failed to resolve layer")
-	case <-time.After(30 * time.Second):
+		return nil, nil, errors.Wrapf(err, "failed to resolve layer")
+	case <-time.After(fs.mountTimeout):
 		log.G(ctx).Debug("failed to resolve layer (timeout)")
-		return fmt.Errorf("failed to resolve layer (timeout)")
+		return nil, nil, fmt.Errorf("failed to resolve layer (timeout)")
 	}
+	setQoSClass(ctx, l.blob, labels)
 
 	// Verify layer's content
 	if fs.disableVerification {
@@ -258,11 +613,11 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 		dgst, err := digest.Parse(tocDigest)
 		if err != nil {
 			log.G(ctx).WithError(err).Debugf("failed to parse passed TOC digest %q", dgst)
-			return errors.Wrapf(err, "invalid TOC digest: %v", tocDigest)
+			return nil, nil, errors.Wrapf(err, "invalid TOC digest: %v", tocDigest)
 		}
 		if err := l.verify(dgst); err != nil {
 			log.G(ctx).WithError(err).Debugf("invalid layer")
-			return errors.Wrapf(err, "invalid stargz layer")
+			return nil, nil, errors.Wrapf(err, "invalid stargz layer")
 		}
 		log.G(ctx).Debugf("verified")
 	} else if _, ok := labels[config.TargetSkipVerifyLabel]; ok && fs.allowNoVerification {
@@ -273,23 +628,44 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 		log.G(ctx).Warningf("No verification is held for layer")
 	} else {
 		// Verification must be done. Don't mount this layer.
-		return fmt.Errorf("digest of TOC JSON must be passed")
+		return nil, nil, fmt.Errorf("digest of TOC JSON must be passed")
 	}
 	layerReader, err := l.reader()
 	if err != nil {
 		log.G(ctx).WithError(err).Warningf("failed to get reader for layer")
-		return err
+		return nil, nil, err
 	}
 
 	// Register the mountpoint layer
+	ref := src[0].Name.String()
+	if fs.pins != nil && labels[config.TargetPinLabel] == "true" {
+		if err := fs.pins.pin(ref, []string{l.desc.Digest.String()}); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to pin layer")
+		}
+		fs.pins.apply(l.desc.Digest.String(), l.verifiableReader)
+	}
+	if fs.pins != nil && fs.pins.isMaterialized(l.desc.Digest.String()) {
+		l.materialize()
+	}
+	l.acquire()
 	fs.layerMu.Lock()
 	fs.layer[mountpoint] = l
+	fs.mountRefs[mountpoint] = ref
 	fs.layerMu.Unlock()
+	if fs.hinter != nil {
+		fs.hinter.learn(ctx, mountpoint, l)
+	}
+	fs.emit(ctx, layerEvent(EventResolved, mountpoint, l, ref, nil))
 
 	// Prefetch this layer. We prefetch several layers in parallel. The first
 	// Check() for this layer waits for the prefetch completion.
 	if !fs.noprefetch {
 		prefetchSize := fs.prefetchSize
+		volume := labels[config.TargetImageVolumeLabel] == "true"
+		if volume {
+			prefetchSize = fs.volumePrefetchSize
+			atomic.StoreInt32(&l.volume, 1)
+		}
 		if psStr, ok := labels[config.TargetPrefetchSizeLabel]; ok {
 			if ps, err := strconv.ParseInt(psStr, 10, 64); err == nil {
 				prefetchSize = ps
@@ -298,11 +674,25 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 		go func() {
 			fs.backgroundTaskManager.DoPrioritizedTask()
 			defer fs.backgroundTaskManager.DonePrioritizedTask()
-			if err := l.prefetch(prefetchSize); err != nil {
+			var cacheOpts []cache.Option
+			if fs.prefetchPageCache {
+				cacheOpts = append(cacheOpts, cache.WillNeed())
+			}
+			profile := labels[config.TargetPrefetchProfileLabel]
+			err := l.prefetch(prefetchSize, !volume, profile, cacheOpts...)
+			l.progress.finishPrefetch(err)
+			if err != nil {
 				log.G(ctx).WithError(err).Debug("failed to prefetched layer")
+				fs.emit(ctx, layerEvent(EventPrefetched, mountpoint, l, ref, err))
 				return
 			}
 			log.G(ctx).Debug("completed to prefetch")
+			fs.emit(ctx, layerEvent(EventPrefetched, mountpoint, l, ref, nil))
+			if fs.hinter != nil && !volume {
+				if err := fs.hinter.prefetch(ctx, l); err != nil {
+					log.G(ctx).WithError(err).Debug("failed to prefetch hinted files")
+				}
+			}
 		}()
 	}
 
@@ -319,6 +709,7 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 						offset,
 						remote.WithContext(ctx),              // Make cancellable
 						remote.WithCacheOpts(cache.Direct()), // Do not pollute mem cache
+						remote.WithBackground(),              // Go after on-demand fetches
 					)
 				}, 120*time.Second)
 				return
@@ -331,43 +722,94 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 				return
 			}
 			log.G(ctx).Debug("completed to fetch all layer data in background")
+			fs.emit(ctx, layerEvent(EventBackgroundFetched, mountpoint, l, ref, nil))
 		}()
 	}
 
+	return l, layerReader, nil
+}
+
+func (fs *filesystem) newLayerState(l *layer) *state {
+	s := newState(l.desc.Digest.String(), l.blob, l.progress)
+	s.atimes = newATimeTracker(fs.atimeMode)
+	if l.verifiableReader != nil {
+		s.addDebugFile(l.desc.Digest.String()+".toc.json", l.verifiableReader.TOCJSON)
+	}
+	if fs.exposeLayerBlob {
+		s.addRawFile(l.desc.Digest.String()+".blob", l.blob.Size(), func(p []byte, offset int64) (int, error) {
+			fs.backgroundTaskManager.DoPrioritizedTask()
+			defer fs.backgroundTaskManager.DonePrioritizedTask()
+			return l.blob.ReadAt(p, offset)
+		})
+	}
+	return s
+}
+
+// serve mounts the root node on the mountpoint.
+func (fs *filesystem) serve(ctx context.Context, mountpoint string, root fusefs.InodeEmbedder) error {
 	// Mounting stargz
 	// TODO: bind mount the state directory as a read-only fs on snapshotter's side
 	timeSec := time.Second
-	rawFS := fusefs.NewNodeFS(&node{
-		fs:    fs,
-		layer: layerReader,
-		e:     l.root,
-		s:     newState(l.desc.Digest.String(), l.blob),
-		root:  mountpoint,
-	}, &fusefs.Options{
+	rawFS := fusefs.NewNodeFS(root, &fusefs.Options{
 		AttrTimeout:     &timeSec,
 		EntryTimeout:    &timeSec,
 		NullPermissions: true,
 	})
-	server, err := fuse.NewServer(rawFS, mountpoint, &fuse.MountOptions{
-		AllowOther: true,             // allow users other than root&mounter to access fs
+	mountOpts := &fuse.MountOptions{
+		AllowOther: !fs.noAllowOther, // allow users other than root&mounter to access fs
 		FsName:     "stargz",         // name this filesystem as "stargz"
 		Options:    []string{"suid"}, // allow setuid inside container
 		Debug:      fs.debug,
-	})
+	}
+	if fs.directMount || fs.serveUID != 0 || fs.serveGID != 0 {
+		// fusermount doesn't allow to specify the owner and isn't needed in
+		// user namespaces (e.g. rootless mode) so mount(2) is used directly.
+		// MS_NOSUID isn't set to allow setuid inside container.
+		mountOpts.Name = "stargz"
+		mountOpts.DirectMount = true
+		mountOpts.DirectMountFlags = unix.MS_NODEV
+		mountOpts.Options = []string{
+			fmt.Sprintf("user_id=%d", fs.serveUID),
+			fmt.Sprintf("group_id=%d", fs.serveGID),
+		}
+	}
+	if opt, flag := atimeMountOption(fs.atimeMode); opt != "" {
+		mountOpts.Options = append(mountOpts.Options, opt)
+		mountOpts.DirectMountFlags |= flag
+	}
+	server, err := fuse.NewServer(rawFS, mountpoint, mountOpts)
 	if err != nil {
 		log.G(ctx).WithError(err).Debug("failed to make filesstem server")
 		return err
 	}
 
 	go server.Serve()
-	return server.WaitMount()
+	if err := server.WaitMount(); err != nil {
+		return err
+	}
+	fs.fdBudget.Acquire(fuseFDOwner(mountpoint), 1)
+	return nil
+}
+
+// maxChunkFilesPerHandle is the maximum number of cache files kept open by a file
+// handle for serving reads with splice(2). Reads of other chunks are copied.
+const maxChunkFilesPerHandle = 16
+
+// fuseFDOwner is the owner of the FD of the FUSE connection in the FD budget.
+func fuseFDOwner(mountpoint string) string {
+	return "fuse:" + mountpoint
 }
 
-func (fs *filesystem) resolveLayer(ctx context.Context, hosts docker.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) (*layer, error) {
-	name := refspec.String() + "/" + desc.Digest.String()
+func (fs *filesystem) resolveLayer(ctx context.Context, s source.Source, desc ocispec.Descriptor, cacheOpts ...cache.Option) (*layer, error) {
+	name := s.Name.String() + "/" + desc.Digest.String()
 	ctx, cancel := context.WithCancel(log.WithLogger(ctx, log.G(ctx).WithField("src", name)))
 	defer cancel()
 
+	if fs.negativeCache != nil && fs.negativeCache.has(name) {
+		log.G(ctx).Debugf("layer is recorded as non-eStargz")
+		return nil, fmt.Errorf("layer is recorded as non-eStargz")
+	}
+
 	fs.resolveResultMu.Lock()
 	c, ok := fs.resolveResult.Get(name)
 	fs.resolveResultMu.Unlock()
@@ -388,7 +830,7 @@ func (fs *filesystem) resolveLayer(ctx context.Context, hosts docker.RegistryHos
 			blob = c.(remote.Blob)
 		} else {
 			var err error
-			blob, err = fs.resolver.Resolve(ctx, hosts, refspec, desc)
+			blob, err = fs.resolveBlob(ctx, s, desc)
 			if err != nil {
 				log.G(ctx).WithError(err).Debugf("failed to resolve source")
 				return nil, errors.Wrap(err, "failed to resolve the source")
@@ -396,28 +838,121 @@ func (fs *filesystem) resolveLayer(ctx context.Context, hosts docker.RegistryHos
 			fs.blobResultMu.Lock()
 			fs.blobResult.Add(name, blob)
 			fs.blobResultMu.Unlock()
+			fs.addResolvedName(desc.Digest.String(), name)
 		}
 
 		// Get a reader for stargz archive.
 		// Each file's read operation is a prioritized task and all background tasks
 		// will be stopped during the execution so this can avoid being disturbed for
 		// NW traffic by background tasks.
+		// Reads are fetches of the TOC until the layer is resolved and then
+		// on-demand fetches. They have different timeouts.
+		var readFailed int32
+		phase := int32(remote.PhaseTOC)
 		sr := io.NewSectionReader(readerAtFunc(func(p []byte, offset int64) (n int, err error) {
 			fs.backgroundTaskManager.DoPrioritizedTask()
 			defer fs.backgroundTaskManager.DonePrioritizedTask()
-			return blob.ReadAt(p, offset)
+			n, err = blob.ReadAt(p, offset, remote.WithPhase(remote.FetchPhase(atomic.LoadInt32(&phase))))
+			if err != nil && err != io.EOF {
+				atomic.StoreInt32(&readFailed, 1)
+			}
+			return
 		}), 0, blob.Size())
-		vr, root, err := reader.NewReader(sr, fs.fsCache)
+		fsCache := fs.layerCache(desc.Digest, cacheOpts)
+		var readerOpts []reader.Option
+		if st, ok := blob.(remote.Streamer); ok {
+			readerOpts = append(readerOpts, reader.WithStreamer(st.Stream))
+		}
+		// On-demand reads of files abort their fetches when the FUSE requests
+		// are interrupted (e.g. the reading process is killed).
+		readerOpts = append(readerOpts, reader.WithContextReaderAt(func(ctx context.Context, p []byte, offset int64) (n int, err error) {
+			fs.backgroundTaskManager.DoPrioritizedTask()
+			defer fs.backgroundTaskManager.DonePrioritizedTask()
+			return blob.ReadAt(p, offset, remote.WithContext(ctx), remote.WithPhase(remote.PhaseOnDemand))
+		}))
+		fetchLog := newFetchLog()
+		readerOpts = append(readerOpts, reader.WithMissObserver(fetchLog.add), reader.WithHitObserver(fetchLog.addHit))
+		if !fs.disableVerification && !fs.allowNoVerification {
+			// All layers are verified before use so chunks can be shared
+			// among layers by their digests.
+			readerOpts = append(readerOpts, reader.WithContentAddressedChunks())
+		}
+		if fs.chunkQuarantine != nil {
+			readerOpts = append(readerOpts, reader.WithChunkQuarantine(fs.chunkQuarantine))
+		}
+		if ci := fs.chunkIndex; ci != nil {
+			readerOpts = append(readerOpts, reader.WithChunkSource(func(chunkDigest string, p []byte) bool {
+				return ci.read(desc.Digest.String(), chunkDigest, p)
+			}))
+		}
+		var root *estargz.TOCEntry
+		sm, shared, err := fs.metadata.acquire(desc.Digest.String(), func() (vr *reader.VerifiableReader, err error) {
+			vr, root, err = reader.NewReader(sr, fsCache, readerOpts...)
+			return
+		})
 		if err != nil {
 			log.G(ctx).WithError(err).Debugf("failed to resolve: layer cannot be read")
+			if fs.negativeCache != nil && atomic.LoadInt32(&readFailed) == 0 {
+				// The blob was successfully read but it's not eStargz. Remember it
+				// so that following mounts don't pay the same latency again.
+				if err := fs.negativeCache.add(name); err != nil {
+					log.G(ctx).WithError(err).Warn("failed to record non-eStargz layer")
+				}
+			}
 			return nil, errors.Wrap(err, "failed to read layer")
 		}
+		vr := sm.vr
+		if shared {
+			// The same layer has already been resolved (e.g. by another
+			// reference). Reuse the metadata.
+			vr, root, err = reader.NewSharedReader(sm.vr, sr, fsCache, readerOpts...)
+			if err != nil {
+				fs.metadata.release(sm)
+				return nil, errors.Wrap(err, "failed to read layer with shared metadata")
+			}
+			log.G(ctx).Debugf("sharing metadata with other resolution result")
+		}
+		atomic.StoreInt32(&phase, int32(remote.PhaseOnDemand))
+
+		counted := true
+		if err := fs.dedup.add(desc.Digest.String(), vr); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to count chunks of layer")
+			counted = false
+		}
+		if fs.pins != nil {
+			fs.pins.apply(desc.Digest.String(), vr)
+		}
 
 		// Combine layer information together
 		l := newLayer(desc, blob, vr, root, fs.prefetchTimeout)
+		indexed := false
+		if ci := fs.chunkIndex; ci != nil {
+			if err := ci.add(desc.Digest.String(), blob, vr); err != nil {
+				log.G(ctx).WithError(err).Warn("failed to index chunks of layer")
+			} else {
+				indexed = true
+			}
+		}
+		l.onRelease = func() {
+			fs.metadata.release(sm)
+			if counted {
+				fs.dedup.remove(desc.Digest.String())
+			}
+			if indexed {
+				fs.chunkIndex.remove(desc.Digest.String())
+			}
+		}
+		l.fetchLog = fetchLog
+		if fs.deltaPrefetch {
+			// Chunks of the prefetch target are compared with this cache.
+			l.deltaCache, l.deltaStats = fsCache, &fs.deltaStats
+		}
+		l.acquire()
 		fs.resolveResultMu.Lock()
+		fs.resolveResult.Remove(name) // releases the old result, if any
 		fs.resolveResult.Add(name, l)
 		fs.resolveResultMu.Unlock()
+		fs.memGuard.enforce(ctx)
 
 		log.G(ctx).Debugf("resolved")
 		return l, nil
@@ -426,7 +961,7 @@ func (fs *filesystem) resolveLayer(ctx context.Context, hosts docker.RegistryHos
 	var res singleflight.Result
 	select {
 	case res = <-resultChan:
-	case <-time.After(30 * time.Second):
+	case <-time.After(fs.mountTimeout):
 		fs.resolveG.Forget(name)
 		return nil, fmt.Errorf("failed to resolve layer (timeout)")
 	}
@@ -437,6 +972,8 @@ func (fs *filesystem) resolveLayer(ctx context.Context, hosts docker.RegistryHos
 }
 
 func (fs *filesystem) Check(ctx context.Context, mountpoint string, labels map[string]string) error {
+	labels = fs.labelFilter.Filter(labels)
+
 	// This is a prioritized task and all background tasks will be stopped
 	// execution so this can avoid being disturbed for NW traffic by background
 	// tasks.
@@ -446,9 +983,17 @@ func (fs *filesystem) Check(ctx context.Context, mountpoint string, labels map[s
 	ctx = log.WithLogger(ctx, log.G(ctx).WithField("mountpoint", mountpoint))
 
 	fs.layerMu.Lock()
-	l := fs.layer[mountpoint]
+	l, pl := fs.layer[mountpoint], fs.pending[mountpoint]
 	fs.layerMu.Unlock()
 	if l == nil {
+		if pl != nil {
+			// The layer is being prepared in background.
+			if err := pl.failed(); err != nil {
+				log.G(ctx).WithError(err).Warn("layer isn't available")
+				return err
+			}
+			return nil
+		}
 		log.G(ctx).Debug("layer not registered")
 		return fmt.Errorf("layer not registered")
 	}
@@ -456,8 +1001,12 @@ func (fs *filesystem) Check(ctx context.Context, mountpoint string, labels map[s
 	// Check the blob connectivity and try to refresh the connection on failure
 	if err := fs.check(ctx, l, labels); err != nil {
 		log.G(ctx).WithError(err).Warn("check failed")
+		if atomic.CompareAndSwapInt32(&l.degraded, 0, 1) {
+			fs.emit(ctx, layerEvent(EventDegraded, mountpoint, l, "", err))
+		}
 		return err
 	}
+	atomic.StoreInt32(&l.degraded, 0)
 
 	// Wait for prefetch compeletion
 	if !fs.noprefetch {
@@ -469,6 +1018,28 @@ func (fs *filesystem) Check(ctx context.Context, mountpoint string, labels map[s
 	return nil
 }
 
+// setQoSClass applies the QoS class specified by the labels to the blob.
+func setQoSClass(ctx context.Context, blob remote.Blob, labels map[string]string) {
+	qb, ok := blob.(remote.QoSBlob)
+	if !ok {
+		return
+	}
+	class, err := remote.ParseQoSClass(labels[config.TargetQoSClassLabel])
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("invalid QoS class; using the default")
+	}
+	qb.SetQoSClass(class)
+}
+
+// resolveBlob resolves the blob from the fetcher of the source if provided,
+// or from the registries otherwise.
+func (fs *filesystem) resolveBlob(ctx context.Context, s source.Source, desc ocispec.Descriptor) (remote.Blob, error) {
+	if s.Fetcher != nil {
+		return fs.resolver.ResolveFetcher(ctx, s.Fetcher, desc)
+	}
+	return fs.resolver.Resolve(ctx, s.Hosts, s.Name, desc)
+}
+
 func (fs *filesystem) check(ctx context.Context, l *layer, labels map[string]string) error {
 	err := l.blob.Check()
 	if err == nil {
@@ -488,6 +1059,10 @@ func (fs *filesystem) check(ctx context.Context, l *layer, labels map[string]str
 	for retry := 0; retry < retrynum; retry++ {
 		log.G(ctx).Warnf("refreshing(%d)...", retry)
 		for _, s := range src {
+			if s.Fetcher != nil {
+				// Blobs fetched by source providers are refreshed by their Check.
+				continue
+			}
 			err := l.blob.Refresh(ctx, s.Hosts, s.Name, s.Target)
 			if err == nil {
 				log.G(ctx).Debug("Successfully refreshed connection")
@@ -503,19 +1078,151 @@ func (fs *filesystem) check(ctx context.Context, l *layer, labels map[string]str
 	return rErr
 }
 
+// PrepareVolume applies the prefetch policy of image volumes to the layer
+// mounted on the mountpoint. The snapshotter calls this when the layer is used
+// by a read-only view, which is how containerd mounts image volumes. This is
+// done once per layer and the contents are prefetched in background.
+func (fs *filesystem) PrepareVolume(ctx context.Context, mountpoint string) error {
+	fs.layerMu.Lock()
+	l, pl := fs.layer[mountpoint], fs.pending[mountpoint]
+	fs.layerMu.Unlock()
+	if l == nil {
+		if pl != nil {
+			return nil // the layer is being prepared in background
+		}
+		return fmt.Errorf("layer not registered")
+	}
+	if fs.noprefetch || l.isMaterialized() || !atomic.CompareAndSwapInt32(&l.volume, 0, 1) {
+		return nil
+	}
+	ctx = log.WithLogger(ctx, log.G(ctx).WithField("mountpoint", mountpoint))
+	go func() {
+		fs.backgroundTaskManager.DoPrioritizedTask()
+		defer fs.backgroundTaskManager.DonePrioritizedTask()
+		var cacheOpts []cache.Option
+		if fs.prefetchPageCache {
+			cacheOpts = append(cacheOpts, cache.WillNeed())
+		}
+		if err := l.prefetchVolume(fs.volumePrefetchSize, cacheOpts...); err != nil {
+			log.G(ctx).WithError(err).Debug("failed to prefetch layer for image volume")
+			return
+		}
+		log.G(ctx).Debug("completed to prefetch layer for image volume")
+	}()
+	return nil
+}
+
+// Materialize fetches all remaining contents of the layer mounted on the
+// specified mountpoint and pins them in the cache so that they are never
+// evicted. The materialized state is persisted in the pin store and restored on
+// the next mount of the layer.
+func (fs *filesystem) Materialize(ctx context.Context, mountpoint string) error {
+	if fs.pins == nil {
+		return errors.Wrapf(errdefs.ErrNotImplemented, "filesystem cache doesn't support pinning")
+	}
+
+	// This is a prioritized task and all background tasks will be stopped
+	// execution so this can avoid being disturbed for NW traffic by background
+	// tasks.
+	fs.backgroundTaskManager.DoPrioritizedTask()
+	defer fs.backgroundTaskManager.DonePrioritizedTask()
+	ctx = log.WithLogger(ctx, log.G(ctx).WithField("mountpoint", mountpoint))
+
+	fs.layerMu.Lock()
+	l, ref := fs.layer[mountpoint], fs.mountRefs[mountpoint]
+	fs.layerMu.Unlock()
+	if l == nil {
+		return fmt.Errorf("layer not registered")
+	}
+	if l.isMaterialized() {
+		return nil
+	}
+	lr, err := l.reader()
+	if err != nil {
+		return err
+	}
+	if err := l.blob.Cache(0, l.blob.Size()); err != nil {
+		return errors.Wrap(err, "failed to fetch layer")
+	}
+	if err := lr.Cache(); err != nil {
+		return errors.Wrap(err, "failed to cache layer contents")
+	}
+	dgst := l.desc.Digest.String()
+	if err := fs.pins.materialize(ref, dgst); err != nil {
+		return errors.Wrap(err, "failed to record materialized layer")
+	}
+	fs.pins.apply(dgst, l.verifiableReader)
+	l.materialize()
+	log.G(ctx).Debug("materialized layer")
+	return nil
+}
+
+// mountedLayers returns a copy of the layers mounted on this filesystem.
+func (fs *filesystem) mountedLayers() map[string]*layer {
+	fs.layerMu.Lock()
+	defer fs.layerMu.Unlock()
+	res := make(map[string]*layer, len(fs.layer))
+	for mp, l := range fs.layer {
+		res[mp] = l
+	}
+	return res
+}
+
 func (fs *filesystem) Unmount(ctx context.Context, mountpoint string) error {
 	fs.layerMu.Lock()
-	if _, ok := fs.layer[mountpoint]; !ok {
+	l, ok := fs.layer[mountpoint]
+	_, pending := fs.pending[mountpoint]
+	dataDir, dataOnly := fs.dataDirs[mountpoint]
+	dev, hasDev := fs.blockDevs[mountpoint]
+	if !ok && !pending {
 		fs.layerMu.Unlock()
 		return fmt.Errorf("specified path %q isn't a mountpoint", mountpoint)
 	}
 	delete(fs.layer, mountpoint) // unregisters the corresponding layer
+	delete(fs.mountRefs, mountpoint)
+	delete(fs.pending, mountpoint)
+	delete(fs.dataDirs, mountpoint)
+	delete(fs.blockDevs, mountpoint)
 	fs.layerMu.Unlock()
+	fs.unmountMergedViews(ctx, mountpoint)
+	fs.fdBudget.Release(fuseFDOwner(mountpoint), 1)
+	if dataOnly {
+		fs.fdBudget.Release(fuseFDOwner(dataDir), 1)
+	}
+	if hasDev {
+		if err := dev.Close(); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to remove block device %q", dev.Path())
+		}
+	}
+	if ok {
+		l.release()
+	}
+	if fs.hinter != nil {
+		fs.hinter.stop(ctx, mountpoint)
+	}
+	if fs.tagPins != nil {
+		fs.tagPins.remove(mountpoint)
+	}
+	if fs.audit != nil {
+		fs.audit.unregister(mountpoint)
+	}
+	if ok && fs.predictor != nil {
+		fs.predictor.forget(ctx, mountpoint, l)
+	}
+	if fs.scanner != nil {
+		fs.scanner.forget(mountpoint)
+	}
 	// The goroutine which serving the mountpoint possibly becomes not responding.
 	// In case of such situations, we use MNT_FORCE here and abort the connection.
 	// In the future, we might be able to consider to kill that specific hanging
 	// goroutine using channel, etc.
 	// See also: https://www.kernel.org/doc/html/latest/filesystems/fuse.html#aborting-a-filesystem-connection
+	if dataOnly {
+		if err := syscall.Unmount(dataDir, syscall.MNT_FORCE); err != nil {
+			return err
+		}
+		return fs.unmountMetadata(mountpoint)
+	}
 	return syscall.Unmount(mountpoint, syscall.MNT_FORCE)
 }
 
@@ -527,6 +1234,7 @@ func newLayer(desc ocispec.Descriptor, blob remote.Blob, vr *reader.VerifiableRe
 		root:             root,
 		prefetchWaiter:   newWaiter(),
 		prefetchTimeout:  prefetchTimeout,
+		progress:         &layerProgress{blob: blob},
 	}
 }
 
@@ -538,6 +1246,17 @@ type layer struct {
 	prefetchWaiter   *waiter
 	prefetchTimeout  time.Duration
 	r                reader.Reader
+	progress         *layerProgress
+	fetchLog         *fetchLog
+	materialized     bool
+	materializedMu   sync.Mutex
+	volume           int32 // 1 if prefetched for image volumes; accessed atomically
+	degraded         int32 // 1 if the last check failed; accessed atomically
+	deltaCache       cache.BlobCache
+	deltaStats       *deltaStats
+	refcnt           int32
+	onRelease        func()
+	releaseOnce      sync.Once
 }
 
 func (l *layer) reader() (reader.Reader, error) {
@@ -556,39 +1275,134 @@ func (l *layer) verify(tocDigest digest.Digest) (err error) {
 	return
 }
 
-func (l *layer) prefetch(prefetchSize int64) error {
+func (l *layer) materialize() {
+	l.materializedMu.Lock()
+	l.materialized = true
+	l.materializedMu.Unlock()
+}
+
+func (l *layer) unmaterialize() {
+	l.materializedMu.Lock()
+	l.materialized = false
+	l.materializedMu.Unlock()
+}
+
+func (l *layer) isMaterialized() bool {
+	l.materializedMu.Lock()
+	defer l.materializedMu.Unlock()
+	return l.materialized
+}
+
+// prefetch fetches the prefetch target of the layer and stores it to the
+// filesystem cache with the specified options. If useLandmarks is false,
+// prefetch landmarks in the layer are ignored. If the layer has the landmark of
+// the named prefetch profile, the files of the profile are the target.
+func (l *layer) prefetch(prefetchSize int64, useLandmarks bool, profile string, cacheOpts ...cache.Option) error {
 	defer l.prefetchWaiter.done() // Notify the completion
 
 	lr, err := l.reader()
 	if err != nil {
 		return err
 	}
-	if _, ok := lr.Lookup(estargz.NoPrefetchLandmark); ok {
+	if profile != "" && useLandmarks {
+		if e, ok := lr.Lookup(estargz.PrefetchProfileLandmark(profile)); ok {
+			return l.prefetchProfile(lr, e, cacheOpts...)
+		}
+	}
+	if _, ok := lr.Lookup(estargz.NoPrefetchLandmark); ok && useLandmarks {
 		// do not prefetch this layer
 		return nil
-	} else if e, ok := lr.Lookup(estargz.PrefetchLandmark); ok {
+	} else if e, ok := lr.Lookup(estargz.PrefetchLandmark); ok && useLandmarks {
 		// override the prefetch size with optimized value
 		prefetchSize = e.Offset
 	} else if prefetchSize > l.blob.Size() {
 		// adjust prefetch size not to exceed the whole layer size
 		prefetchSize = l.blob.Size()
 	}
+	if l.deltaCache != nil {
+		d, err := computeDelta(l.verifiableReader, l.deltaCache, prefetchSize)
+		if err == nil && d.cachedChunks > 0 {
+			// The layer shares chunks with cached layers (e.g. the previous
+			// version of the image). Fetch only the new chunks instead of
+			// the whole range.
+			l.progress.startPrefetch(d.size - d.cachedSize)
+			if err := lr.Cache(reader.WithFilter(func(e *estargz.TOCEntry) bool {
+				return e.Offset < prefetchSize
+			}), reader.WithCacheOpts(cacheOpts...)); err != nil {
+				return errors.Wrap(err, "failed to prefetch delta of layer")
+			}
+			l.progress.donePrefetch()
+			l.deltaStats.add(d)
+			return nil
+		}
+	}
+	l.progress.startPrefetch(prefetchSize)
 
 	// Fetch the target range
-	if err := l.blob.Cache(0, prefetchSize); err != nil {
+	if err := l.blob.Cache(0, prefetchSize, remote.WithPhase(remote.PhasePrefetch)); err != nil {
 		return errors.Wrap(err, "failed to prefetch layer")
 	}
+	l.progress.donePrefetch()
 
 	// Cache uncompressed contents of the prefetched range
 	if err := lr.Cache(reader.WithFilter(func(e *estargz.TOCEntry) bool {
 		return e.Offset < prefetchSize // Cache only prefetch target
-	})); err != nil {
+	}), reader.WithCacheOpts(cacheOpts...)); err != nil {
 		return errors.Wrap(err, "failed to cache prefetched layer")
 	}
 
 	return nil
 }
 
+// prefetchProfile fetches the files listed by the landmark of a prefetch
+// profile and stores them to the filesystem cache.
+func (l *layer) prefetchProfile(lr reader.Reader, landmark *estargz.TOCEntry, cacheOpts ...cache.Option) error {
+	ra, err := lr.OpenFile(landmark.Name)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open landmark %q", landmark.Name)
+	}
+	b := make([]byte, landmark.Size)
+	if _, err := ra.ReadAt(b, 0); err != nil && err != io.EOF {
+		return errors.Wrapf(err, "failed to read landmark %q", landmark.Name)
+	}
+	files := make(map[string]struct{})
+	var size int64
+	for _, name := range strings.Split(string(b), "\n") {
+		if e, ok := lr.Lookup(name); ok && e.Type == "reg" {
+			files[e.Name] = struct{}{}
+			size += e.Size
+		}
+	}
+	l.progress.startPrefetch(size)
+	if err := lr.Cache(reader.WithFilter(func(e *estargz.TOCEntry) bool {
+		_, ok := files[e.Name]
+		return ok
+	}), reader.WithCacheOpts(cacheOpts...)); err != nil {
+		return errors.Wrap(err, "failed to prefetch files of profile")
+	}
+	l.progress.donePrefetch()
+	return nil
+}
+
+// prefetchVolume fetches the range of the layer from the top for image volumes
+// and stores it to the filesystem cache. Unlike prefetch, this doesn't notify
+// the prefetch completion, which has been notified on mount.
+func (l *layer) prefetchVolume(prefetchSize int64, cacheOpts ...cache.Option) error {
+	lr, err := l.reader()
+	if err != nil {
+		return err
+	}
+	if prefetchSize > l.blob.Size() {
+		prefetchSize = l.blob.Size()
+	}
+	if err := l.blob.Cache(0, prefetchSize); err != nil {
+		return errors.Wrap(err, "failed to prefetch layer")
+	}
+	return lr.Cache(reader.WithFilter(func(e *estargz.TOCEntry) bool {
+		return e.Offset < prefetchSize
+	}), reader.WithCacheOpts(cacheOpts...))
+}
+
 func (l *layer) waitForPrefetchCompletion() error {
 	return l.prefetchWaiter.wait(l.prefetchTimeout)
 }
@@ -641,6 +1455,168 @@ func (w *waiter) wait(timeout time.Duration) error {
 	}
 }
 
+// LayerProgress is the fetch progress of a layer mounted on a mountpoint.
+type LayerProgress struct {
+	Mountpoint        string  `json:"mountpoint"`
+	Digest            string  `json:"digest"`
+	Size              int64   `json:"size"`
+	FetchedSize       int64   `json:"fetchedSize"`
+	FetchedPercent    float64 `json:"fetchedPercent"` // FetchedSize / Size * 100.0
+	PrefetchSize      int64   `json:"prefetchSize"`
+	PrefetchedSize    int64   `json:"prefetchedSize"`
+	PrefetchedPercent float64 `json:"prefetchedPercent"` // PrefetchedSize / PrefetchSize * 100.0
+	Materialized      bool    `json:"materialized"`
+	BlockDevice       string  `json:"blockDevice,omitempty"`
+}
+
+// ProgressReporter reports the fetch progress of each mounted layer. The
+// filesystem returned by NewFilesystem implements this interface.
+type ProgressReporter interface {
+	Progress(ctx context.Context) []LayerProgress
+}
+
+var _ = (ProgressReporter)((*filesystem)(nil))
+
+// Progress returns the fetch progress of all layers mounted on this filesystem.
+func (fs *filesystem) Progress(ctx context.Context) (res []LayerProgress) {
+	fs.layerMu.Lock()
+	defer fs.layerMu.Unlock()
+	for mp, l := range fs.layer {
+		p := l.progress.get()
+		p.Mountpoint = mp
+		p.Digest = l.desc.Digest.String()
+		p.Materialized = l.isMaterialized()
+		if dev, ok := fs.blockDevs[mp]; ok {
+			p.BlockDevice = dev.Path()
+		}
+		res = append(res, p)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Mountpoint < res[j].Mountpoint })
+	return
+}
+
+// layerProgress tracks prefetch and background fetch progress of a layer.
+type layerProgress struct {
+	blob           remote.Blob
+	prefetchSize   int64
+	prefetchedDone bool
+	finished       bool  // prefetch returned
+	prefetchErr    error // error returned by prefetch
+	mu             sync.Mutex
+}
+
+func (lp *layerProgress) startPrefetch(size int64) {
+	lp.mu.Lock()
+	lp.prefetchSize = size
+	lp.mu.Unlock()
+}
+
+func (lp *layerProgress) donePrefetch() {
+	lp.mu.Lock()
+	lp.prefetchedDone = true
+	lp.mu.Unlock()
+}
+
+// finishPrefetch records the completion of the whole prefetch including caching
+// the uncompressed contents.
+func (lp *layerProgress) finishPrefetch(err error) {
+	lp.mu.Lock()
+	lp.finished, lp.prefetchErr = true, err
+	lp.mu.Unlock()
+}
+
+func (lp *layerProgress) prefetchResult() (finished bool, err error) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	return lp.finished, lp.prefetchErr
+}
+
+func (lp *layerProgress) get() (p LayerProgress) {
+	p.Size = lp.blob.Size()
+	p.FetchedSize = lp.blob.FetchedSize()
+	if p.Size > 0 {
+		p.FetchedPercent = float64(p.FetchedSize) / float64(p.Size) * 100.0
+	}
+	lp.mu.Lock()
+	p.PrefetchSize = lp.prefetchSize
+	if lp.prefetchedDone {
+		p.PrefetchedSize = lp.prefetchSize
+	} else {
+		// Prefetch reads the layer from the head so the fetched size approximates
+		// the progress until the completion.
+		p.PrefetchedSize = p.FetchedSize
+		if p.PrefetchedSize > p.PrefetchSize {
+			p.PrefetchedSize = p.PrefetchSize
+		}
+	}
+	lp.mu.Unlock()
+	if p.PrefetchSize > 0 {
+		p.PrefetchedPercent = float64(p.PrefetchedSize) / float64(p.PrefetchSize) * 100.0
+	}
+	return
+}
+
+// FDReporter reports the file descriptors held by the filesystem. The
+// filesystem returned by NewFilesystem implements this interface.
+type FDReporter interface {
+	FDStats(ctx context.Context) fdbudget.Stats
+}
+
+var _ = (FDReporter)((*filesystem)(nil))
+
+// FDStats returns the file descriptors held by cache files and FUSE connections
+// per owner (layers and mountpoints).
+func (fs *filesystem) FDStats(ctx context.Context) fdbudget.Stats {
+	return fs.fdBudget.Stats()
+}
+
+// cacheWithOpts applies the options to all Add operations on the underlying
+// cache. This is used for applying per-image cache settings. fetchOpts are
+// applied to FetchAt operations.
+type cacheWithOpts struct {
+	cache.BlobCache
+	opts      []cache.Option
+	fetchOpts []cache.Option
+}
+
+func (c *cacheWithOpts) Add(key string, p []byte, opts ...cache.Option) {
+	c.BlobCache.Add(key, p, append(append([]cache.Option{}, c.opts...), opts...)...)
+}
+
+func (c *cacheWithOpts) FetchAt(key string, offset int64, p []byte, opts ...cache.Option) (int, error) {
+	return c.BlobCache.FetchAt(key, offset, p, append(append([]cache.Option{}, c.fetchOpts...), opts...)...)
+}
+
+// OpenFile opens the file of the underlying cache if it stores contents in
+// files.
+func (c *cacheWithOpts) OpenFile(key string) (*os.File, error) {
+	fo, ok := c.BlobCache.(cache.FileOpener)
+	if !ok {
+		return nil, fmt.Errorf("cache doesn't store contents in files")
+	}
+	return fo.OpenFile(key)
+}
+
+// Remove removes the contents from the underlying cache if it supports removal.
+func (c *cacheWithOpts) Remove(key string) error {
+	r, ok := c.BlobCache.(cache.Remover)
+	if !ok {
+		return fmt.Errorf("cache doesn't support removal")
+	}
+	return r.Remove(key)
+}
+
+// layerCache returns the filesystem cache for the layer. File handles kept open
+// by the cache are accounted to the layer in the FD budget.
+func (fs *filesystem) layerCache(dgst digest.Digest, cacheOpts []cache.Option) cache.BlobCache {
+	owner := cache.Owner("layer:" + dgst.String())
+	return &cacheWithOpts{
+		BlobCache: fs.fsCache,
+		opts:      append(append([]cache.Option{}, cacheOpts...), owner),
+		fetchOpts: []cache.Option{owner},
+	}
+}
+
 type readerAtFunc func([]byte, int64) (int, error)
 
 func (f readerAtFunc) ReadAt(p []byte, offset int64) (int, error) { return f(p, offset) }
@@ -658,6 +1634,19 @@ type node struct {
 	s      *state
 	root   string
 	opaque bool // true if this node is an overlayfs opaque directory
+
+	// openFlags is the FUSE flags returned on opening this node (e.g.
+	// FOPEN_KEEP_CACHE).
+	openFlags uint32
+
+	// streamThreshold is the size of files from which sequential reads are
+	// served by streams of the blob. Zero disables streaming.
+	streamThreshold int64
+
+	// pending is non-nil if this is the root node of a layer which is being
+	// resolved in background.
+	pending   *pendingLayer
+	readyOnce sync.Once
 }
 
 var _ = (fusefs.InodeEmbedder)((*node)(nil))
@@ -665,13 +1654,17 @@ var _ = (fusefs.InodeEmbedder)((*node)(nil))
 var _ = (fusefs.NodeReaddirer)((*node)(nil))
 
 func (n *node) Readdir(ctx context.Context) (fusefs.DirStream, syscall.Errno) {
+	defer n.trace("readdir", "")()
+	if errno := n.ready(); errno != 0 {
+		return nil, errno
+	}
 	var ents []fuse.DirEntry
 	whiteouts := map[string]*estargz.TOCEntry{}
 	normalEnts := map[string]bool{}
 	n.e.ForeachChild(func(baseName string, ent *estargz.TOCEntry) bool {
 
 		// We don't want to show prefetch landmarks in "/".
-		if n.e.Name == "" && (baseName == estargz.PrefetchLandmark || baseName == estargz.NoPrefetchLandmark) {
+		if n.e.Name == "" && estargz.IsLandmark(baseName) {
 			return true
 		}
 
@@ -706,6 +1699,9 @@ func (n *node) Readdir(ctx context.Context) (fusefs.DirStream, syscall.Errno) {
 
 		}
 	}
+	if n.fs != nil && n.fs.scanner != nil {
+		n.fs.scanner.readdir(n.root, n.e)
+	}
 
 	return fusefs.NewListDirStream(ents), 0
 }
@@ -713,8 +1709,12 @@ func (n *node) Readdir(ctx context.Context) (fusefs.DirStream, syscall.Errno) {
 var _ = (fusefs.NodeLookuper)((*node)(nil))
 
 func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	defer n.trace("lookup", name)()
+	if errno := n.ready(); errno != 0 {
+		return nil, errno
+	}
 	// We don't want to show prefetch landmarks in "/".
-	if n.e.Name == "" && (name == estargz.PrefetchLandmark || name == estargz.NoPrefetchLandmark) {
+	if n.e.Name == "" && estargz.IsLandmark(name) {
 		return nil, syscall.ENOENT
 	}
 
@@ -728,6 +1728,10 @@ func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fu
 		return n.NewInode(ctx, n.s, stateToAttr(n.s, &out.Attr)), 0
 	}
 
+	if n.fs != nil && n.fs.scanner != nil {
+		n.fs.scanner.lookup(n.root, n.e)
+	}
+
 	// lookup stargz TOCEntry
 	ce, ok := n.e.LookupChild(name)
 	if !ok {
@@ -745,48 +1749,72 @@ func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fu
 		opaque = true
 	}
 
+	attr := entryToAttr(ce, &out.Attr)
+	n.atimes().setATime(ce, &out.Attr)
 	return n.NewInode(ctx, &node{
-		fs:     n.fs,
-		layer:  n.layer,
-		e:      ce,
-		s:      n.s,
-		root:   n.root,
-		opaque: opaque,
-	}, entryToAttr(ce, &out.Attr)), 0
+		fs:              n.fs,
+		layer:           n.layer,
+		e:               ce,
+		s:               n.s,
+		root:            n.root,
+		opaque:          opaque,
+		openFlags:       n.openFlags,
+		streamThreshold: n.streamThreshold,
+	}, attr), 0
 }
 
 var _ = (fusefs.NodeOpener)((*node)(nil))
 
 func (n *node) Open(ctx context.Context, flags uint32) (fh fusefs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	defer n.trace("open", "")()
+	if errno = n.ready(); errno != 0 {
+		return nil, 0, errno
+	}
 	ra, err := n.layer.OpenFile(n.e.Name)
 	if err != nil {
 		n.s.report(fmt.Errorf("failed to open node: %v", err))
 		return nil, 0, syscall.EIO
 	}
+	if n.fs != nil && n.fs.predictor != nil {
+		n.fs.predictor.observe(n.root, n.e.Name)
+	}
 	return &file{
 		n:  n,
 		e:  n.e,
 		ra: ra,
-	}, 0, 0
+	}, n.openFlags, 0
 }
 
 var _ = (fusefs.NodeGetattrer)((*node)(nil))
 
 func (n *node) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	defer n.trace("getattr", "")()
+	if errno := n.ready(); errno != 0 {
+		return errno
+	}
 	entryToAttr(n.e, &out.Attr)
+	n.atimes().setATime(n.e, &out.Attr)
 	return 0
 }
 
 var _ = (fusefs.NodeGetxattrer)((*node)(nil))
 
 func (n *node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
-	if attr == opaqueXattr && n.opaque {
+	defer n.trace("getxattr", "")()
+	if errno := n.ready(); errno != 0 {
+		return 0, errno
+	}
+	if n.opaque && n.isOpaqueXattr(attr) {
 		// This node is an opaque directory so give overlayfs-compliant indicator.
 		if len(dest) < len(opaqueXattrValue) {
 			return uint32(len(opaqueXattrValue)), syscall.ERANGE
 		}
 		return uint32(copy(dest, opaqueXattrValue)), 0
 	}
+	if isOverlayXattr(attr) {
+		// Layers must not control overlayfs (e.g. redirects and metacopy).
+		return 0, syscall.ENODATA
+	}
 	if v, ok := n.e.Xattrs[attr]; ok {
 		if len(dest) < len(v) {
 			return uint32(len(v)), syscall.ERANGE
@@ -799,12 +1827,21 @@ func (n *node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32,
 var _ = (fusefs.NodeListxattrer)((*node)(nil))
 
 func (n *node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	defer n.trace("listxattr", "")()
+	if errno := n.ready(); errno != 0 {
+		return 0, errno
+	}
 	var attrs []byte
 	if n.opaque {
 		// This node is an opaque directory so add overlayfs-compliant indicator.
-		attrs = append(attrs, []byte(opaqueXattr+"\x00")...)
+		for _, x := range n.opaqueXattrs() {
+			attrs = append(attrs, []byte(x+"\x00")...)
+		}
 	}
 	for k := range n.e.Xattrs {
+		if isOverlayXattr(k) {
+			continue
+		}
 		attrs = append(attrs, []byte(k+"\x00")...)
 	}
 	if len(dest) < len(attrs) {
@@ -813,9 +1850,58 @@ func (n *node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errn
 	return uint32(copy(dest, attrs)), 0
 }
 
+// opaqueXattrs returns the xattrs indicating opaque directories to overlayfs.
+func (n *node) opaqueXattrs() []string {
+	if n.fs == nil || len(n.fs.opaqueXattrs) == 0 {
+		return []string{opaqueXattr}
+	}
+	return n.fs.opaqueXattrs
+}
+
+func (n *node) isOpaqueXattr(attr string) bool {
+	for _, x := range n.opaqueXattrs() {
+		if x == attr {
+			return true
+		}
+	}
+	return false
+}
+
+// isOverlayXattr returns true if the xattr is private to overlayfs. overlayfs
+// stacked on the layers interprets these xattrs of lower layers (e.g.
+// "redirect" with redirect_dir and "metacopy" with metacopy) so the ones
+// recorded in layers are hidden. Opaque directories are indicated by whiteouts
+// instead.
+func isOverlayXattr(attr string) bool {
+	return strings.HasPrefix(attr, overlayXattrs) || strings.HasPrefix(attr, userOverlayXattrs)
+}
+
+// opaqueXattrsOf returns the xattrs indicating opaque directories for the
+// OverlayOpaqueType config. By default, overlayfs in user namespaces reads
+// user.overlay.* xattrs ("userxattr" mount option) because trusted.* xattrs
+// aren't available there.
+func opaqueXattrsOf(typ string, inUserNS bool) []string {
+	switch typ {
+	case config.OverlayOpaqueUser:
+		return []string{userOpaqueXattr}
+	case config.OverlayOpaqueAll:
+		return []string{opaqueXattr, userOpaqueXattr}
+	case config.OverlayOpaqueTrusted:
+		return []string{opaqueXattr}
+	}
+	if inUserNS {
+		return []string{userOpaqueXattr}
+	}
+	return []string{opaqueXattr}
+}
+
 var _ = (fusefs.NodeReadlinker)((*node)(nil))
 
 func (n *node) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	defer n.trace("readlink", "")()
+	if errno := n.ready(); errno != 0 {
+		return nil, errno
+	}
 	return []byte(n.e.LinkName), 0
 }
 
@@ -831,26 +1917,211 @@ type file struct {
 	n  *node
 	e  *estargz.TOCEntry
 	ra io.ReaderAt
+
+	// chunkFiles are cache files of chunks opened for serving reads with
+	// splice(2). They are kept open until the file is released because the
+	// replies refer to them after Read returns.
+	chunkFiles   map[string]*os.File
+	chunkFilesMu sync.Mutex
+
+	// stream serves sequential reads of a large file from streamOffset.
+	// nextOffset is the end of the last read.
+	stream       io.ReadCloser
+	streamOffset int64
+	nextOffset   int64
+	streamMu     sync.Mutex
+
+	// accessOnce records the first read of this open file for updating the
+	// access time.
+	accessOnce sync.Once
 }
 
 var _ = (fusefs.FileReader)((*file)(nil))
 
 func (f *file) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
-	n, err := f.ra.ReadAt(dest, off)
+	defer f.n.trace("read", "")()
+	f.accessOnce.Do(func() { f.n.atimes().accessed(f.e) })
+	f.audit(off, len(dest))
+	if res, ok := f.readStream(ctx, dest, off); ok {
+		return res, 0
+	}
+	if res, ok := f.readCachedChunk(dest, off); ok {
+		return res, 0
+	}
+	var (
+		n   int
+		err error
+	)
+	if cf, ok := f.ra.(reader.ContextFile); ok {
+		n, err = cf.ReadAtContext(ctx, dest, off)
+	} else {
+		n, err = f.ra.ReadAt(dest, off)
+	}
 	if err != nil && err != io.EOF {
+		if ctx.Err() != nil {
+			// The request is interrupted and the fetch is aborted.
+			return nil, syscall.EINTR
+		}
 		f.n.s.report(fmt.Errorf("failed to read node: %v", err))
 		return nil, syscall.EIO
 	}
 	return fuse.ReadResultData(dest[:n]), 0
 }
 
+// readStream serves the read from the stream of the file if the file is large
+// enough and the read is at the position of the stream. The stream is (re)opened
+// on a read continuing the previous one, except the first read of the file, so
+// random reads are served by chunks as usual. If the stream fails, the read
+// falls back to ReadAt.
+func (f *file) readStream(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, bool) {
+	threshold := f.n.streamThreshold
+	if threshold <= 0 || f.e.Size < threshold || off >= f.e.Size {
+		return nil, false
+	}
+	sf, ok := f.ra.(reader.StreamFile)
+	if !ok {
+		return nil, false
+	}
+	f.streamMu.Lock()
+	defer f.streamMu.Unlock()
+	sequential := off != 0 && off == f.nextOffset
+	size := len(dest)
+	if remain := f.e.Size - off; int64(size) > remain {
+		size = int(remain)
+	}
+	f.nextOffset = off + int64(size)
+	if f.stream == nil || off != f.streamOffset {
+		if !sequential {
+			return nil, false
+		}
+		f.closeStream()
+		// The stream isn't bound to the request because it's kept across reads.
+		s, err := sf.OpenStream(context.Background(), off)
+		if err != nil {
+			log.G(ctx).WithError(err).Debugf("failed to open stream of %q", f.e.Name)
+			return nil, false
+		}
+		f.stream, f.streamOffset = s, off
+	}
+	if _, err := io.ReadFull(f.stream, dest[:size]); err != nil {
+		log.G(ctx).WithError(err).Debugf("failed to read stream of %q", f.e.Name)
+		f.closeStream()
+		return nil, false
+	}
+	f.streamOffset += int64(size)
+	return fuse.ReadResultData(dest[:size]), true
+}
+
+// closeStream closes the stream if open. f.streamMu must be held.
+func (f *file) closeStream() {
+	if f.stream != nil {
+		f.stream.Close()
+		f.stream = nil
+	}
+}
+
+// readCachedChunk serves the read from the cache file of the chunk with
+// go-fuse's file descriptor result, which splices the region of the file to
+// the FUSE connection without copying it through the user space. This is
+// possible only when the region fits in a chunk already stored in a plain
+// cache file. Otherwise, the read falls back to ReadAt.
+func (f *file) readCachedChunk(dest []byte, off int64) (fuse.ReadResult, bool) {
+	if f.n.fs == nil || !f.n.fs.zeroCopyRead || off >= f.e.Size {
+		return nil, false
+	}
+	cf, ok := f.ra.(reader.ChunkFile)
+	if !ok {
+		return nil, false
+	}
+	key, fileOffset, n, ok := cf.CachedChunk(off, len(dest))
+	if !ok {
+		return nil, false
+	}
+	f.chunkFilesMu.Lock()
+	defer f.chunkFilesMu.Unlock()
+	cached, ok := f.chunkFiles[key]
+	if !ok {
+		if len(f.chunkFiles) >= maxChunkFilesPerHandle {
+			return nil, false
+		}
+		var err error
+		if cached, err = cf.OpenCachedChunk(key); err != nil {
+			return nil, false // not cached yet
+		}
+		if f.chunkFiles == nil {
+			f.chunkFiles = make(map[string]*os.File)
+		}
+		f.chunkFiles[key] = cached
+		f.n.fs.fdBudget.Acquire(spliceFDOwner(f.n.root), 1)
+	}
+	return fuse.ReadResultFd(cached.Fd(), fileOffset, n), true
+}
+
+func spliceFDOwner(mountpoint string) string {
+	return "splice:" + mountpoint
+}
+
+var _ = (fusefs.FileReleaser)((*file)(nil))
+
+func (f *file) Release(ctx context.Context) syscall.Errno {
+	f.streamMu.Lock()
+	f.closeStream()
+	f.streamMu.Unlock()
+
+	f.chunkFilesMu.Lock()
+	defer f.chunkFilesMu.Unlock()
+	for _, cached := range f.chunkFiles {
+		cached.Close()
+	}
+	if len(f.chunkFiles) > 0 {
+		f.n.fs.fdBudget.Release(spliceFDOwner(f.n.root), len(f.chunkFiles))
+	}
+	f.chunkFiles = nil
+	return 0
+}
+
 var _ = (fusefs.FileGetattrer)((*file)(nil))
 
 func (f *file) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
 	entryToAttr(f.e, &out.Attr)
+	f.n.atimes().setATime(f.e, &out.Attr)
 	return 0
 }
 
+// whence values of lseek(2) forwarded to FUSE.
+const (
+	seekData = 3 // SEEK_DATA
+	seekHole = 4 // SEEK_HOLE
+)
+
+var _ = (fusefs.FileLseeker)((*file)(nil))
+
+// Lseek serves SEEK_DATA and SEEK_HOLE with the holes of sparse files recorded
+// in the TOC. Other files consist of a single data region.
+func (f *file) Lseek(ctx context.Context, off uint64, whence uint32) (uint64, syscall.Errno) {
+	defer f.n.trace("lseek", "")()
+	if whence != seekData && whence != seekHole {
+		return 0, syscall.EINVAL
+	}
+	size := uint64(f.e.Size)
+	if off >= size {
+		return 0, syscall.ENXIO
+	}
+	hole := whence == seekHole
+	sf, ok := f.ra.(reader.SparseFile)
+	if !ok {
+		if hole {
+			return size, 0
+		}
+		return off, 0
+	}
+	next, ok := sf.NextRegion(int64(off), hole)
+	if !ok {
+		return 0, syscall.ENXIO
+	}
+	return uint64(next), 0
+}
+
 // whiteout is a whiteout abstraction compliant to overlayfs.
 type whiteout struct {
 	fusefs.Inode
@@ -873,7 +2144,7 @@ func (w *whiteout) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errn
 
 // newState provides new state directory node.
 // It creates statFile at the same time to give it stable inode number.
-func newState(digest string, blob remote.Blob) *state {
+func newState(digest string, blob remote.Blob, progress *layerProgress) *state {
 	return &state{
 		statFile: &statFile{
 			name: digest + ".json",
@@ -881,7 +2152,8 @@ func newState(digest string, blob remote.Blob) *state {
 				Digest: digest,
 				Size:   blob.Size(),
 			},
-			blob: blob,
+			blob:     blob,
+			progress: progress,
 		},
 	}
 }
@@ -892,24 +2164,80 @@ func newState(digest string, blob remote.Blob) *state {
 // This directory has mode "dr-x------ root root".
 type state struct {
 	fusefs.Inode
-	statFile *statFile
+	statFile   *statFile
+	debugFiles []*debugFile
+	atimes     *atimeTracker // nil if access times aren't updated
+}
+
+// addDebugFile adds a file to this directory. The contents are generated by the
+// passed function on the first access and kept afterwards.
+func (s *state) addDebugFile(name string, contents func() ([]byte, error)) {
+	var (
+		once sync.Once
+		data []byte
+		err  error
+	)
+	get := func() ([]byte, error) {
+		once.Do(func() { data, err = contents() })
+		return data, err
+	}
+	s.debugFiles = append(s.debugFiles, &debugFile{
+		name: name,
+		size: func() (int64, error) {
+			d, err := get()
+			return int64(len(d)), err
+		},
+		readAt: func(p []byte, offset int64) (int, error) {
+			d, err := get()
+			if err != nil {
+				return 0, err
+			}
+			return bytes.NewReader(d).ReadAt(p, offset)
+		},
+	})
+}
+
+// addRawFile adds a file which contents are read from the passed function.
+func (s *state) addRawFile(name string, size int64, readAt func(p []byte, offset int64) (int, error)) {
+	s.debugFiles = append(s.debugFiles, &debugFile{
+		name:   name,
+		size:   func() (int64, error) { return size, nil },
+		readAt: readAt,
+	})
 }
 
 var _ = (fusefs.NodeReaddirer)((*state)(nil))
 
 func (s *state) Readdir(ctx context.Context) (fusefs.DirStream, syscall.Errno) {
-	return fusefs.NewListDirStream([]fuse.DirEntry{
+	ents := []fuse.DirEntry{
 		{
 			Mode: statFileMode,
 			Name: s.statFile.name,
 			Ino:  inodeOfStatFile(s.statFile),
 		},
-	}), 0
+	}
+	for _, df := range s.debugFiles {
+		ents = append(ents, fuse.DirEntry{
+			Mode: statFileMode,
+			Name: df.name,
+			Ino:  inodeOfDebugFile(df),
+		})
+	}
+	return fusefs.NewListDirStream(ents), 0
 }
 
 var _ = (fusefs.NodeLookuper)((*state)(nil))
 
 func (s *state) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	for _, df := range s.debugFiles {
+		if name == df.name {
+			attr, errno := df.attr(&out.Attr)
+			if errno != 0 {
+				return nil, errno
+			}
+			return s.NewInode(ctx, df, attr), 0
+		}
+	}
 	if name != s.statFile.name {
 		return nil, syscall.ENOENT
 	}
@@ -942,9 +2270,12 @@ type statJSON struct {
 	Error  string `json:"error,omitempty"`
 	Digest string `json:"digest"`
 	// URL is excluded for potential security reason
-	Size           int64   `json:"size"`
-	FetchedSize    int64   `json:"fetchedSize"`
-	FetchedPercent float64 `json:"fetchedPercent"` // Fetched / Size * 100.0
+	Size              int64   `json:"size"`
+	FetchedSize       int64   `json:"fetchedSize"`
+	FetchedPercent    float64 `json:"fetchedPercent"` // Fetched / Size * 100.0
+	PrefetchSize      int64   `json:"prefetchSize"`
+	PrefetchedSize    int64   `json:"prefetchedSize"`
+	PrefetchedPercent float64 `json:"prefetchedPercent"` // Prefetched / PrefetchSize * 100.0
 }
 
 // statFile is a file which contain something to be reported from this layer.
@@ -955,6 +2286,7 @@ type statFile struct {
 	fusefs.Inode
 	name     string
 	blob     remote.Blob
+	progress *layerProgress
 	statJSON statJSON
 	mu       sync.Mutex
 }
@@ -1016,6 +2348,12 @@ func (sf *statFile) attr(out *fuse.Attr) (fusefs.StableAttr, syscall.Errno) {
 func (sf *statFile) updateStatUnlocked() ([]byte, error) {
 	sf.statJSON.FetchedSize = sf.blob.FetchedSize()
 	sf.statJSON.FetchedPercent = float64(sf.statJSON.FetchedSize) / float64(sf.statJSON.Size) * 100.0
+	if sf.progress != nil {
+		p := sf.progress.get()
+		sf.statJSON.PrefetchSize = p.PrefetchSize
+		sf.statJSON.PrefetchedSize = p.PrefetchedSize
+		sf.statJSON.PrefetchedPercent = p.PrefetchedPercent
+	}
 	j, err := json.Marshal(&sf.statJSON)
 	if err != nil {
 		return nil, err
@@ -1024,6 +2362,72 @@ func (sf *statFile) updateStatUnlocked() ([]byte, error) {
 	return j, nil
 }
 
+// debugFile is a file which exposes data of this layer (e.g. TOC JSON) for
+// debugging. This file has mode "-r-------- root root".
+type debugFile struct {
+	fusefs.Inode
+	name   string
+	size   func() (int64, error)
+	readAt func(p []byte, offset int64) (int, error)
+}
+
+var _ = (fusefs.NodeOpener)((*debugFile)(nil))
+
+func (df *debugFile) Open(ctx context.Context, flags uint32) (fh fusefs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	return nil, 0, 0
+}
+
+var _ = (fusefs.NodeReader)((*debugFile)(nil))
+
+func (df *debugFile) Read(ctx context.Context, f fusefs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	n, err := df.readAt(dest, off)
+	if err != nil && err != io.EOF {
+		log.G(ctx).WithError(err).Debugf("failed to read debug file %q", df.name)
+		return nil, syscall.EIO
+	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+var _ = (fusefs.NodeGetattrer)((*debugFile)(nil))
+
+func (df *debugFile) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	_, errno := df.attr(&out.Attr)
+	return errno
+}
+
+var _ = (fusefs.NodeStatfser)((*debugFile)(nil))
+
+func (df *debugFile) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	defaultStatfs(out)
+	return 0
+}
+
+func (df *debugFile) attr(out *fuse.Attr) (fusefs.StableAttr, syscall.Errno) {
+	size, err := df.size()
+	if err != nil {
+		return fusefs.StableAttr{}, syscall.EIO
+	}
+	out.Ino = inodeOfDebugFile(df)
+	out.Size = uint64(size)
+	out.Blksize = blockSize
+	out.Blocks = out.Size / uint64(out.Blksize)
+	out.Nlink = 1
+
+	// Root can read it ("-r-------- root root").
+	out.Mode = statFileMode
+	out.Owner = fuse.Owner{Uid: 0, Gid: 0}
+	return fusefs.StableAttr{
+		Mode: out.Mode,
+		Ino:  out.Ino,
+	}, 0
+}
+
+// inodeOfDebugFile calculates the inode number which is one-to-one
+// correspondence with the debug file instance which was created on mount.
+func inodeOfDebugFile(df *debugFile) uint64 {
+	return uint64(uintptr(unsafe.Pointer(df)))
+}
+
 // inodeOfEnt calculates the inode number which is one-to-one conresspondence
 // with the TOCEntry insntance.
 func inodeOfEnt(e *estargz.TOCEntry) uint64 {
@@ -1039,8 +2443,10 @@ func entryToAttr(e *estargz.TOCEntry, out *fuse.Attr) fusefs.StableAttr {
 	if out.Size%uint64(out.Blksize) > 0 {
 		out.Blocks++
 	}
-	mtime := e.ModTime()
-	out.SetTimes(nil, &mtime, nil)
+	// Access times and change times are the modification times as the
+	// layer is read-only.
+	mtime := dataonly.ModTime(e)
+	out.SetTimes(&mtime, &mtime, &mtime)
 	out.Mode = modeOfEntry(e)
 	out.Owner = fuse.Owner{Uid: uint32(e.UID), Gid: uint32(e.GID)}
 	out.Rdev = uint32(unix.Mkdev(uint32(e.DevMajor), uint32(e.DevMinor)))
@@ -1061,13 +2467,12 @@ func entryToAttr(e *estargz.TOCEntry, out *fuse.Attr) fusefs.StableAttr {
 
 // entryToWhAttr converts stargz's TOCEntry to go-fuse's Attr of whiteouts.
 func entryToWhAttr(e *estargz.TOCEntry, out *fuse.Attr) fusefs.StableAttr {
-	fi := e.Stat()
 	out.Ino = inodeOfEnt(e)
 	out.Size = 0
 	out.Blksize = blockSize
 	out.Blocks = 0
-	mtime := fi.ModTime()
-	out.SetTimes(nil, &mtime, nil)
+	mtime := dataonly.ModTime(e)
+	out.SetTimes(&mtime, &mtime, &mtime)
 	out.Mode = syscall.S_IFCHR
 	out.Owner = fuse.Owner{Uid: 0, Gid: 0}
 	out.Rdev = uint32(unix.Mkdev(0, 0))
@@ -35,20 +35,28 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
 
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes/docker"
 	"github.com/containerd/stargz-snapshotter/cache"
 	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/hint"
+	"github.com/containerd/stargz-snapshotter/fs/nydus"
 	"github.com/containerd/stargz-snapshotter/fs/reader"
 	"github.com/containerd/stargz-snapshotter/fs/remote"
 	"github.com/containerd/stargz-snapshotter/fs/source"
 	"github.com/containerd/stargz-snapshotter/task"
+	"github.com/golang/groupcache/lru"
 	fusefs "github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 	digest "github.com/opencontainers/go-digest"
@@ -118,6 +126,7 @@ func (r *breakBlob) Refresh(ctx context.Context, hosts docker.RegistryHosts, ref
 	}
 	return nil
 }
+func (r *breakBlob) Invalidate() error { return nil }
 
 // Tests Read method of each file node.
 func TestNodeRead(t *testing.T) {
@@ -282,6 +291,21 @@ func TestExistence(t *testing.T) {
 				fileNotExist("foo/.wh..wh..opq"),
 			},
 		},
+		{
+			name: "overlay_xattrs_hidden",
+			in: []tarent{
+				directory("foo/", xAttr{
+					"trusted.overlay.redirect": "/bar",
+					"user.overlay.opaque":      "y",
+					"foo":                      "bar",
+				}),
+			},
+			want: []check{
+				hasNodeXattrs("foo/", "foo", "bar"),
+				hasNoNodeXattr("foo/", "trusted.overlay.redirect"),
+				hasNoNodeXattr("foo/", "user.overlay.opaque"),
+			},
+		},
 		{
 			name: "prefetch_landmark",
 			in: []tarent{
@@ -370,7 +394,7 @@ func getRootNode(t *testing.T, r *estargz.Reader) *node {
 	rootNode := &node{
 		layer: &testLayer{r},
 		e:     root,
-		s:     newState(testStateLayerDigest.String(), &dummyBlob{}),
+		s:     newState(testStateLayerDigest.String(), &dummyBlob{}, nil),
 	}
 	fusefs.NewNodeFS(rootNode, &fusefs.Options{})
 	return rootNode
@@ -395,15 +419,18 @@ func (db *dummyBlob) Cache(offset int64, size int64, option ...remote.Option) er
 func (db *dummyBlob) Refresh(ctx context.Context, hosts docker.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) error {
 	return nil
 }
+func (db *dummyBlob) Invalidate() error { return nil }
 
 type chunkSizeInfo int
 type prioritizedFilesInfo []string
 type stargzOnlyInfo bool
+type prefetchProfilesInfo map[string][]string
 
 func buildStargz(t *testing.T, ents []tarent, opts ...interface{}) (*io.SectionReader, digest.Digest) {
 	var chunkSize chunkSizeInfo
 	var prioritizedFiles prioritizedFilesInfo
 	var stargzOnly bool
+	var profiles prefetchProfilesInfo
 	for _, opt := range opts {
 		if v, ok := opt.(chunkSizeInfo); ok {
 			chunkSize = v
@@ -411,6 +438,8 @@ func buildStargz(t *testing.T, ents []tarent, opts ...interface{}) (*io.SectionR
 			prioritizedFiles = v
 		} else if v, ok := opt.(stargzOnlyInfo); ok {
 			stargzOnly = bool(v)
+		} else if v, ok := opt.(prefetchProfilesInfo); ok {
+			profiles = v
 		} else {
 			t.Fatalf("unsupported opt")
 		}
@@ -449,6 +478,7 @@ func buildStargz(t *testing.T, ents []tarent, opts ...interface{}) (*io.SectionR
 	rc, err := estargz.Build(
 		io.NewSectionReader(bytes.NewReader(tarData), 0, int64(len(tarData))),
 		estargz.WithPrioritizedFiles([]string(prioritizedFiles)),
+		estargz.WithPrefetchProfiles(map[string][]string(profiles)),
 		estargz.WithChunkSize(int(chunkSize)),
 	)
 	if err != nil {
@@ -657,6 +687,28 @@ func hasNodeXattrs(entry, name, value string) check {
 	}
 }
 
+func hasNoNodeXattr(entry, name string) check {
+	return func(t *testing.T, root *node) {
+		_, n, err := getDirentAndNode(t, root, entry)
+		if err != nil {
+			t.Fatalf("failed to get node %q: %v", entry, err)
+		}
+		buf := make([]byte, 1000)
+		nb, errno := n.Operations().(fusefs.NodeListxattrer).Listxattr(context.Background(), buf)
+		if errno != 0 {
+			t.Fatalf("failed to get xattrs list of node %q: %v", entry, errno)
+		}
+		for _, x := range strings.Split(string(buf[:nb]), "\x00") {
+			if x == name {
+				t.Errorf("node %q lists xattr %q", entry, name)
+			}
+		}
+		if _, errno := n.Operations().(fusefs.NodeGetxattrer).Getxattr(context.Background(), name, buf); errno != syscall.ENODATA {
+			t.Errorf("xattr %q of node %q = %v; want ENODATA", name, entry, errno)
+		}
+	}
+}
+
 func hasEntry(t *testing.T, name string, ents fusefs.DirStream) (fuse.DirEntry, bool) {
 	for ents.HasNext() {
 		de, errno := ents.Next()
@@ -835,6 +887,8 @@ func TestPrefetch(t *testing.T) {
 		wants            []string // filenames to compare
 		prefetchSize     func(*testing.T, *layer) int64
 		prioritizedFiles []string
+		profiles         map[string][]string
+		profile          string
 		stargz           bool
 	}{
 		{
@@ -880,6 +934,31 @@ func TestPrefetch(t *testing.T) {
 			prefetchSize:     landmarkPosition,
 			prioritizedFiles: []string{"foo/", "foo/bar.txt"},
 		},
+		{
+			name: "profile",
+			in: []tarent{
+				regfile("foo.txt", sampleData1),
+				regfile("bar.txt", sampleData2),
+			},
+			wantNum:          chunkNum(sampleData2) + chunkNum("bar.txt\n"), // including the landmark
+			wants:            []string{"bar.txt"},
+			prioritizedFiles: []string{"foo.txt"},
+			profiles:         map[string][]string{"test": {"bar.txt"}},
+			profile:          "test",
+		},
+		{
+			name: "unknown_profile",
+			in: []tarent{
+				regfile("foo.txt", sampleData1),
+				regfile("bar.txt", sampleData2),
+			},
+			wantNum:          chunkNum(sampleData1),
+			wants:            []string{"foo.txt"},
+			prefetchSize:     landmarkPosition,
+			prioritizedFiles: []string{"foo.txt"},
+			profiles:         map[string][]string{"test": {"bar.txt"}},
+			profile:          "serve",
+		},
 	}
 
 	for _, tt := range tests {
@@ -887,6 +966,7 @@ func TestPrefetch(t *testing.T) {
 			sr, dgst := buildStargz(t, tt.in,
 				chunkSizeInfo(sampleChunkSize),
 				prioritizedFilesInfo(tt.prioritizedFiles),
+				prefetchProfilesInfo(tt.profiles),
 				stargzOnlyInfo(tt.stargz))
 			blob := newBlob(sr)
 			cache := &testCache{membuf: map[string]string{}, t: t}
@@ -905,7 +985,7 @@ func TestPrefetch(t *testing.T) {
 			if tt.prefetchSize != nil {
 				prefetchSize = tt.prefetchSize(t, l)
 			}
-			if err := l.prefetch(defaultPrefetchSize); err != nil {
+			if err := l.prefetch(defaultPrefetchSize, true, tt.profile); err != nil {
 				t.Errorf("failed to prefetch: %v", err)
 				return
 			}
@@ -981,6 +1061,7 @@ func (sb *sampleBlob) Cache(offset int64, size int64, option ...remote.Option) e
 func (sb *sampleBlob) Refresh(ctx context.Context, hosts docker.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) error {
 	return nil
 }
+func (sb *sampleBlob) Invalidate() error { return nil }
 
 type testCache struct {
 	membuf map[string]string
@@ -1032,3 +1113,1462 @@ func TestWaiter(t *testing.T) {
 		t.Errorf("wait time is too short: %v; want %v", doneTime.Sub(startTime), waitTime)
 	}
 }
+
+func TestLayerProgress(t *testing.T) {
+	lp := &layerProgress{blob: &dummyBlob{}} // size: 10, fetched: 5
+	check := func(name string, wantPrefetchSize, wantPrefetched int64) {
+		p := lp.get()
+		if p.Size != 10 || p.FetchedSize != 5 || p.FetchedPercent != 50.0 {
+			t.Errorf("%s: unexpected fetch progress %+v", name, p)
+		}
+		if p.PrefetchSize != wantPrefetchSize || p.PrefetchedSize != wantPrefetched {
+			t.Errorf("%s: prefetch progress = %d/%d; want %d/%d", name,
+				p.PrefetchedSize, p.PrefetchSize, wantPrefetched, wantPrefetchSize)
+		}
+	}
+	check("not-started", 0, 0)
+	lp.startPrefetch(8)
+	check("in-progress", 8, 5)
+	lp.donePrefetch()
+	check("done", 8, 8)
+	if p := lp.get(); p.PrefetchedPercent != 100.0 {
+		t.Errorf("prefetched percent = %v; want 100", p.PrefetchedPercent)
+	}
+}
+
+type testChunkWalker map[string]int64
+
+func (w testChunkWalker) ForeachChunk(f func(id string, size int64)) error {
+	for id, size := range w {
+		f(id, size)
+	}
+	return nil
+}
+
+func TestDedupTracker(t *testing.T) {
+	dt := newDedupTracker()
+	for _, l := range []struct {
+		digest string
+		chunks testChunkWalker
+	}{
+		{"sha256:a", testChunkWalker{"c1": 10, "c2": 20}},
+		{"sha256:b", testChunkWalker{"c1": 10, "c3": 30}},
+		{"sha256:a", testChunkWalker{"c1": 10, "c2": 20}}, // another reference
+	} {
+		if err := dt.add(l.digest, l.chunks); err != nil {
+			t.Fatalf("failed to add layer %q: %v", l.digest, err)
+		}
+	}
+	want := DedupStats{
+		Layers:       2,
+		Chunks:       4,
+		UniqueChunks: 3,
+		LogicalSize:  70,
+		UniqueSize:   60,
+		Ratio:        70.0 / 60.0,
+	}
+	if got := dt.get(); got != want {
+		t.Errorf("dedup stats = %+v; want %+v", got, want)
+	}
+}
+
+func TestDedupRelease(t *testing.T) {
+	fs := &filesystem{
+		layer:         make(map[string]*layer),
+		dedup:         newDedupTracker(),
+		resolveResult: lru.New(10),
+	}
+	fs.resolveResult.OnEvicted = func(_ lru.Key, value interface{}) {
+		value.(*layer).release()
+	}
+	for _, l := range []struct {
+		digest     string
+		mountpoint string
+		chunks     testChunkWalker
+	}{
+		{"sha256:a", "/mnt/a", testChunkWalker{"c1": 10, "c2": 20}},
+		{"sha256:b", "/mnt/b", testChunkWalker{"c1": 10, "c3": 30}},
+	} {
+		d := l.digest
+		if err := fs.dedup.add(d, l.chunks); err != nil {
+			t.Fatalf("failed to add layer %q: %v", d, err)
+		}
+		ly := newLayer(ocispec.Descriptor{}, &dummyBlob{}, nil, nil, time.Second)
+		ly.onRelease = func() { fs.dedup.remove(d) }
+		ly.acquire() // resolution result
+		fs.resolveResult.Add(d, ly)
+		ly.acquire() // mount
+		fs.layer[l.mountpoint] = ly
+	}
+	check := func(name string, layers, chunks int, want DedupStats) {
+		fs.dedup.mu.Lock()
+		gotLayers, gotChunks := len(fs.dedup.layers), len(fs.dedup.chunks)
+		fs.dedup.mu.Unlock()
+		if gotLayers != layers || gotChunks != chunks {
+			t.Errorf("%s: tracking %d layers and %d chunks; want %d and %d", name, gotLayers, gotChunks, layers, chunks)
+		}
+		if s := fs.dedup.get(); s.Layers != want.Layers || s.Chunks != want.Chunks || s.UniqueChunks != want.UniqueChunks ||
+			s.LogicalSize != want.LogicalSize || s.UniqueSize != want.UniqueSize {
+			t.Errorf("%s: dedup stats = %+v; want %+v", name, s, want)
+		}
+	}
+	check("mounted", 2, 3, DedupStats{Layers: 2, Chunks: 4, UniqueChunks: 3, LogicalSize: 70, UniqueSize: 60})
+
+	// Nothing is actually mounted so unmount(2) fails but the layer is
+	// released before that. The resolution result still holds the layer.
+	fs.Unmount(context.Background(), "/mnt/a")
+	check("unmounted", 2, 3, DedupStats{Layers: 2, Chunks: 4, UniqueChunks: 3, LogicalSize: 70, UniqueSize: 60})
+
+	fs.resolveResult.Remove("sha256:a")
+	check("released", 1, 2, DedupStats{Layers: 1, Chunks: 2, UniqueChunks: 2, LogicalSize: 40, UniqueSize: 40})
+
+	fs.resolveResult.Remove("sha256:b")
+	fs.Unmount(context.Background(), "/mnt/b")
+	check("all released", 0, 0, DedupStats{})
+}
+
+func TestNegativeCache(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testnegativecache")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	path := filepath.Join(tmp, negativeCacheFileName)
+	now := time.Now()
+	nc, err := newNegativeCache(path, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to make negative cache: %v", err)
+	}
+	nc.now = func() time.Time { return now }
+	if err := nc.add("ref/sha256:a"); err != nil {
+		t.Fatalf("failed to add record: %v", err)
+	}
+
+	// The record must survive restarts.
+	nc, err = newNegativeCache(path, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to reopen negative cache: %v", err)
+	}
+	nc.now = func() time.Time { return now.Add(30 * time.Minute) }
+	if !nc.has("ref/sha256:a") {
+		t.Errorf("recorded layer must be hit")
+	}
+	if nc.has("ref/sha256:b") {
+		t.Errorf("unrecorded layer must not be hit")
+	}
+	nc.now = func() time.Time { return now.Add(2 * time.Hour) }
+	if nc.has("ref/sha256:a") {
+		t.Errorf("expired record must not be hit")
+	}
+}
+
+func TestMetadataPool(t *testing.T) {
+	p := newMetadataPool()
+	var builds int
+	build := func() (*reader.VerifiableReader, error) {
+		builds++
+		return &reader.VerifiableReader{}, nil
+	}
+	sm1, shared, err := p.acquire("sha256:a", build)
+	if err != nil || shared {
+		t.Fatalf("first acquire must build metadata: shared=%v, err=%v", shared, err)
+	}
+	sm2, shared, err := p.acquire("sha256:a", build)
+	if err != nil || !shared || sm1 != sm2 || builds != 1 {
+		t.Fatalf("metadata must be shared: shared=%v, builds=%d, err=%v", shared, builds, err)
+	}
+
+	// Metadata is kept until all layers release it.
+	l1 := newLayer(ocispec.Descriptor{}, &dummyBlob{}, sm1.vr, nil, time.Second)
+	l1.onRelease = func() { p.release(sm1) }
+	l1.acquire()
+	l1.acquire()
+	l1.release()
+	l1.release()
+	l1.release() // must not release the metadata twice
+	if p.len() != 1 {
+		t.Fatalf("metadata must be kept while referred")
+	}
+	p.release(sm2)
+	if p.len() != 0 {
+		t.Fatalf("metadata must be released")
+	}
+	if _, shared, _ := p.acquire("sha256:a", build); shared || builds != 2 {
+		t.Errorf("released metadata must be built again: shared=%v, builds=%d", shared, builds)
+	}
+
+	// Forgotten metadata is built again but it's still usable by the holder.
+	p.forget("sha256:a")
+	sm3, shared, _ := p.acquire("sha256:a", build)
+	if shared || builds != 3 {
+		t.Errorf("forgotten metadata must be built again: shared=%v, builds=%d", shared, builds)
+	}
+	p.release(sm1) // stale
+	if p.len() != 1 {
+		t.Errorf("releasing stale metadata must not affect the pool")
+	}
+	p.release(sm3)
+}
+
+func TestMetadataPoolConcurrent(t *testing.T) {
+	const storm = 20
+	p := newMetadataPool()
+	var builds int32
+	unblock := make(chan struct{})
+	build := func() (*reader.VerifiableReader, error) {
+		atomic.AddInt32(&builds, 1)
+		<-unblock
+		return &reader.VerifiableReader{}, nil
+	}
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		notShared int
+		sms       = make(map[*sharedMetadata]struct{})
+	)
+	for i := 0; i < storm; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sm, shared, err := p.acquire("sha256:a", build)
+			if err != nil {
+				t.Errorf("failed to acquire: %v", err)
+				return
+			}
+			mu.Lock()
+			sms[sm] = struct{}{}
+			if !shared {
+				notShared++
+			}
+			mu.Unlock()
+		}()
+	}
+	time.Sleep(100 * time.Millisecond) // let the mounts pile up
+	close(unblock)
+	wg.Wait()
+	if builds != 1 || notShared != 1 || len(sms) != 1 {
+		t.Fatalf("metadata must be built once: builds=%d, not shared=%d, metadata=%d", builds, notShared, len(sms))
+	}
+	for sm := range sms {
+		if sm.refcnt != storm {
+			t.Errorf("refcnt = %d; want %d", sm.refcnt, storm)
+		}
+	}
+}
+
+func TestFUSETrace(t *testing.T) {
+	fs := &filesystem{}
+	n := &node{fs: fs, root: "/mnt", e: &estargz.TOCEntry{Name: "dir"}}
+	n.trace("lookup", "untraced")() // not recorded while disabled
+
+	type result struct {
+		trace *FUSETrace
+		err   error
+	}
+	resCh := make(chan result)
+	go func() {
+		tr, err := fs.TraceFUSE(context.Background(), 500*time.Millisecond, 10*time.Millisecond)
+		resCh <- result{tr, err}
+	}()
+	for atomic.LoadInt32(&fs.opTracer.enabled) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := fs.TraceFUSE(context.Background(), time.Second, 0); !errdefs.IsUnavailable(err) {
+		t.Errorf("concurrent trace must fail with unavailable: %v", err)
+	}
+	n.trace("getattr", "")() // faster than the threshold
+	done := n.trace("lookup", "slow")
+	time.Sleep(20 * time.Millisecond)
+	done()
+
+	res := <-resCh
+	if res.err != nil {
+		t.Fatalf("failed to trace: %v", res.err)
+	}
+	if len(res.trace.Ops) != 1 {
+		t.Fatalf("only the slow operation must be recorded: %+v", res.trace.Ops)
+	}
+	op := res.trace.Ops[0]
+	if op.Op != "lookup" || op.Path != "/dir/slow" || op.Mountpoint != "/mnt" || op.Latency < 20*time.Millisecond {
+		t.Errorf("unexpected record: %+v", op)
+	}
+	if atomic.LoadInt32(&fs.opTracer.enabled) != 0 {
+		t.Errorf("tracing must be disabled after the trace")
+	}
+}
+
+func TestStateDebugFiles(t *testing.T) {
+	s := newState(testStateLayerDigest.String(), &dummyBlob{}, nil)
+	var calls int
+	s.addDebugFile("test.toc.json", func() ([]byte, error) {
+		calls++
+		return []byte(`{"version":1}`), nil
+	})
+	s.addRawFile("test.blob", 10, func(p []byte, offset int64) (int, error) {
+		return copy(p, []byte("0123456789")[offset:]), nil
+	})
+	if len(s.debugFiles) != 2 {
+		t.Fatalf("got %d debug files; want 2", len(s.debugFiles))
+	}
+	for _, tt := range []struct {
+		df   *debugFile
+		want string
+	}{
+		{s.debugFiles[0], `{"version":1}`},
+		{s.debugFiles[1], "0123456789"},
+	} {
+		size, err := tt.df.size()
+		if err != nil || size != int64(len(tt.want)) {
+			t.Errorf("size of %q = %d(%v); want %d", tt.df.name, size, err, len(tt.want))
+		}
+		p := make([]byte, 4)
+		n, err := tt.df.readAt(p, 1)
+		if err != nil || string(p[:n]) != tt.want[1:5] {
+			t.Errorf("contents of %q = %q(%v); want %q", tt.df.name, string(p[:n]), err, tt.want[1:5])
+		}
+	}
+	if calls != 1 {
+		t.Errorf("contents must be generated once; generated %d times", calls)
+	}
+}
+
+func TestPendingNode(t *testing.T) {
+	pl := newPendingLayer()
+	n := &node{pending: pl}
+	if err := pl.failed(); err != nil {
+		t.Fatalf("pending layer mustn't report error: %v", err)
+	}
+
+	readyCh := make(chan syscall.Errno)
+	go func() { readyCh <- n.ready() }()
+	select {
+	case <-readyCh:
+		t.Fatalf("node must block until the layer becomes ready")
+	case <-time.After(10 * time.Millisecond):
+	}
+	root := &estargz.TOCEntry{Name: ""}
+	pl.done(&node{e: root}, nil)
+	if errno := <-readyCh; errno != 0 {
+		t.Fatalf("failed to wait for the layer: %v", errno)
+	}
+	if n.e != root {
+		t.Errorf("node must be filled with the prepared layer")
+	}
+
+	pl = newPendingLayer()
+	pl.done(nil, fmt.Errorf("failed"))
+	if errno := (&node{pending: pl}).ready(); errno != syscall.EIO {
+		t.Errorf("node of failed layer must return EIO; got %v", errno)
+	}
+	if pl.failed() == nil {
+		t.Errorf("failed layer must report the error")
+	}
+}
+
+func TestLayerDepth(t *testing.T) {
+	layers := []ocispec.Descriptor{
+		{Digest: digest.FromString("bottom")},
+		{Digest: digest.FromString("middle")},
+		{Digest: digest.FromString("top")},
+	}
+	for name, want := range map[string]int{"bottom": 2, "middle": 1, "top": 0, "unknown": -1} {
+		s := source.Source{
+			Target:   ocispec.Descriptor{Digest: digest.FromString(name)},
+			Manifest: ocispec.Manifest{Layers: layers},
+		}
+		if got := layerDepth(s); got != want {
+			t.Errorf("depth of %q = %d; want %d", name, got, want)
+		}
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	newLayer := func() *layer {
+		return &layer{progress: &layerProgress{blob: &dummyBlob{}}}
+	}
+	prefetching, prefetched, failed, materialized := newLayer(), newLayer(), newLayer(), newLayer()
+	prefetched.progress.finishPrefetch(nil)
+	failed.progress.finishPrefetch(fmt.Errorf("failed"))
+	materialized.materialized = true
+	fs := &filesystem{
+		layer: map[string]*layer{
+			"/prefetching": prefetching, "/prefetched": prefetched,
+			"/failed": failed, "/materialized": materialized,
+		},
+		pending: map[string]*pendingLayer{"/pending": newPendingLayer()},
+	}
+	for _, tt := range []struct {
+		mountpoints []string
+		want        bool
+	}{
+		{[]string{"/prefetched", "/failed", "/materialized"}, true},
+		{[]string{"/prefetched", "/prefetching"}, false},
+		{[]string{"/prefetched", "/pending"}, false},
+		{[]string{"/prefetched", "/unknown"}, false},
+	} {
+		rd := fs.Readiness(context.Background(), tt.mountpoints)
+		if rd.Ready != tt.want || len(rd.Layers) != len(tt.mountpoints) {
+			t.Errorf("readiness of %v = %+v; want %v", tt.mountpoints, rd, tt.want)
+		}
+	}
+	if rd := fs.Readiness(context.Background(), []string{"/failed"}); rd.Layers[0].Error != "failed" {
+		t.Errorf("failed layer must report the error: %+v", rd)
+	}
+	fs.noprefetch = true
+	if rd := fs.Readiness(context.Background(), []string{"/prefetching"}); !rd.Ready {
+		t.Errorf("layers must be ready without prefetch: %+v", rd)
+	}
+}
+
+func TestOpenFlags(t *testing.T) {
+	tests := []struct {
+		name   string
+		mode   string
+		labels map[string]string
+		want   uint32
+	}{
+		{name: "default"},
+		{name: "config", mode: config.FUSECacheModeKeepCache, want: fuse.FOPEN_KEEP_CACHE},
+		{
+			name:   "label overrides config",
+			mode:   config.FUSECacheModeKeepCache,
+			labels: map[string]string{config.TargetFUSECacheModeLabel: config.FUSECacheModeDirectIO},
+			want:   fuse.FOPEN_DIRECT_IO,
+		},
+		{
+			name:   "unknown label",
+			labels: map[string]string{config.TargetFUSECacheModeLabel: "unknown"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := &filesystem{fuseCacheMode: tt.mode}
+			if got := fs.openFlags(context.Background(), tt.labels); got != tt.want {
+				t.Errorf("flags = %#x; want %#x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpaqueXattrs(t *testing.T) {
+	tests := []struct {
+		name     string
+		typ      string
+		inUserNS bool
+		want     []string
+	}{
+		{name: "default", want: []string{opaqueXattr}},
+		{name: "default_userns", inUserNS: true, want: []string{userOpaqueXattr}},
+		{name: "trusted_userns", typ: config.OverlayOpaqueTrusted, inUserNS: true, want: []string{opaqueXattr}},
+		{name: "user", typ: config.OverlayOpaqueUser, want: []string{userOpaqueXattr}},
+		{name: "all", typ: config.OverlayOpaqueAll, want: []string{opaqueXattr, userOpaqueXattr}},
+	}
+	sgz, _ := buildStargz(t, []tarent{
+		directory("foo/"),
+		regfile("foo/.wh..wh..opq", ""),
+	})
+	r, err := estargz.Open(sgz)
+	if err != nil {
+		t.Fatalf("stargz.Open: %v", err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rootNode := getRootNode(t, r)
+			rootNode.fs = &filesystem{opaqueXattrs: opaqueXattrsOf(tt.typ, tt.inUserNS)}
+			for _, x := range tt.want {
+				hasNodeXattrs("foo/", x, opaqueXattrValue)(t, rootNode)
+			}
+			_, n, err := getDirentAndNode(t, rootNode, "foo/")
+			if err != nil {
+				t.Fatalf("failed to get node: %v", err)
+			}
+			for _, x := range []string{opaqueXattr, userOpaqueXattr} {
+				if containsString(tt.want, x) {
+					continue
+				}
+				if _, errno := n.Operations().(fusefs.NodeGetxattrer).Getxattr(context.Background(), x, make([]byte, 10)); errno != syscall.ENODATA {
+					t.Errorf("xattr %q = %v; want ENODATA", x, errno)
+				}
+			}
+		})
+	}
+}
+
+func containsString(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMemoryGuard(t *testing.T) {
+	p := newMetadataPool()
+	fs := &filesystem{metadata: p, resolveResult: lru.New(10)}
+	fs.resolveResult.OnEvicted = func(_ lru.Key, value interface{}) {
+		value.(*layer).release()
+	}
+	for _, d := range []string{"sha256:a", "sha256:b"} {
+		sm, _, err := p.acquire(d, func() (*reader.VerifiableReader, error) {
+			return &reader.VerifiableReader{}, nil
+		})
+		if err != nil {
+			t.Fatalf("failed to acquire metadata: %v", err)
+		}
+		sm.size = 1000
+		l := newLayer(ocispec.Descriptor{}, &dummyBlob{}, sm.vr, nil, time.Second)
+		l.onRelease = func() { p.release(sm) }
+		l.acquire()
+		fs.resolveResult.Add(d, l)
+	}
+	c := cache.NewMemoryCache()
+	c.Add("chunk", []byte("0123456789"))
+
+	// Enough budget
+	fs.memGuard = newMemoryGuard(fs, 1<<50, c)
+	fs.memGuard.enforce(context.Background())
+	if s := fs.MemoryStats(context.Background()); s.Metadata != 2000 || s.Chunks != 10 || s.Reclaims != 0 || len(s.Layers) != 2 {
+		t.Fatalf("memory must not be reclaimed within the budget: %+v", s)
+	}
+
+	// RSS of the process exceeds the budget so everything is dropped.
+	fs.memGuard = newMemoryGuard(fs, 1, c)
+	fs.memGuard.enforce(context.Background())
+	if s := fs.MemoryStats(context.Background()); s.Metadata != 0 || s.Chunks != 0 || s.Reclaims != 1 || s.RSS == 0 {
+		t.Errorf("memory must be reclaimed over the budget: %+v", s)
+	}
+	if fs.resolveResult.Len() != 0 {
+		t.Errorf("resolution results must be dropped")
+	}
+}
+
+// chunkFile is a file of 4-byte chunks. Chunks whose index is in cached are
+// stored in files under dir.
+type chunkFile struct {
+	data   []byte
+	dir    string
+	cached map[int]bool
+	opened int
+}
+
+func (cf *chunkFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(cf.data)) {
+		return 0, io.EOF
+	}
+	return copy(p, cf.data[off:]), nil
+}
+
+func (cf *chunkFile) CachedChunk(offset int64, size int) (string, int64, int, bool) {
+	idx, end := int(offset/4), offset+int64(size)
+	if chunkEnd := int64(idx+1) * 4; end > chunkEnd {
+		if chunkEnd < int64(len(cf.data)) {
+			return "", 0, 0, false
+		}
+		end = int64(len(cf.data))
+	}
+	return fmt.Sprint(idx), offset % 4, int(end - offset), true
+}
+
+func (cf *chunkFile) OpenCachedChunk(key string) (*os.File, error) {
+	var idx int
+	fmt.Sscan(key, &idx)
+	if !cf.cached[idx] {
+		return nil, fmt.Errorf("chunk %d is not cached", idx)
+	}
+	p := filepath.Join(cf.dir, key)
+	end := (idx + 1) * 4
+	if end > len(cf.data) {
+		end = len(cf.data)
+	}
+	if err := ioutil.WriteFile(p, cf.data[idx*4:end], 0600); err != nil {
+		return nil, err
+	}
+	cf.opened++
+	return os.Open(p)
+}
+
+func TestZeroCopyRead(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "test-zerocopy")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	cf := &chunkFile{data: []byte("0123456789"), dir: tempDir, cached: map[int]bool{0: true, 2: true}}
+	n := &node{fs: &filesystem{zeroCopyRead: true}, e: &estargz.TOCEntry{Size: 10}}
+	f := &file{n: n, e: n.e, ra: cf}
+	for _, tt := range []struct {
+		off    int64
+		size   int
+		want   string
+		opened int
+	}{
+		{off: 1, size: 2, want: "12", opened: 1},   // served from the cache file
+		{off: 0, size: 4, want: "0123", opened: 1}, // the opened file is reused
+		{off: 2, size: 4, want: "2345", opened: 1}, // spans chunks
+		{off: 4, size: 2, want: "45", opened: 1},   // not cached
+		{off: 9, size: 10, want: "9", opened: 2},   // end of the file
+		{off: 10, size: 10, want: "", opened: 2},   // out of the file
+	} {
+		res, errno := f.Read(context.Background(), make([]byte, tt.size), tt.off)
+		if errno != 0 {
+			t.Fatalf("failed to read at %d: %v", tt.off, errno)
+		}
+		got, status := res.Bytes(make([]byte, tt.size))
+		if !status.Ok() || string(got) != tt.want || cf.opened != tt.opened {
+			t.Errorf("read at %d = %q (%v), opened %d; want %q, opened %d",
+				tt.off, got, status, cf.opened, tt.want, tt.opened)
+		}
+	}
+	if errno := f.Release(context.Background()); errno != 0 || f.chunkFiles != nil {
+		t.Errorf("failed to release the file: %v", errno)
+	}
+}
+
+type streamFile struct {
+	data   []byte
+	opened int
+}
+
+func (sf *streamFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(sf.data)) {
+		return 0, io.EOF
+	}
+	return copy(p, sf.data[off:]), nil
+}
+
+func (sf *streamFile) OpenStream(ctx context.Context, offset int64) (io.ReadCloser, error) {
+	sf.opened++
+	return ioutil.NopCloser(bytes.NewReader(sf.data[offset:])), nil
+}
+
+func TestStreamingRead(t *testing.T) {
+	data := "0123456789ab"
+	for _, tt := range []struct {
+		name      string
+		threshold int64
+		reads     []int64 // offsets of 4-byte reads
+		opened    int
+	}{
+		{name: "disabled", reads: []int64{0, 4, 8}},
+		{name: "small file", threshold: 100, reads: []int64{0, 4, 8}},
+		{name: "sequential", threshold: 10, reads: []int64{0, 4, 8}, opened: 1},
+		{name: "random", threshold: 10, reads: []int64{8, 0, 6, 2}},
+		{name: "reopen", threshold: 10, reads: []int64{0, 4, 0, 4, 8}, opened: 2},
+		{name: "out of order", threshold: 10, reads: []int64{0, 4, 2, 8}, opened: 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			sf := &streamFile{data: []byte(data)}
+			n := &node{fs: &filesystem{}, e: &estargz.TOCEntry{Size: int64(len(data))}, streamThreshold: tt.threshold}
+			f := &file{n: n, e: n.e, ra: sf}
+			for _, off := range tt.reads {
+				res, errno := f.Read(context.Background(), make([]byte, 4), off)
+				if errno != 0 {
+					t.Fatalf("failed to read at %d: %v", off, errno)
+				}
+				got, _ := res.Bytes(make([]byte, 4))
+				if want := data[off : off+4]; string(got) != want {
+					t.Errorf("read at %d = %q; want %q", off, got, want)
+				}
+			}
+			if sf.opened != tt.opened {
+				t.Errorf("opened %d streams; want %d", sf.opened, tt.opened)
+			}
+			f.Release(context.Background())
+			if f.stream != nil {
+				t.Errorf("stream must be closed on release")
+			}
+		})
+	}
+}
+
+// TestTagPinner tests digests of tags are pinned on the first mount and drifts
+// are detected.
+func TestTagPinner(t *testing.T) {
+	var (
+		current = digest.FromString("v1")
+		mu      sync.Mutex
+	)
+	tp := newTagPinner(func(ctx context.Context, hosts docker.RegistryHosts, ref string) (digest.Digest, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return current, nil
+	})
+	tagged := source.Source{Name: reference.Spec{Locator: "example.com/foo", Object: "latest"}}
+	byDigest := source.Source{Name: reference.Spec{Locator: "example.com/foo", Object: "@" + current.String()}}
+	tp.add(context.TODO(), "/mnt/1", tagged)
+	tp.add(context.TODO(), "/mnt/2", tagged)
+	tp.add(context.TODO(), "/mnt/3", byDigest)
+	var pins []TagPin
+	for i := 0; i < 100; i++ {
+		if pins = tp.list(); len(pins) == 1 && pins[0].Pinned != "" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(pins) != 1 || pins[0].Pinned != current.String() || pins[0].Drifted || pins[0].Mounts != 2 {
+		t.Fatalf("unexpected pins %+v", pins)
+	}
+
+	mu.Lock()
+	current = digest.FromString("v2")
+	mu.Unlock()
+	tp.check(context.TODO(), tp.pins[pins[0].Ref])
+	if pins = tp.list(); !pins[0].Drifted || pins[0].Current != current.String() || pins[0].Pinned != digest.FromString("v1").String() {
+		t.Errorf("drift isn't detected %+v", pins)
+	}
+
+	tp.remove("/mnt/1")
+	tp.remove("/mnt/2")
+	if pins = tp.list(); len(pins) != 0 {
+		t.Errorf("pin must be dropped after unmounting all layers %+v", pins)
+	}
+}
+
+type chunkEntries []*estargz.TOCEntry
+
+func (ce chunkEntries) ForeachChunkEntry(f func(id string, ce *estargz.TOCEntry)) error {
+	for _, e := range ce {
+		f(e.ChunkDigest, e)
+	}
+	return nil
+}
+
+type countPinner map[string]int
+
+func (cp countPinner) Pin(key string)   { cp[key]++ }
+func (cp countPinner) Unpin(key string) { cp[key]-- }
+
+func TestPinStore(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testpinstore")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	path := filepath.Join(tmp, pinsFileName)
+	cp := make(countPinner)
+	ps, err := newPinStore(path, cp)
+	if err != nil {
+		t.Fatalf("failed to make pin store: %v", err)
+	}
+	layerA := chunkEntries{{ChunkDigest: "a"}, {ChunkDigest: "shared"}}
+	layerB := chunkEntries{{ChunkDigest: "b"}, {ChunkDigest: "shared"}}
+	if err := ps.pin("example.com/base:1", []string{"sha256:a", "sha256:b"}); err != nil {
+		t.Fatalf("failed to pin: %v", err)
+	}
+	ps.apply("sha256:a", layerA)
+	ps.apply("sha256:a", layerA) // applied only once
+	ps.apply("sha256:c", layerB) // not pinned
+	if want := (countPinner{"a": 1, "shared": 1}); !reflect.DeepEqual(cp, want) {
+		t.Errorf("pinned keys = %v; want %v", cp, want)
+	}
+
+	// Pins persist but chunks are pinned again after restart.
+	cp2 := make(countPinner)
+	ps2, err := newPinStore(path, cp2)
+	if err != nil {
+		t.Fatalf("failed to reload pin store: %v", err)
+	}
+	pins := ps2.list()
+	if len(pins) != 2 || pins[0].Digest != "sha256:a" || pins[0].Ref != "example.com/base:1" || pins[0].Chunks != 0 {
+		t.Fatalf("unexpected pins after reload %+v", pins)
+	}
+	ps2.apply("sha256:a", layerA)
+	ps2.apply("sha256:b", layerB)
+	if pins := ps2.list(); pins[0].Chunks != 2 || pins[1].Chunks != 2 {
+		t.Errorf("unexpected number of pinned chunks %+v", pins)
+	}
+	if err := ps2.unpin([]string{"sha256:a"}); err != nil {
+		t.Fatalf("failed to unpin: %v", err)
+	}
+	if want := (countPinner{"a": 0, "b": 1, "shared": 1}); !reflect.DeepEqual(cp2, want) {
+		t.Errorf("pinned keys after unpin = %v; want %v", cp2, want)
+	}
+	if pins := ps2.list(); len(pins) != 1 || pins[0].Digest != "sha256:b" {
+		t.Errorf("unexpected pins after unpin %+v", pins)
+	}
+}
+
+// TestPinStoreMaterialize tests materialized layers are pinned and the state
+// persists across restarts.
+func TestPinStoreMaterialize(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testpinstore")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	path := filepath.Join(tmp, pinsFileName)
+	cp := make(countPinner)
+	ps, err := newPinStore(path, cp)
+	if err != nil {
+		t.Fatalf("failed to make pin store: %v", err)
+	}
+	if err := ps.materialize("example.com/app:1", "sha256:a"); err != nil {
+		t.Fatalf("failed to materialize: %v", err)
+	}
+	ps.apply("sha256:a", chunkEntries{{ChunkDigest: "a"}})
+	if cp["a"] != 1 {
+		t.Errorf("chunks of materialized layer must be pinned: %v", cp)
+	}
+
+	ps2, err := newPinStore(path, make(countPinner))
+	if err != nil {
+		t.Fatalf("failed to reload pin store: %v", err)
+	}
+	if !ps2.isMaterialized("sha256:a") || ps2.isMaterialized("sha256:b") {
+		t.Errorf("unexpected materialized state after reload %+v", ps2.list())
+	}
+	if err := ps2.unmaterialize("sha256:a"); err != nil {
+		t.Fatalf("failed to unmaterialize: %v", err)
+	}
+	if pins := ps2.list(); ps2.isMaterialized("sha256:a") || len(pins) != 1 {
+		t.Errorf("layer must stay pinned but not materialized %+v", pins)
+	}
+	if err := ps2.unpin([]string{"sha256:a"}); err != nil {
+		t.Fatalf("failed to unpin: %v", err)
+	}
+	if ps2.isMaterialized("sha256:a") {
+		t.Errorf("unpinned layer must not be materialized")
+	}
+}
+
+// TestComputeDelta tests chunks of the prefetch target are compared with the cache.
+func TestComputeDelta(t *testing.T) {
+	c := cache.NewMemoryCache()
+	c.Add("a", []byte("aaaa"))
+	c.Add("c", []byte("cc"))
+	entries := chunkEntries{
+		{ChunkDigest: "a", Offset: 0, ChunkSize: 4},
+		{ChunkDigest: "b", Offset: 10, ChunkSize: 3},
+		{ChunkDigest: "c", Offset: 20, ChunkSize: 2},
+		{ChunkDigest: "d", Offset: 30, ChunkSize: 5}, // out of the prefetch target
+	}
+	d, err := computeDelta(entries, c, 30)
+	if err != nil {
+		t.Fatalf("failed to compute delta: %v", err)
+	}
+	if d.chunks != 3 || d.cachedChunks != 2 || d.size != 9 || d.cachedSize != 6 {
+		t.Errorf("unexpected delta %+v", d)
+	}
+	var ds deltaStats
+	ds.add(d)
+	if ds.layers != 1 || ds.reusedSize != 6 || ds.fetchedSize != 3 {
+		t.Errorf("unexpected stats %+v", ds)
+	}
+}
+
+type cachedBlob struct {
+	dummyBlob
+	sr     *io.SectionReader
+	cached bool
+}
+
+func (cb *cachedBlob) Size() int64 { return cb.sr.Size() }
+
+func (cb *cachedBlob) ReadCachedAt(p []byte, offset int64) (int, error) {
+	if !cb.cached {
+		return 0, errdefs.ErrNotFound
+	}
+	return cb.sr.ReadAt(p, offset)
+}
+
+// TestChunkIndex tests chunks are taken from the blob cache of another layer
+// containing the same chunks.
+func TestChunkIndex(t *testing.T) {
+	const contents = "0123456789"
+	lowerSR, _ := buildStargz(t, []tarent{regfile("a", contents), regfile("b", "other")}, chunkSizeInfo(sampleChunkSize))
+	upperSR, _ := buildStargz(t, []tarent{directory("dir/"), regfile("dir/copied", contents)}, chunkSizeInfo(sampleChunkSize))
+	lower, _, err := reader.NewReader(lowerSR, cache.NewMemoryCache())
+	if err != nil {
+		t.Fatalf("failed to make stargz reader: %v", err)
+	}
+	upper, _, err := reader.NewReader(upperSR, cache.NewMemoryCache())
+	if err != nil {
+		t.Fatalf("failed to make stargz reader: %v", err)
+	}
+	lowerBlob := &cachedBlob{sr: lowerSR}
+	ci := newChunkIndex()
+	if err := ci.add("lower", lowerBlob, lower); err != nil {
+		t.Fatalf("failed to index chunks: %v", err)
+	}
+	var chunks []*estargz.TOCEntry
+	if err := upper.ForeachChunkEntry(func(_ string, ce *estargz.TOCEntry) {
+		if ce.Name == "dir/copied" {
+			chunks = append(chunks, ce)
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 4 {
+		t.Fatalf("got %d chunks; want 4", len(chunks))
+	}
+	readAll := func(self string) bool {
+		for _, ce := range chunks {
+			p := make([]byte, ce.ChunkSize)
+			if !ci.read(self, ce.ChunkDigest, p) {
+				return false
+			}
+			if want := contents[ce.ChunkOffset : ce.ChunkOffset+ce.ChunkSize]; string(p) != want {
+				t.Fatalf("chunk at %d = %q; want %q", ce.ChunkOffset, string(p), want)
+			}
+		}
+		return true
+	}
+	if readAll("upper") {
+		t.Errorf("chunks not in the blob cache must not be taken")
+	}
+	lowerBlob.cached = true
+	if !readAll("upper") {
+		t.Errorf("chunks in the blob cache of the lower layer must be taken")
+	}
+	if readAll("lower") {
+		t.Errorf("chunks must not be taken from the layer itself")
+	}
+	if ci.hits != 4 || ci.reusedSize != int64(len(contents)) {
+		t.Errorf("hits = %d, reused size = %d; want 4, %d", ci.hits, ci.reusedSize, len(contents))
+	}
+
+	// The layer is removed after all registrations are removed.
+	if err := ci.add("lower", lowerBlob, lower); err != nil {
+		t.Fatalf("failed to index chunks: %v", err)
+	}
+	ci.remove("lower")
+	if !readAll("upper") {
+		t.Errorf("chunks must be kept until all registrations are removed")
+	}
+	ci.remove("lower")
+	if readAll("upper") || len(ci.chunks) != 0 {
+		t.Errorf("chunks must be removed with the layer")
+	}
+}
+
+// TestCollectLayers tests per-layer files of layers neither mounted nor in use
+// are removed.
+func TestCollectLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testcollectlayers")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := hint.NewStore(dir)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	var (
+		unused  = digest.FromString("unused")
+		inUse   = digest.FromString("in-use")
+		mounted = digest.FromString("mounted")
+	)
+	for _, d := range []digest.Digest{unused, inUse, mounted} {
+		if err := s.Save(d, []string{"/foo"}); err != nil {
+			t.Fatalf("failed to save hints: %v", err)
+		}
+	}
+	fs := &filesystem{
+		layer:          map[string]*layer{"/mnt": {desc: ocispec.Descriptor{Digest: mounted}}},
+		layerStateDirs: []string{dir},
+	}
+	want := filepath.Join(dir, unused.Algorithm().String()+"-"+unused.Encoded()+".json")
+	for _, dryRun := range []bool{true, false} {
+		var opts []GCOpt
+		if dryRun {
+			opts = append(opts, GCDryRun())
+		}
+		res, err := fs.CollectLayers(context.TODO(), func(d digest.Digest) bool { return d == inUse }, opts...)
+		if err != nil {
+			t.Fatalf("failed to collect layers: %v", err)
+		}
+		if len(res.Files) != 1 || res.Files[0].Path != want || res.Files[0].Size == 0 || res.ReclaimedSize != res.Files[0].Size {
+			t.Errorf("unexpected removed files %+v (dry run: %v)", res, dryRun)
+		}
+		if _, err := os.Stat(want); dryRun != (err == nil) {
+			t.Errorf("unexpected existence of the file (dry run: %v): %v", dryRun, err)
+		}
+	}
+	files, err := hint.LayerFiles(dir)
+	if err != nil {
+		t.Fatalf("failed to list files: %v", err)
+	}
+	if _, ok := files[unused]; ok || len(files) != 2 {
+		t.Errorf("unexpected remaining files %v", files)
+	}
+}
+
+func TestFetchLog(t *testing.T) {
+	fl := newFetchLog()
+	for i := 0; i < maxFetchLogRecords+2; i++ {
+		fl.add(fmt.Sprintf("file%d", i), int64(i), 1, 0)
+	}
+	records, dropped := fl.get(time.Time{})
+	if len(records) != maxFetchLogRecords || dropped != 2 {
+		t.Fatalf("unexpected number of records %d (dropped %d)", len(records), dropped)
+	}
+	if records[0].Path != "/file2" || records[len(records)-1].Path != fmt.Sprintf("/file%d", maxFetchLogRecords+1) {
+		t.Errorf("unexpected order of records: first %q, last %q", records[0].Path, records[len(records)-1].Path)
+	}
+	if records, _ := fl.get(time.Now().Add(time.Hour)); len(records) != 0 {
+		t.Errorf("records after since must be returned but got %d", len(records))
+	}
+
+	fs := &filesystem{
+		layer: map[string]*layer{"/mnt": {
+			desc:     ocispec.Descriptor{Digest: testStateLayerDigest},
+			progress: &layerProgress{blob: &dummyBlob{}, prefetchSize: 100},
+			fetchLog: fl,
+		}},
+	}
+	logs := fs.FetchLog(context.TODO(), []string{"/mnt", "/unknown"}, time.Time{})
+	if len(logs) != 1 || logs[0].Digest != testStateLayerDigest.String() {
+		t.Fatalf("unexpected logs %+v", logs)
+	}
+	for _, r := range logs[0].Records {
+		if want := r.Offset < 100; r.Prioritized != want {
+			t.Errorf("prioritized of %q (offset %d) = %v; want %v", r.Path, r.Offset, r.Prioritized, want)
+		}
+	}
+}
+
+func TestSnapshotStats(t *testing.T) {
+	fl := newFetchLog()
+	for i := 1; i <= 10; i++ {
+		fl.add("old", 0, 100, time.Hour)
+		fl.records[len(fl.records)-1].Start = time.Now().Add(-2 * time.Hour)
+		fl.add("new", 0, 10, time.Duration(i)*time.Millisecond)
+	}
+	for i := 0; i < 60; i++ {
+		fl.addHit(5)
+	}
+	fs := &filesystem{
+		layer: map[string]*layer{"/mnt": {
+			desc:     ocispec.Descriptor{Digest: testStateLayerDigest},
+			progress: &layerProgress{blob: &dummyBlob{}},
+			fetchLog: fl,
+		}},
+	}
+	st := fs.SnapshotStats(context.TODO(), []string{"/mnt", "/unknown"}, time.Minute)
+	if len(st.Layers) != 1 || st.Layers[0].Digest != testStateLayerDigest.String() {
+		t.Fatalf("unexpected layers %+v", st.Layers)
+	}
+	if l := st.Layers[0]; l.CacheHits != 60 || l.CacheHitSize != 300 || l.CacheMisses != 20 || l.CacheMissSize != 1100 {
+		t.Errorf("unexpected counts of layer %+v", l)
+	}
+	if st.CacheHitRate != 0.75 {
+		t.Errorf("cache hit rate = %v; want 0.75", st.CacheHitRate)
+	}
+	if st.OnDemandFetches != 10 || st.OnDemandSize != 100 {
+		t.Errorf("on-demand fetches in window = %d (%d bytes); want 10 (100 bytes)", st.OnDemandFetches, st.OnDemandSize)
+	}
+	if st.LatencyP50 != 5*time.Millisecond || st.LatencyP90 != 9*time.Millisecond || st.LatencyP99 != 10*time.Millisecond {
+		t.Errorf("unexpected latency percentiles p50=%v p90=%v p99=%v", st.LatencyP50, st.LatencyP90, st.LatencyP99)
+	}
+}
+
+func TestCacheInventory(t *testing.T) {
+	newLayer := func(d digest.Digest) *layer {
+		return &layer{desc: ocispec.Descriptor{Digest: d}, blob: &dummyBlob{}} // size: 10, fetched: 5
+	}
+	shared := newLayer(digest.FromString("shared"))
+	fs := &filesystem{
+		layer: map[string]*layer{
+			"/a1": shared, "/a2": newLayer(digest.FromString("a")), "/a3": shared,
+			"/b1": shared,
+		},
+		mountRefs: map[string]string{
+			"/a1": "example.com/a:1", "/a2": "example.com/a:1", "/a3": "example.com/a:1",
+			"/b1": "example.com/b:1",
+		},
+	}
+	inv := fs.CacheInventory(context.TODO())
+	if len(inv) != 2 || inv[0].Ref != "example.com/a:1" || inv[1].Ref != "example.com/b:1" {
+		t.Fatalf("unexpected inventory %+v", inv)
+	}
+	if a := inv[0]; len(a.Layers) != 2 || a.Size != 20 || a.FetchedSize != 10 || a.FetchedPercent != 50.0 {
+		t.Errorf("layers of an image must be counted once: %+v", a)
+	}
+	if b := inv[1]; len(b.Layers) != 1 || b.Layers[0].Digest != shared.desc.Digest.String() {
+		t.Errorf("shared layer must be counted for each image: %+v", b)
+	}
+}
+
+func TestLatencyWatchdog(t *testing.T) {
+	now := time.Now()
+	newTestLayer := func(latencies ...time.Duration) *layer {
+		fl := newFetchLog()
+		for _, lat := range latencies {
+			fl.records = append(fl.records, FetchRecord{Path: "/a", Start: now.Add(-time.Second), Latency: lat})
+		}
+		fl.records = append(fl.records, FetchRecord{Path: "/old", Start: now.Add(-time.Hour), Latency: time.Hour})
+		return &layer{desc: ocispec.Descriptor{Digest: testStateLayerDigest}, fetchLog: fl}
+	}
+	var fast, slow []time.Duration
+	for i := 0; i < 100; i++ {
+		fast = append(fast, time.Millisecond)
+		slow = append(slow, time.Millisecond)
+	}
+	fast[99] = time.Second // only p100 is slow
+	slow[98], slow[99] = time.Second, time.Second
+	layers := map[string]*layer{
+		"/fast": newTestLayer(fast...),
+		"/slow": newTestLayer(slow...),
+		"/few":  newTestLayer(time.Second),
+	}
+	materialized := make(chan string, len(layers))
+	w := newLatencyWatchdog(100*time.Millisecond, time.Minute, 20,
+		func() map[string]*layer { return layers },
+		func(ctx context.Context, mp string) error {
+			materialized <- mp
+			return nil
+		})
+	w.now = func() time.Time { return now }
+	w.check(context.TODO())
+	w.check(context.TODO()) // must not trigger twice
+	select {
+	case mp := <-materialized:
+		if mp != "/slow" {
+			t.Errorf("unexpected materialized layer %q", mp)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("layer isn't materialized")
+	}
+	events := w.list()
+	if len(events) != 1 || events[0].Mountpoint != "/slow" || events[0].P99 != time.Second || events[0].Samples != 100 {
+		t.Errorf("unexpected events %+v", events)
+	}
+	select {
+	case mp := <-materialized:
+		t.Errorf("unexpected materialization of %q", mp)
+	default:
+	}
+}
+
+func TestScanPrefetch(t *testing.T) {
+	sr, _ := buildStargz(t, []tarent{
+		directory("py/"),
+		regfile("py/a.py", "aa"),
+		regfile("py/b.py", "bbb"),
+		regfile("py/big.py", sampleData1),
+		directory("other/"),
+		regfile("other/c.py", "cc"),
+	}, chunkSizeInfo(sampleChunkSize))
+	blob := newBlob(sr)
+	cache := &testCache{membuf: map[string]string{}, t: t}
+	vr, _, err := reader.NewReader(sr, cache)
+	if err != nil {
+		t.Fatalf("failed to make stargz reader: %v", err)
+	}
+	l := newLayer(ocispec.Descriptor{Digest: testStateLayerDigest}, blob, vr, nil, time.Second)
+	l.skipVerify()
+	lr, err := l.reader()
+	if err != nil {
+		t.Fatalf("failed to get reader from layer: %v", err)
+	}
+	dir, ok := lr.Lookup("py")
+	if !ok {
+		t.Fatalf("failed to lookup directory")
+	}
+
+	// Sweeps are detected only after listing the directory.
+	p := newScanPrefetcher(&filesystem{layer: map[string]*layer{}}, 3, sampleChunkSize)
+	for i := 0; i < 3; i++ {
+		p.lookup("/mnt", dir)
+	}
+	p.readdir("/mnt", dir)
+	for i := 0; i < 2; i++ {
+		p.lookup("/mnt", dir)
+	}
+	if p.dirs["/mnt"]["py"].done {
+		t.Fatalf("sweep detected before the threshold")
+	}
+	p.lookup("/mnt", dir)
+	if !p.dirs["/mnt"]["py"].done {
+		t.Fatalf("sweep isn't detected")
+	}
+	p.forget("/mnt")
+	if len(p.dirs) != 0 {
+		t.Errorf("scans remain after forget")
+	}
+
+	n, err := p.prefetch(l, dir)
+	if err != nil {
+		t.Fatalf("failed to prefetch: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("prefetched %d files; want 2", n)
+	}
+	a, _ := lr.Lookup("py/a.py")
+	b, _ := lr.Lookup("py/b.py")
+	if blob.calledPrefetchOffset != a.Offset || blob.calledPrefetchSize != b.NextOffset()-a.Offset {
+		t.Errorf("fetched [%d, +%d); want [%d, %d)", blob.calledPrefetchOffset, blob.calledPrefetchSize, a.Offset, b.NextOffset())
+	}
+	for _, e := range []*estargz.TOCEntry{a, b} {
+		ra, err := lr.OpenFile(e.Name)
+		if err != nil {
+			t.Fatalf("failed to open %q: %v", e.Name, err)
+		}
+		blob.readCalled = false
+		if _, err := io.Copy(ioutil.Discard, io.NewSectionReader(ra, 0, e.Size)); err != nil {
+			t.Fatalf("failed to read %q: %v", e.Name, err)
+		}
+		if blob.readCalled {
+			t.Errorf("%q isn't cached", e.Name)
+		}
+	}
+}
+
+func TestATime(t *testing.T) {
+	sr, _ := buildStargz(t, []tarent{
+		regfile("implied/foo.txt", "foo"),
+	})
+	r, err := estargz.Open(sr)
+	if err != nil {
+		t.Fatalf("failed to open stargz: %v", err)
+	}
+	dir, ok := r.Lookup("implied")
+	if !ok {
+		t.Fatalf("failed to lookup the directory implied by the path")
+	}
+	var out fuse.Attr
+	entryToAttr(dir, &out)
+	if out.Mtime != 0 || out.Atime != 0 || out.Ctime != 0 {
+		t.Errorf("times of implied directory = %d, %d, %d; want epoch", out.Atime, out.Mtime, out.Ctime)
+	}
+	e, ok := r.Lookup("implied/foo.txt")
+	if !ok {
+		t.Fatalf("failed to lookup file")
+	}
+	entryToAttr(e, &out)
+	mtime := out.Mtime
+	if out.Atime != mtime || out.Ctime != mtime {
+		t.Errorf("times of file = %d, %d, %d; want mtime", out.Atime, mtime, out.Ctime)
+	}
+
+	if newATimeTracker(config.ATimeModeNoATime) != nil {
+		t.Errorf("tracker must be nil in noatime mode")
+	}
+	now := time.Unix(int64(mtime), 0).Add(time.Hour)
+	for _, tt := range []struct {
+		mode string
+		want []time.Duration // access times after reads at now, now+1h and now+25h
+	}{
+		{config.ATimeModeRelATime, []time.Duration{0, 0, 25 * time.Hour}},
+		{config.ATimeModeStrictATime, []time.Duration{0, time.Hour, 25 * time.Hour}},
+	} {
+		tr := newATimeTracker(tt.mode)
+		for i, d := range []time.Duration{0, time.Hour, 25 * time.Hour} {
+			tr.now = func() time.Time { return now.Add(d) }
+			tr.accessed(e)
+			entryToAttr(e, &out)
+			tr.setATime(e, &out)
+			if want := now.Add(tt.want[i]); out.Atime != uint64(want.Unix()) {
+				t.Errorf("%s: atime after read %d = %d; want %d", tt.mode, i, out.Atime, want.Unix())
+			}
+			if out.Mtime != mtime {
+				t.Errorf("%s: mtime changed", tt.mode)
+			}
+		}
+	}
+}
+
+func TestMergedView(t *testing.T) {
+	// Layers are listed upper first.
+	layers := [][]tarent{
+		{
+			directory("foo/"),
+			regfile("foo/.wh.a", ""),
+			directory("bar/"),
+			regfile("bar/.wh..wh..opq", ""),
+			regfile("bar/new", "new"),
+			regfile("baz", "baz"),
+		},
+		{
+			directory("foo/"),
+			regfile("foo/b", "upper"),
+		},
+		{
+			regfile(estargz.PrefetchLandmark, "test"),
+			directory("foo/"),
+			regfile("foo/a", "a"),
+			regfile("foo/b", "lower"),
+			directory("bar/"),
+			regfile("bar/old", "old"),
+			directory("baz/"),
+			regfile("baz/x", "x"),
+		},
+	}
+	var roots []*node
+	for _, in := range layers {
+		sgz, _ := buildStargz(t, in)
+		r, err := estargz.Open(sgz)
+		if err != nil {
+			t.Fatalf("stargz.Open: %v", err)
+		}
+		roots = append(roots, getRootNode(t, r))
+	}
+	root := newMergedRoot(roots, true)
+	fusefs.NewNodeFS(root, &fusefs.Options{})
+
+	ctx := context.Background()
+	lookup := func(d *mergedDir, name string) *fusefs.Inode {
+		var eo fuse.EntryOut
+		n, errno := d.Lookup(ctx, name, &eo)
+		if errno != 0 {
+			t.Fatalf("failed to lookup %q: %v", name, errno)
+		}
+		return n
+	}
+	names := func(d *mergedDir) []string {
+		ents, errno := d.Readdir(ctx)
+		if errno != 0 {
+			t.Fatalf("failed to readdir: %v", errno)
+		}
+		var names []string
+		for ents.HasNext() {
+			de, _ := ents.Next()
+			names = append(names, de.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	if got, want := names(root), []string{"bar", "baz", "foo"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("entries of root = %v; want %v", got, want)
+	}
+	foo := lookup(root, "foo").Operations().(*mergedDir)
+	if got, want := names(foo), []string{"b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("entries of foo = %v; want %v", got, want)
+	}
+	if dgst := lookup(foo, "b").Operations().(*node).e.Digest; dgst != digestFor("upper") {
+		t.Errorf("foo/b isn't taken from the upper layer")
+	}
+	bar := lookup(root, "bar").Operations().(*mergedDir)
+	if got, want := names(bar), []string{"new"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("entries of opaque bar = %v; want %v", got, want)
+	}
+	if typ := lookup(root, "baz").Operations().(*node).e.Type; typ != "reg" {
+		t.Errorf("type of baz = %q; want reg", typ)
+	}
+
+	// Whiteouts and opaque directories are kept if layers are stacked under
+	// the view.
+	root = newMergedRoot(roots, false)
+	fusefs.NewNodeFS(root, &fusefs.Options{})
+	foo = lookup(root, "foo").Operations().(*mergedDir)
+	if got, want := names(foo), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("entries of foo = %v; want %v", got, want)
+	}
+	if _, ok := lookup(foo, "a").Operations().(*whiteout); !ok {
+		t.Errorf("foo/a must be a whiteout")
+	}
+	if opaque := lookup(root, "foo").Operations().(*mergedDir).opaque(); opaque {
+		t.Errorf("foo must not be opaque")
+	}
+	if opaque := lookup(root, "bar").Operations().(*mergedDir).opaque(); !opaque {
+		t.Errorf("bar must be opaque")
+	}
+}
+
+func TestSnapshotLabels(t *testing.T) {
+	tests := []struct {
+		name                string
+		labels              map[string]string
+		disableVerification bool
+		wantVerified        string
+		wantMode            string
+	}{
+		{
+			name:         "toc digest",
+			labels:       map[string]string{estargz.TOCJSONDigestAnnotation: digestFor("toc")},
+			wantVerified: "true",
+			wantMode:     config.VerificationModeTOCDigest,
+		},
+		{
+			name:         "nydus",
+			labels:       map[string]string{nydus.BootstrapLabel: "true"},
+			wantVerified: "true",
+			wantMode:     config.VerificationModeNydus,
+		},
+		{
+			name:         "skipped",
+			labels:       map[string]string{config.TargetSkipVerifyLabel: "true"},
+			wantVerified: "false",
+			wantMode:     config.VerificationModeSkipped,
+		},
+		{
+			name:                "disabled",
+			labels:              map[string]string{estargz.TOCJSONDigestAnnotation: digestFor("toc")},
+			disableVerification: true,
+			wantVerified:        "false",
+			wantMode:            config.VerificationModeDisabled,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := &filesystem{disableVerification: tt.disableVerification}
+			got := fs.SnapshotLabels(context.Background(), "/mnt", tt.labels)
+			if v := got[config.VerifiedLabel]; v != tt.wantVerified {
+				t.Errorf("verified = %q; want %q", v, tt.wantVerified)
+			}
+			if m := got[config.VerificationModeLabel]; m != tt.wantMode {
+				t.Errorf("mode = %q; want %q", m, tt.wantMode)
+			}
+		})
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	var buf bytes.Buffer
+	a := &auditLogger{
+		w:       &buf,
+		targets: make(map[string]auditTarget),
+		now:     func() time.Time { return time.Unix(0, 0) },
+	}
+	a.register("/unverified", auditTarget{
+		image:        "test.io/test:latest",
+		layer:        testStateLayerDigest.String(),
+		verification: config.VerificationModeSkipped,
+	})
+	fs := &filesystem{audit: a}
+	e := &estargz.TOCEntry{Name: "foo", Type: "reg", Size: 10}
+	(&file{n: &node{fs: fs, root: "/unverified"}, e: e}).audit(8, 4096)
+	(&file{n: &node{fs: fs, root: "/verified"}, e: e}).audit(0, 4096)
+	a.unregister("/unverified")
+	(&file{n: &node{fs: fs, root: "/unverified"}, e: e}).audit(0, 4096)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("recorded %d reads; want 1: %q", len(lines), buf.String())
+	}
+	var got auditRecord
+	if err := json.Unmarshal([]byte(lines[0]), &got); err != nil {
+		t.Fatalf("failed to parse record: %v", err)
+	}
+	want := auditRecord{
+		Time:         time.Unix(0, 0).UTC(),
+		Image:        "test.io/test:latest",
+		Layer:        testStateLayerDigest.String(),
+		Verification: config.VerificationModeSkipped,
+		Path:         "foo",
+		Offset:       8,
+		Length:       2,
+	}
+	if got != want {
+		t.Errorf("record = %+v; want %+v", got, want)
+	}
+}
+
+func TestLayerRepositories(t *testing.T) {
+	fs := &filesystem{}
+	dgst := digest.FromString("layer").String()
+	for _, ref := range []string{
+		"docker.io/library/ubuntu:20.04",
+		"docker.io/library/ubuntu@" + digest.FromString("manifest").String(),
+		"registry.test/app:v1",
+	} {
+		fs.addResolvedName(dgst, ref+"/"+dgst)
+	}
+	fs.addResolvedName(digest.FromString("other").String(), "registry.test/other:v1/"+digest.FromString("other").String())
+	want := []string{"docker.io/library/ubuntu", "registry.test/app"}
+	if got := fs.LayerRepositories(dgst); !reflect.DeepEqual(got, want) {
+		t.Errorf("repositories = %v; want %v", got, want)
+	}
+}
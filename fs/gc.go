@@ -0,0 +1,241 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"os"
+	"sort"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/stargz-snapshotter/cache"
+	"github.com/containerd/stargz-snapshotter/fs/hint"
+	"github.com/hashicorp/go-multierror"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// GCResult is the result of garbage collection of layers.
+type GCResult struct {
+	// DryRun is true if nothing was actually removed.
+	DryRun bool `json:"dryRun"`
+
+	// Layers are layers whose cached chunks, TOC and metadata are dropped.
+	Layers []GCLayer `json:"layers"`
+
+	// Files are per-layer files (e.g. access hints and prefetch models)
+	// removed.
+	Files []GCFile `json:"files"`
+
+	// ReclaimedSize is the disk space reclaimed by removing the cached chunks
+	// and the files.
+	ReclaimedSize int64 `json:"reclaimedSize"`
+}
+
+// GCLayer is a layer collected by garbage collection.
+type GCLayer struct {
+	Digest string `json:"digest"`
+
+	// Chunks and CacheSize are the number and the stored size of the cached
+	// chunks of the layer. Chunks shared with layers in use are kept and not
+	// counted.
+	Chunks    int64 `json:"chunks"`
+	CacheSize int64 `json:"cacheSize"`
+
+	// MetadataSize is the estimated memory usage of the metadata of the layer.
+	MetadataSize int64 `json:"metadataSize"`
+}
+
+// GCFile is a per-layer file removed by garbage collection.
+type GCFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// GCOpt is an option of garbage collection.
+type GCOpt func(*gcOptions)
+
+type gcOptions struct {
+	dryRun bool
+}
+
+// GCDryRun reports what would be removed without removing anything.
+func GCDryRun() GCOpt {
+	return func(o *gcOptions) {
+		o.dryRun = true
+	}
+}
+
+// LayerCollector removes caches and metadata of layers which are no longer
+// used. The filesystem returned by NewFilesystem implements this interface.
+type LayerCollector interface {
+	CollectLayers(ctx context.Context, inUse func(digest.Digest) bool, opts ...GCOpt) (GCResult, error)
+}
+
+var _ = (LayerCollector)((*filesystem)(nil))
+
+// CollectLayers drops caches and metadata of layers known to the filesystem,
+// which aren't mounted and inUse returns false for. inUse is typically based on
+// images in containerd so that caches of layers of removed images are cleaned
+// even if their snapshots are left.
+func (fs *filesystem) CollectLayers(ctx context.Context, inUse func(digest.Digest) bool, opts ...GCOpt) (res GCResult, rErr error) {
+	var gcOpts gcOptions
+	for _, o := range opts {
+		o(&gcOpts)
+	}
+	mounted := make(map[digest.Digest]struct{})
+	var kept []*layer
+	fs.layerMu.Lock()
+	for _, l := range fs.layer {
+		mounted[l.desc.Digest] = struct{}{}
+		kept = append(kept, l)
+	}
+	fs.layerMu.Unlock()
+	unused := func(dgst digest.Digest) bool {
+		_, ok := mounted[dgst]
+		return !ok && !inUse(dgst)
+	}
+
+	fs.resolvedNamesMu.Lock()
+	var layers []string
+	for d := range fs.resolvedNames {
+		layers = append(layers, d)
+	}
+	fs.resolvedNamesMu.Unlock()
+	sort.Strings(layers)
+	var collected []string
+	for _, d := range layers {
+		if unused(digest.Digest(d)) {
+			collected = append(collected, d)
+		} else {
+			kept = append(kept, fs.resolvedLayers(d)...)
+		}
+	}
+
+	// Chunks are keyed by their contents so layers in use can share them.
+	keptChunks := make(map[string]struct{})
+	for _, l := range kept {
+		if l.verifiableReader == nil {
+			continue
+		}
+		if err := l.verifiableReader.ForeachChunk(func(id string, _ int64) {
+			keptChunks[id] = struct{}{}
+		}); err != nil {
+			return res, errors.Wrapf(err, "failed to list chunks of layer %q", l.desc.Digest)
+		}
+	}
+	keepChunk := func(id string) bool {
+		_, ok := keptChunks[id]
+		return ok
+	}
+
+	res.DryRun = gcOpts.dryRun
+	res.Layers, res.Files = []GCLayer{}, []GCFile{}
+	for _, d := range collected {
+		u := fs.layerUsage(d, keepChunk)
+		if !gcOpts.dryRun {
+			if err := fs.invalidateLayer(ctx, d, keepChunk); err != nil {
+				rErr = multierror.Append(rErr, err)
+				continue
+			}
+		}
+		res.Layers = append(res.Layers, u)
+		res.ReclaimedSize += u.CacheSize
+	}
+
+	for _, dir := range fs.layerStateDirs {
+		files, err := hint.LayerFiles(dir)
+		if err != nil {
+			rErr = multierror.Append(rErr, err)
+			continue
+		}
+		for dgst, p := range files {
+			if !unused(dgst) {
+				continue
+			}
+			fi, err := os.Stat(p)
+			if err != nil {
+				if !os.IsNotExist(err) {
+					rErr = multierror.Append(rErr, err)
+				}
+				continue
+			}
+			if !gcOpts.dryRun {
+				if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+					rErr = multierror.Append(rErr, err)
+					continue
+				}
+			}
+			res.Files = append(res.Files, GCFile{Path: p, Size: fi.Size()})
+			res.ReclaimedSize += fi.Size()
+		}
+	}
+	sort.Slice(res.Files, func(i, j int) bool { return res.Files[i].Path < res.Files[j].Path })
+	if !gcOpts.dryRun && (len(res.Layers) > 0 || len(res.Files) > 0) {
+		log.G(ctx).WithField("layers", len(res.Layers)).WithField("files", len(res.Files)).
+			WithField("reclaimed", res.ReclaimedSize).Info("collected caches of unused layers")
+	}
+	return res, rErr
+}
+
+// resolvedLayers returns the resolution results of the layer.
+func (fs *filesystem) resolvedLayers(digest string) (layers []*layer) {
+	fs.resolvedNamesMu.Lock()
+	var names []string
+	for name := range fs.resolvedNames[digest] {
+		names = append(names, name)
+	}
+	fs.resolvedNamesMu.Unlock()
+	fs.resolveResultMu.Lock()
+	defer fs.resolveResultMu.Unlock()
+	for _, name := range names {
+		if c, ok := fs.resolveResult.Get(name); ok {
+			layers = append(layers, c.(*layer))
+		}
+	}
+	return
+}
+
+// layerUsage returns the cached chunks and the metadata of the layer, which are
+// dropped by invalidation.
+func (fs *filesystem) layerUsage(digest string, keepChunk func(id string) bool) GCLayer {
+	u := GCLayer{Digest: digest}
+	sizer, _ := fs.fsCache.(cache.Sizer)
+	counted := make(map[string]struct{})
+	for _, l := range fs.resolvedLayers(digest) {
+		if l.verifiableReader == nil {
+			continue
+		}
+		if u.MetadataSize == 0 {
+			u.MetadataSize = l.verifiableReader.MetadataSize()
+		}
+		if sizer == nil {
+			continue
+		}
+		l.verifiableReader.ForeachChunk(func(id string, _ int64) {
+			if _, ok := counted[id]; ok || keepChunk(id) {
+				return
+			}
+			counted[id] = struct{}{}
+			if n, err := sizer.StoredSize(id); err == nil {
+				u.Chunks++
+				u.CacheSize += n
+			}
+		})
+	}
+	return u
+}
@@ -0,0 +1,299 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package hint
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/perf"
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Layout of an event sent by the eBPF program:
+	//   u32 tgid
+	//   s32 dfd
+	//   char filename[maxPathLen]
+	maxPathLen  = 256
+	eventHeader = 8
+	eventSize   = eventHeader + maxPathLen
+
+	perfBufferPages = 16
+
+	bpfFCurrentCPU = 0xffffffff
+	atFDCWD        = -100
+)
+
+// Offsets of arguments in the context of syscalls tracepoints. See
+// /sys/kernel/tracing/events/syscalls/<name>/format.
+var tracepoints = []struct {
+	name        string
+	filenameOff int16
+	dfdOff      int16 // negative if the syscall doesn't take dfd
+}{
+	{"sys_enter_openat", 24, 16},
+	{"sys_enter_execve", 16, -1},
+}
+
+var tracefsPaths = []string{"/sys/kernel/tracing", "/sys/kernel/debug/tracing"}
+
+// AccessEvent is an access to a file by a process.
+type AccessEvent struct {
+	PID int
+
+	// Root is the root directory of the process seen from this process.
+	Root string
+
+	// Path is the absolute path of the accessed file seen from the process.
+	Path string
+}
+
+// Tracer reports openat(2) and execve(2) called by processes on the node using
+// eBPF programs attached to syscall tracepoints. This requires CAP_SYS_ADMIN.
+type Tracer struct {
+	events    *ebpf.Map
+	progs     []*ebpf.Program
+	perfFDs   []int
+	reader    *perf.Reader
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewTracer starts tracing and calls handler for each access. The handler is
+// called from a single goroutine so it must return quickly.
+func NewTracer(handler func(AccessEvent)) (_ *Tracer, retErr error) {
+	events, err := ebpf.NewMap(&ebpf.MapSpec{
+		Name: "stargz_access",
+		Type: ebpf.PerfEventArray,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create perf event array")
+	}
+	t := &Tracer{events: events}
+	defer func() {
+		if retErr != nil {
+			t.Close()
+		}
+	}()
+	ncpu := int(events.ABI().MaxEntries)
+	for _, tp := range tracepoints {
+		id, err := tracepointID(tp.name)
+		if err != nil {
+			return nil, err
+		}
+		prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+			Name:         "stargz_" + strings.TrimPrefix(tp.name, "sys_"),
+			Type:         ebpf.TracePoint,
+			License:      "GPL", // required by bpf_probe_read_str
+			Instructions: accessProgram(events, tp.filenameOff, tp.dfdOff),
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load program for %q", tp.name)
+		}
+		t.progs = append(t.progs, prog)
+		var attached int
+		for cpu := 0; cpu < ncpu; cpu++ {
+			fd, err := attachTracepoint(id, cpu, prog)
+			if err != nil {
+				// Offline CPUs can't be attached.
+				continue
+			}
+			t.perfFDs = append(t.perfFDs, fd)
+			attached++
+		}
+		if attached == 0 {
+			return nil, fmt.Errorf("failed to attach program to %q", tp.name)
+		}
+	}
+	t.reader, err = perf.NewReader(events, perfBufferPages*os.Getpagesize())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create perf reader")
+	}
+
+	self := os.Getpid()
+	go func() {
+		for {
+			rec, err := t.reader.Read()
+			if err != nil {
+				if perf.IsClosed(err) {
+					return
+				}
+				continue
+			}
+			if len(rec.RawSample) < eventHeader {
+				continue
+			}
+			pid := int(binary.LittleEndian.Uint32(rec.RawSample[0:4]))
+			if pid == self {
+				continue
+			}
+			dfd := int32(binary.LittleEndian.Uint32(rec.RawSample[4:8]))
+			name := rec.RawSample[eventHeader:]
+			if i := bytes.IndexByte(name, 0); i >= 0 {
+				name = name[:i]
+			}
+			if ev, ok := resolveEvent(pid, dfd, string(name)); ok {
+				handler(ev)
+			}
+		}
+	}()
+	return t, nil
+}
+
+// Close stops tracing.
+func (t *Tracer) Close() error {
+	t.closeOnce.Do(func() {
+		var errs error
+		for _, fd := range t.perfFDs {
+			unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_DISABLE, 0)
+			if err := unix.Close(fd); err != nil {
+				errs = multierror.Append(errs, err)
+			}
+		}
+		if t.reader != nil {
+			if err := t.reader.Close(); err != nil {
+				errs = multierror.Append(errs, err)
+			}
+		}
+		for _, p := range t.progs {
+			if err := p.Close(); err != nil {
+				errs = multierror.Append(errs, err)
+			}
+		}
+		if err := t.events.Close(); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+		t.closeErr = errs
+	})
+	return t.closeErr
+}
+
+// accessProgram returns a program which sends the caller's tgid, dfd and the
+// filename argument of the syscall to the perf event array.
+func accessProgram(events *ebpf.Map, filenameOff, dfdOff int16) asm.Instructions {
+	insns := asm.Instructions{
+		asm.Mov.Reg(asm.R6, asm.R1), // ctx
+		asm.LoadMem(asm.R7, asm.R1, filenameOff, asm.DWord),
+	}
+	if dfdOff >= 0 {
+		insns = append(insns, asm.LoadMem(asm.R8, asm.R1, dfdOff, asm.DWord))
+	} else {
+		insns = append(insns, asm.Mov.Imm(asm.R8, atFDCWD))
+	}
+	return append(insns,
+		asm.FnGetCurrentPidTgid.Call(),
+		asm.RSh.Imm(asm.R0, 32),
+		asm.StoreMem(asm.RFP, -eventSize, asm.R0, asm.Word),
+		asm.StoreMem(asm.RFP, -eventSize+4, asm.R8, asm.Word),
+		asm.Mov.Reg(asm.R1, asm.RFP),
+		asm.Add.Imm(asm.R1, -maxPathLen),
+		asm.Mov.Imm(asm.R2, maxPathLen),
+		asm.Mov.Reg(asm.R3, asm.R7),
+		asm.FnProbeReadStr.Call(),
+		asm.Mov.Reg(asm.R1, asm.R6),
+		asm.LoadMapPtr(asm.R2, events.FD()),
+		asm.LoadImm(asm.R3, bpfFCurrentCPU, asm.DWord),
+		asm.Mov.Reg(asm.R4, asm.RFP),
+		asm.Add.Imm(asm.R4, -eventSize),
+		asm.Mov.Imm(asm.R5, eventSize),
+		asm.FnPerfEventOutput.Call(),
+		asm.Mov.Imm(asm.R0, 0),
+		asm.Return(),
+	)
+}
+
+func tracepointID(name string) (uint64, error) {
+	var rErr error
+	for _, p := range tracefsPaths {
+		data, err := ioutil.ReadFile(filepath.Join(p, "events", "syscalls", name, "id"))
+		if err != nil {
+			rErr = multierror.Append(rErr, err)
+			continue
+		}
+		return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	}
+	return 0, errors.Wrapf(rErr, "failed to get ID of tracepoint %q", name)
+}
+
+func attachTracepoint(id uint64, cpu int, prog *ebpf.Program) (int, error) {
+	attr := unix.PerfEventAttr{
+		Type:        unix.PERF_TYPE_TRACEPOINT,
+		Config:      id,
+		Sample_type: unix.PERF_SAMPLE_RAW,
+		Sample:      1,
+		Wakeup:      1,
+	}
+	attr.Size = uint32(unsafe.Sizeof(attr))
+	fd, err := unix.PerfEventOpen(&attr, -1, cpu, -1, unix.PERF_FLAG_FD_CLOEXEC)
+	if err != nil {
+		return -1, err
+	}
+	if err := unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_SET_BPF, prog.FD()); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	if err := unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_ENABLE, 0); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// resolveEvent converts the filename passed to the syscall into the absolute
+// path seen from the process. This is best-effort because the process can
+// change its state (e.g. exit) before this function is called.
+func resolveEvent(pid int, dfd int32, name string) (AccessEvent, bool) {
+	if name == "" {
+		return AccessEvent{}, false
+	}
+	procDir := filepath.Join("/proc", strconv.Itoa(pid))
+	root, err := os.Readlink(filepath.Join(procDir, "root"))
+	if err != nil {
+		return AccessEvent{}, false
+	}
+	if !filepath.IsAbs(name) {
+		base := filepath.Join(procDir, "cwd")
+		if dfd != atFDCWD {
+			base = filepath.Join(procDir, "fd", strconv.Itoa(int(dfd)))
+		}
+		dir, err := os.Readlink(base)
+		if err != nil {
+			return AccessEvent{}, false
+		}
+		if root != "/" {
+			if !strings.HasPrefix(dir, root+"/") && dir != root {
+				return AccessEvent{}, false
+			}
+			dir = strings.TrimPrefix(dir, root)
+		}
+		name = filepath.Join("/", dir, name)
+	}
+	return AccessEvent{PID: pid, Root: root, Path: filepath.Clean(name)}, true
+}
@@ -0,0 +1,154 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package hint
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestStore(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testhint")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	s, err := NewStore(tmp)
+	if err != nil {
+		t.Fatalf("failed to make store: %v", err)
+	}
+	layer := digest.FromString("layer")
+	if paths, err := s.Load(layer); err != nil || paths != nil {
+		t.Fatalf("nothing must be loaded: paths=%v, err=%v", paths, err)
+	}
+
+	r := NewRecorder()
+	for _, p := range []string{"/bin/sh", "/etc/passwd", "/bin/sh", "/lib/libc.so"} {
+		r.Record(p)
+	}
+	want := []string{"/bin/sh", "/etc/passwd", "/lib/libc.so"}
+	if !reflect.DeepEqual(r.Paths(), want) {
+		t.Fatalf("recorded %v; want %v", r.Paths(), want)
+	}
+	if err := s.Save(layer, r.Paths()); err != nil {
+		t.Fatalf("failed to save: %v", err)
+	}
+	if paths, err := s.Load(layer); err != nil || !reflect.DeepEqual(paths, want) {
+		t.Errorf("loaded %v; want %v (err=%v)", paths, want, err)
+	}
+	if err := s.Save(digest.Digest("../../evil"), want); err == nil {
+		t.Errorf("invalid digest must be rejected")
+	}
+	if files, err := LayerFiles(tmp); err != nil || len(files) != 1 || files[layer] == "" {
+		t.Errorf("unexpected layer files %v (err=%v)", files, err)
+	}
+
+	r = NewRecorder()
+	for i := 0; i < MaxHints+10; i++ {
+		r.Record(fmt.Sprintf("/file%d", i))
+	}
+	if len(r.Paths()) != MaxHints {
+		t.Errorf("number of recorded paths must be limited: %d", len(r.Paths()))
+	}
+}
+
+func TestOverlayLowerDirs(t *testing.T) {
+	mountinfo := `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+100 22 0:50 / /run/rootfs1 rw,relatime shared:60 - overlay overlay rw,lowerdir=/snapshots/2/fs:/snapshots/1/fs,upperdir=/snapshots/3/fs,workdir=/snapshots/3/work
+101 22 0:51 / /run/root\040fs2 rw,relatime - overlay overlay rw,lowerdir=/snap\040shots/1/fs
+102 22 0:52 / /run/bind rw,relatime - ext4 /dev/sda1 rw
+`
+	for _, tt := range []struct {
+		mountpoint string
+		want       []string
+	}{
+		{"/run/rootfs1", []string{"/snapshots/2/fs", "/snapshots/1/fs"}},
+		{"/run/root fs2", []string{"/snap shots/1/fs"}},
+		{"/run/bind", nil},
+		{"/run/none", nil},
+	} {
+		got, err := OverlayLowerDirs(strings.NewReader(mountinfo), tt.mountpoint)
+		if err != nil {
+			t.Fatalf("failed to parse mountinfo: %v", err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("lower dirs of %q = %v; want %v", tt.mountpoint, got, tt.want)
+		}
+	}
+}
+
+func TestMarkovPredictor(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testmarkov")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	p, err := NewMarkovPredictor(tmp, 3)
+	if err != nil {
+		t.Fatalf("failed to make predictor: %v", err)
+	}
+	layer := digest.FromString("layer")
+	if got := p.Predict(layer, "/bin/sh"); got != nil {
+		t.Fatalf("nothing must be predicted before learning: %v", got)
+	}
+
+	// Learn from prior mounts.
+	mounts := [][]string{
+		{"/bin/sh", "/etc/profile", "/app/main", "/app/lib.so", "/app/data"},
+		{"/bin/sh", "/etc/profile", "/app/main", "/app/lib.so", "/app/data"},
+		{"/bin/sh", "/etc/hosts"},
+	}
+	for _, m := range mounts {
+		for _, f := range m {
+			p.Observe(layer, f)
+		}
+		if err := p.Flush(layer); err != nil {
+			t.Fatalf("failed to flush: %v", err)
+		}
+	}
+
+	// The model must survive restarts.
+	p, err = NewMarkovPredictor(tmp, 3)
+	if err != nil {
+		t.Fatalf("failed to make predictor: %v", err)
+	}
+	for _, tt := range []struct {
+		path string
+		want []string
+	}{
+		{"/bin/sh", []string{"/etc/profile", "/etc/hosts", "/app/main"}},
+		{"/app/main", []string{"/app/lib.so", "/app/data"}},
+		{"/app/data", nil},
+		{"/unknown", nil},
+	} {
+		if got := p.Predict(layer, tt.path); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("prediction after %q = %v; want %v", tt.path, got, tt.want)
+		}
+	}
+	if got := p.Predict(digest.FromString("other"), "/bin/sh"); got != nil {
+		t.Errorf("models must be separated by layers: %v", got)
+	}
+	if err := p.Flush(digest.Digest("../../evil")); err != nil {
+		t.Errorf("flushing unknown layer must be no-op: %v", err)
+	}
+}
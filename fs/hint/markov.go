@@ -0,0 +1,222 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package hint
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultMaxPredictions = 8
+	maxMarkovStates       = 10000
+	maxMarkovSuccessors   = 16
+
+	// Successors less likely than this aren't predicted.
+	minPredictProbability = 0.1
+)
+
+// MarkovPredictor predicts the files accessed next using a first-order Markov
+// chain of file accesses. The model is learned per layer from accesses during
+// prior mounts of the layer on the node and persisted in a directory.
+type MarkovPredictor struct {
+	dir            string
+	maxPredictions int
+	models         map[digest.Digest]*markovModel
+	mu             sync.Mutex
+}
+
+type markovModel struct {
+	// Transitions counts accesses to the file (value's key) just after the
+	// access to the other file (key).
+	Transitions map[string]map[string]int `json:"transitions"`
+
+	last string
+}
+
+// NewMarkovPredictor returns a predictor which stores the models in dir.
+// maxPredictions is the maximum number of files returned by a prediction. Zero
+// means the default (8).
+func NewMarkovPredictor(dir string, maxPredictions int) (*MarkovPredictor, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "failed to create model directory %q", dir)
+	}
+	if maxPredictions <= 0 {
+		maxPredictions = defaultMaxPredictions
+	}
+	return &MarkovPredictor{
+		dir:            dir,
+		maxPredictions: maxPredictions,
+		models:         make(map[digest.Digest]*markovModel),
+	}, nil
+}
+
+// Observe learns the access to the file in the layer.
+func (p *MarkovPredictor) Observe(layer digest.Digest, path string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m := p.model(layer)
+	if m.last != "" && m.last != path {
+		next, ok := m.Transitions[m.last]
+		if !ok && len(m.Transitions) < maxMarkovStates {
+			next = make(map[string]int)
+			m.Transitions[m.last] = next
+		}
+		if next != nil {
+			if _, ok := next[path]; !ok && len(next) >= maxMarkovSuccessors {
+				evictLeastLikely(next)
+			}
+			next[path]++
+		}
+	}
+	m.last = path
+}
+
+// Predict returns files likely accessed after the file, most likely first. The
+// prediction follows the most likely successors so it can include files more
+// than one access ahead.
+func (p *MarkovPredictor) Predict(layer digest.Digest, path string) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m := p.model(layer)
+	var res []string
+	seen := map[string]struct{}{path: {}}
+	add := func(f string) {
+		if _, ok := seen[f]; !ok {
+			seen[f] = struct{}{}
+			res = append(res, f)
+		}
+	}
+	for _, f := range likelySuccessors(m.Transitions[path]) {
+		if len(res) >= p.maxPredictions {
+			return res
+		}
+		add(f)
+	}
+	// Follow the chain of the most likely successors. The number of steps is
+	// bounded because the chain can be a cycle.
+	cur := path
+	for i := 0; i < 2*p.maxPredictions && len(res) < p.maxPredictions; i++ {
+		succ := likelySuccessors(m.Transitions[cur])
+		if len(succ) == 0 {
+			break
+		}
+		cur = succ[0]
+		add(cur)
+	}
+	return res
+}
+
+// Flush persists the model of the layer and drops it from the memory. The next
+// access to the layer loads the model again and starts a new access sequence.
+func (p *MarkovPredictor) Flush(layer digest.Digest) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m, ok := p.models[layer]
+	if !ok {
+		return nil
+	}
+	delete(p.models, layer)
+	path, err := p.path(layer)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(p.dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "failed to write %q", tmp.Name())
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (p *MarkovPredictor) model(layer digest.Digest) *markovModel {
+	if m, ok := p.models[layer]; ok {
+		return m
+	}
+	m := &markovModel{}
+	if path, err := p.path(layer); err == nil {
+		if data, err := ioutil.ReadFile(path); err == nil {
+			if err := json.Unmarshal(data, m); err != nil {
+				m = &markovModel{} // broken model; start over
+			}
+		}
+	}
+	if m.Transitions == nil {
+		m.Transitions = make(map[string]map[string]int)
+	}
+	p.models[layer] = m
+	return m
+}
+
+func (p *MarkovPredictor) path(layer digest.Digest) (string, error) {
+	if err := layer.Validate(); err != nil {
+		return "", errors.Wrapf(err, "invalid layer digest %q", layer)
+	}
+	return filepath.Join(p.dir, layer.Algorithm().String()+"-"+layer.Encoded()+".json"), nil
+}
+
+// likelySuccessors returns successors which are likely enough, most likely first.
+func likelySuccessors(next map[string]int) []string {
+	var total int
+	for _, c := range next {
+		total += c
+	}
+	var res []string
+	for f, c := range next {
+		if float64(c)/float64(total) >= minPredictProbability {
+			res = append(res, f)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if next[res[i]] != next[res[j]] {
+			return next[res[i]] > next[res[j]]
+		}
+		return res[i] < res[j]
+	})
+	return res
+}
+
+func evictLeastLikely(next map[string]int) {
+	var (
+		min    string
+		minCnt int
+	)
+	for f, c := range next {
+		if min == "" || c < minCnt || (c == minCnt && f > min) {
+			min, minCnt = f, c
+		}
+	}
+	delete(next, min)
+}
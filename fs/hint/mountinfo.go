@@ -0,0 +1,75 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package hint
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// OverlayLowerDirs returns lower directories of the overlayfs mounted on the
+// mountpoint, from the top to the bottom. mountinfo is formatted as
+// /proc/<pid>/mountinfo. This returns nil if the mountpoint isn't an overlayfs.
+func OverlayLowerDirs(mountinfo io.Reader, mountpoint string) ([]string, error) {
+	var lowers []string
+	s := bufio.NewScanner(mountinfo)
+	for s.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - overlay overlay rw,lowerdir=...
+		fields := strings.Fields(s.Text())
+		if len(fields) < 5 || unescapeMountinfo(fields[4]) != mountpoint {
+			continue
+		}
+		lowers = nil // The latest mount on the mountpoint wins.
+		i := 6
+		for i < len(fields) && fields[i] != "-" {
+			i++
+		}
+		if i+3 >= len(fields) || fields[i+1] != "overlay" {
+			continue
+		}
+		for _, opt := range strings.Split(fields[i+3], ",") {
+			if strings.HasPrefix(opt, "lowerdir=") {
+				for _, d := range strings.Split(strings.TrimPrefix(opt, "lowerdir="), ":") {
+					lowers = append(lowers, unescapeMountinfo(d))
+				}
+			}
+		}
+	}
+	return lowers, s.Err()
+}
+
+// unescapeMountinfo decodes octal escapes (e.g. "\040" for a space) used in
+// mountinfo.
+func unescapeMountinfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,152 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package hint learns which files containers access during startup and stores
+// them per layer so that following mounts of the layer can prefetch these files
+// even if the image isn't optimized.
+package hint
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// MaxHints is the maximum number of files recorded per layer.
+const MaxHints = 1000
+
+// Store persists access sequences of layers in a directory.
+type Store struct {
+	dir string
+}
+
+// NewStore returns a store on the specified directory.
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "failed to create hint directory %q", dir)
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Load returns the paths of files in the order of the first access recorded for
+// the layer. This returns nil if nothing is recorded.
+func (s *Store) Load(layer digest.Digest) ([]string, error) {
+	p, err := s.path(layer)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var paths []string
+	if err := json.Unmarshal(data, &paths); err != nil {
+		return nil, errors.Wrapf(err, "broken hints of %q", layer)
+	}
+	return paths, nil
+}
+
+// Save records the access sequence of the layer, replacing the previous one.
+func (s *Store) Save(layer digest.Digest, paths []string) error {
+	p, err := s.path(layer)
+	if err != nil {
+		return err
+	}
+	if len(paths) > MaxHints {
+		paths = paths[:MaxHints]
+	}
+	data, err := json.Marshal(paths)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(s.dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "failed to write %q", tmp.Name())
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (s *Store) path(layer digest.Digest) (string, error) {
+	if err := layer.Validate(); err != nil {
+		return "", errors.Wrapf(err, "invalid layer digest %q", layer)
+	}
+	return filepath.Join(s.dir, layer.Algorithm().String()+"-"+layer.Encoded()+".json"), nil
+}
+
+// LayerFiles returns the files of layers in the directory of a Store or a
+// MarkovPredictor keyed by the layer digests. Other files are ignored.
+func LayerFiles(dir string) (map[digest.Digest]string, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	files := make(map[digest.Digest]string)
+	for _, fi := range fis {
+		name := strings.TrimSuffix(fi.Name(), ".json")
+		i := strings.Index(name, "-")
+		if fi.IsDir() || name == fi.Name() || i < 0 {
+			continue
+		}
+		dgst := digest.NewDigestFromEncoded(digest.Algorithm(name[:i]), name[i+1:])
+		if dgst.Validate() == nil {
+			files[dgst] = filepath.Join(dir, fi.Name())
+		}
+	}
+	return files, nil
+}
+
+// Recorder records the first access of each file in order.
+type Recorder struct {
+	paths []string
+	seen  map[string]struct{}
+}
+
+// NewRecorder returns an empty recorder.
+func NewRecorder() *Recorder {
+	return &Recorder{seen: make(map[string]struct{})}
+}
+
+// Record records an access to the file. Accesses to already recorded files and
+// accesses exceeding MaxHints are ignored.
+func (r *Recorder) Record(path string) {
+	if _, ok := r.seen[path]; ok || len(r.paths) >= MaxHints {
+		return
+	}
+	r.seen[path] = struct{}{}
+	r.paths = append(r.paths, path)
+}
+
+// Paths returns the recorded paths in the order of the first access.
+func (r *Recorder) Paths() []string {
+	return r.paths
+}
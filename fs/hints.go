@@ -0,0 +1,223 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/hint"
+	"github.com/containerd/stargz-snapshotter/fs/reader"
+	"github.com/golang/groupcache/lru"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultAccessHintsLearnWindowSec = 60
+	maxCachedRoots                   = 1000
+	hintPrefetchBufSize              = 1 << 20
+)
+
+// accessHinter learns which files containers access during the first period
+// after mounting a layer and stores them as hints of the layer. On the following
+// mounts of the layer, the hinted files are prefetched in the order of the
+// accesses. Accesses are observed by eBPF so they are visible even if they hit
+// the kernel's page cache.
+type accessHinter struct {
+	fs       *filesystem
+	store    *hint.Store
+	tracer   *hint.Tracer
+	window   time.Duration
+	sessions map[string]*learnSession // mountpoint -> session
+	roots    *lru.Cache               // root of processes -> lower dirs of the rootfs
+	mu       sync.Mutex
+}
+
+type learnSession struct {
+	l   *layer
+	rec *hint.Recorder
+}
+
+func newAccessHinter(fs *filesystem, dir string, window time.Duration) (*accessHinter, error) {
+	store, err := hint.NewStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	h := &accessHinter{
+		fs:       fs,
+		store:    store,
+		window:   window,
+		sessions: make(map[string]*learnSession),
+		roots:    lru.New(maxCachedRoots),
+	}
+	if h.tracer, err = hint.NewTracer(h.onAccess); err != nil {
+		return nil, errors.Wrap(err, "failed to start eBPF tracer")
+	}
+	return h, nil
+}
+
+// learn records accesses to the layer mounted on the mountpoint for the learning
+// window.
+func (h *accessHinter) learn(ctx context.Context, mountpoint string, l *layer) {
+	sess := &learnSession{l: l, rec: hint.NewRecorder()}
+	h.mu.Lock()
+	h.sessions[mountpoint] = sess
+	h.mu.Unlock()
+	time.AfterFunc(h.window, func() {
+		h.finish(ctx, mountpoint, sess)
+	})
+}
+
+// stop finishes learning on the mountpoint, if any.
+func (h *accessHinter) stop(ctx context.Context, mountpoint string) {
+	h.mu.Lock()
+	sess := h.sessions[mountpoint]
+	h.mu.Unlock()
+	if sess != nil {
+		h.finish(ctx, mountpoint, sess)
+	}
+}
+
+func (h *accessHinter) finish(ctx context.Context, mountpoint string, sess *learnSession) {
+	h.mu.Lock()
+	if h.sessions[mountpoint] != sess {
+		h.mu.Unlock()
+		return // already finished
+	}
+	delete(h.sessions, mountpoint)
+	paths := sess.rec.Paths()
+	h.mu.Unlock()
+	if len(paths) == 0 {
+		return
+	}
+	if err := h.store.Save(sess.l.desc.Digest, paths); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to save access hints")
+		return
+	}
+	log.G(ctx).Debugf("learned %d files accessed during startup", len(paths))
+}
+
+// onAccess attributes the file access to the top-most layer which contains the
+// file in the rootfs of the process.
+func (h *accessHinter) onAccess(ev hint.AccessEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.sessions) == 0 {
+		return
+	}
+	var lowers []string
+	if v, ok := h.roots.Get(ev.Root); ok {
+		lowers = v.([]string)
+	} else {
+		f, err := os.Open("/proc/self/mountinfo")
+		if err != nil {
+			return
+		}
+		lowers, err = hint.OverlayLowerDirs(f, ev.Root)
+		f.Close()
+		if err != nil {
+			return
+		}
+		h.roots.Add(ev.Root, lowers)
+	}
+	for _, d := range lowers {
+		if sess, ok := h.sessions[d]; ok {
+			lr, err := sess.l.reader()
+			if err != nil {
+				return
+			}
+			if e, ok := lr.Lookup(ev.Path); ok {
+				if e.Type == "reg" {
+					// Lookup resolves hardlinks so accesses through any name
+					// of the file are recorded as the same path.
+					sess.rec.Record("/" + e.Name)
+				}
+				return
+			}
+			continue
+		}
+		h.fs.layerMu.Lock()
+		l := h.fs.layer[d]
+		h.fs.layerMu.Unlock()
+		if l != nil {
+			if lr, err := l.reader(); err == nil {
+				if _, ok := lr.Lookup(ev.Path); ok {
+					return // provided by a layer not being learned
+				}
+			}
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(d, ev.Path)); err == nil {
+			return // provided by a non-lazy layer
+		}
+	}
+}
+
+// prefetch fetches files hinted for the layer in the order of the accesses.
+// Layers optimized with prefetch landmarks are skipped.
+func (h *accessHinter) prefetch(ctx context.Context, l *layer) error {
+	lr, err := l.reader()
+	if err != nil {
+		return err
+	}
+	if _, ok := lr.Lookup(estargz.PrefetchLandmark); ok {
+		return nil
+	} else if _, ok := lr.Lookup(estargz.NoPrefetchLandmark); ok {
+		return nil
+	}
+	paths, err := h.store.Load(l.desc.Digest)
+	if err != nil || len(paths) == 0 {
+		return err
+	}
+	buf := make([]byte, hintPrefetchBufSize)
+	var n int
+	for _, p := range paths {
+		if e, ok := lr.Lookup(p); !ok || e.Type != "reg" {
+			continue
+		}
+		if err := fetchFile(lr, p, buf); err != nil {
+			log.G(ctx).WithError(err).Debugf("failed to prefetch hinted file %q", p)
+			continue
+		}
+		n++
+	}
+	log.G(ctx).Debugf("prefetched %d hinted files", n)
+	return nil
+}
+
+// fetchFile reads the whole contents of the file so that they are cached.
+func fetchFile(lr reader.Reader, name string, buf []byte) error {
+	ra, err := lr.OpenFile(name)
+	if err != nil {
+		return err
+	}
+	for off := int64(0); ; {
+		m, err := ra.ReadAt(buf, off)
+		off += int64(m)
+		if err == io.EOF || (err == nil && m == 0) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
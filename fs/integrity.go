@@ -0,0 +1,59 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/stargz-snapshotter/fs/reader"
+)
+
+// defaultQuarantineThreshold is the default number of verification failures
+// of a cached chunk after which the chunk is quarantined.
+const defaultQuarantineThreshold = 3
+
+// IntegrityReporter reports chunks read from the filesystem cache which failed
+// verification. The filesystem returned by NewFilesystem implements this
+// interface.
+type IntegrityReporter interface {
+	IntegrityStats(ctx context.Context) reader.IntegrityStats
+}
+
+var _ = (IntegrityReporter)((*filesystem)(nil))
+
+// IntegrityStats returns the statistics of corrupted and quarantined chunks.
+// This is empty unless `chunk_integrity.verify_cache` is enabled.
+func (fs *filesystem) IntegrityStats(ctx context.Context) reader.IntegrityStats {
+	return fs.chunkQuarantine.Stats()
+}
+
+// newChunkQuarantine returns the quarantine shared among layers, which logs
+// corrupted chunks.
+func newChunkQuarantine(threshold int) *reader.ChunkQuarantine {
+	if threshold == 0 {
+		threshold = defaultQuarantineThreshold
+	}
+	return reader.NewChunkQuarantine(threshold, func(key string, quarantined bool) {
+		l := log.L.WithField("key", key)
+		if quarantined {
+			l.Warn("cached chunk is corrupted repeatedly; quarantined")
+			return
+		}
+		l.Warn("cached chunk is corrupted; refetching")
+	})
+}
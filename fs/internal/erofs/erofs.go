@@ -0,0 +1,84 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package erofs contains the on-disk constants of EROFS shared by the image
+// writers and readers of this repository. These are defined in
+// fs/erofs/erofs_fs.h in the kernel.
+package erofs
+
+import "syscall"
+
+const (
+	SuperOffset = 1024
+	SuperSize   = 128
+	Magic       = 0xE0F5E1E2
+
+	InodeSize    = 64 // extended inode
+	SlotSize     = 32 // unit of nid
+	DirentSize   = 12
+	XattrHdrSize = 12
+	NullAddr     = 0xFFFFFFFF
+
+	FeatureIncompatChunkedFile = 0x4
+	FeatureIncompatDeviceTable = 0x8
+	DeviceSlotSize             = 128
+
+	LayoutFlatPlain  = 0
+	LayoutFlatInline = 2
+	LayoutChunkBased = 4
+
+	ChunkFormatBlkbitsMask = 0x1f
+	ChunkFormatIndexes     = 0x20
+)
+
+// File types in directory entries.
+const (
+	FTRegFile = 1
+	FTDir     = 2
+	FTChrdev  = 3
+	FTBlkdev  = 4
+	FTFifo    = 5
+	FTSock    = 6
+	FTSymlink = 7
+)
+
+// FileType returns the file type stored in directory entries for the mode.
+// 0 is returned for unknown types.
+func FileType(mode uint32) uint8 {
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFREG:
+		return FTRegFile
+	case syscall.S_IFDIR:
+		return FTDir
+	case syscall.S_IFCHR:
+		return FTChrdev
+	case syscall.S_IFBLK:
+		return FTBlkdev
+	case syscall.S_IFIFO:
+		return FTFifo
+	case syscall.S_IFSOCK:
+		return FTSock
+	case syscall.S_IFLNK:
+		return FTSymlink
+	}
+	return 0
+}
+
+// EncodeDev encodes the device number in the same manner as new_encode_dev()
+// of the kernel. This is also the encoding used by squashfs.
+func EncodeDev(major, minor uint32) uint32 {
+	return (minor & 0xff) | (major << 8) | ((minor &^ 0xff) << 12)
+}
@@ -0,0 +1,149 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/stargz-snapshotter/cache"
+	"github.com/containerd/stargz-snapshotter/fs/remote"
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+)
+
+// CacheInvalidator drops cached contents of layers. The filesystem returned by
+// NewFilesystem implements this interface.
+type CacheInvalidator interface {
+	InvalidateLayerCache(ctx context.Context, digest string) error
+}
+
+var _ = (CacheInvalidator)((*filesystem)(nil))
+
+// InvalidateLayerCache drops cached chunks and the cached resolution result
+// (including TOC) of the specified layer. Contents of the layer are fetched from
+// the registry again on the next access and the next mount of the layer resolves
+// it from scratch. This is useful for recovering from corrupted data served by
+// a registry (mirror) without restarting the node.
+func (fs *filesystem) InvalidateLayerCache(ctx context.Context, digest string) error {
+	return fs.invalidateLayer(ctx, digest, nil)
+}
+
+// invalidateLayer drops caches of the layer except chunks for which keepChunk
+// returns true (e.g. chunks shared with other layers).
+func (fs *filesystem) invalidateLayer(ctx context.Context, digest string, keepChunk func(id string) bool) error {
+	var layers []*layer
+	fs.layerMu.Lock()
+	for _, l := range fs.layer {
+		if l.desc.Digest.String() == digest {
+			layers = append(layers, l)
+		}
+	}
+	fs.layerMu.Unlock()
+
+	fs.metadata.forget(digest)
+	if fs.pins != nil {
+		if err := fs.pins.unmaterialize(digest); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to record unmaterialized layer")
+		}
+	}
+
+	var blobs []remote.Blob
+	for _, name := range fs.takeResolvedNames(digest) {
+		fs.resolveResultMu.Lock()
+		if c, ok := fs.resolveResult.Get(name); ok {
+			layers = append(layers, c.(*layer))
+			fs.resolveResult.Remove(name)
+		}
+		fs.resolveResultMu.Unlock()
+		fs.blobResultMu.Lock()
+		if c, ok := fs.blobResult.Get(name); ok {
+			blobs = append(blobs, c.(remote.Blob))
+			fs.blobResult.Remove(name)
+		}
+		fs.blobResultMu.Unlock()
+		fs.resolveG.Forget(name)
+	}
+	if len(layers) == 0 && len(blobs) == 0 {
+		return errors.Wrapf(errdefs.ErrNotFound, "layer %q isn't known", digest)
+	}
+
+	var rErr error
+	rc, ok := fs.fsCache.(cache.Remover)
+	if !ok {
+		return fmt.Errorf("filesystem cache doesn't support removing contents")
+	}
+	visited := make(map[interface{}]struct{})
+	for _, l := range layers {
+		blobs = append(blobs, l.blob)
+		if _, ok := visited[l]; ok {
+			continue
+		}
+		visited[l] = struct{}{}
+		if err := l.verifiableReader.ForeachChunk(func(id string, _ int64) {
+			if keepChunk != nil && keepChunk(id) {
+				return
+			}
+			if err := rc.Remove(id); err != nil {
+				rErr = multierror.Append(rErr, err)
+			}
+		}); err != nil {
+			rErr = multierror.Append(rErr, err)
+		}
+		l.unmaterialize()
+	}
+	for _, b := range blobs {
+		if _, ok := visited[b]; ok {
+			continue
+		}
+		visited[b] = struct{}{}
+		if err := b.Invalidate(); err != nil {
+			rErr = multierror.Append(rErr, err)
+		}
+	}
+	if rErr != nil {
+		return errors.Wrapf(rErr, "failed to invalidate cache of layer %q", digest)
+	}
+	log.G(ctx).WithField("digest", digest).Info("invalidated layer cache")
+	return nil
+}
+
+// addResolvedName records the name of the resolution result of the layer so
+// that the result can be found by the layer digest.
+func (fs *filesystem) addResolvedName(digest, name string) {
+	fs.resolvedNamesMu.Lock()
+	defer fs.resolvedNamesMu.Unlock()
+	if fs.resolvedNames == nil {
+		fs.resolvedNames = make(map[string]map[string]struct{})
+	}
+	if fs.resolvedNames[digest] == nil {
+		fs.resolvedNames[digest] = make(map[string]struct{})
+	}
+	fs.resolvedNames[digest][name] = struct{}{}
+}
+
+func (fs *filesystem) takeResolvedNames(digest string) (names []string) {
+	fs.resolvedNamesMu.Lock()
+	defer fs.resolvedNamesMu.Unlock()
+	for name := range fs.resolvedNames[digest] {
+		names = append(names, name)
+	}
+	delete(fs.resolvedNames, digest)
+	return
+}
@@ -0,0 +1,92 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"sort"
+)
+
+// ImageCache is how warm the cache of an image mounted on this node is.
+// Schedulers can prefer nodes with warm caches for the image by matching the
+// reference or the layer digests.
+type ImageCache struct {
+	Ref            string       `json:"ref"`
+	Layers         []LayerCache `json:"layers"`
+	Size           int64        `json:"size"`
+	FetchedSize    int64        `json:"fetchedSize"`
+	FetchedPercent float64      `json:"fetchedPercent"` // FetchedSize / Size * 100.0
+}
+
+// LayerCache is how much of a layer is in the cache.
+type LayerCache struct {
+	Digest       string `json:"digest"`
+	Size         int64  `json:"size"`
+	FetchedSize  int64  `json:"fetchedSize"`
+	Materialized bool   `json:"materialized"`
+}
+
+// CacheInventoryReporter reports the caches of images mounted on this node.
+// The filesystem returned by NewFilesystem implements this interface.
+type CacheInventoryReporter interface {
+	CacheInventory(ctx context.Context) []ImageCache
+}
+
+var _ = (CacheInventoryReporter)((*filesystem)(nil))
+
+// CacheInventory returns the caches of images which have mounted layers, sorted
+// by the reference. A layer shared among images is counted for each image.
+func (fs *filesystem) CacheInventory(ctx context.Context) []ImageCache {
+	images := make(map[string]*ImageCache)
+	seen := make(map[string]map[string]struct{}) // ref -> layer digests
+	fs.layerMu.Lock()
+	for mp, l := range fs.layer {
+		ref := fs.mountRefs[mp]
+		d := l.desc.Digest.String()
+		if _, ok := seen[ref][d]; ok {
+			continue
+		}
+		img, ok := images[ref]
+		if !ok {
+			img = &ImageCache{Ref: ref}
+			images[ref] = img
+			seen[ref] = make(map[string]struct{})
+		}
+		seen[ref][d] = struct{}{}
+		lc := LayerCache{
+			Digest:       d,
+			Size:         l.blob.Size(),
+			FetchedSize:  l.blob.FetchedSize(),
+			Materialized: l.isMaterialized(),
+		}
+		img.Layers = append(img.Layers, lc)
+		img.Size += lc.Size
+		img.FetchedSize += lc.FetchedSize
+	}
+	fs.layerMu.Unlock()
+
+	res := []ImageCache{}
+	for _, img := range images {
+		if img.Size > 0 {
+			img.FetchedPercent = float64(img.FetchedSize) / float64(img.Size) * 100.0
+		}
+		sort.Slice(img.Layers, func(i, j int) bool { return img.Layers[i].Digest < img.Layers[j].Digest })
+		res = append(res, *img)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Ref < res[j].Ref })
+	return res
+}
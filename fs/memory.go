@@ -0,0 +1,205 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/stargz-snapshotter/cache"
+)
+
+const (
+	defaultMemoryCheckIntervalSec = 10
+
+	// memoryLowWatermarkPercent is the usage of the memory budget where the
+	// reclamation stops.
+	memoryLowWatermarkPercent = 90
+)
+
+// MemoryReporter reports the memory used by the filesystem. The filesystem
+// returned by NewFilesystem implements this interface.
+type MemoryReporter interface {
+	MemoryStats(ctx context.Context) MemoryStats
+}
+
+var _ = (MemoryReporter)((*filesystem)(nil))
+
+// MemoryStats is the memory used by the filesystem.
+type MemoryStats struct {
+	// Budget is the memory budget of the filesystem. 0 means no budget.
+	Budget int64 `json:"budget"`
+
+	// RSS is the resident set size of the process.
+	RSS int64 `json:"rss"`
+
+	// Metadata is the estimated size of the metadata (parsed TOC) of layers.
+	Metadata int64 `json:"metadata"`
+
+	// Chunks is the size of contents held in the memory caches.
+	Chunks int64 `json:"chunks"`
+
+	// Reclaims is the number of times the memory was reclaimed for the budget.
+	Reclaims int64 `json:"reclaims"`
+
+	// Layers is the memory used per layer in descending order.
+	Layers []LayerMemoryStats `json:"layers"`
+}
+
+// LayerMemoryStats is the memory used for a layer.
+type LayerMemoryStats struct {
+	Digest   string `json:"digest"`
+	Metadata int64  `json:"metadata"`
+
+	// Refs is the number of mounts and resolution results referring to the
+	// metadata.
+	Refs int `json:"refs"`
+}
+
+// MemoryStats returns the memory used by the metadata and the memory caches.
+func (fs *filesystem) MemoryStats(ctx context.Context) MemoryStats {
+	s := MemoryStats{RSS: processRSS()}
+	if g := fs.memGuard; g != nil {
+		s.Budget = g.budget
+		s.Chunks = g.chunks()
+		s.Reclaims = atomic.LoadInt64(&g.reclaims)
+	}
+	s.Metadata, s.Layers = fs.metadata.stats()
+	sort.Slice(s.Layers, func(i, j int) bool {
+		return s.Layers[i].Metadata > s.Layers[j].Metadata
+	})
+	return s
+}
+
+// memoryGuard keeps the memory used by the filesystem within the budget. When
+// the accounted memory or RSS of the process exceeds the budget, contents in
+// the memory caches and then least recently used resolution results (and their
+// metadata) are dropped until the usage gets below the low watermark.
+type memoryGuard struct {
+	fs       *filesystem
+	budget   int64
+	caches   []cache.MemoryReclaimer
+	mu       sync.Mutex
+	reclaims int64
+}
+
+func newMemoryGuard(fs *filesystem, budget int64, caches ...cache.BlobCache) *memoryGuard {
+	g := &memoryGuard{fs: fs, budget: budget}
+	for _, c := range caches {
+		if mr, ok := c.(cache.MemoryReclaimer); ok {
+			g.caches = append(g.caches, mr)
+		}
+	}
+	return g
+}
+
+func (g *memoryGuard) chunks() (n int64) {
+	for _, c := range g.caches {
+		n += c.MemoryUsage()
+	}
+	return n
+}
+
+// usage returns the larger of the accounted memory and RSS.
+func (g *memoryGuard) usage() int64 {
+	metadata, _ := g.fs.metadata.stats()
+	usage := metadata + g.chunks()
+	if rss := processRSS(); rss > usage {
+		usage = rss
+	}
+	return usage
+}
+
+// run checks the memory usage at the interval.
+func (g *memoryGuard) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		g.enforce(ctx)
+	}
+}
+
+// enforce reclaims the memory if the usage exceeds the budget.
+func (g *memoryGuard) enforce(ctx context.Context) {
+	if g == nil || g.budget <= 0 || g.usage() <= g.budget {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	usage := g.usage() // might be reclaimed by others
+	if usage <= g.budget {
+		return
+	}
+	atomic.AddInt64(&g.reclaims, 1)
+	target := g.budget * memoryLowWatermarkPercent / 100
+	log.G(ctx).WithField("usage", usage).WithField("budget", g.budget).Warn("memory budget exceeded; reclaiming memory")
+
+	// Contents in the memory caches can be read from the disk again.
+	for _, c := range g.caches {
+		if usage <= target {
+			break
+		}
+		usage -= c.ReclaimMemory(usage - target)
+	}
+	// Drop resolution results whose metadata can be built again as needed.
+	// Metadata of mounted layers remain in use.
+	for usage > target {
+		g.fs.resolveResultMu.Lock()
+		n := g.fs.resolveResult.Len()
+		if n > 0 {
+			g.fs.resolveResult.RemoveOldest()
+		}
+		g.fs.resolveResultMu.Unlock()
+		if n == 0 {
+			break
+		}
+		metadata, _ := g.fs.metadata.stats()
+		usage = metadata + g.chunks()
+	}
+	// Return the freed memory to the OS so that RSS drops.
+	debug.FreeOSMemory()
+	if usage = g.usage(); usage > g.budget {
+		log.G(ctx).WithField("usage", usage).WithField("budget", g.budget).
+			Warn("memory is still over budget; metadata of mounted layers can't be dropped")
+	}
+}
+
+// processRSS returns the resident set size of the process. 0 if unknown.
+func processRSS() int64 {
+	b, err := ioutil.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) < 2 {
+		return 0
+	}
+	pages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return pages * int64(os.Getpagesize())
+}
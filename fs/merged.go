@@ -0,0 +1,324 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// mergedDirOf returns the directory where the merged view of the layer on the
+// mountpoint and its lower layers is mounted. The layers under a layer are
+// fixed so the view is identified by the uppermost layer and the number of
+// the layers.
+func mergedDirOf(mountpoint string, layers int) string {
+	return fmt.Sprintf("%s.merged.%d", mountpoint, layers)
+}
+
+// MergedView mounts a single directory presenting the merged tree of the
+// layers mounted on the mountpoints (upper first) and returns it. Whiteouts
+// and opaque directories are resolved as overlayfs does. If lowest is false,
+// other layers are stacked under the view so whiteouts and opaque directories
+// hiding their entries are kept in the view. The view is unmounted when any
+// of the layers is unmounted.
+func (fs *filesystem) MergedView(ctx context.Context, mountpoints []string, lowest bool) (string, error) {
+	if len(mountpoints) == 0 {
+		return "", fmt.Errorf("no layer to merge")
+	}
+	if fs.dataOnly || fs.ublkSquashfs {
+		return "", fmt.Errorf("merged views aren't supported in this mode")
+	}
+	dir := mergedDirOf(mountpoints[0], len(mountpoints))
+
+	fs.mergedMu.Lock()
+	defer fs.mergedMu.Unlock()
+	if lowers, ok := fs.mergedViews[dir]; ok {
+		if strings.Join(lowers, ":") == strings.Join(mountpoints, ":") {
+			return dir, nil
+		}
+		return "", fmt.Errorf("%q is merged with other layers", mountpoints[0])
+	}
+
+	layers := make([]*node, len(mountpoints))
+	fs.layerMu.Lock()
+	for i, mp := range mountpoints {
+		l, ok := fs.layer[mp]
+		if !ok || l.root == nil {
+			fs.layerMu.Unlock()
+			return "", fmt.Errorf("%q isn't a mountpoint of a resolved layer", mp)
+		}
+		lr, err := l.reader()
+		if err != nil {
+			fs.layerMu.Unlock()
+			return "", err
+		}
+		layers[i] = &node{
+			fs:              fs,
+			layer:           lr,
+			e:               l.root,
+			s:               fs.newLayerState(l),
+			root:            mp,
+			openFlags:       fs.openFlags(ctx, nil),
+			streamThreshold: fs.streamThreshold(ctx, nil),
+		}
+	}
+	fs.layerMu.Unlock()
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	if err := fs.serve(ctx, dir, newMergedRoot(layers, lowest)); err != nil {
+		return "", err
+	}
+	fs.mergedViews[dir] = append([]string(nil), mountpoints...)
+	log.G(ctx).Debugf("mounted merged view of %d layers on %q", len(mountpoints), dir)
+	return dir, nil
+}
+
+// unmountMergedViews unmounts the merged views containing the layer on the
+// mountpoint.
+func (fs *filesystem) unmountMergedViews(ctx context.Context, mountpoint string) {
+	fs.mergedMu.Lock()
+	defer fs.mergedMu.Unlock()
+	for dir, lowers := range fs.mergedViews {
+		for _, mp := range lowers {
+			if mp != mountpoint {
+				continue
+			}
+			delete(fs.mergedViews, dir)
+			fs.fdBudget.Release(fuseFDOwner(dir), 1)
+			if err := syscall.Unmount(dir, syscall.MNT_FORCE); err != nil {
+				log.G(ctx).WithError(err).Warnf("failed to unmount merged view %q", dir)
+			}
+			break
+		}
+	}
+}
+
+// mergedEntry is an entry of the merged tree of layers.
+type mergedEntry struct {
+	e        *estargz.TOCEntry
+	layer    int                     // index of the layer providing the entry
+	children map[string]*mergedEntry // non-nil for directories
+
+	// whiteouts and opaque are the whiteouts and the opaqueness of the
+	// directory against the layers under the merged ones.
+	whiteouts map[string]*estargz.TOCEntry
+	opaque    bool
+}
+
+// mergeLayers merges the trees of the layers (upper first) as overlayfs does:
+// entries of upper layers hide the ones of lower layers, whiteouts remove the
+// entries of lower layers and opaque directories hide the contents of lower
+// layers. Attributes of a directory are the ones of the uppermost layer.
+// Whiteouts which aren't replaced by upper layers are recorded in directories
+// with their opaqueness so the result can be stacked on other layers.
+func mergeLayers(roots []*estargz.TOCEntry) *mergedEntry {
+	m := &mergedEntry{children: make(map[string]*mergedEntry)}
+	for i := len(roots) - 1; i >= 0; i-- {
+		mergeDir(m, roots[i], i)
+	}
+	return m
+}
+
+func mergeDir(m *mergedEntry, dir *estargz.TOCEntry, idx int) {
+	m.e, m.layer = dir, idx
+
+	// Whiteouts only apply to the lower layers so they are resolved before
+	// adding the entries of this layer.
+	dir.ForeachChild(func(baseName string, e *estargz.TOCEntry) bool {
+		if baseName == whiteoutOpaqueDir {
+			m.children = make(map[string]*mergedEntry)
+			m.whiteouts = nil
+			m.opaque = true
+		} else if strings.HasPrefix(baseName, whiteoutPrefix) {
+			name := baseName[len(whiteoutPrefix):]
+			delete(m.children, name)
+			if m.whiteouts == nil {
+				m.whiteouts = make(map[string]*estargz.TOCEntry)
+			}
+			m.whiteouts[name] = e
+		}
+		return true
+	})
+	dir.ForeachChild(func(baseName string, e *estargz.TOCEntry) bool {
+		if strings.HasPrefix(baseName, whiteoutPrefix) {
+			return true
+		}
+		// We don't want to show prefetch landmarks in "/".
+		if dir.Name == "" && estargz.IsLandmark(baseName) {
+			return true
+		}
+		_, whiteout := m.whiteouts[baseName]
+		delete(m.whiteouts, baseName)
+		if e.Type != "dir" {
+			m.children[baseName] = &mergedEntry{e: e, layer: idx}
+			return true
+		}
+		c, ok := m.children[baseName]
+		if !ok || c.children == nil {
+			// overlayfs doesn't merge a directory with the lower ones over a
+			// whiteout or a non-directory.
+			c = &mergedEntry{
+				children: make(map[string]*mergedEntry),
+				opaque:   whiteout || ok,
+			}
+			m.children[baseName] = c
+		}
+		mergeDir(c, e, idx)
+		return true
+	})
+}
+
+// mergedDir is a directory of a merged view. Other types of files are served
+// by the nodes of the layers providing them.
+type mergedDir struct {
+	fusefs.Inode
+	m      *mergedEntry
+	layers []*node // root nodes of the layers, upper first
+	lowest bool    // true if no layer is under the view
+}
+
+func newMergedRoot(layers []*node, lowest bool) *mergedDir {
+	roots := make([]*estargz.TOCEntry, len(layers))
+	for i, n := range layers {
+		roots[i] = n.e
+	}
+	return &mergedDir{m: mergeLayers(roots), layers: layers, lowest: lowest}
+}
+
+// opaque returns true if the directory needs to be indicated as opaque to
+// overlayfs.
+func (d *mergedDir) opaque() bool {
+	return !d.lowest && d.m.opaque
+}
+
+var _ = (fusefs.NodeReaddirer)((*mergedDir)(nil))
+
+func (d *mergedDir) Readdir(ctx context.Context) (fusefs.DirStream, syscall.Errno) {
+	ents := make([]fuse.DirEntry, 0, len(d.m.children))
+	for name, c := range d.m.children {
+		ents = append(ents, fuse.DirEntry{
+			Mode: modeOfEntry(c.e),
+			Name: name,
+			Ino:  inodeOfEnt(c.e),
+		})
+	}
+	if !d.lowest {
+		for name, wh := range d.m.whiteouts {
+			ents = append(ents, fuse.DirEntry{
+				Mode: syscall.S_IFCHR,
+				Name: name,
+				Ino:  inodeOfEnt(wh),
+			})
+		}
+	}
+	return fusefs.NewListDirStream(ents), 0
+}
+
+var _ = (fusefs.NodeLookuper)((*mergedDir)(nil))
+
+func (d *mergedDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	c, ok := d.m.children[name]
+	if !ok {
+		if wh, ok := d.m.whiteouts[name]; ok && !d.lowest {
+			return d.NewInode(ctx, &whiteout{
+				e: wh,
+			}, entryToWhAttr(wh, &out.Attr)), 0
+		}
+		return nil, syscall.ENOENT
+	}
+	attr := entryToAttr(c.e, &out.Attr)
+	if c.children != nil {
+		return d.NewInode(ctx, &mergedDir{m: c, layers: d.layers, lowest: d.lowest}, attr), 0
+	}
+	l := d.layers[c.layer]
+	l.atimes().setATime(c.e, &out.Attr)
+	return d.NewInode(ctx, &node{
+		fs:              l.fs,
+		layer:           l.layer,
+		e:               c.e,
+		s:               l.s,
+		root:            l.root,
+		openFlags:       l.openFlags,
+		streamThreshold: l.streamThreshold,
+	}, attr), 0
+}
+
+var _ = (fusefs.NodeGetattrer)((*mergedDir)(nil))
+
+func (d *mergedDir) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	entryToAttr(d.m.e, &out.Attr)
+	return 0
+}
+
+var _ = (fusefs.NodeGetxattrer)((*mergedDir)(nil))
+
+func (d *mergedDir) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	if d.opaque() && d.layers[0].isOpaqueXattr(attr) {
+		if len(dest) < len(opaqueXattrValue) {
+			return uint32(len(opaqueXattrValue)), syscall.ERANGE
+		}
+		return uint32(copy(dest, opaqueXattrValue)), 0
+	}
+	if isOverlayXattr(attr) {
+		return 0, syscall.ENODATA
+	}
+	if v, ok := d.m.e.Xattrs[attr]; ok {
+		if len(dest) < len(v) {
+			return uint32(len(v)), syscall.ERANGE
+		}
+		return uint32(copy(dest, v)), 0
+	}
+	return 0, syscall.ENODATA
+}
+
+var _ = (fusefs.NodeListxattrer)((*mergedDir)(nil))
+
+func (d *mergedDir) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	var attrs []byte
+	if d.opaque() {
+		for _, x := range d.layers[0].opaqueXattrs() {
+			attrs = append(attrs, []byte(x+"\x00")...)
+		}
+	}
+	for k := range d.m.e.Xattrs {
+		if isOverlayXattr(k) {
+			continue
+		}
+		attrs = append(attrs, []byte(k+"\x00")...)
+	}
+	if len(dest) < len(attrs) {
+		return uint32(len(attrs)), syscall.ERANGE
+	}
+	return uint32(copy(dest, attrs)), 0
+}
+
+var _ = (fusefs.NodeStatfser)((*mergedDir)(nil))
+
+func (d *mergedDir) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	defaultStatfs(out)
+	return 0
+}
@@ -0,0 +1,101 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/stargz-snapshotter/fs/remote"
+	"github.com/pkg/errors"
+)
+
+// CacheMirror gives read-only access to cached contents of layers, which can
+// be served to other nodes. The filesystem returned by NewFilesystem
+// implements this interface.
+type CacheMirror interface {
+	CachedLayer(ctx context.Context, digest string) (io.ReaderAt, int64, error)
+	LayerRepositories(digest string) []string
+}
+
+var _ = (CacheMirror)((*filesystem)(nil))
+
+// CachedLayer returns a reader of the blob of the layer and the size of the
+// blob. The reader never fetches contents from the registry; reads of regions
+// which aren't cached fail with errdefs.ErrNotFound. This also fails with
+// errdefs.ErrNotFound if the layer isn't known to this filesystem.
+func (fs *filesystem) CachedLayer(ctx context.Context, digest string) (io.ReaderAt, int64, error) {
+	var b remote.Blob
+	fs.layerMu.Lock()
+	for _, l := range fs.layer {
+		if l.desc.Digest.String() == digest {
+			b = l.blob
+			break
+		}
+	}
+	fs.layerMu.Unlock()
+	if b == nil {
+		if layers := fs.resolvedLayers(digest); len(layers) > 0 {
+			b = layers[0].blob
+		}
+	}
+	if b == nil {
+		return nil, 0, errors.Wrapf(errdefs.ErrNotFound, "layer %q isn't known", digest)
+	}
+	cr, ok := b.(remote.CachedReader)
+	if !ok {
+		return nil, 0, errors.Wrapf(errdefs.ErrNotImplemented, "blob of layer %q can't be read from the cache", digest)
+	}
+	return &cachedReaderAt{cr}, b.Size(), nil
+}
+
+// LayerRepositories returns the repositories (e.g. "docker.io/library/ubuntu")
+// which the layer has been resolved from.
+func (fs *filesystem) LayerRepositories(digest string) (repos []string) {
+	fs.resolvedNamesMu.Lock()
+	defer fs.resolvedNamesMu.Unlock()
+	seen := make(map[string]struct{})
+	for name := range fs.resolvedNames[digest] {
+		// name is "<image reference>/<layer digest>". See resolveLayer.
+		refspec, err := reference.Parse(strings.TrimSuffix(name, "/"+digest))
+		if err != nil {
+			continue
+		}
+		if _, ok := seen[refspec.Locator]; !ok {
+			seen[refspec.Locator] = struct{}{}
+			repos = append(repos, refspec.Locator)
+		}
+	}
+	sort.Strings(repos)
+	return
+}
+
+type cachedReaderAt struct {
+	cr remote.CachedReader
+}
+
+func (r *cachedReaderAt) ReadAt(p []byte, offset int64) (int, error) {
+	n, err := r.cr.ReadCachedAt(p, offset)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
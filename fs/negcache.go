@@ -0,0 +1,115 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const negativeCacheFileName = "non-estargz.json"
+
+// negativeCache persistently records layers which are known not to be eStargz
+// so that following mounts of these layers fail fast without resolving them
+// again. Each record expires after TTL because a layer can be served by another
+// (e.g. converted) blob after the record.
+type negativeCache struct {
+	path    string
+	ttl     time.Duration
+	entries map[string]time.Time // name -> expiration
+	mu      sync.Mutex
+	now     func() time.Time
+}
+
+func newNegativeCache(path string, ttl time.Duration) (*negativeCache, error) {
+	nc := &negativeCache{
+		path:    path,
+		ttl:     ttl,
+		entries: make(map[string]time.Time),
+		now:     time.Now,
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nc, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &nc.entries); err != nil {
+		// The record is only an optimization. Start over.
+		nc.entries = make(map[string]time.Time)
+	}
+	return nc, nil
+}
+
+// has returns true if the specified layer is recorded as non-eStargz and the
+// record hasn't expired.
+func (nc *negativeCache) has(name string) bool {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	exp, ok := nc.entries[name]
+	if !ok {
+		return false
+	}
+	if nc.now().After(exp) {
+		delete(nc.entries, name)
+		return false
+	}
+	return true
+}
+
+// add records the specified layer as non-eStargz.
+func (nc *negativeCache) add(name string) error {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	now := nc.now()
+	for n, exp := range nc.entries {
+		if now.After(exp) {
+			delete(nc.entries, n)
+		}
+	}
+	nc.entries[name] = now.Add(nc.ttl)
+	return nc.flushUnlocked()
+}
+
+func (nc *negativeCache) flushUnlocked() error {
+	data, err := json.Marshal(nc.entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(nc.path), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(nc.path), "tmp-"+negativeCacheFileName)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "failed to write %q", tmp.Name())
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), nc.path)
+}
@@ -0,0 +1,146 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/stargz-snapshotter/cache"
+	"github.com/containerd/stargz-snapshotter/fs/nydus"
+	"github.com/containerd/stargz-snapshotter/fs/remote"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// isNydusLayer returns true if the labels indicate that the layer is a part of
+// a Nydus image.
+func isNydusLayer(labels map[string]string) bool {
+	return labels[nydus.BootstrapLabel] == "true" || labels[nydus.BlobLabel] == "true"
+}
+
+// mountNydus mounts a layer of a Nydus image. The bootstrap layer, which is the
+// topmost layer of the image, is mounted with the whole filesystem of the image
+// and the contents of files are lazily read from the data blobs. Data blob
+// layers are mounted as empty layers.
+// The bootstrap layer is verified with its digest and chunks are verified with
+// their digests recorded in the bootstrap so TOC digests aren't needed.
+func (fs *filesystem) mountNydus(ctx context.Context, mountpoint string, labels map[string]string, src []source.Source, cacheOpts []cache.Option) error {
+	var (
+		l         *layer
+		lr        *nydus.Reader
+		bootstrap = labels[nydus.BootstrapLabel] == "true"
+		rErr      = fmt.Errorf("failed to resolve target")
+	)
+	for _, s := range src {
+		var err error
+		if l, lr, err = fs.resolveNydusLayer(ctx, s, bootstrap, cacheOpts); err == nil {
+			break
+		}
+		rErr = errors.Wrapf(rErr, "failed to resolve layer %q from %q: %v",
+			s.Target.Digest, s.Name, err)
+	}
+	if l == nil {
+		log.G(ctx).WithError(rErr).Debug("failed to resolve Nydus layer")
+		return errors.Wrap(rErr, "failed to resolve Nydus layer")
+	}
+	setQoSClass(ctx, l.blob, labels)
+
+	l.acquire()
+	fs.layerMu.Lock()
+	fs.layer[mountpoint] = l
+	fs.mountRefs[mountpoint] = src[0].Name.String()
+	fs.layerMu.Unlock()
+
+	// Prefetch the files listed in the prefetch table of the bootstrap. The first
+	// Check() for this layer waits for the prefetch completion.
+	if bootstrap && !fs.noprefetch {
+		go func() {
+			fs.backgroundTaskManager.DoPrioritizedTask()
+			defer fs.backgroundTaskManager.DonePrioritizedTask()
+			defer l.prefetchWaiter.done()
+			if err := lr.Prefetch(); err != nil {
+				log.G(ctx).WithError(err).Debug("failed to prefetch Nydus layer")
+				return
+			}
+			log.G(ctx).Debug("completed to prefetch")
+		}()
+	} else {
+		l.prefetchWaiter.done()
+	}
+
+	s := fs.newLayerState(l)
+	s.addDebugFile(l.desc.Digest.String()+".toc.json", lr.TOCJSON)
+	return fs.serve(ctx, mountpoint, &node{
+		fs:        fs,
+		layer:     lr,
+		e:         l.root,
+		s:         s,
+		root:      mountpoint,
+		openFlags: fs.openFlags(ctx, labels),
+	})
+}
+
+// resolveNydusLayer resolves the layer of a Nydus image. Data blobs referred by
+// the bootstrap are resolved on the first read of them.
+func (fs *filesystem) resolveNydusLayer(ctx context.Context, s source.Source, bootstrap bool, cacheOpts []cache.Option) (*layer, *nydus.Reader, error) {
+	blob, err := fs.resolveBlob(ctx, s, s.Target)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to resolve the source")
+	}
+	var bs []byte
+	if bootstrap {
+		if bs, err = nydus.ReadBootstrap(io.NewSectionReader(fs.prioritizedReaderAt(blob), 0, blob.Size()), s.Target.Digest); err != nil {
+			return nil, nil, err
+		}
+	}
+	fsCache := fs.layerCache(s.Target.Digest, cacheOpts)
+	// Reads happen after the mount request so they don't use its context.
+	bctx := log.WithLogger(context.Background(), log.G(ctx))
+	lr, root, err := nydus.NewReader(bs, func(id string) (io.ReaderAt, error) {
+		desc := ocispec.Descriptor{Digest: digest.NewDigestFromEncoded(digest.SHA256, id)}
+		b, err := fs.resolveBlob(bctx, s, desc)
+		if err != nil {
+			log.G(bctx).WithError(err).Warnf("failed to resolve Nydus blob %q", desc.Digest)
+			return nil, err
+		}
+		return fs.prioritizedReaderAt(b), nil
+	}, fsCache)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fs.fips && lr.UsesBLAKE3() {
+		return nil, nil, fmt.Errorf("chunks of Nydus layer %q are digested by BLAKE3, which isn't allowed in the FIPS mode", s.Target.Digest)
+	}
+	l := newLayer(s.Target, blob, nil, root, fs.prefetchTimeout)
+	l.r = lr
+	return l, lr, nil
+}
+
+// prioritizedReaderAt returns a reader of the blob whose reads are prioritized
+// tasks so background tasks don't disturb them.
+func (fs *filesystem) prioritizedReaderAt(blob remote.Blob) io.ReaderAt {
+	return readerAtFunc(func(p []byte, offset int64) (int, error) {
+		fs.backgroundTaskManager.DoPrioritizedTask()
+		defer fs.backgroundTaskManager.DonePrioritizedTask()
+		return blob.ReadAt(p, offset)
+	})
+}
@@ -0,0 +1,547 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package nydus
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/cache"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/internal/erofs"
+	"github.com/klauspost/compress/zstd"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"lukechampine.com/blake3"
+)
+
+func TestReader(t *testing.T) {
+	content := make([]byte, 6000)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	// blob 0 is compressed with zstd and digested with sha256 and blob 1 is
+	// compressed with lz4 and digested with blake3.
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatalf("failed to create zstd encoder: %v", err)
+	}
+	blob0 := append([]byte("padding"), enc.EncodeAll(content[:4096], nil)...)
+	blob1 := lz4Literals(content[4096:])
+	sum0, sum1 := sha256.Sum256(content[:4096]), blake3.Sum256(content[4096:])
+	blobs := []testBlob{
+		{id: digest.FromBytes(blob0).Encoded(), compressor: compressorZstd, digester: digesterSHA256},
+		{id: digest.FromBytes(blob1).Encoded(), compressor: compressorLZ4Block, digester: digesterBlake3},
+	}
+	chunks := []*chunkInfo{
+		{digest: sum0, blob: 0, flags: chunkFlagCompressed, compressedSize: uint32(len(blob0) - 7), uncompressedSize: 4096, compressedOffset: 7, index: 0},
+		{digest: sum1, blob: 1, flags: chunkFlagCompressed, compressedSize: uint32(len(blob1)), uncompressedSize: 1904, index: 0x12345},
+	}
+
+	file := &testInode{mode: syscall.S_IFREG | 04755, uid: 1, gid: 2, size: 6000, layout: erofs.LayoutChunkBased, u: erofs.ChunkFormatIndexes,
+		xattrs: [][2]string{{"user.foo", "bar"}, {"security.capability", "cap"}},
+		chunks: []testChunkIndex{{blob: 0, index: 0}, {blob: 1, index: 0x12345}}}
+	dir := &testInode{mode: syscall.S_IFDIR | 0755, children: map[string]*testInode{"b": file, "link": file}}
+	root := &testInode{mode: syscall.S_IFDIR | 0755, children: map[string]*testInode{
+		"a":     dir,
+		"sym":   {mode: syscall.S_IFLNK | 0777, layout: erofs.LayoutFlatInline, inline: []byte("a/b")},
+		"null":  {mode: syscall.S_IFCHR | 0666, u: 1<<8 | 3},
+		"small": {mode: syscall.S_IFREG | 0644, layout: erofs.LayoutFlatInline, inline: []byte("hi")},
+		"hole":  {mode: syscall.S_IFREG | 0644, size: 100, layout: erofs.LayoutChunkBased, u: erofs.ChunkFormatIndexes, chunks: []testChunkIndex{{hole: true}}},
+	}}
+	bootstrap := buildBootstrap(t, root, blobs, chunks, []*testInode{dir})
+
+	blobContents := map[string][]byte{blobs[0].id: blob0, blobs[1].id: blob1}
+	var opened []string
+	r, rootEnt, err := NewReader(bootstrap, func(id string) (io.ReaderAt, error) {
+		opened = append(opened, id)
+		c, ok := blobContents[id]
+		if !ok {
+			return nil, fmt.Errorf("unknown blob %q", id)
+		}
+		return bytes.NewReader(c), nil
+	}, cache.NewMemoryCache())
+	if err != nil {
+		t.Fatalf("failed to create reader: %v", err)
+	}
+	if _, ok := rootEnt.LookupChild("a"); !ok {
+		t.Errorf("root doesn't contain a")
+	}
+	if !r.UsesBLAKE3() {
+		t.Errorf("blob digested by BLAKE3 must be reported")
+	}
+
+	e, ok := r.Lookup("a/b")
+	if !ok {
+		t.Fatalf("a/b isn't found")
+	}
+	if e.Type != "reg" || e.Size != 6000 || e.Mode != 04755 || e.UID != 1 || e.GID != 2 || e.NumLink != 2 {
+		t.Errorf("unexpected entry of a/b: %+v", e)
+	}
+	if string(e.Xattrs["user.foo"]) != "bar" || string(e.Xattrs["security.capability"]) != "cap" {
+		t.Errorf("unexpected xattrs of a/b: %v", e.Xattrs)
+	}
+	if l, ok := r.Lookup("a/link"); !ok || l != e {
+		t.Errorf("a/link must be a hardlink of a/b")
+	}
+	if e, ok := r.Lookup("sym"); !ok || e.Type != "symlink" || e.LinkName != "a/b" {
+		t.Errorf("unexpected symlink: %+v", e)
+	}
+	if e, ok := r.Lookup("null"); !ok || e.Type != "char" || e.DevMajor != 1 || e.DevMinor != 3 {
+		t.Errorf("unexpected device: %+v", e)
+	}
+	if len(opened) != 0 {
+		t.Errorf("blobs must be opened lazily: %v", opened)
+	}
+
+	for name, want := range map[string][]byte{
+		"a/b":   content,
+		"small": []byte("hi"),
+		"hole":  make([]byte, 100),
+	} {
+		ra, err := r.OpenFile(name)
+		if err != nil {
+			t.Fatalf("failed to open %q: %v", name, err)
+		}
+		got, err := ioutil.ReadAll(io.NewSectionReader(ra, 0, int64(len(want))+10))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("contents of %q = %d bytes, %v; want %d bytes", name, len(got), err, len(want))
+		}
+	}
+	ra, err := r.OpenFile("a/b")
+	if err != nil {
+		t.Fatalf("failed to open a/b: %v", err)
+	}
+	p := make([]byte, 200)
+	if n, err := ra.ReadAt(p, 4000); n != len(p) || err != nil || !bytes.Equal(p, content[4000:4200]) {
+		t.Errorf("failed to read across chunks: %d, %v", n, err)
+	}
+
+	// Prefetched chunks are served from the cache.
+	r2, _, err := NewReader(bootstrap, func(id string) (io.ReaderAt, error) {
+		return bytes.NewReader(blobContents[id]), nil
+	}, cache.NewMemoryCache())
+	if err != nil {
+		t.Fatalf("failed to create reader: %v", err)
+	}
+	if err := r2.Prefetch(); err != nil {
+		t.Fatalf("failed to prefetch: %v", err)
+	}
+	for _, b := range r2.blobs {
+		b.ra = bytes.NewReader(nil)
+	}
+	ra, err = r2.OpenFile("a/b")
+	if err != nil {
+		t.Fatalf("failed to open a/b: %v", err)
+	}
+	got := make([]byte, len(content))
+	if n, err := ra.ReadAt(got, 0); n != len(got) || err != nil || !bytes.Equal(got, content) {
+		t.Errorf("failed to read prefetched contents: %d, %v", n, err)
+	}
+
+	// Corrupted chunks are detected.
+	broken := append([]byte{}, blob1...)
+	broken[len(broken)-1] ^= 0xff
+	r3, _, err := NewReader(bootstrap, func(id string) (io.ReaderAt, error) {
+		if id == blobs[1].id {
+			return bytes.NewReader(broken), nil
+		}
+		return bytes.NewReader(blobContents[id]), nil
+	}, cache.NewMemoryCache())
+	if err != nil {
+		t.Fatalf("failed to create reader: %v", err)
+	}
+	if ra, err = r3.OpenFile("a/b"); err != nil {
+		t.Fatalf("failed to open a/b: %v", err)
+	}
+	if _, err := ra.ReadAt(make([]byte, 10), 5000); err == nil {
+		t.Errorf("corrupted chunk must not be read")
+	}
+}
+
+func TestReadBootstrap(t *testing.T) {
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(zw)
+	for _, name := range []string{"image/", "image/image.boot"} {
+		h := &tar.Header{Typeflag: tar.TypeDir, Name: name, Mode: 0755}
+		if name == "image/image.boot" {
+			h.Typeflag, h.Size = tar.TypeReg, 4
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatalf("failed to write header: %v", err)
+		}
+	}
+	if _, err := tw.Write([]byte("boot")); err != nil {
+		t.Fatalf("failed to write bootstrap: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close tar: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("failed to close gzip: %v", err)
+	}
+	sr := io.NewSectionReader(bytes.NewReader(buf.Bytes()), 0, int64(buf.Len()))
+	got, err := ReadBootstrap(sr, digest.FromBytes(buf.Bytes()))
+	if err != nil || string(got) != "boot" {
+		t.Errorf("bootstrap = %q, %v; want boot", got, err)
+	}
+	if _, err := ReadBootstrap(sr, digest.FromString("invalid")); err == nil {
+		t.Errorf("bootstrap layer with invalid digest must not be read")
+	}
+}
+
+func TestWriteBootstrap(t *testing.T) {
+	const chunkSize = 4096
+	content := make([]byte, chunkSize+100)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	// Like eStargz blobs, gzip members contain more data than the chunks.
+	var (
+		blob   bytes.Buffer
+		chunks []Chunk
+	)
+	for off := 0; off < len(content); off += chunkSize {
+		end := off + chunkSize
+		if end > len(content) {
+			end = len(content)
+		}
+		start := blob.Len()
+		zw := gzip.NewWriter(&blob)
+		if _, err := zw.Write(append(append([]byte{}, content[off:end]...), "trailing"...)); err != nil {
+			t.Fatalf("failed to compress chunk: %v", err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("failed to close gzip: %v", err)
+		}
+		chunks = append(chunks, Chunk{
+			Digest:           digest.FromBytes(content[off:end]),
+			CompressedOffset: int64(start),
+			CompressedSize:   int64(blob.Len() - start),
+			Size:             int64(end - off),
+		})
+	}
+	blobDesc := ocispec.Descriptor{Digest: digest.FromBytes(blob.Bytes()), Size: int64(blob.Len())}
+
+	entries := []Entry{
+		{TOCEntry: &estargz.TOCEntry{Name: "a/b", Type: "reg", Mode: 0644, UID: 1, GID: 2, Size: int64(len(content)),
+			ModTime3339: "2021-01-02T03:04:05Z", Xattrs: map[string][]byte{"user.foo": []byte("bar")}}, Chunks: chunks},
+		{TOCEntry: &estargz.TOCEntry{Name: "a/link", Type: "hardlink", LinkName: "a/b"}},
+		{TOCEntry: &estargz.TOCEntry{Name: "a/small", Type: "reg", Mode: 0600, Size: 100}, Chunks: chunks[1:]},
+		{TOCEntry: &estargz.TOCEntry{Name: "sym", Type: "symlink", Mode: 0777, LinkName: "a/b"}},
+		{TOCEntry: &estargz.TOCEntry{Name: "null", Type: "char", Mode: 0666, DevMajor: 1, DevMinor: 3}},
+		{TOCEntry: &estargz.TOCEntry{Name: "empty", Type: "reg", Mode: 0644}},
+	}
+	// Make a directory spanning multiple blocks.
+	for i := 0; i < 300; i++ {
+		entries = append(entries, Entry{TOCEntry: &estargz.TOCEntry{Name: fmt.Sprintf("many/file-%03d", i), Type: "fifo", Mode: 0644}})
+	}
+	var buf bytes.Buffer
+	if err := WriteBootstrap(&buf, entries, []ocispec.Descriptor{blobDesc}, []string{"a"}); err != nil {
+		t.Fatalf("failed to write bootstrap: %v", err)
+	}
+
+	r, _, err := NewReader(buf.Bytes(), func(id string) (io.ReaderAt, error) {
+		if id != blobDesc.Digest.Encoded() {
+			return nil, fmt.Errorf("unknown blob %q", id)
+		}
+		return bytes.NewReader(blob.Bytes()), nil
+	}, cache.NewMemoryCache())
+	if err != nil {
+		t.Fatalf("failed to read bootstrap: %v", err)
+	}
+	e, ok := r.Lookup("a/b")
+	if !ok || e.Type != "reg" || e.Mode != 0644 || e.UID != 1 || e.GID != 2 || e.NumLink != 2 ||
+		e.ModTime3339 != "2021-01-02T03:04:05Z" || string(e.Xattrs["user.foo"]) != "bar" {
+		t.Errorf("unexpected entry of a/b: %+v", e)
+	}
+	if l, ok := r.Lookup("a/link"); !ok || l != e {
+		t.Errorf("a/link must be a hardlink of a/b")
+	}
+	if e, ok := r.Lookup("sym"); !ok || e.Type != "symlink" || e.LinkName != "a/b" {
+		t.Errorf("unexpected symlink: %+v", e)
+	}
+	if e, ok := r.Lookup("null"); !ok || e.Type != "char" || e.DevMajor != 1 || e.DevMinor != 3 {
+		t.Errorf("unexpected device: %+v", e)
+	}
+	for i := 0; i < 300; i++ {
+		if e, ok := r.Lookup(fmt.Sprintf("many/file-%03d", i)); !ok || e.Type != "fifo" {
+			t.Fatalf("many/file-%03d isn't found", i)
+		}
+	}
+	if len(r.prefetch) != 1 || r.prefetch[0] != "a/" {
+		t.Errorf("prefetch = %v; want [a/]", r.prefetch)
+	}
+	for name, want := range map[string][]byte{
+		"a/b":     content,
+		"a/small": content[chunkSize:],
+		"empty":   nil,
+	} {
+		ra, err := r.OpenFile(name)
+		if err != nil {
+			t.Fatalf("failed to open %q: %v", name, err)
+		}
+		got, err := ioutil.ReadAll(io.NewSectionReader(ra, 0, int64(len(want))))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("contents of %q = %d bytes, %v; want %d bytes", name, len(got), err, len(want))
+		}
+	}
+
+	bad := append(entries[:1:1], Entry{TOCEntry: &estargz.TOCEntry{Name: "c", Type: "reg", Size: 10}, Chunks: chunks})
+	if err := WriteBootstrap(ioutil.Discard, bad, []ocispec.Descriptor{blobDesc}, nil); err == nil {
+		t.Errorf("chunks not matching to the file size must be rejected")
+	}
+}
+
+func TestLZ4(t *testing.T) {
+	// "abcabcabcabc!" : literals "abc", a match of 9 bytes at offset 3 and
+	// the last literal.
+	src := []byte{0x35, 'a', 'b', 'c', 3, 0, 0x10, '!'}
+	if dst, err := decompressChunk(compressorLZ4Block, src, 13); err != nil || string(dst) != "abcabcabcabc!" {
+		t.Errorf("lz4 = %q, %v", dst, err)
+	}
+	for _, size := range []int{12, 14} {
+		if _, err := decompressChunk(compressorLZ4Block, src, size); err == nil {
+			t.Errorf("size mismatch (%d) must be detected", size)
+		}
+	}
+}
+
+// lz4Literals returns the LZ4 block which contains p as literals.
+func lz4Literals(p []byte) []byte {
+	res := []byte{0xf0}
+	l := len(p) - 15
+	for ; l >= 255; l -= 255 {
+		res = append(res, 255)
+	}
+	return append(append(res, byte(l)), p...)
+}
+
+type testBlob struct {
+	id         string
+	compressor uint32
+	digester   uint32
+}
+
+type testChunkIndex struct {
+	blob, index uint32
+	hole        bool
+}
+
+type testInode struct {
+	mode     uint32
+	uid, gid uint32
+	size     int64
+	u        uint32
+	layout   uint16
+	xattrs   [][2]string
+	inline   []byte
+	chunks   []testChunkIndex
+	children map[string]*testInode
+
+	nid  uint64
+	off  int64
+	tail int64 // offset of the inline data or chunk indexes
+}
+
+// buildBootstrap builds a RAFS v6 bootstrap. All inodes are extended ones and
+// directories are stored in FLAT_PLAIN blocks.
+func buildBootstrap(t *testing.T, root *testInode, blobs []testBlob, chunks []*chunkInfo, prefetch []*testInode) []byte {
+	const blksz = 4096
+	var inodes []*testInode
+	var walk func(in *testInode)
+	seen := map[*testInode]bool{}
+	walk = func(in *testInode) {
+		if seen[in] {
+			return
+		}
+		seen[in] = true
+		inodes = append(inodes, in)
+		var names []string
+		for name := range in.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			walk(in.children[name])
+		}
+	}
+	walk(root)
+
+	p := make([]byte, 1408)
+	blobTableOff := int64(len(p))
+	for _, b := range blobs {
+		e := make([]byte, rafsBlobSize)
+		copy(e, b.id)
+		binary.LittleEndian.PutUint32(e[76:], b.compressor)
+		binary.LittleEndian.PutUint32(e[80:], b.digester)
+		p = append(p, e...)
+	}
+	chunkTableOff := int64(len(p))
+	for _, c := range chunks {
+		e := make([]byte, rafsChunkInfoSize)
+		copy(e, c.digest[:])
+		binary.LittleEndian.PutUint32(e[32:], c.blob)
+		binary.LittleEndian.PutUint32(e[36:], c.flags)
+		binary.LittleEndian.PutUint32(e[40:], c.compressedSize)
+		binary.LittleEndian.PutUint32(e[44:], c.uncompressedSize)
+		binary.LittleEndian.PutUint64(e[48:], c.compressedOffset)
+		binary.LittleEndian.PutUint32(e[72:], c.index)
+		p = append(p, e...)
+	}
+	prefetchTableOff := int64(len(p))
+	p = append(p, make([]byte, 4*len(prefetch))...) // filled after the nids are assigned
+
+	xattrBody := func(in *testInode) []byte {
+		if len(in.xattrs) == 0 {
+			return nil
+		}
+		b := make([]byte, 12)
+		for _, x := range in.xattrs {
+			idx, name := uint8(1), x[0][len("user."):]
+			if strings.HasPrefix(x[0], "security.") {
+				idx, name = 6, x[0][len("security."):]
+			}
+			e := []byte{byte(len(name)), idx, 0, 0}
+			binary.LittleEndian.PutUint16(e[2:], uint16(len(x[1])))
+			e = append(append(e, name...), x[1]...)
+			for len(e)%4 != 0 {
+				e = append(e, 0)
+			}
+			b = append(b, e...)
+		}
+		return b
+	}
+
+	// Assign nids
+	metaStart := (int64(len(p)) + blksz - 1) / blksz * blksz
+	off := metaStart
+	for _, in := range inodes {
+		in.off = off
+		in.nid = uint64(off-metaStart) / erofs.SlotSize
+		end := off + 64 + int64(len(xattrBody(in)))
+		if in.layout == erofs.LayoutChunkBased {
+			end = (end + 7) &^ 7
+			in.tail = end
+			end += int64(len(in.chunks)) * rafsChunkIndexSize
+		} else {
+			in.tail = end
+			end += int64(len(in.inline))
+		}
+		off = (end + erofs.SlotSize - 1) &^ (erofs.SlotSize - 1)
+	}
+
+	// Directories
+	dataStart := (off + blksz - 1) / blksz * blksz
+	p = append(p, make([]byte, dataStart-int64(len(p)))...)
+	parents := map[*testInode]*testInode{root: root}
+	for _, in := range inodes {
+		for _, c := range in.children {
+			if _, ok := parents[c]; !ok {
+				parents[c] = in
+			}
+		}
+	}
+	for _, in := range inodes {
+		if in.children == nil {
+			continue
+		}
+		ents := map[string]*testInode{".": in, "..": parents[in]}
+		var names []string
+		for name, c := range in.children {
+			ents[name] = c
+		}
+		for name := range ents {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		blk := make([]byte, len(names)*erofs.DirentSize)
+		for i, name := range names {
+			binary.LittleEndian.PutUint64(blk[i*erofs.DirentSize:], ents[name].nid)
+			binary.LittleEndian.PutUint16(blk[i*erofs.DirentSize+8:], uint16(len(blk)))
+			blk = append(blk, name...)
+		}
+		in.u = uint32(int64(len(p)) / blksz)
+		in.size = int64(len(blk))
+		p = append(p, blk...)
+		p = append(p, make([]byte, (blksz-len(p)%blksz)%blksz)...)
+	}
+	if len(p) < blksz { // contains no directories
+		p = append(p, make([]byte, blksz-len(p))...)
+	}
+
+	for _, in := range inodes {
+		x := xattrBody(in)
+		b := make([]byte, 64)
+		binary.LittleEndian.PutUint16(b[0:], 1|in.layout<<1)
+		if len(x) > 0 {
+			binary.LittleEndian.PutUint16(b[2:], uint16((len(x)-12)/4+1))
+		}
+		binary.LittleEndian.PutUint16(b[4:], uint16(in.mode))
+		size := in.size
+		if in.inline != nil {
+			size = int64(len(in.inline))
+		}
+		binary.LittleEndian.PutUint64(b[8:], uint64(size))
+		binary.LittleEndian.PutUint32(b[16:], in.u)
+		binary.LittleEndian.PutUint32(b[24:], in.uid)
+		binary.LittleEndian.PutUint32(b[28:], in.gid)
+		binary.LittleEndian.PutUint64(b[32:], 1577836800)
+		copy(p[in.off:], append(b, x...))
+		tail := in.inline
+		for _, c := range in.chunks {
+			e := make([]byte, rafsChunkIndexSize)
+			if c.hole {
+				binary.LittleEndian.PutUint32(e[4:], erofs.NullAddr)
+			} else {
+				binary.LittleEndian.PutUint16(e[0:], uint16(c.index))
+				binary.LittleEndian.PutUint16(e[2:], uint16(c.blob+1)|uint16(c.index>>16)<<8)
+			}
+			tail = append(tail, e...)
+		}
+		copy(p[in.tail:], tail)
+	}
+	for i, in := range prefetch {
+		binary.LittleEndian.PutUint32(p[prefetchTableOff+int64(i)*4:], uint32(in.nid))
+	}
+
+	sb := p[erofs.SuperOffset:]
+	binary.LittleEndian.PutUint32(sb[0:], erofs.Magic)
+	binary.LittleEndian.PutUint32(sb[8:], rafsFeatureCompat)
+	sb[12] = 12
+	binary.LittleEndian.PutUint16(sb[14:], uint16(root.nid))
+	binary.LittleEndian.PutUint32(sb[40:], uint32(metaStart/blksz))
+	ext := p[erofs.SuperOffset+erofs.SuperSize:]
+	binary.LittleEndian.PutUint64(ext[8:], uint64(blobTableOff))
+	binary.LittleEndian.PutUint32(ext[16:], uint32(len(blobs)*rafsBlobSize))
+	binary.LittleEndian.PutUint64(ext[24:], uint64(chunkTableOff))
+	binary.LittleEndian.PutUint64(ext[32:], uint64(len(chunks)*rafsChunkInfoSize))
+	binary.LittleEndian.PutUint64(ext[40:], uint64(prefetchTableOff))
+	binary.LittleEndian.PutUint32(ext[48:], uint32(len(prefetch)*4))
+	return p
+}
@@ -0,0 +1,500 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package nydus reads images of the Nydus format. A Nydus image consists of
+// a bootstrap layer which contains the metadata of the whole (merged) filesystem
+// as a RAFS (Registry Acceleration File System) v6 image and data blob layers
+// which contain the contents of files split into chunks. RAFS v6 is an EROFS
+// image whose regular files refer to the chunks in the data blobs.
+// See also: https://github.com/dragonflyoss/image-service/blob/master/docs/nydus-design.md
+package nydus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/internal/erofs"
+)
+
+// Constants of the on-disk format. RAFS ones are defined in
+// rafs/src/metadata/layout/v6.rs in the nydus repository. EROFS ones are shared
+// with other image formats in fs/internal/erofs.
+const (
+	erofsMaxWalkDepth  = 10000
+	rafsFeatureCompat  = 0x40000000 // EROFS_FEATURE_COMPAT_RAFS_V6
+	rafsExtSuperSize   = 256
+	rafsBlobSize       = 256
+	rafsChunkInfoSize  = 80
+	rafsChunkIndexSize = 8
+
+	chunkFlagCompressed = 0x1
+)
+
+// Compression algorithms and digest algorithms of chunks in a blob.
+const (
+	compressorNone     = 0
+	compressorLZ4Block = 1
+	compressorGzip     = 2
+	compressorZstd     = 3
+
+	digesterBlake3 = 0
+	digesterSHA256 = 1
+)
+
+var xattrPrefixes = map[uint8]string{
+	1: "user.",
+	2: "system.posix_acl_access",
+	3: "system.posix_acl_default",
+	4: "trusted.",
+	6: "security.",
+}
+
+// blobInfo is an entry of the blob table in the bootstrap.
+type blobInfo struct {
+	id         string
+	compressor uint32
+	digester   uint32
+}
+
+// chunkInfo is an entry of the chunk table in the bootstrap.
+type chunkInfo struct {
+	digest           [32]byte
+	blob             uint32
+	flags            uint32
+	compressedSize   uint32
+	uncompressedSize uint32
+	compressedOffset uint64
+	index            uint32
+}
+
+// file is a regular file in the bootstrap. The contents are either chunks in
+// the data blobs or data inlined in the bootstrap.
+type file struct {
+	size      int64
+	chunkSize int64
+	chunks    []*chunkInfo // nil for holes
+	inline    []byte
+}
+
+// bootstrap is a parsed RAFS v6 bootstrap.
+type bootstrap struct {
+	p         []byte
+	blkszbits uint
+	metaAddr  int64
+	xattrAddr int64
+	buildTime time.Time
+	blobs     []blobInfo
+	chunks    map[chunkKey]*chunkInfo
+	prefetch  []uint64
+
+	entries []*estargz.TOCEntry
+	files   map[string]*file
+	nids    map[uint64]string // names of inodes
+}
+
+type chunkKey struct {
+	blob, index uint32
+}
+
+type inode struct {
+	nid       uint64
+	off       int64 // offset of the inode in the bootstrap
+	layout    uint16
+	mode      uint32
+	size      int64
+	u         uint32
+	uid, gid  uint32
+	mtime     time.Time
+	isize     int64
+	xattrSize int64
+}
+
+// parseBootstrap parses the RAFS v6 bootstrap and lists the entries in it.
+func parseBootstrap(p []byte) (*bootstrap, error) {
+	if len(p) < erofs.SuperOffset+erofs.SuperSize+rafsExtSuperSize {
+		return nil, fmt.Errorf("bootstrap is too small (%d bytes)", len(p))
+	}
+	sb := p[erofs.SuperOffset:]
+	if magic := binary.LittleEndian.Uint32(sb[0:]); magic != erofs.Magic {
+		return nil, fmt.Errorf("invalid magic number %#x; RAFS v5 isn't supported", magic)
+	}
+	if binary.LittleEndian.Uint32(sb[8:])&rafsFeatureCompat == 0 {
+		return nil, fmt.Errorf("EROFS image isn't a RAFS v6 bootstrap")
+	}
+	b := &bootstrap{
+		p:         p,
+		blkszbits: uint(sb[12]),
+		buildTime: time.Unix(int64(binary.LittleEndian.Uint64(sb[24:])), int64(binary.LittleEndian.Uint32(sb[32:]))),
+		chunks:    make(map[chunkKey]*chunkInfo),
+		files:     make(map[string]*file),
+		nids:      make(map[uint64]string),
+	}
+	if b.blkszbits < 9 || b.blkszbits > 16 {
+		return nil, fmt.Errorf("invalid block size bits %d", b.blkszbits)
+	}
+	b.metaAddr = int64(binary.LittleEndian.Uint32(sb[40:])) << b.blkszbits
+	b.xattrAddr = int64(binary.LittleEndian.Uint32(sb[44:])) << b.blkszbits
+	rootNid := uint64(binary.LittleEndian.Uint16(sb[14:]))
+
+	ext := p[erofs.SuperOffset+erofs.SuperSize:]
+	blobTable, err := b.slice(int64(binary.LittleEndian.Uint64(ext[8:])), int64(binary.LittleEndian.Uint32(ext[16:])))
+	if err != nil {
+		return nil, fmt.Errorf("invalid blob table: %v", err)
+	}
+	if len(blobTable)%rafsBlobSize != 0 {
+		return nil, fmt.Errorf("invalid size of blob table %d", len(blobTable))
+	}
+	for ; len(blobTable) > 0; blobTable = blobTable[rafsBlobSize:] {
+		b.blobs = append(b.blobs, blobInfo{
+			id:         strings.TrimRight(string(blobTable[:64]), "\x00"),
+			compressor: binary.LittleEndian.Uint32(blobTable[76:]),
+			digester:   binary.LittleEndian.Uint32(blobTable[80:]),
+		})
+	}
+	chunkTable, err := b.slice(int64(binary.LittleEndian.Uint64(ext[24:])), int64(binary.LittleEndian.Uint64(ext[32:])))
+	if err != nil {
+		return nil, fmt.Errorf("invalid chunk table: %v", err)
+	}
+	if len(chunkTable)%rafsChunkInfoSize != 0 {
+		return nil, fmt.Errorf("invalid size of chunk table %d", len(chunkTable))
+	}
+	for ; len(chunkTable) > 0; chunkTable = chunkTable[rafsChunkInfoSize:] {
+		c := &chunkInfo{
+			blob:             binary.LittleEndian.Uint32(chunkTable[32:]),
+			flags:            binary.LittleEndian.Uint32(chunkTable[36:]),
+			compressedSize:   binary.LittleEndian.Uint32(chunkTable[40:]),
+			uncompressedSize: binary.LittleEndian.Uint32(chunkTable[44:]),
+			compressedOffset: binary.LittleEndian.Uint64(chunkTable[48:]),
+			index:            binary.LittleEndian.Uint32(chunkTable[72:]),
+		}
+		copy(c.digest[:], chunkTable[:32])
+		if int(c.blob) >= len(b.blobs) {
+			return nil, fmt.Errorf("chunk refers to unknown blob %d", c.blob)
+		}
+		b.chunks[chunkKey{c.blob, c.index}] = c
+	}
+	prefetchTable, err := b.slice(int64(binary.LittleEndian.Uint64(ext[40:])), int64(binary.LittleEndian.Uint32(ext[48:])))
+	if err != nil {
+		return nil, fmt.Errorf("invalid prefetch table: %v", err)
+	}
+	for ; len(prefetchTable) >= 4; prefetchTable = prefetchTable[4:] {
+		b.prefetch = append(b.prefetch, uint64(binary.LittleEndian.Uint32(prefetchTable)))
+	}
+
+	root, err := b.inode(rootNid)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.walk(root, "", 0); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// slice returns the region of the bootstrap with bounds checks.
+func (b *bootstrap) slice(off, size int64) ([]byte, error) {
+	if off < 0 || size < 0 || off > int64(len(b.p)) || size > int64(len(b.p))-off {
+		return nil, fmt.Errorf("region (offset:%d,size:%d) is out of the bootstrap", off, size)
+	}
+	return b.p[off : off+size], nil
+}
+
+// inode parses the inode of the nid.
+func (b *bootstrap) inode(nid uint64) (*inode, error) {
+	off := b.metaAddr + int64(nid)*erofs.SlotSize
+	p, err := b.slice(off, erofs.SlotSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid nid %d: %v", nid, err)
+	}
+	format := binary.LittleEndian.Uint16(p[0:])
+	in := &inode{
+		nid:    nid,
+		off:    off,
+		layout: (format >> 1) & 0x7,
+		mode:   uint32(binary.LittleEndian.Uint16(p[4:])),
+	}
+	if format&0x1 == 0 { // compact inode
+		in.isize = 32
+		in.size = int64(binary.LittleEndian.Uint32(p[8:]))
+		in.u = binary.LittleEndian.Uint32(p[16:])
+		in.uid = uint32(binary.LittleEndian.Uint16(p[24:]))
+		in.gid = uint32(binary.LittleEndian.Uint16(p[26:]))
+		in.mtime = b.buildTime
+	} else { // extended inode
+		in.isize = 64
+		if p, err = b.slice(off, in.isize); err != nil {
+			return nil, fmt.Errorf("invalid nid %d: %v", nid, err)
+		}
+		in.size = int64(binary.LittleEndian.Uint64(p[8:]))
+		in.u = binary.LittleEndian.Uint32(p[16:])
+		in.uid = binary.LittleEndian.Uint32(p[24:])
+		in.gid = binary.LittleEndian.Uint32(p[28:])
+		in.mtime = time.Unix(int64(binary.LittleEndian.Uint64(p[32:])), int64(binary.LittleEndian.Uint32(p[40:])))
+	}
+	if in.size < 0 {
+		return nil, fmt.Errorf("invalid size of nid %d", nid)
+	}
+	if icount := int64(binary.LittleEndian.Uint16(p[2:])); icount > 0 {
+		in.xattrSize = 12 + (icount-1)*4
+	}
+	return in, nil
+}
+
+// data returns the contents of the inode stored in the bootstrap. This is
+// used for directories, symlinks and regular files not split into chunks.
+func (b *bootstrap) data(in *inode) ([]byte, error) {
+	switch in.layout {
+	case erofs.LayoutFlatPlain:
+		return b.slice(int64(in.u)<<b.blkszbits, in.size)
+	case erofs.LayoutFlatInline:
+		blksz := int64(1) << b.blkszbits
+		head := (in.size + blksz - 1) / blksz
+		if head > 0 {
+			head = (head - 1) * blksz
+		}
+		h, err := b.slice(int64(in.u)<<b.blkszbits, head)
+		if err != nil {
+			return nil, err
+		}
+		t, err := b.slice(in.off+in.isize+in.xattrSize, in.size-head)
+		if err != nil {
+			return nil, err
+		}
+		return append(append([]byte{}, h...), t...), nil
+	}
+	return nil, fmt.Errorf("unsupported data layout %d of nid %d", in.layout, in.nid)
+}
+
+// xattrs parses the extended attributes of the inode.
+func (b *bootstrap) xattrs(in *inode) (map[string][]byte, error) {
+	if in.xattrSize == 0 {
+		return nil, nil
+	}
+	p, err := b.slice(in.off+in.isize, in.xattrSize)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string][]byte)
+	shared := int(p[4])
+	if 12+shared*4 > len(p) {
+		return nil, fmt.Errorf("invalid number of shared xattrs of nid %d", in.nid)
+	}
+	for i := 0; i < shared; i++ {
+		id := int64(binary.LittleEndian.Uint32(p[12+i*4:]))
+		sp, err := b.slice(b.xattrAddr+id*4, int64(len(b.p))-b.xattrAddr-id*4)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := parseXattr(sp, res); err != nil {
+			return nil, err
+		}
+	}
+	for p = p[12+shared*4:]; len(p) > 0; {
+		n, err := parseXattr(p, res)
+		if err != nil {
+			return nil, err
+		}
+		if n = (n + 3) &^ 3; n > len(p) {
+			break
+		}
+		p = p[n:]
+	}
+	return res, nil
+}
+
+// parseXattr parses an xattr entry and returns the size of the entry.
+func parseXattr(p []byte, xattrs map[string][]byte) (int, error) {
+	if len(p) < 4 {
+		return 0, fmt.Errorf("xattr entry is too small")
+	}
+	nameLen, valueLen := int(p[0]), int(binary.LittleEndian.Uint16(p[2:]))
+	n := 4 + nameLen + valueLen
+	if n > len(p) {
+		return 0, fmt.Errorf("xattr entry is out of the bootstrap")
+	}
+	prefix, ok := xattrPrefixes[p[1]]
+	if ok {
+		xattrs[prefix+string(p[4:4+nameLen])] = append([]byte{}, p[4+nameLen:n]...)
+	}
+	return n, nil
+}
+
+// walk lists the entries in the directory recursively.
+func (b *bootstrap) walk(dir *inode, name string, depth int) error {
+	if depth > erofsMaxWalkDepth {
+		return fmt.Errorf("directory tree is too deep")
+	}
+	if err := b.addEntry(dir, name); err != nil {
+		return err
+	}
+	p, err := b.data(dir)
+	if err != nil {
+		return err
+	}
+	blksz := 1 << b.blkszbits
+	for len(p) > 0 {
+		blk := p
+		if len(blk) > blksz {
+			blk = blk[:blksz]
+		}
+		p = p[len(blk):]
+		if len(blk) < erofs.DirentSize {
+			return fmt.Errorf("invalid directory %q", name)
+		}
+		n := int(binary.LittleEndian.Uint16(blk[8:])) / erofs.DirentSize
+		if n == 0 || n*erofs.DirentSize > len(blk) {
+			return fmt.Errorf("invalid directory %q", name)
+		}
+		for i := 0; i < n; i++ {
+			d := blk[i*erofs.DirentSize:]
+			nameOff, nameEnd := int(binary.LittleEndian.Uint16(d[8:])), len(blk)
+			if i+1 < n {
+				nameEnd = int(binary.LittleEndian.Uint16(d[erofs.DirentSize+8:]))
+			}
+			if nameOff > nameEnd || nameEnd > len(blk) {
+				return fmt.Errorf("invalid directory entry in %q", name)
+			}
+			base := string(blk[nameOff:nameEnd])
+			if i := strings.IndexByte(base, 0); i >= 0 {
+				base = base[:i]
+			}
+			if base == "." || base == ".." {
+				continue
+			} else if base == "" || strings.Contains(base, "/") {
+				return fmt.Errorf("invalid name %q in %q", base, name)
+			}
+			child, err := b.inode(binary.LittleEndian.Uint64(d[0:]))
+			if err != nil {
+				return err
+			}
+			if child.mode&syscall.S_IFMT == syscall.S_IFDIR {
+				err = b.walk(child, path.Join(name, base)+"/", depth+1)
+			} else {
+				err = b.addEntry(child, path.Join(name, base))
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addEntry adds the TOCEntry of the inode.
+func (b *bootstrap) addEntry(in *inode, name string) error {
+	e := &estargz.TOCEntry{
+		Name:        name,
+		Mode:        int64(in.mode & 07777),
+		UID:         int(in.uid),
+		GID:         int(in.gid),
+		ModTime3339: in.mtime.UTC().Format(time.RFC3339),
+	}
+	xattrs, err := b.xattrs(in)
+	if err != nil {
+		return err
+	}
+	e.Xattrs = xattrs
+	switch in.mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		e.Type = "dir"
+	case syscall.S_IFREG:
+		if org, ok := b.nids[in.nid]; ok {
+			b.entries = append(b.entries, &estargz.TOCEntry{Name: name, Type: "hardlink", LinkName: org})
+			return nil
+		}
+		f, err := b.file(in)
+		if err != nil {
+			return err
+		}
+		e.Type, e.Size = "reg", in.size
+		b.files[name] = f
+	case syscall.S_IFLNK:
+		target, err := b.data(in)
+		if err != nil {
+			return err
+		}
+		e.Type, e.LinkName = "symlink", string(target)
+	case syscall.S_IFCHR, syscall.S_IFBLK:
+		e.Type = "char"
+		if in.mode&syscall.S_IFMT == syscall.S_IFBLK {
+			e.Type = "block"
+		}
+		e.DevMajor = int((in.u & 0xfff00) >> 8)
+		e.DevMinor = int((in.u & 0xff) | ((in.u >> 12) & 0xfff00))
+	case syscall.S_IFIFO:
+		e.Type = "fifo"
+	default: // sockets can't be represented in the TOC
+		return nil
+	}
+	b.entries = append(b.entries, e)
+	b.nids[in.nid] = name
+	return nil
+}
+
+// file resolves the contents of the regular file.
+func (b *bootstrap) file(in *inode) (*file, error) {
+	f := &file{size: in.size}
+	if in.size == 0 {
+		return f, nil
+	}
+	if in.layout != erofs.LayoutChunkBased {
+		p, err := b.data(in)
+		if err != nil {
+			return nil, err
+		}
+		f.inline = p
+		return f, nil
+	}
+	if in.u&erofs.ChunkFormatIndexes == 0 {
+		return nil, fmt.Errorf("unsupported chunk format %#x of nid %d", in.u, in.nid)
+	}
+	chunkbits := b.blkszbits + uint(in.u&erofs.ChunkFormatBlkbitsMask)
+	if chunkbits > 40 {
+		return nil, fmt.Errorf("invalid chunk size of nid %d", in.nid)
+	}
+	f.chunkSize = int64(1) << chunkbits
+	n := (in.size + f.chunkSize - 1) / f.chunkSize
+	off := (in.off + in.isize + in.xattrSize + rafsChunkIndexSize - 1) &^ (rafsChunkIndexSize - 1)
+	p, err := b.slice(off, n*rafsChunkIndexSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid chunk indexes of nid %d: %v", in.nid, err)
+	}
+	f.chunks = make([]*chunkInfo, n)
+	for i := range f.chunks {
+		// The low byte of the device ID is the blob index + 1 and the rest is
+		// the index of the chunk in the blob (RafsV6InodeChunkAddr).
+		lo := uint32(binary.LittleEndian.Uint16(p[i*rafsChunkIndexSize:]))
+		hi := uint32(binary.LittleEndian.Uint16(p[i*rafsChunkIndexSize+2:]))
+		if binary.LittleEndian.Uint32(p[i*rafsChunkIndexSize+4:]) == erofs.NullAddr {
+			continue // hole
+		}
+		if hi&0xff == 0 {
+			return nil, fmt.Errorf("chunk %d of nid %d doesn't refer to a blob", i, in.nid)
+		}
+		k := chunkKey{blob: hi&0xff - 1, index: (hi>>8)<<16 | lo}
+		c, ok := b.chunks[k]
+		if !ok {
+			return nil, fmt.Errorf("chunk %d of blob %d isn't in the chunk table", k.index, k.blob)
+		}
+		f.chunks[i] = c
+	}
+	return f, nil
+}
@@ -0,0 +1,407 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package nydus
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sync"
+
+	"github.com/containerd/stargz-snapshotter/cache"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/reader"
+	"github.com/klauspost/compress/zstd"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pierrec/lz4/v4"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/singleflight"
+	"lukechampine.com/blake3"
+)
+
+const (
+	// BootstrapLabel is a snapshot label key which indicates that the layer is
+	// the bootstrap of a Nydus image. Nydus images have this annotation on the
+	// bootstrap layer.
+	BootstrapLabel = "containerd.io/snapshot/nydus-bootstrap"
+
+	// BlobLabel is a snapshot label key which indicates that the layer is a
+	// data blob of a Nydus image.
+	BlobLabel = "containerd.io/snapshot/nydus-blob"
+
+	// BootstrapTarName is the name of the bootstrap in the bootstrap layer.
+	BootstrapTarName = "image/image.boot"
+)
+
+var zstdDecoder, _ = zstd.NewReader(nil)
+
+// BlobOpener returns the reader of the data blob of the ID. The ID is the
+// hex-encoded sha256 digest of the blob.
+type BlobOpener func(id string) (io.ReaderAt, error)
+
+// ReadBootstrap reads the bootstrap from the bootstrap layer (a tar archive
+// optionally compressed with gzip) and verifies the layer with the digest.
+func ReadBootstrap(sr *io.SectionReader, dgst digest.Digest) ([]byte, error) {
+	verifier := dgst.Verifier()
+	br := bufio.NewReader(io.TeeReader(sr, verifier))
+	var r io.Reader = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decompress bootstrap layer")
+		}
+		r = zr
+	}
+	var bootstrap []byte
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Wrap(err, "failed to read bootstrap layer")
+		}
+		if path.Clean("/"+h.Name) == "/"+BootstrapTarName {
+			if bootstrap, err = ioutil.ReadAll(tr); err != nil {
+				return nil, errors.Wrap(err, "failed to read bootstrap")
+			}
+		}
+	}
+	if _, err := io.Copy(ioutil.Discard, br); err != nil {
+		return nil, err
+	}
+	if !verifier.Verified() {
+		return nil, fmt.Errorf("bootstrap layer doesn't match to the digest %q", dgst)
+	}
+	if bootstrap == nil {
+		return nil, fmt.Errorf("%q isn't found in the bootstrap layer", BootstrapTarName)
+	}
+	return bootstrap, nil
+}
+
+// Reader is a reader of a Nydus image. The metadata is read from the bootstrap
+// and the contents of files are lazily read from the data blobs by chunks.
+// Chunks are verified with their digests recorded in the bootstrap.
+type Reader struct {
+	r        *estargz.Reader
+	tocJSON  []byte
+	files    map[string]*file
+	prefetch []string
+	blobs    []*blob
+	cache    cache.BlobCache
+	fetchG   singleflight.Group
+}
+
+var _ = (reader.Reader)((*Reader)(nil))
+
+// NewReader creates a Reader of the Nydus image with the bootstrap, reading
+// the data blobs opened by open. A nil bootstrap makes a Reader of an empty
+// layer, which is used for the data blob layers of the image.
+func NewReader(bootstrap []byte, open BlobOpener, c cache.BlobCache) (*Reader, *estargz.TOCEntry, error) {
+	var (
+		entries []*estargz.TOCEntry
+		r       = &Reader{files: make(map[string]*file), cache: c}
+	)
+	if bootstrap != nil {
+		b, err := parseBootstrap(bootstrap)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to parse bootstrap")
+		}
+		entries, r.files = b.entries, b.files
+		for _, info := range b.blobs {
+			r.blobs = append(r.blobs, &blob{info: info, open: open})
+		}
+		for _, nid := range b.prefetch {
+			if name, ok := b.nids[nid]; ok {
+				r.prefetch = append(r.prefetch, name)
+			}
+		}
+	}
+	tocJSON, err := json.Marshal(struct {
+		Version int                 `json:"version"`
+		Entries []*estargz.TOCEntry `json:"entries"`
+	}{1, entries})
+	if err != nil {
+		return nil, nil, err
+	}
+	if r.r, err = estargz.OpenTOCJSON(tocJSON); err != nil {
+		return nil, nil, err
+	}
+	r.tocJSON = tocJSON
+	root, ok := r.r.Lookup("")
+	if !ok {
+		return nil, nil, fmt.Errorf("failed to get a TOCEntry of the root")
+	}
+	return r, root, nil
+}
+
+// TOCJSON returns the TOC JSON which represents the bootstrap.
+func (r *Reader) TOCJSON() ([]byte, error) {
+	return r.tocJSON, nil
+}
+
+// UsesBLAKE3 returns true if chunks of any blob referred by the bootstrap are
+// digested by BLAKE3, which isn't a FIPS 140 approved algorithm.
+func (r *Reader) UsesBLAKE3() bool {
+	for _, b := range r.blobs {
+		if b.info.digester == digesterBlake3 {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Reader) Lookup(name string) (*estargz.TOCEntry, bool) {
+	return r.r.Lookup(name)
+}
+
+func (r *Reader) OpenFile(name string) (io.ReaderAt, error) {
+	f, ok := r.files[name]
+	if !ok {
+		return nil, fmt.Errorf("%q isn't a regular file", name)
+	}
+	return &fileReader{r: r, f: f}, nil
+}
+
+// Cache fetches and caches all chunks in the image. Options are ignored.
+func (r *Reader) Cache(opts ...reader.CacheOption) error {
+	for _, f := range r.files {
+		if err := r.cacheFile(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Prefetch fetches and caches chunks of the files listed in the prefetch table
+// of the bootstrap. Directories in the table mean all files under them.
+func (r *Reader) Prefetch() error {
+	var walk func(e *estargz.TOCEntry) error
+	walk = func(e *estargz.TOCEntry) (rErr error) {
+		if f, ok := r.files[e.Name]; ok {
+			return r.cacheFile(f)
+		}
+		e.ForeachChild(func(_ string, c *estargz.TOCEntry) bool {
+			rErr = walk(c)
+			return rErr == nil
+		})
+		return
+	}
+	for _, name := range r.prefetch {
+		if e, ok := r.r.Lookup(name); ok {
+			if err := walk(e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *Reader) cacheFile(f *file) error {
+	for _, c := range f.chunks {
+		if c == nil {
+			continue
+		}
+		key := r.chunkID(c)
+		if n, err := r.cache.FetchAt(key, 0, make([]byte, 1)); err == nil && n == 1 {
+			continue
+		}
+		if _, err := r.fetchChunk(key, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readChunk reads the uncompressed contents of the chunk at the offset.
+func (r *Reader) readChunk(c *chunkInfo, p []byte, offset int64) error {
+	if offset+int64(len(p)) > int64(c.uncompressedSize) {
+		return fmt.Errorf("read (offset:%d,size:%d) exceeds the chunk size %d",
+			offset, len(p), c.uncompressedSize)
+	}
+	key := r.chunkID(c)
+	if n, err := r.cache.FetchAt(key, offset, p); err == nil && n == len(p) {
+		return nil
+	}
+	data, err := r.fetchChunk(key, c)
+	if err != nil {
+		return err
+	}
+	copy(p, data[offset:])
+	return nil
+}
+
+// fetchChunk reads the chunk from the blob, verifies and caches it.
+func (r *Reader) fetchChunk(key string, c *chunkInfo) ([]byte, error) {
+	v, err, _ := r.fetchG.Do(key, func() (interface{}, error) {
+		b := r.blobs[c.blob]
+		ra, err := b.reader()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to open blob %q", b.info.id)
+		}
+		raw := make([]byte, c.compressedSize)
+		if n, err := ra.ReadAt(raw, int64(c.compressedOffset)); n != len(raw) {
+			return nil, fmt.Errorf("failed to read chunk from blob %q (%d/%d bytes): %v", b.info.id, n, len(raw), err)
+		}
+		data := raw
+		if c.flags&chunkFlagCompressed != 0 {
+			if data, err = decompressChunk(b.info.compressor, raw, int(c.uncompressedSize)); err != nil {
+				return nil, errors.Wrapf(err, "failed to decompress chunk in blob %q", b.info.id)
+			}
+		}
+		if len(data) != int(c.uncompressedSize) {
+			return nil, fmt.Errorf("size of chunk %d doesn't match to %d", len(data), c.uncompressedSize)
+		}
+		if err := verifyChunk(b.info.digester, data, c.digest); err != nil {
+			return nil, errors.Wrapf(err, "invalid chunk in blob %q", b.info.id)
+		}
+		r.cache.Add(key, data)
+		return data, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]byte), nil
+}
+
+// chunkID returns the key of the chunk in the cache. Chunks having the same
+// contents share the key even if they are in different blobs.
+func (r *Reader) chunkID(c *chunkInfo) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("nydus-%d-%x-%d", r.blobs[c.blob].info.digester, c.digest, c.uncompressedSize)))
+	return fmt.Sprintf("%x", sum)
+}
+
+func decompressChunk(compressor uint32, p []byte, size int) ([]byte, error) {
+	switch compressor {
+	case compressorNone:
+		return p, nil
+	case compressorLZ4Block:
+		dst := make([]byte, size)
+		n, err := lz4.UncompressBlock(p, dst)
+		if err != nil {
+			return nil, err
+		} else if n != size {
+			return nil, fmt.Errorf("decompressed %d bytes; want %d", n, size)
+		}
+		return dst, nil
+	case compressorGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(p))
+		if err != nil {
+			return nil, err
+		}
+		// The gzip member can contain more data than the chunk (e.g. the tar
+		// header of the next file in eStargz blobs) so only the chunk is read.
+		dst := make([]byte, size)
+		if _, err := io.ReadFull(zr, dst); err != nil {
+			return nil, err
+		}
+		return dst, nil
+	case compressorZstd:
+		return zstdDecoder.DecodeAll(p, make([]byte, 0, size))
+	}
+	return nil, fmt.Errorf("unsupported compression algorithm %d", compressor)
+}
+
+func verifyChunk(digester uint32, p []byte, want [32]byte) error {
+	var got [32]byte
+	switch digester {
+	case digesterBlake3:
+		got = blake3.Sum256(p)
+	case digesterSHA256:
+		got = sha256.Sum256(p)
+	default:
+		return fmt.Errorf("unsupported digest algorithm %d", digester)
+	}
+	if got != want {
+		return fmt.Errorf("digest of chunk %x doesn't match to %x", got, want)
+	}
+	return nil
+}
+
+// blob is a data blob lazily opened on the first read.
+type blob struct {
+	info   blobInfo
+	open   BlobOpener
+	ra     io.ReaderAt
+	openMu sync.Mutex
+}
+
+func (b *blob) reader() (io.ReaderAt, error) {
+	b.openMu.Lock()
+	defer b.openMu.Unlock()
+	if b.ra == nil {
+		ra, err := b.open(b.info.id)
+		if err != nil {
+			return nil, err // retried on the next read
+		}
+		b.ra = ra
+	}
+	return b.ra, nil
+}
+
+type fileReader struct {
+	r *Reader
+	f *file
+}
+
+func (fr *fileReader) ReadAt(p []byte, offset int64) (n int, err error) {
+	if offset < 0 {
+		return 0, fmt.Errorf("invalid offset %d", offset)
+	}
+	f := fr.f
+	if f.inline != nil {
+		if offset >= int64(len(f.inline)) {
+			return 0, io.EOF
+		}
+		n = copy(p, f.inline[offset:])
+		if n < len(p) {
+			err = io.EOF
+		}
+		return
+	}
+	for n < len(p) && offset < f.size {
+		i, off := offset/f.chunkSize, offset%f.chunkSize
+		csize := f.chunkSize
+		if rest := f.size - i*f.chunkSize; rest < csize {
+			csize = rest
+		}
+		l := int64(len(p) - n)
+		if l > csize-off {
+			l = csize - off
+		}
+		if c := f.chunks[i]; c == nil {
+			for j := range p[n : n+int(l)] {
+				p[n+j] = 0
+			}
+		} else if err := fr.r.readChunk(c, p[n:n+int(l)], off); err != nil {
+			return n, err
+		}
+		n += int(l)
+		offset += l
+	}
+	if n < len(p) {
+		err = io.EOF
+	}
+	return
+}
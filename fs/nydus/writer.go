@@ -0,0 +1,599 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package nydus
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/internal/erofs"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	writerBlkszBits = 12
+	writerBlksz     = 1 << writerBlkszBits
+
+	// Flags of the RAFS v6 extended superblock (RafsSuperFlags)
+	rafsFlagHashSHA256      = 0x8
+	rafsFlagExplicitUIDGID  = 0x10
+	rafsFlagHasXattr        = 0x20
+	rafsFlagCompressionGzip = 0x40
+
+	// Default chunk size recorded in the blob table
+	rafsDefaultChunkSize = 1 << 22
+)
+
+// Chunk is a chunk of a regular file in a data blob.
+type Chunk struct {
+	// Blob is the index of the data blob passed to WriteBootstrap.
+	Blob int
+
+	// Digest is the sha256 digest of the uncompressed chunk.
+	Digest digest.Digest
+
+	// CompressedOffset and CompressedSize are the region in the data blob. The
+	// region starts with a gzip member which decompresses to the chunk.
+	CompressedOffset int64
+	CompressedSize   int64
+
+	// Size is the size of the uncompressed chunk.
+	Size int64
+}
+
+// Entry is a file written to the bootstrap.
+type Entry struct {
+	// TOCEntry is the metadata of the file. Hardlinks must come after the
+	// entries they link to. Type "chunk" isn't allowed.
+	TOCEntry *estargz.TOCEntry
+
+	// Chunks are the contents of the regular file. All chunks but the last one
+	// must have the same size which is a power of two.
+	Chunks []Chunk
+}
+
+// wnode is an inode written to the bootstrap.
+type wnode struct {
+	e        *estargz.TOCEntry
+	chunks   []Chunk
+	children map[string]*wnode
+	parent   *wnode
+	nlink    int
+
+	mode   uint32
+	layout uint16
+	u      uint32
+	size   int64
+	xattrs []byte
+	data   []byte // contents of directories and symlinks
+	inline bool
+
+	off int64
+	nid uint64
+	ino uint32
+}
+
+type writerChunk struct {
+	blob    int
+	index   uint32
+	blk     uint32
+	c       Chunk
+	fileOff int64
+}
+
+// WriteBootstrap writes a RAFS v6 bootstrap of the entries to w. The data blobs
+// are eStargz blobs so chunks are gzip members whose digests are sha256 ones.
+// Blobs are identified with the hex part of their sha256 digests. Files and
+// directories in prefetch are recorded in the prefetch table of the bootstrap.
+func WriteBootstrap(w io.Writer, entries []Entry, blobs []ocispec.Descriptor, prefetch []string) error {
+	root := &wnode{
+		e:        &estargz.TOCEntry{Type: "dir", Mode: 0755},
+		children: make(map[string]*wnode),
+	}
+	root.parent = root
+	names := map[string]*wnode{"": root}
+	var mkdirAll func(name string) (*wnode, error)
+	mkdirAll = func(name string) (*wnode, error) {
+		if n, ok := names[name]; ok {
+			if n.children == nil {
+				return nil, fmt.Errorf("parent %q isn't a directory", name)
+			}
+			return n, nil
+		}
+		parent, err := mkdirAll(cleanWriterName(path.Dir(name)))
+		if err != nil {
+			return nil, err
+		}
+		n := &wnode{
+			e:        &estargz.TOCEntry{Name: name, Type: "dir", Mode: 0755},
+			children: make(map[string]*wnode),
+			parent:   parent,
+		}
+		parent.children[path.Base(name)] = n
+		names[name] = n
+		return n, nil
+	}
+	for _, ent := range entries {
+		e := ent.TOCEntry
+		name := cleanWriterName(e.Name)
+		if name == "" {
+			if e.Type != "dir" {
+				return fmt.Errorf("root must be a directory")
+			}
+			root.e = e
+			continue
+		}
+		parent, err := mkdirAll(cleanWriterName(path.Dir(name)))
+		if err != nil {
+			return err
+		}
+		base := path.Base(name)
+		if e.Type == "hardlink" {
+			org, ok := names[cleanWriterName(e.LinkName)]
+			if !ok || org.e.Type != "reg" {
+				return fmt.Errorf("%q is a hardlink but the target %q isn't a regular file", name, e.LinkName)
+			}
+			parent.children[base] = org
+			names[name] = org
+			continue
+		}
+		n, ok := names[name]
+		if ok && n.children != nil && e.Type == "dir" {
+			n.e = e // keep the implicitly created children
+			continue
+		}
+		n = &wnode{e: e, chunks: ent.Chunks, parent: parent}
+		switch e.Type {
+		case "dir":
+			n.children = make(map[string]*wnode)
+		case "reg", "symlink", "char", "block", "fifo":
+		default:
+			return fmt.Errorf("unsupported type %q of %q", e.Type, name)
+		}
+		parent.children[base] = n
+		names[name] = n
+	}
+
+	// List the inodes in the order of traversal. The root comes first so its nid
+	// fits in the 16 bits field of the superblock.
+	var (
+		nodes []*wnode
+		seen  = make(map[*wnode]bool)
+		walk  func(n *wnode)
+	)
+	walk = func(n *wnode) {
+		n.nlink++
+		if seen[n] {
+			return
+		}
+		seen[n] = true
+		nodes = append(nodes, n)
+		if n.children != nil {
+			n.nlink++ // "." of the directory
+		}
+		for _, base := range sortedChildren(n) {
+			c := n.children[base]
+			if c.children != nil {
+				n.nlink++ // ".." of the child
+			}
+			walk(c)
+		}
+	}
+	walk(root) // the root has no parent but ".." refers to itself
+
+	var hasXattr bool
+	for i, n := range nodes {
+		n.ino = uint32(i + 1)
+		if err := n.prepare(); err != nil {
+			return err
+		}
+		hasXattr = hasXattr || len(n.xattrs) > 0
+	}
+
+	// Inodes are placed from the second block. The meta block address is 0 so
+	// nids are never 0, which the kernel skips in directories.
+	off := int64(writerBlksz)
+	for _, n := range nodes {
+		end := off + 64 + int64(len(n.xattrs))
+		if n.inline {
+			// Inline data must not cross the block boundary.
+			if off%writerBlksz+end-off+int64(len(n.data)) > writerBlksz {
+				off = alignUp(off, writerBlksz)
+				end = off + 64 + int64(len(n.xattrs))
+			}
+			end += int64(len(n.data))
+		} else if n.layout == erofs.LayoutChunkBased {
+			end = alignUp(end, rafsChunkIndexSize) + int64(len(n.chunks))*rafsChunkIndexSize
+		}
+		n.off = off
+		n.nid = uint64(off) / erofs.SlotSize
+		off = alignUp(end, erofs.SlotSize)
+	}
+	if root.nid > math.MaxUint16 {
+		return fmt.Errorf("nid of the root %d is too large", root.nid)
+	}
+
+	// Data blocks of directories and symlinks not inlined.
+	dataAddr := alignUp(off, writerBlksz)
+	off = dataAddr
+	for _, n := range nodes {
+		if n.children != nil {
+			n.data = n.dirents()
+			n.size = int64(len(n.data))
+		}
+		if n.inline || len(n.data) == 0 {
+			continue
+		}
+		n.u = uint32(off / writerBlksz)
+		off = alignUp(off+int64(len(n.data)), writerBlksz)
+	}
+
+	// Chunk table. Chunks are shared among files by their regions in the blobs.
+	type chunkRef struct {
+		blob int
+		off  int64
+	}
+	var (
+		chunks      []*writerChunk
+		chunkRefs   = make(map[chunkRef]*writerChunk)
+		blobChunks  = make([]uint32, len(blobs))
+		blobBlocks  = make([]uint32, len(blobs))
+		blobUncSize = make([]uint64, len(blobs))
+		fileChunks  = make(map[*wnode][]*writerChunk)
+	)
+	for _, n := range nodes {
+		var fileOff int64
+		for _, c := range n.chunks {
+			if c.Blob < 0 || c.Blob >= len(blobs) {
+				return fmt.Errorf("chunk of %q refers to unknown blob %d", n.e.Name, c.Blob)
+			}
+			if c.Size > math.MaxUint32 || c.CompressedSize > math.MaxUint32 {
+				return fmt.Errorf("chunk of %q is too large", n.e.Name)
+			}
+			ref := chunkRef{c.Blob, c.CompressedOffset}
+			wc, ok := chunkRefs[ref]
+			if !ok {
+				wc = &writerChunk{blob: c.Blob, index: blobChunks[c.Blob], blk: blobBlocks[c.Blob], c: c, fileOff: fileOff}
+				if wc.index >= 1<<24 {
+					return fmt.Errorf("too many chunks in blob %d", c.Blob)
+				}
+				blobChunks[c.Blob]++
+				blobBlocks[c.Blob] += uint32((c.Size + writerBlksz - 1) / writerBlksz)
+				blobUncSize[c.Blob] += uint64(c.Size)
+				chunkRefs[ref] = wc
+				chunks = append(chunks, wc)
+			}
+			fileChunks[n] = append(fileChunks[n], wc)
+			fileOff += c.Size
+		}
+	}
+
+	blobTableOff := alignUp(off, 8)
+	chunkTableOff := blobTableOff + int64(len(blobs))*rafsBlobSize
+	prefetchTableOff := chunkTableOff + int64(len(chunks))*rafsChunkInfoSize
+	var prefetchNids []uint32
+	for _, name := range prefetch {
+		if n, ok := names[cleanWriterName(name)]; ok {
+			prefetchNids = append(prefetchNids, uint32(n.nid))
+		}
+	}
+	off = prefetchTableOff + int64(len(prefetchNids))*4
+
+	// The device table is placed in the first block if possible.
+	devTableOff := int64(erofs.SuperOffset + erofs.SuperSize + rafsExtSuperSize)
+	if devTableOff+int64(len(blobs))*erofs.DeviceSlotSize > writerBlksz {
+		devTableOff = alignUp(off, erofs.DeviceSlotSize)
+		off = devTableOff + int64(len(blobs))*erofs.DeviceSlotSize
+	}
+	if devTableOff/erofs.DeviceSlotSize > math.MaxUint16 {
+		return fmt.Errorf("too large bootstrap to have the device table")
+	}
+	p := make([]byte, alignUp(off, writerBlksz))
+
+	// Superblock
+	sb := p[erofs.SuperOffset:]
+	binary.LittleEndian.PutUint32(sb[0:], erofs.Magic)
+	binary.LittleEndian.PutUint32(sb[8:], rafsFeatureCompat)
+	sb[12] = writerBlkszBits
+	binary.LittleEndian.PutUint16(sb[14:], uint16(root.nid))
+	binary.LittleEndian.PutUint64(sb[16:], uint64(len(nodes)))
+	binary.LittleEndian.PutUint32(sb[36:], uint32(len(p)/writerBlksz))
+	binary.LittleEndian.PutUint32(sb[80:], erofs.FeatureIncompatChunkedFile|erofs.FeatureIncompatDeviceTable)
+	binary.LittleEndian.PutUint16(sb[86:], uint16(len(blobs)))
+	binary.LittleEndian.PutUint16(sb[88:], uint16(devTableOff/erofs.DeviceSlotSize))
+
+	ext := p[erofs.SuperOffset+erofs.SuperSize:]
+	flags := uint64(rafsFlagHashSHA256 | rafsFlagExplicitUIDGID | rafsFlagCompressionGzip)
+	if hasXattr {
+		flags |= rafsFlagHasXattr
+	}
+	binary.LittleEndian.PutUint64(ext[0:], flags)
+	binary.LittleEndian.PutUint64(ext[8:], uint64(blobTableOff))
+	binary.LittleEndian.PutUint32(ext[16:], uint32(len(blobs)*rafsBlobSize))
+	binary.LittleEndian.PutUint32(ext[20:], rafsDefaultChunkSize)
+	binary.LittleEndian.PutUint64(ext[24:], uint64(chunkTableOff))
+	binary.LittleEndian.PutUint64(ext[32:], uint64(len(chunks)*rafsChunkInfoSize))
+	binary.LittleEndian.PutUint64(ext[40:], uint64(prefetchTableOff))
+	binary.LittleEndian.PutUint32(ext[48:], uint32(len(prefetchNids)*4))
+
+	// Inodes and data
+	for _, n := range nodes {
+		in := p[n.off:]
+		format := uint16(1) | n.layout<<1 // extended inode
+		binary.LittleEndian.PutUint16(in[0:], format)
+		if len(n.xattrs) > 0 {
+			binary.LittleEndian.PutUint16(in[2:], uint16((len(n.xattrs)-12)/4+1))
+		}
+		binary.LittleEndian.PutUint16(in[4:], uint16(n.mode))
+		binary.LittleEndian.PutUint64(in[8:], uint64(n.size))
+		binary.LittleEndian.PutUint32(in[16:], n.u)
+		binary.LittleEndian.PutUint32(in[20:], n.ino)
+		binary.LittleEndian.PutUint32(in[24:], uint32(n.e.UID))
+		binary.LittleEndian.PutUint32(in[28:], uint32(n.e.GID))
+		if mtime, err := time.Parse(time.RFC3339, n.e.ModTime3339); err == nil {
+			binary.LittleEndian.PutUint64(in[32:], uint64(mtime.Unix()))
+			binary.LittleEndian.PutUint32(in[40:], uint32(mtime.Nanosecond()))
+		}
+		binary.LittleEndian.PutUint32(in[44:], uint32(n.nlink))
+		tail := n.off + 64 + int64(copy(in[64:], n.xattrs))
+		switch {
+		case n.inline:
+			copy(p[tail:], n.data)
+		case n.layout == erofs.LayoutChunkBased:
+			idx := p[alignUp(tail, rafsChunkIndexSize):]
+			for i, wc := range fileChunks[n] {
+				// The low byte of the device ID is the blob index + 1 and the rest
+				// is the index of the chunk in the blob.
+				binary.LittleEndian.PutUint16(idx[i*rafsChunkIndexSize:], uint16(wc.index))
+				binary.LittleEndian.PutUint16(idx[i*rafsChunkIndexSize+2:], uint16(wc.index>>16)<<8|uint16(wc.blob+1))
+				binary.LittleEndian.PutUint32(idx[i*rafsChunkIndexSize+4:], wc.blk)
+			}
+		case len(n.data) > 0:
+			copy(p[int64(n.u)*writerBlksz:], n.data)
+		}
+	}
+
+	// Tables
+	for i, b := range blobs {
+		id := b.Digest.Encoded()
+		if b.Digest.Algorithm() != digest.SHA256 || len(id) > 64 {
+			return fmt.Errorf("unsupported digest of blob %q", b.Digest)
+		}
+		e := p[blobTableOff+int64(i)*rafsBlobSize:]
+		copy(e[0:64], id)
+		binary.LittleEndian.PutUint32(e[64:], uint32(i))
+		binary.LittleEndian.PutUint32(e[68:], rafsDefaultChunkSize)
+		binary.LittleEndian.PutUint32(e[72:], blobChunks[i])
+		binary.LittleEndian.PutUint32(e[76:], compressorGzip)
+		binary.LittleEndian.PutUint32(e[80:], digesterSHA256)
+		binary.LittleEndian.PutUint64(e[88:], uint64(b.Size))
+		binary.LittleEndian.PutUint64(e[96:], blobUncSize[i])
+
+		slot := p[devTableOff+int64(i)*erofs.DeviceSlotSize:]
+		copy(slot[0:64], id)
+		binary.LittleEndian.PutUint32(slot[64:], blobBlocks[i])
+	}
+	for i, wc := range chunks {
+		d, err := chunkDigest(wc.c.Digest)
+		if err != nil {
+			return err
+		}
+		e := p[chunkTableOff+int64(i)*rafsChunkInfoSize:]
+		copy(e[0:32], d)
+		binary.LittleEndian.PutUint32(e[32:], uint32(wc.blob))
+		binary.LittleEndian.PutUint32(e[36:], chunkFlagCompressed)
+		binary.LittleEndian.PutUint32(e[40:], uint32(wc.c.CompressedSize))
+		binary.LittleEndian.PutUint32(e[44:], uint32(wc.c.Size))
+		binary.LittleEndian.PutUint64(e[48:], uint64(wc.c.CompressedOffset))
+		binary.LittleEndian.PutUint64(e[56:], uint64(wc.blk)*writerBlksz)
+		binary.LittleEndian.PutUint64(e[64:], uint64(wc.fileOff))
+		binary.LittleEndian.PutUint32(e[72:], wc.index)
+	}
+	for i, nid := range prefetchNids {
+		binary.LittleEndian.PutUint32(p[prefetchTableOff+int64(i)*4:], nid)
+	}
+
+	_, err := w.Write(p)
+	return err
+}
+
+// prepare decides the mode, the layout and the attributes of the inode.
+func (n *wnode) prepare() error {
+	e := n.e
+	n.mode = uint32(e.Mode & 07777)
+	switch e.Type {
+	case "dir":
+		n.mode |= syscall.S_IFDIR
+		n.layout = erofs.LayoutFlatPlain
+	case "symlink":
+		n.mode |= syscall.S_IFLNK
+		n.data, n.size = []byte(e.LinkName), int64(len(e.LinkName))
+		n.layout = erofs.LayoutFlatPlain
+	case "char":
+		n.mode |= syscall.S_IFCHR
+		n.u = erofs.EncodeDev(uint32(e.DevMajor), uint32(e.DevMinor))
+	case "block":
+		n.mode |= syscall.S_IFBLK
+		n.u = erofs.EncodeDev(uint32(e.DevMajor), uint32(e.DevMinor))
+	case "fifo":
+		n.mode |= syscall.S_IFIFO
+	case "reg":
+		n.mode |= syscall.S_IFREG
+		n.size = e.Size
+		if e.Size == 0 {
+			break
+		}
+		chunkbits, err := chunkBits(n.chunks, e.Size)
+		if err != nil {
+			return fmt.Errorf("invalid chunks of %q: %v", e.Name, err)
+		}
+		n.layout = erofs.LayoutChunkBased
+		n.u = erofs.ChunkFormatIndexes | uint32(chunkbits-writerBlkszBits)
+	}
+	xattrs, err := xattrBody(e.Xattrs)
+	if err != nil {
+		return fmt.Errorf("invalid xattrs of %q: %v", e.Name, err)
+	}
+	n.xattrs = xattrs
+	if e.Type == "symlink" && 64+len(n.xattrs)+len(n.data) <= writerBlksz {
+		n.layout, n.inline = erofs.LayoutFlatInline, true
+	}
+	return nil
+}
+
+// dirents returns the contents of the directory. Entries are sorted by their
+// names and each block starts with dirents followed by the names.
+func (n *wnode) dirents() []byte {
+	ents := map[string]*wnode{".": n, "..": n.parent}
+	for base, c := range n.children {
+		ents[base] = c
+	}
+	var names []string
+	for base := range ents {
+		names = append(names, base)
+	}
+	sort.Strings(names)
+
+	var p []byte
+	for len(names) > 0 {
+		i, size := 0, 0
+		for ; i < len(names) && size+erofs.DirentSize+len(names[i]) <= writerBlksz; i++ {
+			size += erofs.DirentSize + len(names[i])
+		}
+		blk := make([]byte, i*erofs.DirentSize, size)
+		for j, base := range names[:i] {
+			c := ents[base]
+			d := blk[j*erofs.DirentSize:]
+			binary.LittleEndian.PutUint64(d[0:], c.nid)
+			binary.LittleEndian.PutUint16(d[8:], uint16(len(blk)))
+			d[10] = erofs.FileType(c.mode)
+			blk = append(blk, base...)
+		}
+		names = names[i:]
+		if len(names) > 0 { // pad all blocks but the last one
+			blk = append(blk, make([]byte, writerBlksz-len(blk))...)
+		}
+		p = append(p, blk...)
+	}
+	return p
+}
+
+// chunkBits returns log2 of the chunk size of the file.
+func chunkBits(chunks []Chunk, size int64) (uint, error) {
+	if len(chunks) == 0 {
+		return 0, fmt.Errorf("no chunk")
+	}
+	chunkSize, total := chunks[0].Size, int64(0)
+	for i, c := range chunks {
+		if c.Size <= 0 || c.Size > chunkSize || (i < len(chunks)-1 && c.Size != chunkSize) {
+			return 0, fmt.Errorf("chunk %d has invalid size %d", i, c.Size)
+		}
+		total += c.Size
+	}
+	if total != size {
+		return 0, fmt.Errorf("total size of chunks %d doesn't match to the file size %d", total, size)
+	}
+	if len(chunks) == 1 && chunkSize < writerBlksz {
+		chunkSize = writerBlksz
+	}
+	b := uint(bits.Len64(uint64(chunkSize - 1)))
+	if len(chunks) > 1 && int64(1)<<b != chunkSize {
+		return 0, fmt.Errorf("chunk size %d isn't a power of two", chunkSize)
+	}
+	if b < writerBlkszBits || b-writerBlkszBits > erofs.ChunkFormatBlkbitsMask {
+		return 0, fmt.Errorf("unsupported chunk size %d", chunkSize)
+	}
+	return b, nil
+}
+
+// xattrBody returns the inline xattr body of the inode. Xattrs without known
+// prefixes can't be recorded.
+func xattrBody(xattrs map[string][]byte) ([]byte, error) {
+	if len(xattrs) == 0 {
+		return nil, nil
+	}
+	var keys []string
+	for k := range xattrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	p := make([]byte, 12)
+	for _, k := range keys {
+		idx, name := xattrIndex(k)
+		if idx == 0 {
+			return nil, fmt.Errorf("unsupported xattr %q", k)
+		}
+		v := xattrs[k]
+		if len(name) > math.MaxUint8 || len(v) > math.MaxUint16 {
+			return nil, fmt.Errorf("too large xattr %q", k)
+		}
+		e := []byte{byte(len(name)), idx, 0, 0}
+		binary.LittleEndian.PutUint16(e[2:], uint16(len(v)))
+		e = append(append(e, name...), v...)
+		p = append(p, e...)
+		p = append(p, make([]byte, int(alignUp(int64(len(e)), 4))-len(e))...)
+	}
+	return p, nil
+}
+
+func xattrIndex(key string) (uint8, string) {
+	var (
+		idx    uint8
+		prefix string
+	)
+	for i, pfx := range xattrPrefixes {
+		if strings.HasPrefix(key, pfx) && len(pfx) > len(prefix) {
+			idx, prefix = i, pfx
+		}
+	}
+	return idx, key[len(prefix):]
+}
+
+func chunkDigest(d digest.Digest) ([]byte, error) {
+	if err := d.Validate(); err != nil || d.Algorithm() != digest.SHA256 {
+		return nil, fmt.Errorf("invalid chunk digest %q", d)
+	}
+	return hex.DecodeString(d.Encoded())
+}
+
+func cleanWriterName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func sortedChildren(n *wnode) []string {
+	var names []string
+	for base := range n.children {
+		names = append(names, base)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func alignUp(v, a int64) int64 {
+	return (v + a - 1) / a * a
+}
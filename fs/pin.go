@@ -0,0 +1,263 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/stargz-snapshotter/cache"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/pkg/errors"
+)
+
+const pinsFileName = "pins.json"
+
+// LayerPin is a layer whose cached chunks are never evicted from the
+// filesystem cache (e.g. by the disk usage watermark).
+type LayerPin struct {
+	Digest   string    `json:"digest"`
+	Ref      string    `json:"ref,omitempty"`
+	PinnedAt time.Time `json:"pinnedAt"`
+
+	// Chunks is the number of chunks pinned in the cache. This is zero until
+	// the layer is resolved after the daemon started.
+	Chunks int `json:"chunks"`
+
+	// Materialized is true if all contents of the layer have been fetched to
+	// the cache by Materialize.
+	Materialized bool `json:"materialized,omitempty"`
+}
+
+// CachePinner pins layers in the filesystem cache. Pins persist across
+// restarts of the daemon. The filesystem returned by NewFilesystem implements
+// this interface.
+type CachePinner interface {
+	PinLayers(ctx context.Context, ref string, digests []string) error
+	UnpinLayers(ctx context.Context, digests []string) error
+	Pins(ctx context.Context) []LayerPin
+}
+
+var _ = (CachePinner)((*filesystem)(nil))
+
+// PinLayers pins the layers of the digests. ref is the reference of the image
+// recorded for information. Chunks of layers not resolved yet are pinned when
+// they are resolved.
+func (fs *filesystem) PinLayers(ctx context.Context, ref string, digests []string) error {
+	if fs.pins == nil {
+		return errors.Wrapf(errdefs.ErrNotImplemented, "filesystem cache doesn't support pinning")
+	}
+	if err := fs.pins.pin(ref, digests); err != nil {
+		return err
+	}
+	fs.layerMu.Lock()
+	defer fs.layerMu.Unlock()
+	for _, l := range fs.layer {
+		fs.pins.apply(l.desc.Digest.String(), l.verifiableReader)
+	}
+	return nil
+}
+
+// UnpinLayers unpins the layers of the digests. The chunks become evictable
+// unless they are also contained in other pinned layers.
+func (fs *filesystem) UnpinLayers(ctx context.Context, digests []string) error {
+	if fs.pins == nil {
+		return errors.Wrapf(errdefs.ErrNotImplemented, "filesystem cache doesn't support pinning")
+	}
+	if err := fs.pins.unpin(digests); err != nil {
+		return err
+	}
+	unpinned := make(map[string]bool)
+	for _, d := range digests {
+		unpinned[d] = true
+	}
+	fs.layerMu.Lock()
+	defer fs.layerMu.Unlock()
+	for _, l := range fs.layer {
+		if unpinned[l.desc.Digest.String()] {
+			l.unmaterialize() // contents are evictable again
+		}
+	}
+	return nil
+}
+
+// Pins returns the pinned layers sorted by the digest.
+func (fs *filesystem) Pins(ctx context.Context) []LayerPin {
+	if fs.pins == nil {
+		return []LayerPin{}
+	}
+	return fs.pins.list()
+}
+
+// pinStore persistently records pinned layers and pins their chunks in the
+// cache. Chunks are pinned by their cache keys, which are derived from their
+// contents, so the same chunk in several pinned layers is pinned for each.
+type pinStore struct {
+	path    string
+	cache   cache.Pinner
+	pins    map[string]LayerPin // layer digest -> pin
+	applied map[string][]string // layer digest -> keys pinned in the cache
+	mu      sync.Mutex
+	now     func() time.Time
+}
+
+func newPinStore(path string, c cache.Pinner) (*pinStore, error) {
+	ps := &pinStore{
+		path:    path,
+		cache:   c,
+		pins:    make(map[string]LayerPin),
+		applied: make(map[string][]string),
+		now:     time.Now,
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ps, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &ps.pins); err != nil {
+		// Unlike other records, losing pins silently would let the chunks
+		// be evicted so this is an error.
+		return nil, errors.Wrapf(err, "failed to parse %q", path)
+	}
+	return ps, nil
+}
+
+func (ps *pinStore) pin(ref string, digests []string) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	var changed bool
+	for _, d := range digests {
+		if _, ok := ps.pins[d]; !ok {
+			ps.pins[d] = LayerPin{Digest: d, Ref: ref, PinnedAt: ps.now()}
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return ps.flushUnlocked()
+}
+
+// materialize pins the layer and records that all of its contents are cached.
+func (ps *pinStore) materialize(ref, dgst string) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	p, ok := ps.pins[dgst]
+	if !ok {
+		p = LayerPin{Digest: dgst, Ref: ref, PinnedAt: ps.now()}
+	} else if p.Materialized {
+		return nil
+	}
+	p.Materialized = true
+	ps.pins[dgst] = p
+	return ps.flushUnlocked()
+}
+
+// unmaterialize records that contents of the layer aren't fully cached anymore.
+// The layer stays pinned.
+func (ps *pinStore) unmaterialize(dgst string) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	p, ok := ps.pins[dgst]
+	if !ok || !p.Materialized {
+		return nil
+	}
+	p.Materialized = false
+	ps.pins[dgst] = p
+	return ps.flushUnlocked()
+}
+
+func (ps *pinStore) isMaterialized(dgst string) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.pins[dgst].Materialized
+}
+
+func (ps *pinStore) unpin(digests []string) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for _, d := range digests {
+		delete(ps.pins, d)
+		for _, key := range ps.applied[d] {
+			ps.cache.Unpin(key)
+		}
+		delete(ps.applied, d)
+	}
+	return ps.flushUnlocked()
+}
+
+// apply pins the chunks of the layer in the cache if the layer is pinned and
+// its chunks aren't pinned yet.
+func (ps *pinStore) apply(dgst string, w chunkEntryWalker) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if _, ok := ps.pins[dgst]; !ok {
+		return
+	}
+	if _, ok := ps.applied[dgst]; ok {
+		return
+	}
+	keys := []string{}
+	w.ForeachChunkEntry(func(id string, ce *estargz.TOCEntry) {
+		ps.cache.Pin(id)
+		keys = append(keys, id)
+	})
+	ps.applied[dgst] = keys
+}
+
+func (ps *pinStore) list() []LayerPin {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	res := []LayerPin{}
+	for d, p := range ps.pins {
+		p.Chunks = len(ps.applied[d])
+		res = append(res, p)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Digest < res[j].Digest })
+	return res
+}
+
+func (ps *pinStore) flushUnlocked() error {
+	data, err := json.Marshal(ps.pins)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(ps.path), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(ps.path), "tmp-"+pinsFileName)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "failed to write %q", tmp.Name())
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), ps.path)
+}
@@ -0,0 +1,142 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	digest "github.com/opencontainers/go-digest"
+)
+
+const (
+	predictQueueSize       = 1000
+	predictFetchTimeoutSec = 120
+)
+
+// PrefetchPolicy predicts files of a layer which will be accessed soon. Files
+// predicted by the policy are prefetched in background while no prioritized
+// task (e.g. Mount) is running.
+type PrefetchPolicy interface {
+	// Observe is called when the file in the layer is opened.
+	Observe(layer digest.Digest, path string)
+
+	// Predict returns files likely accessed after the file, most likely first.
+	Predict(layer digest.Digest, path string) []string
+
+	// Flush is called when a mount of the layer is unmounted. The policy can
+	// persist what it learned from the mount.
+	Flush(layer digest.Digest) error
+}
+
+// predictivePrefetcher prefetches files predicted by the policy on each file
+// open.
+type predictivePrefetcher struct {
+	fs     *filesystem
+	policy PrefetchPolicy
+	queue  chan predictTask
+	seen   map[string]map[string]struct{} // mountpoint -> files opened or queued
+	mu     sync.Mutex
+}
+
+type predictTask struct {
+	mountpoint string
+	l          *layer
+	name       string
+}
+
+func newPredictivePrefetcher(fs *filesystem, policy PrefetchPolicy) *predictivePrefetcher {
+	p := &predictivePrefetcher{
+		fs:     fs,
+		policy: policy,
+		queue:  make(chan predictTask, predictQueueSize),
+		seen:   make(map[string]map[string]struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// observe tells the policy the access to the file and queues files predicted to
+// be accessed next.
+func (p *predictivePrefetcher) observe(mountpoint, name string) {
+	p.fs.layerMu.Lock()
+	l := p.fs.layer[mountpoint]
+	p.fs.layerMu.Unlock()
+	if l == nil {
+		return
+	}
+	p.policy.Observe(l.desc.Digest, name)
+	predicted := p.policy.Predict(l.desc.Digest, name)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	seen, ok := p.seen[mountpoint]
+	if !ok {
+		seen = make(map[string]struct{})
+		p.seen[mountpoint] = seen
+	}
+	seen[name] = struct{}{}
+	for _, f := range predicted {
+		if _, ok := seen[f]; ok {
+			continue
+		}
+		select {
+		case p.queue <- predictTask{mountpoint, l, f}:
+			seen[f] = struct{}{}
+		default:
+			return // queue is full; predictions are best-effort
+		}
+	}
+}
+
+// forget flushes the policy for the layer unmounted from the mountpoint.
+func (p *predictivePrefetcher) forget(ctx context.Context, mountpoint string, l *layer) {
+	p.mu.Lock()
+	delete(p.seen, mountpoint)
+	p.mu.Unlock()
+	if err := p.policy.Flush(l.desc.Digest); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to flush prefetch policy")
+	}
+}
+
+func (p *predictivePrefetcher) run() {
+	buf := make([]byte, hintPrefetchBufSize)
+	for t := range p.queue {
+		p.fs.layerMu.Lock()
+		mounted := p.fs.layer[t.mountpoint] == t.l
+		p.fs.layerMu.Unlock()
+		if !mounted {
+			continue
+		}
+		lr, err := t.l.reader()
+		if err != nil {
+			continue
+		}
+		if e, ok := lr.Lookup(t.name); !ok || e.Type != "reg" {
+			continue
+		}
+		// Use background task manager so that prioritized tasks aren't
+		// disturbed by predictive prefetch.
+		p.fs.backgroundTaskManager.InvokeBackgroundTask(func(ctx context.Context) {
+			if err := fetchFile(lr, t.name, buf); err != nil {
+				log.G(ctx).WithError(err).Debugf("failed to prefetch predicted file %q", t.name)
+			}
+		}, predictFetchTimeoutSec*time.Second)
+	}
+}
@@ -0,0 +1,37 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+
+	"github.com/containerd/stargz-snapshotter/util/ratelimit"
+)
+
+// RateLimitReporter reports rate limits of registries observed by fetches of
+// layers. The filesystem returned by NewFilesystem implements this interface.
+type RateLimitReporter interface {
+	RateLimitStats(ctx context.Context) []ratelimit.HostStats
+}
+
+var _ = (RateLimitReporter)((*filesystem)(nil))
+
+// RateLimitStats returns the rate limits reported by the registries and the
+// background fetches deferred by them.
+func (fs *filesystem) RateLimitStats(ctx context.Context) []ratelimit.HostStats {
+	return fs.resolver.RateLimitStats()
+}
@@ -0,0 +1,107 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package reader
+
+import (
+	"sort"
+	"sync"
+)
+
+// IntegrityStats is the statistics of chunks read from the cache which failed
+// verification.
+type IntegrityStats struct {
+	Corrupted   int64    `json:"corrupted"`             // cached chunks failed verification
+	Refetched   int64    `json:"refetched"`             // corrupted chunks refetched from the blob
+	Quarantined []string `json:"quarantined,omitempty"` // keys of quarantined chunks
+}
+
+// ChunkQuarantine tracks chunks whose contents in the cache failed
+// verification. Such chunks are dropped from the cache and refetched from the
+// blob. Chunks failing threshold times are quarantined: they are always read
+// from the blob and never stored in the cache again, so a faulty region of the
+// cache storage doesn't cause a refetch on every read. A nil ChunkQuarantine
+// quarantines nothing.
+type ChunkQuarantine struct {
+	threshold   int
+	onCorrupted func(key string, quarantined bool)
+
+	mu         sync.Mutex
+	failures   map[string]int
+	quarantine map[string]struct{}
+	stats      IntegrityStats // Quarantined isn't used
+}
+
+// NewChunkQuarantine returns a ChunkQuarantine which quarantines chunks after
+// threshold verification failures. onCorrupted is called on each failure if
+// non-nil.
+func NewChunkQuarantine(threshold int, onCorrupted func(key string, quarantined bool)) *ChunkQuarantine {
+	if threshold <= 0 {
+		threshold = 1
+	}
+	return &ChunkQuarantine{
+		threshold:   threshold,
+		onCorrupted: onCorrupted,
+		failures:    make(map[string]int),
+		quarantine:  make(map[string]struct{}),
+	}
+}
+
+// Stats returns the statistics of verification failures.
+func (q *ChunkQuarantine) Stats() IntegrityStats {
+	if q == nil {
+		return IntegrityStats{}
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s := q.stats
+	for key := range q.quarantine {
+		s.Quarantined = append(s.Quarantined, key)
+	}
+	sort.Strings(s.Quarantined)
+	return s
+}
+
+func (q *ChunkQuarantine) quarantined(key string) bool {
+	if q == nil {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	_, ok := q.quarantine[key]
+	return ok
+}
+
+func (q *ChunkQuarantine) reportCorrupted(key string) {
+	q.mu.Lock()
+	q.stats.Corrupted++
+	q.failures[key]++
+	quarantined := q.failures[key] >= q.threshold
+	if quarantined {
+		q.quarantine[key] = struct{}{}
+		delete(q.failures, key)
+	}
+	q.mu.Unlock()
+	if q.onCorrupted != nil {
+		q.onCorrupted(key, quarantined)
+	}
+}
+
+func (q *ChunkQuarantine) refetched() {
+	q.mu.Lock()
+	q.stats.Refetched++
+	q.mu.Unlock()
+}
@@ -24,13 +24,17 @@ package reader
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/sha256"
 	"fmt"
 	"io"
+	"os"
 	"path/filepath"
 	"runtime"
 	"sync"
+	"time"
+	"unsafe"
 
 	"github.com/containerd/stargz-snapshotter/cache"
 	"github.com/containerd/stargz-snapshotter/estargz"
@@ -48,6 +52,32 @@ type Reader interface {
 	Cache(opts ...CacheOption) error
 }
 
+// ChunkFile is implemented by files returned by Reader.OpenFile whose chunks
+// can be read from the cache files directly.
+type ChunkFile interface {
+
+	// CachedChunk locates the chunk holding the region [offset, offset+size)
+	// of the file. This returns the key of the chunk in the cache, the offset
+	// of the region in the chunk and its size, which is shorter than size only
+	// at the end of the file. ok is false if the region spans multiple chunks
+	// or the cache doesn't store chunks in files.
+	CachedChunk(offset int64, size int) (key string, fileOffset int64, n int, ok bool)
+
+	// OpenCachedChunk opens the cache file of the chunk returned by
+	// CachedChunk. The caller must close the file.
+	OpenCachedChunk(key string) (*os.File, error)
+}
+
+// SparseFile is implemented by files returned by Reader.OpenFile which can
+// locate holes of sparse files.
+type SparseFile interface {
+
+	// NextRegion returns the start of the first hole (if hole is true) or
+	// data region at or after offset. The end of the file is regarded as a
+	// hole. ok is false if there is no such region.
+	NextRegion(offset int64, hole bool) (next int64, ok bool)
+}
+
 // VerifiableReader produces a Reader with a given verifier.
 type VerifiableReader struct {
 	r *reader
@@ -67,6 +97,126 @@ func (vr *VerifiableReader) VerifyTOC(tocDigest digest.Digest) (Reader, error) {
 	return vr.r, nil
 }
 
+// TOCJSON returns the raw TOC JSON of this layer.
+func (vr *VerifiableReader) TOCJSON() ([]byte, error) {
+	return vr.r.r.TOCJSON()
+}
+
+// ForeachChunk calls f for each chunk of regular files contained in this layer
+// with the key of the chunk in the cache and its size. Chunks that have the same
+// contents have the same key so they are stored only once in the cache even if
+// they are contained in different layers.
+func (vr *VerifiableReader) ForeachChunk(f func(id string, size int64)) error {
+	return vr.ForeachChunkEntry(func(id string, ce *estargz.TOCEntry) {
+		f(id, ce.ChunkSize)
+	})
+}
+
+// ForeachChunkEntry is the same as ForeachChunk but passes the TOCEntry of each
+// chunk, which tells the position of the chunk in the layer blob.
+func (vr *VerifiableReader) ForeachChunkEntry(f func(id string, ce *estargz.TOCEntry)) error {
+	root, ok := vr.r.r.Lookup("")
+	if !ok {
+		return fmt.Errorf("failed to get a TOCEntry of the root")
+	}
+	return vr.r.foreachChunk(root, 0, f)
+}
+
+func (gr *reader) foreachChunk(dir *estargz.TOCEntry, depth int, f func(id string, ce *estargz.TOCEntry)) (rErr error) {
+	if depth > maxWalkDepth {
+		return fmt.Errorf("TOCEntry tree is too deep (depth:%d)", depth)
+	}
+	dir.ForeachChild(func(_ string, e *estargz.TOCEntry) bool {
+		if e.Type == "dir" {
+			if e.Name == "" && dir.Name == "" {
+				return true
+			}
+			if filepath.Dir(filepath.Clean(e.Name)) != filepath.Clean(dir.Name) {
+				rErr = fmt.Errorf("invalid child path %q; must be child of %q",
+					e.Name, dir.Name)
+				return false
+			}
+			rErr = gr.foreachChunk(e, depth+1, f)
+			return rErr == nil
+		} else if e.Type != "reg" || e.Name == estargz.TOCTarName {
+			return true
+		}
+		var nr int64
+		for nr < e.Size {
+			ce, ok := gr.r.ChunkEntryForOffset(e.Name, nr)
+			if !ok {
+				break
+			}
+			nr += ce.ChunkSize
+			f(gr.chunkID(e.Digest, ce), ce)
+		}
+		return true
+	})
+	return
+}
+
+// tocEntryOverhead is the estimated memory used for indexing a TOCEntry (e.g.
+// entries of maps) in addition to the entry itself.
+const tocEntryOverhead = 64
+
+// MetadataSize returns the estimated size of the memory used by the metadata
+// (parsed TOC) of this layer.
+func (vr *VerifiableReader) MetadataSize() int64 {
+	if vr.r == nil {
+		return 0
+	}
+	r := vr.r.r
+	root, ok := r.Lookup("")
+	if !ok {
+		return 0
+	}
+	size := entryMemSize(root)
+	var walk func(dir *estargz.TOCEntry, depth int)
+	walk = func(dir *estargz.TOCEntry, depth int) {
+		if depth > maxWalkDepth {
+			return
+		}
+		dir.ForeachChild(func(_ string, e *estargz.TOCEntry) bool {
+			switch e.Type {
+			case "dir":
+				if e.Name == "" && dir.Name == "" {
+					return true
+				}
+				size += entryMemSize(e)
+				walk(e, depth+1)
+			case "reg":
+				size += entryMemSize(e)
+				var nr int64
+				for nr < e.Size {
+					ce, ok := r.ChunkEntryForOffset(e.Name, nr)
+					if !ok || ce.ChunkSize <= 0 {
+						break
+					}
+					if ce != e {
+						size += entryMemSize(ce)
+					}
+					nr += ce.ChunkSize
+				}
+			default:
+				size += entryMemSize(e)
+			}
+			return true
+		})
+	}
+	walk(root, 0)
+	return size
+}
+
+func entryMemSize(e *estargz.TOCEntry) int64 {
+	n := int64(unsafe.Sizeof(*e)) + tocEntryOverhead +
+		int64(len(e.Name)+len(e.LinkName)+len(e.Uname)+len(e.Gname)+
+			len(e.ModTime3339)+len(e.Digest)+len(e.ChunkDigest))
+	for k, v := range e.Xattrs {
+		n += int64(len(k) + len(v))
+	}
+	return n
+}
+
 type nopTOCEntryVerifier struct{}
 
 func (nev nopTOCEntryVerifier) Verifier(ce *estargz.TOCEntry) (digest.Verifier, error) {
@@ -86,7 +236,7 @@ func (nv nopVerifier) Verified() bool {
 // NewReader creates a Reader based on the given stargz blob and cache implementation.
 // It returns VerifiableReader so the caller must provide a estargz.TOCEntryVerifier
 // to use for verifying file or chunk contained in this stargz blob.
-func NewReader(sr *io.SectionReader, cache cache.BlobCache) (*VerifiableReader, *estargz.TOCEntry, error) {
+func NewReader(sr *io.SectionReader, cache cache.BlobCache, opts ...Option) (*VerifiableReader, *estargz.TOCEntry, error) {
 	r, err := estargz.Open(sr)
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "failed to parse stargz")
@@ -97,26 +247,67 @@ func NewReader(sr *io.SectionReader, cache cache.BlobCache) (*VerifiableReader,
 		return nil, nil, fmt.Errorf("failed to get a TOCEntry of the root")
 	}
 
-	vr := &reader{
-		r:     r,
-		sr:    sr,
-		cache: cache,
+	return &VerifiableReader{newReaderFromStargz(r, sr, cache, opts)}, root, nil
+}
+
+func newReaderFromStargz(r *estargz.Reader, sr *io.SectionReader, cache cache.BlobCache, opts []Option) *reader {
+	var rOpts options
+	for _, o := range opts {
+		o(&rOpts)
+	}
+	return &reader{
+		r:           r,
+		sr:          sr,
+		cache:       cache,
+		streamer:    rOpts.streamer,
+		observer:    rOpts.missObserver,
+		hitObserver: rOpts.hitObserver,
+		quarantine:  rOpts.quarantine,
+		source:      rOpts.chunkSource,
+		ctxReaderAt: rOpts.ctxReaderAt,
+
+		contentAddressed: rOpts.contentAddressed,
 		bufPool: sync.Pool{
 			New: func() interface{} {
 				return new(bytes.Buffer)
 			},
 		},
 	}
+}
 
-	return &VerifiableReader{vr}, root, nil
+// NewSharedReader creates a Reader of the same blob as base using the given
+// section reader and cache implementation. The metadata (TOC) of base is shared
+// so the TOC isn't fetched nor parsed again.
+func NewSharedReader(base *VerifiableReader, sr *io.SectionReader, cache cache.BlobCache, opts ...Option) (*VerifiableReader, *estargz.TOCEntry, error) {
+	if base.r.sr.Size() != sr.Size() {
+		return nil, nil, fmt.Errorf("size of blob %d doesn't match to the base %d",
+			sr.Size(), base.r.sr.Size())
+	}
+	r := base.r.r.WithSectionReader(sr)
+	root, ok := r.Lookup("")
+	if !ok {
+		return nil, nil, fmt.Errorf("failed to get a TOCEntry of the root")
+	}
+	return &VerifiableReader{newReaderFromStargz(r, sr, cache, opts)}, root, nil
 }
 
 type reader struct {
-	r        *estargz.Reader
-	sr       *io.SectionReader
-	cache    cache.BlobCache
-	bufPool  sync.Pool
-	verifier estargz.TOCEntryVerifier
+	r           *estargz.Reader
+	sr          *io.SectionReader
+	cache       cache.BlobCache
+	streamer    Streamer
+	observer    MissObserver
+	hitObserver HitObserver
+	bufPool     sync.Pool
+	verifier    estargz.TOCEntryVerifier
+	source      ChunkSource
+	ctxReaderAt ContextReaderAt
+
+	// quarantine is non-nil if chunks read from the cache are verified.
+	quarantine *ChunkQuarantine
+
+	// contentAddressed is true if chunks are keyed by their digests.
+	contentAddressed bool
 }
 
 func (gr *reader) OpenFile(name string) (io.ReaderAt, error) {
@@ -167,15 +358,18 @@ func (gr *reader) Cache(opts ...CacheOption) (err error) {
 	}
 
 	eg, egCtx := errgroup.WithContext(context.Background())
+	// Hardlinks share the TOCEntry of the target so seen makes sure that the
+	// contents are cached once.
+	seen := make(map[*estargz.TOCEntry]struct{})
 	eg.Go(func() error {
 		return gr.cacheWithReader(egCtx,
 			0, eg, semaphore.NewWeighted(int64(runtime.GOMAXPROCS(0))),
-			root, r, filter, cacheOpts.cacheOpts...)
+			root, r, filter, seen, cacheOpts.cacheOpts...)
 	})
 	return eg.Wait()
 }
 
-func (gr *reader) cacheWithReader(ctx context.Context, currentDepth int, eg *errgroup.Group, sem *semaphore.Weighted, dir *estargz.TOCEntry, r *estargz.Reader, filter func(*estargz.TOCEntry) bool, opts ...cache.Option) (rErr error) {
+func (gr *reader) cacheWithReader(ctx context.Context, currentDepth int, eg *errgroup.Group, sem *semaphore.Weighted, dir *estargz.TOCEntry, r *estargz.Reader, filter func(*estargz.TOCEntry) bool, seen map[*estargz.TOCEntry]struct{}, opts ...cache.Option) (rErr error) {
 	if currentDepth > maxWalkDepth {
 		return fmt.Errorf("TOCEntry tree is too deep (depth:%d)", currentDepth)
 	}
@@ -195,7 +389,7 @@ func (gr *reader) cacheWithReader(ctx context.Context, currentDepth int, eg *err
 					e.Name, dir.Name)
 				return false
 			}
-			if err := gr.cacheWithReader(ctx, currentDepth+1, eg, sem, e, r, filter, opts...); err != nil {
+			if err := gr.cacheWithReader(ctx, currentDepth+1, eg, sem, e, r, filter, seen, opts...); err != nil {
 				rErr = err
 				return false
 			}
@@ -209,7 +403,11 @@ func (gr *reader) cacheWithReader(ctx context.Context, currentDepth int, eg *err
 		} else if e.Name == estargz.TOCTarName {
 			// We don't need to cache TOC json file
 			return true
+		} else if _, ok := seen[e]; ok {
+			// Another name (hardlink) of this file has been cached
+			return true
 		}
+		seen[e] = struct{}{}
 
 		sr, err := r.OpenFile(e.Name)
 		if err != nil {
@@ -224,6 +422,10 @@ func (gr *reader) cacheWithReader(ctx context.Context, currentDepth int, eg *err
 				break
 			}
 			nr += ce.ChunkSize
+			if ce.Hole {
+				// Holes of sparse files are never fetched
+				continue
+			}
 
 			if err := sem.Acquire(ctx, 1); err != nil {
 				rErr = err
@@ -234,7 +436,10 @@ func (gr *reader) cacheWithReader(ctx context.Context, currentDepth int, eg *err
 				defer sem.Release(1)
 
 				// Check if the target chunks exists in the cache
-				id := genID(e.Digest, ce.ChunkOffset, ce.ChunkSize)
+				id := gr.chunkID(e.Digest, ce)
+				if gr.quarantine.quarantined(id) {
+					return nil
+				}
 				if _, err := gr.cache.FetchAt(id, 0, nil, opts...); err == nil {
 					return nil
 				}
@@ -245,6 +450,10 @@ func (gr *reader) cacheWithReader(ctx context.Context, currentDepth int, eg *err
 				defer gr.bufPool.Put(b)
 				b.Reset()
 				b.Grow(int(ce.ChunkSize))
+				if ip := b.Bytes()[:ce.ChunkSize]; gr.readFromSource(ip, ce) {
+					gr.cache.Add(id, ip, opts...)
+					return nil
+				}
 				v, err := gr.verifier.Verifier(ce)
 				if err != nil {
 					return errors.Wrapf(err, "verifier not found %q(off:%d,size:%d)",
@@ -284,9 +493,43 @@ type file struct {
 	gr     *reader
 }
 
+var _ = (ChunkFile)((*file)(nil))
+
+func (sf *file) CachedChunk(offset int64, size int) (key string, fileOffset int64, n int, ok bool) {
+	if _, ok := sf.cache.(cache.FileOpener); !ok || size <= 0 || sf.gr.quarantine != nil {
+		return "", 0, 0, false
+	}
+	ce, ok := sf.r.ChunkEntryForOffset(sf.name, offset)
+	if !ok || ce.Hole {
+		return "", 0, 0, false
+	}
+	end := ce.ChunkOffset + ce.ChunkSize
+	if offset+int64(size) > end {
+		if _, more := sf.r.ChunkEntryForOffset(sf.name, end); more {
+			return "", 0, 0, false
+		}
+		size = int(end - offset)
+	}
+	return sf.gr.chunkID(sf.digest, ce), offset - ce.ChunkOffset, size, true
+}
+
+func (sf *file) OpenCachedChunk(key string) (*os.File, error) {
+	fo, ok := sf.cache.(cache.FileOpener)
+	if !ok {
+		return nil, fmt.Errorf("cache doesn't store chunks in files")
+	}
+	return fo.OpenFile(key)
+}
+
 // ReadAt reads chunks from the stargz file with trying to fetch as many chunks
 // as possible from the cache.
 func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
+	return sf.ReadAtContext(context.Background(), p, offset)
+}
+
+var _ = (ContextFile)((*file)(nil))
+
+func (sf *file) ReadAtContext(ctx context.Context, p []byte, offset int64) (int, error) {
 	nr := 0
 	for nr < len(p) {
 		ce, ok := sf.r.ChunkEntryForOffset(sf.name, offset+int64(nr))
@@ -294,26 +537,65 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 			break
 		}
 		var (
-			id           = genID(sf.digest, ce.ChunkOffset, ce.ChunkSize)
+			id           = sf.gr.chunkID(sf.digest, ce)
 			lowerDiscard = positive(offset - ce.ChunkOffset)
 			upperDiscard = positive(ce.ChunkOffset + ce.ChunkSize - (offset + int64(len(p))))
 			expectedSize = ce.ChunkSize - upperDiscard - lowerDiscard
 		)
 
-		// Check if the content exists in the cache
-		n, err := sf.cache.FetchAt(id, lowerDiscard, p[nr:int64(nr)+expectedSize])
-		if err == nil && int64(n) == expectedSize {
-			nr += n
+		// Holes of sparse files are zeros so they don't need to be fetched.
+		if ce.Hole {
+			hole := p[nr : int64(nr)+expectedSize]
+			for i := range hole {
+				hole[i] = 0
+			}
+			nr += len(hole)
 			continue
 		}
 
+		// Check if the content exists in the cache
+		var (
+			cacheable = !sf.gr.quarantine.quarantined(id)
+			corrupted bool
+		)
+		if cacheable && sf.gr.quarantine != nil {
+			var n int
+			if n, corrupted = sf.fetchVerified(id, ce, lowerDiscard, p[nr:int64(nr)+expectedSize]); int64(n) == expectedSize {
+				sf.observeHit(expectedSize)
+				nr += n
+				continue
+			}
+			if corrupted {
+				// This failure may have quarantined the chunk.
+				cacheable = !sf.gr.quarantine.quarantined(id)
+			}
+		} else if cacheable {
+			n, err := sf.cache.FetchAt(id, lowerDiscard, p[nr:int64(nr)+expectedSize])
+			if err == nil && int64(n) == expectedSize {
+				sf.observeHit(expectedSize)
+				nr += n
+				continue
+			}
+		}
+
 		// We missed cache. Take it from underlying reader.
 		// We read the whole chunk here and add it to the cache so that following
 		// reads against neighboring chunks can take the data without decmpression.
+		start := time.Now()
 		if lowerDiscard == 0 && upperDiscard == 0 {
 			// We can directly store the result to the given buffer
 			ip := p[nr : int64(nr)+ce.ChunkSize]
-			n, err := sf.ra.ReadAt(ip, ce.ChunkOffset)
+			if sf.gr.readFromSource(ip, ce) {
+				if corrupted {
+					sf.gr.quarantine.refetched()
+				}
+				if cacheable {
+					sf.cache.Add(id, ip)
+				}
+				nr += len(ip)
+				continue
+			}
+			n, err := sf.readChunk(ctx, ip, ce)
 			if err != nil && err != io.EOF {
 				return 0, errors.Wrap(err, "failed to read data")
 			}
@@ -322,9 +604,15 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 			if err := sf.verify(ip, ce); err != nil {
 				return 0, errors.Wrap(err, "invalid chunk")
 			}
+			sf.observeMiss(ce, start)
+			if corrupted {
+				sf.gr.quarantine.refetched()
+			}
 
 			// Cache this chunk
-			sf.cache.Add(id, ip)
+			if cacheable {
+				sf.cache.Add(id, ip)
+			}
 			nr += n
 			continue
 		}
@@ -334,20 +622,28 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 		b.Reset()
 		b.Grow(int(ce.ChunkSize))
 		ip := b.Bytes()[:ce.ChunkSize]
-		if _, err := sf.ra.ReadAt(ip, ce.ChunkOffset); err != nil && err != io.EOF {
-			sf.gr.bufPool.Put(b)
-			return 0, errors.Wrap(err, "failed to read data")
-		}
+		if !sf.gr.readFromSource(ip, ce) {
+			if _, err := sf.readChunk(ctx, ip, ce); err != nil && err != io.EOF {
+				sf.gr.bufPool.Put(b)
+				return 0, errors.Wrap(err, "failed to read data")
+			}
 
-		// Verify this chunk
-		if err := sf.verify(ip, ce); err != nil {
-			sf.gr.bufPool.Put(b)
-			return 0, errors.Wrap(err, "invalid chunk")
+			// Verify this chunk
+			if err := sf.verify(ip, ce); err != nil {
+				sf.gr.bufPool.Put(b)
+				return 0, errors.Wrap(err, "invalid chunk")
+			}
+			sf.observeMiss(ce, start)
+		}
+		if corrupted {
+			sf.gr.quarantine.refetched()
 		}
 
 		// Cache this chunk
-		sf.cache.Add(id, ip)
-		n = copy(p[nr:], ip[lowerDiscard:ce.ChunkSize-upperDiscard])
+		if cacheable {
+			sf.cache.Add(id, ip)
+		}
+		n := copy(p[nr:], ip[lowerDiscard:ce.ChunkSize-upperDiscard])
 		sf.gr.bufPool.Put(b)
 		if int64(n) != expectedSize {
 			return 0, fmt.Errorf("unexpected final data size %d; want %d", n, expectedSize)
@@ -358,8 +654,98 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 	return nr, nil
 }
 
+// readChunk reads the whole chunk from the blob to p. If the reader has the
+// ContextReaderAt, the compressed chunk is fetched with ctx and decompressed
+// here.
+func (sf *file) readChunk(ctx context.Context, p []byte, ce *estargz.TOCEntry) (int, error) {
+	if sf.gr.ctxReaderAt == nil {
+		return sf.ra.ReadAt(p, ce.ChunkOffset)
+	}
+	b := sf.gr.bufPool.Get().(*bytes.Buffer)
+	defer sf.gr.bufPool.Put(b)
+	b.Reset()
+	b.Grow(int(ce.NextOffset() - ce.Offset))
+	cp := b.Bytes()[:ce.NextOffset()-ce.Offset]
+	if _, err := sf.gr.ctxReaderAt(ctx, cp, ce.Offset); err != nil && err != io.EOF {
+		return 0, err
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(cp))
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to decompress chunk at %d of %q", ce.ChunkOffset, sf.name)
+	}
+	return io.ReadFull(gz, p)
+}
+
+var _ = (SparseFile)((*file)(nil))
+
+func (sf *file) NextRegion(offset int64, hole bool) (int64, bool) {
+	for {
+		ce, ok := sf.r.ChunkEntryForOffset(sf.name, offset)
+		if !ok {
+			// The end of the file is regarded as a hole.
+			return offset, hole
+		}
+		if ce.Hole == hole {
+			if offset < ce.ChunkOffset {
+				offset = ce.ChunkOffset
+			}
+			return offset, true
+		}
+		offset = ce.ChunkOffset + ce.ChunkSize
+	}
+}
+
+// fetchVerified reads the region of the chunk from the cache to p after
+// verifying the whole chunk. If the cached chunk is corrupted, it's dropped
+// from the cache and reported to the quarantine. This returns the size read,
+// which is zero on miss.
+func (sf *file) fetchVerified(id string, ce *estargz.TOCEntry, lowerDiscard int64, p []byte) (n int, corrupted bool) {
+	b := sf.gr.bufPool.Get().(*bytes.Buffer)
+	defer sf.gr.bufPool.Put(b)
+	b.Reset()
+	b.Grow(int(ce.ChunkSize))
+	ip := b.Bytes()[:ce.ChunkSize]
+	if n, err := sf.cache.FetchAt(id, 0, ip); err != nil || int64(n) != ce.ChunkSize {
+		return 0, false
+	}
+	if err := sf.verify(ip, ce); err != nil {
+		if r, ok := sf.cache.(cache.Remover); ok {
+			r.Remove(id)
+		}
+		sf.gr.quarantine.reportCorrupted(id)
+		return 0, true
+	}
+	return copy(p, ip[lowerDiscard:]), false
+}
+
+func (sf *file) observeMiss(ce *estargz.TOCEntry, start time.Time) {
+	if sf.gr.observer != nil {
+		sf.gr.observer(sf.name, ce.Offset, ce.ChunkSize, time.Since(start))
+	}
+}
+
+func (sf *file) observeHit(size int64) {
+	if sf.gr.hitObserver != nil {
+		sf.gr.hitObserver(size)
+	}
+}
+
 func (sf *file) verify(p []byte, ce *estargz.TOCEntry) error {
-	v, err := sf.gr.verifier.Verifier(ce)
+	return sf.gr.verify(p, ce)
+}
+
+// readFromSource fills p with the whole chunk taken from the chunk source (see
+// WithChunkSource). This returns false if the chunk source doesn't have the
+// chunk or the taken contents don't pass the verification.
+func (gr *reader) readFromSource(p []byte, ce *estargz.TOCEntry) bool {
+	if gr.source == nil || ce.ChunkDigest == "" || int64(len(p)) != ce.ChunkSize {
+		return false
+	}
+	return gr.source(ce.ChunkDigest, p) && gr.verify(p, ce) == nil
+}
+
+func (gr *reader) verify(p []byte, ce *estargz.TOCEntry) error {
+	v, err := gr.verifier.Verifier(ce)
 	if err != nil {
 		return errors.Wrapf(err, "verifier not found %q (offset:%d,size:%d)",
 			ce.Name, ce.ChunkOffset, ce.ChunkSize)
@@ -376,6 +762,17 @@ func (sf *file) verify(p []byte, ce *estargz.TOCEntry) error {
 	return nil
 }
 
+// chunkID returns the key of the chunk in the cache. If the reader is content
+// addressed and the chunk has its own digest, the key is based on it so that the
+// same contents share the same key across files and layers. Otherwise, the file
+// digest and the position of the chunk in the file are used.
+func (gr *reader) chunkID(fileDigest string, ce *estargz.TOCEntry) string {
+	if gr.contentAddressed && ce.ChunkDigest != "" {
+		return genID(ce.ChunkDigest, 0, ce.ChunkSize)
+	}
+	return genID(fileDigest, ce.ChunkOffset, ce.ChunkSize)
+}
+
 func genID(digest string, offset, size int64) string {
 	sum := sha256.Sum256([]byte(fmt.Sprintf("%s-%d-%d", digest, offset, size)))
 	return fmt.Sprintf("%x", sum)
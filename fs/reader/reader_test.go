@@ -25,8 +25,10 @@ package reader
 import (
 	"archive/tar"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
 	"sync"
 	"testing"
@@ -171,6 +173,13 @@ func (tc *testCache) Add(key string, p []byte, opts ...cache.Option) {
 	tc.t.Logf("  cached [%s...]: %q", key[:8], string(p))
 }
 
+func (tc *testCache) Remove(key string) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	delete(tc.membuf, key)
+	return nil
+}
+
 type region struct{ b, e int64 }
 
 // Tests ReadAt method of each file.
@@ -277,6 +286,375 @@ func TestFileReadAt(t *testing.T) {
 	}
 }
 
+// Tests corrupted chunks in the cache are refetched and quarantined.
+func TestChunkQuarantine(t *testing.T) {
+	f := makeFile(t, []byte(sampleData1), sampleChunkSize)
+	f.gr.quarantine = NewChunkQuarantine(2, nil)
+	tc := f.cache.(*testCache)
+	ce, ok := f.r.ChunkEntryForOffset(f.name, 0)
+	if !ok {
+		t.Fatalf("no chunk entry for offset 0")
+	}
+	id := f.gr.chunkID(f.digest, ce)
+	read := func() {
+		p := make([]byte, len(sampleData1))
+		if n, err := f.ReadAt(p, 0); err != nil || !bytes.Equal(p[:n], []byte(sampleData1)) {
+			t.Fatalf("failed to read %q (%v); want %q", string(p[:n]), err, sampleData1)
+		}
+	}
+	corrupt := func() {
+		tc.mu.Lock()
+		tc.membuf[id] = strings.Repeat("x", int(ce.ChunkSize))
+		tc.mu.Unlock()
+	}
+	check := func(corrupted, refetched int64, quarantined bool) {
+		s := f.gr.quarantine.Stats()
+		if s.Corrupted != corrupted || s.Refetched != refetched || (len(s.Quarantined) == 1) != quarantined {
+			t.Fatalf("unexpected stats %+v; want corrupted=%d, refetched=%d, quarantined=%v",
+				s, corrupted, refetched, quarantined)
+		}
+		tc.mu.Lock()
+		_, cached := tc.membuf[id]
+		tc.mu.Unlock()
+		if cached == quarantined {
+			t.Fatalf("chunk cached=%v; want %v", cached, !quarantined)
+		}
+	}
+
+	read()
+	check(0, 0, false)
+	corrupt()
+	read()
+	check(1, 1, false)
+	corrupt()
+	read()
+	check(2, 2, true)
+	read()
+	check(2, 2, true)
+}
+
+// Tests chunks missing the cache are taken from the chunk source and the ones
+// failing verification are read from the blob.
+func TestChunkSource(t *testing.T) {
+	f := makeFile(t, []byte(sampleData1), sampleChunkSize)
+	var taken []int64
+	f.gr.source = func(chunkDigest string, p []byte) bool {
+		for off := int64(0); off < int64(len(sampleData1)); off += sampleChunkSize {
+			ce, ok := f.r.ChunkEntryForOffset(f.name, off)
+			if !ok || ce.ChunkDigest != chunkDigest {
+				continue
+			}
+			taken = append(taken, ce.ChunkOffset)
+			if ce.ChunkOffset == 0 {
+				copy(p, strings.Repeat("x", len(p))) // broken
+			} else {
+				copy(p, sampleData1[ce.ChunkOffset:])
+			}
+			return true
+		}
+		return false
+	}
+	var blobReads int
+	ra := f.ra
+	f.ra = readerAtFunc(func(p []byte, offset int64) (int, error) {
+		blobReads++
+		return ra.ReadAt(p, offset)
+	})
+	p := make([]byte, len(sampleData1))
+	if n, err := f.ReadAt(p, 0); err != nil || string(p[:n]) != sampleData1 {
+		t.Fatalf("failed to read %q (%v); want %q", string(p[:n]), err, sampleData1)
+	}
+	if wantTaken := (len(sampleData1) + sampleChunkSize - 1) / sampleChunkSize; len(taken) != wantTaken {
+		t.Errorf("%d chunks are taken from the source; want %d", len(taken), wantTaken)
+	}
+	if blobReads != 1 {
+		t.Errorf("blob is read %d times; want once for the broken chunk", blobReads)
+	}
+}
+
+func TestHitObserver(t *testing.T) {
+	f := makeFile(t, []byte(sampleData1), sampleChunkSize)
+	var hits, hitSize int64
+	f.gr.hitObserver = func(size int64) {
+		hits++
+		hitSize += size
+	}
+	p := make([]byte, len(sampleData1))
+	for i := 0; i < 2; i++ {
+		if n, err := f.ReadAt(p, 0); err != nil || string(p[:n]) != sampleData1 {
+			t.Fatalf("failed to read %q (%v); want %q", string(p[:n]), err, sampleData1)
+		}
+	}
+	if wantHits := int64((len(sampleData1) + sampleChunkSize - 1) / sampleChunkSize); hits != wantHits || hitSize != int64(len(sampleData1)) {
+		t.Errorf("hits = %d (%d bytes); want %d (%d bytes) by the second read", hits, hitSize, wantHits, len(sampleData1))
+	}
+}
+
+// Tests fetches of chunks are aborted with the context of the read.
+func TestReadAtContext(t *testing.T) {
+	sr, dgst := buildStargz(t, []tarent{
+		regfile("x", sampleData1),
+	}, chunkSizeInfo(sampleChunkSize))
+	var fetches int
+	vr, _, err := NewReader(sr, cache.NewMemoryCache(), WithContextReaderAt(func(ctx context.Context, p []byte, offset int64) (int, error) {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		fetches++
+		return sr.ReadAt(p, offset)
+	}))
+	if err != nil {
+		t.Fatalf("failed to make new reader: %v", err)
+	}
+	r, err := vr.VerifyTOC(dgst)
+	if err != nil {
+		t.Fatalf("failed to verify TOC: %v", err)
+	}
+	ra, err := r.OpenFile("x")
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	cf, ok := ra.(ContextFile)
+	if !ok {
+		t.Fatalf("file must be ContextFile")
+	}
+	p := make([]byte, len(sampleData1))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := cf.ReadAtContext(ctx, p, 0); err == nil {
+		t.Errorf("read must fail with the canceled context")
+	}
+	if n, err := cf.ReadAtContext(context.Background(), p, 0); err != nil || string(p[:n]) != sampleData1 {
+		t.Fatalf("failed to read %q (%v); want %q", string(p[:n]), err, sampleData1)
+	}
+	if want := (len(sampleData1) + sampleChunkSize - 1) / sampleChunkSize; fetches != want {
+		t.Errorf("fetches = %d; want %d", fetches, want)
+	}
+}
+
+// Tests contents of hardlinked files are cached once.
+func TestCacheHardlink(t *testing.T) {
+	link := func(name, target string) tarent {
+		return tarent{header: &tar.Header{Typeflag: tar.TypeLink, Name: name, Linkname: target}}
+	}
+	sr, dgst := buildStargz(t, []tarent{
+		regfile("x", sampleData1),
+		link("y", "x"),
+		link("z", "x"),
+	}, chunkSizeInfo(sampleChunkSize))
+	cc := &countCache{added: make(map[string]int)}
+	vr, _, err := NewReader(sr, cc)
+	if err != nil {
+		t.Fatalf("failed to make new reader: %v", err)
+	}
+	gr, err := vr.VerifyTOC(dgst)
+	if err != nil {
+		t.Fatalf("failed to verify TOC: %v", err)
+	}
+	if err := gr.Cache(); err != nil {
+		t.Fatalf("failed to cache: %v", err)
+	}
+	if len(cc.added) == 0 {
+		t.Fatalf("nothing cached")
+	}
+	for k, n := range cc.added {
+		if n != 1 {
+			t.Errorf("chunk %q is cached %d times; want once", k, n)
+		}
+	}
+}
+
+// Tests identical chunks at different positions of different files share the
+// keys in the cache only if the reader is content addressed.
+func TestContentAddressedChunks(t *testing.T) {
+	for _, contentAddressed := range []bool{true, false} {
+		t.Run(fmt.Sprintf("contentAddressed=%v", contentAddressed), func(t *testing.T) {
+			var opts []Option
+			if contentAddressed {
+				opts = append(opts, WithContentAddressedChunks())
+			}
+			c := cache.NewMemoryCache()
+			keys := func(contents string) map[string]bool {
+				sr, dgst := buildStargz(t, []tarent{
+					regfile("x", contents),
+				}, chunkSizeInfo(sampleChunkSize))
+				vr, _, err := NewReader(sr, c, opts...)
+				if err != nil {
+					t.Fatalf("failed to make new reader: %v", err)
+				}
+				gr, err := vr.VerifyTOC(dgst)
+				if err != nil {
+					t.Fatalf("failed to verify TOC: %v", err)
+				}
+				if err := gr.Cache(); err != nil {
+					t.Fatalf("failed to cache: %v", err)
+				}
+				ids := make(map[string]bool)
+				if err := vr.ForeachChunkEntry(func(id string, ce *estargz.TOCEntry) {
+					if ce.Name == "x" {
+						ids[id] = true
+					}
+				}); err != nil {
+					t.Fatalf("failed to walk chunks: %v", err)
+				}
+				return ids
+			}
+			// The second file has the same chunks shifted by one chunk.
+			a, b := keys(sampleData1), keys(strings.Repeat("-", sampleChunkSize)+sampleData1)
+			if len(a) == 0 {
+				t.Fatalf("no chunk")
+			}
+			shared := 0
+			for id := range a {
+				if b[id] {
+					shared++
+				}
+			}
+			if contentAddressed && shared != len(a) {
+				t.Errorf("%d of %d chunks are shared; want all", shared, len(a))
+			} else if !contentAddressed && shared != 0 {
+				t.Errorf("%d chunks are shared; want none", shared)
+			}
+		})
+	}
+}
+
+// Tests holes of sparse files are served without reading the blob.
+func TestSparseFile(t *testing.T) {
+	const (
+		blockSize = 4096
+		size      = 8 * blockSize
+		holeStart = blockSize
+		holeEnd   = 6 * blockSize
+	)
+	data := map[int64]string{
+		0:       strings.Repeat("a", blockSize),
+		holeEnd: strings.Repeat("b", blockSize),
+	}
+	want := make([]byte, size)
+	for off, d := range data {
+		copy(want[off:], d)
+	}
+	tarData := sparseTarOf(t, "sparse", size, data)
+	rc, err := estargz.Build(io.NewSectionReader(bytes.NewReader(tarData), 0, int64(len(tarData))),
+		estargz.WithChunkSize(2*blockSize))
+	if err != nil {
+		t.Fatalf("failed to build stargz: %v", err)
+	}
+	defer rc.Close()
+	b := new(bytes.Buffer)
+	if _, err := io.Copy(b, rc); err != nil {
+		t.Fatalf("failed to read stargz: %v", err)
+	}
+	vr, _, err := NewReader(io.NewSectionReader(bytes.NewReader(b.Bytes()), 0, int64(b.Len())),
+		&testCache{membuf: map[string]string{}, t: t})
+	if err != nil {
+		t.Fatalf("failed to make new reader: %v", err)
+	}
+	gr, err := vr.VerifyTOC(rc.TOCDigest())
+	if err != nil {
+		t.Fatalf("failed to verify TOC: %v", err)
+	}
+	ra, err := gr.OpenFile("sparse")
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	f := ra.(*file)
+	orig := f.ra
+	f.ra = readerAtFunc(func(p []byte, offset int64) (int, error) {
+		if offset < holeEnd && offset+int64(len(p)) > holeStart {
+			t.Fatalf("hole is read (offset=%d,size=%d)", offset, len(p))
+		}
+		return orig.ReadAt(p, offset)
+	})
+	got := make([]byte, size)
+	if n, err := f.ReadAt(got, 0); err != nil || n != size {
+		t.Fatalf("failed to read file (n=%d): %v", n, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("unexpected contents")
+	}
+
+	for _, tt := range []struct {
+		offset int64
+		hole   bool
+		want   int64
+	}{
+		{0, true, holeStart},
+		{holeStart + 1, true, holeStart + 1},
+		{holeEnd - 1, false, holeEnd},
+		{holeEnd, true, size},
+		{holeEnd + 1, false, holeEnd + 1},
+	} {
+		if got, ok := f.NextRegion(tt.offset, tt.hole); !ok || got != tt.want {
+			t.Errorf("NextRegion(%d, %v) = %d, %v; want %d", tt.offset, tt.hole, got, ok, tt.want)
+		}
+	}
+}
+
+type readerAtFunc func([]byte, int64) (int, error)
+
+func (f readerAtFunc) ReadAt(p []byte, offset int64) (int, error) { return f(p, offset) }
+
+// sparseTarOf returns a tar containing a PAX (0.1) sparse file of the size
+// with data at the offsets. archive/tar can't write sparse files so GNU
+// sparse records are written with placeholder keys which are fixed later.
+func sparseTarOf(t *testing.T, name string, size int64, data map[int64]string) []byte {
+	var (
+		offs   []int64
+		packed bytes.Buffer
+		spMap  []string
+	)
+	for off := range data {
+		offs = append(offs, off)
+	}
+	sort.Slice(offs, func(i, j int) bool { return offs[i] < offs[j] })
+	for _, off := range offs {
+		packed.WriteString(data[off])
+		spMap = append(spMap, fmt.Sprintf("%d,%d", off, len(data[off])))
+	}
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(packed.Len()),
+		PAXRecords: map[string]string{
+			"GNU_sparse.major":     "0",
+			"GNU_sparse.minor":     "1",
+			"GNU_sparse.size":      fmt.Sprintf("%d", size),
+			"GNU_sparse.map":       strings.Join(spMap, ","),
+			"GNU_sparse.numblocks": fmt.Sprintf("%d", len(spMap)),
+		},
+		Format: tar.FormatPAX,
+	}); err != nil {
+		t.Fatalf("failed to write header: %v", err)
+	}
+	if _, err := tw.Write(packed.Bytes()); err != nil {
+		t.Fatalf("failed to write data: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close tar: %v", err)
+	}
+	return bytes.ReplaceAll(buf.Bytes(), []byte("GNU_sparse."), []byte("GNU.sparse."))
+}
+
+type countCache struct {
+	mu    sync.Mutex
+	added map[string]int
+}
+
+func (cc *countCache) FetchAt(key string, offset int64, p []byte, opts ...cache.Option) (int, error) {
+	return 0, fmt.Errorf("Missed cache: %q", key)
+}
+
+func (cc *countCache) Add(key string, p []byte, opts ...cache.Option) {
+	cc.mu.Lock()
+	cc.added[key]++
+	cc.mu.Unlock()
+}
+
 type exceptSectionReader struct {
 	ra     io.ReaderAt
 	except map[region]bool
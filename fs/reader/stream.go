@@ -0,0 +1,229 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package reader
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/pkg/errors"
+)
+
+// Streamer returns a reader of the region [offset, offset+size) of the blob
+// fetched with a single request.
+type Streamer func(ctx context.Context, offset, size int64) (io.ReadCloser, error)
+
+// Option is an option of readers.
+type Option func(*options)
+
+type options struct {
+	streamer     Streamer
+	missObserver MissObserver
+	hitObserver  HitObserver
+	quarantine   *ChunkQuarantine
+	chunkSource  ChunkSource
+	ctxReaderAt  ContextReaderAt
+
+	contentAddressed bool
+}
+
+// WithContentAddressedChunks keys chunks in the cache by their digests instead
+// of their positions in the file so that identical chunks contained in
+// different files or layers are stored only once. Chunks of unverified layers
+// must not be keyed by their digests; they aren't trustworthy and would be
+// served to other layers. So this must be used only if the TOC of the layer is
+// always verified by VerifyTOC before the reader is used.
+func WithContentAddressedChunks() Option {
+	return func(opts *options) {
+		opts.contentAddressed = true
+	}
+}
+
+// WithStreamer enables reading files with streams of the blob (see StreamFile).
+func WithStreamer(s Streamer) Option {
+	return func(opts *options) {
+		opts.streamer = s
+	}
+}
+
+// MissObserver is called when a read of a file misses the cache and the chunk
+// is read from the blob. offset is the offset of the chunk in the blob and
+// latency includes the fetch and the verification of the chunk.
+type MissObserver func(name string, offset, size int64, latency time.Duration)
+
+// WithMissObserver observes reads of files missing the cache.
+func WithMissObserver(o MissObserver) Option {
+	return func(opts *options) {
+		opts.missObserver = o
+	}
+}
+
+// HitObserver is called when a read of a file is served from the cache. size
+// is the size of the region of the chunk read from the cache.
+type HitObserver func(size int64)
+
+// WithHitObserver observes reads of files served from the cache.
+func WithHitObserver(o HitObserver) Option {
+	return func(opts *options) {
+		opts.hitObserver = o
+	}
+}
+
+// WithChunkQuarantine verifies chunks read from the cache. Chunks failing
+// verification are dropped from the cache and refetched from the blob instead
+// of failing the read, and quarantined by q on repeated failures. Files don't
+// serve chunks from the cache files directly (see ChunkFile) because such
+// reads can't be verified.
+func WithChunkQuarantine(q *ChunkQuarantine) Option {
+	return func(opts *options) {
+		opts.quarantine = q
+	}
+}
+
+// ChunkSource fills p with the contents of the chunk of the digest taken from
+// somewhere other than the blob (e.g. caches of other layers containing the
+// same chunk) and reports whether it succeeded. p has the size of the chunk.
+type ChunkSource func(chunkDigest string, p []byte) bool
+
+// WithChunkSource tries s for chunks missing the cache before reading them
+// from the blob. Chunks taken from s are verified in the same way as the ones
+// read from the blob.
+func WithChunkSource(s ChunkSource) Option {
+	return func(opts *options) {
+		opts.chunkSource = s
+	}
+}
+
+// ContextReaderAt reads the region [offset, offset+len(p)) of the blob. The
+// read is aborted when ctx is done.
+type ContextReaderAt func(ctx context.Context, p []byte, offset int64) (int, error)
+
+// WithContextReaderAt reads chunks of files missing the cache with ra instead
+// of the section reader of the blob. The contexts of reads (see ContextFile)
+// are passed to ra so that the fetches are aborted with the reads.
+func WithContextReaderAt(ra ContextReaderAt) Option {
+	return func(opts *options) {
+		opts.ctxReaderAt = ra
+	}
+}
+
+// ContextFile is implemented by files returned by Reader.OpenFile which can be
+// read with contexts.
+type ContextFile interface {
+
+	// ReadAtContext is the same as ReadAt but fetches of chunks missing the
+	// cache are aborted when ctx is done (e.g. the reading process is
+	// killed) if the reader is created with WithContextReaderAt.
+	ReadAtContext(ctx context.Context, p []byte, offset int64) (int, error)
+}
+
+// StreamFile is implemented by files returned by Reader.OpenFile which can be
+// read sequentially with a stream of the blob.
+type StreamFile interface {
+
+	// OpenStream returns a reader of the contents of the file from the offset
+	// to the end. The compressed contents are fetched with a single request and
+	// decompressed and verified chunk by chunk. They aren't stored in the cache.
+	OpenStream(ctx context.Context, offset int64) (io.ReadCloser, error)
+}
+
+var _ = (StreamFile)((*file)(nil))
+
+func (sf *file) OpenStream(ctx context.Context, offset int64) (io.ReadCloser, error) {
+	if sf.gr.streamer == nil {
+		return nil, fmt.Errorf("streaming isn't enabled")
+	}
+	e, ok := sf.r.Lookup(sf.name)
+	if !ok {
+		return nil, fmt.Errorf("failed to get TOCEntry %q", sf.name)
+	}
+	first, ok := sf.r.ChunkEntryForOffset(sf.name, offset)
+	if !ok {
+		return nil, fmt.Errorf("offset %d is out of %q", offset, sf.name)
+	}
+	last, ok := sf.r.ChunkEntryForOffset(sf.name, e.Size-1)
+	if !ok {
+		return nil, fmt.Errorf("failed to get the last chunk of %q", sf.name)
+	}
+	if h, ok := sf.NextRegion(offset, true); ok && h < e.Size {
+		// Streaming would fetch the holes which ReadAt serves for free.
+		return nil, fmt.Errorf("%q has holes after offset %d", sf.name, offset)
+	}
+	rc, err := sf.gr.streamer(ctx, first.Offset, last.NextOffset()-first.Offset)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open stream of %q", sf.name)
+	}
+	// Chunks are consecutive gzip streams so they are read as a multistream.
+	gz, err := gzip.NewReader(bufio.NewReader(rc))
+	if err != nil {
+		rc.Close()
+		return nil, errors.Wrapf(err, "failed to decompress stream of %q", sf.name)
+	}
+	return &chunkStream{
+		sf:      sf,
+		rc:      rc,
+		gz:      gz,
+		next:    first,
+		discard: offset - first.ChunkOffset,
+	}, nil
+}
+
+// chunkStream reads the decompressed contents of a file chunk by chunk so
+// that each chunk is verified before it's returned.
+type chunkStream struct {
+	sf      *file
+	rc      io.ReadCloser
+	gz      *gzip.Reader
+	next    *estargz.TOCEntry // nil at the end of the file
+	discard int64             // bytes of the next chunk before the offset
+	chunk   []byte            // buffer of the current chunk
+	unread  []byte
+}
+
+func (cs *chunkStream) Read(p []byte) (int, error) {
+	for len(cs.unread) == 0 {
+		if cs.next == nil {
+			return 0, io.EOF
+		}
+		ce := cs.next
+		if int64(cap(cs.chunk)) < ce.ChunkSize {
+			cs.chunk = make([]byte, ce.ChunkSize)
+		}
+		b := cs.chunk[:ce.ChunkSize]
+		if _, err := io.ReadFull(cs.gz, b); err != nil {
+			return 0, errors.Wrapf(err, "failed to read chunk at %d of %q", ce.ChunkOffset, cs.sf.name)
+		}
+		if err := cs.sf.verify(b, ce); err != nil {
+			return 0, errors.Wrap(err, "invalid chunk")
+		}
+		cs.unread = b[cs.discard:]
+		cs.discard = 0
+		cs.next, _ = cs.sf.r.ChunkEntryForOffset(cs.sf.name, ce.ChunkOffset+ce.ChunkSize)
+	}
+	n := copy(p, cs.unread)
+	cs.unread = cs.unread[n:]
+	return n, nil
+}
+
+func (cs *chunkStream) Close() error {
+	return cs.rc.Close()
+}
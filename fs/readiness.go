@@ -0,0 +1,81 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+)
+
+// Readiness is the prefetch state of the layers of a snapshot. The snapshot is
+// ready when the prefetch of all of its layers finished, which means the
+// prioritized files (e.g. files marked by the prefetch landmark of eStargz)
+// are in the cache and the workload won't fault them in from the registry.
+type Readiness struct {
+	Ready  bool             `json:"ready"`
+	Layers []LayerReadiness `json:"layers"`
+}
+
+// LayerReadiness is the prefetch state of a layer mounted on a mountpoint.
+type LayerReadiness struct {
+	Mountpoint        string  `json:"mountpoint"`
+	Digest            string  `json:"digest,omitempty"`
+	Ready             bool    `json:"ready"`
+	PrefetchedPercent float64 `json:"prefetchedPercent"`
+
+	// Error is the reason of the failure of resolving or prefetching the
+	// layer. A layer which failed to be prefetched is still ready because
+	// it is readable on demand.
+	Error string `json:"error,omitempty"`
+}
+
+// ReadinessReporter reports whether the prefetch of layers finished. The
+// filesystem returned by NewFilesystem implements this interface.
+type ReadinessReporter interface {
+	Readiness(ctx context.Context, mountpoints []string) Readiness
+}
+
+var _ = (ReadinessReporter)((*filesystem)(nil))
+
+// Readiness returns the prefetch state of the layers mounted on the
+// mountpoints. Layers being resolved in background and mountpoints which
+// aren't mounted are reported as not ready.
+func (fs *filesystem) Readiness(ctx context.Context, mountpoints []string) Readiness {
+	res := Readiness{Ready: true}
+	fs.layerMu.Lock()
+	defer fs.layerMu.Unlock()
+	for _, mp := range mountpoints {
+		lr := LayerReadiness{Mountpoint: mp}
+		if l, ok := fs.layer[mp]; ok {
+			lr.Digest = l.desc.Digest.String()
+			lr.PrefetchedPercent = l.progress.get().PrefetchedPercent
+			finished, err := l.progress.prefetchResult()
+			lr.Ready = finished || fs.noprefetch || l.isMaterialized()
+			if err != nil {
+				lr.Error = err.Error()
+			}
+		} else if pl, ok := fs.pending[mp]; ok {
+			if err := pl.failed(); err != nil {
+				lr.Error = err.Error()
+			}
+		} else {
+			lr.Error = "not mounted"
+		}
+		res.Ready = res.Ready && lr.Ready
+		res.Layers = append(res.Layers, lr)
+	}
+	return res
+}
@@ -32,6 +32,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes/docker"
 	"github.com/containerd/stargz-snapshotter/cache"
@@ -48,10 +49,39 @@ type Blob interface {
 	ReadAt(p []byte, offset int64, opts ...Option) (int, error)
 	Cache(offset int64, size int64, opts ...Option) error
 	Refresh(ctx context.Context, host docker.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) error
+	Invalidate() error
+}
+
+// Streamer is implemented by blobs which can stream a region with a single
+// request.
+type Streamer interface {
+
+	// Stream returns a reader of the region [offset, offset+size) of the blob
+	// fetched with a single long-lived request. Fetched contents aren't stored
+	// in the cache. The request is aborted when ctx is done or the reader is
+	// closed.
+	Stream(ctx context.Context, offset, size int64) (io.ReadCloser, error)
+}
+
+// CachedReader is implemented by blobs which can read contents only from the
+// cache.
+type CachedReader interface {
+
+	// ReadCachedAt reads the region [offset, offset+len(p)) of the blob from
+	// the cache without fetching. This fails with errdefs.ErrNotFound if any
+	// chunk of the region isn't cached.
+	ReadCachedAt(p []byte, offset int64) (int, error)
+}
+
+// blobFetcher fetches regions of a blob.
+type blobFetcher interface {
+	fetch(ctx context.Context, rs []region, retry bool, opts *options) (multipartReadCloser, error)
+	check() error
+	genID(reg region) string
 }
 
 type blob struct {
-	fetcher   *fetcher
+	fetcher   blobFetcher
 	fetcherMu sync.Mutex
 
 	size          int64
@@ -61,21 +91,39 @@ type blob struct {
 	lastCheckMu   sync.Mutex
 	checkInterval time.Duration
 	fetchTimeout  time.Duration
+	phaseTimeouts map[FetchPhase]time.Duration
 
 	fetchedRegionSet   regionSet
 	fetchedRegionSetMu sync.Mutex
 
+	qosClass   QoSClass
+	qosClassMu sync.Mutex
+	qosFlows   [2]qosFlow // on-demand and background
+
 	resolver *Resolver
 }
 
+func (b *blob) SetQoSClass(class QoSClass) {
+	b.qosClassMu.Lock()
+	if class > b.qosClass {
+		b.qosClass = class
+	}
+	b.qosClassMu.Unlock()
+}
+
 func (b *blob) Refresh(ctx context.Context, hosts docker.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) error {
+	if hosts == nil {
+		return fmt.Errorf("no registry to refresh the blob")
+	}
+
 	// refresh the fetcher
-	new, newSize, err := newFetcher(ctx, hosts, refspec, desc)
+	new, newSize, err := newFetcher(ctx, hosts, refspec, desc, b.resolver.rateLimits, b.resolver.ResolveTimeout())
 	if err != nil {
 		return err
 	} else if newSize != b.size {
 		return fmt.Errorf("Invalid size of new blob %d; want %d", newSize, b.size)
 	}
+	new.hedger = b.resolver.hedger
 
 	// update the blob's fetcher with new one
 	b.fetcherMu.Lock()
@@ -88,6 +136,28 @@ func (b *blob) Refresh(ctx context.Context, hosts docker.RegistryHosts, refspec
 	return nil
 }
 
+// Invalidate drops all cached contents of this blob so that they are fetched
+// from the registry again on the next access.
+func (b *blob) Invalidate() error {
+	rc, ok := b.cache.(cache.Remover)
+	if !ok {
+		return fmt.Errorf("cache doesn't support removing contents")
+	}
+	b.fetcherMu.Lock()
+	fr := b.fetcher
+	b.fetcherMu.Unlock()
+
+	b.fetchedRegionSetMu.Lock()
+	defer b.fetchedRegionSetMu.Unlock()
+	if err := b.walkChunks(region{0, b.size - 1}, func(reg region) error {
+		return rc.Remove(fr.genID(reg))
+	}); err != nil {
+		return err
+	}
+	b.fetchedRegionSet = regionSet{}
+	return nil
+}
+
 func (b *blob) Check() error {
 	now := time.Now()
 	b.lastCheckMu.Lock()
@@ -148,6 +218,61 @@ func (b *blob) Cache(offset int64, size int64, opts ...Option) error {
 	return nil
 }
 
+var _ = (Streamer)((*blob)(nil))
+
+// Stream doesn't wait for the turn of fetching even if fetches are scheduled
+// by QoS classes because the request is kept during the whole read of the region.
+func (b *blob) Stream(ctx context.Context, offset, size int64) (io.ReadCloser, error) {
+	if offset < 0 || size <= 0 || offset+size > b.size {
+		return nil, fmt.Errorf("invalid region [%d, %d) of blob of size %d", offset, offset+size, b.size)
+	}
+	b.fetcherMu.Lock()
+	fr := b.fetcher
+	b.fetcherMu.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	reg := region{offset, offset + size - 1}
+	mr, err := fr.fetch(ctx, []region{reg}, true, &options{})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	closeFn := func() error {
+		err := mr.Close()
+		cancel()
+		return err
+	}
+	got, r, err := mr.Next()
+	if err != nil {
+		closeFn()
+		return nil, errors.Wrapf(err, "failed to read the response")
+	}
+	if got.b > reg.b || got.e < reg.e {
+		closeFn()
+		return nil, fmt.Errorf("unexpected region %v in the response; want %v", got, reg)
+	}
+	// The registry can return the whole blob (status 200).
+	if _, err := io.CopyN(ioutil.Discard, r, reg.b-got.b); err != nil {
+		closeFn()
+		return nil, errors.Wrapf(err, "failed to skip to offset %d", offset)
+	}
+
+	b.lastCheckMu.Lock()
+	b.lastCheck = time.Now()
+	b.lastCheckMu.Unlock()
+
+	return &streamReader{io.LimitReader(r, size), closeFn}, nil
+}
+
+type streamReader struct {
+	io.Reader
+	closeFn func() error
+}
+
+func (sr *streamReader) Close() error {
+	return sr.closeFn()
+}
+
 // ReadAt reads remote chunks from specified offset for the buffer size.
 // It tries to fetch as many chunks as possible from local cache.
 // We can configure this function with options.
@@ -249,6 +374,39 @@ func (b *blob) ReadAt(p []byte, offset int64, opts ...Option) (int, error) {
 	return len(p), nil
 }
 
+// ReadCachedAt reads chunks from specified offset for the buffer size only
+// from the local cache.
+func (b *blob) ReadCachedAt(p []byte, offset int64) (int, error) {
+	if len(p) == 0 || offset >= b.size {
+		return 0, nil
+	}
+	if remain := b.size - offset; int64(len(p)) > remain {
+		p = p[:remain]
+	}
+
+	b.fetcherMu.Lock()
+	fr := b.fetcher
+	b.fetcherMu.Unlock()
+
+	allRegion := region{floor(offset, b.chunkSize), ceil(offset+int64(len(p))-1, b.chunkSize) - 1}
+	if err := b.walkChunks(allRegion, func(chunk region) error {
+		var (
+			base         = positive(chunk.b - offset)
+			lowerUnread  = positive(offset - chunk.b)
+			upperUnread  = positive(chunk.e + 1 - (offset + int64(len(p))))
+			expectedSize = chunk.size() - upperUnread - lowerUnread
+		)
+		n, err := b.cache.FetchAt(fr.genID(chunk), lowerUnread, p[base:base+expectedSize])
+		if err != nil || n != int(expectedSize) {
+			return errors.Wrapf(errdefs.ErrNotFound, "chunk %d-%d isn't cached", chunk.b, chunk.e)
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
 // fetchRange fetches all specified chunks from local cache and remote blob.
 func (b *blob) fetchRange(allData map[region]io.Writer, opts *options) error {
 	if len(allData) == 0 {
@@ -268,9 +426,46 @@ func (b *blob) fetchRange(allData map[region]io.Writer, opts *options) error {
 		req = append(req, reg)
 		fetched[reg] = false
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), b.fetchTimeout)
+	timeout := b.fetchTimeout
+	if t, ok := b.phaseTimeouts[opts.phase]; ok && t > 0 {
+		timeout = t
+	}
+	// The fetch is aborted when the context of the caller is done (e.g. the
+	// reading process is killed) as well as on the timeout.
+	parent := context.Background()
+	if opts.ctx != nil {
+		parent = opts.ctx
+	}
+	ctx, cancel := context.WithTimeout(parent, timeout)
 	defer cancel()
-	mr, err := fr.fetch(ctx, req, true, opts)
+	wctx := ctx
+	if opts.ctx != nil {
+		wctx = opts.ctx
+	}
+	if f, ok := fr.(*fetcher); ok && opts.background {
+		// Background fetches can wait so they don't consume the quota of the
+		// registry left to on-demand fetches.
+		if err := b.resolver.rateLimits.Wait(wctx, f.host); err != nil {
+			return errors.Wrapf(err, "background fetch deferred by the rate limit of %q", f.host)
+		}
+	}
+	if s := b.resolver.scheduler; s != nil {
+		var cost int64
+		for _, reg := range req {
+			cost += reg.size()
+		}
+		b.qosClassMu.Lock()
+		class := b.qosClass
+		b.qosClassMu.Unlock()
+		release, err := s.acquire(wctx, &b.qosFlows[flowIndex(opts.background)], class, opts.background, cost)
+		if err != nil {
+			return errors.Wrap(err, "failed to wait for the turn of fetching")
+		}
+		defer release()
+	}
+	fetchOpts := *opts
+	fetchOpts.ctx = ctx
+	mr, err := fr.fetch(ctx, req, true, &fetchOpts)
 	if err != nil {
 		return err
 	}
@@ -24,6 +24,7 @@ package remote
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -38,6 +39,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/stargz-snapshotter/cache"
 )
 
@@ -317,6 +319,125 @@ func (tc *testCache) Add(key string, p []byte, opts ...cache.Option) {
 	tc.t.Logf("  cached [%s...]: %q", key[:8], string(p))
 }
 
+func (tc *testCache) Remove(key string) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	delete(tc.membuf, key)
+	return nil
+}
+
+func TestInvalidate(t *testing.T) {
+	size := int64(len(sampleData1))
+	b := makeBlob(t, size, sampleChunkSize, multiRoundTripper(t, []byte(sampleData1)))
+	checkRead(t, []byte(sampleData1), b, 0, size)
+	if fetched := b.FetchedSize(); fetched != size {
+		t.Fatalf("fetched size = %d; want %d", fetched, size)
+	}
+	if err := b.Invalidate(); err != nil {
+		t.Fatalf("failed to invalidate blob: %v", err)
+	}
+	if fetched := b.FetchedSize(); fetched != 0 {
+		t.Errorf("fetched size = %d after invalidation; want 0", fetched)
+	}
+	if n := len(b.cache.(*testCache).membuf); n != 0 {
+		t.Errorf("%d chunks remain in the cache after invalidation", n)
+	}
+
+	// Contents are fetched again.
+	checkRead(t, []byte(sampleData1), b, 0, size)
+}
+
+func TestStream(t *testing.T) {
+	size := int64(len(sampleData1))
+	b := makeBlob(t, size, sampleChunkSize, multiRoundTripper(t, []byte(sampleData1)))
+	for _, reg := range []region{{3, size - 2}, {0, size - 1}} {
+		rc, err := b.Stream(context.Background(), reg.b, reg.size())
+		if err != nil {
+			t.Fatalf("failed to stream %v: %v", reg, err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil || string(data) != sampleData1[reg.b:reg.e+1] {
+			t.Errorf("streamed %q (%v); want %q", string(data), err, sampleData1[reg.b:reg.e+1])
+		}
+	}
+	if n := len(b.cache.(*testCache).membuf); n != 0 {
+		t.Errorf("%d chunks are cached by streams", n)
+	}
+	if _, err := b.Stream(context.Background(), 1, size); err == nil {
+		t.Errorf("region out of the blob must be rejected")
+	}
+}
+
+func TestPhaseTimeout(t *testing.T) {
+	var remaining time.Duration
+	b := makeBlob(t, int64(len(sampleData1)), sampleChunkSize, func(req *http.Request) *http.Response {
+		if deadline, ok := req.Context().Deadline(); ok {
+			remaining = time.Until(deadline)
+		}
+		return &http.Response{StatusCode: http.StatusInternalServerError, Body: ioutil.NopCloser(bytes.NewReader(nil))}
+	})
+	b.fetchTimeout = time.Hour
+	b.phaseTimeouts = map[FetchPhase]time.Duration{
+		PhaseTOC:      time.Minute,
+		PhaseOnDemand: 2 * time.Minute,
+	}
+	for _, tt := range []struct {
+		opts []Option
+		want time.Duration
+	}{
+		{want: time.Hour},
+		{opts: []Option{WithPhase(PhaseTOC)}, want: time.Minute},
+		{opts: []Option{WithPhase(PhaseOnDemand)}, want: 2 * time.Minute},
+		{opts: []Option{WithPhase(PhasePrefetch)}, want: time.Hour},
+	} {
+		remaining = 0
+		if _, err := b.ReadAt(make([]byte, 1), 0, tt.opts...); err == nil {
+			t.Fatalf("read must fail")
+		}
+		if remaining <= tt.want-time.Second || remaining > tt.want {
+			t.Errorf("timeout = %v; want %v", remaining, tt.want)
+		}
+	}
+}
+
+func TestReadAtCanceled(t *testing.T) {
+	var canceled bool
+	b := makeBlob(t, int64(len(sampleData1)), sampleChunkSize, func(req *http.Request) *http.Response {
+		canceled = req.Context().Err() != nil
+		return &http.Response{StatusCode: http.StatusInternalServerError, Body: ioutil.NopCloser(bytes.NewReader(nil))}
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := b.ReadAt(make([]byte, 1), 0, WithContext(ctx)); err == nil {
+		t.Fatalf("read must fail")
+	}
+	if !canceled {
+		t.Errorf("fetch must be aborted with the context of the read")
+	}
+}
+
+func TestReadCachedAt(t *testing.T) {
+	size := int64(len(sampleData1))
+	b := makeBlob(t, size, sampleChunkSize, multiRoundTripper(t, []byte(sampleData1)))
+	p := make([]byte, size)
+	if _, err := b.ReadCachedAt(p, 0); !errdefs.IsNotFound(err) {
+		t.Fatalf("read of uncached contents = %v; want not found", err)
+	}
+
+	// Cache only the first two chunks.
+	checkRead(t, []byte(sampleData1[:2*sampleChunkSize]), b, 0, 2*sampleChunkSize)
+	for _, reg := range []region{{0, 2*sampleChunkSize - 1}, {1, sampleChunkSize + 1}} {
+		p := make([]byte, reg.size())
+		if n, err := b.ReadCachedAt(p, reg.b); err != nil || string(p[:n]) != sampleData1[reg.b:reg.e+1] {
+			t.Errorf("read cached %v = %q (%v); want %q", reg, string(p[:n]), err, sampleData1[reg.b:reg.e+1])
+		}
+	}
+	if _, err := b.ReadCachedAt(make([]byte, 2), 2*sampleChunkSize-1); !errdefs.IsNotFound(err) {
+		t.Errorf("read over uncached chunk = %v; want not found", err)
+	}
+}
+
 func TestCheckInterval(t *testing.T) {
 	var (
 		tr        = &calledRoundTripper{}
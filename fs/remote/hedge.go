@@ -0,0 +1,289 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+)
+
+const (
+	defaultHedgePercentile    = 95
+	defaultHedgeMinDelayMsec  = 50
+	defaultHedgeBudgetPercent = 5
+
+	// hedgeSamples is the number of recent latencies the delay is based on.
+	hedgeSamples = 128
+
+	// hedgeMinSamples is the number of latencies needed for using the
+	// percentile instead of the minimum delay.
+	hedgeMinSamples = 20
+
+	// maxHedgeTokens bounds the burst of hedged requests.
+	maxHedgeTokens = 10
+
+	// altResolveTimeout is the timeout of resolving the blob on another host
+	// for hedged requests.
+	altResolveTimeout = 30 * time.Second
+)
+
+// hedger decides when on-demand fetches are hedged. The delay is a percentile
+// of the latencies (until the response headers) of recent fetches and the
+// number of hedged requests is capped by a token bucket filled by each fetch.
+type hedger struct {
+	percentile int
+	minDelay   time.Duration
+	budget     float64 // tokens added by a fetch
+
+	mu        sync.Mutex
+	latencies []time.Duration // ring buffer
+	next      int
+	tokens    float64
+}
+
+func newHedger(cfg config.HedgingConfig) *hedger {
+	if !cfg.Enable {
+		return nil
+	}
+	h := &hedger{
+		percentile: cfg.Percentile,
+		minDelay:   time.Duration(cfg.MinDelayMsec) * time.Millisecond,
+		budget:     float64(cfg.BudgetPercent) / 100,
+	}
+	if h.percentile == 0 {
+		h.percentile = defaultHedgePercentile
+	}
+	if h.minDelay == 0 {
+		h.minDelay = defaultHedgeMinDelayMsec * time.Millisecond
+	}
+	if cfg.BudgetPercent == 0 {
+		h.budget = defaultHedgeBudgetPercent / 100.0
+	}
+	return h
+}
+
+// delay returns the duration to wait for the response before hedging.
+func (h *hedger) delay() time.Duration {
+	h.mu.Lock()
+	if len(h.latencies) < hedgeMinSamples {
+		h.mu.Unlock()
+		return h.minDelay
+	}
+	ls := append([]time.Duration(nil), h.latencies...)
+	h.mu.Unlock()
+	sort.Slice(ls, func(i, j int) bool { return ls[i] < ls[j] })
+	idx := (len(ls)*h.percentile+99)/100 - 1 // nearest-rank
+	if idx < 0 {
+		idx = 0
+	}
+	if d := ls[idx]; d > h.minDelay {
+		return d
+	}
+	return h.minDelay
+}
+
+// observe records the latency of a fetch.
+func (h *hedger) observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.latencies) < hedgeSamples {
+		h.latencies = append(h.latencies, d)
+		return
+	}
+	h.latencies[h.next] = d
+	h.next = (h.next + 1) % hedgeSamples
+}
+
+// fetched adds the budget of a fetch to the bucket.
+func (h *hedger) fetched() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.tokens += h.budget; h.tokens > maxHedgeTokens {
+		h.tokens = maxHedgeTokens
+	}
+}
+
+// acquire takes a token for a hedged request. This returns false if the budget
+// is exhausted.
+func (h *hedger) acquire() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.tokens < 1 {
+		return false
+	}
+	h.tokens--
+	return true
+}
+
+// hedgeTarget returns the URL and the transport for hedged requests. The blob
+// on the other host is resolved in background on the first call and the same
+// host is used until it's resolved or if there is no other host.
+func (f *fetcher) hedgeTarget() (string, http.RoundTripper) {
+	f.altOnce.Do(func() {
+		if f.resolveAlt == nil {
+			return
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), altResolveTimeout)
+			defer cancel()
+			alt, err := f.resolveAlt(ctx)
+			if err != nil {
+				log.G(ctx).WithError(err).Debugf("failed to resolve blob for hedged requests")
+				return
+			}
+			f.altMu.Lock()
+			f.alt = alt
+			f.altMu.Unlock()
+		}()
+	})
+	f.altMu.Lock()
+	alt := f.alt
+	f.altMu.Unlock()
+	if alt != nil {
+		alt.urlMu.Lock()
+		defer alt.urlMu.Unlock()
+		return alt.url, alt.tr
+	}
+	f.urlMu.Lock()
+	defer f.urlMu.Unlock()
+	return f.url, f.tr
+}
+
+type hedgeResult struct {
+	res    *http.Response
+	err    error
+	cancel context.CancelFunc
+	hedged bool
+}
+
+// roundTrip sends the request. If the fetch is on-demand and hedging is
+// enabled, a second request is sent to another host when the response doesn't
+// come within the delay and the first successful response is taken.
+func (f *fetcher) roundTrip(tr http.RoundTripper, req *http.Request, opts *options) (*http.Response, error) {
+	h := f.hedger
+	if h == nil || opts.background || opts.phase != PhaseOnDemand || opts.tr != nil {
+		return tr.RoundTrip(req)
+	}
+	h.fetched()
+
+	results := make(chan hedgeResult, 2)
+	send := func(req *http.Request, tr http.RoundTripper, hedged bool) context.CancelFunc {
+		ctx, cancel := context.WithCancel(req.Context())
+		req = req.Clone(ctx)
+		go func() {
+			start := time.Now()
+			res, err := tr.RoundTrip(req)
+			if err == nil && !hedged {
+				h.observe(time.Since(start))
+			}
+			results <- hedgeResult{res, err, cancel, hedged}
+		}()
+		return cancel
+	}
+	cancels := map[bool]context.CancelFunc{false: send(req, tr, false)}
+	pending := 1
+	timer := time.NewTimer(h.delay())
+	defer timer.Stop()
+	var primary *hedgeResult
+	for {
+		select {
+		case r := <-results:
+			pending--
+			delete(cancels, r.hedged)
+			if !r.hedged {
+				if r.err != nil && pending > 0 {
+					primary = &r // Wait for the hedged request
+					continue
+				}
+				return f.takeResult(r, cancels, results, pending)
+			}
+			if r.err == nil && (r.res.StatusCode == http.StatusOK || r.res.StatusCode == http.StatusPartialContent) {
+				log.G(req.Context()).Debugf("hedged request won (host:%q)", f.host)
+				return f.takeResult(r, cancels, results, pending)
+			}
+			discardResult(r)
+			if pending == 0 {
+				return f.takeResult(*primary, cancels, results, pending)
+			}
+		case <-timer.C:
+			if !h.acquire() {
+				continue
+			}
+			u, htr := f.hedgeTarget()
+			hreq := req
+			if u != req.URL.String() {
+				pu, err := url.Parse(u)
+				if err != nil {
+					continue
+				}
+				hreq = req.Clone(req.Context())
+				hreq.URL, hreq.Host = pu, pu.Host
+			}
+			cancels[true] = send(hreq, htr, true)
+			pending++
+		}
+	}
+}
+
+// takeResult returns the result and aborts the other request. The context of
+// the taken request is canceled when the body is closed.
+func (f *fetcher) takeResult(r hedgeResult, cancels map[bool]context.CancelFunc, results chan hedgeResult, pending int) (*http.Response, error) {
+	for _, cancel := range cancels {
+		cancel()
+	}
+	if pending > 0 {
+		go func() {
+			for i := 0; i < pending; i++ {
+				discardResult(<-results)
+			}
+		}()
+	}
+	if r.err != nil {
+		r.cancel()
+		return nil, r.err
+	}
+	r.res.Body = &cancelBody{r.res.Body, r.cancel}
+	return r.res, nil
+}
+
+func discardResult(r hedgeResult) {
+	if r.err == nil {
+		io.Copy(ioutil.Discard, io.LimitReader(r.res.Body, 4096))
+		r.res.Body.Close()
+	}
+	r.cancel()
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
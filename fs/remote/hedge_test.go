@@ -0,0 +1,116 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/fs/config"
+)
+
+func TestHedgeDelay(t *testing.T) {
+	h := newHedger(config.HedgingConfig{Enable: true, Percentile: 90, MinDelayMsec: 5})
+	if d := h.delay(); d != 5*time.Millisecond {
+		t.Errorf("delay without samples = %v; want min delay", d)
+	}
+	for i := 1; i <= 100; i++ {
+		h.observe(time.Duration(i) * time.Millisecond)
+	}
+	if d := h.delay(); d != 90*time.Millisecond {
+		t.Errorf("delay = %v; want 90ms", d)
+	}
+}
+
+func TestHedge(t *testing.T) {
+	respond := func(body string) *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusPartialContent,
+			Header:     http.Header{"Content-Range": []string{"bytes 0-3/10"}},
+			Body:       ioutil.NopCloser(bytes.NewReader([]byte(body))),
+		}
+	}
+	slow := RoundTripFunc(func(req *http.Request) *http.Response {
+		select {
+		case <-req.Context().Done():
+		case <-time.After(time.Second):
+		}
+		return respond("slow")
+	})
+	var hedged int32
+	alt := &fetcher{url: "http://mirror.test/blob", tr: RoundTripFunc(func(req *http.Request) *http.Response {
+		atomic.AddInt32(&hedged, 1)
+		if req.URL.Host != "mirror.test" {
+			t.Errorf("hedged request to %q; want mirror.test", req.URL.Host)
+		}
+		return respond("fast")
+	})}
+	newTestFetcher := func(h *hedger) *fetcher {
+		return &fetcher{url: "http://registry.test/blob", tr: slow, hedger: h, alt: alt}
+	}
+	read := func(f *fetcher, opts *options) string {
+		req, err := http.NewRequestWithContext(context.Background(), "GET", f.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := f.roundTrip(f.tr, req, opts)
+		if err != nil {
+			t.Fatalf("failed to round trip: %v", err)
+		}
+		defer res.Body.Close()
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	h := newHedger(config.HedgingConfig{Enable: true, MinDelayMsec: 10, BudgetPercent: 100})
+	f := newTestFetcher(h)
+	start := time.Now()
+	if got := read(f, &options{phase: PhaseOnDemand}); got != "fast" {
+		t.Errorf("body = %q; want response of hedged request", got)
+	}
+	if d := time.Since(start); d >= time.Second {
+		t.Errorf("hedged fetch took %v", d)
+	}
+	if hedged != 1 {
+		t.Errorf("hedged %d times; want 1", hedged)
+	}
+
+	// Non on-demand fetches and fetches over the budget aren't hedged.
+	hedged = 0
+	if got := read(f, &options{phase: PhasePrefetch}); got != "slow" {
+		t.Errorf("body of prefetch = %q; want slow", got)
+	}
+	h = newHedger(config.HedgingConfig{Enable: true, MinDelayMsec: 10, BudgetPercent: 50})
+	f = newTestFetcher(h)
+	if got := read(f, &options{phase: PhaseOnDemand}); got != "slow" {
+		t.Errorf("body over budget = %q; want slow", got)
+	}
+	if got := read(f, &options{phase: PhaseOnDemand}); got != "fast" {
+		t.Errorf("body within budget = %q; want fast", got)
+	}
+	if hedged != 1 {
+		t.Errorf("hedged %d times; want 1", hedged)
+	}
+}
@@ -0,0 +1,188 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// QoSClass is the class of fetch traffic of a blob.
+type QoSClass int
+
+const (
+	// QoSLow is for blobs of pods which can wait (e.g. batch jobs).
+	QoSLow QoSClass = iota
+
+	// QoSNormal is the default class.
+	QoSNormal
+
+	// QoSHigh is for blobs of latency-critical pods.
+	QoSHigh
+)
+
+// qosWeights are the shares of on-demand fetches of each class.
+var qosWeights = map[QoSClass]float64{
+	QoSLow:    1,
+	QoSNormal: 4,
+	QoSHigh:   16,
+}
+
+// ParseQoSClass parses the name of the class ("high", "normal" or "low").
+func ParseQoSClass(s string) (QoSClass, error) {
+	switch s {
+	case "high":
+		return QoSHigh, nil
+	case "normal", "":
+		return QoSNormal, nil
+	case "low":
+		return QoSLow, nil
+	}
+	return QoSNormal, fmt.Errorf("unknown QoS class %q", s)
+}
+
+// QoSBlob is implemented by blobs whose fetches can be scheduled by QoS classes.
+type QoSBlob interface {
+
+	// SetQoSClass sets the class of the blob. If the blob is shared by several
+	// snapshots, the highest class is used.
+	SetQoSClass(class QoSClass)
+}
+
+// qosFlow is a flow of fetches of a blob. Each blob has separate flows for
+// on-demand and background fetches.
+type qosFlow struct {
+	finish float64 // virtual finish time of the last request; guarded by fetchScheduler.mu
+}
+
+// fetchScheduler limits the number of concurrent fetches and admits them in a
+// weighted fair queueing manner. On-demand fetches are always admitted before
+// background fetches. Among on-demand fetches, each blob is a flow weighted by
+// its QoS class and the cost of a fetch is its size, so a blob with a lot of
+// requests can't starve others. Background fetches share the bandwidth
+// equally.
+type fetchScheduler struct {
+	mu      sync.Mutex
+	slots   int
+	running int
+	vtime   [2]float64 // virtual time of on-demand and background fetches
+	seq     uint64
+	waiters []*fetchWaiter
+}
+
+type fetchWaiter struct {
+	background bool
+	start      float64
+	finish     float64
+	seq        uint64
+	ready      chan struct{}
+}
+
+func newFetchScheduler(slots int) *fetchScheduler {
+	return &fetchScheduler{slots: slots}
+}
+
+// acquire waits for the turn of the fetch and returns the function to be called
+// when the fetch completes.
+func (s *fetchScheduler) acquire(ctx context.Context, flow *qosFlow, class QoSClass, background bool, cost int64) (func(), error) {
+	return s.wait(ctx, s.enqueue(flow, class, background, cost))
+}
+
+// enqueue tags the fetch with the virtual times and queues it.
+func (s *fetchScheduler) enqueue(flow *qosFlow, class QoSClass, background bool, cost int64) *fetchWaiter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	weight := qosWeights[class]
+	if background {
+		weight = 1
+	}
+	start := flow.finish
+	if vtime := s.vtime[flowIndex(background)]; start < vtime {
+		start = vtime
+	}
+	flow.finish = start + float64(cost)/weight
+	s.seq++
+	w := &fetchWaiter{background, start, flow.finish, s.seq, make(chan struct{})}
+	s.waiters = append(s.waiters, w)
+	s.dispatch()
+	return w
+}
+
+func (s *fetchScheduler) wait(ctx context.Context, w *fetchWaiter) (func(), error) {
+	select {
+	case <-w.ready:
+		return s.release, nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for i, ww := range s.waiters {
+			if ww == w {
+				s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+				return nil, ctx.Err()
+			}
+		}
+		// Admitted right before the cancellation.
+		s.running--
+		s.dispatch()
+		return nil, ctx.Err()
+	}
+}
+
+func (s *fetchScheduler) release() {
+	s.mu.Lock()
+	s.running--
+	s.dispatch()
+	s.mu.Unlock()
+}
+
+// dispatch admits waiters while slots are available. s.mu must be held.
+func (s *fetchScheduler) dispatch() {
+	for s.running < s.slots && len(s.waiters) > 0 {
+		next := 0
+		for i, w := range s.waiters[1:] {
+			if w.before(s.waiters[next]) {
+				next = i + 1
+			}
+		}
+		w := s.waiters[next]
+		s.waiters = append(s.waiters[:next], s.waiters[next+1:]...)
+		if i := flowIndex(w.background); w.start > s.vtime[i] {
+			s.vtime[i] = w.start
+		}
+		s.running++
+		close(w.ready)
+	}
+}
+
+func (w *fetchWaiter) before(o *fetchWaiter) bool {
+	if w.background != o.background {
+		return !w.background
+	}
+	if w.finish != o.finish {
+		return w.finish < o.finish
+	}
+	return w.seq < o.seq
+}
+
+// flowIndex returns the index of the flow of on-demand or background fetches.
+func flowIndex(background bool) int {
+	if background {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,121 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestFetchScheduler tests the order fetches are admitted.
+func TestFetchScheduler(t *testing.T) {
+	s := newFetchScheduler(1)
+	release, err := s.acquire(context.Background(), &qosFlow{}, QoSNormal, false, 1)
+	if err != nil {
+		t.Fatalf("failed to acquire free slot: %v", err)
+	}
+
+	var (
+		order   []string
+		orderMu sync.Mutex
+		wg      sync.WaitGroup
+		high    = &qosFlow{}
+		low     = &qosFlow{}
+		bg      = &qosFlow{}
+		queued  int
+	)
+	enqueue := func(name string, flow *qosFlow, class QoSClass, background bool) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := s.acquire(context.Background(), flow, class, background, 100)
+			if err != nil {
+				t.Errorf("failed to acquire %s: %v", name, err)
+				return
+			}
+			orderMu.Lock()
+			order = append(order, name)
+			orderMu.Unlock()
+			r()
+		}()
+		// Wait for the waiter to be queued so that the sequence is deterministic.
+		for {
+			s.mu.Lock()
+			n := len(s.waiters)
+			s.mu.Unlock()
+			if n > 0 && n == queued+1 {
+				queued++
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	enqueue("bg", bg, QoSHigh, true)
+	enqueue("low1", low, QoSLow, false)
+	enqueue("low2", low, QoSLow, false)
+	enqueue("high1", high, QoSHigh, false)
+	enqueue("high2", high, QoSHigh, false)
+
+	// A cancelled waiter leaves the queue.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.acquire(ctx, &qosFlow{}, QoSHigh, false, 1); err == nil {
+		t.Errorf("cancelled fetch must not be admitted")
+	}
+
+	release()
+	wg.Wait()
+	// High-class fetches get 16x shares of low ones so both of high fetches go
+	// before the first low one. Background fetches go last.
+	if got := fmt.Sprint(order); got != "[high1 high2 low1 low2 bg]" {
+		t.Errorf("unexpected order %v", got)
+	}
+	if s.running != 0 || len(s.waiters) != 0 {
+		t.Errorf("slots are leaked: running=%d waiters=%d", s.running, len(s.waiters))
+	}
+}
+
+// TestFetchSchedulerFairness tests a blob with a lot of requests doesn't starve
+// others in the same class.
+func TestFetchSchedulerFairness(t *testing.T) {
+	s := newFetchScheduler(1)
+	hold, err := s.acquire(context.Background(), &qosFlow{}, QoSNormal, false, 1)
+	if err != nil {
+		t.Fatalf("failed to acquire free slot: %v", err)
+	}
+	heavy, light := &qosFlow{}, &qosFlow{}
+	var ws []*fetchWaiter
+	for _, f := range []*qosFlow{heavy, heavy, heavy, light} {
+		ws = append(ws, s.enqueue(f, QoSNormal, false, 100))
+	}
+	for i, want := range []int{0, 3, 1, 2} {
+		if i == 0 {
+			hold()
+		} else {
+			s.release()
+		}
+		select {
+		case <-ws[want].ready:
+		case <-time.After(time.Second):
+			t.Fatalf("request %d isn't admitted %d-th", want, i)
+		}
+	}
+	s.release()
+}
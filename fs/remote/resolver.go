@@ -40,18 +40,26 @@ import (
 	"time"
 
 	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes/docker"
 	"github.com/containerd/stargz-snapshotter/cache"
 	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/containerd/stargz-snapshotter/util/ratelimit"
+	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
+	"golang.org/x/sync/singleflight"
 )
 
 const (
-	defaultChunkSize        = 50000
-	defaultValidIntervalSec = 60
-	defaultFetchTimeoutSec  = 300
+	defaultChunkSize         = 50000
+	defaultValidIntervalSec  = 60
+	defaultFetchTimeoutSec   = 300
+	defaultResolveTimeoutSec = 10
+	defaultRateLimitReserve  = 10
 )
 
 func NewResolver(cache cache.BlobCache, cfg config.BlobConfig) *Resolver {
@@ -67,8 +75,24 @@ func NewResolver(cache cache.BlobCache, cfg config.BlobConfig) *Resolver {
 	if cfg.FetchTimeoutSec == 0 {
 		cfg.FetchTimeoutSec = defaultFetchTimeoutSec
 	}
+	if cfg.ResolveTimeoutSec == 0 {
+		cfg.ResolveTimeoutSec = defaultResolveTimeoutSec
+	}
+	for _, t := range []*int64{&cfg.TOCFetchTimeoutSec, &cfg.PrefetchFetchTimeoutSec, &cfg.OnDemandFetchTimeoutSec} {
+		if *t == 0 {
+			*t = cfg.FetchTimeoutSec
+		}
+	}
+	if cfg.RateLimitReserve == 0 {
+		cfg.RateLimitReserve = defaultRateLimitReserve
+	}
 
+	var scheduler *fetchScheduler
+	if cfg.MaxConcurrentFetches > 0 {
+		scheduler = newFetchScheduler(cfg.MaxConcurrentFetches)
+	}
 	return &Resolver{
+		scheduler: scheduler,
 		bufPool: sync.Pool{
 			New: func() interface{} {
 				return new(bytes.Buffer)
@@ -76,6 +100,8 @@ func NewResolver(cache cache.BlobCache, cfg config.BlobConfig) *Resolver {
 		},
 		blobCache:  cache,
 		blobConfig: cfg,
+		rateLimits: ratelimit.NewTracker(cfg.RateLimitReserve),
+		hedger:     newHedger(cfg.Hedging),
 	}
 }
 
@@ -83,15 +109,76 @@ type Resolver struct {
 	blobCache  cache.BlobCache
 	blobConfig config.BlobConfig
 	bufPool    sync.Pool
+	resolveG   singleflight.Group
+	scheduler  *fetchScheduler
+	rateLimits *ratelimit.Tracker
+	hedger     *hedger
+}
+
+// ResolveTimeout returns the timeout of each request for resolving blobs. This
+// is also applicable to resolving manifests.
+func (r *Resolver) ResolveTimeout() time.Duration {
+	return time.Duration(r.blobConfig.ResolveTimeoutSec) * time.Second
+}
+
+// RateLimitStats returns the rate limits reported by the registries.
+func (r *Resolver) RateLimitStats() []ratelimit.HostStats {
+	return r.rateLimits.Stats()
+}
+
+type resolveResult struct {
+	fetcher *fetcher
+	size    int64
 }
 
 func (r *Resolver) Resolve(ctx context.Context, hosts docker.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) (Blob, error) {
-	fetcher, size, err := newFetcher(ctx, hosts, refspec, desc)
+	// Simultaneous resolutions of the same blob of the same reference (e.g. a
+	// storm of mounts of the same layer) share the redirection and the size
+	// resolution. Blobs aren't shared among references because the credentials
+	// and the scope of the authorization depend on the repository.
+	key := refspec.String() + "/" + desc.Digest.String()
+	ch := r.resolveG.DoChan(key, func() (interface{}, error) {
+		// The resolution mustn't fail because the context of the first caller
+		// is cancelled while others are waiting for it. Only the logger and
+		// the namespace are inherited.
+		bCtx := log.WithLogger(context.Background(), log.G(ctx))
+		if ns, ok := namespaces.Namespace(ctx); ok {
+			bCtx = namespaces.WithNamespace(bCtx, ns)
+		}
+		fetcher, size, err := newFetcher(bCtx, hosts, refspec, desc, r.rateLimits, r.ResolveTimeout())
+		if err != nil {
+			return nil, err
+		}
+		fetcher.hedger = r.hedger
+		return &resolveResult{fetcher, size}, nil
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		// Each caller gets its own copy of the fetcher so refreshing the URL
+		// of one blob doesn't affect others.
+		rr := res.Val.(*resolveResult)
+		return r.newBlob(rr.fetcher.clone(), rr.size), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// ResolveFetcher resolves the blob fetched by the fetcher of a source provider
+// instead of registries.
+func (r *Resolver) ResolveFetcher(ctx context.Context, f source.FetcherFunc, desc ocispec.Descriptor) (Blob, error) {
+	sf, err := f(ctx, desc)
 	if err != nil {
 		return nil, err
 	}
+	return r.newBlob(&providedFetcher{sf, desc}, sf.Size()), nil
+}
+
+func (r *Resolver) newBlob(f blobFetcher, size int64) *blob {
 	return &blob{
-		fetcher:       fetcher,
+		fetcher:       f,
 		size:          size,
 		chunkSize:     r.blobConfig.ChunkSize,
 		cache:         r.blobCache,
@@ -99,10 +186,16 @@ func (r *Resolver) Resolve(ctx context.Context, hosts docker.RegistryHosts, refs
 		checkInterval: time.Duration(r.blobConfig.ValidInterval) * time.Second,
 		resolver:      r,
 		fetchTimeout:  time.Duration(r.blobConfig.FetchTimeoutSec) * time.Second,
-	}, nil
+		phaseTimeouts: map[FetchPhase]time.Duration{
+			PhaseTOC:      time.Duration(r.blobConfig.TOCFetchTimeoutSec) * time.Second,
+			PhasePrefetch: time.Duration(r.blobConfig.PrefetchFetchTimeoutSec) * time.Second,
+			PhaseOnDemand: time.Duration(r.blobConfig.OnDemandFetchTimeoutSec) * time.Second,
+		},
+		qosClass: QoSNormal,
+	}
 }
 
-func newFetcher(ctx context.Context, hosts docker.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) (*fetcher, int64, error) {
+func newFetcher(ctx context.Context, hosts docker.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor, rateLimits *ratelimit.Tracker, timeout time.Duration) (*fetcher, int64, error) {
 	reghosts, err := hosts(refspec.Hostname())
 	if err != nil {
 		return nil, 0, err
@@ -118,57 +211,83 @@ func newFetcher(ctx context.Context, hosts docker.RegistryHosts, refspec referen
 
 	// Try to create fetcher until succeeded
 	rErr := fmt.Errorf("failed to resolve")
-	for _, host := range reghosts {
-		if host.Host == "" || strings.Contains(host.Host, "/") {
-			rErr = errors.Wrapf(rErr, "invalid destination (host %q, ref:%q, digest:%q)",
-				host.Host, refspec, digest)
+	for i, host := range reghosts {
+		f, size, err := newHostFetcher(ctx, host, refspec, u, digest, rateLimits, timeout)
+		if err != nil {
+			rErr = errors.Wrapf(rErr, "%v", err)
 			continue // Try another
-
 		}
-
-		// Prepare transport with authorization functionality
-		tr := host.Client.Transport
-		if host.Authorizer != nil {
-			tr = &transport{
-				inner: tr,
-				auth:  host.Authorizer,
-				// Specify pull scope
-				// TODO: The scope generator function in containerd (github.com/containerd/containerd/remotes/docker/scope.go) should be exported and used here.
-				scope: "repository:" + strings.TrimPrefix(u.Path, "/") + ":pull",
+		if rest := reghosts[i+1:]; len(rest) > 0 {
+			// The following hosts (mirrors or the registry) are used for
+			// hedged requests.
+			f.resolveAlt = func(ctx context.Context) (*fetcher, error) {
+				for _, host := range rest {
+					if af, _, err := newHostFetcher(ctx, host, refspec, u, digest, rateLimits, timeout); err == nil {
+						return af, nil
+					}
+				}
+				return nil, fmt.Errorf("no other host serves the blob")
 			}
 		}
+		return f, size, nil
+	}
 
-		// Resolve redirection and get blob URL
-		blobURL := fmt.Sprintf("%s://%s/%s/blobs/%s",
-			host.Scheme,
-			path.Join(host.Host, host.Path),
-			strings.TrimPrefix(refspec.Locator, refspec.Hostname()+"/"),
-			digest)
-		url, err := redirect(ctx, blobURL, tr)
-		if err != nil {
-			rErr = errors.Wrapf(rErr, "failed to redirect (host %q, ref:%q, digest:%q): %v",
-				host.Host, refspec, digest, err)
-			continue // Try another
-		}
+	return nil, 0, errors.Wrapf(rErr, "cannot resolve layer")
+}
 
-		// Get size information
-		// TODO: we should try to use the Size field in the descriptor here.
-		size, err := getSize(ctx, url, tr)
-		if err != nil {
-			rErr = errors.Wrapf(rErr, "failed to get size (host %q, ref:%q, digest:%q): %v",
-				host.Host, refspec, digest, err)
-			continue // Try another
+func newHostFetcher(ctx context.Context, host docker.RegistryHost, refspec reference.Spec, u *url.URL, dgst digest.Digest, rateLimits *ratelimit.Tracker, timeout time.Duration) (*fetcher, int64, error) {
+	if host.Host == "" || strings.Contains(host.Host, "/") {
+		return nil, 0, fmt.Errorf("invalid destination (host %q, ref:%q, digest:%q)",
+			host.Host, refspec, dgst)
+	}
+
+	// Prepare transport with authorization functionality. The default
+	// transport honors proxy configuration in the environment variables.
+	var tr http.RoundTripper = http.DefaultTransport
+	if host.Client != nil && host.Client.Transport != nil {
+		tr = host.Client.Transport
+	}
+	if host.Authorizer != nil {
+		tr = &transport{
+			inner: tr,
+			auth:  host.Authorizer,
+			// Specify pull scope
+			// TODO: The scope generator function in containerd (github.com/containerd/containerd/remotes/docker/scope.go) should be exported and used here.
+			scope: "repository:" + strings.TrimPrefix(u.Path, "/") + ":pull",
 		}
-
-		// Hit one destination
-		return &fetcher{
-			url:     url,
-			tr:      tr,
-			blobURL: blobURL,
-		}, size, nil
+	}
+	// Rate limits are recorded for the registry even if blobs are served
+	// from another host after redirection.
+	tr = &ratelimit.Transport{Inner: tr, Tracker: rateLimits, Host: host.Host}
+
+	// Resolve redirection and get blob URL
+	blobURL := fmt.Sprintf("%s://%s/%s/blobs/%s",
+		host.Scheme,
+		path.Join(host.Host, host.Path),
+		strings.TrimPrefix(refspec.Locator, refspec.Hostname()+"/"),
+		dgst)
+	url, err := redirect(ctx, blobURL, tr, timeout)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to redirect (host %q, ref:%q, digest:%q): %v",
+			host.Host, refspec, dgst, err)
 	}
 
-	return nil, 0, errors.Wrapf(rErr, "cannot resolve layer")
+	// Get size information
+	// TODO: we should try to use the Size field in the descriptor here.
+	size, err := getSize(ctx, url, tr, timeout)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get size (host %q, ref:%q, digest:%q): %v",
+			host.Host, refspec, dgst, err)
+	}
+
+	// Hit one destination
+	return &fetcher{
+		url:            url,
+		tr:             tr,
+		blobURL:        blobURL,
+		host:           host.Host,
+		resolveTimeout: timeout,
+	}, size, nil
 }
 
 type transport struct {
@@ -212,8 +331,8 @@ func (tr *transport) RoundTrip(req *http.Request) (*http.Response, error) {
 	return resp, nil
 }
 
-func redirect(ctx context.Context, blobURL string, tr http.RoundTripper) (url string, err error) {
-	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+func redirect(ctx context.Context, blobURL string, tr http.RoundTripper, timeout time.Duration) (url string, err error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
 	// We use GET request for redirect.
@@ -246,8 +365,8 @@ func redirect(ctx context.Context, blobURL string, tr http.RoundTripper) (url st
 	return
 }
 
-func getSize(ctx context.Context, url string, tr http.RoundTripper) (int64, error) {
-	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+func getSize(ctx context.Context, url string, tr http.RoundTripper, timeout time.Duration) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
 	if err != nil {
@@ -298,8 +417,40 @@ type fetcher struct {
 	urlMu         sync.Mutex
 	tr            http.RoundTripper
 	blobURL       string
+	host          string
 	singleRange   bool
 	singleRangeMu sync.Mutex
+
+	resolveTimeout time.Duration
+
+	// hedger is non-nil if on-demand fetches are hedged. resolveAlt resolves
+	// the blob on another host for hedged requests.
+	hedger     *hedger
+	resolveAlt func(ctx context.Context) (*fetcher, error)
+	altOnce    sync.Once
+	alt        *fetcher
+	altMu      sync.Mutex
+}
+
+// clone returns a copy of the fetcher which can be modified (e.g. refreshing
+// the URL) independently from the original one.
+func (f *fetcher) clone() *fetcher {
+	f.urlMu.Lock()
+	url := f.url
+	f.urlMu.Unlock()
+	f.singleRangeMu.Lock()
+	singleRange := f.singleRange
+	f.singleRangeMu.Unlock()
+	return &fetcher{
+		url:            url,
+		tr:             f.tr,
+		blobURL:        f.blobURL,
+		host:           f.host,
+		singleRange:    singleRange,
+		resolveTimeout: f.resolveTimeout,
+		hedger:         f.hedger,
+		resolveAlt:     f.resolveAlt,
+	}
 }
 
 type multipartReadCloser interface {
@@ -353,7 +504,7 @@ func (f *fetcher) fetch(ctx context.Context, rs []region, retry bool, opts *opti
 	req.Header.Add("Range", fmt.Sprintf("bytes=%s", ranges[:len(ranges)-1]))
 	req.Header.Add("Accept-Encoding", "identity")
 	req.Close = false
-	res, err := tr.RoundTrip(req) // NOT DefaultClient; don't want redirects
+	res, err := f.roundTrip(tr, req, opts) // NOT DefaultClient; don't want redirects
 	if err != nil {
 		return nil, err
 	}
@@ -419,9 +570,7 @@ func (f *fetcher) check() error {
 		return nil
 	} else if res.StatusCode == http.StatusForbidden {
 		// Try to re-redirect this blob
-		rCtx, rCancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer rCancel()
-		if err := f.refreshURL(rCtx); err == nil {
+		if err := f.refreshURL(context.Background()); err == nil {
 			return nil
 		}
 		return fmt.Errorf("failed to refresh URL on status %v", res.Status)
@@ -431,7 +580,7 @@ func (f *fetcher) check() error {
 }
 
 func (f *fetcher) refreshURL(ctx context.Context) error {
-	newURL, err := redirect(ctx, f.blobURL, f.tr)
+	newURL, err := redirect(ctx, f.blobURL, f.tr, f.resolveTimeout)
 	if err != nil {
 		return err
 	}
@@ -459,6 +608,68 @@ func (f *fetcher) isSingleRangeMode() bool {
 	return r
 }
 
+// providedFetcher fetches a blob with the fetcher of a source provider. Each
+// region is fetched by a separate call of the fetcher.
+type providedFetcher struct {
+	f    source.Fetcher
+	desc ocispec.Descriptor
+}
+
+func (f *providedFetcher) fetch(ctx context.Context, rs []region, retry bool, opts *options) (multipartReadCloser, error) {
+	if len(rs) == 0 {
+		return nil, fmt.Errorf("no request queried")
+	}
+	if opts.ctx != nil {
+		ctx = opts.ctx
+	}
+	var s regionSet
+	for _, reg := range rs {
+		s.add(reg)
+	}
+	return &providedReader{ctx: ctx, f: f.f, rs: s.rs}, nil
+}
+
+func (f *providedFetcher) check() error {
+	return f.f.Check()
+}
+
+func (f *providedFetcher) genID(reg region) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("provided-%s-%d-%d", f.desc.Digest, reg.b, reg.e)))
+	return fmt.Sprintf("%x", sum)
+}
+
+type providedReader struct {
+	ctx context.Context
+	f   source.Fetcher
+	rs  []region
+	cur io.ReadCloser
+}
+
+func (pr *providedReader) Next() (region, io.Reader, error) {
+	if pr.cur != nil {
+		pr.cur.Close()
+		pr.cur = nil
+	}
+	if len(pr.rs) == 0 {
+		return region{}, nil, io.EOF
+	}
+	reg := pr.rs[0]
+	pr.rs = pr.rs[1:]
+	rc, err := pr.f.Fetch(pr.ctx, reg.b, reg.size())
+	if err != nil {
+		return region{}, nil, err
+	}
+	pr.cur = rc
+	return reg, rc, nil
+}
+
+func (pr *providedReader) Close() error {
+	if pr.cur != nil {
+		return pr.cur.Close()
+	}
+	return nil
+}
+
 func singlePartReader(reg region, rc io.ReadCloser) multipartReadCloser {
 	return &singlepartReader{
 		r:      rc,
@@ -530,9 +741,11 @@ func parseRange(header string) (region, int64, error) {
 type Option func(*options)
 
 type options struct {
-	ctx       context.Context
-	tr        http.RoundTripper
-	cacheOpts []cache.Option
+	background bool
+	phase      FetchPhase
+	ctx        context.Context
+	tr         http.RoundTripper
+	cacheOpts  []cache.Option
 }
 
 func WithContext(ctx context.Context) Option {
@@ -547,6 +760,39 @@ func WithRoundTripper(tr http.RoundTripper) Option {
 	}
 }
 
+// FetchPhase is the phase of lazy pulling which a fetch belongs to. The timeout
+// of the fetch is decided by the phase.
+type FetchPhase int
+
+const (
+	// PhaseOther is fetches of no particular phase (e.g. background fetches).
+	PhaseOther FetchPhase = iota
+
+	// PhaseTOC is fetches of TOCs.
+	PhaseTOC
+
+	// PhasePrefetch is fetches of the ranges prefetched on mount.
+	PhasePrefetch
+
+	// PhaseOnDemand is fetches of chunks read on demand.
+	PhaseOnDemand
+)
+
+// WithPhase specifies the phase of the fetch.
+func WithPhase(phase FetchPhase) Option {
+	return func(opts *options) {
+		opts.phase = phase
+	}
+}
+
+// WithBackground marks the fetch as a background one which is scheduled after
+// on-demand fetches when max_concurrent_fetches is configured.
+func WithBackground() Option {
+	return func(opts *options) {
+		opts.background = true
+	}
+}
+
 func WithCacheOpts(cacheOpts ...cache.Option) Option {
 	return func(opts *options) {
 		opts.cacheOpts = cacheOpts
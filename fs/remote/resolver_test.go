@@ -31,10 +31,15 @@ import (
 	"net/url"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/stargz-snapshotter/cache"
+	"github.com/containerd/stargz-snapshotter/fs/config"
 	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
@@ -162,7 +167,7 @@ func TestMirror(t *testing.T) {
 				}
 				return
 			}
-			fetcher, _, err := newFetcher(context.Background(), hosts, refspec, ocispec.Descriptor{Digest: blobDigest})
+			fetcher, _, err := newFetcher(context.Background(), hosts, refspec, ocispec.Descriptor{Digest: blobDigest}, nil, defaultResolveTimeoutSec*time.Second)
 			if err != nil {
 				if tt.error {
 					return
@@ -230,6 +235,137 @@ func (tr *sampleRoundTripper) RoundTrip(req *http.Request) (*http.Response, erro
 	}, nil
 }
 
+func TestResolveConcurrent(t *testing.T) {
+	const storm = 20
+	refspec, err := reference.Parse("dummyexample.com/library/test")
+	if err != nil {
+		t.Fatalf("failed to prepare dummy reference: %v", err)
+	}
+	tr := &countingRoundTripper{
+		RoundTripper: &sampleRoundTripper{okURLs: []string{`.*`}},
+		unblock:      make(chan struct{}),
+	}
+	hosts := func(host string) ([]docker.RegistryHost, error) {
+		return []docker.RegistryHost{{
+			Client:       &http.Client{Transport: tr},
+			Host:         host,
+			Scheme:       "https",
+			Path:         "/v2",
+			Capabilities: docker.HostCapabilityPull,
+		}}, nil
+	}
+	r := NewResolver(cache.NewMemoryCache(), config.BlobConfig{})
+	desc := ocispec.Descriptor{Digest: digest.FromString("dummy")}
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		blobs = make(map[Blob]struct{})
+	)
+	for i := 0; i < storm; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b, err := r.Resolve(context.Background(), hosts, refspec, desc)
+			if err != nil {
+				t.Errorf("failed to resolve: %v", err)
+				return
+			}
+			mu.Lock()
+			blobs[b] = struct{}{}
+			mu.Unlock()
+		}()
+	}
+	time.Sleep(100 * time.Millisecond) // let the resolutions pile up
+	close(tr.unblock)
+	wg.Wait()
+	// A resolution sends a redirection request and a size request.
+	if n := atomic.LoadInt32(&tr.n); n != 2 {
+		t.Errorf("simultaneous resolutions must be deduplicated: %d requests", n)
+	}
+	if len(blobs) != storm {
+		t.Errorf("each resolution must get its own blob: %d blobs", len(blobs))
+	}
+	fetchers := make(map[blobFetcher]struct{})
+	for b := range blobs {
+		fetchers[b.(*blob).fetcher] = struct{}{}
+	}
+	if len(fetchers) != storm {
+		t.Errorf("each resolution must get its own fetcher: %d fetchers", len(fetchers))
+	}
+
+	// Resolution after completion isn't shared.
+	if _, err := r.Resolve(context.Background(), hosts, refspec, desc); err != nil {
+		t.Fatalf("failed to resolve: %v", err)
+	}
+	if n := atomic.LoadInt32(&tr.n); n != 4 {
+		t.Errorf("resolution must be done again: %d requests", n)
+	}
+}
+
+// TestResolveConcurrentReferences tests resolutions aren't shared among
+// repositories and a cancelled caller doesn't fail others.
+func TestResolveConcurrentReferences(t *testing.T) {
+	tr := &countingRoundTripper{
+		RoundTripper: &sampleRoundTripper{okURLs: []string{`.*`}},
+		unblock:      make(chan struct{}),
+	}
+	hosts := func(host string) ([]docker.RegistryHost, error) {
+		return []docker.RegistryHost{{
+			Client:       &http.Client{Transport: tr},
+			Host:         host,
+			Scheme:       "https",
+			Path:         "/v2",
+			Capabilities: docker.HostCapabilityPull,
+		}}, nil
+	}
+	r := NewResolver(cache.NewMemoryCache(), config.BlobConfig{})
+	desc := ocispec.Descriptor{Digest: digest.FromString("dummy")}
+	resolve := func(ctx context.Context, ref string) <-chan error {
+		refspec, err := reference.Parse(ref)
+		if err != nil {
+			t.Fatalf("failed to prepare dummy reference: %v", err)
+		}
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := r.Resolve(ctx, hosts, refspec, desc)
+			errCh <- err
+		}()
+		return errCh
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := resolve(ctx, "dummyexample.com/library/test")
+	time.Sleep(100 * time.Millisecond) // the first caller starts the resolution
+	shared := resolve(context.Background(), "dummyexample.com/library/test")
+	other := resolve(context.Background(), "dummyexample.com/library/other")
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	if err := <-cancelled; err == nil {
+		t.Errorf("cancelled resolution must fail")
+	}
+	close(tr.unblock)
+	if err := <-shared; err != nil {
+		t.Errorf("resolution sharing the cancelled one must succeed: %v", err)
+	}
+	if err := <-other; err != nil {
+		t.Errorf("failed to resolve other repository: %v", err)
+	}
+	if n := atomic.LoadInt32(&tr.n); n != 4 {
+		t.Errorf("each repository must be resolved once: %d requests", n)
+	}
+}
+
+type countingRoundTripper struct {
+	http.RoundTripper
+	n       int32
+	unblock chan struct{}
+}
+
+func (tr *countingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&tr.n, 1)
+	<-tr.unblock
+	return tr.RoundTripper.RoundTrip(req)
+}
+
 func TestCheck(t *testing.T) {
 	tr := &breakRoundTripper{}
 	f := &fetcher{
@@ -0,0 +1,195 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/reader"
+	"github.com/containerd/stargz-snapshotter/fs/remote"
+)
+
+const (
+	defaultScanPrefetchThreshold   = 16
+	defaultScanPrefetchMaxFileSize = 64 << 10
+	scanPrefetchFetchTimeoutSec    = 120
+
+	// scanWindow is the duration after listing a directory during which
+	// lookups of its children are counted as a scan.
+	scanWindow = 5 * time.Second
+
+	// scanMaxGap is the maximum gap between small files fetched by a request.
+	scanMaxGap = 64 << 10
+)
+
+// scanPrefetcher detects sweeps of directories (a readdir followed by lookups
+// of many children, e.g. module scanning of Python) and prefetches the small
+// files in the directories in bulk. Small files in a directory tend to be
+// adjacent in the layer so they are fetched by a few requests instead of
+// faulting them one read at a time.
+type scanPrefetcher struct {
+	fs          *filesystem
+	threshold   int
+	maxFileSize int64
+	dirs        map[string]map[string]*dirScan // mountpoint -> directory -> scan
+	mu          sync.Mutex
+}
+
+type dirScan struct {
+	listed  time.Time
+	lookups int
+	done    bool
+}
+
+func newScanPrefetcher(fs *filesystem, threshold int, maxFileSize int64) *scanPrefetcher {
+	if threshold == 0 {
+		threshold = defaultScanPrefetchThreshold
+	}
+	if maxFileSize == 0 {
+		maxFileSize = defaultScanPrefetchMaxFileSize
+	}
+	return &scanPrefetcher{
+		fs:          fs,
+		threshold:   threshold,
+		maxFileSize: maxFileSize,
+		dirs:        make(map[string]map[string]*dirScan),
+	}
+}
+
+// readdir records the listing of the directory.
+func (p *scanPrefetcher) readdir(mountpoint string, dir *estargz.TOCEntry) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	dirs, ok := p.dirs[mountpoint]
+	if !ok {
+		dirs = make(map[string]*dirScan)
+		p.dirs[mountpoint] = dirs
+	}
+	s, ok := dirs[dir.Name]
+	if !ok {
+		s = &dirScan{}
+		dirs[dir.Name] = s
+	}
+	if s.done {
+		return
+	}
+	s.listed = time.Now()
+	s.lookups = 0
+}
+
+// lookup records the lookup of a child of the directory and starts prefetching
+// the directory once the lookups reach the threshold.
+func (p *scanPrefetcher) lookup(mountpoint string, dir *estargz.TOCEntry) {
+	p.mu.Lock()
+	s, ok := p.dirs[mountpoint][dir.Name]
+	if !ok || s.done || time.Since(s.listed) > scanWindow {
+		p.mu.Unlock()
+		return
+	}
+	s.lookups++
+	if s.lookups < p.threshold {
+		p.mu.Unlock()
+		return
+	}
+	s.done = true
+	p.mu.Unlock()
+
+	p.fs.layerMu.Lock()
+	l := p.fs.layer[mountpoint]
+	p.fs.layerMu.Unlock()
+	if l == nil {
+		return
+	}
+	// Use background task manager so that prioritized tasks aren't disturbed
+	// by the prefetch.
+	p.fs.backgroundTaskManager.InvokeBackgroundTask(func(ctx context.Context) {
+		n, err := p.prefetch(l, dir)
+		if err != nil {
+			log.G(ctx).WithError(err).Debugf("failed to prefetch scanned directory %q", dir.Name)
+			return
+		}
+		log.G(ctx).Debugf("prefetched %d small files in scanned directory %q", n, dir.Name)
+	}, scanPrefetchFetchTimeoutSec*time.Second)
+}
+
+// forget drops the scans of the layer unmounted from the mountpoint.
+func (p *scanPrefetcher) forget(mountpoint string) {
+	p.mu.Lock()
+	delete(p.dirs, mountpoint)
+	p.mu.Unlock()
+}
+
+// prefetch fetches the small files in the directory and caches their
+// uncompressed contents. This returns the number of the files.
+func (p *scanPrefetcher) prefetch(l *layer, dir *estargz.TOCEntry) (int, error) {
+	lr, err := l.reader()
+	if err != nil {
+		return 0, err
+	}
+	var files []*estargz.TOCEntry
+	names := make(map[string]struct{})
+	dir.ForeachChild(func(_ string, e *estargz.TOCEntry) bool {
+		// Only files stored in a chunk are targeted so the compressed range
+		// of each file is [Offset, NextOffset).
+		if e.Type == "reg" && e.Size > 0 && e.Size <= p.maxFileSize && e.ChunkSize == e.Size {
+			files = append(files, e)
+			names[e.Name] = struct{}{}
+		}
+		return true
+	})
+	if len(files) == 0 {
+		return 0, nil
+	}
+	for _, r := range scanRegions(files, scanMaxGap) {
+		if err := l.blob.Cache(r.b, r.e-r.b, remote.WithPhase(remote.PhasePrefetch)); err != nil {
+			return 0, err
+		}
+	}
+	if err := lr.Cache(reader.WithFilter(func(e *estargz.TOCEntry) bool {
+		_, ok := names[e.Name]
+		return ok
+	})); err != nil {
+		return 0, err
+	}
+	return len(files), nil
+}
+
+// scanRegion is a range [b, e) of the blob.
+type scanRegion struct {
+	b, e int64
+}
+
+// scanRegions merges the compressed ranges of the files into regions. Ranges
+// separated by up to maxGap bytes are merged.
+func scanRegions(files []*estargz.TOCEntry, maxGap int64) (regions []scanRegion) {
+	sort.Slice(files, func(i, j int) bool { return files[i].Offset < files[j].Offset })
+	for _, e := range files {
+		if n := len(regions); n > 0 && e.Offset-regions[n-1].e <= maxGap {
+			if end := e.NextOffset(); end > regions[n-1].e {
+				regions[n-1].e = end
+			}
+			continue
+		}
+		regions = append(regions, scanRegion{e.Offset, e.NextOffset()})
+	}
+	return regions
+}
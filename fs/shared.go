@@ -0,0 +1,141 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/containerd/stargz-snapshotter/fs/reader"
+	"golang.org/x/sync/singleflight"
+)
+
+// metadataPool holds the metadata (i.e. parsed TOC and node tree) of layers
+// keyed by the layer digest. A layer resolved more than once (e.g. pulled by
+// different references) shares the metadata instead of building the same tree
+// in memory again. The metadata is released when no layer refers to it.
+type metadataPool struct {
+	m  map[string]*sharedMetadata
+	mu sync.Mutex
+
+	// buildG deduplicates simultaneous builds of the metadata of the same layer
+	// so the TOC is fetched and parsed only once.
+	buildG singleflight.Group
+}
+
+type sharedMetadata struct {
+	digest string
+	vr     *reader.VerifiableReader
+	refcnt int
+	size   int64 // estimated memory usage of the metadata
+}
+
+func newMetadataPool() *metadataPool {
+	return &metadataPool{m: make(map[string]*sharedMetadata)}
+}
+
+// acquire returns the metadata of the layer. If the metadata isn't in the pool,
+// it's built by the specified function. The returned bool reports whether the
+// metadata was already in the pool. The metadata must be released by release.
+func (p *metadataPool) acquire(digest string, build func() (*reader.VerifiableReader, error)) (*sharedMetadata, bool, error) {
+	p.mu.Lock()
+	if sm, ok := p.m[digest]; ok {
+		sm.refcnt++
+		p.mu.Unlock()
+		return sm, true, nil
+	}
+	p.mu.Unlock()
+
+	// Build the metadata without the lock. Simultaneous acquisitions of the same
+	// layer wait for the single build. Only the caller which ran the build gets
+	// the metadata as not shared.
+	var built *reader.VerifiableReader
+	v, err, _ := p.buildG.Do(digest, func() (interface{}, error) {
+		vr, err := build()
+		if err != nil {
+			return nil, err
+		}
+		built = vr
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if sm, ok := p.m[digest]; ok {
+			return sm, nil
+		}
+		sm := &sharedMetadata{digest: digest, vr: vr, size: vr.MetadataSize()}
+		p.m[digest] = sm
+		return sm, nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	sm := v.(*sharedMetadata)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sm.refcnt++
+	return sm, built == nil || built != sm.vr, nil
+}
+
+func (p *metadataPool) release(sm *sharedMetadata) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sm.refcnt--
+	if sm.refcnt <= 0 && p.m[sm.digest] == sm {
+		delete(p.m, sm.digest)
+	}
+}
+
+// forget removes the metadata from the pool so that the next acquire builds it
+// again. Layers which already refer to the metadata can still use it.
+func (p *metadataPool) forget(digest string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.m, digest)
+}
+
+// stats returns the estimated memory usage of the metadata in the pool per
+// layer.
+func (p *metadataPool) stats() (total int64, layers []LayerMemoryStats) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, sm := range p.m {
+		total += sm.size
+		layers = append(layers, LayerMemoryStats{Digest: sm.digest, Metadata: sm.size, Refs: sm.refcnt})
+	}
+	return total, layers
+}
+
+func (p *metadataPool) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.m)
+}
+
+// acquire increments the number of references to the layer, which are held by
+// the resolution result cache and mountpoints.
+func (l *layer) acquire() {
+	atomic.AddInt32(&l.refcnt, 1)
+}
+
+// release decrements the number of references to the layer. When no one refers
+// to the layer, the shared metadata is released. The layer itself is still
+// usable after that because it holds the metadata; this only stops sharing it
+// with layers resolved later.
+func (l *layer) release() {
+	if atomic.AddInt32(&l.refcnt, -1) == 0 && l.onRelease != nil {
+		l.releaseOnce.Do(l.onRelease)
+	}
+}
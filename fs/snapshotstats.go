@@ -0,0 +1,118 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// SnapshotStats is the statistics of reads on the layers of a snapshot, which
+// shows how warm the cache of this node is for the image (e.g. for schedulers
+// preferring nodes with warm caches).
+type SnapshotStats struct {
+	Layers      []LayerStats `json:"layers"`
+	Size        int64        `json:"size"`
+	FetchedSize int64        `json:"fetchedSize"`
+
+	// CacheHits and CacheMisses are the numbers of chunks read from the cache
+	// and fetched on demand since the layers were mounted.
+	CacheHits    int64   `json:"cacheHits"`
+	CacheMisses  int64   `json:"cacheMisses"`
+	CacheHitRate float64 `json:"cacheHitRate"` // CacheHits / (CacheHits + CacheMisses)
+
+	// Window is the duration until now in which the following on-demand
+	// fetches are aggregated.
+	Window          time.Duration `json:"window"`
+	OnDemandFetches int           `json:"onDemandFetches"`
+	OnDemandSize    int64         `json:"onDemandSize"`
+	LatencyP50      time.Duration `json:"latencyP50"`
+	LatencyP90      time.Duration `json:"latencyP90"`
+	LatencyP99      time.Duration `json:"latencyP99"`
+}
+
+// LayerStats is the statistics of reads on a layer mounted on a mountpoint.
+type LayerStats struct {
+	LayerProgress
+	CacheHits     int64 `json:"cacheHits"`
+	CacheHitSize  int64 `json:"cacheHitSize"`
+	CacheMisses   int64 `json:"cacheMisses"`
+	CacheMissSize int64 `json:"cacheMissSize"`
+}
+
+// SnapshotStatsReporter reports the statistics of reads on the layers of a
+// snapshot. The filesystem returned by NewFilesystem implements this interface.
+type SnapshotStatsReporter interface {
+	SnapshotStats(ctx context.Context, mountpoints []string, window time.Duration) SnapshotStats
+}
+
+var _ = (SnapshotStatsReporter)((*filesystem)(nil))
+
+// SnapshotStats returns the statistics of the layers mounted on the
+// mountpoints. On-demand fetches in the window until now are aggregated.
+// Mountpoints where no layer is mounted are ignored.
+func (fs *filesystem) SnapshotStats(ctx context.Context, mountpoints []string, window time.Duration) SnapshotStats {
+	res := SnapshotStats{Window: window}
+	var latencies []time.Duration
+	for _, l := range fs.FetchLog(ctx, mountpoints, time.Now().Add(-window)) {
+		res.Size += l.Size
+		res.FetchedSize += l.FetchedSize
+		for _, r := range l.Records {
+			res.OnDemandFetches++
+			res.OnDemandSize += r.Size
+			latencies = append(latencies, r.Latency)
+		}
+	}
+	fs.layerMu.Lock()
+	for _, mp := range mountpoints {
+		l, ok := fs.layer[mp]
+		if !ok {
+			continue
+		}
+		ls := LayerStats{LayerProgress: l.progress.get()}
+		ls.Mountpoint = mp
+		ls.Digest = l.desc.Digest.String()
+		ls.Materialized = l.isMaterialized()
+		ls.CacheHits, ls.CacheHitSize, ls.CacheMisses, ls.CacheMissSize = l.fetchLog.counts()
+		res.CacheHits += ls.CacheHits
+		res.CacheMisses += ls.CacheMisses
+		res.Layers = append(res.Layers, ls)
+	}
+	fs.layerMu.Unlock()
+	if total := res.CacheHits + res.CacheMisses; total > 0 {
+		res.CacheHitRate = float64(res.CacheHits) / float64(total)
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	res.LatencyP50 = percentile(latencies, 50)
+	res.LatencyP90 = percentile(latencies, 90)
+	res.LatencyP99 = percentile(latencies, 99)
+	return res
+}
+
+// percentile returns the p-th percentile of the sorted durations with the
+// nearest-rank method. This returns zero if d is empty.
+func percentile(d []time.Duration, p int) time.Duration {
+	if len(d) == 0 {
+		return 0
+	}
+	rank := (len(d)*p + 99) / 100 // ceil(len(d) * p / 100)
+	if rank < 1 {
+		rank = 1
+	}
+	return d[rank-1]
+}
@@ -0,0 +1,117 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package example is an example of source providers maintained outside of
+// this repository. This provider serves blobs from a local directory laid out
+// in the same way as the "blobs" directory of OCI image layouts
+// (<root>/<algorithm>/<encoded digest>). Importing this package registers the
+// provider as "example-dir" and it can be enabled by the configuration of the
+// snapshotter:
+//
+//	source_providers = ["example-dir", "cri", "default"]
+//	[source_provider_config.example-dir]
+//	root = "/var/lib/blobs"
+package example
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Name is the name of this provider.
+const Name = "example-dir"
+
+func init() {
+	source.Register(Name, NewProvider)
+}
+
+// NewProvider returns a provider serving blobs under the directory specified
+// by "root" in the configuration. Image information is taken from the default
+// labels.
+func NewProvider(cfg source.ProviderConfig) (source.GetSources, error) {
+	root := cfg.Config["root"]
+	if root == "" {
+		return nil, fmt.Errorf("root directory must be specified")
+	}
+	getSources := source.FromDefaultLabels(cfg.Hosts)
+	return func(labels map[string]string) ([]source.Source, error) {
+		src, err := getSources(labels)
+		if err != nil {
+			return nil, err
+		}
+		for i := range src {
+			// Fail early so that the next provider is consulted for blobs
+			// which don't exist in the directory.
+			if _, err := os.Stat(blobPath(root, src[i].Target)); err != nil {
+				return nil, err
+			}
+			src[i].Fetcher = func(ctx context.Context, desc ocispec.Descriptor) (source.Fetcher, error) {
+				return openFetcher(blobPath(root, desc))
+			}
+		}
+		return src, nil
+	}, nil
+}
+
+func blobPath(root string, desc ocispec.Descriptor) string {
+	return filepath.Join(root, desc.Digest.Algorithm().String(), desc.Digest.Encoded())
+}
+
+// fetcher opens the file on each fetch because blobs don't notify fetchers
+// when they are no longer used.
+type fetcher struct {
+	path string
+	size int64
+}
+
+func openFetcher(path string) (*fetcher, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return &fetcher{path: path, size: fi.Size()}, nil
+}
+
+func (f *fetcher) Size() int64 {
+	return f.size
+}
+
+func (f *fetcher) Fetch(ctx context.Context, offset, size int64) (io.ReadCloser, error) {
+	if offset < 0 || offset+size > f.size {
+		return nil, fmt.Errorf("region [%d, %d) is out of the blob of size %d", offset, offset+size, f.size)
+	}
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, err
+	}
+	return &readCloser{io.NewSectionReader(file, offset, size), file}, nil
+}
+
+func (f *fetcher) Check() error {
+	_, err := os.Stat(f.path)
+	return err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,87 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package example
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/cache"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/remote"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// TestProvider tests the provider is registered and blobs are read through it.
+func TestProvider(t *testing.T) {
+	root, err := ioutil.TempDir("", "test-example-dir")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	dgst := digest.FromBytes(data)
+	if err := os.MkdirAll(filepath.Join(root, "sha256"), 0755); err != nil {
+		t.Fatalf("failed to create blobs dir: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "sha256", dgst.Encoded()), data, 0644); err != nil {
+		t.Fatalf("failed to write blob: %v", err)
+	}
+
+	getSources, err := source.FromProviders([]string{Name, source.DefaultProvider}, nil,
+		map[string]map[string]string{Name: {"root": root}})
+	if err != nil {
+		t.Fatalf("failed to initialize providers: %v", err)
+	}
+	labels := map[string]string{
+		"containerd.io/snapshot/remote/stargz.reference": "example.test/foo:latest",
+		"containerd.io/snapshot/remote/stargz.digest":    dgst.String(),
+	}
+	src, err := getSources(labels)
+	if err != nil {
+		t.Fatalf("failed to get sources: %v", err)
+	}
+	if len(src) != 1 || src[0].Fetcher == nil {
+		t.Fatalf("unexpected sources %+v", src)
+	}
+	r := remote.NewResolver(cache.NewMemoryCache(), config.BlobConfig{ChunkSize: 4096})
+	blob, err := r.ResolveFetcher(context.Background(), src[0].Fetcher, src[0].Target)
+	if err != nil {
+		t.Fatalf("failed to resolve blob: %v", err)
+	}
+	if blob.Size() != int64(len(data)) {
+		t.Errorf("size = %d; want %d", blob.Size(), len(data))
+	}
+	p := make([]byte, 5000)
+	if n, err := blob.ReadAt(p, 3000); err != nil || !bytes.Equal(p[:n], data[3000:8000]) {
+		t.Errorf("failed to read blob: %d bytes, %v", n, err)
+	}
+	if err := blob.Check(); err != nil {
+		t.Errorf("failed to check blob: %v", err)
+	}
+
+	// Blobs which aren't in the directory are provided by the next provider.
+	labels["containerd.io/snapshot/remote/stargz.digest"] = digest.FromString("missing").String()
+	if src, err = getSources(labels); err != nil || len(src) != 1 || src[0].Fetcher != nil {
+		t.Errorf("unexpected sources of missing blob %+v: %v", src, err)
+	}
+}
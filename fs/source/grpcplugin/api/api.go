@@ -0,0 +1,23 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package api contains the gRPC protocol between the snapshotter and blob
+// source plugins defined in blobsource.proto. blobsource.pb.go is generated
+// from it by "make generate".
+package api
+
+// ProtocolVersion is the version of this protocol exchanged on handshake.
+const ProtocolVersion = "v1"
@@ -0,0 +1,219 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package grpcplugin provides source providers backed by blob source plugins
+// running as separate processes. The snapshotter talks to plugins over a unix
+// socket with the gRPC protocol defined in the api package.
+package grpcplugin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/containerd/stargz-snapshotter/fs/source/grpcplugin/api"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const requestTimeout = 10 * time.Second
+
+// NewProviderFunc returns a function initializing the source provider backed
+// by the plugin listening on the unix socket. The plugin doesn't need to be
+// running at the initialization; the connection is established on demand.
+func NewProviderFunc(address string) source.NewProviderFunc {
+	return func(cfg source.ProviderConfig) (source.GetSources, error) {
+		conn, err := grpc.Dial(address,
+			grpc.WithInsecure(),
+			grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+			}),
+		)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to dial plugin %q", address)
+		}
+		p := &plugin{
+			address: address,
+			client:  api.NewBlobSourceClient(conn),
+			health:  grpc_health_v1.NewHealthClient(conn),
+		}
+		return p.getSources, nil
+	}
+}
+
+type plugin struct {
+	address string
+	client  api.BlobSourceClient
+	health  grpc_health_v1.HealthClient
+
+	handshaked   bool
+	handshakedMu sync.Mutex
+}
+
+// handshake negotiates the protocol version with the plugin once.
+func (p *plugin) handshake(ctx context.Context) error {
+	p.handshakedMu.Lock()
+	defer p.handshakedMu.Unlock()
+	if p.handshaked {
+		return nil
+	}
+	res, err := p.client.Handshake(ctx, &api.HandshakeRequest{ProtocolVersion: api.ProtocolVersion})
+	if err != nil {
+		return errors.Wrapf(err, "failed to handshake with plugin %q", p.address)
+	}
+	if res.ProtocolVersion != api.ProtocolVersion {
+		return fmt.Errorf("plugin %q (%s) speaks protocol %q; want %q",
+			p.address, res.Name, res.ProtocolVersion, api.ProtocolVersion)
+	}
+	p.handshaked = true
+	return nil
+}
+
+func (p *plugin) getSources(labels map[string]string) ([]source.Source, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	if err := p.handshake(ctx); err != nil {
+		return nil, err
+	}
+	res, err := p.client.GetSources(ctx, &api.GetSourcesRequest{Labels: labels})
+	if err != nil {
+		return nil, errors.Wrapf(errdefs.FromGRPC(err), "failed to get sources from plugin %q", p.address)
+	}
+	var src []source.Source
+	for _, s := range res.Sources {
+		refspec, err := reference.Parse(s.Reference)
+		if err != nil {
+			return nil, err
+		}
+		target, err := digest.Parse(s.Digest)
+		if err != nil {
+			return nil, err
+		}
+		layers := []ocispec.Descriptor{{Digest: target}}
+		for _, l := range s.Layers {
+			d, err := digest.Parse(l)
+			if err != nil {
+				return nil, err
+			}
+			if d != target {
+				layers = append(layers, ocispec.Descriptor{Digest: d})
+			}
+		}
+		ref := s.Reference
+		src = append(src, source.Source{
+			Name:     refspec,
+			Target:   ocispec.Descriptor{Digest: target},
+			Manifest: ocispec.Manifest{Layers: layers},
+			Fetcher: func(ctx context.Context, desc ocispec.Descriptor) (source.Fetcher, error) {
+				return p.fetcher(ctx, ref, desc.Digest)
+			},
+		})
+	}
+	if len(src) == 0 {
+		return nil, fmt.Errorf("plugin %q returned no source", p.address)
+	}
+	return src, nil
+}
+
+func (p *plugin) fetcher(ctx context.Context, ref string, dgst digest.Digest) (source.Fetcher, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	if err := p.handshake(ctx); err != nil {
+		return nil, err
+	}
+	res, err := p.client.Stat(ctx, &api.StatRequest{Reference: ref, Digest: dgst.String()})
+	if err != nil {
+		return nil, errors.Wrapf(errdefs.FromGRPC(err), "failed to stat blob %q", dgst)
+	}
+	return &fetcher{p: p, ref: ref, dgst: dgst, size: res.Size}, nil
+}
+
+type fetcher struct {
+	p    *plugin
+	ref  string
+	dgst digest.Digest
+	size int64
+}
+
+func (f *fetcher) Size() int64 {
+	return f.size
+}
+
+func (f *fetcher) Fetch(ctx context.Context, offset, size int64) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := f.p.client.Read(ctx, &api.ReadRequest{
+		Reference: f.ref,
+		Digest:    f.dgst.String(),
+		Offset:    offset,
+		Length:    size,
+	})
+	if err != nil {
+		cancel()
+		return nil, errors.Wrapf(errdefs.FromGRPC(err), "failed to read blob %q", f.dgst)
+	}
+	return &streamReader{stream: stream, cancel: cancel}, nil
+}
+
+// Check checks the plugin is serving with the gRPC health checking protocol.
+func (f *fetcher) Check() error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	res, err := f.p.health.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	if err != nil {
+		return errors.Wrapf(err, "failed to check plugin %q", f.p.address)
+	}
+	if res.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+		return fmt.Errorf("plugin %q isn't serving: %v", f.p.address, res.Status)
+	}
+	return nil
+}
+
+// streamReader reads the data streamed by Read calls.
+type streamReader struct {
+	stream api.BlobSource_ReadClient
+	cancel context.CancelFunc
+	buf    []byte
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		res, err := r.stream.Recv()
+		if err != nil {
+			if err != io.EOF {
+				err = errdefs.FromGRPC(err)
+			}
+			return 0, err
+		}
+		r.buf = res.Data
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *streamReader) Close() error {
+	r.cancel()
+	return nil
+}
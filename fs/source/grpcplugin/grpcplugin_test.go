@@ -0,0 +1,131 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package grpcplugin
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/stargz-snapshotter/cache"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/remote"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/containerd/stargz-snapshotter/fs/source/grpcplugin/api"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+const testRef = "example.test/foo:latest"
+
+type testPlugin map[digest.Digest][]byte
+
+func (p testPlugin) GetSources(ctx context.Context, labels map[string]string) ([]*api.Source, error) {
+	d, ok := labels["test.digest"]
+	if !ok {
+		return nil, errors.Wrap(errdefs.ErrNotFound, "no test label")
+	}
+	return []*api.Source{{Reference: testRef, Digest: d, Layers: []string{d}}}, nil
+}
+
+func (p testPlugin) Open(ctx context.Context, ref string, dgst digest.Digest) (io.ReaderAt, int64, error) {
+	b, ok := p[dgst]
+	if !ok || ref != testRef {
+		return nil, 0, errors.Wrapf(errdefs.ErrNotFound, "blob %q", dgst)
+	}
+	return bytes.NewReader(b), int64(len(b)), nil
+}
+
+// TestPlugin tests blobs are read from a plugin over the gRPC protocol.
+func TestPlugin(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "test-grpcplugin")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	data := bytes.Repeat([]byte("0123456789"), 300000) // larger than a message
+	dgst := digest.FromBytes(data)
+
+	addr := filepath.Join(tempDir, "plugin.sock")
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	s := NewServer("test", testPlugin{dgst: data})
+	go s.Serve(l)
+	defer s.Stop()
+
+	getSources, err := NewProviderFunc(addr)(source.ProviderConfig{})
+	if err != nil {
+		t.Fatalf("failed to initialize provider: %v", err)
+	}
+	if _, err := getSources(map[string]string{}); !errdefs.IsNotFound(err) {
+		t.Errorf("labels not for the plugin must be rejected with not found: %v", err)
+	}
+	src, err := getSources(map[string]string{"test.digest": dgst.String()})
+	if err != nil {
+		t.Fatalf("failed to get sources: %v", err)
+	}
+	if len(src) != 1 || src[0].Name.String() != testRef || src[0].Target.Digest != dgst || src[0].Fetcher == nil {
+		t.Fatalf("unexpected sources %+v", src)
+	}
+	if _, err := src[0].Fetcher(context.Background(), src[0].Target); err != nil {
+		t.Fatalf("failed to get fetcher: %v", err)
+	}
+
+	r := remote.NewResolver(cache.NewMemoryCache(), config.BlobConfig{ChunkSize: 1 << 20})
+	blob, err := r.ResolveFetcher(context.Background(), src[0].Fetcher, src[0].Target)
+	if err != nil {
+		t.Fatalf("failed to resolve blob: %v", err)
+	}
+	if blob.Size() != int64(len(data)) {
+		t.Errorf("size = %d; want %d", blob.Size(), len(data))
+	}
+	p := make([]byte, 2500000)
+	if n, err := blob.ReadAt(p, 100); err != nil || !bytes.Equal(p[:n], data[100:100+len(p)]) {
+		t.Errorf("failed to read blob: %d bytes, %v", n, err)
+	}
+	if err := blob.Check(); err != nil {
+		t.Errorf("failed to check blob: %v", err)
+	}
+	s.Stop()
+	f, err := NewProviderFunc(addr)(source.ProviderConfig{})
+	if err != nil {
+		t.Fatalf("failed to initialize provider: %v", err)
+	}
+	if _, err := f(map[string]string{"test.digest": dgst.String()}); err == nil {
+		t.Errorf("stopped plugin must not provide sources")
+	}
+}
+
+// TestHandshake tests the plugin rejects unknown protocol versions.
+func TestHandshake(t *testing.T) {
+	s := &server{name: "test", p: testPlugin{}}
+	if _, err := s.Handshake(context.Background(), &api.HandshakeRequest{ProtocolVersion: "v0"}); err == nil {
+		t.Errorf("unknown protocol version must be rejected")
+	}
+	res, err := s.Handshake(context.Background(), &api.HandshakeRequest{ProtocolVersion: api.ProtocolVersion})
+	if err != nil || res.ProtocolVersion != api.ProtocolVersion || res.Name != "test" {
+		t.Errorf("unexpected handshake %+v: %v", res, err)
+	}
+}
@@ -0,0 +1,122 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package grpcplugin
+
+import (
+	"context"
+	"io"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/stargz-snapshotter/fs/source/grpcplugin/api"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// readChunkSize is the maximum size of data sent in a message of Read streams.
+const readChunkSize = 1 << 20
+
+// Plugin is a blob source implemented by plugins written in Go.
+type Plugin interface {
+
+	// GetSources converts snapshot labels into sources. This returns an error
+	// wrapping errdefs.ErrNotFound if the labels aren't for this plugin.
+	GetSources(ctx context.Context, labels map[string]string) ([]*api.Source, error)
+
+	// Open returns the contents and the size of the blob.
+	Open(ctx context.Context, ref string, dgst digest.Digest) (io.ReaderAt, int64, error)
+}
+
+// NewServer returns a gRPC server serving the plugin with the BlobSource and
+// the health checking services.
+func NewServer(name string, p Plugin) *grpc.Server {
+	s := grpc.NewServer()
+	api.RegisterBlobSourceServer(s, &server{name, p})
+	hs := health.NewServer()
+	hs.SetServingStatus("", grpc_health_v1.HealthCheckResponse_SERVING)
+	grpc_health_v1.RegisterHealthServer(s, hs)
+	return s
+}
+
+type server struct {
+	name string
+	p    Plugin
+}
+
+func (s *server) Handshake(ctx context.Context, req *api.HandshakeRequest) (*api.HandshakeResponse, error) {
+	if req.ProtocolVersion != api.ProtocolVersion {
+		return nil, errdefs.ToGRPC(errors.Wrapf(errdefs.ErrNotImplemented, "protocol %q isn't supported; only %q",
+			req.ProtocolVersion, api.ProtocolVersion))
+	}
+	return &api.HandshakeResponse{ProtocolVersion: api.ProtocolVersion, Name: s.name}, nil
+}
+
+func (s *server) GetSources(ctx context.Context, req *api.GetSourcesRequest) (*api.GetSourcesResponse, error) {
+	src, err := s.p.GetSources(ctx, req.Labels)
+	if err != nil {
+		return nil, errdefs.ToGRPC(err)
+	}
+	return &api.GetSourcesResponse{Sources: src}, nil
+}
+
+func (s *server) Stat(ctx context.Context, req *api.StatRequest) (*api.StatResponse, error) {
+	_, size, err := s.open(ctx, req.Reference, req.Digest)
+	if err != nil {
+		return nil, err
+	}
+	return &api.StatResponse{Size: size}, nil
+}
+
+func (s *server) Read(req *api.ReadRequest, stream api.BlobSource_ReadServer) error {
+	ra, size, err := s.open(stream.Context(), req.Reference, req.Digest)
+	if err != nil {
+		return err
+	}
+	if req.Offset < 0 || req.Length < 0 || req.Offset+req.Length > size {
+		return errdefs.ToGRPC(errors.Wrapf(errdefs.ErrInvalidArgument, "region [%d, %d) is out of the blob of size %d",
+			req.Offset, req.Offset+req.Length, size))
+	}
+	sr := io.NewSectionReader(ra, req.Offset, req.Length)
+	buf := make([]byte, readChunkSize)
+	for {
+		n, err := io.ReadFull(sr, buf)
+		if n > 0 {
+			if sErr := stream.Send(&api.ReadResponse{Data: buf[:n]}); sErr != nil {
+				return sErr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return errdefs.ToGRPC(err)
+		}
+	}
+}
+
+func (s *server) open(ctx context.Context, ref, dgstStr string) (io.ReaderAt, int64, error) {
+	dgst, err := digest.Parse(dgstStr)
+	if err != nil {
+		return nil, 0, errdefs.ToGRPC(errors.Wrapf(errdefs.ErrInvalidArgument, "%v", err))
+	}
+	ra, size, err := s.p.Open(ctx, ref, dgst)
+	if err != nil {
+		return nil, 0, errdefs.ToGRPC(err)
+	}
+	return ra, size, nil
+}
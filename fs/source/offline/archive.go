@@ -0,0 +1,310 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package offline
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// Export writes the image as a tar archive of an OCI image layout, which can be
+// imported to the cache by Import. The archive contains the manifests and the
+// configs of the image and the whole blobs of all layers, fetched by f. Only
+// manifests of platforms matching p are exported from the index.
+func Export(ctx context.Context, w io.Writer, f remotes.Fetcher, name string, target ocispec.Descriptor, p platforms.Matcher) error {
+	tw := tar.NewWriter(w)
+	layout, err := json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+	if err != nil {
+		return err
+	}
+	if err := writeFile(tw, ocispec.ImageLayoutFile, layout); err != nil {
+		return err
+	}
+	written := make(map[digest.Digest]bool)
+	var walk func(desc ocispec.Descriptor) error
+	walk = func(desc ocispec.Descriptor) error {
+		if written[desc.Digest] {
+			return nil
+		}
+		written[desc.Digest] = true
+		rc, err := f.Fetch(ctx, desc)
+		if err != nil {
+			return errors.Wrapf(err, "failed to fetch %q", desc.Digest)
+		}
+		defer rc.Close()
+		var children []ocispec.Descriptor
+		switch desc.MediaType {
+		case images.MediaTypeDockerSchema2Manifest, ocispec.MediaTypeImageManifest,
+			images.MediaTypeDockerSchema2ManifestList, ocispec.MediaTypeImageIndex:
+			data, err := ioutil.ReadAll(io.LimitReader(rc, desc.Size+1))
+			if err != nil {
+				return err
+			}
+			if children, err = manifestChildren(desc, data, p); err != nil {
+				return err
+			}
+			rc = ioutil.NopCloser(bytes.NewReader(data))
+		}
+		if err := writeBlob(tw, desc, rc); err != nil {
+			return err
+		}
+		for _, c := range children {
+			if err := walk(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(target); err != nil {
+		return err
+	}
+	target.Annotations = map[string]string{images.AnnotationImageName: name}
+	index, err := json.Marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []ocispec.Descriptor{target},
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeFile(tw, indexFile, index); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func manifestChildren(desc ocispec.Descriptor, data []byte, p platforms.Matcher) ([]ocispec.Descriptor, error) {
+	switch desc.MediaType {
+	case images.MediaTypeDockerSchema2ManifestList, ocispec.MediaTypeImageIndex:
+		var index ocispec.Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse index %q", desc.Digest)
+		}
+		var children []ocispec.Descriptor
+		for _, m := range index.Manifests {
+			if m.Platform == nil || p.Match(*m.Platform) {
+				children = append(children, m)
+			}
+		}
+		return children, nil
+	default:
+		var manifest ocispec.Manifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse manifest %q", desc.Digest)
+		}
+		return append([]ocispec.Descriptor{manifest.Config}, manifest.Layers...), nil
+	}
+}
+
+func writeFile(tw *tar.Writer, name string, data []byte) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+func writeBlob(tw *tar.Writer, desc ocispec.Descriptor, r io.Reader) error {
+	name := path.Join(blobsDir, desc.Digest.Algorithm().String(), desc.Digest.Encoded())
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0444, Size: desc.Size, Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+	verifier := desc.Digest.Verifier()
+	if n, err := io.Copy(tw, io.TeeReader(io.LimitReader(r, desc.Size), verifier)); err != nil {
+		return errors.Wrapf(err, "failed to write %q", desc.Digest)
+	} else if n != desc.Size {
+		return fmt.Errorf("size of %q is %d; want %d", desc.Digest, n, desc.Size)
+	}
+	if !verifier.Verified() {
+		return errors.Wrapf(errdefs.ErrFailedPrecondition, "digest of %q mismatches", desc.Digest)
+	}
+	return nil
+}
+
+// Import extracts the archive written by Export to the cache directory and
+// returns the names of the imported images. Blobs are verified with their
+// digests. Images of the same names in the cache are replaced.
+func Import(root string, r io.Reader) ([]string, error) {
+	var (
+		tr       = tar.NewReader(r)
+		imported ocispec.Index
+	)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Wrap(err, "failed to read archive")
+		}
+		name := path.Clean(h.Name)
+		switch {
+		case name == indexFile:
+			if err := json.NewDecoder(tr).Decode(&imported); err != nil {
+				return nil, errors.Wrap(err, "failed to parse index of archive")
+			}
+		case strings.HasPrefix(name, blobsDir+"/") && h.Typeflag == tar.TypeReg:
+			dgst, err := digest.Parse(strings.Replace(strings.TrimPrefix(name, blobsDir+"/"), "/", ":", 1))
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid blob %q in archive", h.Name)
+			}
+			if err := importBlob(root, dgst, tr); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	index, err := readIndex(root)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, m := range imported.Manifests {
+		name := m.Annotations[images.AnnotationImageName]
+		if name == "" {
+			continue
+		}
+		if _, err := os.Stat(BlobPath(root, m.Digest)); err != nil {
+			return nil, errors.Wrapf(err, "manifest of %q isn't in archive", name)
+		}
+		var ms []ocispec.Descriptor
+		for _, e := range index.Manifests {
+			if e.Annotations[images.AnnotationImageName] != name {
+				ms = append(ms, e)
+			}
+		}
+		index.Manifests = append(ms, m)
+		names = append(names, name)
+	}
+	if err := writeIndex(root, index); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+func importBlob(root string, dgst digest.Digest, r io.Reader) error {
+	p := BlobPath(root, dgst)
+	if _, err := os.Stat(p); err == nil {
+		return nil // already imported
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(p), "import")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	verifier := dgst.Verifier()
+	_, err = io.Copy(tmp, io.TeeReader(r, verifier))
+	if cErr := tmp.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to import %q", dgst)
+	}
+	if !verifier.Verified() {
+		return errors.Wrapf(errdefs.ErrFailedPrecondition, "digest of %q mismatches", dgst)
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func readIndex(root string) (index ocispec.Index, _ error) {
+	index.SchemaVersion = 2
+	data, err := ioutil.ReadFile(filepath.Join(root, indexFile))
+	if os.IsNotExist(err) {
+		return index, nil
+	} else if err != nil {
+		return index, err
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return index, errors.Wrap(err, "failed to parse index of cache")
+	}
+	return index, nil
+}
+
+func writeIndex(root string, index ocispec.Index) error {
+	layout, err := json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, ocispec.ImageLayoutFile), layout, 0600); err != nil {
+		return err
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(root, indexFile+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(root, indexFile))
+}
+
+// NewResolver returns a resolver of images in the cache. This is used for
+// pulling imported images into containerd without registries.
+func NewResolver(root string) remotes.Resolver {
+	return &resolver{root}
+}
+
+type resolver struct {
+	root string
+}
+
+func (r *resolver) Resolve(ctx context.Context, ref string) (string, ocispec.Descriptor, error) {
+	index, err := readIndex(r.root)
+	if err != nil {
+		return "", ocispec.Descriptor{}, err
+	}
+	for _, m := range index.Manifests {
+		if m.Annotations[images.AnnotationImageName] == ref {
+			return ref, m, nil
+		}
+	}
+	return "", ocispec.Descriptor{}, errors.Wrapf(errdefs.ErrNotFound, "image %q isn't in the offline cache", ref)
+}
+
+func (r *resolver) Fetcher(ctx context.Context, ref string) (remotes.Fetcher, error) {
+	return remotes.FetcherFunc(func(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+		f, err := os.Open(BlobPath(r.root, desc.Digest))
+		if os.IsNotExist(err) {
+			return nil, errors.Wrapf(errdefs.ErrNotFound, "blob %q isn't in the offline cache", desc.Digest)
+		}
+		return f, err
+	}), nil
+}
+
+func (r *resolver) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {
+	return nil, errors.Wrap(errdefs.ErrNotImplemented, "offline cache is read-only")
+}
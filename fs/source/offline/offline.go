@@ -0,0 +1,131 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package offline provides the pre-seeded cache of images for disconnected
+// sites. The cache is a directory laid out as an OCI image layout, which is
+// filled by importing archives exported on connected hosts. The source
+// provider registered as "offline" serves blobs exclusively from the cache
+// and never contacts registries:
+//
+//	source_providers = ["offline"]
+//	[source_provider_config.offline]
+//	root = "/var/lib/containerd-stargz-grpc/offline"
+package offline
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// Name is the name of this provider.
+const Name = "offline"
+
+const (
+	blobsDir  = "blobs"
+	indexFile = "index.json"
+)
+
+func init() {
+	source.Register(Name, NewProvider)
+}
+
+// NewProvider returns a provider serving blobs from the cache specified by
+// "root" in the configuration. Image information is taken from the default
+// labels. The registry configuration of the sources is replaced by Hosts so
+// that registries are never contacted for them.
+func NewProvider(cfg source.ProviderConfig) (source.GetSources, error) {
+	root := cfg.Config["root"]
+	if root == "" {
+		return nil, fmt.Errorf("root directory must be specified")
+	}
+	getSources := source.FromDefaultLabels(Hosts)
+	return func(labels map[string]string) ([]source.Source, error) {
+		src, err := getSources(labels)
+		if err != nil {
+			return nil, err
+		}
+		for i := range src {
+			if _, err := os.Stat(BlobPath(root, src[i].Target.Digest)); err != nil {
+				return nil, errors.Wrapf(errdefs.ErrNotFound, "layer %q isn't in the offline cache", src[i].Target.Digest)
+			}
+			src[i].Fetcher = func(ctx context.Context, desc ocispec.Descriptor) (source.Fetcher, error) {
+				return openFetcher(BlobPath(root, desc.Digest))
+			}
+		}
+		return src, nil
+	}, nil
+}
+
+// Hosts is the registry configuration of the offline mode, which fails for all
+// hosts.
+func Hosts(host string) ([]docker.RegistryHost, error) {
+	return nil, fmt.Errorf("registry %q can't be contacted in the offline mode", host)
+}
+
+// BlobPath returns the path of the blob in the cache.
+func BlobPath(root string, dgst digest.Digest) string {
+	return filepath.Join(root, blobsDir, dgst.Algorithm().String(), dgst.Encoded())
+}
+
+// fetcher opens the file on each fetch because blobs don't notify fetchers
+// when they are no longer used.
+type fetcher struct {
+	path string
+	size int64
+}
+
+func openFetcher(path string) (*fetcher, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return &fetcher{path: path, size: fi.Size()}, nil
+}
+
+func (f *fetcher) Size() int64 {
+	return f.size
+}
+
+func (f *fetcher) Fetch(ctx context.Context, offset, size int64) (io.ReadCloser, error) {
+	if offset < 0 || offset+size > f.size {
+		return nil, fmt.Errorf("region [%d, %d) is out of the blob of size %d", offset, offset+size, f.size)
+	}
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, err
+	}
+	return &readCloser{io.NewSectionReader(file, offset, size), file}, nil
+}
+
+func (f *fetcher) Check() error {
+	_, err := os.Stat(f.path)
+	return err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
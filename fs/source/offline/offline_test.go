@@ -0,0 +1,132 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package offline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// TestExportImport tests an exported image is imported to the cache and its
+// layers are provided without registries.
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	blobs := make(map[digest.Digest][]byte)
+	add := func(mediaType string, data []byte) ocispec.Descriptor {
+		blobs[digest.FromBytes(data)] = data
+		return ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(data), Size: int64(len(data))}
+	}
+	marshal := func(v interface{}) []byte {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("failed to marshal: %v", err)
+		}
+		return data
+	}
+	layer := add(ocispec.MediaTypeImageLayerGzip, bytes.Repeat([]byte("layer"), 1000))
+	manifest := add(ocispec.MediaTypeImageManifest, marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    add(ocispec.MediaTypeImageConfig, []byte("{}")),
+		Layers:    []ocispec.Descriptor{layer},
+	}))
+	other := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("other"), Size: 5,
+		Platform: &ocispec.Platform{OS: "other", Architecture: "other"}}
+	platform := platforms.DefaultSpec()
+	manifest.Platform = &platform
+	index := add(ocispec.MediaTypeImageIndex, marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []ocispec.Descriptor{manifest, other}, // other platforms aren't fetched
+	}))
+	f := remotes.FetcherFunc(func(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+		data, ok := blobs[desc.Digest]
+		if !ok {
+			return nil, errdefs.ErrNotFound
+		}
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	})
+	var archive bytes.Buffer
+	if err := Export(ctx, &archive, f, "example.test/foo:latest", index, platforms.Default()); err != nil {
+		t.Fatalf("failed to export: %v", err)
+	}
+
+	root, err := ioutil.TempDir("", "test-offline")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	names, err := Import(root, &archive)
+	if err != nil {
+		t.Fatalf("failed to import: %v", err)
+	}
+	if len(names) != 1 || names[0] != "example.test/foo:latest" {
+		t.Errorf("unexpected imported images %v", names)
+	}
+
+	r := NewResolver(root)
+	if _, desc, err := r.Resolve(ctx, "example.test/foo:latest"); err != nil || desc.Digest != index.Digest {
+		t.Errorf("failed to resolve %v: %v", desc, err)
+	}
+	if _, _, err := r.Resolve(ctx, "example.test/foo:missing"); !errdefs.IsNotFound(err) {
+		t.Errorf("missing image must not be resolved: %v", err)
+	}
+
+	getSources, err := source.FromProviders([]string{Name}, nil, map[string]map[string]string{Name: {"root": root}})
+	if err != nil {
+		t.Fatalf("failed to initialize provider: %v", err)
+	}
+	labels := map[string]string{
+		"containerd.io/snapshot/remote/stargz.reference": "example.test/foo:latest",
+		"containerd.io/snapshot/remote/stargz.digest":    layer.Digest.String(),
+	}
+	src, err := getSources(labels)
+	if err != nil || len(src) != 1 || src[0].Fetcher == nil {
+		t.Fatalf("unexpected sources %+v: %v", src, err)
+	}
+	if _, err := src[0].Hosts("example.test"); err == nil {
+		t.Errorf("registries must not be contacted in the offline mode")
+	}
+	sf, err := src[0].Fetcher(ctx, layer)
+	if err != nil {
+		t.Fatalf("failed to get fetcher: %v", err)
+	}
+	rc, err := sf.Fetch(ctx, 5, 10)
+	if err != nil {
+		t.Fatalf("failed to fetch: %v", err)
+	}
+	defer rc.Close()
+	if data, err := ioutil.ReadAll(rc); err != nil || !bytes.Equal(data, blobs[layer.Digest][5:15]) {
+		t.Errorf("unexpected contents %q: %v", string(data), err)
+	}
+
+	labels["containerd.io/snapshot/remote/stargz.digest"] = digest.FromString("missing").String()
+	if _, err := getSources(labels); err == nil {
+		t.Errorf("layers not in the cache must not be provided")
+	}
+}
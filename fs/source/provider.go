@@ -0,0 +1,119 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package source
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/hashicorp/go-multierror"
+)
+
+// DefaultProvider is the name of the provider which is registered by this
+// package and provides sources based on the default labels.
+const DefaultProvider = "default"
+
+// ProviderConfig is the configuration passed to providers on initialization.
+type ProviderConfig struct {
+
+	// Hosts is the registry configuration of the snapshotter.
+	Hosts docker.RegistryHosts
+
+	// Config is the provider-specific configuration which is passed through
+	// from the configuration file of the snapshotter.
+	Config map[string]string
+}
+
+// NewProviderFunc initializes a source provider. Providers return errors from
+// GetSources when the labels aren't for them so that the next provider is
+// consulted.
+type NewProviderFunc func(cfg ProviderConfig) (GetSources, error)
+
+var (
+	providers   = make(map[string]NewProviderFunc)
+	providersMu sync.Mutex
+)
+
+func init() {
+	Register(DefaultProvider, func(cfg ProviderConfig) (GetSources, error) {
+		return FromDefaultLabels(cfg.Hosts), nil
+	})
+}
+
+// Register makes a source provider available by the name. This is intended to
+// be called from init functions of provider packages so that downstream
+// builds can add blob sources by importing them. Register panics if the name
+// is already registered.
+func Register(name string, f NewProviderFunc) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	if _, ok := providers[name]; ok {
+		panic(fmt.Sprintf("source provider %q is already registered", name))
+	}
+	providers[name] = f
+}
+
+// Providers returns the sorted names of registered providers.
+func Providers() (names []string) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// NewProvider initializes the registered provider of the name.
+func NewProvider(name string, cfg ProviderConfig) (GetSources, error) {
+	providersMu.Lock()
+	f, ok := providers[name]
+	providersMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("source provider %q isn't registered", name)
+	}
+	return f(cfg)
+}
+
+// FromProviders initializes the named providers and returns a function which
+// consults them in order and returns the sources of the first one succeeded.
+// cfgs is the provider-specific configuration keyed by provider names.
+func FromProviders(names []string, hosts docker.RegistryHosts, cfgs map[string]map[string]string) (GetSources, error) {
+	var ps []GetSources
+	for _, name := range names {
+		p, err := NewProvider(name, ProviderConfig{Hosts: hosts, Config: cfgs[name]})
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, p)
+	}
+	return func(labels map[string]string) (source []Source, allErr error) {
+		for _, p := range ps {
+			src, err := p(labels)
+			if err == nil {
+				return src, nil
+			}
+			allErr = multierror.Append(allErr, err)
+		}
+		if allErr == nil {
+			allErr = fmt.Errorf("no source provider is configured")
+		}
+		return
+	}, nil
+}
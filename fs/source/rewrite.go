@@ -0,0 +1,109 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package source
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/containerd/containerd/reference"
+)
+
+// RewriteRule rewrites repositories of image references before they are
+// resolved (e.g. for pulling images through a pull-through cache).
+type RewriteRule struct {
+	// From is the repository to be rewritten (e.g. "docker.io/library/ubuntu")
+	// or a namespace with the trailing "/*" (e.g. "docker.io/*"), which
+	// matches all repositories under it.
+	From string
+
+	// To is the repository or the namespace replacing From. Repositories
+	// matching a namespace keep the path under the namespace (e.g.
+	// "docker.io/library/ubuntu" is rewritten to "proxy.example.com/dockerhub/library/ubuntu"
+	// by the rule from "docker.io/*" to "proxy.example.com/dockerhub").
+	To string
+
+	// Fallback keeps the original reference as the source tried after the
+	// rewritten one fails.
+	Fallback bool
+}
+
+// WithRewriteRules returns GetSources which rewrites the references of the
+// sources returned by getSources. When several rules match a repository, the
+// most specific one (i.e. with the longest From) is used, so rules for
+// namespaces can override the rules for the whole registry. A rule rewriting
+// a repository to itself excludes it from the other rules.
+func WithRewriteRules(getSources GetSources, rules []RewriteRule) (GetSources, error) {
+	for _, r := range rules {
+		if strings.TrimSuffix(r.From, "/*") == "" || strings.TrimSuffix(r.To, "/*") == "" {
+			return nil, fmt.Errorf("invalid rewrite rule from %q to %q", r.From, r.To)
+		}
+	}
+	return func(labels map[string]string) ([]Source, error) {
+		srcs, err := getSources(labels)
+		if err != nil {
+			return nil, err
+		}
+		var res []Source
+		for _, s := range srcs {
+			name, rule, ok := rewriteRef(s.Name, rules)
+			if !ok {
+				res = append(res, s)
+				continue
+			}
+			rs := s
+			rs.Name = name
+			res = append(res, rs)
+			if rule.Fallback {
+				res = append(res, s)
+			}
+		}
+		return res, nil
+	}, nil
+}
+
+// rewriteRef rewrites the reference with the most specific rule matching it.
+func rewriteRef(ref reference.Spec, rules []RewriteRule) (reference.Spec, RewriteRule, bool) {
+	var (
+		match   RewriteRule
+		matched = -1
+		rest    string
+	)
+	for _, r := range rules {
+		from := strings.TrimSuffix(r.From, "/*")
+		var p string
+		if strings.HasSuffix(r.From, "/*") {
+			if !strings.HasPrefix(ref.Locator, from+"/") {
+				continue
+			}
+			p = strings.TrimPrefix(ref.Locator, from)
+		} else if ref.Locator != from {
+			continue
+		}
+		if len(from) > matched {
+			match, matched, rest = r, len(from), p
+		}
+	}
+	if matched < 0 {
+		return ref, RewriteRule{}, false
+	}
+	locator := strings.TrimSuffix(match.To, "/*") + rest
+	if locator == ref.Locator {
+		return ref, RewriteRule{}, false
+	}
+	return reference.Spec{Locator: locator, Object: ref.Object}, match, true
+}
@@ -0,0 +1,79 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package source
+
+import (
+	"testing"
+
+	"github.com/containerd/containerd/reference"
+)
+
+func TestWithRewriteRules(t *testing.T) {
+	rules := []RewriteRule{
+		{From: "docker.io/*", To: "proxy.example.com/dockerhub"},
+		{From: "docker.io/myorg/*", To: "docker.io/myorg"},
+		{From: "docker.io/library/ubuntu", To: "mirror.example.com/ubuntu", Fallback: true},
+		{From: "ghcr.io/team/*", To: "proxy.example.com/ghcr/team"},
+	}
+	for ref, want := range map[string][]string{
+		"docker.io/library/alpine:3.12":               {"proxy.example.com/dockerhub/library/alpine:3.12"},
+		"docker.io/library/ubuntu@sha256:" + dgst:     {"mirror.example.com/ubuntu@sha256:" + dgst, "docker.io/library/ubuntu@sha256:" + dgst},
+		"docker.io/library/ubuntu-debootstrap:latest": {"proxy.example.com/dockerhub/library/ubuntu-debootstrap:latest"},
+		"docker.io/myorg/app:1.0":                     {"docker.io/myorg/app:1.0"},
+		"ghcr.io/team/app:1.0":                        {"proxy.example.com/ghcr/team/app:1.0"},
+		"ghcr.io/teammate/app:1.0":                    {"ghcr.io/teammate/app:1.0"},
+	} {
+		name, err := reference.Parse(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		getSources, err := WithRewriteRules(func(map[string]string) ([]Source, error) {
+			return []Source{{Name: name}}, nil
+		}, rules)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srcs, err := getSources(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, s := range srcs {
+			got = append(got, s.Name.String())
+		}
+		if len(got) != len(want) {
+			t.Errorf("%q: got %v; want %v", ref, got, want)
+			continue
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Errorf("%q: got %v; want %v", ref, got, want)
+				break
+			}
+		}
+	}
+}
+
+func TestInvalidRewriteRules(t *testing.T) {
+	for _, r := range []RewriteRule{{From: "/*", To: "example.com"}, {From: "docker.io/*", To: ""}} {
+		if _, err := WithRewriteRules(nil, []RewriteRule{r}); err == nil {
+			t.Errorf("rule %+v must be invalid", r)
+		}
+	}
+}
+
+const dgst = "2a2b1f4e3a8d1a4bb7d7d56b7e4b0f6bd8ef3b08c6f0e1b7d1c3e38c0f4a6a1e"
@@ -19,6 +19,7 @@ package source
 import (
 	"context"
 	"fmt"
+	"io"
 	"strings"
 
 	"github.com/containerd/containerd/images"
@@ -55,6 +56,32 @@ type Source struct {
 	// the manifest.
 	// Currently, only layer digests (Manifest.Layers.Digest) will be used.
 	Manifest ocispec.Manifest
+
+	// Fetcher fetches blobs of this source from somewhere other than the
+	// registries in Hosts. This is optional and nil means blobs are fetched
+	// from the registries.
+	Fetcher FetcherFunc
+}
+
+// FetcherFunc returns a fetcher of the blob specified by the descriptor. This is
+// called for the target blob and for the other blobs in the manifest.
+type FetcherFunc func(ctx context.Context, desc ocispec.Descriptor) (Fetcher, error)
+
+// Fetcher fetches contents of a blob. Implementations must be safe for
+// concurrent use.
+type Fetcher interface {
+
+	// Size returns the size of the blob.
+	Size() int64
+
+	// Fetch returns a reader of the region [offset, offset+size) of the blob.
+	Fetch(ctx context.Context, offset, size int64) (io.ReadCloser, error)
+
+	// Check checks the blob is still available. This is called periodically
+	// and implementations should re-establish the connection to the blob if
+	// needed because blobs fetched by Fetcher are never refreshed by the
+	// filesystem.
+	Check() error
 }
 
 const (
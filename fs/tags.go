@@ -0,0 +1,207 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// defaultTagDriftCheckIntervalSec is the default interval of checking tags of
+// mounted images.
+const defaultTagDriftCheckIntervalSec = 600
+
+// TagPin is the digest pinned for an image mounted by tag.
+type TagPin struct {
+	Ref    string `json:"ref"`
+	Pinned string `json:"pinned"` // manifest digest resolved on the first mount
+
+	// Current is the digest the tag was resolved to on the last check. The
+	// tag has moved upstream (Drifted) if this differs from Pinned. DriftedAt
+	// is when the tag was found to be moved to Current.
+	Current   string    `json:"current,omitempty"`
+	Drifted   bool      `json:"drifted"`
+	CheckedAt time.Time `json:"checkedAt,omitempty"`
+	DriftedAt time.Time `json:"driftedAt,omitempty"`
+	Mounts    int       `json:"mounts"`
+}
+
+// TagPinReporter reports digests pinned for images mounted by tag. The
+// filesystem returned by NewFilesystem implements this interface.
+type TagPinReporter interface {
+	TagPins(ctx context.Context) []TagPin
+}
+
+var _ = (TagPinReporter)((*filesystem)(nil))
+
+// TagPins returns digests pinned for images mounted by tag. This is empty
+// unless `pin_tag_digest` is enabled.
+func (fs *filesystem) TagPins(ctx context.Context) []TagPin {
+	if fs.tagPins == nil {
+		return []TagPin{}
+	}
+	return fs.tagPins.list()
+}
+
+type resolveFunc func(ctx context.Context, hosts docker.RegistryHosts, ref string) (digest.Digest, error)
+
+func resolveManifest(ctx context.Context, hosts docker.RegistryHosts, ref string) (digest.Digest, error) {
+	_, desc, err := docker.NewResolver(docker.ResolverOptions{Hosts: hosts}).Resolve(ctx, ref)
+	if err != nil {
+		return "", err
+	}
+	return desc.Digest, nil
+}
+
+type tagPin struct {
+	TagPin
+	hosts  docker.RegistryHosts
+	mounts map[string]struct{}
+}
+
+// tagPinner pins the manifest digest of each image mounted by tag on its first
+// mount and periodically resolves the tag again to detect it has moved
+// upstream. Contents of mounted layers never change on drift because layers
+// are fetched by their digests; the drift is only reported so that operators
+// can roll out the new image explicitly.
+type tagPinner struct {
+	pins      map[string]*tagPin // ref -> pin
+	mu        sync.Mutex
+	resolve   resolveFunc
+	now       func() time.Time
+	mountRefs map[string]string // mountpoint -> ref
+}
+
+func newTagPinner(resolve resolveFunc) *tagPinner {
+	return &tagPinner{
+		pins:      make(map[string]*tagPin),
+		resolve:   resolve,
+		now:       time.Now,
+		mountRefs: make(map[string]string),
+	}
+}
+
+// add registers the mountpoint of a layer of the image. The digest is pinned in
+// background if this is the first mount of the image. Images referred by
+// digests are ignored.
+func (tp *tagPinner) add(ctx context.Context, mountpoint string, src source.Source) {
+	if !isTagged(src.Name) {
+		return
+	}
+	ref := src.Name.String()
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	tp.mountRefs[mountpoint] = ref
+	if p, ok := tp.pins[ref]; ok {
+		p.mounts[mountpoint] = struct{}{}
+		return
+	}
+	p := &tagPin{
+		TagPin: TagPin{Ref: ref},
+		hosts:  src.Hosts,
+		mounts: map[string]struct{}{mountpoint: {}},
+	}
+	tp.pins[ref] = p
+	go tp.check(log.WithLogger(context.Background(), log.G(ctx).WithField("ref", ref)), p)
+}
+
+// remove unregisters the mountpoint. The pin is dropped when all layers of the
+// image are unmounted.
+func (tp *tagPinner) remove(mountpoint string) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	ref, ok := tp.mountRefs[mountpoint]
+	if !ok {
+		return
+	}
+	delete(tp.mountRefs, mountpoint)
+	if p, ok := tp.pins[ref]; ok {
+		delete(p.mounts, mountpoint)
+		if len(p.mounts) == 0 {
+			delete(tp.pins, ref)
+		}
+	}
+}
+
+// check resolves the tag and pins the digest or compares with the pinned one.
+func (tp *tagPinner) check(ctx context.Context, p *tagPin) {
+	tp.mu.Lock()
+	ref, hosts := p.Ref, p.hosts
+	tp.mu.Unlock()
+	dgst, err := tp.resolve(ctx, hosts, ref)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to resolve tag of mounted image")
+		return
+	}
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	p.CheckedAt = tp.now()
+	if p.Pinned == "" {
+		p.Pinned = dgst.String()
+		log.G(ctx).WithField("digest", p.Pinned).Debug("pinned digest of tag")
+	}
+	p.Drifted = dgst.String() != p.Pinned
+	if p.Drifted && p.Current != dgst.String() {
+		p.DriftedAt = p.CheckedAt
+		log.G(ctx).WithField("pinned", p.Pinned).WithField("current", dgst.String()).
+			Warn("tag of mounted image has moved upstream; mounted contents are kept pinned")
+	}
+	p.Current = dgst.String()
+}
+
+// run checks all pinned tags at the interval.
+func (tp *tagPinner) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		tp.mu.Lock()
+		var pins []*tagPin
+		for _, p := range tp.pins {
+			pins = append(pins, p)
+		}
+		tp.mu.Unlock()
+		for _, p := range pins {
+			tp.check(log.WithLogger(ctx, log.G(ctx).WithField("ref", p.Ref)), p)
+		}
+	}
+}
+
+func (tp *tagPinner) list() []TagPin {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	res := []TagPin{}
+	for _, p := range tp.pins {
+		tpin := p.TagPin
+		tpin.Mounts = len(p.mounts)
+		res = append(res, tpin)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Ref < res[j].Ref })
+	return res
+}
+
+// isTagged returns true if the reference refers to the image by tag only.
+func isTagged(r reference.Spec) bool {
+	return r.Object != "" && r.Digest() == ""
+}
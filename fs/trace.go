@@ -0,0 +1,152 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/pkg/errors"
+)
+
+// Maximum number of operations recorded in a trace. Operations exceeding
+// this are counted as dropped.
+const maxFUSETraceRecords = 10000
+
+// FUSETracer records FUSE operations slower than the threshold for the
+// specified duration. The filesystem returned by NewFilesystem implements this
+// interface.
+type FUSETracer interface {
+	TraceFUSE(ctx context.Context, duration, threshold time.Duration) (*FUSETrace, error)
+}
+
+// FUSETrace is the result of tracing FUSE operations.
+type FUSETrace struct {
+	Start     time.Time      `json:"start"`
+	Duration  time.Duration  `json:"duration"`
+	Threshold time.Duration  `json:"threshold"`
+	Ops       []FUSEOpRecord `json:"ops"`
+	Dropped   int            `json:"dropped"`
+}
+
+// FUSEOpRecord is a slow FUSE operation.
+type FUSEOpRecord struct {
+	Op         string        `json:"op"`
+	Mountpoint string        `json:"mountpoint"`
+	Path       string        `json:"path"`
+	Start      time.Time     `json:"start"`
+	Latency    time.Duration `json:"latency"`
+}
+
+var _ = (FUSETracer)((*filesystem)(nil))
+
+func (fs *filesystem) TraceFUSE(ctx context.Context, duration, threshold time.Duration) (*FUSETrace, error) {
+	t := &fs.opTracer
+	t.mu.Lock()
+	if t.tracing {
+		t.mu.Unlock()
+		return nil, errors.Wrapf(errdefs.ErrUnavailable, "another trace is running")
+	}
+	t.tracing = true
+	t.records, t.dropped = nil, 0
+	atomic.StoreInt64(&t.threshold, int64(threshold))
+	atomic.StoreInt32(&t.enabled, 1)
+	t.mu.Unlock()
+
+	start := time.Now()
+	select {
+	case <-time.After(duration):
+	case <-ctx.Done():
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	atomic.StoreInt32(&t.enabled, 0)
+	t.tracing = false
+	res := &FUSETrace{
+		Start:     start,
+		Duration:  time.Since(start),
+		Threshold: threshold,
+		Ops:       t.records,
+		Dropped:   t.dropped,
+	}
+	t.records = nil
+	return res, nil
+}
+
+// opTracer records slow operations while tracing is enabled. This costs only an
+// atomic load per operation while disabled.
+type opTracer struct {
+	enabled   int32
+	threshold int64 // nanoseconds
+
+	tracing bool
+	records []FUSEOpRecord
+	dropped int
+	mu      sync.Mutex
+}
+
+func nopTraceDone() {}
+
+// start starts tracing an operation. The returned function must be called when
+// the operation completes. name is called only when the operation is recorded.
+func (t *opTracer) start(op, mountpoint string, name func() string) func() {
+	if atomic.LoadInt32(&t.enabled) == 0 {
+		return nopTraceDone
+	}
+	start := time.Now()
+	return func() {
+		latency := time.Since(start)
+		if int64(latency) < atomic.LoadInt64(&t.threshold) {
+			return
+		}
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if !t.tracing {
+			return
+		}
+		if len(t.records) >= maxFUSETraceRecords {
+			t.dropped++
+			return
+		}
+		t.records = append(t.records, FUSEOpRecord{
+			Op:         op,
+			Mountpoint: mountpoint,
+			Path:       name(),
+			Start:      start,
+			Latency:    latency,
+		})
+	}
+}
+
+// trace starts tracing an operation on this node. name is the name of the child
+// which the operation targets, if any.
+func (n *node) trace(op, name string) func() {
+	if n.fs == nil {
+		return nopTraceDone
+	}
+	return n.fs.opTracer.start(op, n.root, func() string {
+		if n.e == nil {
+			return name // the layer isn't ready
+		}
+		return path.Join("/", n.e.Name, name)
+	})
+}
@@ -0,0 +1,60 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	snbase "github.com/containerd/stargz-snapshotter/snapshot"
+)
+
+var _ = (snbase.SnapshotLabeler)((*filesystem)(nil))
+
+// SnapshotLabels returns the labels recording how the layer mounted on the
+// mountpoint with the labels is verified (config.VerifiedLabel and
+// config.VerificationModeLabel). The snapshotter adds them to the remote
+// snapshot so that tools can audit unverified lazy mounts via containerd.
+func (fs *filesystem) SnapshotLabels(ctx context.Context, mountpoint string, labels map[string]string) map[string]string {
+	mode := fs.verificationMode(fs.labelFilter.Filter(labels))
+	return map[string]string{
+		config.VerifiedLabel:         strconv.FormatBool(isVerified(mode)),
+		config.VerificationModeLabel: mode,
+	}
+}
+
+// verificationMode returns how the layer mounted with the labels is verified.
+// This follows prepareLayer; layers without TOC digests are mounted only if
+// they are allowed to skip verification.
+func (fs *filesystem) verificationMode(labels map[string]string) string {
+	switch {
+	case isNydusLayer(labels):
+		return config.VerificationModeNydus
+	case fs.disableVerification:
+		return config.VerificationModeDisabled
+	case labels[estargz.TOCJSONDigestAnnotation] != "":
+		return config.VerificationModeTOCDigest
+	}
+	return config.VerificationModeSkipped
+}
+
+// isVerified returns true if the chunks of layers are verified in the mode.
+func isVerified(mode string) bool {
+	return mode == config.VerificationModeTOCDigest || mode == config.VerificationModeNydus
+}
@@ -0,0 +1,209 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+)
+
+const (
+	// defaultLatencyWatchdogWindowSec is the default duration in which the
+	// on-demand fetch latency must be sustained to trigger the fallback.
+	defaultLatencyWatchdogWindowSec = 60
+
+	// defaultLatencyWatchdogMinSamples is the default minimum number of fetches
+	// in the window for evaluating the latency.
+	defaultLatencyWatchdogMinSamples = 20
+
+	// maxLatencyWatchdogInterval is the maximum interval of checking the
+	// latency. Shorter windows are checked at the window.
+	maxLatencyWatchdogInterval = 10 * time.Second
+
+	// maxLatencyWatchdogEvents is the number of the latest events kept for the
+	// API.
+	maxLatencyWatchdogEvents = 1000
+)
+
+// LatencyWatchdogEvent is a fallback to fetching the whole layer triggered by
+// the slow on-demand fetches.
+type LatencyWatchdogEvent struct {
+	Mountpoint string        `json:"mountpoint"`
+	Digest     string        `json:"digest"`
+	Time       time.Time     `json:"time"`
+	P99        time.Duration `json:"p99"`
+	Threshold  time.Duration `json:"threshold"`
+	Samples    int           `json:"samples"`
+
+	// Done is true when the layer has been fetched. Error is the reason of the
+	// failure, if any.
+	Done  bool   `json:"done"`
+	Error string `json:"error,omitempty"`
+}
+
+// LatencyWatchdogReporter reports fallbacks triggered by the watchdog of the
+// on-demand fetch latency. The filesystem returned by NewFilesystem implements
+// this interface.
+type LatencyWatchdogReporter interface {
+	LatencyWatchdogEvents(ctx context.Context) []LatencyWatchdogEvent
+}
+
+var _ = (LatencyWatchdogReporter)((*filesystem)(nil))
+
+// LatencyWatchdogEvents returns the latest fallbacks, oldest first. This is
+// empty unless `latency_watchdog.threshold_msec` is configured.
+func (fs *filesystem) LatencyWatchdogEvents(ctx context.Context) []LatencyWatchdogEvent {
+	if fs.latencyWatchdog == nil {
+		return []LatencyWatchdogEvent{}
+	}
+	return fs.latencyWatchdog.list()
+}
+
+// latencyWatchdog periodically evaluates the p99 latency of on-demand fetches
+// of each mounted layer and materializes layers exceeding the threshold in
+// background. Each layer is materialized at most once.
+type latencyWatchdog struct {
+	threshold   time.Duration
+	window      time.Duration
+	minSamples  int
+	layers      func() map[string]*layer // mountpoint -> layer
+	materialize func(ctx context.Context, mountpoint string) error
+	now         func() time.Time
+
+	fired  map[*layer]struct{}
+	events []*LatencyWatchdogEvent
+	mu     sync.Mutex
+}
+
+func newLatencyWatchdog(threshold, window time.Duration, minSamples int, layers func() map[string]*layer, materialize func(ctx context.Context, mountpoint string) error) *latencyWatchdog {
+	return &latencyWatchdog{
+		threshold:   threshold,
+		window:      window,
+		minSamples:  minSamples,
+		layers:      layers,
+		materialize: materialize,
+		now:         time.Now,
+		fired:       make(map[*layer]struct{}),
+	}
+}
+
+// run checks mounted layers until the context is done.
+func (w *latencyWatchdog) run(ctx context.Context) {
+	interval := w.window
+	if interval > maxLatencyWatchdogInterval {
+		interval = maxLatencyWatchdogInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.check(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// check evaluates the latency of each layer and starts materializing the ones
+// exceeding the threshold.
+func (w *latencyWatchdog) check(ctx context.Context) {
+	layers := w.layers()
+	now := w.now()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	alive := make(map[*layer]struct{})
+	for mp, l := range layers {
+		alive[l] = struct{}{}
+		if _, ok := w.fired[l]; ok || l.isMaterialized() {
+			continue
+		}
+		records, _ := l.fetchLog.get(now.Add(-w.window))
+		if len(records) < w.minSamples {
+			continue
+		}
+		p99 := latencyPercentile(records, 99)
+		if p99 <= w.threshold {
+			continue
+		}
+		w.fired[l] = struct{}{}
+		e := &LatencyWatchdogEvent{
+			Mountpoint: mp,
+			Digest:     l.desc.Digest.String(),
+			Time:       now,
+			P99:        p99,
+			Threshold:  w.threshold,
+			Samples:    len(records),
+		}
+		w.events = append(w.events, e)
+		if len(w.events) > maxLatencyWatchdogEvents {
+			w.events = w.events[1:]
+		}
+		lctx := log.WithLogger(ctx, log.G(ctx).WithField("mountpoint", mp).WithField("digest", e.Digest))
+		log.G(lctx).WithField("p99", p99).WithField("samples", len(records)).
+			Warn("on-demand fetches are persistently slow; fetching the whole layer in background")
+		go w.fallback(lctx, mp, e)
+	}
+	for l := range w.fired {
+		if _, ok := alive[l]; !ok {
+			delete(w.fired, l) // unmounted
+		}
+	}
+}
+
+func (w *latencyWatchdog) fallback(ctx context.Context, mountpoint string, e *LatencyWatchdogEvent) {
+	err := w.materialize(ctx, mountpoint)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to fetch the whole layer on slow on-demand fetches")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err != nil {
+		e.Error = err.Error()
+	} else {
+		e.Done = true
+	}
+}
+
+func (w *latencyWatchdog) list() []LatencyWatchdogEvent {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	res := make([]LatencyWatchdogEvent, 0, len(w.events))
+	for _, e := range w.events {
+		res = append(res, *e)
+	}
+	return res
+}
+
+// latencyPercentile returns the p-th percentile of the latency of the records
+// with the nearest-rank method. records must not be empty.
+func latencyPercentile(records []FetchRecord, p int) time.Duration {
+	latencies := make([]time.Duration, len(records))
+	for i, r := range records {
+		latencies[i] = r.Latency
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	rank := (len(latencies)*p + 99) / 100 // ceil(len * p / 100)
+	if rank < 1 {
+		rank = 1
+	}
+	return latencies[rank-1]
+}
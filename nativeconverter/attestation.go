@@ -0,0 +1,95 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package nativeconverter
+
+import (
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// AnnotationReferenceType is the annotation of an index entry which
+	// indicates the kind of the artifact referring to another entry.
+	// BuildKit sets "attestation-manifest" to manifests of SBOMs and provenances.
+	AnnotationReferenceType = "vnd.docker.reference.type"
+
+	// AnnotationReferenceDigest is the annotation of an index entry which
+	// indicates the digest of the manifest the artifact refers to.
+	AnnotationReferenceDigest = "vnd.docker.reference.digest"
+
+	// ReferenceTypeAttestation is the value of AnnotationReferenceType for
+	// attestation manifests.
+	ReferenceTypeAttestation = "attestation-manifest"
+)
+
+// attestationSubject returns the digest of the manifest the attestation
+// manifest desc refers to. ok is false if desc isn't an attestation manifest.
+func attestationSubject(desc ocispec.Descriptor) (subject digest.Digest, ok bool) {
+	if desc.Annotations[AnnotationReferenceType] != ReferenceTypeAttestation {
+		return "", false
+	}
+	subject, err := digest.Parse(desc.Annotations[AnnotationReferenceDigest])
+	if err != nil {
+		return "", false
+	}
+	return subject, true
+}
+
+// relinkAttestations updates attestation manifests in newManifests so that they
+// refer to the converted manifests. oldManifests and newManifests are the index
+// entries before and after the conversion. Attestations whose subjects are
+// removed are also marked to be removed. Returns true if anything was modified.
+func relinkAttestations(oldManifests, newManifests []ocispec.Descriptor, toBeRemoved map[int]struct{}, labels map[string]string) (modified bool) {
+	var (
+		converted = make(map[digest.Digest]digest.Digest) // key: old digest, value: new digest
+		removed   = make(map[digest.Digest]struct{})
+	)
+	for i, m := range oldManifests {
+		if _, ok := attestationSubject(m); ok {
+			continue
+		}
+		if _, ok := toBeRemoved[i]; ok {
+			removed[m.Digest] = struct{}{}
+		} else if newManifests[i].Digest != m.Digest {
+			converted[m.Digest] = newManifests[i].Digest
+		}
+	}
+	for i, m := range oldManifests {
+		subject, ok := attestationSubject(m)
+		if !ok {
+			continue
+		}
+		if _, ok := removed[subject]; ok {
+			ClearGCLabels(labels, m.Digest)
+			toBeRemoved[i] = struct{}{}
+			modified = true
+			continue
+		}
+		newSubject, ok := converted[subject]
+		if !ok {
+			continue
+		}
+		annotations := make(map[string]string, len(m.Annotations))
+		for k, v := range m.Annotations {
+			annotations[k] = v
+		}
+		annotations[AnnotationReferenceDigest] = newSubject.String()
+		newManifests[i].Annotations = annotations
+		modified = true
+	}
+	return modified
+}
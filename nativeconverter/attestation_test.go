@@ -0,0 +1,77 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package nativeconverter
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestRelinkAttestations(t *testing.T) {
+	var (
+		amd64     = digest.FromString("amd64")
+		amd64New  = digest.FromString("amd64-converted")
+		arm64     = digest.FromString("arm64")
+		amd64Att  = digest.FromString("amd64-attestation")
+		arm64Att  = digest.FromString("arm64-attestation")
+		unrelated = digest.FromString("unrelated")
+	)
+	att := func(dgst, subject digest.Digest) ocispec.Descriptor {
+		return ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Digest:    dgst,
+			Platform:  &ocispec.Platform{OS: "unknown", Architecture: "unknown"},
+			Annotations: map[string]string{
+				AnnotationReferenceType:   ReferenceTypeAttestation,
+				AnnotationReferenceDigest: subject.String(),
+			},
+		}
+	}
+	mani := func(dgst digest.Digest) ocispec.Descriptor {
+		return ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: dgst}
+	}
+	oldManifests := []ocispec.Descriptor{mani(amd64), mani(arm64), att(amd64Att, amd64), att(arm64Att, arm64), mani(unrelated)}
+	newManifests := []ocispec.Descriptor{mani(amd64New), {}, att(amd64Att, amd64), att(arm64Att, arm64), mani(unrelated)}
+	toBeRemoved := map[int]struct{}{1: {}}
+	labels := make(map[string]string)
+	for i, m := range oldManifests {
+		labels[fmt.Sprintf("containerd.io/gc.ref.content.m.%d", i)] = m.Digest.String()
+	}
+
+	if !relinkAttestations(oldManifests, newManifests, toBeRemoved, labels) {
+		t.Fatalf("attestations must be modified")
+	}
+	if got := newManifests[2].Annotations[AnnotationReferenceDigest]; got != amd64New.String() {
+		t.Errorf("subject of the attestation = %q; want %q", got, amd64New)
+	}
+	if got := oldManifests[2].Annotations[AnnotationReferenceDigest]; got != amd64.String() {
+		t.Errorf("annotations of the original descriptor must not be modified; got %q", got)
+	}
+	if want := map[int]struct{}{1: {}, 3: {}}; !reflect.DeepEqual(toBeRemoved, want) {
+		t.Errorf("removed manifests = %v; want %v", toBeRemoved, want)
+	}
+	if _, ok := labels["containerd.io/gc.ref.content.m.3"]; ok {
+		t.Errorf("GC label of the removed attestation must be cleared")
+	}
+	if got := labels["containerd.io/gc.ref.content.m.2"]; got != amd64Att.String() {
+		t.Errorf("GC label of the kept attestation = %q; want %q", got, amd64Att)
+	}
+}
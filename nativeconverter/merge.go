@@ -0,0 +1,467 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package nativeconverter
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	whiteoutPrefix    = ".wh."
+	whiteoutOpaqueDir = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+// LayerRange is an inclusive range of 0-based layer indexes of a manifest.
+// End < 0 means the last layer of the manifest.
+type LayerRange struct {
+	Start int
+	End   int
+}
+
+func (r LayerRange) String() string {
+	if r.End < 0 {
+		return fmt.Sprintf("%d-", r.Start)
+	}
+	return fmt.Sprintf("%d-%d", r.Start, r.End)
+}
+
+// ParseLayerRange parses a layer range formatted as "<START>-<END>" or
+// "<START>-" (until the last layer).
+func ParseLayerRange(s string) (LayerRange, error) {
+	i := strings.Index(s, "-")
+	if i < 0 {
+		return LayerRange{}, fmt.Errorf("invalid layer range %q; must be <START>-<END> or <START>-", s)
+	}
+	start, err := strconv.Atoi(s[:i])
+	if err != nil || start < 0 {
+		return LayerRange{}, fmt.Errorf("invalid start of layer range %q", s)
+	}
+	end := -1
+	if s[i+1:] != "" {
+		end, err = strconv.Atoi(s[i+1:])
+		if err != nil || end < start {
+			return LayerRange{}, fmt.Errorf("invalid end of layer range %q", s)
+		}
+	}
+	return LayerRange{Start: start, End: end}, nil
+}
+
+// WithMergeLayers merges the layers in each range into a single layer before
+// converting layers. Merged layers follow the whiteout semantics of overlayfs
+// so the merged image has the same rootfs as the original one. This reduces the
+// number of layers which the snapshotter needs to resolve and mount. Effective
+// only with the default index convert func.
+func WithMergeLayers(ranges ...LayerRange) ConvertOpt {
+	return func(copts *convertOpts) error {
+		copts.mergeRanges = append(copts.mergeRanges, ranges...)
+		return nil
+	}
+}
+
+// resolveRanges resolves ranges against a manifest with n layers. The result
+// is sorted and doesn't contain ranges of a single layer.
+func resolveRanges(ranges []LayerRange, n int) ([]LayerRange, error) {
+	var res []LayerRange
+	for _, r := range ranges {
+		if r.End < 0 {
+			r.End = n - 1
+		}
+		if r.Start >= n || r.End >= n {
+			return nil, fmt.Errorf("layer range %v is out of bounds of %d layers", r, n)
+		}
+		if r.Start < r.End {
+			res = append(res, r)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Start < res[j].Start })
+	for i := 1; i < len(res); i++ {
+		if res[i].Start <= res[i-1].End {
+			return nil, fmt.Errorf("layer ranges %v and %v overlap", res[i-1], res[i])
+		}
+	}
+	return res, nil
+}
+
+// mergeManifestLayers merges the layers of the manifest in ranges. The
+// manifest's layers, config and GC labels are updated.
+func (c *defaultConverter) mergeManifestLayers(ctx context.Context, cs content.Store, manifest *DualManifest, labels map[string]string) error {
+	ranges, err := resolveRanges(c.mergeRanges, len(manifest.Layers))
+	if err != nil {
+		return err
+	}
+	if len(ranges) == 0 {
+		return nil
+	}
+	var (
+		newLayers []ocispec.Descriptor
+		merged    = make(map[int]digest.Digest) // key: index of the last layer in a range
+		next      int
+	)
+	for _, r := range ranges {
+		newLayers = append(newLayers, manifest.Layers[next:r.Start]...)
+		l, err := mergeLayers(ctx, cs, manifest.Layers[r.Start:r.End+1])
+		if err != nil {
+			return fmt.Errorf("failed to merge layers %v: %w", r, err)
+		}
+		newLayers = append(newLayers, *l)
+		merged[r.End] = l.Digest // the digest of uncompressed layer is the diffID
+		next = r.End + 1
+	}
+	newLayers = append(newLayers, manifest.Layers[next:]...)
+
+	newConfig, err := mergeDiffIDs(ctx, cs, manifest.Config, ranges, merged)
+	if err != nil {
+		return err
+	}
+	for k := range labels {
+		if strings.HasPrefix(k, "containerd.io/gc.ref.content.l.") {
+			delete(labels, k)
+		}
+	}
+	for i, l := range newLayers {
+		labels[fmt.Sprintf("containerd.io/gc.ref.content.l.%d", i)] = l.Digest.String()
+	}
+	ClearGCLabels(labels, manifest.Config.Digest)
+	labels["containerd.io/gc.ref.content.config"] = newConfig.Digest.String()
+	manifest.Layers = newLayers
+	manifest.Config = *newConfig
+	return nil
+}
+
+// mergeDiffIDs replaces the diff IDs of the layers in ranges with the merged
+// ones. `.history` entries of the merged layers except the last one are marked
+// as empty layers.
+func mergeDiffIDs(ctx context.Context, cs content.Store, desc ocispec.Descriptor, ranges []LayerRange, merged map[int]digest.Digest) (*ocispec.Descriptor, error) {
+	var (
+		cfg      DualConfig
+		cfgAsOCI ocispec.Image // read only, used for parsing cfg
+	)
+	labels, err := readJSON(ctx, cs, &cfg, desc)
+	if err != nil {
+		return nil, err
+	}
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	if _, err := readJSON(ctx, cs, &cfgAsOCI, desc); err != nil {
+		return nil, err
+	}
+	rootfs := cfgAsOCI.RootFS
+	if rootfs.Type != "layers" {
+		return nil, fmt.Errorf("unsupported rootfs type %q", rootfs.Type)
+	}
+	inRange := func(i int) bool {
+		for _, r := range ranges {
+			if r.Start <= i && i < r.End {
+				return true
+			}
+		}
+		return false
+	}
+	var diffIDs []digest.Digest
+	for i, d := range rootfs.DiffIDs {
+		if inRange(i) {
+			continue
+		}
+		if m, ok := merged[i]; ok {
+			d = m
+		}
+		diffIDs = append(diffIDs, d)
+	}
+	rootfs.DiffIDs = diffIDs
+	rootfsB, err := json.Marshal(rootfs)
+	if err != nil {
+		return nil, err
+	}
+	cfg["rootfs"] = (*json.RawMessage)(&rootfsB)
+	if history := cfgAsOCI.History; len(history) > 0 {
+		var layerIdx int
+		for i, h := range history {
+			if h.EmptyLayer {
+				continue
+			}
+			if inRange(layerIdx) {
+				history[i].EmptyLayer = true
+			}
+			layerIdx++
+		}
+		historyB, err := json.Marshal(history)
+		if err != nil {
+			return nil, err
+		}
+		cfg["history"] = (*json.RawMessage)(&historyB)
+	}
+	if _, err := clearDockerV1DummyID(cfg); err != nil {
+		return nil, err
+	}
+	return writeJSON(ctx, cs, &cfg, desc, labels)
+}
+
+// mergeLayers merges the layers into an uncompressed tar layer.
+func mergeLayers(ctx context.Context, cs content.Store, layers []ocispec.Descriptor) (*ocispec.Descriptor, error) {
+	var (
+		srs     []*io.SectionReader
+		closers []func() error
+	)
+	defer func() {
+		for _, c := range closers {
+			c()
+		}
+	}()
+	for _, l := range layers {
+		sr, closeFn, err := openUncompressedLayer(ctx, cs, l)
+		if err != nil {
+			return nil, err
+		}
+		closers = append(closers, closeFn)
+		srs = append(srs, sr)
+	}
+
+	ref := fmt.Sprintf("convert-merge-layers-%s-%s", layers[0].Digest, layers[len(layers)-1].Digest)
+	w, err := content.OpenWriter(ctx, cs, content.WithRef(ref))
+	if err != nil {
+		return nil, err
+	}
+	defer w.Close()
+	if err := w.Truncate(0); err != nil {
+		return nil, err
+	}
+	cw := &countWriter{w: w}
+	if err := mergeTar(cw, srs); err != nil {
+		return nil, err
+	}
+	if err := w.Commit(ctx, cw.n, ""); err != nil && !errdefs.IsAlreadyExists(err) {
+		return nil, err
+	}
+
+	mediaType := ocispec.MediaTypeImageLayer
+	if IsDockerType(layers[len(layers)-1].MediaType) {
+		mediaType = images.MediaTypeDockerSchema2Layer
+	}
+	return &ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    w.Digest(),
+		Size:      cw.n,
+	}, nil
+}
+
+// openUncompressedLayer returns the uncompressed contents of the layer. gzip
+// layers are decompressed to a temporary file.
+func openUncompressedLayer(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*io.SectionReader, func() error, error) {
+	switch desc.MediaType {
+	case images.MediaTypeDockerSchema2Layer, ocispec.MediaTypeImageLayer:
+		ra, err := cs.ReaderAt(ctx, desc)
+		if err != nil {
+			return nil, nil, err
+		}
+		return io.NewSectionReader(ra, 0, ra.Size()), ra.Close, nil
+	case images.MediaTypeDockerSchema2LayerGzip, ocispec.MediaTypeImageLayerGzip:
+	default:
+		return nil, nil, fmt.Errorf("unsupported media type %q of layer %v", desc.MediaType, desc.Digest)
+	}
+	ra, err := cs.ReaderAt(ctx, desc)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer ra.Close()
+	zr, err := gzip.NewReader(io.NewSectionReader(ra, 0, ra.Size()))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer zr.Close()
+	f, err := ioutil.TempFile("", "merge-layer")
+	if err != nil {
+		return nil, nil, err
+	}
+	closeFn := func() error {
+		f.Close()
+		return os.Remove(f.Name())
+	}
+	n, err := io.Copy(f, zr)
+	if err != nil {
+		closeFn()
+		return nil, nil, err
+	}
+	return io.NewSectionReader(f, 0, n), closeFn, nil
+}
+
+type mergeEntry struct {
+	header  *tar.Header
+	payload *io.SectionReader
+	layer   int         // index of the layer containing this entry
+	seq     int         // order of the entry in the merged layer
+	link    *mergeEntry // target of a hardlink
+}
+
+// mergeTar writes the tar layers merged into a tar layer to w. Entries are
+// applied from the lowest layer with overlayfs semantics. An entry replaces the
+// same path in lower layers and a non-directory also removes the children of
+// the path. A whiteout removes the path and its children in lower layers and an
+// opaque whiteout removes the children of the directory in lower layers.
+// Whiteouts are kept in the merged layer to hide paths in the layers below.
+// When a whited-out path is recreated in an upper layer, the whiteout is
+// dropped and a directory gets an opaque whiteout instead. Hardlinks whose
+// targets are replaced become regular files.
+func mergeTar(w io.Writer, layers []*io.SectionReader) error {
+	var (
+		entries = make(map[string]*mergeEntry)
+		seq     int
+	)
+	removeLower := func(layer int, name string, children bool) {
+		prefix := name + "/"
+		if name == "" {
+			prefix = ""
+		}
+		for k, e := range entries {
+			if e.layer < layer && ((!children && k == name) || strings.HasPrefix(k, prefix)) {
+				delete(entries, k)
+			}
+		}
+	}
+	add := func(name string, e *mergeEntry) {
+		if old, ok := entries[name]; ok {
+			e.seq = old.seq // keep the position so that parents precede children
+		} else {
+			e.seq = seq
+			seq++
+		}
+		entries[name] = e
+	}
+	for layer, sr := range layers {
+		cr := &countReader{r: sr}
+		tr := tar.NewReader(cr)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return fmt.Errorf("failed to parse tar of layer %d: %w", layer, err)
+			}
+			if h.Typeflag == tar.TypeGNUSparse || h.PAXRecords["GNU.sparse.major"] != "" {
+				return fmt.Errorf("sparse file %q is not supported", h.Name)
+			}
+			name := cleanEntryName(h.Name)
+			e := &mergeEntry{
+				header:  h,
+				payload: io.NewSectionReader(sr, cr.n, h.Size),
+				layer:   layer,
+			}
+			dir, base := path.Split(name)
+			dir = strings.TrimSuffix(dir, "/")
+			switch {
+			case base == whiteoutOpaqueDir:
+				removeLower(layer, dir, true)
+				add(name, e)
+				continue
+			case strings.HasPrefix(base, whiteoutPrefix):
+				removeLower(layer, path.Join(dir, base[len(whiteoutPrefix):]), false)
+				add(name, e)
+				continue
+			}
+			if old, ok := entries[name]; ok && old.layer < layer && !(old.header.Typeflag == tar.TypeDir && h.Typeflag == tar.TypeDir) {
+				removeLower(layer, name, true)
+			}
+			if h.Typeflag == tar.TypeLink {
+				e.link = entries[cleanEntryName(h.Linkname)]
+			}
+			add(name, e)
+			if wh := path.Join(dir, whiteoutPrefix+base); entries[wh] != nil {
+				delete(entries, wh)
+				if h.Typeflag == tar.TypeDir {
+					opq := path.Join(name, whiteoutOpaqueDir)
+					add(opq, &mergeEntry{
+						header: &tar.Header{
+							Typeflag: tar.TypeReg,
+							Name:     opq,
+							ModTime:  h.ModTime,
+						},
+						payload: io.NewSectionReader(sr, 0, 0),
+						layer:   layer,
+					})
+				}
+			}
+		}
+	}
+
+	sorted := make([]*mergeEntry, 0, len(entries))
+	for _, e := range entries {
+		sorted = append(sorted, e)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].seq < sorted[j].seq })
+	tw := tar.NewWriter(w)
+	for _, e := range sorted {
+		h, payload := e.header, e.payload
+		if e.link != nil && entries[cleanEntryName(h.Linkname)] != e.link {
+			// The target of the hardlink was replaced. Keep the original contents.
+			lh := *e.link.header
+			lh.Name = h.Name
+			h, payload = &lh, e.link.payload
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+		if h.Typeflag == tar.TypeReg {
+			if _, err := io.Copy(tw, io.NewSectionReader(payload, 0, h.Size)); err != nil {
+				return err
+			}
+		}
+	}
+	return tw.Close()
+}
+
+func cleanEntryName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
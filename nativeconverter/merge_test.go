@@ -0,0 +1,187 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package nativeconverter
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+type testEntry struct {
+	name     string
+	typ      byte
+	contents string // linkname for hardlinks
+}
+
+func dir(name string) testEntry            { return testEntry{name: name, typ: tar.TypeDir} }
+func file(name, contents string) testEntry { return testEntry{name: name, typ: tar.TypeReg, contents: contents} }
+func link(name, target string) testEntry   { return testEntry{name: name, typ: tar.TypeLink, contents: target} }
+
+func tarOf(t *testing.T, entries ...testEntry) *io.SectionReader {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		h := &tar.Header{Name: e.name, Typeflag: e.typ, Mode: 0644}
+		switch e.typ {
+		case tar.TypeReg:
+			h.Size = int64(len(e.contents))
+		case tar.TypeLink:
+			h.Linkname = e.contents
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if e.typ == tar.TypeReg {
+			if _, err := io.WriteString(tw, e.contents); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return io.NewSectionReader(bytes.NewReader(buf.Bytes()), 0, int64(buf.Len()))
+}
+
+func TestMergeTar(t *testing.T) {
+	tests := []struct {
+		name   string
+		layers [][]testEntry
+		want   []testEntry
+	}{
+		{
+			name: "replace",
+			layers: [][]testEntry{
+				{dir("a/"), file("a/x", "lower"), file("a/y", "y")},
+				{dir("a/"), file("a/x", "upper")},
+			},
+			want: []testEntry{dir("a"), file("a/x", "upper"), file("a/y", "y")},
+		},
+		{
+			name: "whiteout",
+			layers: [][]testEntry{
+				{dir("a/"), file("a/x", "x"), dir("b/"), file("b/y", "y")},
+				{file("a/.wh.x", ""), file(".wh.b", "")},
+			},
+			want: []testEntry{dir("a"), file("a/.wh.x", ""), file(".wh.b", "")},
+		},
+		{
+			name: "opaque",
+			layers: [][]testEntry{
+				{dir("a/"), file("a/x", "x")},
+				{dir("a/"), file("a/.wh..wh..opq", ""), file("a/y", "y")},
+			},
+			want: []testEntry{dir("a"), file("a/.wh..wh..opq", ""), file("a/y", "y")},
+		},
+		{
+			name: "recreate",
+			layers: [][]testEntry{
+				{dir("a/"), file("a/x", "x"), file("f", "lower")},
+				{file(".wh.a", ""), file(".wh.f", "")},
+				{dir("a/"), file("a/y", "y"), file("f", "upper")},
+			},
+			want: []testEntry{dir("a"), file("a/.wh..wh..opq", ""), file("a/y", "y"), file("f", "upper")},
+		},
+		{
+			name: "dir_replaced_by_file",
+			layers: [][]testEntry{
+				{dir("a/"), file("a/x", "x")},
+				{file("a", "file")},
+			},
+			want: []testEntry{file("a", "file")},
+		},
+		{
+			name: "hardlink_target_replaced",
+			layers: [][]testEntry{
+				{file("x", "orig"), link("y", "x")},
+				{file("x", "new")},
+			},
+			want: []testEntry{file("x", "new"), file("y", "orig")},
+		},
+		{
+			name: "hardlink_kept",
+			layers: [][]testEntry{
+				{file("x", "orig"), link("y", "x")},
+				{file("z", "z")},
+			},
+			want: []testEntry{file("x", "orig"), link("y", "x"), file("z", "z")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var layers []*io.SectionReader
+			for _, l := range tt.layers {
+				layers = append(layers, tarOf(t, l...))
+			}
+			buf := new(bytes.Buffer)
+			if err := mergeTar(buf, layers); err != nil {
+				t.Fatalf("failed to merge: %v", err)
+			}
+			var got []testEntry
+			tr := tar.NewReader(buf)
+			for {
+				h, err := tr.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				e := testEntry{name: cleanEntryName(h.Name), typ: h.Typeflag}
+				switch h.Typeflag {
+				case tar.TypeReg:
+					b, err := ioutil.ReadAll(tr)
+					if err != nil {
+						t.Fatal(err)
+					}
+					e.contents = string(b)
+				case tar.TypeLink:
+					e.contents = h.Linkname
+				}
+				got = append(got, e)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("merged entries = %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLayerRange(t *testing.T) {
+	for s, want := range map[string]*LayerRange{
+		"0-3":  {Start: 0, End: 3},
+		"2-":   {Start: 2, End: -1},
+		"3-1":  nil,
+		"a-1":  nil,
+		"1":    nil,
+		"-1-2": nil,
+	} {
+		got, err := ParseLayerRange(s)
+		if want == nil {
+			if err == nil {
+				t.Errorf("%q: got %v; want error", s, got)
+			}
+			continue
+		}
+		if err != nil || got != *want {
+			t.Errorf("%q: got %v (err: %v); want %v", s, got, err, *want)
+		}
+	}
+}
@@ -54,9 +54,13 @@ type Converter struct {
 
 type convertOpts struct {
 	layerConvertFunc ConvertFunc
+	appendLayersFunc AppendLayersFunc
 	docker2oci       bool
 	indexConvertFunc ConvertFunc
 	platformMC       platforms.MatchComparer
+	mergeRanges      []LayerRange
+	digestMap        map[digest.Digest]digest.Digest
+	annotations      map[string]string
 }
 
 // ConvertOpt is an option for Convert()
@@ -74,6 +78,20 @@ func WithLayerConvertFunc(fn ConvertFunc) ConvertOpt {
 	}
 }
 
+// AppendLayersFunc returns layers appended to a manifest. layers are the layers
+// of the manifest after conversion. The appended layers must have
+// LabelUncompressed labels in the content store unless they are uncompressed.
+type AppendLayersFunc func(ctx context.Context, cs content.Store, layers []ocispec.Descriptor) ([]ocispec.Descriptor, error)
+
+// WithAppendLayersFunc specifies the function that appends layers to manifests
+// (e.g. a metadata layer built from the converted layers).
+func WithAppendLayersFunc(fn AppendLayersFunc) ConvertOpt {
+	return func(copts *convertOpts) error {
+		copts.appendLayersFunc = fn
+		return nil
+	}
+}
+
 // WithDockerToOCI converts Docker media types into OCI ones.
 func WithDockerToOCI(v bool) ConvertOpt {
 	return func(copts *convertOpts) error {
@@ -91,6 +109,29 @@ func WithPlatform(p platforms.MatchComparer) ConvertOpt {
 	}
 }
 
+// WithDigestMap records the digests of the converted manifests and indexes into
+// m (key: old digest, value: new digest). This is useful for re-associating
+// artifacts that refer to the original image (e.g. signatures and SBOMs pushed
+// as OCI referrers) with the converted one.
+// This doesn't take effect when WithIndexConvertFunc is specified.
+func WithDigestMap(m map[digest.Digest]digest.Digest) ConvertOpt {
+	return func(copts *convertOpts) error {
+		copts.digestMap = m
+		return nil
+	}
+}
+
+// WithManifestAnnotations adds the annotations to the converted manifests.
+// Docker manifests, which don't support annotations, aren't annotated unless
+// they are converted to OCI ones by WithDockerToOCI.
+// This doesn't take effect when WithIndexConvertFunc is specified.
+func WithManifestAnnotations(annotations map[string]string) ConvertOpt {
+	return func(copts *convertOpts) error {
+		copts.annotations = annotations
+		return nil
+	}
+}
+
 // WithIndexConvertFunc specifies the function that converts manifests and index (manifest lists).
 // Defaults to DefaultIndexConvertFunc.
 func WithIndexConvertFunc(fn ConvertFunc) ConvertOpt {
@@ -112,7 +153,11 @@ func (conv *Converter) Convert(ctx context.Context, dstRef, srcRef string, opts
 		copts.platformMC = platforms.All
 	}
 	if copts.indexConvertFunc == nil {
-		copts.indexConvertFunc = DefaultIndexConvertFunc(copts.layerConvertFunc, copts.docker2oci, copts.platformMC)
+		c := newDefaultConverter(copts.layerConvertFunc, copts.appendLayersFunc, copts.docker2oci, copts.platformMC)
+		c.mergeRanges = copts.mergeRanges
+		c.digestMap = copts.digestMap
+		c.annotations = copts.annotations
+		copts.indexConvertFunc = c.convert
 	}
 
 	ctx, done, err := conv.client.WithLease(ctx)
@@ -150,21 +195,36 @@ func (conv *Converter) Convert(ctx context.Context, dstRef, srcRef string, opts
 
 // DefaultIndexConvertFunc is the default convert func.
 func DefaultIndexConvertFunc(layerConvertFunc ConvertFunc, docker2oci bool, platformMC platforms.MatchComparer) ConvertFunc {
-	c := &defaultConverter{
+	return DefaultIndexConvertFuncWithAppendLayers(layerConvertFunc, nil, docker2oci, platformMC)
+}
+
+// DefaultIndexConvertFuncWithAppendLayers is the default convert func which
+// also appends layers returned by appendLayersFunc to manifests.
+func DefaultIndexConvertFuncWithAppendLayers(layerConvertFunc ConvertFunc, appendLayersFunc AppendLayersFunc, docker2oci bool, platformMC platforms.MatchComparer) ConvertFunc {
+	return newDefaultConverter(layerConvertFunc, appendLayersFunc, docker2oci, platformMC).convert
+}
+
+func newDefaultConverter(layerConvertFunc ConvertFunc, appendLayersFunc AppendLayersFunc, docker2oci bool, platformMC platforms.MatchComparer) *defaultConverter {
+	return &defaultConverter{
 		layerConvertFunc: layerConvertFunc,
+		appendLayersFunc: appendLayersFunc,
 		docker2oci:       docker2oci,
 		platformMC:       platformMC,
 		diffIDMap:        make(map[digest.Digest]digest.Digest),
 	}
-	return c.convert
 }
 
 type defaultConverter struct {
 	layerConvertFunc ConvertFunc
+	appendLayersFunc AppendLayersFunc
 	docker2oci       bool
 	platformMC       platforms.MatchComparer
+	mergeRanges      []LayerRange
 	diffIDMap        map[digest.Digest]digest.Digest // key: old diffID, value: new diffID
 	diffIDMapMu      sync.RWMutex
+	digestMap        map[digest.Digest]digest.Digest // key: old manifest (index) digest, value: new one
+	digestMapMu      sync.Mutex
+	annotations      map[string]string // added to manifests
 }
 
 // convert dispatches desc.MediaType and calls c.convert{Layer,Manifest,Index,Config}.
@@ -202,6 +262,12 @@ func (c *defaultConverter) convert(ctx context.Context, cs content.Store, desc o
 			newDesc.Annotations = nil
 		}
 	}
+	if c.digestMap != nil && newDesc != nil && newDesc.Digest != desc.Digest &&
+		(IsManifestType(desc.MediaType) || IsIndexType(desc.MediaType)) {
+		c.digestMapMu.Lock()
+		c.digestMap[desc.Digest] = newDesc.Digest
+		c.digestMapMu.Unlock()
+	}
 	logrus.WithField("old", desc).WithField("new", newDesc).Debugf("converted")
 	return newDesc, nil
 }
@@ -225,7 +291,13 @@ func (c *defaultConverter) convertLayer(ctx context.Context, cs content.Store, d
 //
 // - clears `.mediaType` if the target format is OCI
 //
+// - merges layers in c.mergeRanges into single layers
+//
 // - records diff ID changes in c.diffIDMap
+//
+// - appends layers returned by c.appendLayersFunc and their diff IDs
+//
+// - adds c.annotations unless the manifest is a Docker one
 func (c *defaultConverter) convertManifest(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
 	var (
 		manifest DualManifest
@@ -242,6 +314,15 @@ func (c *defaultConverter) convertManifest(ctx context.Context, cs content.Store
 		manifest.MediaType = ""
 		modified = true
 	}
+	if len(c.mergeRanges) > 0 {
+		n := len(manifest.Layers)
+		if err := c.mergeManifestLayers(ctx, cs, &manifest, labels); err != nil {
+			return nil, err
+		}
+		if len(manifest.Layers) != n {
+			modified = true
+		}
+	}
 	var mu sync.Mutex
 	eg, ctx2 := errgroup.WithContext(ctx)
 	for i, l := range manifest.Layers {
@@ -286,10 +367,38 @@ func (c *defaultConverter) convertManifest(ctx context.Context, cs content.Store
 		return nil, err
 	}
 
+	var appendedDiffIDs []digest.Digest
+	if c.appendLayersFunc != nil {
+		appended, err := c.appendLayersFunc(ctx, cs, manifest.Layers)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range appended {
+			diffID, err := GetDiffID(ctx, cs, l)
+			if err != nil {
+				return nil, err
+			}
+			labelKey := fmt.Sprintf("containerd.io/gc.ref.content.l.%d", len(manifest.Layers))
+			labels[labelKey] = l.Digest.String()
+			manifest.Layers = append(manifest.Layers, l)
+			appendedDiffIDs = append(appendedDiffIDs, diffID)
+			modified = true
+		}
+	}
+
 	newConfig, err := c.convert(ctx, cs, manifest.Config)
 	if err != nil {
 		return nil, err
 	}
+	if len(appendedDiffIDs) > 0 {
+		cfgDesc := manifest.Config
+		if newConfig != nil {
+			cfgDesc = *newConfig
+		}
+		if newConfig, err = appendDiffIDs(ctx, cs, cfgDesc, appendedDiffIDs); err != nil {
+			return nil, err
+		}
+	}
 	if newConfig != nil {
 		ClearGCLabels(labels, manifest.Config.Digest)
 		labels["containerd.io/gc.ref.content.config"] = newConfig.Digest.String()
@@ -297,6 +406,18 @@ func (c *defaultConverter) convertManifest(ctx context.Context, cs content.Store
 		modified = true
 	}
 
+	if !IsDockerType(manifest.MediaType) {
+		for k, v := range c.annotations {
+			if manifest.Annotations == nil {
+				manifest.Annotations = make(map[string]string)
+			}
+			if old, ok := manifest.Annotations[k]; !ok || old != v {
+				manifest.Annotations[k] = v
+				modified = true
+			}
+		}
+	}
+
 	if modified {
 		return writeJSON(ctx, cs, &manifest, desc, labels)
 	}
@@ -308,6 +429,9 @@ func (c *defaultConverter) convertManifest(ctx context.Context, cs content.Store
 // - clears `.mediaType` if the target format is OCI
 //
 // - clears manifest entries that do not match c.platformMC
+//
+// - keeps attestation manifests (e.g. SBOMs and provenances made by BuildKit)
+// of the kept manifests and re-associates them with the converted manifests
 func (c *defaultConverter) convertIndex(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
 	var (
 		index    DualIndex
@@ -334,6 +458,14 @@ func (c *defaultConverter) convertIndex(ctx context.Context, cs content.Store, d
 		mani := mani
 		labelKey := fmt.Sprintf("containerd.io/gc.ref.content.m.%d", i)
 		eg.Go(func() error {
+			if _, ok := attestationSubject(mani); ok {
+				// Attestations are kept as is and re-associated with the converted
+				// manifests after all manifests are converted.
+				mu.Lock()
+				newManifests[i] = mani
+				mu.Unlock()
+				return nil
+			}
 			if mani.Platform != nil && !c.platformMC.Match(*mani.Platform) {
 				mu.Lock()
 				ClearGCLabels(labels, mani.Digest)
@@ -363,6 +495,9 @@ func (c *defaultConverter) convertIndex(ctx context.Context, cs content.Store, d
 	if err := eg.Wait(); err != nil {
 		return nil, err
 	}
+	if relinkAttestations(index.Manifests, newManifests, newManifestsToBeRemoved, labels) {
+		modified = true
+	}
 	if modified {
 		var newManifestsClean []ocispec.Descriptor
 		for i, m := range newManifests {
@@ -430,6 +565,49 @@ func (c *defaultConverter) convertConfig(ctx context.Context, cs content.Store,
 	return nil, nil
 }
 
+// appendDiffIDs appends diff IDs of appended layers to `.rootfs.diff_ids` of the
+// config. `.history` also gets entries of the layers if it exists.
+func appendDiffIDs(ctx context.Context, cs content.Store, desc ocispec.Descriptor, diffIDs []digest.Digest) (*ocispec.Descriptor, error) {
+	var (
+		cfg      DualConfig
+		cfgAsOCI ocispec.Image // read only, used for parsing cfg
+	)
+	labels, err := readJSON(ctx, cs, &cfg, desc)
+	if err != nil {
+		return nil, err
+	}
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	if _, err := readJSON(ctx, cs, &cfgAsOCI, desc); err != nil {
+		return nil, err
+	}
+	rootfs := cfgAsOCI.RootFS
+	if rootfs.Type != "layers" {
+		return nil, fmt.Errorf("unsupported rootfs type %q", rootfs.Type)
+	}
+	rootfs.DiffIDs = append(rootfs.DiffIDs, diffIDs...)
+	rootfsB, err := json.Marshal(rootfs)
+	if err != nil {
+		return nil, err
+	}
+	cfg["rootfs"] = (*json.RawMessage)(&rootfsB)
+	if history := cfgAsOCI.History; len(history) > 0 {
+		for range diffIDs {
+			history = append(history, ocispec.History{Comment: "appended by converter"})
+		}
+		historyB, err := json.Marshal(history)
+		if err != nil {
+			return nil, err
+		}
+		cfg["history"] = (*json.RawMessage)(&historyB)
+	}
+	if _, err := clearDockerV1DummyID(cfg); err != nil {
+		return nil, err
+	}
+	return writeJSON(ctx, cs, &cfg, desc, labels)
+}
+
 // clearDockerV1DummyID clears the dummy values for legacy `.config.Image` and `.container_config.Image`.
 // Returns true if the cfg was modified.
 func clearDockerV1DummyID(cfg DualConfig) (bool, error) {
@@ -0,0 +1,97 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package nativeconverter
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestManifestAnnotations(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testannotations")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	cs, err := local.NewStore(tmp)
+	if err != nil {
+		t.Fatalf("failed to create content store: %v", err)
+	}
+	ctx := context.Background()
+	config, err := writeJSON(ctx, cs, ocispec.Image{}, ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig}, nil)
+	if err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	annotations := map[string]string{"org.example.team": "platform"}
+
+	for _, tt := range []struct {
+		name       string
+		mediaType  string
+		docker2oci bool
+		want       bool
+	}{
+		{name: "oci", mediaType: ocispec.MediaTypeImageManifest, want: true},
+		{name: "docker", mediaType: images.MediaTypeDockerSchema2Manifest, want: false},
+		{name: "docker2oci", mediaType: images.MediaTypeDockerSchema2Manifest, docker2oci: true, want: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var manifest DualManifest
+			manifest.SchemaVersion = 2
+			manifest.MediaType = tt.mediaType
+			manifest.Config = *config
+			desc, err := writeJSON(ctx, cs, &manifest, ocispec.Descriptor{MediaType: tt.mediaType}, nil)
+			if err != nil {
+				t.Fatalf("failed to write manifest: %v", err)
+			}
+			c := newDefaultConverter(nil, nil, tt.docker2oci, platforms.All)
+			c.annotations = annotations
+			newDesc, err := c.convert(ctx, cs, *desc)
+			if err != nil {
+				t.Fatalf("failed to convert: %v", err)
+			}
+			if !tt.want {
+				if newDesc != nil {
+					t.Errorf("docker manifest must not be annotated: %+v", newDesc)
+				}
+				return
+			}
+			if newDesc == nil {
+				t.Fatalf("manifest must be annotated")
+			}
+			b, err := content.ReadBlob(ctx, cs, *newDesc)
+			if err != nil {
+				t.Fatalf("failed to read manifest: %v", err)
+			}
+			var got ocispec.Manifest
+			if err := json.Unmarshal(b, &got); err != nil {
+				t.Fatalf("failed to parse manifest: %v", err)
+			}
+			if got.Annotations["org.example.team"] != "platform" {
+				t.Errorf("annotation isn't added: %+v", got.Annotations)
+			}
+		})
+	}
+}
@@ -0,0 +1,354 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package nydus converts eStargz images into Nydus images. eStargz layers are
+// reused as Nydus data blobs without modification and a bootstrap layer built
+// from their TOCs is appended to the image.
+package nydus
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/nydus"
+	"github.com/containerd/stargz-snapshotter/nativeconverter"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	// MediaTypeNydusBlob is the media type of data blob layers of Nydus images.
+	MediaTypeNydusBlob = "application/vnd.oci.image.layer.nydus.blob.v1"
+
+	// FSVersionAnnotation is an annotation of the bootstrap layer indicating the
+	// RAFS version.
+	FSVersionAnnotation = "containerd.io/snapshot/nydus-fs-version"
+
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+// LayerConvertFunc converts eStargz layers into Nydus data blob layers. The
+// blobs aren't modified and only the media type and the annotations change.
+// Layers which aren't eStargz can't be converted.
+//
+// Should be used in conjunction with WithDockerToOCI() and AppendBootstrapFunc().
+func LayerConvertFunc() nativeconverter.ConvertFunc {
+	return func(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+		if !images.IsLayerType(desc.MediaType) {
+			// No conversion. No need to return an error here.
+			return nil, nil
+		}
+		l, err := openLayer(ctx, cs, desc)
+		if err != nil {
+			return nil, err
+		}
+		l.close()
+		newDesc := desc
+		newDesc.MediaType = MediaTypeNydusBlob
+		newDesc.Annotations = make(map[string]string, len(desc.Annotations)+1)
+		for k, v := range desc.Annotations {
+			if k != estargz.TOCJSONDigestAnnotation {
+				newDesc.Annotations[k] = v
+			}
+		}
+		newDesc.Annotations[nydus.BlobLabel] = "true"
+		return &newDesc, nil
+	}
+}
+
+// AppendBootstrapFunc returns a function which appends the bootstrap layer to
+// manifests. The bootstrap is built by merging the TOCs of the data blob layers
+// and files prioritized in eStargz layers are recorded as ones to prefetch.
+func AppendBootstrapFunc() nativeconverter.AppendLayersFunc {
+	return func(ctx context.Context, cs content.Store, layers []ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		var ls []*layer
+		defer func() {
+			for _, l := range ls {
+				l.close()
+			}
+		}()
+		for _, desc := range layers {
+			l, err := openLayer(ctx, cs, desc)
+			if err != nil {
+				return nil, err
+			}
+			ls = append(ls, l)
+		}
+		entries, prefetch, err := merge(ls)
+		if err != nil {
+			return nil, err
+		}
+		var bootstrap bytes.Buffer
+		if err := nydus.WriteBootstrap(&bootstrap, entries, layers, prefetch); err != nil {
+			return nil, errors.Wrap(err, "failed to write bootstrap")
+		}
+		desc, err := writeBootstrapLayer(ctx, cs, bootstrap.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		return []ocispec.Descriptor{*desc}, nil
+	}
+}
+
+// layer is an eStargz layer in the content store.
+type layer struct {
+	r        *estargz.Reader
+	ra       content.ReaderAt
+	entries  []*estargz.TOCEntry // in the order of the TOC
+	tocOff   int64
+	prefetch map[string]struct{}
+}
+
+func (l *layer) close() {
+	l.ra.Close()
+}
+
+func openLayer(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*layer, error) {
+	ra, err := cs.ReaderAt(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	sr := io.NewSectionReader(ra, 0, desc.Size)
+	r, err := estargz.Open(sr)
+	if err != nil {
+		ra.Close()
+		return nil, errors.Wrapf(err, "layer %s isn't eStargz", desc.Digest)
+	}
+	if want, ok := desc.Annotations[estargz.TOCJSONDigestAnnotation]; ok && want != r.TOCDigest().String() {
+		ra.Close()
+		return nil, fmt.Errorf("TOC digest of layer %s doesn't match to %q", desc.Digest, want)
+	}
+	tocOff, _, err := estargz.OpenFooter(sr)
+	if err != nil {
+		ra.Close()
+		return nil, err
+	}
+	tocJSON, err := r.TOCJSON()
+	if err != nil {
+		ra.Close()
+		return nil, err
+	}
+	var toc struct {
+		Entries []*estargz.TOCEntry `json:"entries"`
+	}
+	if err := json.Unmarshal(tocJSON, &toc); err != nil {
+		ra.Close()
+		return nil, err
+	}
+	l := &layer{r: r, ra: ra, tocOff: tocOff, prefetch: make(map[string]struct{})}
+	prioritized := true
+	for _, e := range toc.Entries {
+		e.Name = cleanName(e.Name)
+		switch e.Name {
+		case estargz.PrefetchLandmark:
+			prioritized = false
+			continue
+		case estargz.NoPrefetchLandmark:
+			l.prefetch, prioritized = make(map[string]struct{}), false
+			continue
+		}
+		if e.Type == "chunk" || estargz.IsLandmark(e.Name) {
+			continue
+		}
+		if prioritized && e.Type == "reg" {
+			l.prefetch[e.Name] = struct{}{}
+		}
+		l.entries = append(l.entries, e)
+	}
+	if prioritized {
+		l.prefetch = make(map[string]struct{}) // no landmark so nothing is prioritized
+	}
+	return l, nil
+}
+
+// mergedEntry is an entry of the merged filesystem.
+type mergedEntry struct {
+	e     *estargz.TOCEntry
+	layer int
+}
+
+// merge merges the layers applying whiteouts in the same way as overlayfs and
+// returns the entries of the bootstrap and the names of files to prefetch.
+func merge(ls []*layer) ([]nydus.Entry, []string, error) {
+	merged := make(map[string]mergedEntry)
+	removeAll := func(name string, self bool) {
+		for n := range merged {
+			if (self && n == name) || name == "" || strings.HasPrefix(n, name+"/") {
+				if n != "" {
+					delete(merged, n)
+				}
+			}
+		}
+	}
+	for i, l := range ls {
+		for _, e := range l.entries {
+			dir, base := path.Split(e.Name)
+			dir = strings.TrimSuffix(dir, "/")
+			if base == whiteoutOpaque {
+				removeAll(dir, false)
+			} else if strings.HasPrefix(base, whiteoutPrefix) {
+				removeAll(path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)), true)
+			}
+		}
+		for _, e := range l.entries {
+			if strings.HasPrefix(path.Base(e.Name), whiteoutPrefix) {
+				continue
+			}
+			if old, ok := merged[e.Name]; ok && old.e.Type == "dir" && e.Type != "dir" {
+				removeAll(e.Name, true)
+			}
+			merged[e.Name] = mergedEntry{e, i}
+		}
+	}
+
+	var names []string
+	for name := range merged {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var entries, hardlinks []nydus.Entry
+	var prefetch []string
+	for _, name := range names {
+		m := merged[name]
+		l := ls[m.layer]
+		if _, ok := l.prefetch[name]; ok {
+			prefetch = append(prefetch, name)
+		}
+		if m.e.Type == "hardlink" {
+			linkName := cleanName(m.e.LinkName)
+			if target, ok := merged[linkName]; ok && target.layer == m.layer && target.e.Type == "reg" {
+				hardlinks = append(hardlinks, nydus.Entry{TOCEntry: &estargz.TOCEntry{
+					Name:     name,
+					Type:     "hardlink",
+					LinkName: linkName,
+				}})
+				continue
+			}
+			// The target was removed or overwritten by the upper layers so this
+			// becomes a regular file.
+		}
+		org, ok := l.r.Lookup(name)
+		if !ok {
+			return nil, nil, fmt.Errorf("%q isn't found in layer %d", name, m.layer)
+		}
+		e := *org
+		e.Name = name
+		ent := nydus.Entry{TOCEntry: &e}
+		if e.Type == "reg" && e.Size > 0 {
+			chunks, err := l.chunks(m.layer, org)
+			if err != nil {
+				return nil, nil, err
+			}
+			ent.Chunks = chunks
+		}
+		entries = append(entries, ent)
+	}
+	return append(entries, hardlinks...), prefetch, nil
+}
+
+// chunks returns the chunks of the regular file. Each chunk of eStargz starts
+// with a gzip member and ends at the offset of the next entry having contents.
+func (l *layer) chunks(blob int, e *estargz.TOCEntry) ([]nydus.Chunk, error) {
+	var chunks []nydus.Chunk
+	for off := int64(0); off < e.Size; {
+		ce, ok := l.r.ChunkEntryForOffset(e.Name, off)
+		if !ok || ce.ChunkSize <= 0 {
+			return nil, fmt.Errorf("chunk of %q at %d isn't found", e.Name, off)
+		}
+		if ce.ChunkDigest == "" {
+			return nil, fmt.Errorf("chunk digest of %q at %d isn't recorded in the TOC", e.Name, off)
+		}
+		d, err := digest.Parse(ce.ChunkDigest)
+		if err != nil {
+			return nil, err
+		}
+		end := ce.NextOffset()
+		if end > l.tocOff {
+			end = l.tocOff
+		}
+		chunks = append(chunks, nydus.Chunk{
+			Blob:             blob,
+			Digest:           d,
+			CompressedOffset: ce.Offset,
+			CompressedSize:   end - ce.Offset,
+			Size:             ce.ChunkSize,
+		})
+		off += ce.ChunkSize
+	}
+	return chunks, nil
+}
+
+// writeBootstrapLayer writes the bootstrap layer which is a tar.gz archive
+// containing the bootstrap.
+func writeBootstrapLayer(ctx context.Context, cs content.Store, bootstrap []byte) (*ocispec.Descriptor, error) {
+	var (
+		buf      bytes.Buffer
+		digester = digest.Canonical.Digester()
+	)
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(io.MultiWriter(zw, digester.Hash()))
+	for _, h := range []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: path.Dir(nydus.BootstrapTarName) + "/", Mode: 0755},
+		{Typeflag: tar.TypeReg, Name: nydus.BootstrapTarName, Mode: 0444, Size: int64(len(bootstrap))},
+	} {
+		h.ModTime = time.Unix(0, 0)
+		if err := tw.WriteHeader(h); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := tw.Write(bootstrap); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(buf.Bytes()),
+		Size:      int64(buf.Len()),
+		Annotations: map[string]string{
+			nydus.BootstrapLabel: "true",
+			FSVersionAnnotation:  "6",
+		},
+	}
+	labels := map[string]string{nativeconverter.LabelUncompressed: digester.Digest().String()}
+	ref := fmt.Sprintf("convert-nydus-bootstrap-%s", desc.Digest)
+	if err := content.WriteBlob(ctx, cs, ref, bytes.NewReader(buf.Bytes()), desc, content.WithLabels(labels)); err != nil {
+		return nil, err
+	}
+	return &desc, nil
+}
+
+func cleanName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
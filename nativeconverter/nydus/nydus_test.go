@@ -0,0 +1,184 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package nydus
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/stargz-snapshotter/cache"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/nydus"
+	"github.com/containerd/stargz-snapshotter/nativeconverter"
+	"github.com/containerd/stargz-snapshotter/util/testutil"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// TestConvert tests conversion of an eStargz image into a Nydus image.
+func TestConvert(t *testing.T) {
+	ctx := context.Background()
+	tempDir, err := ioutil.TempDir("", "test-nydus")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	cs, err := testutil.NewContentStore(tempDir)
+	if err != nil {
+		t.Fatalf("failed to create content store: %v", err)
+	}
+
+	big := bytes.Repeat([]byte("0123456789"), 1000)
+	lower, err := testutil.WriteEStargz(ctx, cs, []testutil.EStargzEntry{
+		{Header: &tar.Header{Typeflag: tar.TypeDir, Name: "a/", Mode: 0755}},
+		{Header: &tar.Header{Typeflag: tar.TypeReg, Name: "a/big", Mode: 0644}, Contents: big},
+		{Header: &tar.Header{Typeflag: tar.TypeReg, Name: estargz.PrefetchLandmark, Mode: 0644}, Contents: []byte{0xf}},
+		{Header: &tar.Header{Typeflag: tar.TypeLink, Name: "a/link", Linkname: "a/big"}},
+		{Header: &tar.Header{Typeflag: tar.TypeReg, Name: "a/removed", Mode: 0644}, Contents: []byte("removed")},
+		{Header: &tar.Header{Typeflag: tar.TypeReg, Name: "d/hidden", Mode: 0644}, Contents: []byte("hidden")},
+	}, 4096)
+	if err != nil {
+		t.Fatalf("failed to write lower layer: %v", err)
+	}
+	upper, err := testutil.WriteEStargz(ctx, cs, []testutil.EStargzEntry{
+		{Header: &tar.Header{Typeflag: tar.TypeReg, Name: "a/big", Mode: 0600}, Contents: []byte("new")},
+		{Header: &tar.Header{Typeflag: tar.TypeReg, Name: "a/.wh.removed", Mode: 0644}},
+		{Header: &tar.Header{Typeflag: tar.TypeReg, Name: "d/.wh..wh..opq", Mode: 0644}},
+		{Header: &tar.Header{Typeflag: tar.TypeSymlink, Name: "d/sym", Linkname: "../a/big", Mode: 0777}},
+	}, 4096)
+	if err != nil {
+		t.Fatalf("failed to write upper layer: %v", err)
+	}
+	layers := []ocispec.Descriptor{lower, upper}
+	var diffIDs []digest.Digest
+	for _, l := range layers {
+		diffID, err := nativeconverter.GetDiffID(ctx, cs, l)
+		if err != nil {
+			t.Fatalf("failed to get diffID: %v", err)
+		}
+		diffIDs = append(diffIDs, diffID)
+	}
+	config := writeJSON(ctx, t, cs, ocispec.MediaTypeImageConfig, ocispec.Image{
+		RootFS: ocispec.RootFS{Type: "layers", DiffIDs: diffIDs},
+	})
+	manifest := writeJSON(ctx, t, cs, ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    config,
+		Layers:    layers,
+	})
+
+	cf := nativeconverter.DefaultIndexConvertFuncWithAppendLayers(LayerConvertFunc(), AppendBootstrapFunc(), true, platforms.All)
+	newDesc, err := cf(ctx, cs, manifest)
+	if err != nil {
+		t.Fatalf("failed to convert image: %v", err)
+	}
+	var newManifest ocispec.Manifest
+	readJSON(ctx, t, cs, *newDesc, &newManifest)
+	if len(newManifest.Layers) != 3 {
+		t.Fatalf("converted image has %d layers; want 3", len(newManifest.Layers))
+	}
+	for i, l := range newManifest.Layers[:2] {
+		if l.Digest != layers[i].Digest || l.MediaType != MediaTypeNydusBlob || l.Annotations[nydus.BlobLabel] != "true" {
+			t.Errorf("unexpected data blob layer %+v", l)
+		}
+	}
+	bootstrapLayer := newManifest.Layers[2]
+	if bootstrapLayer.Annotations[nydus.BootstrapLabel] != "true" {
+		t.Errorf("unexpected bootstrap layer %+v", bootstrapLayer)
+	}
+	var newConfig ocispec.Image
+	readJSON(ctx, t, cs, newManifest.Config, &newConfig)
+	bootstrapDiffID, err := nativeconverter.GetDiffID(ctx, cs, bootstrapLayer)
+	if err != nil {
+		t.Fatalf("failed to get diffID of bootstrap: %v", err)
+	}
+	if got := newConfig.RootFS.DiffIDs; len(got) != 3 || got[0] != diffIDs[0] || got[1] != diffIDs[1] || got[2] != bootstrapDiffID {
+		t.Errorf("unexpected diffIDs %v", got)
+	}
+
+	ra, err := cs.ReaderAt(ctx, bootstrapLayer)
+	if err != nil {
+		t.Fatalf("failed to open bootstrap layer: %v", err)
+	}
+	defer ra.Close()
+	bootstrap, err := nydus.ReadBootstrap(io.NewSectionReader(ra, 0, bootstrapLayer.Size), bootstrapLayer.Digest)
+	if err != nil {
+		t.Fatalf("failed to read bootstrap: %v", err)
+	}
+	r, _, err := nydus.NewReader(bootstrap, func(id string) (io.ReaderAt, error) {
+		return cs.ReaderAt(ctx, ocispec.Descriptor{Digest: digest.NewDigestFromEncoded(digest.SHA256, id)})
+	}, cache.NewMemoryCache())
+	if err != nil {
+		t.Fatalf("failed to parse bootstrap: %v", err)
+	}
+	for _, name := range []string{"a/removed", "d/hidden", "a/.wh.removed", estargz.PrefetchLandmark} {
+		if _, ok := r.Lookup(name); ok {
+			t.Errorf("%q must not exist", name)
+		}
+	}
+	if e, ok := r.Lookup("d/sym"); !ok || e.LinkName != "../a/big" {
+		t.Errorf("unexpected d/sym %+v", e)
+	}
+	for name, want := range map[string][]byte{
+		"a/big":  []byte("new"),
+		"a/link": big, // the target was overwritten so the hardlink keeps the lower file
+	} {
+		e, ok := r.Lookup(name)
+		if !ok || e.NumLink != 1 {
+			t.Fatalf("unexpected entry of %q: %+v", name, e)
+		}
+		fr, err := r.OpenFile(name)
+		if err != nil {
+			t.Fatalf("failed to open %q: %v", name, err)
+		}
+		got, err := ioutil.ReadAll(io.NewSectionReader(fr, 0, int64(len(want))))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("contents of %q = %d bytes, %v; want %d bytes", name, len(got), err, len(want))
+		}
+	}
+}
+
+func writeJSON(ctx context.Context, t *testing.T, cs content.Store, mediaType string, x interface{}) ocispec.Descriptor {
+	b, err := json.Marshal(x)
+	if err != nil {
+		t.Fatalf("failed to marshal %s: %v", mediaType, err)
+	}
+	desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(b), Size: int64(len(b))}
+	if err := content.WriteBlob(ctx, cs, "test-"+desc.Digest.String(), bytes.NewReader(b), desc); err != nil {
+		t.Fatalf("failed to write %s: %v", mediaType, err)
+	}
+	return desc
+}
+
+func readJSON(ctx context.Context, t *testing.T, cs content.Store, desc ocispec.Descriptor, x interface{}) {
+	b, err := content.ReadBlob(ctx, cs, desc)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", desc.MediaType, err)
+	}
+	if err := json.Unmarshal(b, x); err != nil {
+		t.Fatalf("failed to parse %s: %v", desc.MediaType, err)
+	}
+}
@@ -0,0 +1,370 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package zstdchunked converts eStargz layers into zstd:chunked layers which
+// are lazily pulled by containers/storage.
+//
+// A zstd:chunked layer is a tar archive compressed with zstd where the
+// contents of each regular file are stored in separated zstd frames. The
+// manifest listing the files with the offsets of their frames is stored in a
+// zstd skippable frame and the footer pointing to the manifest is stored in
+// another skippable frame at the end of the layer. So the layer is also a zstd
+// compressed tar which can be extracted by any zstd decompressor.
+// See also: https://github.com/containers/storage/tree/main/pkg/chunked
+package zstdchunked
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/nativeconverter"
+	"github.com/klauspost/compress/zstd"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	// MediaTypeImageLayerZstd is the media type of zstd compressed layers.
+	MediaTypeImageLayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
+
+	// ManifestChecksumAnnotation is an annotation of the layer storing the
+	// digest of the compressed manifest.
+	ManifestChecksumAnnotation = "io.github.containers.zstd-chunked.manifest-checksum"
+
+	// ManifestPositionAnnotation is an annotation of the layer storing the
+	// position of the manifest as offset:length:uncompressedLength:type.
+	ManifestPositionAnnotation = "io.github.containers.zstd-chunked.manifest-position"
+
+	skippableFrameMagic = 0x184D2A50
+	manifestTypeCRFS    = 1
+	footerSize          = 40
+)
+
+// footerMagic is the magic number at the end of the footer.
+var footerMagic = []byte("GNUlInUx")
+
+// manifest is the manifest of zstd:chunked layers.
+type manifest struct {
+	Version int              `json:"version"`
+	Entries []*manifestEntry `json:"entries"`
+}
+
+type manifestEntry struct {
+	Type      string            `json:"type"`
+	Name      string            `json:"name"`
+	Linkname  string            `json:"linkName,omitempty"`
+	Mode      int64             `json:"mode,omitempty"`
+	Size      int64             `json:"size,omitempty"`
+	UID       int               `json:"uid"`
+	GID       int               `json:"gid"`
+	ModTime   *time.Time        `json:"modtime,omitempty"`
+	Devmajor  int64             `json:"devMajor,omitempty"`
+	Devminor  int64             `json:"devMinor,omitempty"`
+	Xattrs    map[string]string `json:"xattrs,omitempty"`
+	Digest    string            `json:"digest,omitempty"`
+	Offset    int64             `json:"offset,omitempty"`
+	EndOffset int64             `json:"endOffset,omitempty"`
+}
+
+// LayerConvertFunc converts eStargz layers into zstd:chunked layers. The TOC
+// of the eStargz layer is reused as the list of the files and the contents of
+// the files are recompressed with zstd. eStargz-specific landmark files are
+// removed so the diffID changes.
+//
+// Should be used in conjunction with WithDockerToOCI().
+//
+// Otherwise the annotations pointing to the manifest will be lost, because the
+// Docker media type does not support layer annotations.
+func LayerConvertFunc(opts ...zstd.EOption) nativeconverter.ConvertFunc {
+	return func(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+		if !images.IsLayerType(desc.MediaType) {
+			// No conversion. No need to return an error here.
+			return nil, nil
+		}
+		ra, err := cs.ReaderAt(ctx, desc)
+		if err != nil {
+			return nil, err
+		}
+		defer ra.Close()
+		r, err := estargz.Open(io.NewSectionReader(ra, 0, desc.Size))
+		if err != nil {
+			return nil, errors.Wrapf(err, "layer %s isn't eStargz", desc.Digest)
+		}
+		if want, ok := desc.Annotations[estargz.TOCJSONDigestAnnotation]; ok && want != r.TOCDigest().String() {
+			return nil, fmt.Errorf("TOC digest of layer %s doesn't match to %q", desc.Digest, want)
+		}
+
+		info, err := cs.Info(ctx, desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		labels := info.Labels
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		ref := fmt.Sprintf("convert-zstdchunked-from-%s", desc.Digest)
+		w, err := content.OpenWriter(ctx, cs, content.WithRef(ref))
+		if err != nil {
+			return nil, err
+		}
+		defer w.Close()
+		if err := w.Truncate(0); err != nil {
+			return nil, err
+		}
+		res, err := convert(w, r, opts...)
+		if err != nil {
+			return nil, err
+		}
+		// update diffID label
+		labels[nativeconverter.LabelUncompressed] = res.diffID.String()
+		if err = w.Commit(ctx, res.size, "", content.WithLabels(labels)); err != nil && !errdefs.IsAlreadyExists(err) {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		newDesc := desc
+		newDesc.MediaType = MediaTypeImageLayerZstd
+		newDesc.Digest = w.Digest()
+		newDesc.Size = res.size
+		newDesc.Annotations = make(map[string]string, len(desc.Annotations)+2)
+		for k, v := range desc.Annotations {
+			if k != estargz.TOCJSONDigestAnnotation {
+				newDesc.Annotations[k] = v
+			}
+		}
+		newDesc.Annotations[ManifestChecksumAnnotation] = res.manifestDigest.String()
+		newDesc.Annotations[ManifestPositionAnnotation] = fmt.Sprintf("%d:%d:%d:%d",
+			res.manifestOffset, res.manifestSize, res.manifestUncompressedSize, manifestTypeCRFS)
+		return &newDesc, nil
+	}
+}
+
+type result struct {
+	size                     int64
+	diffID                   digest.Digest
+	manifestDigest           digest.Digest
+	manifestOffset           int64
+	manifestSize             int64
+	manifestUncompressedSize int64
+}
+
+// convert writes the zstd:chunked layer of the files in the eStargz layer.
+func convert(w io.Writer, r *estargz.Reader, opts ...zstd.EOption) (*result, error) {
+	tocJSON, err := r.TOCJSON()
+	if err != nil {
+		return nil, err
+	}
+	var toc struct {
+		Entries []*estargz.TOCEntry `json:"entries"`
+	}
+	if err := json.Unmarshal(tocJSON, &toc); err != nil {
+		return nil, err
+	}
+
+	cw := &countWriter{w: w}
+	zw, err := zstd.NewWriter(cw, opts...)
+	if err != nil {
+		return nil, err
+	}
+	diffID := digest.Canonical.Digester()
+	tw := tar.NewWriter(io.MultiWriter(zw, diffID.Hash()))
+	// newFrame ends the current zstd frame and starts a new one.
+	newFrame := func() error {
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		zw.Reset(cw)
+		return nil
+	}
+
+	var m manifest
+	m.Version = 1
+	for _, te := range toc.Entries {
+		name := strings.TrimPrefix(path.Clean("/"+te.Name), "/")
+		if te.Type == "chunk" || estargz.IsLandmark(name) {
+			continue
+		}
+		e := te
+		if te.Type != "hardlink" {
+			// The entry in the reader has normalized fields (e.g. modtime).
+			if e, _ = r.Lookup(name); e == nil {
+				return nil, fmt.Errorf("%q isn't found", name)
+			}
+		}
+		h, me, err := headerOf(te, e, name)
+		if err != nil {
+			return nil, err
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			return nil, err
+		}
+		if h.Typeflag == tar.TypeReg && h.Size > 0 {
+			// The contents are stored in their own frame.
+			if err := newFrame(); err != nil {
+				return nil, err
+			}
+			me.Offset = cw.n
+			sr, err := r.OpenFile(name)
+			if err != nil {
+				return nil, err
+			}
+			dgstr := digest.Canonical.Digester()
+			if _, err := io.Copy(io.MultiWriter(tw, dgstr.Hash()), sr); err != nil {
+				return nil, errors.Wrapf(err, "failed to read %q", name)
+			}
+			if err := newFrame(); err != nil {
+				return nil, err
+			}
+			me.EndOffset = cw.n
+			me.Digest = dgstr.Digest().String()
+		}
+		m.Entries = append(m.Entries, me)
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	manifestJSON, err := json.Marshal(&m)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := zstd.NewWriter(nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	compressedManifest := enc.EncodeAll(manifestJSON, nil)
+	res := &result{
+		diffID:                   diffID.Digest(),
+		manifestDigest:           digest.FromBytes(compressedManifest),
+		manifestOffset:           cw.n + 8, // after the header of the skippable frame
+		manifestSize:             int64(len(compressedManifest)),
+		manifestUncompressedSize: int64(len(manifestJSON)),
+	}
+	if err := writeSkippableFrame(cw, compressedManifest); err != nil {
+		return nil, err
+	}
+	footer := make([]byte, footerSize)
+	binary.LittleEndian.PutUint64(footer[0:], uint64(res.manifestOffset))
+	binary.LittleEndian.PutUint64(footer[8:], uint64(res.manifestSize))
+	binary.LittleEndian.PutUint64(footer[16:], uint64(res.manifestUncompressedSize))
+	binary.LittleEndian.PutUint64(footer[24:], manifestTypeCRFS)
+	copy(footer[32:], footerMagic)
+	if err := writeSkippableFrame(cw, footer); err != nil {
+		return nil, err
+	}
+	res.size = cw.n
+	return res, nil
+}
+
+// headerOf returns the tar header and the manifest entry of the TOCEntry. te
+// is the entry in the TOC and e is the normalized one.
+func headerOf(te, e *estargz.TOCEntry, name string) (*tar.Header, *manifestEntry, error) {
+	h := &tar.Header{
+		Name:     name,
+		Mode:     e.Mode,
+		Uid:      e.UID,
+		Gid:      e.GID,
+		Uname:    e.Uname,
+		Gname:    e.Gname,
+		ModTime:  e.ModTime(),
+		Devmajor: int64(e.DevMajor),
+		Devminor: int64(e.DevMinor),
+		Format:   tar.FormatPAX,
+	}
+	switch te.Type {
+	case "dir":
+		h.Typeflag = tar.TypeDir
+		h.Name += "/"
+	case "reg":
+		h.Typeflag, h.Size = tar.TypeReg, e.Size
+	case "symlink":
+		h.Typeflag, h.Linkname = tar.TypeSymlink, e.LinkName
+	case "hardlink":
+		h.Typeflag, h.Linkname = tar.TypeLink, strings.TrimPrefix(path.Clean("/"+te.LinkName), "/")
+	case "char":
+		h.Typeflag = tar.TypeChar
+	case "block":
+		h.Typeflag = tar.TypeBlock
+	case "fifo":
+		h.Typeflag = tar.TypeFifo
+	default:
+		return nil, nil, fmt.Errorf("unsupported type %q of %q", te.Type, name)
+	}
+	if h.Name == "/" {
+		h.Name = "./"
+	}
+	me := &manifestEntry{
+		Type:     te.Type,
+		Name:     h.Name,
+		Linkname: h.Linkname,
+		Mode:     h.Mode,
+		Size:     h.Size,
+		UID:      h.Uid,
+		GID:      h.Gid,
+		Devmajor: h.Devmajor,
+		Devminor: h.Devminor,
+	}
+	if !h.ModTime.IsZero() {
+		t := h.ModTime.UTC()
+		me.ModTime = &t
+	}
+	if len(e.Xattrs) > 0 && te.Type != "hardlink" {
+		h.PAXRecords = make(map[string]string, len(e.Xattrs))
+		me.Xattrs = make(map[string]string, len(e.Xattrs))
+		for k, v := range e.Xattrs {
+			h.PAXRecords["SCHILY.xattr."+k] = string(v)
+			me.Xattrs[k] = base64.StdEncoding.EncodeToString(v)
+		}
+	}
+	return h, me, nil
+}
+
+func writeSkippableFrame(w io.Writer, data []byte) error {
+	header := make([]byte, 8)
+	binary.LittleEndian.PutUint32(header[0:], skippableFrameMagic)
+	binary.LittleEndian.PutUint32(header[4:], uint32(len(data)))
+	_, err := io.Copy(w, io.MultiReader(bytes.NewReader(header), bytes.NewReader(data)))
+	return err
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (n int, err error) {
+	n, err = cw.w.Write(p)
+	cw.n += int64(n)
+	return
+}
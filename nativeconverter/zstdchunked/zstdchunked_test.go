@@ -0,0 +1,147 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package zstdchunked
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/nativeconverter"
+	"github.com/containerd/stargz-snapshotter/util/testutil"
+	"github.com/klauspost/compress/zstd"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// TestLayerConvertFunc tests zstd:chunked conversion of an eStargz layer.
+func TestLayerConvertFunc(t *testing.T) {
+	ctx := context.Background()
+	tempDir, err := ioutil.TempDir("", "test-zstdchunked")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	cs, err := testutil.NewContentStore(tempDir)
+	if err != nil {
+		t.Fatalf("failed to create content store: %v", err)
+	}
+
+	big := bytes.Repeat([]byte("0123456789"), 1000)
+	desc, err := testutil.WriteEStargz(ctx, cs, []testutil.EStargzEntry{
+		{Header: &tar.Header{Typeflag: tar.TypeDir, Name: "a/", Mode: 0755}},
+		{Header: &tar.Header{Typeflag: tar.TypeReg, Name: "a/big", Mode: 0644, Uid: 1, Gid: 2,
+			PAXRecords: map[string]string{"SCHILY.xattr.user.foo": "bar"}}, Contents: big},
+		{Header: &tar.Header{Typeflag: tar.TypeReg, Name: estargz.PrefetchLandmark, Mode: 0644}, Contents: []byte{0xf}},
+		{Header: &tar.Header{Typeflag: tar.TypeLink, Name: "a/link", Linkname: "a/big"}},
+		{Header: &tar.Header{Typeflag: tar.TypeSymlink, Name: "sym", Linkname: "a/big", Mode: 0777}},
+		{Header: &tar.Header{Typeflag: tar.TypeReg, Name: "empty", Mode: 0644}},
+	}, 4096)
+	if err != nil {
+		t.Fatalf("failed to write eStargz layer: %v", err)
+	}
+	newDesc, err := LayerConvertFunc()(ctx, cs, desc)
+	if err != nil {
+		t.Fatalf("failed to convert layer: %v", err)
+	}
+	if newDesc.MediaType != MediaTypeImageLayerZstd {
+		t.Errorf("media type = %q; want %q", newDesc.MediaType, MediaTypeImageLayerZstd)
+	}
+	blob, err := content.ReadBlob(ctx, cs, *newDesc)
+	if err != nil {
+		t.Fatalf("failed to read converted layer: %v", err)
+	}
+
+	// The layer is a valid zstd compressed tar.
+	zr, err := zstd.NewReader(bytes.NewReader(blob))
+	if err != nil {
+		t.Fatalf("failed to create zstd reader: %v", err)
+	}
+	defer zr.Close()
+	uncompressed, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("failed to decompress layer: %v", err)
+	}
+	diffID, err := nativeconverter.GetDiffID(ctx, cs, *newDesc)
+	if err != nil || diffID != digest.FromBytes(uncompressed) {
+		t.Errorf("diffID = %q, %v; want %q", diffID, err, digest.FromBytes(uncompressed))
+	}
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(uncompressed))
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("failed to read tar: %v", err)
+		}
+		names = append(names, h.Name)
+		if h.Name == "a/big" {
+			got, err := ioutil.ReadAll(tr)
+			if err != nil || !bytes.Equal(got, big) || h.Uid != 1 || h.Gid != 2 || h.PAXRecords["SCHILY.xattr.user.foo"] != "bar" {
+				t.Errorf("unexpected a/big: %+v, %d bytes, %v", h, len(got), err)
+			}
+		}
+	}
+	if fmt.Sprint(names) != "[a/ a/big a/link sym empty]" {
+		t.Errorf("unexpected entries %v", names)
+	}
+
+	// The footer and the annotations point to the manifest.
+	footer := blob[len(blob)-footerSize:]
+	if !bytes.Equal(footer[32:], footerMagic) {
+		t.Fatalf("invalid footer magic %q", footer[32:])
+	}
+	off, size := binary.LittleEndian.Uint64(footer[0:]), binary.LittleEndian.Uint64(footer[8:])
+	if pos := fmt.Sprintf("%d:%d:%d:1", off, size, binary.LittleEndian.Uint64(footer[16:])); newDesc.Annotations[ManifestPositionAnnotation] != pos {
+		t.Errorf("manifest position = %q; want %q", newDesc.Annotations[ManifestPositionAnnotation], pos)
+	}
+	compressedManifest := blob[off : off+size]
+	if d := digest.FromBytes(compressedManifest).String(); newDesc.Annotations[ManifestChecksumAnnotation] != d {
+		t.Errorf("manifest checksum = %q; want %q", newDesc.Annotations[ManifestChecksumAnnotation], d)
+	}
+	manifestJSON, err := zr.DecodeAll(compressedManifest, nil)
+	if err != nil {
+		t.Fatalf("failed to decompress manifest: %v", err)
+	}
+	var m manifest
+	if err := json.Unmarshal(manifestJSON, &m); err != nil {
+		t.Fatalf("failed to parse manifest: %v", err)
+	}
+	if len(m.Entries) != 5 {
+		t.Fatalf("manifest has %d entries; want 5", len(m.Entries))
+	}
+	e := m.Entries[1]
+	if e.Name != "a/big" || e.Digest != digest.FromBytes(big).String() || e.Xattrs["user.foo"] != "YmFy" {
+		t.Errorf("unexpected manifest entry %+v", e)
+	}
+	got, err := zr.DecodeAll(blob[e.Offset:e.EndOffset], nil)
+	if err != nil || !bytes.Equal(got, big) {
+		t.Errorf("frame of a/big has %d bytes, %v; want %d bytes", len(got), err, len(big))
+	}
+	if l := m.Entries[2]; l.Type != "hardlink" || l.Linkname != "a/big" {
+		t.Errorf("unexpected hardlink %+v", l)
+	}
+}
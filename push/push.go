@@ -0,0 +1,650 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package push provides a pusher of images which uploads blobs in parallel.
+// Each blob is uploaded in chunks so a failed upload can resume from the data
+// the registry has already received.
+package push
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+)
+
+const (
+	defaultConcurrency = 4
+	defaultChunkSize   = 32 << 20
+	defaultRetries     = 3
+	maxRetryWait       = 30 * time.Second
+
+	distributionSourceLabel = "containerd.io/distribution.source."
+)
+
+// retryWait is the duration to wait before the first retry. This doubles on
+// each retry.
+var retryWait = time.Second
+
+type options struct {
+	concurrency int
+	chunkSize   int64
+	retries     int
+	mountFrom   []string
+	progress    func(desc ocispec.Descriptor, state string)
+}
+
+type Option func(*options)
+
+// WithConcurrency specifies the maximum number of blobs uploaded in parallel.
+// Defaults to 4.
+func WithConcurrency(n int) Option {
+	return func(opts *options) {
+		opts.concurrency = n
+	}
+}
+
+// WithChunkSize specifies the size of each chunk uploaded in a request. Negative
+// value uploads each blob in a request. Defaults to 32MiB.
+func WithChunkSize(size int64) Option {
+	return func(opts *options) {
+		opts.chunkSize = size
+	}
+}
+
+// WithRetries specifies the number of retries of a request failed with 5xx
+// status or a network error. Negative value disables retries. Defaults to 3.
+func WithRetries(n int) Option {
+	return func(opts *options) {
+		opts.retries = n
+	}
+}
+
+// WithMountFrom specifies repositories in the same registry from which blobs
+// are tried to be mounted (cross-repository blob mount) before uploading. The
+// repositories recorded in "containerd.io/distribution.source" labels of the
+// content are also tried.
+func WithMountFrom(repos ...string) Option {
+	return func(opts *options) {
+		opts.mountFrom = append(opts.mountFrom, repos...)
+	}
+}
+
+// WithProgress specifies the function called when the state of pushing a
+// content changes. state is one of "pushing", "exists", "mounted" and "done".
+func WithProgress(f func(desc ocispec.Descriptor, state string)) Option {
+	return func(opts *options) {
+		opts.progress = f
+	}
+}
+
+// Pusher pushes images to registries.
+type Pusher struct {
+	hosts docker.RegistryHosts
+	opts  options
+}
+
+// NewPusher returns a pusher which connects to registries provided by hosts.
+func NewPusher(hosts docker.RegistryHosts, opts ...Option) *Pusher {
+	p := &Pusher{hosts: hosts}
+	for _, o := range opts {
+		o(&p.opts)
+	}
+	if p.opts.concurrency <= 0 {
+		p.opts.concurrency = defaultConcurrency
+	}
+	if p.opts.chunkSize == 0 {
+		p.opts.chunkSize = defaultChunkSize
+	}
+	if p.opts.retries < 0 {
+		p.opts.retries = 0
+	} else if p.opts.retries == 0 {
+		p.opts.retries = defaultRetries
+	}
+	return p
+}
+
+// Push pushes the content described by desc and its children to ref. Children
+// are pushed before their parents so that the registry never sees a manifest
+// referring to missing blobs.
+func (p *Pusher) Push(ctx context.Context, ref string, provider content.Provider, desc ocispec.Descriptor) error {
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse reference %q", ref)
+	}
+	reghosts, err := p.hosts(refspec.Hostname())
+	if err != nil {
+		return err
+	}
+	var host *docker.RegistryHost
+	for i := range reghosts {
+		if reghosts[i].Capabilities.Has(docker.HostCapabilityPush) {
+			host = &reghosts[i]
+			break
+		}
+	}
+	if host == nil {
+		return fmt.Errorf("no host with push capability for %q", refspec.Hostname())
+	}
+	ctx, err = docker.ContextWithRepositoryScope(ctx, refspec, true)
+	if err != nil {
+		return err
+	}
+	tag := refspec.Object
+	if i := strings.Index(tag, "@"); i >= 0 {
+		tag = tag[:i]
+	}
+	s := &pushState{
+		p:        p,
+		r:        newRegistry(host, strings.TrimPrefix(refspec.Locator, refspec.Hostname()+"/"), p.opts.retries),
+		hostname: refspec.Hostname(),
+		provider: provider,
+		sem:      semaphore.NewWeighted(int64(p.opts.concurrency)),
+		jobs:     make(map[digest.Digest]*pushJob),
+	}
+	return s.push(ctx, desc, tag)
+}
+
+type pushState struct {
+	p        *Pusher
+	r        *registry
+	hostname string
+	provider content.Provider
+	sem      *semaphore.Weighted
+	jobs     map[digest.Digest]*pushJob
+	mu       sync.Mutex
+}
+
+type pushJob struct {
+	done chan struct{}
+	err  error
+}
+
+// push pushes the content once even if it's referred from several parents.
+func (s *pushState) push(ctx context.Context, desc ocispec.Descriptor, tag string) error {
+	s.mu.Lock()
+	if j, ok := s.jobs[desc.Digest]; ok {
+		s.mu.Unlock()
+		select {
+		case <-j.done:
+			return j.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	j := &pushJob{done: make(chan struct{})}
+	s.jobs[desc.Digest] = j
+	s.mu.Unlock()
+
+	j.err = s.pushContent(ctx, desc, tag)
+	close(j.done)
+	return j.err
+}
+
+func (s *pushState) pushContent(ctx context.Context, desc ocispec.Descriptor, tag string) error {
+	switch desc.MediaType {
+	case images.MediaTypeDockerSchema2Manifest, ocispec.MediaTypeImageManifest,
+		images.MediaTypeDockerSchema2ManifestList, ocispec.MediaTypeImageIndex:
+	default:
+		if err := s.sem.Acquire(ctx, 1); err != nil {
+			return err
+		}
+		defer s.sem.Release(1)
+		return s.pushBlob(ctx, desc)
+	}
+
+	children, err := images.Children(ctx, s.provider, desc)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get children of %v", desc.Digest)
+	}
+	eg, egCtx := errgroup.WithContext(ctx)
+	for _, c := range children {
+		c := c
+		eg.Go(func() error {
+			return s.push(egCtx, c, "")
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+	s.progress(desc, "pushing")
+	data, err := content.ReadBlob(ctx, s.provider, desc)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read manifest %v", desc.Digest)
+	}
+	if tag == "" {
+		tag = desc.Digest.String()
+	}
+	if err := s.r.putManifest(ctx, desc.MediaType, tag, data); err != nil {
+		return errors.Wrapf(err, "failed to push manifest %v", desc.Digest)
+	}
+	s.progress(desc, "done")
+	return nil
+}
+
+func (s *pushState) pushBlob(ctx context.Context, desc ocispec.Descriptor) error {
+	if ok, err := s.r.exists(ctx, desc.Digest); err != nil {
+		return errors.Wrapf(err, "failed to check existence of %v", desc.Digest)
+	} else if ok {
+		s.progress(desc, "exists")
+		return nil
+	}
+	s.progress(desc, "pushing")
+
+	var loc string
+	for _, from := range s.mountSources(ctx, desc) {
+		mounted, l, err := s.r.mount(ctx, desc.Digest, from)
+		if err != nil {
+			log.G(ctx).WithError(err).Debugf("failed to mount %v from %q", desc.Digest, from)
+			continue
+		}
+		if mounted {
+			s.progress(desc, "mounted")
+			return nil
+		}
+		loc = l // the registry started an upload instead
+		break
+	}
+	if loc == "" {
+		var err error
+		if loc, err = s.r.startUpload(ctx); err != nil {
+			return errors.Wrapf(err, "failed to start upload of %v", desc.Digest)
+		}
+	}
+
+	ra, err := s.provider.ReaderAt(ctx, desc)
+	if err != nil {
+		return err
+	}
+	defer ra.Close()
+	chunkSize := s.p.opts.chunkSize
+	if chunkSize < 0 {
+		chunkSize = desc.Size
+	}
+	for offset := int64(0); offset < desc.Size; {
+		end := offset + chunkSize
+		if end > desc.Size {
+			end = desc.Size
+		}
+		for i := 0; ; i++ {
+			next, err := s.r.patch(ctx, loc, ra, offset, end)
+			if err == nil {
+				loc, offset = next, end
+				break
+			}
+			if !isRetryable(err) || i >= s.r.retries {
+				return errors.Wrapf(err, "failed to upload %v", desc.Digest)
+			}
+			log.G(ctx).WithError(err).Debugf("retrying upload of %v from %d", desc.Digest, offset)
+			if err := wait(ctx, i); err != nil {
+				return err
+			}
+			// Resume from the data the registry has already received.
+			if received, l, err := s.r.uploadStatus(ctx, loc); err == nil {
+				if received > desc.Size {
+					received = desc.Size
+				}
+				loc, offset = l, received
+				if end = offset + chunkSize; end > desc.Size {
+					end = desc.Size
+				}
+			}
+		}
+	}
+	if err := s.r.commit(ctx, loc, desc.Digest); err != nil {
+		return errors.Wrapf(err, "failed to commit upload of %v", desc.Digest)
+	}
+	s.progress(desc, "done")
+	return nil
+}
+
+// mountSources returns repositories from which the blob can be mounted.
+func (s *pushState) mountSources(ctx context.Context, desc ocispec.Descriptor) (repos []string) {
+	seen := map[string]struct{}{s.r.repo: {}}
+	add := func(r string) {
+		if _, ok := seen[r]; !ok && r != "" {
+			seen[r] = struct{}{}
+			repos = append(repos, r)
+		}
+	}
+	for _, r := range s.p.opts.mountFrom {
+		add(r)
+	}
+	if ip, ok := s.provider.(interface {
+		Info(context.Context, digest.Digest) (content.Info, error)
+	}); ok {
+		if info, err := ip.Info(ctx, desc.Digest); err == nil {
+			for _, r := range strings.Split(info.Labels[distributionSourceLabel+s.hostname], ",") {
+				add(r)
+			}
+		}
+	}
+	return
+}
+
+func (s *pushState) progress(desc ocispec.Descriptor, state string) {
+	if s.p.opts.progress != nil {
+		s.p.opts.progress(desc, state)
+	}
+}
+
+// registry talks to the repository of a registry host with the distribution
+// API.
+type registry struct {
+	host    *docker.RegistryHost
+	client  *http.Client
+	repo    string
+	retries int
+}
+
+func newRegistry(host *docker.RegistryHost, repo string, retries int) *registry {
+	client := host.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &registry{host: host, client: client, repo: repo, retries: retries}
+}
+
+func (r *registry) url(format string, a ...interface{}) string {
+	return fmt.Sprintf("%s://%s/", r.host.Scheme, path.Join(r.host.Host, r.host.Path, r.repo)) +
+		fmt.Sprintf(format, a...)
+}
+
+func (r *registry) exists(ctx context.Context, dgst digest.Digest) (ok bool, err error) {
+	err = r.retry(ctx, func() error {
+		resp, err := r.do(ctx, "HEAD", r.url("blobs/%s", dgst), nil, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK:
+			ok = true
+		case http.StatusNotFound:
+			ok = false
+		default:
+			return newStatusError(resp)
+		}
+		return nil
+	})
+	return
+}
+
+func (r *registry) mount(ctx context.Context, dgst digest.Digest, from string) (mounted bool, loc string, err error) {
+	ctx = docker.ContextWithAppendPullRepositoryScope(ctx, from)
+	u := r.url("blobs/uploads/?mount=%s&from=%s", url.QueryEscape(dgst.String()), url.QueryEscape(from))
+	resp, err := r.do(ctx, "POST", u, nil, nil)
+	if err != nil {
+		return false, "", err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return true, "", nil
+	case http.StatusAccepted:
+		l, err := resp.Location()
+		if err != nil {
+			return false, "", err
+		}
+		return false, l.String(), nil
+	}
+	return false, "", newStatusError(resp)
+}
+
+func (r *registry) startUpload(ctx context.Context) (loc string, err error) {
+	err = r.retry(ctx, func() error {
+		resp, err := r.do(ctx, "POST", r.url("blobs/uploads/"), nil, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			return newStatusError(resp)
+		}
+		l, err := resp.Location()
+		if err != nil {
+			return err
+		}
+		loc = l.String()
+		return nil
+	})
+	return
+}
+
+// patch uploads the range [offset, end) of the blob and returns the location
+// of the next chunk.
+func (r *registry) patch(ctx context.Context, loc string, ra io.ReaderAt, offset, end int64) (string, error) {
+	body := func() io.Reader { return io.NewSectionReader(ra, offset, end-offset) }
+	resp, err := r.do(ctx, "PATCH", loc, body, http.Header{
+		"Content-Type":   {"application/octet-stream"},
+		"Content-Range":  {fmt.Sprintf("%d-%d", offset, end-1)},
+		"Content-Length": {strconv.FormatInt(end-offset, 10)},
+	})
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusNoContent {
+		return "", newStatusError(resp)
+	}
+	return nextLocation(resp, loc)
+}
+
+// uploadStatus returns the size of the data received by the registry.
+func (r *registry) uploadStatus(ctx context.Context, loc string) (int64, string, error) {
+	resp, err := r.do(ctx, "GET", loc, nil, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return 0, "", newStatusError(resp)
+	}
+	next, err := nextLocation(resp, loc)
+	if err != nil {
+		return 0, "", err
+	}
+	rng := resp.Header.Get("Range") // e.g. "0-1023"
+	if rng == "" {
+		return 0, next, nil
+	}
+	i := strings.Index(rng, "-")
+	if i < 0 {
+		return 0, "", fmt.Errorf("invalid range %q", rng)
+	}
+	last, err := strconv.ParseInt(strings.TrimPrefix(rng[i+1:], " "), 10, 64)
+	if err != nil {
+		return 0, "", errors.Wrapf(err, "invalid range %q", rng)
+	}
+	return last + 1, next, nil
+}
+
+func (r *registry) commit(ctx context.Context, loc string, dgst digest.Digest) error {
+	u, err := url.Parse(loc)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("digest", dgst.String())
+	u.RawQuery = q.Encode()
+	return r.retry(ctx, func() error {
+		resp, err := r.do(ctx, "PUT", u.String(), nil, http.Header{"Content-Length": {"0"}})
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
+			return newStatusError(resp)
+		}
+		return nil
+	})
+}
+
+func (r *registry) putManifest(ctx context.Context, mediaType, ref string, data []byte) error {
+	return r.retry(ctx, func() error {
+		resp, err := r.do(ctx, "PUT", r.url("manifests/%s", ref), func() io.Reader {
+			return bytes.NewReader(data)
+		}, http.Header{
+			"Content-Type":   {mediaType},
+			"Content-Length": {strconv.Itoa(len(data))},
+		})
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+			return newStatusError(resp)
+		}
+		return nil
+	})
+}
+
+// do sends the request with authorization. body is called every time the
+// request is sent.
+func (r *registry) do(ctx context.Context, method, u string, body func() io.Reader, header http.Header) (*http.Response, error) {
+	send := func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, method, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if body != nil {
+			req.Body = ioutil.NopCloser(body())
+			req.GetBody = func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(body()), nil
+			}
+			if cl := header.Get("Content-Length"); cl != "" {
+				if req.ContentLength, err = strconv.ParseInt(cl, 10, 64); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if r.host.Authorizer != nil {
+			if err := r.host.Authorizer.Authorize(ctx, req); err != nil {
+				return nil, err
+			}
+		}
+		resp, err := r.client.Do(req)
+		if err != nil {
+			return nil, retryableError{err}
+		}
+		return resp, nil
+	}
+	resp, err := send()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized && r.host.Authorizer != nil {
+		if err := r.host.Authorizer.AddResponses(ctx, []*http.Response{resp}); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		resp.Body.Close()
+		return send()
+	}
+	return resp, nil
+}
+
+func (r *registry) retry(ctx context.Context, f func() error) error {
+	for i := 0; ; i++ {
+		err := f()
+		if err == nil || !isRetryable(err) || i >= r.retries {
+			return err
+		}
+		log.G(ctx).WithError(err).Debug("retrying request")
+		if err := wait(ctx, i); err != nil {
+			return err
+		}
+	}
+}
+
+func wait(ctx context.Context, attempt int) error {
+	d := retryWait << uint(attempt)
+	if d > maxRetryWait {
+		d = maxRetryWait
+	}
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func nextLocation(resp *http.Response, cur string) (string, error) {
+	if resp.Header.Get("Location") == "" {
+		return cur, nil
+	}
+	l, err := resp.Location()
+	if err != nil {
+		return "", err
+	}
+	return l.String(), nil
+}
+
+type statusError struct {
+	method string
+	url    string
+	status int
+}
+
+func newStatusError(resp *http.Response) error {
+	return statusError{
+		method: resp.Request.Method,
+		url:    resp.Request.URL.Scheme + "://" + resp.Request.URL.Host + resp.Request.URL.Path,
+		status: resp.StatusCode,
+	}
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("unexpected status %d on %s %s", e.status, e.method, e.url)
+}
+
+// retryableError is an error of sending a request (e.g. connection reset).
+type retryableError struct {
+	error
+}
+
+func isRetryable(err error) bool {
+	switch e := err.(type) {
+	case statusError:
+		return e.status >= 500
+	case retryableError:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,333 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package push
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/remotes/docker"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestPush(t *testing.T) {
+	retryWait = time.Millisecond
+	ctx := context.Background()
+	tmp, err := ioutil.TempDir("", "testpush")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	cs, err := local.NewLabeledStore(tmp, &labelStore{labels: make(map[digest.Digest]map[string]string)})
+	if err != nil {
+		t.Fatalf("failed to make content store: %v", err)
+	}
+
+	reg := newTestRegistry()
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	// The base layer exists in another repository and is mounted from it.
+	base := randomBytes(t, 1000)
+	reg.blobs["library/base"] = map[digest.Digest][]byte{digest.FromBytes(base): base}
+	baseDesc := writeContent(ctx, t, cs, images.MediaTypeDockerSchema2LayerGzip, base, map[string]string{
+		distributionSourceLabel + host: "library/base",
+	})
+	layer := randomBytes(t, 100*1024)
+	layerDesc := writeContent(ctx, t, cs, images.MediaTypeDockerSchema2LayerGzip, layer, nil)
+	configDesc := writeContent(ctx, t, cs, images.MediaTypeDockerSchema2Config, []byte("{}"), nil)
+	manifest, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    configDesc,
+		Layers:    []ocispec.Descriptor{baseDesc, layerDesc},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal manifest: %v", err)
+	}
+	manifestDesc := writeContent(ctx, t, cs, ocispec.MediaTypeImageManifest, manifest, nil)
+	index, err := json.Marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []ocispec.Descriptor{manifestDesc},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal index: %v", err)
+	}
+	indexDesc := writeContent(ctx, t, cs, ocispec.MediaTypeImageIndex, index, nil)
+
+	// The registry receives only a part of a chunk and fails.
+	reg.failPatch = 3
+	reg.failManifest = 1
+
+	var states []string
+	var statesMu sync.Mutex
+	p := NewPusher(docker.ConfigureDefaultRegistries(docker.WithPlainHTTP(docker.MatchAllHosts)),
+		WithChunkSize(16*1024),
+		WithProgress(func(desc ocispec.Descriptor, state string) {
+			statesMu.Lock()
+			states = append(states, desc.Digest.String()+" "+state)
+			statesMu.Unlock()
+		}))
+	if err := p.Push(ctx, host+"/test/image:v1", cs, indexDesc); err != nil {
+		t.Fatalf("failed to push: %v", err)
+	}
+
+	repo := reg.blobs["test/image"]
+	for _, d := range []ocispec.Descriptor{baseDesc, layerDesc, configDesc} {
+		data, err := content.ReadBlob(ctx, cs, d)
+		if err != nil {
+			t.Fatalf("failed to read blob: %v", err)
+		}
+		if !bytes.Equal(repo[d.Digest], data) {
+			t.Errorf("blob %v isn't pushed correctly", d.Digest)
+		}
+	}
+	if !bytes.Equal(reg.manifests["test/image"]["v1"], index) {
+		t.Errorf("index isn't pushed with the tag")
+	}
+	if !bytes.Equal(reg.manifests["test/image"][manifestDesc.Digest.String()], manifest) {
+		t.Errorf("manifest isn't pushed by digest")
+	}
+	if !contains(states, baseDesc.Digest.String()+" mounted") {
+		t.Errorf("base layer must be mounted: %v", states)
+	}
+	if n := reg.committed[layerDesc.Digest]; n < 100/16+1 {
+		t.Errorf("layer must be uploaded in chunks: %d requests", n)
+	}
+	if reg.failPatch != 0 || reg.failManifest != 0 {
+		t.Errorf("failures must be injected")
+	}
+
+	// Existing blobs aren't pushed again.
+	states = nil
+	if err := p.Push(ctx, host+"/test/image:v2", cs, manifestDesc); err != nil {
+		t.Fatalf("failed to push: %v", err)
+	}
+	for _, d := range []ocispec.Descriptor{baseDesc, layerDesc, configDesc} {
+		if !contains(states, d.Digest.String()+" exists") {
+			t.Errorf("blob %v must be skipped: %v", d.Digest, states)
+		}
+	}
+}
+
+type labelStore struct {
+	labels map[digest.Digest]map[string]string
+	mu     sync.Mutex
+}
+
+func (s *labelStore) Get(d digest.Digest) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.labels[d], nil
+}
+
+func (s *labelStore) Set(d digest.Digest, labels map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.labels[d] = labels
+	return nil
+}
+
+func (s *labelStore) Update(d digest.Digest, update map[string]string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	labels := s.labels[d]
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	for k, v := range update {
+		if v == "" {
+			delete(labels, k)
+		} else {
+			labels[k] = v
+		}
+	}
+	s.labels[d] = labels
+	return labels, nil
+}
+
+func contains(a []string, s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatalf("failed to read random bytes: %v", err)
+	}
+	return b
+}
+
+func writeContent(ctx context.Context, t *testing.T, cs content.Store, mediaType string, data []byte, labels map[string]string) ocispec.Descriptor {
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	if err := content.WriteBlob(ctx, cs, desc.Digest.String(), bytes.NewReader(data), desc, content.WithLabels(labels)); err != nil {
+		t.Fatalf("failed to write content: %v", err)
+	}
+	return desc
+}
+
+var (
+	uploadsPath   = regexp.MustCompile(`^/v2/(.+)/blobs/uploads/$`)
+	uploadPath    = regexp.MustCompile(`^/v2/(.+)/blobs/uploads/([0-9]+)$`)
+	blobPath      = regexp.MustCompile(`^/v2/(.+)/blobs/(sha256:[0-9a-f]+)$`)
+	manifestsPath = regexp.MustCompile(`^/v2/(.+)/manifests/(.+)$`)
+)
+
+// testRegistry is a minimal registry supporting the uploads of the distribution
+// API.
+type testRegistry struct {
+	blobs     map[string]map[digest.Digest][]byte
+	manifests map[string]map[string][]byte
+	uploads   map[string]*bytes.Buffer
+	patches   map[string]int        // upload -> number of PATCH requests
+	committed map[digest.Digest]int // blob -> number of PATCH requests
+	nextID    int
+
+	failPatch    int // the PATCH request which fails after receiving a half
+	failManifest int // the number of manifest PUTs which fail
+	mu           sync.Mutex
+}
+
+func newTestRegistry() *testRegistry {
+	return &testRegistry{
+		blobs:     make(map[string]map[digest.Digest][]byte),
+		manifests: make(map[string]map[string][]byte),
+		uploads:   make(map[string]*bytes.Buffer),
+		patches:   make(map[string]int),
+		committed: make(map[digest.Digest]int),
+	}
+}
+
+func (r *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	body, _ := ioutil.ReadAll(req.Body)
+	switch p := req.URL.Path; {
+	case req.Method == "POST" && uploadsPath.MatchString(p):
+		repo := uploadsPath.FindStringSubmatch(p)[1]
+		if m := req.URL.Query().Get("mount"); m != "" {
+			if data, ok := r.blobs[req.URL.Query().Get("from")][digest.Digest(m)]; ok {
+				r.putBlob(repo, digest.Digest(m), data)
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+		}
+		r.nextID++
+		id := fmt.Sprintf("%d", r.nextID)
+		r.uploads[id] = new(bytes.Buffer)
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", repo, id))
+		w.WriteHeader(http.StatusAccepted)
+	case uploadPath.MatchString(p):
+		m := uploadPath.FindStringSubmatch(p)
+		buf, ok := r.uploads[m[2]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch req.Method {
+		case "PATCH":
+			var start, end int
+			if _, err := fmt.Sscanf(req.Header.Get("Content-Range"), "%d-%d", &start, &end); err != nil || start != buf.Len() || end-start+1 != len(body) {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			r.patches[m[2]]++
+			if r.failPatch > 0 {
+				if r.failPatch--; r.failPatch == 0 {
+					buf.Write(body[:len(body)/2])
+					w.WriteHeader(http.StatusBadGateway)
+					return
+				}
+			}
+			buf.Write(body)
+			w.Header().Set("Location", p)
+			w.Header().Set("Range", fmt.Sprintf("0-%d", buf.Len()-1))
+			w.WriteHeader(http.StatusAccepted)
+		case "GET":
+			if buf.Len() > 0 {
+				w.Header().Set("Range", fmt.Sprintf("0-%d", buf.Len()-1))
+			}
+			w.Header().Set("Location", p)
+			w.WriteHeader(http.StatusNoContent)
+		case "PUT":
+			dgst := digest.Digest(req.URL.Query().Get("digest"))
+			buf.Write(body)
+			if digest.FromBytes(buf.Bytes()) != dgst {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			r.putBlob(m[1], dgst, buf.Bytes())
+			r.committed[dgst] = r.patches[m[2]]
+			delete(r.uploads, m[2])
+			w.WriteHeader(http.StatusCreated)
+		}
+	case req.Method == "HEAD" && blobPath.MatchString(p):
+		m := blobPath.FindStringSubmatch(p)
+		if _, ok := r.blobs[m[1]][digest.Digest(m[2])]; ok {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	case req.Method == "PUT" && manifestsPath.MatchString(p):
+		if r.failManifest > 0 {
+			r.failManifest--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		m := manifestsPath.FindStringSubmatch(p)
+		if r.manifests[m[1]] == nil {
+			r.manifests[m[1]] = make(map[string][]byte)
+		}
+		r.manifests[m[1]][m[2]] = body
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (r *testRegistry) putBlob(repo string, dgst digest.Digest, data []byte) {
+	if r.blobs[repo] == nil {
+		r.blobs[repo] = make(map[digest.Digest][]byte)
+	}
+	r.blobs[repo][dgst] = append([]byte{}, data...)
+}
@@ -0,0 +1,96 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/containerd/containerd/log"
+)
+
+// metadataImageSuffix is the suffix of metadata images written next to the
+// mountpoints in the composefs mode. They are attached to loop devices while
+// mounted.
+const metadataImageSuffix = ".erofs"
+
+// CleanupDir is a directory of a removed or abandoned snapshot.
+type CleanupDir struct {
+	Path string `json:"path"`
+
+	// Size is the disk usage of the directory. The layer mounted on the
+	// directory (if any) isn't counted.
+	Size int64 `json:"size"`
+
+	// Images are the metadata images in the directory, which are detached
+	// from loop devices on cleanup.
+	Images []string `json:"images,omitempty"`
+}
+
+// CleanupDirs reports directories of removed or abandoned snapshots and
+// removes them unless dryRun is true. This is the same as Cleanup but reports
+// what is (or would be) removed.
+func (o *snapshotter) CleanupDirs(ctx context.Context, dryRun bool) ([]CleanupDir, error) {
+	dirs, err := o.cleanupDirectories(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	res := []CleanupDir{}
+	for _, dir := range dirs {
+		d, err := scanCleanupDir(dir)
+		if err != nil {
+			log.G(ctx).WithError(err).WithField("path", dir).Warn("failed to scan directory")
+		}
+		if !dryRun {
+			if err := o.cleanupSnapshotDirectory(ctx, dir); err != nil {
+				log.G(ctx).WithError(err).WithField("path", dir).Warn("failed to remove directory")
+				continue
+			}
+		}
+		res = append(res, d)
+	}
+	return res, nil
+}
+
+// scanCleanupDir walks the directory without crossing mountpoints because
+// walking the remote layer possibly mounted on it fetches the contents.
+func scanCleanupDir(dir string) (CleanupDir, error) {
+	d := CleanupDir{Path: dir}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return d, err
+	}
+	dev := fi.Sys().(*syscall.Stat_t).Dev
+	err = filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+		if st.Dev != dev {
+			return filepath.SkipDir
+		}
+		d.Size += st.Blocks * 512
+		if fi.Mode().IsRegular() && strings.HasSuffix(p, metadataImageSuffix) {
+			d.Images = append(d.Images, p)
+		}
+		return nil
+	})
+	return d, err
+}
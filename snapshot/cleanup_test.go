@@ -0,0 +1,65 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestCleanupDirs tests directories of abandoned snapshots are reported with
+// their metadata images and removed only if it isn't a dry run.
+func TestCleanupDirs(t *testing.T) {
+	root, err := ioutil.TempDir("", "cleanup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	sn, err := NewSnapshotter(context.TODO(), root, dummyFileSystem())
+	if err != nil {
+		t.Fatalf("failed to create snapshotter: %v", err)
+	}
+	defer sn.Close()
+	if _, err := sn.Prepare(context.TODO(), "active", ""); err != nil {
+		t.Fatalf("failed to prepare snapshot: %v", err)
+	}
+	orphan := filepath.Join(root, "snapshots", "orphan")
+	if err := os.MkdirAll(filepath.Join(orphan, "fs"), 0700); err != nil {
+		t.Fatalf("failed to create dir: %v", err)
+	}
+	image := filepath.Join(orphan, "fs"+metadataImageSuffix)
+	if err := ioutil.WriteFile(image, make([]byte, 8192), 0600); err != nil {
+		t.Fatalf("failed to write image: %v", err)
+	}
+
+	o := sn.(*snapshotter)
+	for _, dryRun := range []bool{true, false} {
+		dirs, err := o.CleanupDirs(context.TODO(), dryRun)
+		if err != nil {
+			t.Fatalf("failed to clean up: %v", err)
+		}
+		if len(dirs) != 1 || dirs[0].Path != orphan || dirs[0].Size < 8192 || len(dirs[0].Images) != 1 || dirs[0].Images[0] != image {
+			t.Errorf("unexpected directories %+v (dry run: %v)", dirs, dryRun)
+		}
+		if _, err := os.Stat(orphan); dryRun != (err == nil) {
+			t.Errorf("unexpected existence of the directory (dry run: %v): %v", dryRun, err)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	whiteoutPrefix    = ".wh."
+	whiteoutOpaqueDir = whiteoutPrefix + whiteoutPrefix + ".opq"
+	opaqueXattr       = "trusted.overlay.opaque"
+	overlayXattrs     = "trusted.overlay."
+	userOpaqueXattr   = "user.overlay.opaque" // overlayfs with "userxattr" (e.g. rootless)
+	userOverlayXattrs = "user.overlay."
+	paxSchilyXattr    = "SCHILY.xattr."
+)
+
+// Export writes the contents of the snapshot specified by key to w as a tar
+// archive. If merged is false, only the topmost layer of the snapshot is
+// exported as an OCI layer tar (overlayfs whiteouts are converted to OCI
+// whiteouts). If merged is true, the merged view of the snapshot and all of
+// its parents is exported.
+func (o *snapshotter) Export(ctx context.Context, key string, w io.Writer, merged bool) error {
+	_, info, err := o.findSnapshot(ctx, key)
+	if err != nil {
+		return err
+	}
+	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		return err
+	}
+	s, err := storage.GetSnapshot(ctx, info.Name)
+	t.Rollback()
+	if err != nil {
+		return errors.Wrapf(err, "failed to get snapshot %q", info.Name)
+	}
+	if err := o.ensureChainMounted(ctx, info.Name); err != nil {
+		return err
+	}
+	if !merged || len(s.ParentIDs) == 0 {
+		return writeLayerTar(ctx, w, o.upperPath(s.ID), !merged)
+	}
+
+	// Mount the merged view on a temporary directory.
+	var lowers []string
+	for _, id := range append([]string{s.ID}, s.ParentIDs...) {
+		lowers = append(lowers, o.upperPath(id))
+	}
+	td, err := ioutil.TempDir(o.root, "export-")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temp dir")
+	}
+	defer os.RemoveAll(td)
+	m := mount.Mount{
+		Type:    "overlay",
+		Source:  "overlay",
+		Options: []string{fmt.Sprintf("lowerdir=%s", strings.Join(lowers, ":"))},
+	}
+	if err := m.Mount(td); err != nil {
+		return errors.Wrapf(err, "failed to mount merged view of %q", info.Name)
+	}
+	defer func() {
+		if err := mount.UnmountAll(td, 0); err != nil {
+			log.G(ctx).WithError(err).WithField("path", td).Warn("failed to unmount")
+		}
+	}()
+	return writeLayerTar(ctx, w, td, false)
+}
+
+// writeLayerTar walks the directory and writes all contents to w as a tar
+// archive. If ociWhiteouts is true, overlayfs-styled whiteouts (char device 0/0
+// and opaque xattr) are converted to OCI whiteout files.
+func writeLayerTar(ctx context.Context, w io.Writer, root string, ociWhiteouts bool) error {
+	tw := tar.NewWriter(w)
+	links := make(map[uint64]string)
+	if err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if fi.Mode()&os.ModeSocket != 0 {
+			return nil // sockets can't be archived
+		}
+		name := filepath.ToSlash(rel)
+		st, _ := fi.Sys().(*syscall.Stat_t)
+
+		// overlayfs whiteout
+		if ociWhiteouts && fi.Mode()&os.ModeCharDevice != 0 && st != nil && st.Rdev == 0 {
+			return tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     filepath.ToSlash(filepath.Join(filepath.Dir(rel), whiteoutPrefix+fi.Name())),
+				ModTime:  fi.ModTime(),
+			})
+		}
+
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		if st != nil {
+			hdr.Uid, hdr.Gid = int(st.Uid), int(st.Gid)
+			hdr.Uname, hdr.Gname = "", ""
+			if fi.Mode().IsRegular() && st.Nlink > 1 {
+				if target, ok := links[st.Ino]; ok {
+					hdr.Typeflag = tar.TypeLink
+					hdr.Linkname = target
+					hdr.Size = 0
+				} else {
+					links[st.Ino] = name
+				}
+			}
+		}
+		opaque, err := setXattrs(hdr, p)
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if ociWhiteouts && opaque {
+			if err := tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     name + "/" + whiteoutOpaqueDir,
+				ModTime:  fi.ModTime(),
+			}); err != nil {
+				return err
+			}
+		}
+		if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(tw, f)
+			f.Close()
+			if err != nil {
+				return errors.Wrapf(err, "failed to copy %q", name)
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// setXattrs sets extended attributes of the file to the tar header. overlayfs
+// specific attributes are excluded and this reports whether the file is an
+// opaque directory.
+func setXattrs(hdr *tar.Header, p string) (opaque bool, _ error) {
+	sz, err := unix.Llistxattr(p, nil)
+	if err != nil || sz <= 0 {
+		return false, nil // xattrs aren't supported or no xattr
+	}
+	buf := make([]byte, sz)
+	if sz, err = unix.Llistxattr(p, buf); err != nil {
+		return false, errors.Wrapf(err, "failed to list xattrs of %q", p)
+	}
+	for _, k := range strings.Split(strings.TrimRight(string(buf[:sz]), "\x00"), "\x00") {
+		if k == "" {
+			continue
+		}
+		vsz, err := unix.Lgetxattr(p, k, nil)
+		if err != nil {
+			continue
+		}
+		v := make([]byte, vsz)
+		if vsz, err = unix.Lgetxattr(p, k, v); err != nil {
+			continue
+		}
+		if k == opaqueXattr || k == userOpaqueXattr {
+			opaque = opaque || string(v[:vsz]) == "y"
+			continue
+		} else if strings.HasPrefix(k, overlayXattrs) || strings.HasPrefix(k, userOverlayXattrs) {
+			continue
+		}
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords[paxSchilyXattr+k] = string(v[:vsz])
+	}
+	return opaque, nil
+}
@@ -0,0 +1,125 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/pkg/testutil"
+	"golang.org/x/sys/unix"
+)
+
+func TestWriteLayerTar(t *testing.T) {
+	testutil.RequiresRoot(t)
+	root, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.MkdirAll(filepath.Join(root, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "a", "foo"), []byte("foofoo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(root, "a", "foo"), filepath.Join(root, "a", "foolink")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("foo", filepath.Join(root, "a", "symlink")); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Mknod(filepath.Join(root, "a", "deleted"), unix.S_IFCHR, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Setxattr(filepath.Join(root, "a", "b"), opaqueXattr, []byte("y"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		ociWhiteouts bool
+		want         map[string]byte
+	}{
+		{
+			name:         "oci-layer",
+			ociWhiteouts: true,
+			want: map[string]byte{
+				"a/":               tar.TypeDir,
+				"a/b/":             tar.TypeDir,
+				"a/b/.wh..wh..opq": tar.TypeReg,
+				"a/foo":            tar.TypeReg,
+				"a/foolink":        tar.TypeLink,
+				"a/symlink":        tar.TypeSymlink,
+				"a/.wh.deleted":    tar.TypeReg,
+			},
+		},
+		{
+			name:         "raw",
+			ociWhiteouts: false,
+			want: map[string]byte{
+				"a/":        tar.TypeDir,
+				"a/b/":      tar.TypeDir,
+				"a/foo":     tar.TypeReg,
+				"a/foolink": tar.TypeLink,
+				"a/symlink": tar.TypeSymlink,
+				"a/deleted": tar.TypeChar,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			if err := writeLayerTar(context.Background(), buf, root, tt.ociWhiteouts); err != nil {
+				t.Fatalf("failed to write tar: %v", err)
+			}
+			got := make(map[string]byte)
+			tr := tar.NewReader(buf)
+			for {
+				h, err := tr.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatalf("failed to read tar: %v", err)
+				}
+				got[h.Name] = h.Typeflag
+				if h.Name == "a/foo" {
+					if data, err := ioutil.ReadAll(tr); err != nil || string(data) != "foofoo" {
+						t.Errorf("unexpected contents of a/foo: %q, %v", string(data), err)
+					}
+				}
+				if _, ok := h.PAXRecords[paxSchilyXattr+opaqueXattr]; ok {
+					t.Errorf("overlayfs xattr must not be exported in %q", h.Name)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("got entries %v; want %v", got, tt.want)
+			}
+			for name, typ := range tt.want {
+				if g, ok := got[name]; !ok || g != typ {
+					t.Errorf("entry %q: got type %q(exist=%v); want %q", name, g, ok, typ)
+				}
+			}
+		})
+	}
+}
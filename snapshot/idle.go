@@ -0,0 +1,243 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/pkg/errors"
+)
+
+// IdleTTLLabel is a snapshot label key which overrides the TTL given by
+// IdleUnmountTTL for the remote snapshot. The value is a duration (e.g. "30m")
+// and "0" prevents the snapshot from being unmounted.
+const IdleTTLLabel = "containerd.io/snapshot/remote/stargz.idle-ttl"
+
+// maxIdleCheckInterval is the maximum interval of checking idle snapshots.
+const maxIdleCheckInterval = time.Minute
+
+// IdleUnmountTTL makes the snapshotter unmount remote snapshots which aren't
+// used by any container and haven't been accessed for the TTL. This releases
+// the resources held by the FileSystem (e.g. file descriptors and metadata)
+// for the snapshot. The snapshot is mounted again on the next access through
+// this snapshotter (e.g. Prepare and View of a child snapshot).
+func IdleUnmountTTL(ttl time.Duration) Opt {
+	return func(config *SnapshotterConfig) error {
+		config.idleTTL = ttl
+		return nil
+	}
+}
+
+// idleTracker tracks the last access time of remote snapshots.
+type idleTracker struct {
+	ttl time.Duration
+
+	// mu guards the following fields and serializes unmounting and remounting
+	// of idle snapshots.
+	mu         sync.Mutex
+	lastAccess map[string]time.Time // keyed by snapshot IDs
+	unmounted  map[string]bool
+
+	stopCh chan struct{}
+}
+
+func newIdleTracker(ttl time.Duration) *idleTracker {
+	return &idleTracker{
+		ttl:        ttl,
+		lastAccess: make(map[string]time.Time),
+		unmounted:  make(map[string]bool),
+		stopCh:     make(chan struct{}),
+	}
+}
+
+func (it *idleTracker) touch(id string) {
+	if it == nil {
+		return
+	}
+	it.mu.Lock()
+	it.lastAccess[id] = time.Now()
+	delete(it.unmounted, id)
+	it.mu.Unlock()
+}
+
+// ttlOf returns the TTL of the snapshot. The label overrides the default.
+func (it *idleTracker) ttlOf(ctx context.Context, info snapshots.Info) time.Duration {
+	v, ok := info.Labels[IdleTTLLabel]
+	if !ok {
+		return it.ttl
+	}
+	ttl, err := time.ParseDuration(v)
+	if err != nil {
+		log.G(ctx).WithError(err).Warnf("invalid %s label of %q; using default", IdleTTLLabel, info.Name)
+		return it.ttl
+	}
+	return ttl
+}
+
+// runIdleUnmounter periodically unmounts idle snapshots until the snapshotter
+// is closed.
+func (o *snapshotter) runIdleUnmounter(ctx context.Context) {
+	interval := o.idle.ttl / 2
+	if interval > maxIdleCheckInterval {
+		interval = maxIdleCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if err := o.unmountIdle(ctx, now); err != nil {
+				log.G(ctx).WithError(err).Warn("failed to unmount idle snapshots")
+			}
+		case <-o.idle.stopCh:
+			return
+		}
+	}
+}
+
+// unmountIdle unmounts remote snapshots which haven't been accessed since
+// their TTL before now. Remote snapshots in the parent chain of non-remote
+// snapshots (i.e. containers and views) are used by overlayfs so they are
+// never unmounted.
+func (o *snapshotter) unmountIdle(ctx context.Context, now time.Time) error {
+	type candidate struct {
+		id   string
+		info snapshots.Info
+	}
+	var candidates []candidate
+	if err := func() error {
+		ctx, t, err := o.ms.TransactionContext(ctx, false)
+		if err != nil {
+			return err
+		}
+		defer t.Rollback()
+		infos := make(map[string]snapshots.Info)
+		if err := storage.WalkInfo(ctx, func(ctx context.Context, info snapshots.Info) error {
+			infos[info.Name] = info
+			return nil
+		}); err != nil {
+			return err
+		}
+		inUse := make(map[string]bool)
+		for _, info := range infos {
+			if _, ok := info.Labels[remoteLabel]; ok {
+				continue
+			}
+			for p := info.Parent; p != "" && !inUse[p]; p = infos[p].Parent {
+				inUse[p] = true
+			}
+		}
+		ids, err := storage.IDMap(ctx)
+		if err != nil {
+			return err
+		}
+		for id, name := range ids {
+			info := infos[name]
+			if _, ok := info.Labels[remoteLabel]; ok && !inUse[name] {
+				candidates = append(candidates, candidate{id, info})
+			}
+		}
+		o.idle.forget(ids)
+		return nil
+	}(); err != nil {
+		return err
+	}
+
+	for _, c := range candidates {
+		ttl := o.idle.ttlOf(ctx, c.info)
+		o.idle.mu.Lock()
+		last, ok := o.idle.lastAccess[c.id]
+		if !ok {
+			// Not tracked yet. Count from now.
+			o.idle.lastAccess[c.id] = now
+		} else if !o.idle.unmounted[c.id] && ttl > 0 && now.Sub(last) >= ttl {
+			mp := o.upperPath(c.id)
+			if err := o.fs.Unmount(ctx, mp); err != nil {
+				log.G(ctx).WithError(err).WithField("mount-point", mp).Warn("failed to unmount idle snapshot")
+			} else {
+				log.G(ctx).WithField("mount-point", mp).Debugf("unmounted snapshot %q idle for %v", c.info.Name, now.Sub(last))
+				o.idle.unmounted[c.id] = true
+			}
+		}
+		o.idle.mu.Unlock()
+	}
+	return nil
+}
+
+// forget drops the records of removed snapshots. ids is the snapshot IDs
+// existing in the metadata store.
+func (it *idleTracker) forget(ids map[string]string) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	for id := range it.lastAccess {
+		if _, ok := ids[id]; !ok {
+			delete(it.lastAccess, id)
+			delete(it.unmounted, id)
+		}
+	}
+}
+
+// ensureMounted records the access to the remote snapshot and mounts it again
+// if it has been unmounted as idle.
+func (o *snapshotter) ensureMounted(ctx context.Context, id string, info snapshots.Info) error {
+	if o.idle == nil {
+		return nil
+	}
+	if _, ok := info.Labels[remoteLabel]; !ok {
+		return nil
+	}
+	o.idle.mu.Lock()
+	defer o.idle.mu.Unlock()
+	o.idle.lastAccess[id] = time.Now()
+	if !o.idle.unmounted[id] {
+		return nil
+	}
+	if err := o.fs.Mount(ctx, o.upperPath(id), info.Labels); err != nil {
+		return errors.Wrapf(err, "failed to remount idle snapshot %q", info.Name)
+	}
+	delete(o.idle.unmounted, id)
+	log.G(ctx).WithField("mount-point", o.upperPath(id)).Debugf("remounted idle snapshot %q", info.Name)
+	return nil
+}
+
+// ensureChainMounted calls ensureMounted for the snapshot and all its parents.
+func (o *snapshotter) ensureChainMounted(ctx context.Context, key string) error {
+	if o.idle == nil {
+		return nil
+	}
+	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer t.Rollback()
+	for cKey := key; cKey != ""; {
+		id, info, _, err := storage.GetInfo(ctx, cKey)
+		if err != nil {
+			return err
+		}
+		if err := o.ensureMounted(ctx, id, info); err != nil {
+			return err
+		}
+		cKey = info.Parent
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/pkg/testutil"
+	"github.com/containerd/containerd/snapshots/storage"
+)
+
+// TestIdleUnmount tests idle remote snapshots are unmounted and mounted again
+// on the next access.
+func TestIdleUnmount(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	sn, err := NewSnapshotter(context.TODO(), root, bindFileSystem(t), IdleUnmountTTL(time.Hour))
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+	defer sn.Close()
+	o := sn.(*snapshotter)
+
+	idle := prepareWithTarget(t, sn, "idle", "idle-key", "", nil)
+	pinned := prepareWithTarget(t, sn, "pinned", "pinned-key", "", map[string]string{IdleTTLLabel: "0"})
+	used := prepareWithTarget(t, sn, "used", "used-key", "", nil)
+	if _, err := sn.Prepare(ctx, "container", used); err != nil {
+		t.Fatalf("failed to prepare container snapshot: %v", err)
+	}
+	mounted := func(key string) bool {
+		ctx, tx, err := o.ms.TransactionContext(ctx, false)
+		if err != nil {
+			t.Fatalf("failed to get transaction: %v", err)
+		}
+		defer tx.Rollback()
+		id, _, _, err := storage.GetInfo(ctx, key)
+		if err != nil {
+			t.Fatalf("failed to get info of %q: %v", key, err)
+		}
+		_, err = os.Stat(filepath.Join(o.upperPath(id), remoteSampleFile))
+		return err == nil
+	}
+
+	if err := o.unmountIdle(ctx, time.Now().Add(30*time.Minute)); err != nil {
+		t.Fatalf("failed to unmount idle snapshots: %v", err)
+	}
+	if !mounted(idle) {
+		t.Fatalf("snapshot must not be unmounted before the TTL")
+	}
+	if err := o.unmountIdle(ctx, time.Now().Add(2*time.Hour)); err != nil {
+		t.Fatalf("failed to unmount idle snapshots: %v", err)
+	}
+	if mounted(idle) {
+		t.Errorf("idle snapshot must be unmounted")
+	}
+	if !mounted(pinned) {
+		t.Errorf("snapshot with TTL 0 must not be unmounted")
+	}
+	if !mounted(used) {
+		t.Errorf("snapshot used by a container must not be unmounted")
+	}
+
+	// The next access mounts the snapshot again.
+	if _, err := sn.View(ctx, "view", idle); err != nil {
+		t.Fatalf("failed to view idle snapshot: %v", err)
+	}
+	if !mounted(idle) {
+		t.Errorf("idle snapshot must be mounted again on access")
+	}
+	if err := o.unmountIdle(ctx, time.Now().Add(2*time.Hour)); err != nil {
+		t.Fatalf("failed to unmount idle snapshots: %v", err)
+	}
+	if !mounted(idle) {
+		t.Errorf("snapshot used by a view must not be unmounted")
+	}
+}
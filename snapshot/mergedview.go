@@ -0,0 +1,143 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots/storage"
+)
+
+// MergedViewFileSystem is a FileSystem which can present a stack of remote
+// snapshots as a single directory. MergedView returns the directory holding
+// the merged tree of the snapshots mounted on the mountpoints (upper first)
+// with whiteouts and opaque directories resolved. If lowest is false, other
+// layers are stacked under the directory so it keeps whiteouts and opaque
+// directories hiding their entries.
+type MergedViewFileSystem interface {
+	MergedView(ctx context.Context, mountpoints []string, lowest bool) (string, error)
+}
+
+// overlayMaxLowerdirs is the maximum number of lowerdirs of an overlayfs mount
+// (OVL_MAX_STACK of the kernel).
+var overlayMaxLowerdirs = 500
+
+// MergedLowerView passes the lower layers of a snapshot to overlayfs as a
+// single merged directory if the snapshot has at least minLayers lower layers
+// and all of them are remote snapshots. This keeps images with many layers
+// within the limit of the number of lowerdirs of overlayfs. Zero disables it.
+func MergedLowerView(minLayers int) Opt {
+	return func(config *SnapshotterConfig) error {
+		config.mergedViews = minLayers
+		return nil
+	}
+}
+
+// mergedLowerdir returns the merged view of the lower layers if it's enabled
+// and available for them.
+func (o *snapshotter) mergedLowerdir(ctx context.Context, parentPaths []string) (string, bool) {
+	if o.mergedViewMinLayers <= 0 || len(parentPaths) < o.mergedViewMinLayers {
+		return "", false
+	}
+	mfs, ok := o.fs.(MergedViewFileSystem)
+	if !ok {
+		return "", false
+	}
+	dir, err := mfs.MergedView(ctx, parentPaths, true)
+	if err != nil {
+		log.G(ctx).WithError(err).Debug("failed to merge lower layers; passing them to overlayfs")
+		return "", false
+	}
+	return dir, true
+}
+
+// groupLowerdirs merges runs of remote snapshots among the lower layers into
+// merged views so that the number of lowerdirs fits in the limit of
+// overlayfs. Layers are grouped from the lowest one, which tends to be shared
+// among images. The layers are returned as is if they already fit or can't be
+// grouped enough.
+func (o *snapshotter) groupLowerdirs(ctx context.Context, s storage.Snapshot, parentPaths []string) []string {
+	excess := len(parentPaths) - overlayMaxLowerdirs
+	if excess <= 0 {
+		return parentPaths
+	}
+	mfs, ok := o.fs.(MergedViewFileSystem)
+	if !ok {
+		return parentPaths
+	}
+	remote, err := o.remoteParents(ctx, s)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to get lower layers to group")
+		return parentPaths
+	}
+
+	// Lowerdirs are collected from the lowest one.
+	var lowerdirs []string
+	for end := len(parentPaths); end > 0; {
+		begin := end - 1
+		if remote[begin] {
+			for begin > 0 && remote[begin-1] && end-begin <= excess {
+				begin--
+			}
+		}
+		if n := end - begin; n > 1 {
+			dir, err := mfs.MergedView(ctx, parentPaths[begin:end], end == len(parentPaths))
+			if err != nil {
+				log.G(ctx).WithError(err).Warn("failed to group lower layers")
+				return parentPaths
+			}
+			lowerdirs = append(lowerdirs, dir)
+			excess -= n - 1
+		} else {
+			lowerdirs = append(lowerdirs, parentPaths[begin])
+		}
+		end = begin
+	}
+	if excess > 0 {
+		log.G(ctx).Warnf("%d lower layers exceed the limit of overlayfs (%d)", len(parentPaths), overlayMaxLowerdirs)
+		return parentPaths
+	}
+	for i, j := 0, len(lowerdirs)-1; i < j; i, j = i+1, j-1 {
+		lowerdirs[i], lowerdirs[j] = lowerdirs[j], lowerdirs[i]
+	}
+	log.G(ctx).Debugf("grouped %d lower layers into %d lowerdirs", len(parentPaths), len(lowerdirs))
+	return lowerdirs
+}
+
+// remoteParents returns whether each parent of the snapshot is a remote
+// snapshot.
+func (o *snapshotter) remoteParents(ctx context.Context, s storage.Snapshot) ([]bool, error) {
+	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer t.Rollback()
+	ids, err := storage.IDMap(ctx)
+	if err != nil {
+		return nil, err
+	}
+	remote := make([]bool, len(s.ParentIDs))
+	for i, id := range s.ParentIDs {
+		_, info, _, err := storage.GetInfo(ctx, ids[id])
+		if err != nil {
+			return nil, err
+		}
+		_, remote[i] = info.Labels[remoteLabel]
+	}
+	return remote, nil
+}
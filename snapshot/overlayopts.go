@@ -0,0 +1,80 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// overlayParamDir is the directory of the parameters of the overlay module,
+// which are the defaults of the mount options.
+var overlayParamDir = "/sys/module/overlay/parameters"
+
+// OverlayFeatures specifies the "redirect_dir" and "metacopy" options of
+// overlayfs mounts of snapshots. Empty means the default.
+//
+// By default, "metacopy=off" is passed if the overlay module enables metacopy
+// by default. Metadata-only copy-ups keep the contents of files in the lower
+// layers so upperdirs of containers don't hold the contents of files whose
+// metadata are changed. "metacopy=on" is always passed for data-only lower
+// layers, which require it.
+func OverlayFeatures(redirectDir, metacopy string) Opt {
+	return func(config *SnapshotterConfig) error {
+		switch redirectDir {
+		case "", "on", "off", "follow", "nofollow":
+		default:
+			return fmt.Errorf("redirect_dir must be \"on\", \"off\", \"follow\" or \"nofollow\" but %q", redirectDir)
+		}
+		switch metacopy {
+		case "", "on", "off":
+		default:
+			return fmt.Errorf("metacopy must be \"on\" or \"off\" but %q", metacopy)
+		}
+		if metacopy == "on" && redirectDir != "" && redirectDir != "on" {
+			// overlayfs refuses this combination.
+			return fmt.Errorf("metacopy=on conflicts with redirect_dir=%s", redirectDir)
+		}
+		config.redirectDir = redirectDir
+		config.metacopy = metacopy
+		return nil
+	}
+}
+
+// overlayFeatures returns the options of overlayfs features of a mount.
+func (o *snapshotter) overlayFeatures(dataOnly bool) (options []string) {
+	if dataOnly {
+		options = append(options, "metacopy=on")
+	} else if o.metacopy != "" {
+		options = append(options, "metacopy="+o.metacopy)
+	} else if overlayParamEnabled("metacopy") {
+		options = append(options, "metacopy=off")
+	}
+	if o.redirectDir != "" {
+		options = append(options, "redirect_dir="+o.redirectDir)
+	}
+	return options
+}
+
+// overlayParamEnabled returns true if the boolean parameter of the overlay
+// module is enabled.
+func overlayParamEnabled(name string) bool {
+	v, err := ioutil.ReadFile(filepath.Join(overlayParamDir, name))
+	return err == nil && strings.TrimSpace(string(v)) == "Y"
+}
@@ -0,0 +1,179 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/pkg/errors"
+)
+
+// RouteFunc reports whether the layer prepared with the labels is of an image
+// which should be served by the remote snapshotter.
+type RouteFunc func(labels map[string]string) bool
+
+// router is a snapshotter which routes each image to the remote snapshotter or
+// the fallback snapshotter (e.g. overlayfs). The image is routed when its
+// lowest layer is prepared and the upper layers and containers follow the
+// snapshotter of their parents, so each chain of snapshots stays in a
+// snapshotter. Other operations go to the snapshotter which has the key.
+type router struct {
+	remote   snapshots.Snapshotter
+	fallback snapshots.Snapshotter
+	route    RouteFunc
+}
+
+// NewRouter returns a snapshotter routing images to the remote or fallback
+// snapshotter based on the labels of their lowest layers, so that images which
+// can't be lazily pulled don't pay the overhead of the remote snapshotter.
+func NewRouter(remote, fallback snapshots.Snapshotter, route RouteFunc) snapshots.Snapshotter {
+	return &router{remote: remote, fallback: fallback, route: route}
+}
+
+var _ = (snapshots.Cleaner)((*router)(nil))
+
+// owner returns the snapshotter which has the key.
+func (r *router) owner(ctx context.Context, key string) (snapshots.Snapshotter, error) {
+	for _, sn := range []snapshots.Snapshotter{r.remote, r.fallback} {
+		if _, err := sn.Stat(ctx, key); err == nil {
+			return sn, nil
+		} else if !errdefs.IsNotFound(err) {
+			return nil, err
+		}
+	}
+	return nil, errors.Wrapf(errdefs.ErrNotFound, "snapshot %q", key)
+}
+
+// target returns the snapshotter where the new snapshot is created.
+func (r *router) target(ctx context.Context, key, parent string, opts []snapshots.Opt) (snapshots.Snapshotter, error) {
+	if _, err := r.owner(ctx, key); err == nil {
+		return nil, errors.Wrapf(errdefs.ErrAlreadyExists, "snapshot %q", key)
+	} else if !errdefs.IsNotFound(err) {
+		return nil, err
+	}
+	if parent != "" {
+		return r.owner(ctx, parent)
+	}
+	var base snapshots.Info
+	for _, opt := range opts {
+		if err := opt(&base); err != nil {
+			return nil, err
+		}
+	}
+	if r.route(base.Labels) {
+		return r.remote, nil
+	}
+	return r.fallback, nil
+}
+
+func (r *router) Stat(ctx context.Context, key string) (snapshots.Info, error) {
+	sn, err := r.owner(ctx, key)
+	if err != nil {
+		return snapshots.Info{}, err
+	}
+	return sn.Stat(ctx, key)
+}
+
+func (r *router) Update(ctx context.Context, info snapshots.Info, fieldpaths ...string) (snapshots.Info, error) {
+	sn, err := r.owner(ctx, info.Name)
+	if err != nil {
+		return snapshots.Info{}, err
+	}
+	return sn.Update(ctx, info, fieldpaths...)
+}
+
+func (r *router) Usage(ctx context.Context, key string) (snapshots.Usage, error) {
+	sn, err := r.owner(ctx, key)
+	if err != nil {
+		return snapshots.Usage{}, err
+	}
+	return sn.Usage(ctx, key)
+}
+
+func (r *router) Mounts(ctx context.Context, key string) ([]mount.Mount, error) {
+	sn, err := r.owner(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return sn.Mounts(ctx, key)
+}
+
+func (r *router) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	sn, err := r.target(ctx, key, parent, opts)
+	if err != nil {
+		return nil, err
+	}
+	return sn.Prepare(ctx, key, parent, opts...)
+}
+
+func (r *router) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	sn, err := r.target(ctx, key, parent, opts)
+	if err != nil {
+		return nil, err
+	}
+	return sn.View(ctx, key, parent, opts...)
+}
+
+func (r *router) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) error {
+	if _, err := r.owner(ctx, name); err == nil {
+		return errors.Wrapf(errdefs.ErrAlreadyExists, "snapshot %q", name)
+	} else if !errdefs.IsNotFound(err) {
+		return err
+	}
+	sn, err := r.owner(ctx, key)
+	if err != nil {
+		return err
+	}
+	return sn.Commit(ctx, name, key, opts...)
+}
+
+func (r *router) Remove(ctx context.Context, key string) error {
+	sn, err := r.owner(ctx, key)
+	if err != nil {
+		return err
+	}
+	return sn.Remove(ctx, key)
+}
+
+func (r *router) Walk(ctx context.Context, fn snapshots.WalkFunc, fs ...string) error {
+	if err := r.remote.Walk(ctx, fn, fs...); err != nil {
+		return err
+	}
+	return r.fallback.Walk(ctx, fn, fs...)
+}
+
+func (r *router) Cleanup(ctx context.Context) error {
+	for _, sn := range []snapshots.Snapshotter{r.remote, r.fallback} {
+		if c, ok := sn.(snapshots.Cleaner); ok {
+			if err := c.Cleanup(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *router) Close() error {
+	rErr := r.remote.Close()
+	if err := r.fallback.Close(); err != nil {
+		return err
+	}
+	return rErr
+}
@@ -0,0 +1,108 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/snapshots"
+)
+
+// TestRouter tests each image is routed by its lowest layer and the chain stays
+// in the snapshotter.
+func TestRouter(t *testing.T) {
+	ctx := context.TODO()
+	root, err := ioutil.TempDir("", "router")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	remote, err := NewSnapshotter(ctx, filepath.Join(root, "remote"), dummyFileSystem())
+	if err != nil {
+		t.Fatalf("failed to make remote snapshotter: %v", err)
+	}
+	fallback, err := NewSnapshotter(ctx, filepath.Join(root, "fallback"), dummyFileSystem())
+	if err != nil {
+		t.Fatalf("failed to make fallback snapshotter: %v", err)
+	}
+	sn := NewRouter(remote, fallback, func(labels map[string]string) bool {
+		return labels["lazy"] == "true"
+	})
+	defer sn.Close()
+
+	lazy := snapshots.WithLabels(map[string]string{"lazy": "true"})
+	for _, s := range []struct {
+		key, parent string
+		opts        []snapshots.Opt
+	}{
+		{"lazy-lower", "", []snapshots.Opt{lazy}},
+		{"lazy-upper", "lazy-lower-c", nil},
+		{"normal-lower", "", nil},
+		{"normal-upper", "normal-lower-c", []snapshots.Opt{lazy}}, // follows the parent
+	} {
+		if _, err := sn.Prepare(ctx, s.key, s.parent, s.opts...); err != nil {
+			t.Fatalf("failed to prepare %q: %v", s.key, err)
+		}
+		if err := sn.Commit(ctx, s.key+"-c", s.key); err != nil {
+			t.Fatalf("failed to commit %q: %v", s.key, err)
+		}
+	}
+	if _, err := sn.View(ctx, "lazy-view", "lazy-upper-c"); err != nil {
+		t.Fatalf("failed to view: %v", err)
+	}
+
+	for backend, want := range map[snapshots.Snapshotter][]string{
+		remote:   {"lazy-lower-c", "lazy-upper-c", "lazy-view"},
+		fallback: {"normal-lower-c", "normal-upper-c"},
+	} {
+		var got []string
+		if err := backend.Walk(ctx, func(ctx context.Context, info snapshots.Info) error {
+			got = append(got, info.Name)
+			return nil
+		}); err != nil {
+			t.Fatalf("failed to walk: %v", err)
+		}
+		sort.Strings(got)
+		if len(got) != len(want) {
+			t.Fatalf("snapshots = %v; want %v", got, want)
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Errorf("snapshots = %v; want %v", got, want)
+			}
+		}
+	}
+
+	if _, err := sn.Prepare(ctx, "normal-lower-c", "", lazy); !errdefs.IsAlreadyExists(err) {
+		t.Errorf("existing key in other snapshotter must be rejected: %v", err)
+	}
+	if _, err := sn.Stat(ctx, "normal-upper-c"); err != nil {
+		t.Errorf("failed to stat: %v", err)
+	}
+	if err := sn.Remove(ctx, "lazy-view"); err != nil {
+		t.Errorf("failed to remove: %v", err)
+	}
+	if _, err := sn.Stat(ctx, "lazy-view"); !errdefs.IsNotFound(err) {
+		t.Errorf("removed snapshot must not be found: %v", err)
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/log"
@@ -52,6 +53,11 @@ const (
 	prepareFailed        = "false"
 )
 
+// NoFallbackLabel is a snapshot label key which makes Prepare fail if the
+// remote snapshot can't be prepared, instead of falling back to a normal
+// snapshot where the layer is unpacked by the client.
+const NoFallbackLabel = "containerd.io/snapshot/remote.no-fallback"
+
 // FileSystem is a backing filesystem abstraction.
 //
 // Mount() tries to mount a remote snapshot to the specified mount point
@@ -67,9 +73,46 @@ type FileSystem interface {
 	Unmount(ctx context.Context, mountpoint string) error
 }
 
+// Materializer is a FileSystem which can fetch all contents of a remote snapshot
+// and make it a fully local snapshot.
+type Materializer interface {
+	Materialize(ctx context.Context, mountpoint string) error
+}
+
+// DataOnlyFileSystem is a FileSystem which can provide remote snapshots as
+// overlayfs data-only lower layers. The mountpoint of such a snapshot holds
+// only the metadata and DataDir returns the directory holding the contents.
+type DataOnlyFileSystem interface {
+	DataDir(mountpoint string) (string, bool)
+}
+
+// VolumeFileSystem is a FileSystem which applies a distinct prefetch policy to
+// layers of images mounted as volumes. PrepareVolume is called for each remote
+// layer used by a read-only view, which is how containerd mounts image volumes.
+type VolumeFileSystem interface {
+	PrepareVolume(ctx context.Context, mountpoint string) error
+}
+
+// SnapshotLabeler is a FileSystem which provides labels of remote snapshots.
+// The labels returned by SnapshotLabels for the remote snapshot mounted on the
+// mountpoint with the labels are added to the snapshot when it's committed.
+type SnapshotLabeler interface {
+	SnapshotLabels(ctx context.Context, mountpoint string, labels map[string]string) map[string]string
+}
+
+// FallbackNotifier is a FileSystem which is notified when a remote snapshot
+// can't be prepared and the snapshotter falls back to a normal snapshot.
+type FallbackNotifier interface {
+	NotifyFallback(ctx context.Context, labels map[string]string, err error)
+}
+
 // SnapshotterConfig is used to configure the remote snapshotter instance
 type SnapshotterConfig struct {
 	asyncRemove bool
+	idleTTL     time.Duration
+	redirectDir string
+	metacopy    string
+	mergedViews int
 }
 
 // Opt is an option to configure the remote snapshotter
@@ -89,6 +132,19 @@ type snapshotter struct {
 	ms          *storage.MetaStore
 	asyncRemove bool
 
+	// redirectDir and metacopy are the options of overlayfs features. Empty
+	// means the default.
+	redirectDir string
+	metacopy    string
+
+	// mergedViewMinLayers is the number of lower layers from which they are
+	// merged into a single lowerdir. Zero disables it.
+	mergedViewMinLayers int
+
+	// idle tracks accesses to remote snapshots for unmounting idle ones. nil
+	// if disabled.
+	idle *idleTracker
+
 	// fs is a filesystem that this snapshotter recognizes.
 	fs FileSystem
 }
@@ -129,15 +185,24 @@ func NewSnapshotter(ctx context.Context, root string, targetFs FileSystem, opts
 	}
 
 	o := &snapshotter{
-		root:        root,
-		ms:          ms,
-		asyncRemove: config.asyncRemove,
-		fs:          targetFs,
+		root:                root,
+		ms:                  ms,
+		asyncRemove:         config.asyncRemove,
+		redirectDir:         config.redirectDir,
+		metacopy:            config.metacopy,
+		fs:                  targetFs,
+		mergedViewMinLayers: config.mergedViews,
+	}
+	if config.idleTTL > 0 {
+		o.idle = newIdleTracker(config.idleTTL)
 	}
 
 	if err := o.restoreRemoteSnapshot(ctx); err != nil {
 		return nil, errors.Wrap(err, "failed to restore remote snapshot")
 	}
+	if o.idle != nil {
+		go o.runIdleUnmounter(log.WithLogger(context.Background(), log.G(ctx)))
+	}
 
 	return o, nil
 }
@@ -235,8 +300,14 @@ func (o *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...s
 		//       or not, using the key `remoteSnapshotLogKey` defined in the above. This
 		//       log is used by tests in this project.
 		lCtx := log.WithLogger(ctx, log.G(ctx).WithField("key", key).WithField("parent", parent))
-		if err := o.prepareRemoteSnapshot(ctx, key, base.Labels); err == nil {
+		err := o.prepareRemoteSnapshot(ctx, key, base.Labels)
+		if err == nil {
 			base.Labels[remoteLabel] = fmt.Sprintf("remote snapshot") // Mark this snapshot as remote
+			if sl, ok := o.fs.(SnapshotLabeler); ok {
+				for k, v := range sl.SnapshotLabels(ctx, o.upperPath(s.ID), base.Labels) {
+					base.Labels[k] = v
+				}
+			}
 			err := o.Commit(ctx, target, key, append(opts, snapshots.WithLabels(base.Labels))...)
 			if err == nil || errdefs.IsAlreadyExists(err) {
 				// count also AlreadyExists as "success"
@@ -251,6 +322,15 @@ func (o *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...s
 		}
 		log.G(lCtx).WithField(remoteSnapshotLogKey, prepareFailed).
 			WithError(err).Debug("failed to prepare remote snapshot")
+		if base.Labels[NoFallbackLabel] == "true" {
+			if rErr := o.Remove(ctx, key); rErr != nil {
+				log.G(lCtx).WithError(rErr).Warn("failed to cleanup snapshot")
+			}
+			return nil, errors.Wrapf(err, "failed to prepare remote snapshot %q", target)
+		}
+		if fn, ok := o.fs.(FallbackNotifier); ok {
+			fn.NotifyFallback(ctx, base.Labels, err)
+		}
 	}
 
 	return o.mounts(ctx, s, parent)
@@ -261,7 +341,39 @@ func (o *snapshotter) View(ctx context.Context, key, parent string, opts ...snap
 	if err != nil {
 		return nil, err
 	}
-	return o.mounts(ctx, s, parent)
+	mounts, err := o.mounts(ctx, s, parent)
+	if err != nil {
+		return nil, err
+	}
+	if vfs, ok := o.fs.(VolumeFileSystem); ok && parent != "" {
+		o.prepareVolume(ctx, vfs, parent)
+	}
+	return mounts, nil
+}
+
+// prepareVolume notifies the filesystem that the remote layers of the specified
+// snapshot and all lower layers are used as a volume. Failures are only logged
+// because the view is usable without the distinct prefetch.
+func (o *snapshotter) prepareVolume(ctx context.Context, vfs VolumeFileSystem, key string) {
+	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to get transaction")
+		return
+	}
+	defer t.Rollback()
+	for cKey := key; cKey != ""; {
+		id, info, _, err := storage.GetInfo(ctx, cKey)
+		if err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to get info of %q", cKey)
+			return
+		}
+		if _, ok := info.Labels[remoteLabel]; ok {
+			if err := vfs.PrepareVolume(ctx, o.upperPath(id)); err != nil {
+				log.G(ctx).WithError(err).WithField("mount-point", o.upperPath(id)).Debug("failed to prepare layer for volume")
+			}
+		}
+		cKey = info.Parent
+	}
 }
 
 // Mounts returns the mounts for the transaction identified by key. Can be
@@ -572,12 +684,16 @@ func (o *snapshotter) mounts(ctx context.Context, s storage.Snapshot, checkKey s
 	}
 	var options []string
 
+	// Data directories of data-only lower layers. These layers need overlayfs
+	// even if there is only one layer.
+	dataDirs := o.dataDirs(s.ParentIDs)
+
 	if s.Kind == snapshots.KindActive {
 		options = append(options,
 			fmt.Sprintf("workdir=%s", o.workPath(s.ID)),
 			fmt.Sprintf("upperdir=%s", o.upperPath(s.ID)),
 		)
-	} else if len(s.ParentIDs) == 1 {
+	} else if len(s.ParentIDs) == 1 && len(dataDirs) == 0 {
 		return []mount.Mount{
 			{
 				Source: o.upperPath(s.ParentIDs[0]),
@@ -594,8 +710,33 @@ func (o *snapshotter) mounts(ctx context.Context, s storage.Snapshot, checkKey s
 	for i := range s.ParentIDs {
 		parentPaths[i] = o.upperPath(s.ParentIDs[i])
 	}
+	if len(dataDirs) == 0 {
+		if dir, ok := o.mergedLowerdir(ctx, parentPaths); ok {
+			if s.Kind != snapshots.KindActive {
+				// overlayfs needs two lowerdirs at least without upperdir.
+				return []mount.Mount{
+					{
+						Source: dir,
+						Type:   "bind",
+						Options: []string{
+							"ro",
+							"rbind",
+						},
+					},
+				}, nil
+			}
+			parentPaths = []string{dir}
+		} else {
+			parentPaths = o.groupLowerdirs(ctx, s, parentPaths)
+		}
+	}
 
-	options = append(options, fmt.Sprintf("lowerdir=%s", strings.Join(parentPaths, ":")))
+	lowerdir := strings.Join(parentPaths, ":")
+	if len(dataDirs) > 0 {
+		lowerdir += "::" + strings.Join(dataDirs, "::")
+	}
+	options = append(options, o.overlayFeatures(len(dataDirs) > 0)...)
+	options = append(options, fmt.Sprintf("lowerdir=%s", lowerdir))
 	return []mount.Mount{
 		{
 			Type:    "overlay",
@@ -606,6 +747,21 @@ func (o *snapshotter) mounts(ctx context.Context, s storage.Snapshot, checkKey s
 
 }
 
+// dataDirs returns the data directories of the snapshots provided as overlayfs
+// data-only lower layers.
+func (o *snapshotter) dataDirs(ids []string) (dirs []string) {
+	dfs, ok := o.fs.(DataOnlyFileSystem)
+	if !ok {
+		return nil
+	}
+	for _, id := range ids {
+		if d, ok := dfs.DataDir(o.upperPath(id)); ok {
+			dirs = append(dirs, d)
+		}
+	}
+	return dirs
+}
+
 func (o *snapshotter) upperPath(id string) string {
 	return filepath.Join(o.root, "snapshots", id, "fs")
 }
@@ -619,12 +775,96 @@ func (o *snapshotter) Close() error {
 	// unmount all mounts including Committed
 	const cleanupCommitted = true
 	ctx := context.Background()
+	if o.idle != nil {
+		close(o.idle.stopCh)
+	}
 	if err := o.cleanup(ctx, cleanupCommitted); err != nil {
 		log.G(ctx).WithError(err).Warn("failed to cleanup")
 	}
 	return o.ms.Close()
 }
 
+// Materialize fetches all contents of the remote snapshot specified by key and
+// makes it a fully local snapshot that doesn't need the connection to the
+// registry. The key can be the name of the snapshot known to this snapshotter
+// or the one known to containerd's clients (without namespace and ID prefix).
+func (o *snapshotter) Materialize(ctx context.Context, key string) error {
+	m, ok := o.fs.(Materializer)
+	if !ok {
+		return errors.Wrap(errdefs.ErrNotImplemented, "filesystem doesn't support materialization")
+	}
+	id, info, err := o.findSnapshot(ctx, key)
+	if err != nil {
+		return err
+	}
+	if _, ok := info.Labels[remoteLabel]; !ok {
+		return errors.Wrapf(errdefs.ErrInvalidArgument, "snapshot %q isn't a remote snapshot", info.Name)
+	}
+	if err := o.ensureMounted(ctx, id, info); err != nil {
+		return err
+	}
+	return m.Materialize(ctx, o.upperPath(id))
+}
+
+// RemoteMountpoints returns the mountpoints of the remote snapshots in the
+// chain of the specified snapshot, the topmost first. The key is resolved in the
+// same way as Materialize.
+func (o *snapshotter) RemoteMountpoints(ctx context.Context, key string) ([]string, error) {
+	_, info, err := o.findSnapshot(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer t.Rollback()
+	var mps []string
+	for cKey := info.Name; cKey != ""; {
+		id, info, _, err := storage.GetInfo(ctx, cKey)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := info.Labels[remoteLabel]; ok {
+			mps = append(mps, o.upperPath(id))
+		}
+		cKey = info.Parent
+	}
+	return mps, nil
+}
+
+// findSnapshot finds a snapshot by its name. If no snapshot has the exact name,
+// this treats the key as a name of containerd's clients and searches a snapshot
+// that has the name with the namespace and ID prefix ("<namespace>/<id>/<key>").
+func (o *snapshotter) findSnapshot(ctx context.Context, key string) (string, snapshots.Info, error) {
+	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		return "", snapshots.Info{}, err
+	}
+	defer t.Rollback()
+	if id, info, _, err := storage.GetInfo(ctx, key); err == nil {
+		return id, info, nil
+	} else if !errdefs.IsNotFound(err) {
+		return "", snapshots.Info{}, err
+	}
+	var found []string
+	if err := storage.WalkInfo(ctx, func(ctx context.Context, info snapshots.Info) error {
+		if strings.HasSuffix(info.Name, "/"+key) {
+			found = append(found, info.Name)
+		}
+		return nil
+	}); err != nil {
+		return "", snapshots.Info{}, err
+	}
+	if len(found) == 0 {
+		return "", snapshots.Info{}, errors.Wrapf(errdefs.ErrNotFound, "snapshot %q", key)
+	} else if len(found) > 1 {
+		return "", snapshots.Info{}, errors.Wrapf(errdefs.ErrInvalidArgument, "snapshot %q is ambiguous: %v", key, found)
+	}
+	id, info, _, err := storage.GetInfo(ctx, found[0])
+	return id, info, err
+}
+
 // prepareRemoteSnapshot tries to prepare the snapshot as a remote snapshot
 // using filesystems registered in this snapshotter.
 func (o *snapshotter) prepareRemoteSnapshot(ctx context.Context, key string, labels map[string]string) error {
@@ -641,6 +881,7 @@ func (o *snapshotter) prepareRemoteSnapshot(ctx context.Context, key string, lab
 	if err := o.fs.Mount(ctx, o.upperPath(id), labels); err != nil {
 		return err
 	}
+	o.idle.touch(id)
 
 	return nil
 }
@@ -668,6 +909,10 @@ func (o *snapshotter) checkAvailability(ctx context.Context, key string) bool {
 		mp := o.upperPath(id)
 		lCtx := log.WithLogger(ctx, log.G(ctx).WithField("mount-point", mp))
 		if _, ok := info.Labels[remoteLabel]; ok {
+			if err := o.ensureMounted(ctx, id, info); err != nil {
+				log.G(lCtx).WithError(err).Warn("layer is unavailable")
+				return false
+			}
 			eg.Go(func() error {
 				log.G(lCtx).Debug("checking mount point")
 				if err := o.fs.Check(egCtx, mp, info.Labels); err != nil {
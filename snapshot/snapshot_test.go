@@ -23,6 +23,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"syscall"
 	"testing"
 
@@ -32,6 +33,7 @@ import (
 	"github.com/containerd/containerd/snapshots"
 	"github.com/containerd/containerd/snapshots/storage"
 	"github.com/containerd/containerd/snapshots/testsuite"
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -103,6 +105,58 @@ func TestRemotePrepare(t *testing.T) {
 	}
 }
 
+func TestRemotePrepareNoFallback(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := ioutil.TempDir("", "overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	fs := &fallbackFs{}
+	sn, err := NewSnapshotter(context.TODO(), root, fs)
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+
+	// Fallback to a normal snapshot by default.
+	key := "/tmp/prepareFallback"
+	if _, err := sn.Prepare(ctx, key, "", snapshots.WithLabels(map[string]string{
+		targetSnapshotLabel: "testTarget",
+	})); err != nil {
+		t.Fatalf("failed to fallback to normal snapshot: %v", err)
+	}
+	if err := sn.Remove(ctx, key); err != nil {
+		t.Fatalf("failed to remove snapshot: %v", err)
+	}
+	if fs.fallbacks != 1 {
+		t.Errorf("fallback notified %d times; want once", fs.fallbacks)
+	}
+
+	// Fail without fallback and cleanup the snapshot.
+	if _, err := sn.Prepare(ctx, key, "", snapshots.WithLabels(map[string]string{
+		targetSnapshotLabel: "testTarget",
+		NoFallbackLabel:     "true",
+	})); err == nil || errdefs.IsAlreadyExists(err) {
+		t.Fatalf("prepare must fail without fallback: %v", err)
+	}
+	if _, err := sn.Stat(ctx, key); !errdefs.IsNotFound(err) {
+		t.Errorf("failed snapshot must be removed: %v", err)
+	}
+	if fs.fallbacks != 1 {
+		t.Errorf("fallback notified without fallback")
+	}
+}
+
+type fallbackFs struct {
+	dummyFs
+	fallbacks int
+}
+
+func (fs *fallbackFs) NotifyFallback(ctx context.Context, labels map[string]string, err error) {
+	fs.fallbacks++
+}
+
 func TestRemoteOverlay(t *testing.T) {
 	testutil.RequiresRoot(t)
 	ctx := context.TODO()
@@ -374,6 +428,172 @@ func TestFailureDetection(t *testing.T) {
 	}
 }
 
+func TestRemoteMaterialize(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	fs := bindFileSystem(t)
+	sn, err := NewSnapshotter(context.TODO(), root, fs)
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+	defer sn.Close()
+
+	// Prepare a remote snapshot named in the same manner as containerd.
+	target := prepareWithTarget(t, sn, "default/1/testTarget", "default/2/testKey", "", nil)
+	defer sn.Remove(ctx, target)
+
+	// Prepare a normal snapshot.
+	if _, err := sn.Prepare(ctx, "default/3/normal", ""); err != nil {
+		t.Fatalf("failed to prepare normal snapshot: %v", err)
+	}
+
+	ms := sn.(*snapshotter)
+	for _, key := range []string{"default/1/testTarget", "testTarget"} {
+		if err := ms.Materialize(ctx, key); err != nil {
+			t.Errorf("failed to materialize %q: %v", key, err)
+		}
+	}
+	if n := len(fs.(*bindFs).materialized); n != 2 {
+		t.Errorf("materialized %d times; want 2", n)
+	}
+	if err := ms.Materialize(ctx, "normal"); !errdefs.IsInvalidArgument(err) {
+		t.Errorf("normal snapshot must not be materialized: %v", err)
+	}
+	if err := ms.Materialize(ctx, "unknown"); !errdefs.IsNotFound(err) {
+		t.Errorf("unknown snapshot must not be found: %v", err)
+	}
+}
+
+// TestRemoteView tests remote layers used by views are prepared as volumes.
+func TestRemoteView(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	fs := bindFileSystem(t)
+	sn, err := NewSnapshotter(context.TODO(), root, fs)
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+	defer sn.Close()
+
+	lower := prepareWithTarget(t, sn, "lower", "lowerKey", "", nil)
+	upper := prepareWithTarget(t, sn, "upper", "upperKey", lower, nil)
+	if _, err := sn.Prepare(ctx, "rootfs", upper); err != nil {
+		t.Fatalf("failed to prepare rootfs: %v", err)
+	}
+	if n := len(fs.(*bindFs).volumes); n != 0 {
+		t.Errorf("rootfs must not be prepared as volume: %d layers", n)
+	}
+	if _, err := sn.View(ctx, "volume", upper); err != nil {
+		t.Fatalf("failed to view: %v", err)
+	}
+	if n := len(fs.(*bindFs).volumes); n != 2 {
+		t.Errorf("prepared %d layers as volume; want 2", n)
+	}
+}
+
+func TestRemoteDataOnly(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	sn, err := NewSnapshotter(context.TODO(), root, &dataOnlyFs{t: t})
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+	defer sn.Close()
+
+	// A view of the single data-only remote snapshot must be an overlayfs.
+	target := prepareWithTarget(t, sn, "testTarget", "/tmp/prepareTarget", "", nil)
+	defer sn.Remove(ctx, target)
+	mounts, err := sn.View(ctx, "/tmp/view", target)
+	if err != nil {
+		t.Fatalf("failed to make view: %v", err)
+	}
+	if len(mounts) != 1 || mounts[0].Type != "overlay" {
+		t.Fatalf("view must be an overlay mount: %+v", mounts)
+	}
+	lower := getParents(ctx, sn, root, "/tmp/view")[0]
+	for i, v := range []string{"metacopy=on", "lowerdir=" + lower + "::" + lower + ".data"} {
+		if mounts[0].Options[i] != v {
+			t.Errorf("expected %q but received %q", v, mounts[0].Options[i])
+		}
+	}
+
+	mnt, err := ioutil.TempDir("", "remotemnt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mnt)
+	if err := mount.All(mounts, mnt); err != nil {
+		t.Skipf("overlayfs data-only layers are unavailable: %v", err)
+	}
+	defer mount.UnmountAll(mnt, 0)
+	data, err := ioutil.ReadFile(filepath.Join(mnt, remoteSampleFile))
+	if err != nil {
+		t.Fatalf("failed to read a file in the remote snapshot: %v", err)
+	}
+	if e := string(data); e != remoteSampleFileContents {
+		t.Fatalf("expected file contents %q but got %q", remoteSampleFileContents, e)
+	}
+}
+
+// dataOnlyFs provides a remote snapshot as a data-only layer holding the sample
+// file.
+type dataOnlyFs struct {
+	t *testing.T
+}
+
+func (fs *dataOnlyFs) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
+	dataDir := mountpoint + ".data"
+	if err := os.MkdirAll(filepath.Join(dataDir, "sha256"), 0700); err != nil {
+		fs.t.Fatalf("failed to make data directory: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dataDir, "sha256", "sample"), []byte(remoteSampleFileContents), 0600); err != nil {
+		fs.t.Fatalf("failed to write sample contents: %v", err)
+	}
+	p := filepath.Join(mountpoint, remoteSampleFile)
+	if err := ioutil.WriteFile(p, nil, 0644); err != nil {
+		fs.t.Fatalf("failed to write sample file: %v", err)
+	}
+	if err := os.Truncate(p, int64(len(remoteSampleFileContents))); err != nil {
+		fs.t.Fatalf("failed to truncate sample file: %v", err)
+	}
+	for k, v := range map[string]string{
+		"trusted.overlay.metacopy": "",
+		"trusted.overlay.redirect": "/sha256/sample",
+	} {
+		if err := unix.Setxattr(p, k, []byte(v), 0); err != nil {
+			fs.t.Fatalf("failed to set xattr %q: %v", k, err)
+		}
+	}
+	return nil
+}
+
+func (fs *dataOnlyFs) Check(ctx context.Context, mountpoint string, labels map[string]string) error {
+	return nil
+}
+
+func (fs *dataOnlyFs) Unmount(ctx context.Context, mountpoint string) error {
+	return nil
+}
+
+func (fs *dataOnlyFs) DataDir(mountpoint string) (string, bool) {
+	return mountpoint + ".data", true
+}
+
 func bindFileSystem(t *testing.T) FileSystem {
 	root, err := ioutil.TempDir("", "remote")
 	if err != nil {
@@ -394,6 +614,18 @@ type bindFs struct {
 	root         string
 	checkFailure bool
 	broken       map[string]bool
+	materialized []string
+	volumes      []string
+}
+
+func (fs *bindFs) PrepareVolume(ctx context.Context, mountpoint string) error {
+	fs.volumes = append(fs.volumes, mountpoint)
+	return nil
+}
+
+func (fs *bindFs) Materialize(ctx context.Context, mountpoint string) error {
+	fs.materialized = append(fs.materialized, mountpoint)
+	return nil
 }
 
 func (fs *bindFs) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
@@ -719,3 +951,193 @@ func TestOverlayView(t *testing.T) {
 		t.Errorf("expected option %q but received %q", expected, m.Options[0])
 	}
 }
+
+func TestOverlayFeatures(t *testing.T) {
+	paramDir, err := ioutil.TempDir("", "overlayparams")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(paramDir)
+	defer func(d string) { overlayParamDir = d }(overlayParamDir)
+	overlayParamDir = paramDir
+
+	tests := []struct {
+		name          string
+		redirectDir   string
+		metacopy      string
+		kernelDefault string // default of metacopy of the overlay module
+		dataOnly      bool
+		want          []string
+		wantErr       bool
+	}{
+		{name: "default"},
+		{name: "gate kernel default", kernelDefault: "Y", want: []string{"metacopy=off"}},
+		{name: "kernel default off", kernelDefault: "N"},
+		{name: "data-only", kernelDefault: "Y", dataOnly: true, want: []string{"metacopy=on"}},
+		{name: "explicit", redirectDir: "on", metacopy: "on", kernelDefault: "Y", want: []string{"metacopy=on", "redirect_dir=on"}},
+		{name: "conflict", redirectDir: "nofollow", metacopy: "on", wantErr: true},
+		{name: "unknown", metacopy: "yes", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(filepath.Join(paramDir, "metacopy"))
+			if tt.kernelDefault != "" {
+				if err := ioutil.WriteFile(filepath.Join(paramDir, "metacopy"), []byte(tt.kernelDefault+"\n"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var config SnapshotterConfig
+			if err := OverlayFeatures(tt.redirectDir, tt.metacopy)(&config); err != nil {
+				if !tt.wantErr {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			} else if tt.wantErr {
+				t.Fatalf("options must be rejected")
+			}
+			o := &snapshotter{redirectDir: config.redirectDir, metacopy: config.metacopy}
+			if got := o.overlayFeatures(tt.dataOnly); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("options = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestMergedLowerView tests remote lower layers are merged into a single
+// lowerdir.
+func TestMergedLowerView(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	fs := &mergedViewFs{FileSystem: bindFileSystem(t), dir: filepath.Join(root, "merged")}
+	sn, err := NewSnapshotter(context.TODO(), root, fs, MergedLowerView(2))
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+	defer sn.Close()
+
+	lower := prepareWithTarget(t, sn, "lower", "lowerKey", "", nil)
+	upper := prepareWithTarget(t, sn, "upper", "upperKey", lower, nil)
+	mounts, err := sn.Prepare(ctx, "rootfs", upper)
+	if err != nil {
+		t.Fatalf("failed to prepare rootfs: %v", err)
+	}
+	if want := "lowerdir=" + fs.dir; mounts[0].Options[len(mounts[0].Options)-1] != want {
+		t.Errorf("options = %v; want %q", mounts[0].Options, want)
+	}
+	if parents := getParents(ctx, sn, root, "rootfs"); !reflect.DeepEqual(fs.merged, parents) {
+		t.Errorf("merged layers = %v; want %v", fs.merged, parents)
+	}
+	mounts, err = sn.View(ctx, "view", upper)
+	if err != nil {
+		t.Fatalf("failed to view: %v", err)
+	}
+	if len(mounts) != 1 || mounts[0].Type != "bind" || mounts[0].Source != fs.dir {
+		t.Errorf("view must be a bind mount of the merged view: %+v", mounts)
+	}
+
+	// A single lower layer isn't merged.
+	fs.merged = nil
+	if _, err := sn.Prepare(ctx, "rootfs2", lower); err != nil {
+		t.Fatalf("failed to prepare rootfs: %v", err)
+	}
+	if fs.merged != nil {
+		t.Errorf("layers must not be merged: %v", fs.merged)
+	}
+}
+
+// TestGroupLowerdirs tests remote lower layers are grouped into merged views
+// when they exceed the limit of overlayfs.
+func TestGroupLowerdirs(t *testing.T) {
+	testutil.RequiresRoot(t)
+	defer func(n int) { overlayMaxLowerdirs = n }(overlayMaxLowerdirs)
+	overlayMaxLowerdirs = 2
+	ctx := context.TODO()
+	root, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	fs := &mergedViewFs{FileSystem: bindFileSystem(t), dir: filepath.Join(root, "merged")}
+	sn, err := NewSnapshotter(context.TODO(), root, fs)
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+	defer sn.Close()
+
+	// The lowest layer is a normal snapshot.
+	if _, err := sn.Prepare(ctx, "baseKey", ""); err != nil {
+		t.Fatalf("failed to prepare base: %v", err)
+	}
+	if err := sn.Commit(ctx, "base", "baseKey"); err != nil {
+		t.Fatalf("failed to commit base: %v", err)
+	}
+	lower := prepareWithTarget(t, sn, "lower", "lowerKey", "base", nil)
+	upper := prepareWithTarget(t, sn, "upper", "upperKey", lower, nil)
+	mounts, err := sn.Prepare(ctx, "rootfs", upper)
+	if err != nil {
+		t.Fatalf("failed to prepare rootfs: %v", err)
+	}
+	parents := getParents(ctx, sn, root, "rootfs")
+	if !reflect.DeepEqual(fs.merged, parents[:2]) || fs.lowest {
+		t.Errorf("merged layers = %v (lowest: %v); want %v", fs.merged, fs.lowest, parents[:2])
+	}
+	if want := "lowerdir=" + fs.dir + ":" + parents[2]; mounts[0].Options[len(mounts[0].Options)-1] != want {
+		t.Errorf("options = %v; want %q", mounts[0].Options, want)
+	}
+}
+
+type mergedViewFs struct {
+	FileSystem
+	dir    string
+	merged []string
+	lowest bool
+}
+
+func (fs *mergedViewFs) MergedView(ctx context.Context, mountpoints []string, lowest bool) (string, error) {
+	fs.merged, fs.lowest = mountpoints, lowest
+	return fs.dir, nil
+}
+
+// TestSnapshotLabeler tests labels provided by the filesystem are added to
+// remote snapshots.
+func TestSnapshotLabeler(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	fs := &labelerFs{FileSystem: bindFileSystem(t), labels: map[string]string{"foo": "bar"}}
+	sn, err := NewSnapshotter(context.TODO(), root, fs)
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+	defer sn.Close()
+
+	target := prepareWithTarget(t, sn, "testTarget", "/tmp/prepareTarget", "", nil)
+	info, err := sn.Stat(ctx, target)
+	if err != nil {
+		t.Fatalf("failed to stat remote snapshot: %v", err)
+	}
+	if v := info.Labels["foo"]; v != "bar" {
+		t.Errorf("label of remote snapshot = %q; want %q", v, "bar")
+	}
+	if _, ok := info.Labels[remoteLabel]; !ok {
+		t.Errorf("remote snapshot must be labeled as remote")
+	}
+}
+
+type labelerFs struct {
+	FileSystem
+	labels map[string]string
+}
+
+func (fs *labelerFs) SnapshotLabels(ctx context.Context, mountpoint string, labels map[string]string) map[string]string {
+	return fs.labels
+}
@@ -0,0 +1,155 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/pkg/errors"
+)
+
+// WrittenPath is a file written by a container into its upper directory.
+type WrittenPath struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+
+	// CopyUp is true if the file exists in a lower layer, which means the
+	// file was copied up from the image on write.
+	CopyUp bool `json:"copyUp"`
+}
+
+// WriteReport reports writes of a container on top of a lazily pulled image.
+// Heavy writes (especially copy-ups) indicate that the image should bake the
+// written files (e.g. caches generated on startup) because copying up a file
+// of a lazily pulled layer fetches the whole file.
+type WriteReport struct {
+	Key        string        `json:"key"`
+	Files      int           `json:"files"`
+	Size       int64         `json:"size"`
+	CopyUps    int           `json:"copyUps"`
+	CopyUpSize int64         `json:"copyUpSize"`
+	Top        []WrittenPath `json:"top"` // largest written files
+}
+
+// WriteReports scans upper directories of active snapshots (i.e. containers)
+// on top of remote snapshots and reports the top written files of each. Active
+// snapshots used for unpacking layers aren't reported.
+func (o *snapshotter) WriteReports(ctx context.Context, top int) ([]WriteReport, error) {
+	type target struct {
+		key     string
+		id      string
+		parents []string
+	}
+	var targets []target
+	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	err = storage.WalkInfo(ctx, func(ctx context.Context, info snapshots.Info) error {
+		if info.Kind != snapshots.KindActive || strings.Contains(info.Name, "/"+snapshots.UnpackKeyPrefix+"-") {
+			return nil
+		}
+		s, err := storage.GetSnapshot(ctx, info.Name)
+		if err != nil {
+			return errors.Wrapf(err, "failed to get snapshot %q", info.Name)
+		}
+		remote := false
+		for p := info.Parent; p != "" && !remote; {
+			_, pInfo, _, err := storage.GetInfo(ctx, p)
+			if err != nil {
+				return errors.Wrapf(err, "failed to get info of %q", p)
+			}
+			_, remote = pInfo.Labels[remoteLabel]
+			p = pInfo.Parent
+		}
+		if remote {
+			targets = append(targets, target{info.Name, s.ID, s.ParentIDs})
+		}
+		return nil
+	})
+	t.Rollback()
+	if err != nil {
+		return nil, err
+	}
+
+	res := []WriteReport{}
+	for _, tg := range targets {
+		var lowers []string
+		for _, id := range tg.parents {
+			lowers = append(lowers, o.upperPath(id))
+		}
+		r, err := scanWrites(o.upperPath(tg.id), lowers, top)
+		if err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to scan writes of %q", tg.key)
+			continue
+		}
+		r.Key = tg.key
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+// scanWrites walks the upper directory and reports regular files in it. A file
+// is regarded as copied up if one of lower directories has the same path.
+// Lower directories are ordered from the upper to the lower.
+func scanWrites(upper string, lowers []string, top int) (WriteReport, error) {
+	var r WriteReport
+	err := filepath.Walk(upper, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil // directories, whiteouts, symlinks, etc.
+		}
+		rel, err := filepath.Rel(upper, path)
+		if err != nil {
+			return err
+		}
+		wp := WrittenPath{Path: "/" + rel, Size: fi.Size()}
+		for _, l := range lowers {
+			if _, err := os.Lstat(filepath.Join(l, rel)); err == nil {
+				wp.CopyUp = true
+				break
+			}
+		}
+		r.Files++
+		r.Size += wp.Size
+		if wp.CopyUp {
+			r.CopyUps++
+			r.CopyUpSize += wp.Size
+		}
+		r.Top = append(r.Top, wp)
+		return nil
+	})
+	if err != nil {
+		return WriteReport{}, err
+	}
+	sort.Slice(r.Top, func(i, j int) bool {
+		return r.Top[i].Size > r.Top[j].Size
+	})
+	if top >= 0 && len(r.Top) > top {
+		r.Top = r.Top[:top]
+	}
+	return r, nil
+}
@@ -0,0 +1,67 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestScanWrites tests written files are reported with copy-ups.
+func TestScanWrites(t *testing.T) {
+	root, err := ioutil.TempDir("", "writes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	upper, lower := filepath.Join(root, "upper"), filepath.Join(root, "lower")
+	for path, size := range map[string]int{
+		"upper/etc/app.conf":    10,
+		"upper/var/cache/a.bin": 300,
+		"upper/tmp/b":           20,
+		"lower/etc/app.conf":    5,
+		"lower/usr/bin/app":     1000,
+	} {
+		p := filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("failed to create dir: %v", err)
+		}
+		if err := ioutil.WriteFile(p, make([]byte, size), 0644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+
+	r, err := scanWrites(upper, []string{lower}, 2)
+	if err != nil {
+		t.Fatalf("failed to scan writes: %v", err)
+	}
+	if r.Files != 3 || r.Size != 330 || r.CopyUps != 1 || r.CopyUpSize != 10 {
+		t.Errorf("unexpected report %+v", r)
+	}
+	if len(r.Top) != 2 || r.Top[0].Path != "/var/cache/a.bin" || r.Top[0].CopyUp || r.Top[1].Path != "/tmp/b" {
+		t.Errorf("unexpected top files %+v", r.Top)
+	}
+	r, err = scanWrites(upper, []string{lower}, -1)
+	if err != nil {
+		t.Fatalf("failed to scan writes: %v", err)
+	}
+	if len(r.Top) != 3 || r.Top[2].Path != "/etc/app.conf" || !r.Top[2].CopyUp {
+		t.Errorf("copy-up isn't detected %+v", r.Top)
+	}
+}
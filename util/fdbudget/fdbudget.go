@@ -0,0 +1,270 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package fdbudget accounts file descriptors held by long-lived objects (e.g.
+// cache files and FUSE connections) against a process-wide budget. When the
+// soft cap is exceeded, registered reclaimers are asked to close idle
+// descriptors.
+package fdbudget
+
+import (
+	"context"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// leakWarnPercent is the usage of RLIMIT_NOFILE where the leak detector
+	// reports the holders of descriptors.
+	leakWarnPercent = 80
+
+	// leakReportOwners is the number of top holders reported.
+	leakReportOwners = 5
+)
+
+// Reclaimer closes up to n idle descriptors and returns the number of closed
+// ones.
+type Reclaimer func(n int) int
+
+// Budget accounts descriptors by owners. The nil Budget accounts nothing.
+type Budget struct {
+	softCap int
+
+	mu         sync.Mutex
+	held       map[string]int
+	total      int
+	reclaimers []Reclaimer
+
+	reclaiming int32
+	reclaimed  int64
+	overCap    int64
+}
+
+// Stats is the statistics of descriptors.
+type Stats struct {
+	// Held is the number of descriptors accounted in the budget.
+	Held int `json:"held"`
+
+	// SoftCap is the soft cap of the budget. 0 means no cap.
+	SoftCap int `json:"softCap"`
+
+	// Process is the number of descriptors opened by the process. -1 if unknown.
+	Process int `json:"process"`
+
+	// Limit is the soft limit of RLIMIT_NOFILE of the process.
+	Limit uint64 `json:"limit"`
+
+	// OverCap is the number of times the soft cap was exceeded.
+	OverCap int64 `json:"overCap"`
+
+	// Reclaimed is the number of descriptors closed for the soft cap.
+	Reclaimed int64 `json:"reclaimed"`
+
+	// Owners is the holders of descriptors in descending order.
+	Owners []OwnerStats `json:"owners"`
+}
+
+// OwnerStats is the number of descriptors held by an owner.
+type OwnerStats struct {
+	Owner string `json:"owner"`
+	FDs   int    `json:"fds"`
+}
+
+// New returns a budget with the soft cap. 0 disables the cap and the budget
+// only accounts descriptors.
+func New(softCap int) *Budget {
+	return &Budget{
+		softCap: softCap,
+		held:    make(map[string]int),
+	}
+}
+
+// AddReclaimer registers the function called when the soft cap is exceeded.
+func (b *Budget) AddReclaimer(r Reclaimer) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.reclaimers = append(b.reclaimers, r)
+	b.mu.Unlock()
+}
+
+// Acquire accounts n descriptors opened by the owner. If this exceeds the soft
+// cap, reclaimers are called in background for closing the excess.
+func (b *Budget) Acquire(owner string, n int) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.held[owner] += n
+	b.total += n
+	excess := b.total - b.softCap
+	b.mu.Unlock()
+	if b.softCap > 0 && excess > 0 {
+		atomic.AddInt64(&b.overCap, 1)
+		if atomic.CompareAndSwapInt32(&b.reclaiming, 0, 1) {
+			// Reclaimers possibly take locks the caller holds.
+			go b.reclaim()
+		}
+	}
+}
+
+// Release accounts n descriptors closed by the owner.
+func (b *Budget) Release(owner string, n int) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	h, ok := b.held[owner]
+	if !ok {
+		return
+	}
+	if n > h {
+		n = h
+	}
+	if h == n {
+		delete(b.held, owner)
+	} else {
+		b.held[owner] = h - n
+	}
+	b.total -= n
+}
+
+func (b *Budget) reclaim() {
+	for {
+		reclaimed := b.reclaimOnce()
+		atomic.StoreInt32(&b.reclaiming, 0)
+		// Descriptors might be acquired during the reclamation.
+		if reclaimed == 0 || b.excess() <= 0 || !atomic.CompareAndSwapInt32(&b.reclaiming, 0, 1) {
+			return
+		}
+	}
+}
+
+func (b *Budget) reclaimOnce() (reclaimed int) {
+	b.mu.Lock()
+	reclaimers := append([]Reclaimer{}, b.reclaimers...)
+	b.mu.Unlock()
+	for _, r := range reclaimers {
+		excess := b.excess()
+		if excess <= 0 {
+			break
+		}
+		reclaimed += r(excess)
+	}
+	atomic.AddInt64(&b.reclaimed, int64(reclaimed))
+	return reclaimed
+}
+
+func (b *Budget) excess() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.total - b.softCap
+}
+
+// Stats returns the current statistics.
+func (b *Budget) Stats() Stats {
+	s := Stats{Process: processFDs(), Limit: fdLimit()}
+	if b == nil {
+		return s
+	}
+	b.mu.Lock()
+	for owner, n := range b.held {
+		s.Owners = append(s.Owners, OwnerStats{owner, n})
+	}
+	s.Held = b.total
+	b.mu.Unlock()
+	s.SoftCap = b.softCap
+	s.OverCap = atomic.LoadInt64(&b.overCap)
+	s.Reclaimed = atomic.LoadInt64(&b.reclaimed)
+	sort.Slice(s.Owners, func(i, j int) bool {
+		if s.Owners[i].FDs != s.Owners[j].FDs {
+			return s.Owners[i].FDs > s.Owners[j].FDs
+		}
+		return s.Owners[i].Owner < s.Owners[j].Owner
+	})
+	return s
+}
+
+// RunLeakDetector checks the descriptors of the process at the interval until
+// the context is done. When the process uses most of RLIMIT_NOFILE or the
+// descriptors not accounted in the budget keep growing, this logs the top
+// holders.
+func (b *Budget) RunLeakDetector(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var (
+		lastUnaccounted = -1
+		growth          int
+	)
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		s := b.Stats()
+		if s.Process < 0 {
+			continue
+		}
+		unaccounted := s.Process - s.Held
+		if lastUnaccounted >= 0 && unaccounted > lastUnaccounted {
+			growth++
+		} else {
+			growth = 0
+		}
+		lastUnaccounted = unaccounted
+		nearLimit := s.Limit > 0 && uint64(s.Process)*100 >= s.Limit*leakWarnPercent
+		if !nearLimit && growth < 3 {
+			continue
+		}
+		top := s.Owners
+		if len(top) > leakReportOwners {
+			top = top[:leakReportOwners]
+		}
+		log.G(ctx).WithField("process", s.Process).
+			WithField("limit", s.Limit).
+			WithField("held", s.Held).
+			WithField("unaccounted", unaccounted).
+			WithField("top", top).
+			Warn("too many file descriptors may be open; possible leak")
+		growth = 0
+	}
+}
+
+// processFDs returns the number of descriptors opened by the process.
+func processFDs() int {
+	fis, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(fis)
+}
+
+func fdLimit() uint64 {
+	var rlimit unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &rlimit); err != nil {
+		return 0
+	}
+	return rlimit.Cur
+}
@@ -0,0 +1,80 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fdbudget
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBudget(t *testing.T) {
+	b := New(0)
+	b.Acquire("layer-a", 1)
+	b.Acquire("layer-b", 3)
+	b.Acquire("layer-c", 1)
+	b.Release("layer-c", 1)
+	b.Release("layer-a", 2) // more than held
+	b.Release("unknown", 1)
+	s := b.Stats()
+	if s.Held != 3 {
+		t.Errorf("held = %d; want 3", s.Held)
+	}
+	if got := fmt.Sprint(s.Owners); got != "[{layer-b 3}]" {
+		t.Errorf("unexpected owners %v", got)
+	}
+	if s.Process <= 0 || s.Limit == 0 {
+		t.Errorf("descriptors of the process must be reported: %+v", s)
+	}
+	if s.OverCap != 0 {
+		t.Errorf("budget without cap must not be over cap: %+v", s)
+	}
+
+	// The nil budget accounts nothing.
+	var nb *Budget
+	nb.Acquire("layer-a", 1)
+	nb.Release("layer-a", 1)
+	nb.AddReclaimer(func(int) int { return 0 })
+	if s := nb.Stats(); s.Held != 0 || len(s.Owners) != 0 {
+		t.Errorf("nil budget must hold nothing: %+v", s)
+	}
+}
+
+func TestBudgetReclaim(t *testing.T) {
+	b := New(2)
+	done := make(chan int, 10)
+	b.AddReclaimer(func(n int) int {
+		b.Release("cache", n)
+		done <- n
+		return n
+	})
+	b.Acquire("fuse", 1)
+	b.Acquire("cache", 3)
+	if n := <-done; n != 2 {
+		t.Errorf("reclaimed %d; want 2", n)
+	}
+	var s Stats
+	for i := 0; i < 100; i++ {
+		if s = b.Stats(); s.Reclaimed == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s.Held != 2 || s.OverCap != 1 || s.Reclaimed != 2 {
+		t.Errorf("unexpected stats after reclamation: %+v", s)
+	}
+}
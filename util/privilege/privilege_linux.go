@@ -0,0 +1,320 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package privilege reduces privileges of the process by dropping
+// capabilities, switching credentials and filtering syscalls with seccomp.
+// Goroutines run on any thread so these are applied to all threads of the
+// process, not only to the calling one.
+package privilege
+
+import (
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	linuxCapabilityVersion3 = 0x20080522
+
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1
+	seccompRetAllow        = 0x7fff0000
+	seccompRetErrno        = 0x00050000
+
+	// x32SyscallBit is set in the numbers of syscalls of the x32 ABI on x86_64.
+	x32SyscallBit = 0x40000000
+
+	// seccompDataArchOffset and seccompDataNrOffset are offsets of the fields
+	// of struct seccomp_data.
+	seccompDataNrOffset   = 0
+	seccompDataArchOffset = 4
+)
+
+// auditArches is AUDIT_ARCH_* of the supported architectures.
+var auditArches = map[string]uint32{
+	"386":     0x40000003,
+	"amd64":   0xc000003e,
+	"arm":     0x40000028,
+	"arm64":   0xc00000b7,
+	"ppc64le": 0xc0000015,
+	"riscv64": 0xc00000f3,
+	"s390x":   0x80000016,
+}
+
+var capabilities = map[string]int{
+	"CAP_CHOWN":              unix.CAP_CHOWN,
+	"CAP_DAC_OVERRIDE":       unix.CAP_DAC_OVERRIDE,
+	"CAP_DAC_READ_SEARCH":    unix.CAP_DAC_READ_SEARCH,
+	"CAP_FOWNER":             unix.CAP_FOWNER,
+	"CAP_FSETID":             unix.CAP_FSETID,
+	"CAP_KILL":               unix.CAP_KILL,
+	"CAP_SETGID":             unix.CAP_SETGID,
+	"CAP_SETUID":             unix.CAP_SETUID,
+	"CAP_SETPCAP":            unix.CAP_SETPCAP,
+	"CAP_LINUX_IMMUTABLE":    unix.CAP_LINUX_IMMUTABLE,
+	"CAP_NET_BIND_SERVICE":   unix.CAP_NET_BIND_SERVICE,
+	"CAP_NET_BROADCAST":      unix.CAP_NET_BROADCAST,
+	"CAP_NET_ADMIN":          unix.CAP_NET_ADMIN,
+	"CAP_NET_RAW":            unix.CAP_NET_RAW,
+	"CAP_IPC_LOCK":           unix.CAP_IPC_LOCK,
+	"CAP_IPC_OWNER":          unix.CAP_IPC_OWNER,
+	"CAP_SYS_MODULE":         unix.CAP_SYS_MODULE,
+	"CAP_SYS_RAWIO":          unix.CAP_SYS_RAWIO,
+	"CAP_SYS_CHROOT":         unix.CAP_SYS_CHROOT,
+	"CAP_SYS_PTRACE":         unix.CAP_SYS_PTRACE,
+	"CAP_SYS_PACCT":          unix.CAP_SYS_PACCT,
+	"CAP_SYS_ADMIN":          unix.CAP_SYS_ADMIN,
+	"CAP_SYS_BOOT":           unix.CAP_SYS_BOOT,
+	"CAP_SYS_NICE":           unix.CAP_SYS_NICE,
+	"CAP_SYS_RESOURCE":       unix.CAP_SYS_RESOURCE,
+	"CAP_SYS_TIME":           unix.CAP_SYS_TIME,
+	"CAP_SYS_TTY_CONFIG":     unix.CAP_SYS_TTY_CONFIG,
+	"CAP_MKNOD":              unix.CAP_MKNOD,
+	"CAP_LEASE":              unix.CAP_LEASE,
+	"CAP_AUDIT_WRITE":        unix.CAP_AUDIT_WRITE,
+	"CAP_AUDIT_CONTROL":      unix.CAP_AUDIT_CONTROL,
+	"CAP_SETFCAP":            unix.CAP_SETFCAP,
+	"CAP_MAC_OVERRIDE":       unix.CAP_MAC_OVERRIDE,
+	"CAP_MAC_ADMIN":          unix.CAP_MAC_ADMIN,
+	"CAP_SYSLOG":             unix.CAP_SYSLOG,
+	"CAP_WAKE_ALARM":         unix.CAP_WAKE_ALARM,
+	"CAP_BLOCK_SUSPEND":      unix.CAP_BLOCK_SUSPEND,
+	"CAP_AUDIT_READ":         unix.CAP_AUDIT_READ,
+	"CAP_PERFMON":            unix.CAP_PERFMON,
+	"CAP_BPF":                unix.CAP_BPF,
+	"CAP_CHECKPOINT_RESTORE": unix.CAP_CHECKPOINT_RESTORE,
+}
+
+// syscalls is the syscalls which can be denied by DenySyscalls.
+var syscalls = map[string]uint32{
+	"acct":              unix.SYS_ACCT,
+	"add_key":           unix.SYS_ADD_KEY,
+	"adjtimex":          unix.SYS_ADJTIMEX,
+	"bpf":               unix.SYS_BPF,
+	"clock_adjtime":     unix.SYS_CLOCK_ADJTIME,
+	"clock_settime":     unix.SYS_CLOCK_SETTIME,
+	"delete_module":     unix.SYS_DELETE_MODULE,
+	"finit_module":      unix.SYS_FINIT_MODULE,
+	"init_module":       unix.SYS_INIT_MODULE,
+	"kexec_load":        unix.SYS_KEXEC_LOAD,
+	"keyctl":            unix.SYS_KEYCTL,
+	"lookup_dcookie":    unix.SYS_LOOKUP_DCOOKIE,
+	"move_pages":        unix.SYS_MOVE_PAGES,
+	"name_to_handle_at": unix.SYS_NAME_TO_HANDLE_AT,
+	"open_by_handle_at": unix.SYS_OPEN_BY_HANDLE_AT,
+	"perf_event_open":   unix.SYS_PERF_EVENT_OPEN,
+	"pivot_root":        unix.SYS_PIVOT_ROOT,
+	"process_vm_readv":  unix.SYS_PROCESS_VM_READV,
+	"process_vm_writev": unix.SYS_PROCESS_VM_WRITEV,
+	"ptrace":            unix.SYS_PTRACE,
+	"quotactl":          unix.SYS_QUOTACTL,
+	"reboot":            unix.SYS_REBOOT,
+	"request_key":       unix.SYS_REQUEST_KEY,
+	"setdomainname":     unix.SYS_SETDOMAINNAME,
+	"sethostname":       unix.SYS_SETHOSTNAME,
+	"settimeofday":      unix.SYS_SETTIMEOFDAY,
+	"swapoff":           unix.SYS_SWAPOFF,
+	"swapon":            unix.SYS_SWAPON,
+	"syslog":            unix.SYS_SYSLOG,
+	"userfaultfd":       unix.SYS_USERFAULTFD,
+	"vhangup":           unix.SYS_VHANGUP,
+}
+
+// DefaultDeniedSyscalls is syscalls which a daemon serving filesystems never
+// needs (e.g. loading kernel modules, tracing other processes and changing
+// the clock). These are the syscalls an attacker exploiting the daemon would
+// use to escalate to the node.
+var DefaultDeniedSyscalls = []string{
+	"acct", "add_key", "adjtimex", "bpf", "clock_adjtime", "clock_settime",
+	"delete_module", "finit_module", "init_module", "kexec_load", "keyctl",
+	"lookup_dcookie", "move_pages", "name_to_handle_at", "open_by_handle_at",
+	"perf_event_open", "pivot_root", "process_vm_readv", "process_vm_writev",
+	"ptrace", "quotactl", "reboot", "request_key", "setdomainname",
+	"sethostname", "settimeofday", "swapoff", "swapon", "syslog",
+	"userfaultfd", "vhangup",
+}
+
+// ParseCapabilities returns the numbers of the named capabilities (e.g.
+// "CAP_SYS_ADMIN"). Names are case-insensitive and the "CAP_" prefix is
+// optional.
+func ParseCapabilities(names []string) ([]int, error) {
+	var caps []int
+	for _, name := range names {
+		n := strings.ToUpper(name)
+		if !strings.HasPrefix(n, "CAP_") {
+			n = "CAP_" + n
+		}
+		c, ok := capabilities[n]
+		if !ok {
+			return nil, fmt.Errorf("unknown capability %q", name)
+		}
+		caps = append(caps, c)
+	}
+	return caps, nil
+}
+
+// Drop drops capabilities other than keep from all sets of all threads
+// including the bounding set, so executed programs can't regain them. nil keep
+// keeps all permitted capabilities. If uid or gid is non-zero, the credentials
+// are switched to them (with no supplementary groups) while keeping the kept
+// capabilities effective.
+//
+// This requires the binary built without cgo because threads created by C
+// code can't be updated.
+func Drop(keep []string, uid, gid int) error {
+	hdr := &unix.CapUserHeader{Version: linuxCapabilityVersion3}
+	data := &[2]unix.CapUserData{}
+	if err := unix.Capget(hdr, &data[0]); err != nil {
+		return errors.Wrap(err, "failed to get capabilities")
+	}
+	permitted := uint64(data[0].Permitted) | uint64(data[1].Permitted)<<32
+	mask := permitted
+	if keep != nil {
+		caps, err := ParseCapabilities(keep)
+		if err != nil {
+			return err
+		}
+		mask = 0
+		for _, c := range caps {
+			mask |= 1 << uint(c)
+		}
+		mask &= permitted
+	}
+
+	// The bounding set must be dropped first because this needs CAP_SETPCAP.
+	lastCap, err := lastCap()
+	if err != nil {
+		return err
+	}
+	for c := 0; c <= lastCap; c++ {
+		if mask&(1<<uint(c)) != 0 {
+			continue
+		}
+		if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_PRCTL, unix.PR_CAPBSET_DROP, uintptr(c), 0); errno != 0 {
+			if errno == syscall.ENOTSUP {
+				return fmt.Errorf("dropping capabilities requires the binary built with CGO_ENABLED=0")
+			}
+			return errors.Wrapf(errno, "failed to drop capability %d from the bounding set", c)
+		}
+	}
+
+	if uid != 0 || gid != 0 {
+		// Permitted capabilities survive the switch from root with
+		// PR_SET_KEEPCAPS. Effective ones are restored by capset below.
+		if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_PRCTL, unix.PR_SET_KEEPCAPS, 1, 0); errno != 0 {
+			return errors.Wrap(errno, "failed to keep capabilities")
+		}
+		// These are applied to all threads by the syscall package.
+		if err := syscall.Setgroups(nil); err != nil {
+			return errors.Wrap(err, "failed to clear supplementary groups")
+		}
+		if err := syscall.Setresgid(gid, gid, gid); err != nil {
+			return errors.Wrapf(err, "failed to switch to group %d", gid)
+		}
+		if err := syscall.Setresuid(uid, uid, uid); err != nil {
+			return errors.Wrapf(err, "failed to switch to user %d", uid)
+		}
+	}
+
+	data[0] = unix.CapUserData{Effective: uint32(mask), Permitted: uint32(mask)}
+	data[1] = unix.CapUserData{Effective: uint32(mask >> 32), Permitted: uint32(mask >> 32)}
+	if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_CAPSET,
+		uintptr(unsafe.Pointer(hdr)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return errors.Wrap(errno, "failed to set capabilities")
+	}
+	return nil
+}
+
+func lastCap() (int, error) {
+	b, err := ioutil.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to get the last capability")
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+// DenySyscalls installs a seccomp filter to all threads of the process, which
+// fails the named syscalls with EPERM. Syscalls of other ABIs (e.g. x32 and
+// 32-bit ABIs on 64-bit architectures) are denied as well. Installed filters
+// can't be removed.
+//
+// This requires CAP_SYS_ADMIN or no_new_privs set on the calling thread.
+func DenySyscalls(names []string) error {
+	var nrs []uint32
+	for _, name := range names {
+		nr, ok := syscalls[name]
+		if !ok {
+			return fmt.Errorf("unknown syscall %q", name)
+		}
+		nrs = append(nrs, nr)
+	}
+	filter, err := denyFilter(runtime.GOARCH, nrs)
+	if err != nil {
+		return err
+	}
+	prog := &unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	// With TSYNC, the ID of the thread which couldn't be synchronized is
+	// returned on failure.
+	tid, _, errno := unix.Syscall(unix.SYS_SECCOMP, seccompSetModeFilter, seccompFilterFlagTsync, uintptr(unsafe.Pointer(prog)))
+	if errno != 0 {
+		return errors.Wrap(errno, "failed to install seccomp filter")
+	} else if tid != 0 {
+		return fmt.Errorf("failed to install seccomp filter to thread %d", tid)
+	}
+	return nil
+}
+
+// denyFilter returns a seccomp BPF program which denies the syscalls nrs and
+// syscalls of ABIs other than arch's one.
+func denyFilter(arch string, nrs []uint32) ([]unix.SockFilter, error) {
+	auditArch, ok := auditArches[arch]
+	if !ok {
+		return nil, fmt.Errorf("seccomp isn't supported on %q", arch)
+	}
+	var checks []unix.SockFilter
+	if arch == "amd64" {
+		checks = append(checks, unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K, K: x32SyscallBit})
+	}
+	for _, nr := range nrs {
+		checks = append(checks, unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: nr})
+	}
+	if len(checks) > 255 {
+		return nil, fmt.Errorf("too many syscalls to deny (%d)", len(nrs))
+	}
+	for i := range checks {
+		// Jump over the remaining checks and the "allow" to the "deny".
+		checks[i].Jt = uint8(len(checks) - i)
+	}
+	deny := unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetErrno | uint32(unix.EPERM)}
+	filter := []unix.SockFilter{
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: seccompDataArchOffset},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: auditArch, Jt: 1},
+		deny,
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: seccompDataNrOffset},
+	}
+	filter = append(filter, checks...)
+	return append(filter,
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetAllow},
+		deny,
+	), nil
+}
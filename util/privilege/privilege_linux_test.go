@@ -0,0 +1,110 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package privilege
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseCapabilities(t *testing.T) {
+	caps, err := ParseCapabilities([]string{"CAP_SYS_ADMIN", "mknod", "cap_bpf"})
+	if err != nil {
+		t.Fatalf("failed to parse capabilities: %v", err)
+	}
+	want := []int{unix.CAP_SYS_ADMIN, unix.CAP_MKNOD, unix.CAP_BPF}
+	if len(caps) != len(want) {
+		t.Fatalf("got %v; want %v", caps, want)
+	}
+	for i := range want {
+		if caps[i] != want[i] {
+			t.Errorf("capability %d = %d; want %d", i, caps[i], want[i])
+		}
+	}
+	if _, err := ParseCapabilities([]string{"CAP_UNKNOWN"}); err == nil {
+		t.Errorf("unknown capability must be rejected")
+	}
+}
+
+func TestDenyFilter(t *testing.T) {
+	const arch = "amd64"
+	filter, err := denyFilter(arch, []uint32{unix.SYS_PTRACE, unix.SYS_KEXEC_LOAD})
+	if err != nil {
+		t.Fatalf("failed to build filter: %v", err)
+	}
+	denied := seccompRetErrno | uint32(unix.EPERM)
+	tests := []struct {
+		name string
+		arch uint32
+		nr   uint32
+		want uint32
+	}{
+		{"allowed", auditArches[arch], unix.SYS_READ, seccompRetAllow},
+		{"denied", auditArches[arch], unix.SYS_PTRACE, denied},
+		{"last denied", auditArches[arch], unix.SYS_KEXEC_LOAD, denied},
+		{"x32", auditArches[arch], x32SyscallBit | unix.SYS_READ, denied},
+		{"other arch", auditArches["386"], unix.SYS_READ, denied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := runFilter(t, filter, tt.arch, tt.nr); got != tt.want {
+				t.Errorf("filter returned %#x; want %#x", got, tt.want)
+			}
+		})
+	}
+	if _, err := denyFilter("mips", nil); err == nil {
+		t.Errorf("unsupported arch must be rejected")
+	}
+}
+
+// runFilter interprets the subset of classic BPF used by denyFilter.
+func runFilter(t *testing.T, filter []unix.SockFilter, arch, nr uint32) uint32 {
+	var a uint32
+	for pc := 0; pc < len(filter); pc++ {
+		ins := filter[pc]
+		switch ins.Code {
+		case unix.BPF_LD | unix.BPF_W | unix.BPF_ABS:
+			switch ins.K {
+			case seccompDataNrOffset:
+				a = nr
+			case seccompDataArchOffset:
+				a = arch
+			default:
+				t.Fatalf("unexpected load offset %d", ins.K)
+			}
+		case unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K:
+			if a == ins.K {
+				pc += int(ins.Jt)
+			} else {
+				pc += int(ins.Jf)
+			}
+		case unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K:
+			if a >= ins.K {
+				pc += int(ins.Jt)
+			} else {
+				pc += int(ins.Jf)
+			}
+		case unix.BPF_RET | unix.BPF_K:
+			return ins.K
+		default:
+			t.Fatalf("unexpected instruction %#x", ins.Code)
+		}
+	}
+	t.Fatalf("filter didn't return")
+	return 0
+}
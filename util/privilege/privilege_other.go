@@ -0,0 +1,40 @@
+//go:build !linux
+// +build !linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package privilege
+
+import "fmt"
+
+// DefaultDeniedSyscalls is empty because seccomp is Linux-only.
+var DefaultDeniedSyscalls []string
+
+func ParseCapabilities(names []string) ([]int, error) {
+	if len(names) > 0 {
+		return nil, fmt.Errorf("capabilities aren't supported on this platform")
+	}
+	return nil, nil
+}
+
+func Drop(keep []string, uid, gid int) error {
+	return fmt.Errorf("dropping privileges isn't supported on this platform")
+}
+
+func DenySyscalls(names []string) error {
+	return fmt.Errorf("seccomp isn't supported on this platform")
+}
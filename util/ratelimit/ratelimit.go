@@ -0,0 +1,310 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package ratelimit tracks rate limits that registries report in responses
+// (e.g. Docker Hub's RateLimit-Remaining header and 429 responses) so that
+// work that can wait is deferred until the limit is lifted.
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	headerLimit     = "RateLimit-Limit"
+	headerRemaining = "RateLimit-Remaining"
+	headerRetry     = "Retry-After"
+
+	// defaultRetryAfter is used when a 429 response doesn't have Retry-After.
+	defaultRetryAfter = time.Minute
+
+	maxRetries = 3
+)
+
+// Tracker tracks rate limits of registry hosts.
+type Tracker struct {
+	reserve int
+	hosts   map[string]*hostState
+	mu      sync.Mutex
+	now     func() time.Time
+}
+
+type hostState struct {
+	limit        int // -1 if unknown
+	remaining    int // -1 if unknown
+	window       time.Duration
+	observed     time.Time
+	retryAfter   time.Time
+	tooMany      int64
+	deferred     int64
+	deferredTime time.Duration
+}
+
+// HostStats is the rate limit status of a registry host.
+type HostStats struct {
+	Host string `json:"host"`
+
+	// Limit and Remaining are the latest values reported by the registry.
+	// -1 means the registry doesn't report them.
+	Limit     int   `json:"limit"`
+	Remaining int   `json:"remaining"`
+	WindowSec int64 `json:"windowSec,omitempty"`
+
+	// LimitedUntil is set while work for the host is deferred.
+	LimitedUntil *time.Time `json:"limitedUntil,omitempty"`
+
+	// TooManyRequests is the number of 429 responses.
+	TooManyRequests int64 `json:"tooManyRequests"`
+
+	// Deferred is the number of deferred works and DeferredSec is the total
+	// time they waited.
+	Deferred    int64   `json:"deferred"`
+	DeferredSec float64 `json:"deferredSec"`
+}
+
+// NewTracker returns a tracker. Work is deferred while a host reports that
+// only reserve or fewer requests remain in the current window, leaving them
+// to work which can't wait.
+func NewTracker(reserve int) *Tracker {
+	return &Tracker{
+		reserve: reserve,
+		hosts:   make(map[string]*hostState),
+		now:     time.Now,
+	}
+}
+
+// Observe records the rate limit reported by the response from the host.
+func (t *Tracker) Observe(host string, resp *http.Response) {
+	if t == nil || resp == nil {
+		return
+	}
+	limit, window, okLimit := parseQuota(resp.Header.Get(headerLimit))
+	remaining, rwindow, okRemaining := parseQuota(resp.Header.Get(headerRemaining))
+	tooMany := resp.StatusCode == http.StatusTooManyRequests
+	if !okLimit && !okRemaining && !tooMany {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	s := t.state(host)
+	if okLimit {
+		s.limit = limit
+	}
+	if okRemaining {
+		s.remaining = remaining
+		if rwindow > 0 {
+			window = rwindow
+		}
+	}
+	if window > 0 {
+		s.window = window
+	}
+	if okLimit || okRemaining {
+		s.observed = now
+	}
+	if tooMany {
+		s.tooMany++
+		s.retryAfter = now.Add(parseRetryAfter(resp.Header.Get(headerRetry), now))
+	}
+}
+
+// LimitedUntil returns the time until which work for the host should be
+// deferred. ok is false if the host isn't limited.
+func (t *Tracker) LimitedUntil(host string) (until time.Time, ok bool) {
+	if t == nil {
+		return time.Time{}, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.hosts[host]
+	if !ok {
+		return time.Time{}, false
+	}
+	return s.limitedUntil(t.now(), t.reserve)
+}
+
+// Wait waits until the host isn't limited or ctx is done.
+func (t *Tracker) Wait(ctx context.Context, host string) error {
+	until, ok := t.LimitedUntil(host)
+	if !ok {
+		return nil
+	}
+	start := t.now()
+	defer func() { t.recordDeferred(host, t.now().Sub(start)) }()
+	for ok {
+		timer := time.NewTimer(until.Sub(t.now()))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+		until, ok = t.LimitedUntil(host)
+	}
+	return nil
+}
+
+// Stats returns the rate limit status of the hosts sorted by the names.
+func (t *Tracker) Stats() []HostStats {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	res := make([]HostStats, 0, len(t.hosts))
+	for host, s := range t.hosts {
+		st := HostStats{
+			Host:            host,
+			Limit:           s.limit,
+			Remaining:       s.remaining,
+			WindowSec:       int64(s.window / time.Second),
+			TooManyRequests: s.tooMany,
+			Deferred:        s.deferred,
+			DeferredSec:     s.deferredTime.Seconds(),
+		}
+		if until, ok := s.limitedUntil(now, t.reserve); ok {
+			st.LimitedUntil = &until
+		}
+		res = append(res, st)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Host < res[j].Host })
+	return res
+}
+
+func (t *Tracker) recordDeferred(host string, d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	s := t.state(host)
+	s.deferred++
+	s.deferredTime += d
+	t.mu.Unlock()
+}
+
+// state returns the state of the host. t.mu must be held.
+func (t *Tracker) state(host string) *hostState {
+	s, ok := t.hosts[host]
+	if !ok {
+		s = &hostState{limit: -1, remaining: -1}
+		t.hosts[host] = s
+	}
+	return s
+}
+
+func (s *hostState) limitedUntil(now time.Time, reserve int) (until time.Time, ok bool) {
+	if now.Before(s.retryAfter) {
+		until, ok = s.retryAfter, true
+	}
+	if s.remaining >= 0 && s.remaining <= reserve && s.window > 0 {
+		// The quota is recovered by the end of the window at the latest.
+		if end := s.observed.Add(s.window); now.Before(end) && end.After(until) {
+			until, ok = end, true
+		}
+	}
+	return
+}
+
+// parseQuota parses the value of RateLimit-Limit and RateLimit-Remaining
+// headers (e.g. "100;w=21600").
+func parseQuota(v string) (n int, window time.Duration, ok bool) {
+	if v == "" {
+		return 0, 0, false
+	}
+	fields := strings.Split(v, ";")
+	n, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+	if err != nil || n < 0 {
+		return 0, 0, false
+	}
+	for _, f := range fields[1:] {
+		if kv := strings.SplitN(strings.TrimSpace(f), "=", 2); len(kv) == 2 && kv[0] == "w" {
+			if sec, err := strconv.ParseInt(kv[1], 10, 64); err == nil && sec > 0 {
+				window = time.Duration(sec) * time.Second
+			}
+		}
+	}
+	return n, window, true
+}
+
+// parseRetryAfter parses the value of Retry-After header, which is seconds or
+// an HTTP date.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if sec, err := strconv.ParseInt(v, 10, 64); err == nil && sec >= 0 {
+		return time.Duration(sec) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return defaultRetryAfter
+}
+
+// Transport is an http.RoundTripper which records rate limits reported by the
+// responses to the Tracker.
+type Transport struct {
+	Inner   http.RoundTripper
+	Tracker *Tracker
+
+	// Host is the registry host the rate limits are recorded for. Defaults to
+	// the host of the request. This needs to be specified if requests are
+	// redirected to other hosts (e.g. CDN of the registry).
+	Host string
+
+	// MaxRetryWait is the maximum time to wait for retrying requests rejected
+	// with 429. Requests with bodies aren't retried. Zero disables retries.
+	MaxRetryWait time.Duration
+}
+
+func (tr *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := tr.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	for i := 0; ; i++ {
+		resp, err := tr.Inner.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		tr.Tracker.Observe(host, resp)
+		if resp.StatusCode != http.StatusTooManyRequests || req.Body != nil || i >= maxRetries || tr.MaxRetryWait <= 0 {
+			return resp, nil
+		}
+		until, ok := tr.Tracker.LimitedUntil(host)
+		if !ok {
+			until = time.Now()
+		}
+		wait := time.Until(until)
+		if wait > tr.MaxRetryWait {
+			return resp, nil
+		}
+		resp.Body.Close()
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+		tr.Tracker.recordDeferred(host, wait)
+	}
+}
@@ -0,0 +1,125 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func response(code int, headers ...string) *http.Response {
+	resp := &http.Response{StatusCode: code, Header: make(http.Header)}
+	for i := 0; i+1 < len(headers); i += 2 {
+		resp.Header.Set(headers[i], headers[i+1])
+	}
+	return resp
+}
+
+func TestTracker(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	tr := NewTracker(10)
+	tr.now = func() time.Time { return now }
+	const host = "registry-1.docker.io"
+
+	tr.Observe(host, response(http.StatusOK, "RateLimit-Limit", "100;w=21600", "RateLimit-Remaining", "50;w=21600"))
+	if until, ok := tr.LimitedUntil(host); ok {
+		t.Errorf("limited until %v with enough remaining requests", until)
+	}
+
+	tr.Observe(host, response(http.StatusOK, "RateLimit-Remaining", "10;w=21600"))
+	until, ok := tr.LimitedUntil(host)
+	if want := now.Add(21600 * time.Second); !ok || !until.Equal(want) {
+		t.Errorf("limited until %v (%v); want %v", until, ok, want)
+	}
+
+	tr.Observe(host, response(http.StatusTooManyRequests, "Retry-After", "30"))
+	now = now.Add(21600 * time.Second)
+	if _, ok := tr.LimitedUntil(host); ok {
+		t.Errorf("must not be limited after the window")
+	}
+
+	tr.Observe(host, response(http.StatusTooManyRequests, "Retry-After", "30"))
+	until, ok = tr.LimitedUntil(host)
+	if want := now.Add(30 * time.Second); !ok || !until.Equal(want) {
+		t.Errorf("limited until %v (%v); want %v", until, ok, want)
+	}
+
+	stats := tr.Stats()
+	if len(stats) != 1 {
+		t.Fatalf("stats of %d hosts; want 1", len(stats))
+	}
+	if s := stats[0]; s.Host != host || s.Limit != 100 || s.Remaining != 10 || s.WindowSec != 21600 || s.TooManyRequests != 2 || s.LimitedUntil == nil {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestParseQuota(t *testing.T) {
+	for v, want := range map[string]struct {
+		n      int
+		window time.Duration
+		ok     bool
+	}{
+		"100;w=21600": {100, 6 * time.Hour, true},
+		"76":          {76, 0, true},
+		"5; w=60":     {5, time.Minute, true},
+		"":            {0, 0, false},
+		"abc;w=60":    {0, 0, false},
+		"-1":          {0, 0, false},
+	} {
+		n, window, ok := parseQuota(v)
+		if n != want.n || window != want.window || ok != want.ok {
+			t.Errorf("%q: got (%d, %v, %v); want %+v", v, n, window, ok, want)
+		}
+	}
+}
+
+func TestTransportRetry(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("RateLimit-Remaining", "5;w=60")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	tracker := NewTracker(1)
+	client := &http.Client{Transport: &Transport{
+		Inner:        http.DefaultTransport,
+		Tracker:      tracker,
+		Host:         "example.com",
+		MaxRetryWait: time.Second,
+	}}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || requests != 2 {
+		t.Errorf("got %d after %d requests; want 200 after 2 requests", resp.StatusCode, requests)
+	}
+	stats := tracker.Stats()
+	if len(stats) != 1 || stats[0].Host != "example.com" || stats[0].Remaining != 5 || stats[0].TooManyRequests != 1 || stats[0].Deferred != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
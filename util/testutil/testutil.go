@@ -17,15 +17,24 @@
 package testutil
 
 import (
+	"archive/tar"
+	"bytes"
 	"compress/gzip"
 	"context"
+	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/content/local"
 	"github.com/containerd/containerd/images/archive"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/nativeconverter"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
@@ -78,3 +87,202 @@ func EnsureHello(ctx context.Context) (*ocispec.Descriptor, content.Store, error
 	}
 	return &desc, cs, nil
 }
+
+// EStargzEntry is an entry of the layer written by WriteEStargz.
+type EStargzEntry struct {
+	Header   *tar.Header
+	Contents []byte
+}
+
+// WriteEStargz writes an eStargz layer of the entries into the content store.
+// Regular files are split into chunks of chunkSize bytes. The layer is built
+// without estargz.Writer so tests of consumers of eStargz layers don't depend
+// on it.
+func WriteEStargz(ctx context.Context, cs content.Store, entries []EStargzEntry, chunkSize int) (ocispec.Descriptor, error) {
+	var (
+		buf    bytes.Buffer
+		diffID = digest.Canonical.Digester()
+		zw     = gzip.NewWriter(&buf)
+		toc    = struct {
+			Version int                 `json:"version"`
+			Entries []*estargz.TOCEntry `json:"entries"`
+		}{Version: 1}
+	)
+	tw := tar.NewWriter(writerFunc(func(p []byte) (int, error) {
+		diffID.Hash().Write(p)
+		return zw.Write(p)
+	}))
+	// newMember starts a new gzip member and returns its offset.
+	newMember := func() (int64, error) {
+		if err := zw.Close(); err != nil {
+			return 0, err
+		}
+		zw.Reset(&buf)
+		return int64(buf.Len()), nil
+	}
+	types := map[byte]string{
+		tar.TypeReg: "reg", tar.TypeDir: "dir", tar.TypeSymlink: "symlink", tar.TypeLink: "hardlink",
+		tar.TypeChar: "char", tar.TypeBlock: "block", tar.TypeFifo: "fifo",
+	}
+	for _, ent := range entries {
+		h := *ent.Header
+		h.Size = int64(len(ent.Contents))
+		typ, ok := types[h.Typeflag]
+		if !ok {
+			return ocispec.Descriptor{}, errors.Errorf("unsupported type %q of %q", h.Typeflag, h.Name)
+		}
+		if err := tw.WriteHeader(&h); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		e := &estargz.TOCEntry{
+			Name:        h.Name,
+			Type:        typ,
+			Size:        h.Size,
+			LinkName:    h.Linkname,
+			Mode:        h.Mode,
+			UID:         h.Uid,
+			GID:         h.Gid,
+			ModTime3339: h.ModTime.UTC().Format(time.RFC3339),
+			DevMajor:    int(h.Devmajor),
+			DevMinor:    int(h.Devminor),
+			Digest:      digest.FromBytes(ent.Contents).String(),
+		}
+		for k, v := range h.PAXRecords {
+			if strings.HasPrefix(k, "SCHILY.xattr.") {
+				if e.Xattrs == nil {
+					e.Xattrs = make(map[string][]byte)
+				}
+				e.Xattrs[strings.TrimPrefix(k, "SCHILY.xattr.")] = []byte(v)
+			}
+		}
+		if typ != "reg" {
+			e.Digest = ""
+		}
+		toc.Entries = append(toc.Entries, e)
+		for off := 0; off < len(ent.Contents); off += chunkSize {
+			end := off + chunkSize
+			if end > len(ent.Contents) {
+				end = len(ent.Contents)
+			}
+			offset, err := newMember()
+			if err != nil {
+				return ocispec.Descriptor{}, err
+			}
+			if _, err := tw.Write(ent.Contents[off:end]); err != nil {
+				return ocispec.Descriptor{}, err
+			}
+			ce := e
+			if off > 0 {
+				ce = &estargz.TOCEntry{Name: h.Name, Type: "chunk"}
+				toc.Entries = append(toc.Entries, ce)
+			}
+			ce.Offset, ce.ChunkOffset = offset, int64(off)
+			if end-off < len(ent.Contents) {
+				ce.ChunkSize = int64(end - off)
+			}
+			ce.ChunkDigest = digest.FromBytes(ent.Contents[off:end]).String()
+		}
+	}
+	tocJSON, err := json.Marshal(&toc)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if err := tw.Flush(); err != nil { // padding of the last file
+		return ocispec.Descriptor{}, err
+	}
+	tocOff, err := newMember()
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: estargz.TOCTarName, Mode: 0444, Size: int64(len(tocJSON))}); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if _, err := tw.Write(tocJSON); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if err := tw.Close(); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if err := zw.Close(); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	buf.Write(eStargzFooter(tocOff))
+
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(buf.Bytes()),
+		Size:      int64(buf.Len()),
+		Annotations: map[string]string{
+			estargz.TOCJSONDigestAnnotation: digest.FromBytes(tocJSON).String(),
+		},
+	}
+	labels := map[string]string{nativeconverter.LabelUncompressed: diffID.Digest().String()}
+	if err := content.WriteBlob(ctx, cs, "test-estargz-"+desc.Digest.String(), bytes.NewReader(buf.Bytes()), desc, content.WithLabels(labels)); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+// eStargzFooter returns the footer of eStargz which is an empty gzip member
+// containing the TOC offset in the extra field.
+func eStargzFooter(tocOff int64) []byte {
+	subfield := fmt.Sprintf("%016xSTARGZ", tocOff)
+	p := []byte{0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 0xff} // gzip header with FEXTRA
+	p = append(p, byte(4+len(subfield)), 0, 'S', 'G', byte(len(subfield)), 0)
+	p = append(p, subfield...)
+	p = append(p, 1, 0, 0, 0xff, 0xff)       // empty stored block
+	return append(p, 0, 0, 0, 0, 0, 0, 0, 0) // CRC32 and ISIZE
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+// NewContentStore creates a content store in the directory. Unlike
+// local.NewStore, labels of contents are kept in memory.
+func NewContentStore(root string) (content.Store, error) {
+	return local.NewLabeledStore(root, &memoryLabelStore{labels: make(map[digest.Digest]map[string]string)})
+}
+
+type memoryLabelStore struct {
+	labels map[digest.Digest]map[string]string
+	mu     sync.Mutex
+}
+
+func (s *memoryLabelStore) Get(dgst digest.Digest) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return copyLabels(s.labels[dgst]), nil
+}
+
+func (s *memoryLabelStore) Set(dgst digest.Digest, labels map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.labels[dgst] = copyLabels(labels)
+	return nil
+}
+
+func (s *memoryLabelStore) Update(dgst digest.Digest, update map[string]string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	labels := copyLabels(s.labels[dgst])
+	for k, v := range update {
+		if v == "" {
+			delete(labels, k)
+		} else {
+			labels[k] = v
+		}
+	}
+	s.labels[dgst] = labels
+	return copyLabels(labels), nil
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	res := make(map[string]string, len(labels))
+	for k, v := range labels {
+		res[k] = v
+	}
+	return res
+}